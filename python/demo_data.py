@@ -0,0 +1,98 @@
+#!/usr/bin/env python3
+#
+# Write the small demo dataset used by simulate --demo to data/demo, by
+# taking the rows of the full input datasets for a few LSOAs in the north
+# of Camden, and the GP practices around them. The comments and preamble
+# at the head of each file are kept, so readers parse them in exactly the
+# same way as the full datasets, and sources remain attributed.
+#
+# Run from the root of the repository:
+#
+#   python3 python/demo_data.py
+
+import argparse
+import csv
+import gzip
+import os.path
+
+# Camden 001 and 002, around Highgate and Hampstead Heath
+LSOAS = {
+    "E01000893", "E01000894", "E01000895", "E01000896", "E01000899",
+    "E01000907", "E01000908", "E01000909", "E01000912", "E01000913",
+}
+
+PRACTICES = {
+    "F83003", "F83017", "F83020", "F83022", "F83023",
+    "F83057", "F83623", "F83633", "F83665", "F85014",
+}
+
+CONDITIONS = ["dm", "hyp", "copd", "af"]
+
+def subset(input, output, codes, column=None, header=None):
+    """Copy the lines of gzipped CSV input whose value in column is in
+    codes. Lines up to, and including, the first whose first field is
+    header are copied as they are. Column is either an index, or the name
+    of a column in the header."""
+    body = header is None
+    index = column if isinstance(column, int) else None
+    kept = 0
+    with gzip.open(input, "rt", newline="", encoding="utf-8-sig") as f, gzip.open(output, "wt", newline="", encoding="utf-8") as w:
+        for line in f:
+            if line.startswith("#"):
+                w.write(line)
+                continue
+            row = next(csv.reader([line]), [])
+            if not body:
+                w.write(line)
+                if len(row) > 0 and row[0] == header:
+                    body = True
+                    if index is None:
+                        index = row.index(column)
+                continue
+            if len(row) > index and row[index] in codes:
+                w.write(line)
+                kept += 1
+    print("%s: %d rows" % (output, kept))
+
+def subset_qof(input, output, codes):
+    """Copy the rows of a QOF condition table for the given practices,
+    keeping the spreadsheet preamble before the table's header."""
+    with gzip.open(input, "rt", newline="", encoding="utf-8-sig") as f:
+        lines = f.readlines()
+    index = None
+    kept = 0
+    with gzip.open(output, "wt", newline="", encoding="utf-8") as w:
+        for line in lines:
+            row = next(csv.reader([line]), [])
+            if index is None:
+                w.write(line)
+                if "Practice code" in row:
+                    index = row.index("Practice code")
+            elif len(row) > index and row[index] in codes:
+                w.write(line)
+                kept += 1
+    print("%s: %d rows" % (output, kept))
+
+def main():
+    parser = argparse.ArgumentParser()
+    parser.add_argument("--data", default="data", help="Directory containing the full datasets")
+    parser.add_argument("--output", default="data/demo", help="Directory to write the demo datasets")
+    flags = parser.parse_args()
+
+    os.makedirs(os.path.join(flags.output, "qof-condition"), exist_ok=True)
+    def paths(filename):
+        return os.path.join(flags.data, filename), os.path.join(flags.output, filename)
+
+    subset(*paths("lsoa-icb.csv.gz"), LSOAS, column="LSOA11CD", header="LSOA11CD")
+    for sex in ("persons", "males", "females"):
+        subset(*paths("lsoa-%s.csv.gz" % sex), LSOAS, column=0, header="LSOA Code")
+    subset(*paths("lsoa-msoa.csv.gz"), LSOAS, column="LSOA11CD", header="OA11CD")
+    subset(*paths("lsoa-imd.csv.gz"), LSOAS, column=0, header="LSOA code (2011)")
+    subset(*paths("gp-practices.csv.gz"), PRACTICES, column=0)
+    subset(*paths("gp-practioners.csv.gz"), PRACTICES, column=14)
+    subset(*paths("gp-practices-appointments-03-2023.csv.gz"), PRACTICES, column="GP_CODE", header="APPOINTMENT_MONTH_START_DATE")
+    for condition in CONDITIONS:
+        subset_qof(*paths("qof-condition/%s.csv.gz" % condition), PRACTICES)
+
+if __name__ == "__main__":
+    main()
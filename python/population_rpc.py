@@ -0,0 +1,75 @@
+#!/usr/bin/env python3
+#
+# A client for the population simulation's JSON-RPC bridge, allowing
+# scenarios to be run, and their results queried, from notebooks. The
+# simulation is started once, as a subprocess, with rpc, and keeps the
+# world and input data loaded between runs.
+#
+# For example:
+#
+#   from population_rpc import Population
+#   with Population(["--world=world/codepoint-open-2023-02.index,world/lsoa-2011.index"]) as p:
+#       run = p.run(Scenario="move-phlebotomy", ScenarioFilename="data/scenarios/move-phlebotomy.yaml", OutputDirectory="output/move-phlebotomy")
+#       print(p.query(run["OutputDirectory"], MSOAs=["E02000566"], Age="65-79", Conditions=["dm"]))
+#
+# Only the standard library is needed.
+
+import itertools
+import json
+import subprocess
+
+DEFAULT_BINARY = "bin/population"
+
+class RPCError(Exception):
+    pass
+
+class Population:
+
+    def __init__(self, flags=(), binary=DEFAULT_BINARY, cwd=None):
+        """Start the simulation, with flags giving the defaults for each run.
+        Logs are left on stderr."""
+        self.process = subprocess.Popen([binary, "rpc"] + list(flags), stdin=subprocess.PIPE, stdout=subprocess.PIPE, cwd=cwd, text=True)
+        self.ids = itertools.count(1)
+
+    def call(self, method, params):
+        id = next(self.ids)
+        self.process.stdin.write(json.dumps({"method": "Population." + method, "params": [params], "id": id}) + "\n")
+        self.process.stdin.flush()
+        line = self.process.stdout.readline()
+        if not line:
+            raise RPCError("simulation exited, see its log for details")
+        response = json.loads(line)
+        if response.get("id") != id:
+            raise RPCError("unexpected response id %s, expected %d" % (response.get("id"), id))
+        if response.get("error"):
+            raise RPCError(response["error"])
+        return response["result"]
+
+    def run(self, **options):
+        """Simulate the population, overriding the default flags with
+        options, which are the fields of RunArgs, eg OutputDirectory,
+        Scenario, ScenarioFilename, Profile, Buffer, ConditionModel,
+        AggregatePopulation, SmokingFilename, BMIFilename and
+        AdmissionsFilename. Returns the output directory, and the manifest
+        describing the outputs."""
+        return self.call("Run", options)
+
+    def query(self, output_directory, **filters):
+        """Return the number of people in the population written to
+        output_directory matching filters, and the count and prevalence of
+        conditions among them. Filters are the fields of PopulationQuery:
+        MSOAs, LSOAs, GPs, Sexes and Conditions, each a list, and Age, a
+        single age, or a range like 65-79."""
+        params = dict(filters)
+        params["OutputDirectory"] = output_directory
+        return self.call("Query", params)
+
+    def close(self):
+        self.process.stdin.close()
+        self.process.wait()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
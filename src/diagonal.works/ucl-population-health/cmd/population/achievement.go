@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// IndicatorAchievement is the simulated achievement of a practice against
+// a QOF indicator.
+type IndicatorAchievement struct {
+	Practice  GPPracticeCode
+	Indicator *QOFIndicator
+	// Registered patients with the indicator's condition, within its ages
+	Eligible int
+	// Eligible patients removed from the denominator by personalised care
+	// adjustments
+	PCAs        int
+	Denominator int
+	// Patients in the denominator whose last measurement meets the
+	// indicator
+	Numerator int
+}
+
+// Achievement returns the numerator as a proportion of the denominator,
+// or NaN if the denominator is empty.
+func (a *IndicatorAchievement) Achievement() float64 {
+	if a.Denominator > 0 {
+		return float64(a.Numerator) / float64(a.Denominator)
+	}
+	return math.NaN()
+}
+
+// simulateAchievement assesses the patients of each selected practice
+// against each indicator of the model, using their simulated measurements,
+// ordered by practice, then indicator. Patients without a measurement are
+// included in the denominator, but not the numerator, as in QOF.
+func simulateAchievement(selected GPPracticeCodeSet, byPractice map[GPPracticeCode][]*Person, model *MeasurementModel) []*IndicatorAchievement {
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	achievements := make([]*IndicatorAchievement, 0, len(codes)*len(model.Indicators))
+	totals := make([]IndicatorAchievement, len(model.Indicators))
+	for _, code := range codes {
+		for i, indicator := range model.Indicators {
+			a := &IndicatorAchievement{Practice: code, Indicator: indicator}
+			condition := model.distributions[indicator.measurement].condition
+			for _, p := range byPractice[code] {
+				if !p.Conditions.Contains(condition) || !indicator.Ages.Contains(p.Age) {
+					continue
+				}
+				a.Eligible++
+				if rng.Float64() < indicator.PCAs {
+					a.PCAs++
+					continue
+				}
+				a.Denominator++
+				if value := p.Measurements[indicator.measurement]; value > 0.0 && float64(value) <= indicator.Max {
+					a.Numerator++
+				}
+			}
+			achievements = append(achievements, a)
+			totals[i].Denominator += a.Denominator
+			totals[i].Numerator += a.Numerator
+		}
+	}
+	for i, indicator := range model.Indicators {
+		log.Printf("  %s: %d/%d: %.01f%%", indicator.Code, totals[i].Numerator, totals[i].Denominator, 100.0*totals[i].Achievement())
+	}
+	return achievements
+}
+
+// writeQOFAchievement writes qof-achievement.csv, with the simulated
+// achievement of each practice in long form, with a row for each
+// practice, indicator and measure, following the achievement extracts
+// published for QOF, so that it can be used to test pipelines that read
+// them.
+func writeQOFAchievement(achievements []*IndicatorAchievement, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "qof-achievement.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"PRACTICE_CODE", "INDICATOR_CODE", "MEASURE", "VALUE"})
+	for _, a := range achievements {
+		measures := []struct {
+			Name  string
+			Value int
+		}{
+			{"NUMERATOR", a.Numerator},
+			{"DENOMINATOR", a.Denominator},
+			{"PCAS", a.PCAs},
+		}
+		for _, m := range measures {
+			w.Write([]string{a.Practice.String(), a.Indicator.Code, m.Name, strconv.Itoa(m.Value)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+type AdmissionType int
+
+const (
+	AdmissionElective AdmissionType = iota
+	AdmissionEmergency
+
+	AdmissionTypeLast = AdmissionEmergency
+)
+
+func (a AdmissionType) String() string {
+	switch a {
+	case AdmissionElective:
+		return "elective"
+	case AdmissionEmergency:
+		return "emergency"
+	}
+	return "invalid"
+}
+
+func AdmissionTypes() []AdmissionType {
+	return []AdmissionType{AdmissionElective, AdmissionEmergency}
+}
+
+type AdmissionRates struct {
+	ByAge AgePrevalences `yaml:"byage"`
+	// Multipliers by IMD decile, with index 0 being the most deprived
+	IMD        []float64
+	Conditions map[string]float64
+	// Mean bed days per admission, counting day cases as 0, used to
+	// estimate bed demand
+	LengthOfStay float64 `yaml:"lengthofstay"`
+}
+
+func (a *AdmissionRates) Rate(p *Person, lsoas map[LSOACode]*LSOA) float64 {
+	rate := a.ByAge.Prevalence(p.Sex, p.Age)
+	if decile := lsoas[p.Home].IMDDecile; decile > 0 && decile <= len(a.IMD) {
+		rate *= a.IMD[decile-1]
+	}
+	for _, c := range AllQOFConditions() {
+		if p.Conditions.Contains(c) {
+			if m, ok := a.Conditions[c.String()]; ok {
+				rate *= m
+			}
+		}
+	}
+	return rate
+}
+
+type AdmissionModel struct {
+	Elective  AdmissionRates
+	Emergency AdmissionRates
+}
+
+func (a *AdmissionModel) Rates(t AdmissionType) *AdmissionRates {
+	if t == AdmissionElective {
+		return &a.Elective
+	}
+	return &a.Emergency
+}
+
+func readAdmissionModel(filename string) (*AdmissionModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open admission rates: %s", err)
+	}
+	defer f.Close()
+	var model AdmissionModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read admission rates: %s", err)
+	}
+	for _, t := range AdmissionTypes() {
+		rates := model.Rates(t)
+		if len(rates.ByAge) == 0 {
+			return nil, fmt.Errorf("no %s admission rates by age", t)
+		}
+		if len(rates.IMD) != 0 && len(rates.IMD) != 10 {
+			return nil, fmt.Errorf("expected 10 %s admission imd multipliers, found %d", t, len(rates.IMD))
+		}
+		for c := range rates.Conditions {
+			if QOFConditionFromString(c) == QOFConditionInvalid {
+				return nil, fmt.Errorf("unknown condition %q in %s admission rates", c, t)
+			}
+		}
+	}
+	return &model, nil
+}
+
+// Admissions holds the expected and sampled number of hospital admissions
+// for a person over a year.
+type Admissions struct {
+	Expected [AdmissionTypeLast + 1]float64
+	Sampled  [AdmissionTypeLast + 1]int
+}
+
+// samplePoisson uses Knuth's method, which is efficient for the small
+// rates we expect here.
+func samplePoisson(lambda float64, rng *rand.Rand) int {
+	l := math.Exp(-lambda)
+	k := 0
+	p := rng.Float64()
+	for p > l {
+		k++
+		p *= rng.Float64()
+	}
+	return k
+}
+
+func assignAdmissions(people []Person, model *AdmissionModel, lsoas map[LSOACode]*LSOA) {
+	var expected [AdmissionTypeLast + 1]float64
+	var sampled [AdmissionTypeLast + 1]int
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := range people {
+		p := &people[i]
+		for _, t := range AdmissionTypes() {
+			p.Admissions.Expected[t] = model.Rates(t).Rate(p, lsoas)
+			p.Admissions.Sampled[t] = samplePoisson(p.Admissions.Expected[t], rng)
+			expected[t] += p.Admissions.Expected[t]
+			sampled[t] += p.Admissions.Sampled[t]
+		}
+	}
+	for _, t := range AdmissionTypes() {
+		log.Printf("  %s: expected: %.0f sampled: %d", t, expected[t], sampled[t])
+	}
+}
+
+func AdmissionsHeaderRow() []string {
+	row := make([]string, 0, 2*len(AdmissionTypes()))
+	for _, t := range AdmissionTypes() {
+		row = append(row, fmt.Sprintf("expected_admissions_%s", t))
+	}
+	for _, t := range AdmissionTypes() {
+		row = append(row, fmt.Sprintf("admissions_%s", t))
+	}
+	return row
+}
+
+func (a *Admissions) ToRow() []string {
+	row := make([]string, 0, 2*len(AdmissionTypes()))
+	for _, t := range AdmissionTypes() {
+		row = append(row, fmt.Sprintf("%f", a.Expected[t]))
+	}
+	for _, t := range AdmissionTypes() {
+		row = append(row, strconv.Itoa(a.Sampled[t]))
+	}
+	return row
+}
+
+// writeAdmissionsByMSOA writes admissions for people living in homes,
+// aggregated by the MSOA of their home.
+func writeAdmissionsByMSOA(people []Person, homes LSOASet, lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, outputDirectory string) error {
+	type msoaAdmissions struct {
+		People     int
+		Admissions Admissions
+	}
+	byMSOA := make(map[MSOACode]*msoaAdmissions)
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		code := lsoas[p.Home].MSOACode
+		a, ok := byMSOA[code]
+		if !ok {
+			a = &msoaAdmissions{}
+			byMSOA[code] = a
+		}
+		a.People++
+		for _, t := range AdmissionTypes() {
+			a.Admissions.Expected[t] += p.Admissions.Expected[t]
+			a.Admissions.Sampled[t] += p.Admissions.Sampled[t]
+		}
+	}
+	codes := make([]MSOACode, 0, len(byMSOA))
+	for code := range byMSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "admissions-msoa.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"msoa", "name", "people"}, AdmissionsHeaderRow()...))
+	for _, code := range codes {
+		name := ""
+		if msoa, ok := msoas[code]; ok {
+			name = msoa.Name
+		}
+		row := []string{code.String(), name, strconv.Itoa(byMSOA[code].People)}
+		w.Write(append(row, byMSOA[code].Admissions.ToRow()...))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AgeBands partitions ages into contiguous bands, with the last open ended
+type AgeBands struct {
+	Name        string
+	Description string
+	// The first age in each band, in ascending order, beginning at 0
+	Begins []int
+}
+
+var AgeBandSchemes = []*AgeBands{
+	{
+		Name:        "decade",
+		Description: "10 year bands, with 90 and over together",
+		Begins:      []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90},
+	},
+	{
+		Name:        "ons",
+		Description: "ONS 5 year bands, with 90 and over together",
+		Begins:      []int{0, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60, 65, 70, 75, 80, 85, 90},
+	},
+	{
+		Name:        "qof",
+		Description: "The bands used for practice list sizes in QOF publications",
+		Begins:      []int{0, 5, 15, 45, 65, 75, 85},
+	},
+}
+
+// AgeBandsFromString returns the named scheme from AgeBandSchemes, or, for
+// comma separated ages, like 0,18,65, bands beginning at each.
+func AgeBandsFromString(s string) (*AgeBands, error) {
+	if strings.Contains(s, ",") {
+		return ageBandsFromBegins(s)
+	}
+	names := make([]string, 0, len(AgeBandSchemes))
+	for _, a := range AgeBandSchemes {
+		if a.Name == s {
+			return a, nil
+		}
+		names = append(names, a.Name)
+	}
+	return nil, fmt.Errorf("unknown age bands %q, expected one of %s, or comma separated ages at which each band begins", s, strings.Join(names, ", "))
+}
+
+func ageBandsFromBegins(s string) (*AgeBands, error) {
+	bands := &AgeBands{Name: s}
+	for _, b := range strings.Split(s, ",") {
+		begin, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("bad age band %q", b)
+		}
+		if n := len(bands.Begins); n > 0 && begin <= bands.Begins[n-1] {
+			return nil, fmt.Errorf("age bands must increase, but %d follows %d", begin, bands.Begins[n-1])
+		}
+		bands.Begins = append(bands.Begins, begin)
+	}
+	if bands.Begins[0] != 0 {
+		return nil, fmt.Errorf("age bands must begin at 0, found %d", bands.Begins[0])
+	}
+	parts := make([]string, len(bands.Begins))
+	for i := range bands.Begins {
+		parts[i] = bands.Label(i)
+	}
+	bands.Description = strings.Join(parts, ", ")
+	return bands, nil
+}
+
+// SingleYearAgeBands returns a band for each year of age, with people
+// aged max and over together.
+func SingleYearAgeBands(max int) *AgeBands {
+	bands := &AgeBands{Name: "single-year", Description: fmt.Sprintf("Single years of age, with %d and over together", max)}
+	for age := 0; age <= max; age++ {
+		bands.Begins = append(bands.Begins, age)
+	}
+	return bands
+}
+
+// Band returns the index of the band containing age
+func (a *AgeBands) Band(age int) int {
+	return sort.Search(len(a.Begins), func(i int) bool { return a.Begins[i] > age }) - 1
+}
+
+func (a *AgeBands) Range(band int) AgeRange {
+	r := AgeRange{Begin: a.Begins[band]}
+	if band+1 < len(a.Begins) {
+		r.End = a.Begins[band+1]
+	}
+	return r
+}
+
+func (a *AgeBands) Label(band int) string {
+	r := a.Range(band)
+	if r.End == 0 {
+		return fmt.Sprintf("%d+", r.Begin)
+	}
+	return fmt.Sprintf("%d-%d", r.Begin, r.End-1)
+}
+
+// GroupByAgeBands groups people by the band containing their age, with
+// groups identified by the first age in the band.
+func GroupByAgeBands(key string, bands *AgeBands) *GroupBy {
+	values := make([]string, len(bands.Begins))
+	for i, begin := range bands.Begins {
+		values[i] = strconv.Itoa(begin)
+	}
+	return &GroupBy{
+		Key:   key,
+		Fixed: values,
+		Group: func(p *Person) (string, bool) {
+			return values[bands.Band(p.Age)], true
+		},
+	}
+}
+
+// Rebanded returns prevalences with a range for each of the given bands,
+// averaging the prevalence for each single year of age in a band, weighted
+// by the number of people of that sex and age, indexed by sex, then age.
+// Bands without people use an unweighted average, with the last band
+// ending at LSOADataMaxAge.
+func (a AgePrevalences) Rebanded(bands *AgeBands, weights [][]int) AgePrevalences {
+	rebanded := make(AgePrevalences, len(AllSexes()))
+	for _, sex := range AllSexes() {
+		for band := range bands.Begins {
+			r := bands.Range(band)
+			end := r.End
+			if end == 0 {
+				end = LSOADataMaxAge + 1
+			}
+			total, n := 0.0, 0.0
+			uniform, ages := 0.0, 0.0
+			for age := r.Begin; age < end; age++ {
+				p := a.Prevalence(sex, age)
+				w := 0.0
+				if int(sex) < len(weights) && age < len(weights[sex]) {
+					w = float64(weights[sex][age])
+				}
+				total += p * w
+				n += w
+				uniform += p
+				ages++
+			}
+			prevalence := uniform / ages
+			if n > 0.0 {
+				prevalence = total / n
+			}
+			rebanded[sex] = append(rebanded[sex], AgePrevalence{Ages: r, Prevalence: prevalence})
+		}
+	}
+	return rebanded
+}
+
+// writePrevalenceByAgeBand compares the input prevalence of each condition
+// with that simulated, for each sex and age band, for people living in
+// homes. Input prevalences are rebanded, weighted by the simulated
+// population, and left empty for conditions only rolled up from their
+// sub-conditions, without a prevalence of their own.
+func writePrevalenceByAgeBand(people []Person, homes LSOASet, conditions []QOFCondition, prevalences AllPrevalences, bands *AgeBands, outputDirectory string) error {
+	weights := make([][]int, len(AllSexes()))
+	for sex := range weights {
+		weights[sex] = make([]int, LSOADataMaxAge+1)
+	}
+	counts := make(map[QOFCondition][][]int)
+	for _, condition := range conditions {
+		counts[condition] = make([][]int, len(AllSexes()))
+		for sex := range counts[condition] {
+			counts[condition][sex] = make([]int, len(bands.Begins))
+		}
+	}
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		age := p.Age
+		if age > LSOADataMaxAge {
+			age = LSOADataMaxAge
+		}
+		weights[p.Sex][age]++
+		for _, condition := range conditions {
+			if p.Conditions.Contains(condition) {
+				counts[condition][p.Sex][bands.Band(p.Age)]++
+			}
+		}
+	}
+
+	f, err := createOutput(filepath.Join(outputDirectory, "prevalence-age.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"condition", "sex", "age_band", "people", "input_prevalence", "simulated_prevalence"})
+	for _, condition := range conditions {
+		given, ok := prevalences[OneCondition(condition)]
+		input := given.ByAge.Rebanded(bands, weights)
+		for _, sex := range sexesOf(people) {
+			for band := range bands.Begins {
+				r := bands.Range(band)
+				n := 0
+				for age := r.Begin; age <= LSOADataMaxAge && (r.End == 0 || age < r.End); age++ {
+					n += weights[sex][age]
+				}
+				simulated := ""
+				if n > 0 {
+					simulated = fmt.Sprintf("%f", float64(counts[condition][sex][band])/float64(n))
+				}
+				prevalence := ""
+				if ok {
+					prevalence = fmt.Sprintf("%f", input[sex][band].Prevalence)
+				}
+				w.Write([]string{condition.String(), sex.String(), bands.Label(band), strconv.Itoa(n), prevalence, simulated})
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
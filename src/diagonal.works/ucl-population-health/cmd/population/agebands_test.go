@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAgeBandsFromString(t *testing.T) {
+	tests := []struct {
+		s      string
+		begins []int
+		valid  bool
+	}{
+		{"decade", []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90}, true},
+		{"qof", []int{0, 5, 15, 45, 65, 75, 85}, true},
+		{"0,18,65,85", []int{0, 18, 65, 85}, true},
+		{"0, 16", []int{0, 16}, true},
+		{"decades", nil, false},
+		// Bands must begin at 0, so every age is covered
+		{"18,65", nil, false},
+		{"0,65,18", nil, false},
+		{"0,18,18", nil, false},
+		{"0,x", nil, false},
+	}
+	for _, test := range tests {
+		bands, err := AgeBandsFromString(test.s)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%q: expected no error, found %s", test.s, err)
+			} else if !reflect.DeepEqual(bands.Begins, test.begins) {
+				t.Errorf("%q: expected %v, found %v", test.s, test.begins, bands.Begins)
+			}
+		} else if err == nil {
+			t.Errorf("%q: expected an error", test.s)
+		}
+	}
+}
+
+func TestAgeBandsBandAndLabel(t *testing.T) {
+	bands, err := AgeBandsFromString("0,18,65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		age   int
+		band  int
+		label string
+	}{
+		{0, 0, "0-17"},
+		{17, 0, "0-17"},
+		{18, 1, "18-64"},
+		{65, 2, "65+"},
+		{110, 2, "65+"},
+	}
+	for _, test := range tests {
+		band := bands.Band(test.age)
+		if band != test.band {
+			t.Errorf("expected band %d for age %d, found %d", test.band, test.age, band)
+		} else if label := bands.Label(band); label != test.label {
+			t.Errorf("expected label %s for age %d, found %s", test.label, test.age, label)
+		}
+	}
+	if bands.Description != "0-17, 18-64, 65+" {
+		t.Errorf("unexpected description %q", bands.Description)
+	}
+}
+
+func TestSingleYearAgeBands(t *testing.T) {
+	g := GroupByAgeBands("single_year_age", SingleYearAgeBands(99))
+	if len(g.Fixed) != 100 {
+		t.Fatalf("expected 100 groups, found %d", len(g.Fixed))
+	}
+	for _, age := range []int{0, 42, 99} {
+		if v, _ := g.Group(&Person{Age: age}); v != g.Fixed[age] {
+			t.Errorf("expected group %s for age %d, found %s", g.Fixed[age], age, v)
+		}
+	}
+	if v, _ := g.Group(&Person{Age: 104}); v != "99" {
+		t.Errorf("expected people over 99 to be grouped with 99, found %s", v)
+	}
+}
+
+func TestCountUnregisteredByAgeBand(t *testing.T) {
+	bands, err := AgeBandsFromString("0,18,65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	homes := LSOASet{"E01000001": struct{}{}}
+	people := []Person{
+		{Age: 10, Home: "E01000001", GP: "G1"},
+		{Age: 30, Home: "E01000001", GP: GPPracticeCodeInvalid},
+		{Age: 40, Home: "E01000001", GP: "G1"},
+		{Age: 70, Home: "E01000001", GP: GPPracticeCodeInvalid},
+		// Outside homes
+		{Age: 70, Home: "E01000002", GP: GPPracticeCodeInvalid},
+	}
+	u := countUnregistered(people, homes, bands)
+	expected := []UnregisteredCount{{Residents: 1}, {Residents: 2, Unregistered: 1}, {Residents: 1, Unregistered: 1}}
+	if !reflect.DeepEqual(u.ByAge, expected) {
+		t.Errorf("expected %v, found %v", expected, u.ByAge)
+	}
+}
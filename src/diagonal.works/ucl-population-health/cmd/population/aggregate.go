@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A Filter returns true if a person should enter an aggregate
+type Filter func(p *Person) bool
+
+// FilterRegisteredWith includes people registered with one of the given
+// practices.
+func FilterRegisteredWith(practices GPPracticeCodeSet) Filter {
+	return func(p *Person) bool {
+		_, ok := practices[p.GP]
+		return ok
+	}
+}
+
+// FilterResidentIn includes people whose home is in one of the given LSOAs,
+// whether or not they're registered with a practice there.
+func FilterResidentIn(homes LSOASet) Filter {
+	return func(p *Person) bool {
+		_, ok := homes[p.Home]
+		return ok
+	}
+}
+
+// AggregatePopulation describes a rule for which people enter aggregates
+type AggregatePopulation int
+
+const (
+	// People registered with a practice in the ICB, wherever they live
+	AggregatePopulationRegistered AggregatePopulation = iota
+	// People living in the ICB, wherever they're registered
+	AggregatePopulationResident
+)
+
+func (a AggregatePopulation) String() string {
+	switch a {
+	case AggregatePopulationRegistered:
+		return "registered"
+	case AggregatePopulationResident:
+		return "resident"
+	}
+	return "invalid"
+}
+
+// AggregatePopulationsFromString returns the populations for a flag value,
+// with both returning each, to be reported separately.
+func AggregatePopulationsFromString(s string) ([]AggregatePopulation, error) {
+	switch s {
+	case "registered":
+		return []AggregatePopulation{AggregatePopulationRegistered}, nil
+	case "resident":
+		return []AggregatePopulation{AggregatePopulationResident}, nil
+	case "both":
+		return []AggregatePopulation{AggregatePopulationRegistered, AggregatePopulationResident}, nil
+	}
+	return nil, fmt.Errorf("unknown aggregate population %q, expected registered, resident or both", s)
+}
+
+// GroupBy assigns people to the groups of a breakdown
+type GroupBy struct {
+	Key string
+	// Values of groups that are always present, in order, even if empty.
+	// Other groups follow, ordered by value.
+	Fixed []string
+	// Group returns the value of the group to which a person belongs, or
+	// false if they don't belong to any, in which case they're counted
+	// as skipped.
+	Group func(p *Person) (string, bool)
+}
+
+// A Measure counts people by an index, for example the bitmask of their
+// conditions.
+type Measure struct {
+	Size  int
+	Index func(p *Person) int
+}
+
+var MeasureConditions = &Measure{
+	Size:  int(QOFConditionsMaxUint32) + 1,
+	Index: func(p *Person) int { return int(p.Conditions.ToUint32()) },
+}
+
+type AggregateGroup struct {
+	Value  string
+	Counts []int
+}
+
+type Aggregate struct {
+	Key    string
+	Groups []AggregateGroup
+	// The number of people passing the filter, but not belonging to any
+	// group
+	Skipped int
+}
+
+// Aggregation computes breakdowns of the people passing a filter, for
+// every GroupBy, in a single pass.
+type Aggregation struct {
+	Filter  Filter
+	GroupBy []*GroupBy
+	Measure *Measure
+}
+
+type AggregationResult struct {
+	// The rule for which people entered the aggregates
+	Population AggregatePopulation
+	Aggregates []*Aggregate
+	Included   int
+	Excluded   int
+}
+
+func (a *Aggregation) Run(people []Person) *AggregationResult {
+	result := &AggregationResult{}
+	groups := make([]map[string][]int, len(a.GroupBy))
+	for i, g := range a.GroupBy {
+		groups[i] = make(map[string][]int)
+		for _, value := range g.Fixed {
+			groups[i][value] = make([]int, a.Measure.Size)
+		}
+		result.Aggregates = append(result.Aggregates, &Aggregate{Key: g.Key})
+	}
+	for i := range people {
+		p := &people[i]
+		if a.Filter != nil && !a.Filter(p) {
+			result.Excluded++
+			continue
+		}
+		result.Included++
+		index := a.Measure.Index(p)
+		for j, g := range a.GroupBy {
+			value, ok := g.Group(p)
+			if !ok {
+				result.Aggregates[j].Skipped++
+				continue
+			}
+			counts, ok := groups[j][value]
+			if !ok {
+				counts = make([]int, a.Measure.Size)
+				groups[j][value] = counts
+			}
+			counts[index]++
+		}
+	}
+	for i, g := range a.GroupBy {
+		fixed := make(map[string]struct{}, len(g.Fixed))
+		for _, value := range g.Fixed {
+			fixed[value] = struct{}{}
+			result.Aggregates[i].Groups = append(result.Aggregates[i].Groups, AggregateGroup{Value: value, Counts: groups[i][value]})
+		}
+		others := make([]string, 0, len(groups[i]))
+		for value := range groups[i] {
+			if _, ok := fixed[value]; !ok {
+				others = append(others, value)
+			}
+		}
+		sort.Strings(others)
+		for _, value := range others {
+			result.Aggregates[i].Groups = append(result.Aggregates[i].Groups, AggregateGroup{Value: value, Counts: groups[i][value]})
+		}
+	}
+	return result
+}
+
+func (r *AggregationResult) Get(key string) *Aggregate {
+	for _, a := range r.Aggregates {
+		if a.Key == key {
+			return a
+		}
+	}
+	return nil
+}
+
+func GroupByAll() *GroupBy {
+	return &GroupBy{
+		Key:   "all",
+		Fixed: []string{"all"},
+		Group: func(p *Person) (string, bool) { return "all", true },
+	}
+}
+
+// GroupByPracticeMSOA groups people by the name of the MSOA in which
+// their GP practice is located.
+func GroupByPracticeMSOA(lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, gps map[GPPracticeCode]*GPPractice) *GroupBy {
+	return &GroupBy{
+		Key: "msoa",
+		Group: func(p *Person) (string, bool) {
+			if gp, ok := gps[p.GP]; ok {
+				if lsoa, ok := lsoas[gp.LSOA]; ok {
+					if msoa, ok := msoas[lsoa.MSOACode]; ok {
+						return msoa.Name, true
+					}
+				}
+			}
+			return "", false
+		},
+	}
+}
+
+// GroupBySex groups people by sex, with groups for each of sexes
+func GroupBySex(sexes []Sex) *GroupBy {
+	values := make([]string, 0, len(sexes))
+	for _, sex := range sexes {
+		values = append(values, sex.String())
+	}
+	return &GroupBy{
+		Key:   "sex",
+		Fixed: values,
+		Group: func(p *Person) (string, bool) { return p.Sex.String(), true },
+	}
+}
+
+// GroupBySexThenAgeBand groups people by sex, and then by age band, as
+// for GroupByAgeBands, with values like m:40, in order of sexes, then
+// band.
+func GroupBySexThenAgeBand(key string, sexes []Sex, ageBands *AgeBands) *GroupBy {
+	bands := GroupByAgeBands(key, ageBands)
+	values := make([]string, 0, len(sexes)*len(bands.Fixed))
+	for _, sex := range sexes {
+		for _, band := range bands.Fixed {
+			values = append(values, sexThenAgeBandValue(sex, band))
+		}
+	}
+	return &GroupBy{
+		Key:   key,
+		Fixed: values,
+		Group: func(p *Person) (string, bool) {
+			band, _ := bands.Group(p)
+			return sexThenAgeBandValue(p.Sex, band), true
+		},
+	}
+}
+
+func sexThenAgeBandValue(sex Sex, band string) string {
+	return sex.String() + ":" + band
+}
+
+func GroupByIMDDecile(lsoas map[LSOACode]*LSOA) *GroupBy {
+	deciles := make([]string, 10)
+	for i := range deciles {
+		deciles[i] = strconv.Itoa(i + 1)
+	}
+	return &GroupBy{
+		Key:   "imd",
+		Fixed: deciles,
+		Group: func(p *Person) (string, bool) {
+			if d := lsoas[p.Home].IMDDecile; d >= 1 && d <= len(deciles) {
+				return deciles[d-1], true
+			}
+			return "", false
+		},
+	}
+}
+
+// aggregatesTable returns aggregates of conditions in tidy form, with
+// one row for each combination of conditions in each group, for each
+// population.
+func aggregatesTable(results []*AggregationResult) *ExportTable {
+	fields := []ArrowField{{Name: "population"}, {Name: "breakdown"}, {Name: "value"}}
+	for _, condition := range AllQOFConditions() {
+		fields = append(fields, ArrowField{Name: fmt.Sprintf("condition_%s", condition), Type: ArrowTypeInt64})
+	}
+	fields = append(fields, ArrowField{Name: "people", Type: ArrowTypeInt64})
+	rows := func(each func(row []string) error) error {
+		for _, result := range results {
+			for _, a := range result.Aggregates {
+				for _, g := range a.Groups {
+					for index, count := range g.Counts {
+						if count == 0 {
+							continue
+						}
+						row := []string{result.Population.String(), a.Key, g.Value}
+						for _, condition := range AllQOFConditions() {
+							row = append(row, presentToString(QOFConditions(index).Contains(condition)))
+						}
+						if err := each(append(row, strconv.Itoa(count))); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return &ExportTable{Fields: fields, Rows: rows}
+}
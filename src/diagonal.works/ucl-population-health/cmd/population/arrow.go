@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Arrow IPC, as written by ArrowWriter, and read by pyarrow.feather or
+// pyarrow.ipc.open_file, see
+// https://arrow.apache.org/docs/format/Columnar.html#ipc-file-format
+const (
+	arrowMagic = "ARROW1"
+	// The continuation marker before the length of each message
+	arrowContinuation = 0xffffffff
+
+	arrowMetadataVersionV5 = 4
+
+	arrowMessageHeaderSchema      = 1
+	arrowMessageHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+
+	arrowPrecisionDouble = 2
+
+	// The rows of each record batch, unless given
+	ArrowDefaultBatchRows = 64 * 1024
+)
+
+// ArrowType is the type of a column of an Arrow table. Values are given
+// as strings, as written to CSV, with empty numbers written as nulls.
+type ArrowType int
+
+const (
+	ArrowTypeUtf8 ArrowType = iota
+	ArrowTypeInt64
+	ArrowTypeFloat64
+)
+
+// ArrowTypeFromSQL returns the Arrow type for a column of the given type
+// in SQL outputs, as given by PersonColumn.
+func ArrowTypeFromSQL(t string) ArrowType {
+	switch t {
+	case "INTEGER":
+		return ArrowTypeInt64
+	case "REAL":
+		return ArrowTypeFloat64
+	}
+	return ArrowTypeUtf8
+}
+
+type ArrowField struct {
+	Name string
+	Type ArrowType
+}
+
+// arrowColumn accumulates the values of a column for a record batch
+type arrowColumn struct {
+	valid   []bool
+	nulls   int
+	numbers []uint64 // Int64, or the bits of Float64
+	offsets []int32  // Utf8, with a leading 0
+	data    []byte   // Utf8
+}
+
+// ArrowWriter writes a table to an Arrow IPC file, in record batches of a
+// fixed number of rows, so that tables can be streamed as they're
+// produced, holding only one batch in memory.
+type ArrowWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	fields    []ArrowField
+	metadata  [][2]string
+	batchRows int
+	rows      int
+	columns   []arrowColumn
+	// The position of the next byte written
+	offset  int64
+	batches []arrowBlock
+}
+
+// arrowBlock locates a message in the file, for the footer
+type arrowBlock struct {
+	Offset         int64
+	MetadataLength int32
+	BodyLength     int64
+}
+
+// NewArrowWriter creates filename, writing the schema of the table with
+// the given fields, and metadata as keys and values. If batchRows is zero,
+// ArrowDefaultBatchRows is used.
+func NewArrowWriter(filename string, fields []ArrowField, metadata [][2]string, batchRows int) (*ArrowWriter, error) {
+	if batchRows <= 0 {
+		batchRows = ArrowDefaultBatchRows
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &ArrowWriter{f: f, w: bufio.NewWriter(f), fields: fields, metadata: metadata, batchRows: batchRows}
+	a.reset()
+	a.write([]byte(arrowMagic + "\x00\x00"))
+	message := fbTable{
+		fbInt16(arrowMetadataVersionV5),
+		fbUint8(arrowMessageHeaderSchema),
+		a.schema(),
+		fbInt64(0),
+	}
+	a.writeMessage(message, nil)
+	return a, nil
+}
+
+func (a *ArrowWriter) reset() {
+	a.rows = 0
+	a.columns = make([]arrowColumn, len(a.fields))
+	for i := range a.columns {
+		a.columns[i].offsets = []int32{0}
+	}
+}
+
+func (a *ArrowWriter) write(b []byte) {
+	a.w.Write(b)
+	a.offset += int64(len(b))
+}
+
+func (a *ArrowWriter) schema() fbTable {
+	fields := make(fbTables, len(a.fields))
+	for i, field := range a.fields {
+		var t fbTable
+		var typeType uint8
+		switch field.Type {
+		case ArrowTypeInt64:
+			typeType, t = arrowTypeInt, fbTable{fbInt32(64), fbBool(true)}
+		case ArrowTypeFloat64:
+			typeType, t = arrowTypeFloatingPoint, fbTable{fbInt16(arrowPrecisionDouble)}
+		default:
+			typeType, t = arrowTypeUtf8, fbTable{}
+		}
+		fields[i] = fbTable{
+			fbString(field.Name),
+			fbBool(true),
+			fbUint8(typeType),
+			t,
+			nil,
+			fbTables{},
+		}
+	}
+	metadata := make(fbTables, len(a.metadata))
+	for i, kv := range a.metadata {
+		metadata[i] = fbTable{fbString(kv[0]), fbString(kv[1])}
+	}
+	// Little endian, with the metadata as the schema's custom_metadata
+	return fbTable{fbInt16(0), fields, metadata}
+}
+
+// Write adds a row, with a value for each field, writing a record batch
+// once batchRows have been added.
+func (a *ArrowWriter) Write(row []string) error {
+	if len(row) != len(a.fields) {
+		return fmt.Errorf("row has %d values, expected %d", len(row), len(a.fields))
+	}
+	for i, v := range row {
+		c := &a.columns[i]
+		valid := true
+		switch a.fields[i].Type {
+		case ArrowTypeInt64:
+			var n int64
+			if v == "" {
+				valid = false
+			} else if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+				n = parsed
+			} else {
+				return fmt.Errorf("%s: bad integer %q", a.fields[i].Name, v)
+			}
+			c.numbers = append(c.numbers, uint64(n))
+		case ArrowTypeFloat64:
+			var x float64
+			if v == "" {
+				valid = false
+			} else if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				x = parsed
+			} else {
+				return fmt.Errorf("%s: bad number %q", a.fields[i].Name, v)
+			}
+			c.numbers = append(c.numbers, math.Float64bits(x))
+		default:
+			c.data = append(c.data, v...)
+			if len(c.data) > math.MaxInt32 {
+				return fmt.Errorf("%s: too much text for a record batch", a.fields[i].Name)
+			}
+			c.offsets = append(c.offsets, int32(len(c.data)))
+		}
+		c.valid = append(c.valid, valid)
+		if !valid {
+			c.nulls++
+		}
+	}
+	a.rows++
+	if a.rows == a.batchRows {
+		a.flush()
+	}
+	return nil
+}
+
+// flush writes the rows added since the last record batch as a batch
+func (a *ArrowWriter) flush() {
+	if a.rows == 0 {
+		return
+	}
+	var body []byte
+	nodes := make([]byte, 0, len(a.columns)*16)
+	buffers := make([]byte, 0)
+	addBuffer := func(b []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(b)))
+		body = append(body, b...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+	buffersN := 0
+	for i, c := range a.columns {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(a.rows))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(c.nulls))
+		if c.nulls > 0 {
+			validity := make([]byte, (a.rows+7)/8)
+			for j, valid := range c.valid {
+				if valid {
+					validity[j/8] |= 1 << (j % 8)
+				}
+			}
+			addBuffer(validity)
+		} else {
+			// A buffer may be omitted if there are no nulls
+			addBuffer(nil)
+		}
+		switch a.fields[i].Type {
+		case ArrowTypeInt64, ArrowTypeFloat64:
+			values := make([]byte, 0, 8*len(c.numbers))
+			for _, n := range c.numbers {
+				values = binary.LittleEndian.AppendUint64(values, n)
+			}
+			addBuffer(values)
+			buffersN += 2
+		default:
+			offsets := make([]byte, 0, 4*len(c.offsets))
+			for _, o := range c.offsets {
+				offsets = binary.LittleEndian.AppendUint32(offsets, uint32(o))
+			}
+			addBuffer(offsets)
+			addBuffer(c.data)
+			buffersN += 3
+		}
+	}
+	batch := fbTable{
+		fbInt64(int64(a.rows)),
+		fbStructs{align: 8, n: len(a.columns), data: nodes},
+		fbStructs{align: 8, n: buffersN, data: buffers},
+	}
+	message := fbTable{
+		fbInt16(arrowMetadataVersionV5),
+		fbUint8(arrowMessageHeaderRecordBatch),
+		batch,
+		fbInt64(int64(len(body))),
+	}
+	a.batches = append(a.batches, a.writeMessage(message, body))
+	a.reset()
+}
+
+// writeMessage writes an encapsulated message, with its body, returning
+// its location.
+func (a *ArrowWriter) writeMessage(message fbTable, body []byte) arrowBlock {
+	metadata := fbFinish(message)
+	block := arrowBlock{Offset: a.offset, MetadataLength: int32(8 + len(metadata)), BodyLength: int64(len(body))}
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:4], arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:8], uint32(len(metadata)))
+	a.write(prefix[:])
+	a.write(metadata)
+	a.write(body)
+	return block
+}
+
+// Close writes any remaining rows, and the footer, and closes the file.
+func (a *ArrowWriter) Close() error {
+	a.flush()
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[0:4], arrowContinuation)
+	a.write(eos[:])
+	blocks := make([]byte, 0, 24*len(a.batches))
+	for _, b := range a.batches {
+		blocks = binary.LittleEndian.AppendUint64(blocks, uint64(b.Offset))
+		blocks = binary.LittleEndian.AppendUint32(blocks, uint32(b.MetadataLength))
+		blocks = binary.LittleEndian.AppendUint32(blocks, 0)
+		blocks = binary.LittleEndian.AppendUint64(blocks, uint64(b.BodyLength))
+	}
+	footer := fbFinish(fbTable{
+		fbInt16(arrowMetadataVersionV5),
+		a.schema(),
+		fbStructs{align: 8},
+		fbStructs{align: 8, n: len(a.batches), data: blocks},
+	})
+	a.write(footer)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	a.write(length[:])
+	a.write([]byte(arrowMagic))
+	if err := a.w.Flush(); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+// A minimal flatbuffer encoder, sufficient for Arrow's metadata, see
+// https://flatbuffers.dev/flatbuffers_internals.html. Objects are laid
+// out after the fields that refer to them, since offsets are unsigned.
+type fbObject interface {
+	// write appends the object to b, returning the position to which
+	// offsets to it refer
+	write(b *fbBuilder) int
+}
+
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// reference writes a placeholder for an offset to an object, returning a
+// function that writes the object, and fills in the offset.
+func (b *fbBuilder) reference(o fbObject) func() {
+	b.pad(4)
+	at := len(b.buf)
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	return func() {
+		to := o.write(b)
+		binary.LittleEndian.PutUint32(b.buf[at:], uint32(to-at))
+	}
+}
+
+// fbFinish returns the encoding of root, padded to a multiple of 8 bytes
+func fbFinish(root fbTable) []byte {
+	b := &fbBuilder{}
+	b.reference(root)()
+	b.pad(8)
+	return b.buf
+}
+
+type fbScalar struct {
+	size  int
+	value uint64
+}
+
+func fbBool(v bool) fbScalar {
+	if v {
+		return fbScalar{size: 1, value: 1}
+	}
+	return fbScalar{size: 1}
+}
+
+func fbUint8(v uint8) fbScalar { return fbScalar{size: 1, value: uint64(v)} }
+func fbInt16(v int16) fbScalar { return fbScalar{size: 2, value: uint64(uint16(v))} }
+func fbInt32(v int32) fbScalar { return fbScalar{size: 4, value: uint64(uint32(v))} }
+func fbInt64(v int64) fbScalar { return fbScalar{size: 8, value: uint64(v)} }
+
+// fbTable is a table, with the value of each field, indexed by its
+// position in the schema, being an fbScalar, an fbObject, or nil if
+// absent.
+type fbTable []interface{}
+
+func (t fbTable) write(b *fbBuilder) int {
+	b.pad(2)
+	vtable := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+2*len(t))...)
+	b.pad(4)
+	table := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(int32(table-vtable)))
+	children := make([]func(), 0)
+	for i, v := range t {
+		at := 0
+		switch v := v.(type) {
+		case fbScalar:
+			b.pad(v.size)
+			at = len(b.buf)
+			for j := 0; j < v.size; j++ {
+				b.buf = append(b.buf, byte(v.value>>(8*j)))
+			}
+		case fbObject:
+			children = append(children, b.reference(v))
+			at = len(b.buf) - 4
+		default:
+			continue
+		}
+		binary.LittleEndian.PutUint16(b.buf[vtable+4+2*i:], uint16(at-table))
+	}
+	binary.LittleEndian.PutUint16(b.buf[vtable:], uint16(4+2*len(t)))
+	binary.LittleEndian.PutUint16(b.buf[vtable+2:], uint16(len(b.buf)-table))
+	for _, c := range children {
+		c()
+	}
+	return table
+}
+
+type fbString string
+
+func (s fbString) write(b *fbBuilder) int {
+	b.pad(4)
+	at := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return at
+}
+
+// fbTables is a vector of tables
+type fbTables []fbObject
+
+func (v fbTables) write(b *fbBuilder) int {
+	b.pad(4)
+	at := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+	children := make([]func(), len(v))
+	for i, o := range v {
+		children[i] = b.reference(o)
+	}
+	for _, c := range children {
+		c()
+	}
+	return at
+}
+
+// fbStructs is a vector of n structs, encoded in data, each aligned to
+// align bytes.
+type fbStructs struct {
+	align int
+	n     int
+	data  []byte
+}
+
+func (v fbStructs) write(b *fbBuilder) int {
+	for (len(b.buf)+4)%v.align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+	at := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v.n))
+	b.buf = append(b.buf, v.data...)
+	return at
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fbReader decodes the flatbuffer tables written by fbFinish, see
+// https://flatbuffers.dev/flatbuffers_internals.html
+type fbReader struct {
+	buf []byte
+}
+
+// root returns the position of the root table
+func (r fbReader) root() int {
+	return int(binary.LittleEndian.Uint32(r.buf))
+}
+
+// field returns the position of field i of the table at table, or -1 if
+// it's absent.
+func (r fbReader) field(table int, i int) int {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(r.buf[table:])))
+	if 4+2*i >= int(binary.LittleEndian.Uint16(r.buf[vtable:])) {
+		return -1
+	}
+	if offset := int(binary.LittleEndian.Uint16(r.buf[vtable+4+2*i:])); offset > 0 {
+		return table + offset
+	}
+	return -1
+}
+
+// object returns the position of the object referred to by field i of
+// the table at table.
+func (r fbReader) object(table int, i int) int {
+	at := r.field(table, i)
+	return at + int(binary.LittleEndian.Uint32(r.buf[at:]))
+}
+
+func (r fbReader) int64(table int, i int) int64 {
+	if at := r.field(table, i); at >= 0 {
+		return int64(binary.LittleEndian.Uint64(r.buf[at:]))
+	}
+	return 0
+}
+
+func (r fbReader) uint8(table int, i int) uint8 {
+	if at := r.field(table, i); at >= 0 {
+		return r.buf[at]
+	}
+	return 0
+}
+
+// vector returns the length of the vector referred to by field i, and the
+// position of its first element.
+func (r fbReader) vector(table int, i int) (int, int) {
+	at := r.object(table, i)
+	return int(binary.LittleEndian.Uint32(r.buf[at:])), at + 4
+}
+
+// tables returns the positions of the tables of the vector referred to by
+// field i.
+func (r fbReader) tables(table int, i int) []int {
+	n, at := r.vector(table, i)
+	tables := make([]int, n)
+	for j := range tables {
+		element := at + 4*j
+		tables[j] = element + int(binary.LittleEndian.Uint32(r.buf[element:]))
+	}
+	return tables
+}
+
+func (r fbReader) string(table int, i int) string {
+	at := r.object(table, i)
+	n := int(binary.LittleEndian.Uint32(r.buf[at:]))
+	return string(r.buf[at+4 : at+4+n])
+}
+
+// readArrow returns the rows of a file written by ArrowWriter, with nulls
+// as empty strings, the number of rows of each record batch, the names
+// of its fields, and its metadata.
+func readArrow(t *testing.T, filename string) ([][]string, []int, []string, map[string]string) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[0:8]) != arrowMagic+"\x00\x00" || string(b[len(b)-6:]) != arrowMagic {
+		t.Fatalf("expected %s at the beginning and end of the file", arrowMagic)
+	}
+	if binary.LittleEndian.Uint32(b[8:]) != arrowContinuation {
+		t.Fatalf("expected the schema message to follow the magic")
+	}
+	length := int(binary.LittleEndian.Uint32(b[len(b)-10:]))
+	end := len(b) - 10
+	if binary.LittleEndian.Uint32(b[end-length-8:]) != arrowContinuation || binary.LittleEndian.Uint32(b[end-length-4:]) != 0 {
+		t.Fatalf("expected an end of stream marker before the footer")
+	}
+	footer := fbReader{buf: b[end-length : end]}
+	schema := footer.object(footer.root(), 1)
+	names := make([]string, 0)
+	types := make([]uint8, 0)
+	for _, field := range footer.tables(schema, 1) {
+		names = append(names, footer.string(field, 0))
+		types = append(types, footer.uint8(field, 2))
+	}
+	metadata := make(map[string]string)
+	for _, kv := range footer.tables(schema, 2) {
+		metadata[footer.string(kv, 0)] = footer.string(kv, 1)
+	}
+
+	rows := make([][]string, 0)
+	lengths := make([]int, 0)
+	n, blocks := footer.vector(footer.root(), 3)
+	for i := 0; i < n; i++ {
+		block := footer.buf[blocks+24*i:]
+		offset := int(binary.LittleEndian.Uint64(block[0:]))
+		metadataLength := int(binary.LittleEndian.Uint32(block[8:]))
+		bodyLength := int(binary.LittleEndian.Uint64(block[16:]))
+		if binary.LittleEndian.Uint32(b[offset:]) != arrowContinuation {
+			t.Fatalf("expected a continuation marker at the offset of batch %d", i)
+		}
+		message := fbReader{buf: b[offset+8 : offset+metadataLength]}
+		root := message.root()
+		if h := message.uint8(root, 1); h != arrowMessageHeaderRecordBatch {
+			t.Fatalf("expected a record batch, found header %d", h)
+		}
+		if l := message.int64(root, 3); int(l) != bodyLength {
+			t.Errorf("expected a body of %d bytes in the footer, found %d in the message", bodyLength, l)
+		}
+		body := b[offset+metadataLength : offset+metadataLength+bodyLength]
+		batch := message.object(root, 2)
+		rowsN := int(message.int64(batch, 0))
+		lengths = append(lengths, rowsN)
+		nodesN, nodes := message.vector(batch, 1)
+		if nodesN != len(names) {
+			t.Fatalf("expected a node for each of %d fields, found %d", len(names), nodesN)
+		}
+		_, buffers := message.vector(batch, 2)
+		buffer := func() []byte {
+			at := message.buf[buffers:]
+			buffers += 16
+			offset := int(binary.LittleEndian.Uint64(at[0:]))
+			return body[offset : offset+int(binary.LittleEndian.Uint64(at[8:]))]
+		}
+		begin := len(rows)
+		for j := 0; j < rowsN; j++ {
+			rows = append(rows, make([]string, len(names)))
+		}
+		for j := range names {
+			if l := int(binary.LittleEndian.Uint64(message.buf[nodes+16*j:])); l != rowsN {
+				t.Errorf("expected %d values for %s, found %d", rowsN, names[j], l)
+			}
+			validity := buffer()
+			valid := func(k int) bool { return len(validity) == 0 || validity[k/8]&(1<<(k%8)) != 0 }
+			switch types[j] {
+			case arrowTypeInt, arrowTypeFloatingPoint:
+				values := buffer()
+				for k := 0; k < rowsN; k++ {
+					if !valid(k) {
+						continue
+					}
+					v := binary.LittleEndian.Uint64(values[8*k:])
+					if types[j] == arrowTypeInt {
+						rows[begin+k][j] = strconv.FormatInt(int64(v), 10)
+					} else {
+						rows[begin+k][j] = strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)
+					}
+				}
+			default:
+				offsets, data := buffer(), buffer()
+				for k := 0; k < rowsN; k++ {
+					from, to := binary.LittleEndian.Uint32(offsets[4*k:]), binary.LittleEndian.Uint32(offsets[4*k+4:])
+					rows[begin+k][j] = string(data[from:to])
+				}
+			}
+		}
+	}
+	return rows, lengths, names, metadata
+}
+
+func TestArrowWriterRoundTrip(t *testing.T) {
+	fields := []ArrowField{
+		{Name: "id", Type: ArrowTypeInt64},
+		{Name: "weight", Type: ArrowTypeFloat64},
+		{Name: "name", Type: ArrowTypeUtf8},
+	}
+	rows := [][]string{
+		{"1", "0.5", "Camden"},
+		{"", "", "Islington"},
+		{"-3", "", ""},
+		{"4", "1e+20", "Barnet"},
+		{"", "2.25", "Enfield"},
+	}
+	filename := filepath.Join(t.TempDir(), "test.arrow")
+	// Two rows per batch, to write more than one, and a final partial
+	// batch
+	w, err := NewArrowWriter(filename, fields, [][2]string{{"scenario", "baseline"}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, lengths, names, metadata := readArrow(t, filename)
+	if len(lengths) != 3 || lengths[0] != 2 || lengths[1] != 2 || lengths[2] != 1 {
+		t.Errorf("expected batches of 2, 2 and 1 rows, found %v", lengths)
+	}
+	for i, field := range fields {
+		if i >= len(names) || names[i] != field.Name {
+			t.Errorf("expected column %d to be %s, found %v", i, field.Name, names)
+		}
+	}
+	if metadata["scenario"] != "baseline" {
+		t.Errorf("expected scenario metadata, found %v", metadata)
+	}
+	if len(read) != len(rows) {
+		t.Fatalf("expected %d rows, found %d", len(rows), len(read))
+	}
+	for i := range rows {
+		for j := range rows[i] {
+			if read[i][j] != rows[i][j] {
+				t.Errorf("expected %q for %s of row %d, found %q", rows[i][j], fields[j].Name, i, read[i][j])
+			}
+		}
+	}
+}
+
+func TestArrowWriterWritesBatchesAsTheyFill(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.arrow")
+	w, err := NewArrowWriter(filename, []ArrowField{{Name: "id", Type: ArrowTypeInt64}}, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, id := range []string{"1", "2", "3"} {
+		if err := w.Write([]string{id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.batches) != 1 || w.rows != 1 {
+		t.Errorf("expected one batch written, and one row held, found %d and %d", len(w.batches), w.rows)
+	}
+	if err := w.Write([]string{"one"}); err == nil {
+		t.Error("expected an error for a bad integer")
+	}
+	if err := w.Write([]string{"1", "2"}); err == nil {
+		t.Error("expected an error for a row with too many values")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Assumption is a modelling choice made by a run, either by a built in
+// constant, a flag, or a model read from a file, recorded so that it can
+// be reviewed alongside the outputs it led to.
+type Assumption struct {
+	Area  string `json:"area"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Where the value came from: "built in", a flag, or a file
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+// Assumptions is a register of the assumptions made by a run, in the order
+// they were recorded, grouped by area when written.
+type Assumptions []Assumption
+
+func (a *Assumptions) Add(area string, name string, value string, source string, description string) {
+	*a = append(*a, Assumption{Area: area, Name: name, Value: value, Source: source, Description: description})
+}
+
+// AppliedAssumptions holds what was done to the inputs during a run,
+// rather than how it was configured.
+type AppliedAssumptions struct {
+	PrevalenceOverrides PrevalenceOverrides
+	// The practices and conditions whose reported prevalence was adjusted
+	// as an outlier
+	OutlierAdjustments int
+	// The practices and conditions without a reported prevalence, and
+	// the number of those imputed from nearby practices
+	MissingPrevalences  int
+	ImputedPrevalences  int
+	OtherSexPeople      int
+	Buffer              *Buffer
+	CrossBorderInwards  int
+	CrossBorderOutwards int
+	BalancedAssignment  *BalancedAssignment
+	Reweighting         *Reweighting
+}
+
+// collectAssumptions returns the assumptions of a run with options, and
+// the adjustments it applied to its inputs.
+func collectAssumptions(options *PopulationOptions, applied *AppliedAssumptions) Assumptions {
+	var a Assumptions
+	const builtIn = "built in"
+	fromFlag := func(name string) string { return "--" + name }
+
+	area := "Practice assignment"
+	parameters := builtIn
+	if options.Parameters.filename != "" {
+		parameters = fromFlag("parameters")
+	}
+	a.Add(area, "Nearby radius", fmt.Sprintf("%.0fm", options.Parameters.GPLSOANearbyRadiusM), parameters, "People are only assigned to practices within this distance of the centre of their home LSOA")
+	a.Add(area, "Equal distance", fmt.Sprintf("%.0fm", options.Parameters.GPPracticeEqualDistanceLimitM), parameters, "Practices closer than this are equally likely to be chosen. Beyond it, likelihood is the reciprocal of distance, halving at twice the distance")
+	a.Add(area, "List size weight", fmt.Sprintf("list size / %.0f, clamped to 0.01-1", options.Parameters.GPPracticeMaxListSize), parameters, "Likelihood of choosing a practice is further scaled by its reported list size. Practices without a reported list are never chosen")
+	if r := options.Rurality; r != nil {
+		for _, p := range []struct {
+			name       string
+			parameters AssignmentParameters
+		}{{"Urban", r.Urban}, {"Rural", r.Rural}} {
+			radius := "of the nearby lookup"
+			if p.parameters.RadiusM > 0.0 {
+				radius = fmt.Sprintf("%.0fm", p.parameters.RadiusM)
+			}
+			a.Add(area, p.name+" parameters", fmt.Sprintf("radius %s, equal distance %.0fm", radius, p.parameters.withDefaults(options.Parameters).EqualDistanceM), fromFlag("rurality"), "Assignment parameters used for "+strings.ToLower(p.name)+" LSOAs, by the ONS rural-urban classification. Unclassified LSOAs are treated as urban")
+		}
+	}
+	if b := applied.BalancedAssignment; b != nil {
+		a.Add(area, "Balanced assignment", fmt.Sprintf("%d iterations, %d moved, %d unmet", b.Iterations, b.Moved, b.Unmet), fromFlag("assignment"), "The number of people from each LSOA at each nearby practice was fitted so that ICB practices' simulated list sizes match those reported, except where there weren't enough people near a practice, or too many")
+	}
+	if options.RegistrationCalibrationIterations > 0 {
+		a.Add(area, "Registration calibration", fmt.Sprintf("%d iterations", options.RegistrationCalibrationIterations), fromFlag("calibrate-registrations"), "Assignment to ICB practices is reweighted to match their published registrations by age and sex")
+	}
+	if options.CrossBorderCalibration {
+		a.Add(area, "Cross border calibration", fmt.Sprintf("%d moved inside, %d outside", applied.CrossBorderInwards, applied.CrossBorderOutwards), fromFlag("calibrate-cross-border"), "People were moved between nearby practices inside and outside the scope to match the published share of each LSOA's patients registered outside it")
+	}
+	if options.CareHomes {
+		a.Add(area, "Care homes", fmt.Sprintf("%d and over", CareHomeMinAge), fromFlag("care-homes"), "People of this age are placed into CQC registered care homes, and registered with the practice serving the home")
+	}
+
+	area = "Geography"
+	a.Add(area, "Scope", options.Scope.String(), fromFlag("scope"), "The area whose residents and practices are simulated")
+	a.Add(area, "Census year", fmt.Sprintf("%d", options.CensusYear), fromFlag("census-year"), "The census from which LSOA codes, boundaries and populations by age and sex are drawn")
+	buffer := options.Buffer.Policy.String()
+	switch options.Buffer.Policy {
+	case BufferPolicyRegistration:
+		buffer = fmt.Sprintf("%s, at least %.02f registered", buffer, options.Buffer.MinRegisteredShare)
+	case BufferPolicyTravelTime:
+		buffer = fmt.Sprintf("%s, at most %.0f minutes", buffer, options.Buffer.MaxTravelMinutes)
+	}
+	if applied.Buffer != nil {
+		buffer = fmt.Sprintf("%s (%d LSOAs)", buffer, len(applied.Buffer.LSOAs))
+	}
+	a.Add(area, "Buffer", buffer, fromFlag("buffer"), "LSOAs outside the scope from which people registered with its practices are also drawn")
+	if options.TargetYear > 0 {
+		target := "local authority, age and sex"
+		if options.TargetLSOATotals {
+			target += ", and LSOA totals"
+		}
+		a.Add(area, "Target year", fmt.Sprintf("%d, by %s", options.TargetYear, target), fromFlag("target-year"), "Census counts are reweighted to the ONS mid-year estimates of this year")
+	}
+	if r := applied.Reweighting; r != nil {
+		margins := make([]string, len(options.ReweightMargins))
+		for i, m := range options.ReweightMargins {
+			margins[i] = m.String()
+		}
+		a.Add(area, "Person weights", fmt.Sprintf("%s: %d controls, within %.4f%%, weights %.2f to %.2f", strings.Join(margins, ", "), len(r.Controls), 100.0*r.MaxDifference(), r.MinWeight, r.MaxWeight), fromFlag("reweight"), "Each person has a weight, calibrated by raking so that weighted totals match external controls. Unweighted outputs, like aggregates, are unaffected")
+	}
+
+	area = "Prevalence"
+	a.Add(area, "Prevalences", PrevalencesFilename, builtIn, "National prevalence of single conditions and pairs, by age and sex, scaled to the reported prevalence of each practice")
+	if len(applied.PrevalenceOverrides) > 0 {
+		a.Add(area, "Overrides", applied.PrevalenceOverrides.String(), fromFlag("set-prevalence")+" and scenario", "Patches applied to the national prevalences before they're used")
+	}
+	for _, condition := range options.Conditions {
+		a.Add(area, "Reported "+condition.String(), options.Data.Get(QOFConditionDataset(condition)).Filename, "data manifest", "QOF register sizes, and list sizes, from which each practice's reported prevalence is taken")
+	}
+	a.Add(area, "Outliers", fmt.Sprintf("%s (%d adjusted)", options.PrevalenceOutlier, applied.OutlierAdjustments), fromFlag("prevalence-outlier"), "Rule by which practices whose reported prevalence appears not to be reported correctly are adjusted, listed in prevalence-outliers.csv")
+	a.Add(area, "Imputation", fmt.Sprintf("%d of %d missing imputed", applied.ImputedPrevalences, applied.MissingPrevalences), builtIn, "Practices and conditions without a reported prevalence are given the average of nearby practices, weighted by the inverse of their distance")
+	if len(options.PrescribingFilenames) > 0 && options.PrescribingBiasWeight > 0.0 {
+		a.Add(area, "Prescribing weight", fmt.Sprintf("%.02f", options.PrescribingBiasWeight), fromFlag("prescribing-bias-weight"), "Weight given to prescribing volume, rather than reported prevalence, when estimating condition bias")
+	}
+	a.Add(area, "Other sex", fmt.Sprintf("%s (%d people)", options.OtherSexPrevalence, applied.OtherSexPeople), fromFlag("other-sex-prevalence"), "Rates used for people who are neither male nor female, where models don't give them")
+
+	area = "Conditions"
+	a.Add(area, "Condition model", options.ConditionModel, fromFlag("condition-model"), "Model used to assign conditions to people, given their age, sex and practice")
+	if options.ConditionModel == "logistic" {
+		a.Add(area, "Logistic coefficients", options.LogisticCoefficientsFilename, fromFlag("logistic-coefficients"), "Log odds ratios for deprivation and comorbidity, by condition")
+	}
+	if len(options.SmallAreaConditions) > 0 {
+		names := make([]string, len(options.SmallAreaConditions))
+		for i, c := range options.SmallAreaConditions {
+			names[i] = c.String()
+		}
+		a.Add(area, "Small area estimation", strings.Join(names, ","), fromFlag("small-area"), "Conditions assigned from small area estimates of prevalence by LSOA, rather than the condition model")
+	}
+
+	area = "Models"
+	for _, m := range []struct {
+		name        string
+		filename    string
+		flag        string
+		description string
+	}{
+		{"Incidence", options.IncidenceFilename, "incidence", "Annual incidence by age and sex, from which the age at onset of each condition is sampled"},
+		{"Complications", options.ComplicationsFilename, "complications", "Annual incidence of complications by years since diagnosis, from which complications are assigned"},
+		{"Detection", options.DetectionFilename, "detection", "Detection rates by age, sex and deprivation, from which people living with a condition undiagnosed are estimated"},
+		{"Control", options.ControlFilename, "control", "The QOF indicators measuring the control of each condition, at the rates practices achieved against which people with it are marked as controlled"},
+		{"Backlog", options.BacklogFilename, "backlog", "The share of a register overdue a diagnostic service, and the need for it and capacity each year, from which backlogs are estimated"},
+		{"Smoking", options.SmokingFilename, "smoking", "Smoking status by age and sex, and the relative risk of conditions given it"},
+		{"Practice smoking", options.PracticeSmokingFilename, "practice-smoking", "Reported smoking prevalence by practice, to which simulated smoking status is matched"},
+		{"BMI", options.BMIFilename, "bmi", "BMI by age and sex, and the relative risk of conditions for those who are obese"},
+		{"Measurements", options.MeasurementsFilename, "measurements", "Clinical measurements of people with conditions, against which QOF achievement is simulated"},
+		{"Segments", options.SegmentsFilename, "segments", "Frailty and end of life, by which people are placed in population health segments"},
+		{"Benefits", options.BenefitsFilename, "benefits", "Who claims DWP benefits, given the claimants in their home LSOA"},
+		{"Employment", options.EmploymentFilename, "employment", "Who has each economic activity status and occupation class, given census counts"},
+		{"Admissions", options.AdmissionsFilename, "admissions", "Rates of hospital admission, from which secondary care demand is estimated"},
+		{"Demand", options.DemandFilename, "demand-surface", "Annual activity by condition, from which demand surfaces and projected activity are estimated"},
+		{"Dispensing", options.DispensingFilename, "pharmacies", "Annual prescription items by condition, dispensed by the pharmacy nearest each person's home, as nominations aren't published"},
+		{"Costs", options.CostsFilename, "costs", "Unit costs of simulated activity"},
+		{"Travel", options.TravelAssumptionsFilename, "travel", "Mode shares and speeds, from which patient travel and emissions are estimated"},
+	} {
+		if m.filename != "" {
+			a.Add(area, m.name, m.filename, fromFlag(m.flag), m.description)
+		}
+	}
+	if options.ProjectYears > 0 {
+		a.Add(area, "Projection", fmt.Sprintf("%s, %d years", options.ProjectionFilename, options.ProjectYears), fromFlag("project-years")+" and "+fromFlag("projection"), "Mortality, fertility and net migration by age and sex, with which residents are projected forward each year. Arrivals are taken to be like existing residents of the same LSOA, and newborns register with their mother's practice")
+	}
+	return a
+}
+
+// WriteJSON writes the register to assumptions.json
+func (a Assumptions) WriteJSON(outputDirectory string) error {
+	return writeJSONOutput(filepath.Join(outputDirectory, "assumptions.json"), a, true)
+}
+
+// WriteMarkdown writes the register to assumptions.md, with a table for
+// each area, for review by people who don't read the source.
+func (a Assumptions) WriteMarkdown(scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "assumptions.md"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# Assumptions: %s\n\n", scenario)
+	fmt.Fprintf(w, "The assumptions made by this run, from built in constants, flags and the models read.\n")
+	areas := make([]string, 0)
+	byArea := make(map[string][]Assumption)
+	for _, assumption := range a {
+		if _, ok := byArea[assumption.Area]; !ok {
+			areas = append(areas, assumption.Area)
+		}
+		byArea[assumption.Area] = append(byArea[assumption.Area], assumption)
+	}
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	for _, area := range areas {
+		fmt.Fprintf(w, "\n## %s\n\n", area)
+		fmt.Fprintf(w, "| Assumption | Value | Source | Description |\n")
+		fmt.Fprintf(w, "|---|---|---|---|\n")
+		for _, assumption := range byArea[area] {
+			fmt.Fprintf(w, "| %s | %s | %s | %s |\n", escape.Replace(assumption.Name), escape.Replace(assumption.Value), escape.Replace(assumption.Source), escape.Replace(assumption.Description))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const AuditFilename = "audit.json"
+
+// ConditionDecision records how a condition model decided whether a
+// person has a condition.
+type ConditionDecision struct {
+	Condition string `json:"condition"`
+	// The condition model that made the decision, like chain-rule
+	Model string `json:"model"`
+	// The prevalence on which the probability is based, like dm| for the
+	// marginal prevalence of diabetes by age and sex, or dm|hyp for the
+	// prevalence of diabetes given hypertension
+	Given string `json:"given,omitempty"`
+	// The probability of assigning the condition, after bias and risk
+	Probability float64 `json:"probability"`
+	// The practice's calibration bias for the condition
+	Bias float64 `json:"bias,omitempty"`
+	// The relative risk from smoking and BMI
+	Risk float64 `json:"risk,omitempty"`
+	// The random number drawn, below which the condition is assigned, or
+	// 0 if none was drawn for the condition alone
+	Draw float64 `json:"draw,omitempty"`
+	// assigned, not assigned, implied, if an earlier condition implied
+	// it, or excluded, if an earlier condition excluded it
+	Outcome string `json:"outcome"`
+}
+
+// ConditionAudit collects the decisions of a condition model for a person.
+// Models are given a nil ConditionAudit for people who aren't audited,
+// for which Record does nothing.
+type ConditionAudit struct {
+	Decisions []ConditionDecision
+}
+
+func (c *ConditionAudit) Record(d ConditionDecision) {
+	if c != nil {
+		c.Decisions = append(c.Decisions, d)
+	}
+}
+
+// Enabled returns true if decisions are recorded, so that models can skip
+// computing what's only needed for the audit.
+func (c *ConditionAudit) Enabled() bool {
+	return c != nil
+}
+
+// RecordSkipped records that condition wasn't considered for p, since an
+// earlier condition implied it, or excluded it.
+func (c *ConditionAudit) RecordSkipped(p *Person, condition QOFCondition, model string) {
+	outcome := "excluded"
+	if p.Conditions.Contains(condition) {
+		outcome = "implied"
+	}
+	c.Record(ConditionDecision{Condition: condition.String(), Model: model, Outcome: outcome})
+}
+
+func conditionOutcome(assigned bool) string {
+	if assigned {
+		return "assigned"
+	}
+	return "not assigned"
+}
+
+// GPCandidate is a practice from which a person's practice was chosen,
+// with the weights that gave its probability.
+type GPCandidate struct {
+	Practice       string  `json:"practice"`
+	DistanceM      float64 `json:"distance_m"`
+	DistanceWeight float64 `json:"distance_weight"`
+	ListSizeWeight float64 `json:"list_size_weight"`
+	Probability    float64 `json:"probability"`
+}
+
+// GPAudit records the practice with which a person is registered, and
+// why.
+type GPAudit struct {
+	// The practice, or empty if the person is unregistered
+	Practice string `json:"practice"`
+	Reason   string `json:"reason"`
+	// The parameters used for the person's home LSOA
+	RadiusM        float64 `json:"radius_m"`
+	EqualDistanceM float64 `json:"equal_distance_m"`
+	// The practices near the person's home LSOA, with the probability of
+	// choosing each given by the assignment model, before any calibration
+	Candidates []GPCandidate `json:"candidates"`
+}
+
+// PersonAudit records why a person sampled for the audit was assigned
+// their practice, and each condition.
+type PersonAudit struct {
+	ID         int                 `json:"id"`
+	Sex        string              `json:"sex"`
+	Age        int                 `json:"age"`
+	Home       string              `json:"home"`
+	GP         GPAudit             `json:"gp"`
+	Conditions []ConditionDecision `json:"conditions"`
+
+	conditions ConditionAudit
+}
+
+// Audits are keyed by person ID
+type Audits map[int]*PersonAudit
+
+// Conditions returns the audit to which the decisions of condition models
+// for p are recorded, or nil if p isn't audited.
+func (a Audits) Conditions(p *Person) *ConditionAudit {
+	if audit, ok := a[p.ID]; ok {
+		return &audit.conditions
+	}
+	return nil
+}
+
+// sampleAudits returns the audits of n people living in homes, sampled at
+// random, or all of them, if there are fewer, recording why each was
+// assigned their practice. Condition decisions are recorded once
+// conditions are assigned.
+func sampleAudits(people []Person, homes LSOASet, n int, lsoas map[LSOACode]*LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, careHomes map[CareHomeID]*CareHome, options *PopulationOptions) Audits {
+	residents := make([]int, 0, len(people))
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			residents = append(residents, i)
+		}
+	}
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	rng.Shuffle(len(residents), func(i, j int) {
+		residents[i], residents[j] = residents[j], residents[i]
+	})
+	if len(residents) > n {
+		residents = residents[0:n]
+	}
+	steps := []string{options.Assignment.String() + " assignment"}
+	if options.RegistrationCalibrationIterations > 0 {
+		steps = append(steps, "registration calibration")
+	}
+	if options.CrossBorderCalibration {
+		steps = append(steps, "cross border calibration")
+	}
+	audits := make(Audits)
+	for _, i := range residents {
+		p := &people[i]
+		audits[p.ID] = &PersonAudit{
+			ID:   p.ID,
+			Sex:  p.Sex.String(),
+			Age:  p.Age,
+			Home: p.Home.String(),
+			GP:   auditGP(p, lsoas[p.Home], nearbyGPs, gps, careHomes, options.Rurality, options.Parameters, steps),
+		}
+	}
+	return audits
+}
+
+// auditGP records why p was registered with their practice, with the
+// candidates near their home, and the probabilities with which the
+// assignment model, before calibration, chooses each.
+func auditGP(p *Person, lsoa *LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, careHomes map[CareHomeID]*CareHome, rurality *RuralityModel, parameters SimulationParameters, steps []string) GPAudit {
+	assignment := rurality.Parameters(lsoa, parameters)
+	audit := GPAudit{RadiusM: rurality.SearchRadiusM(parameters), EqualDistanceM: assignment.EqualDistanceM, Candidates: []GPCandidate{}}
+	if assignment.RadiusM > 0.0 {
+		audit.RadiusM = assignment.RadiusM
+	}
+	filtered, distances, sizes := nearbyGPWeights(nearbyGPs[p.Home], gps, assignment, nil)
+	probabilities := choiceProbabilities(distances, sizes)
+	candidate := false
+	for i, gp := range filtered {
+		audit.Candidates = append(audit.Candidates, GPCandidate{
+			Practice:       gp.Practice.String(),
+			DistanceM:      gp.DistanceM,
+			DistanceWeight: distances[i],
+			ListSizeWeight: sizes[i],
+			Probability:    probabilities[i],
+		})
+		candidate = candidate || gp.Practice == p.GP
+	}
+	if p.GP == GPPracticeCodeInvalid {
+		if len(filtered) == 0 {
+			audit.Reason = "unregistered, since no practice with a list is near the home LSOA"
+		} else {
+			audit.Reason = "unregistered by " + strings.Join(steps, ", then ")
+		}
+		return audit
+	}
+	audit.Practice = p.GP.String()
+	if home, ok := careHomes[p.CareHome]; ok && home.GP == p.GP {
+		audit.Reason = fmt.Sprintf("registered with the practice serving care home %s", home.ID)
+	} else if candidate {
+		audit.Reason = "chosen from the candidates by " + strings.Join(steps, ", then ")
+	} else {
+		audit.Reason = "not among the candidates, so reassigned by a step of " + strings.Join(steps, ", then ")
+	}
+	return audit
+}
+
+// writeAudits writes audit.json, with the audit of each sampled person,
+// ordered by id.
+func writeAudits(audits Audits, outputDirectory string) error {
+	people := make([]*PersonAudit, 0, len(audits))
+	for _, audit := range audits {
+		audit.Conditions = audit.conditions.Decisions
+		if audit.Conditions == nil {
+			audit.Conditions = []ConditionDecision{}
+		}
+		people = append(people, audit)
+	}
+	sort.Slice(people, func(i, j int) bool { return people[i].ID < people[j].ID })
+	return writeJSONOutput(filepath.Join(outputDirectory, AuditFilename), people, true)
+}
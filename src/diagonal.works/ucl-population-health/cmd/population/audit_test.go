@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditGP(t *testing.T) {
+	nearbyGPs := NearbyGPs{
+		"E01000001": {
+			{Practice: "G1", DistanceM: 500.0, TravelMinutes: math.NaN()},
+			{Practice: "G2", DistanceM: 1500.0, TravelMinutes: math.NaN()},
+			// Without a list, so never chosen
+			{Practice: "G3", DistanceM: 200.0, TravelMinutes: math.NaN()},
+		},
+	}
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", ListSize: 10000},
+		"G2": {Code: "G2", ListSize: 10000},
+		"G3": {Code: "G3"},
+		"G4": {Code: "G4", ListSize: 10000},
+	}
+	careHomes := map[CareHomeID]*CareHome{"C1": {ID: "C1", GP: "G4"}}
+	steps := []string{"probabilistic assignment", "registration calibration"}
+	tests := []struct {
+		name     string
+		person   Person
+		home     LSOACode
+		practice string
+		reason   string
+	}{
+		{"chosen", Person{Home: "E01000001", GP: "G2"}, "E01000001", "G2", "chosen from the candidates by probabilistic assignment, then registration calibration"},
+		{"care home", Person{Home: "E01000001", GP: "G4", CareHome: "C1"}, "E01000001", "G4", "registered with the practice serving care home C1"},
+		{"reassigned", Person{Home: "E01000001", GP: "G4"}, "E01000001", "G4", "not among the candidates, so reassigned by a step of probabilistic assignment, then registration calibration"},
+		{"unregistered", Person{Home: "E01000001", GP: GPPracticeCodeInvalid}, "E01000001", "", "unregistered by probabilistic assignment, then registration calibration"},
+		{"no practices", Person{Home: "E01000002", GP: GPPracticeCodeInvalid}, "E01000002", "", "unregistered, since no practice with a list is near the home LSOA"},
+	}
+	parameters := DefaultSimulationParameters()
+	for _, test := range tests {
+		audit := auditGP(&test.person, &LSOA{Code: test.home}, nearbyGPs, gps, careHomes, nil, parameters, steps)
+		if audit.Practice != test.practice || audit.Reason != test.reason {
+			t.Errorf("%s: expected %q, %q, found %q, %q", test.name, test.practice, test.reason, audit.Practice, audit.Reason)
+		}
+	}
+
+	p := Person{Home: "E01000001", GP: "G1"}
+	audit := auditGP(&p, &LSOA{Code: "E01000001"}, nearbyGPs, gps, careHomes, nil, parameters, steps)
+	if audit.RadiusM != parameters.GPLSOANearbyRadiusM || audit.EqualDistanceM != parameters.GPPracticeEqualDistanceLimitM {
+		t.Errorf("expected the simulation parameters without a rurality model, found %fm and %fm", audit.RadiusM, audit.EqualDistanceM)
+	}
+	// The probabilities recorded are those with which the assignment model
+	// chooses practices
+	filtered, probabilities := nearbyGPProbabilities(nearbyGPs["E01000001"], gps, AssignmentParameters{}.withDefaults(parameters), nil)
+	if len(audit.Candidates) != len(filtered) {
+		t.Fatalf("expected %d candidates, found %d", len(filtered), len(audit.Candidates))
+	}
+	for i, c := range audit.Candidates {
+		if c.Practice != filtered[i].Practice.String() || math.Abs(c.Probability-probabilities[i]) > 1e-9 {
+			t.Errorf("expected %s with probability %f, found %s with %f", filtered[i].Practice, probabilities[i], c.Practice, c.Probability)
+		}
+	}
+	// G2 is twice the equal distance away, so half as likely as G1
+	if math.Abs(audit.Candidates[0].Probability-2.0/3.0) > 1e-9 {
+		t.Errorf("expected G1 to be chosen with probability 2/3, found %f", audit.Candidates[0].Probability)
+	}
+
+	rurality := &RuralityModel{Urban: AssignmentParameters{RadiusM: 1000.0, EqualDistanceM: 250.0}}
+	audit = auditGP(&p, &LSOA{Code: "E01000001"}, nearbyGPs, gps, careHomes, rurality, parameters, steps)
+	if audit.RadiusM != 1000.0 || audit.EqualDistanceM != 250.0 || len(audit.Candidates) != 1 {
+		t.Errorf("expected the urban parameters of the rurality model, found %fm, %fm and %d candidates", audit.RadiusM, audit.EqualDistanceM, len(audit.Candidates))
+	}
+}
+
+func TestSampleAudits(t *testing.T) {
+	people := make([]Person, 0)
+	for i := 0; i < 20; i++ {
+		home := LSOACode("E01000001")
+		if i%2 == 1 {
+			home = "E01000002"
+		}
+		people = append(people, Person{ID: i, Home: home, GP: "G1"})
+	}
+	homes := LSOASet{"E01000001": struct{}{}}
+	lsoas := map[LSOACode]*LSOA{"E01000001": {Code: "E01000001"}, "E01000002": {Code: "E01000002"}}
+	nearbyGPs := NearbyGPs{"E01000001": {{Practice: "G1", DistanceM: 100.0, TravelMinutes: math.NaN()}}}
+	gps := map[GPPracticeCode]*GPPractice{"G1": {Code: "G1", ListSize: 1000}}
+	options := &PopulationOptions{Parameters: DefaultSimulationParameters(), RegistrationCalibrationIterations: 5}
+
+	tests := []struct {
+		n        int
+		expected int
+	}{
+		{4, 4},
+		// Only the 10 people living in homes can be sampled
+		{15, 10},
+	}
+	for _, test := range tests {
+		audits := sampleAudits(people, homes, test.n, lsoas, nearbyGPs, gps, nil, options)
+		if len(audits) != test.expected {
+			t.Errorf("expected %d audits, found %d", test.expected, len(audits))
+		}
+		for id, audit := range audits {
+			if audit.Home != "E01000001" || audit.ID != id {
+				t.Errorf("expected only people living in homes, found %d in %s", audit.ID, audit.Home)
+			}
+			if !strings.HasSuffix(audit.GP.Reason, "then registration calibration") {
+				t.Errorf("expected registration calibration among the steps, found %q", audit.GP.Reason)
+			}
+		}
+	}
+}
+
+func TestWriteAudits(t *testing.T) {
+	audits := Audits{
+		7: {ID: 7, GP: GPAudit{Candidates: []GPCandidate{}}},
+		3: {ID: 3, GP: GPAudit{Candidates: []GPCandidate{}}},
+	}
+	audits.Conditions(&Person{ID: 3}).Record(ConditionDecision{Condition: "hyp", Model: "chain-rule", Outcome: "assigned"})
+	// People who aren't audited have no audit, to which nothing is recorded
+	if c := audits.Conditions(&Person{ID: 5}); c != nil || c.Enabled() {
+		t.Errorf("expected no audit for a person who wasn't sampled")
+	}
+	audits.Conditions(&Person{ID: 5}).Record(ConditionDecision{Condition: "hyp"})
+
+	directory := t.TempDir()
+	if err := writeAudits(audits, directory); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(directory, AuditFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []PersonAudit
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || written[0].ID != 3 || written[1].ID != 7 {
+		t.Fatalf("expected audits for 3 and 7 in order, found %+v", written)
+	}
+	if len(written[0].Conditions) != 1 || written[0].Conditions[0].Outcome != "assigned" {
+		t.Errorf("expected the decision recorded for 3, found %+v", written[0].Conditions)
+	}
+	if written[1].Conditions == nil {
+		t.Errorf("expected an empty list of decisions for 7, rather than null")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceModel is a diagnostic service needed by people with a condition,
+// like spirometry for COPD, given as the share of the register overdue a
+// test, the tests needed each year by those on the register, and for new
+// diagnoses, and the tests practices can provide, from which the backlog
+// of each practice, and the time to clear it, are estimated.
+type ServiceModel struct {
+	// The name of the service, used in the name of its output
+	Service     string
+	Description string
+	Condition   string
+	// The share of the register overdue a test, like those whose
+	// diagnosis wasn't confirmed while spirometry was suspended during
+	// the COVID-19 pandemic
+	Overdue float64
+	// Tests needed each year per person on the register, for review
+	Annual float64
+	// Tests needed per new diagnosis, to confirm it, counted only when new
+	// diagnoses are estimated, with incidence
+	PerDiagnosis float64 `yaml:"perdiagnosis"`
+	// Tests each practice can provide each year per 1,000 registered
+	// patients, unless given for the practice
+	Capacity float64
+	// Tests each year that particular practices can provide, keyed by
+	// practice code, in place of Capacity
+	PracticeCapacity map[string]float64 `yaml:"practicecapacity"`
+
+	condition QOFCondition
+}
+
+func readServiceModel(filename string) (*ServiceModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open service model: %s", err)
+	}
+	defer f.Close()
+	var model ServiceModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read service model: %s", err)
+	}
+	if model.Service == "" {
+		return nil, fmt.Errorf("service model needs a service name")
+	}
+	if model.condition = QOFConditionFromString(model.Condition); model.condition == QOFConditionInvalid {
+		return nil, fmt.Errorf("unknown condition %q for %s", model.Condition, model.Service)
+	}
+	if model.Overdue < 0.0 || model.Overdue > 1.0 {
+		return nil, fmt.Errorf("%s: service model needs an overdue share between 0 and 1", model.Service)
+	}
+	if model.Annual < 0.0 || model.PerDiagnosis < 0.0 || model.Capacity < 0.0 {
+		return nil, fmt.Errorf("%s: service model needs non-negative need and capacity", model.Service)
+	}
+	for code, capacity := range model.PracticeCapacity {
+		if capacity < 0.0 {
+			return nil, fmt.Errorf("%s: negative capacity for %s", model.Service, code)
+		}
+	}
+	return &model, nil
+}
+
+// Filename returns the name of the file to which backlogs are written
+func (s *ServiceModel) Filename() string {
+	return fmt.Sprintf("backlog-%s.csv", s.Service)
+}
+
+func (s *ServiceModel) warnUnsimulated(simulated []QOFCondition) {
+	var included QOFConditions
+	for _, c := range simulated {
+		included.Add(c)
+	}
+	if !included.Contains(s.condition) {
+		Warningf("  %s isn't simulated, so nobody will need %s", s.condition, s.Service)
+	}
+}
+
+// PracticeBacklog is the need for a service among the patients of a
+// practice, and the backlog left by its capacity.
+type PracticeBacklog struct {
+	Code     GPPracticeCode
+	Name     string
+	Patients int
+	Register int
+	// Expected new diagnoses each year, or 0 without incidence
+	NewDiagnoses float64
+	// Tests overdue
+	Backlog float64
+	// Tests needed, and provided, each year
+	Need     float64
+	Capacity float64
+}
+
+// Shortfall returns the tests needed each year that capacity can't
+// provide, by which the backlog grows.
+func (b *PracticeBacklog) Shortfall() float64 {
+	return math.Max(0.0, b.Need-b.Capacity)
+}
+
+// YearsToClear returns the years needed to clear the backlog with the
+// capacity left over after each year's need, or false if there's none
+// left over, and the backlog isn't cleared.
+func (b *PracticeBacklog) YearsToClear() (float64, bool) {
+	if b.Backlog <= 0.0 {
+		return 0.0, true
+	} else if b.Capacity <= b.Need {
+		return 0.0, false
+	}
+	return b.Backlog / (b.Capacity - b.Need), true
+}
+
+// estimateBacklogs returns the backlog of the service, the need for it,
+// and its capacity, for each of practices, in order of practice code, from
+// the simulated register of its patients, and, if given, the expected new
+// diagnoses of the condition among them. Practices that can't meet the
+// year's need, and so never clear their backlog, are logged.
+func estimateBacklogs(practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, byPractice map[GPPracticeCode][]*Person, diagnoses []*NewDiagnoses, model *ServiceModel) []*PracticeBacklog {
+	newDiagnoses := make(map[GPPracticeCode]float64)
+	for _, d := range diagnoses {
+		if d.Area == NewDiagnosesAreaPractice && d.Condition == model.condition {
+			newDiagnoses[GPPracticeCode(d.Code)] = d.Expected
+		}
+	}
+	codes := make([]GPPracticeCode, 0, len(practices))
+	for code := range practices {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	backlogs := make([]*PracticeBacklog, 0, len(codes))
+	need, capacity, backlog := 0.0, 0.0, 0.0
+	uncleared := 0
+	for _, code := range codes {
+		b := &PracticeBacklog{Code: code, Name: gps[code].Name, Patients: len(byPractice[code]), NewDiagnoses: newDiagnoses[code]}
+		for _, p := range byPractice[code] {
+			if p.Conditions.Contains(model.condition) {
+				b.Register++
+			}
+		}
+		b.Backlog = model.Overdue * float64(b.Register)
+		b.Need = model.Annual*float64(b.Register) + model.PerDiagnosis*b.NewDiagnoses
+		if c, ok := model.PracticeCapacity[code.String()]; ok {
+			b.Capacity = c
+		} else {
+			b.Capacity = model.Capacity * float64(b.Patients) / 1000.0
+		}
+		need += b.Need
+		capacity += b.Capacity
+		backlog += b.Backlog
+		if _, ok := b.YearsToClear(); !ok {
+			uncleared++
+		}
+		backlogs = append(backlogs, b)
+	}
+	log.Printf("  %s: backlog: %.0f", model.Service, backlog)
+	log.Printf("  %s: need: %.0f capacity: %.0f a year", model.Service, need, capacity)
+	if uncleared > 0 {
+		Warningf("  %s: %d practices can't meet the need of each year, so their backlogs grow", model.Service, uncleared)
+	}
+	return backlogs
+}
+
+// writeBacklogs writes backlog-<service>.csv, with the register of each
+// practice, its backlog, the tests it needs and can provide each year, and
+// the years in which the capacity left over each year would clear the
+// backlog, empty where it wouldn't.
+func writeBacklogs(backlogs []*PracticeBacklog, model *ServiceModel, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, model.Filename()))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "code", "name", "service", "condition", "patients", "register", "new_diagnoses", "backlog", "annual_need", "annual_capacity", "annual_shortfall", "years_to_clear"})
+	for _, b := range backlogs {
+		clear := ""
+		if years, ok := b.YearsToClear(); ok {
+			clear = fmt.Sprintf("%f", years)
+		}
+		w.Write([]string{scenario, b.Code.String(), b.Name, model.Service, model.condition.String(), strconv.Itoa(b.Patients), strconv.Itoa(b.Register), fmt.Sprintf("%f", b.NewDiagnoses), fmt.Sprintf("%f", b.Backlog), fmt.Sprintf("%f", b.Need), fmt.Sprintf("%f", b.Capacity), fmt.Sprintf("%f", b.Shortfall()), clear})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// AssignmentMode decides how people are assigned to practices
+type AssignmentMode int
+
+const (
+	// Each person independently chooses a nearby practice, more likely
+	// closer, and with a larger list, so that simulated list sizes only
+	// match those reported on average
+	AssignmentProbabilistic AssignmentMode = iota
+	// The number of people from each LSOA assigned to each nearby
+	// practice is solved for, so that the simulated list size of each ICB
+	// practice matches its reported list size
+	AssignmentBalanced
+)
+
+func (a AssignmentMode) String() string {
+	switch a {
+	case AssignmentProbabilistic:
+		return "probabilistic"
+	case AssignmentBalanced:
+		return "balanced"
+	}
+	return "invalid"
+}
+
+func AssignmentModeFromString(s string) (AssignmentMode, error) {
+	for a := AssignmentProbabilistic; a <= AssignmentBalanced; a++ {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return AssignmentProbabilistic, fmt.Errorf("unknown assignment %q, expected probabilistic or balanced", s)
+}
+
+const (
+	// The maximum number of times the LSOA x practice matrix is scaled to
+	// match reported list sizes, and then LSOA populations
+	BalancedAssignmentMaxIterations = 200
+	// The fit stops early once every practice is within this many people
+	// of its reported list size
+	BalancedAssignmentTolerance = 0.5
+)
+
+// BalancedAssignment summarises the fit of a balanced assignment
+type BalancedAssignment struct {
+	Iterations int
+	// The people reassigned to a different practice
+	Moved int
+	// The sum of the differences between the simulated and reported list
+	// sizes of ICB practices that couldn't be closed, since there weren't
+	// enough people near a practice, or too many
+	Unmet int
+}
+
+// balanceAssignment reassigns the people living in homes between the
+// practices near their home LSOA, so that the simulated list size of each
+// of practices matches its reported list size. The expected number of
+// people from each LSOA choosing each practice, as assigned
+// probabilistically, seeds a matrix that is fitted by iterative
+// proportional fitting to the LSOA populations, and the reported list
+// sizes. Each LSOA's row is then rounded to whole people, and remaining
+// differences closed by moving people between the practices near a common
+// LSOA. Practices outside the ICB aren't constrained, and take up the
+// people left over in buffer LSOAs. Care home residents, who are
+// registered with the practice serving their home, count towards list
+// sizes, but aren't moved.
+func balanceAssignment(people []Person, homes LSOASet, practices GPPracticeCodeSet, lsoas map[LSOACode]*LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, rurality *RuralityModel, parameters SimulationParameters) *BalancedAssignment {
+	b := &BalancedAssignment{}
+	movable := make(map[LSOACode][]*Person)
+	pinned := make(map[GPPracticeCode]int)
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		if p.CareHome != CareHomeIDInvalid {
+			if p.GP != GPPracticeCodeInvalid {
+				pinned[p.GP]++
+			}
+		} else if p.GP != GPPracticeCodeInvalid {
+			movable[p.Home] = append(movable[p.Home], p)
+		}
+	}
+	targets := make(map[GPPracticeCode]float64)
+	for code := range practices {
+		if gp, ok := gps[code]; ok && gp.ListSize > 0 {
+			targets[code] = math.Max(0.0, float64(gp.ListSize-pinned[code]))
+		}
+	}
+
+	// One row for each LSOA, with a cell for each practice that can be
+	// chosen from it
+	type row struct {
+		lsoa      LSOACode
+		n         float64
+		practices []GPPracticeCode
+		cells     []float64
+		counts    []int
+	}
+	codes := make([]LSOACode, 0, len(movable))
+	for code := range movable {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	rows := make([]*row, 0, len(codes))
+	for _, code := range codes {
+		filtered, p := nearbyGPProbabilities(nearbyGPs[code], gps, rurality.Parameters(lsoas[code], parameters), nil)
+		if len(filtered) == 0 {
+			continue
+		}
+		r := &row{lsoa: code, n: float64(len(movable[code])), practices: make([]GPPracticeCode, len(filtered)), cells: make([]float64, len(filtered))}
+		for i, gp := range filtered {
+			r.practices[i] = gp.Practice
+			r.cells[i] = p[i] * r.n
+		}
+		rows = append(rows, r)
+	}
+
+	columns := make(map[GPPracticeCode]float64)
+	for b.Iterations < BalancedAssignmentMaxIterations {
+		b.Iterations++
+		for code := range columns {
+			columns[code] = 0.0
+		}
+		for _, r := range rows {
+			for i, code := range r.practices {
+				columns[code] += r.cells[i]
+			}
+		}
+		worst := 0.0
+		for code, target := range targets {
+			worst = math.Max(worst, math.Abs(columns[code]-target))
+		}
+		if worst < BalancedAssignmentTolerance {
+			break
+		}
+		for _, r := range rows {
+			total := 0.0
+			for i, code := range r.practices {
+				if target, ok := targets[code]; ok && columns[code] > 0.0 {
+					r.cells[i] *= target / columns[code]
+				}
+				total += r.cells[i]
+			}
+			if total > 0.0 {
+				for i := range r.cells {
+					r.cells[i] *= r.n / total
+				}
+			}
+		}
+	}
+
+	// Round each row to whole people, giving those left over to the cells
+	// with the largest remainders
+	assigned := make(map[GPPracticeCode]int)
+	for _, r := range rows {
+		r.counts = make([]int, len(r.cells))
+		left := int(r.n)
+		order := make([]int, len(r.cells))
+		for i, x := range r.cells {
+			r.counts[i] = int(math.Floor(x))
+			left -= r.counts[i]
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return r.cells[order[i]]-math.Floor(r.cells[order[i]]) > r.cells[order[j]]-math.Floor(r.cells[order[j]])
+		})
+		for i := 0; left > 0; i = (i + 1) % len(order) {
+			r.counts[order[i]]++
+			left--
+		}
+		for i, code := range r.practices {
+			assigned[code] += r.counts[i]
+		}
+	}
+
+	// Close the remaining differences by moving people from practices with
+	// too many to those with too few, or from or to unconstrained
+	// practices, within the same LSOA
+	excess := func(code GPPracticeCode) (int, bool) {
+		target, ok := targets[code]
+		return assigned[code] - int(math.Round(target)), ok
+	}
+	for moved := true; moved; {
+		moved = false
+		for _, r := range rows {
+			for from := range r.practices {
+				for to := range r.practices {
+					if from == to || r.counts[from] == 0 {
+						continue
+					}
+					fromExcess, fromConstrained := excess(r.practices[from])
+					toExcess, toConstrained := excess(r.practices[to])
+					if !fromConstrained && !toConstrained {
+						continue
+					}
+					n := r.counts[from]
+					if fromConstrained {
+						n = minInt(n, fromExcess)
+					}
+					if toConstrained {
+						n = minInt(n, -toExcess)
+					}
+					if n > 0 {
+						r.counts[from] -= n
+						r.counts[to] += n
+						assigned[r.practices[from]] -= n
+						assigned[r.practices[to]] += n
+						moved = true
+					}
+				}
+			}
+		}
+	}
+	for code := range targets {
+		e, _ := excess(code)
+		if e < 0 {
+			e = -e
+		}
+		b.Unmet += e
+	}
+
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for _, r := range rows {
+		residents := movable[r.lsoa]
+		rng.Shuffle(len(residents), func(i, j int) { residents[i], residents[j] = residents[j], residents[i] })
+		next := 0
+		for i, code := range r.practices {
+			for j := 0; j < r.counts[i]; j++ {
+				if residents[next].GP != code {
+					residents[next].GP = code
+					b.Moved++
+				}
+				next++
+			}
+		}
+	}
+	for _, gp := range gps {
+		gp.SimulatedListSize = 0
+	}
+	for i := range people {
+		if people[i].GP != GPPracticeCodeInvalid {
+			gps[people[i].GP].SimulatedListSize++
+		}
+	}
+	log.Printf("  iterations: %d", b.Iterations)
+	log.Printf("  people moved: %d", b.Moved)
+	if b.Unmet > 0 {
+		Warningf("  balanced assignment: list sizes of ICB practices differ from those reported by %d patients in total", b.Unmet)
+	}
+	return b
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBalanceAssignment(t *testing.T) {
+	near := func(codes ...GPPracticeCode) []NearbyGP {
+		nearby := make([]NearbyGP, len(codes))
+		for i, code := range codes {
+			nearby[i] = NearbyGP{Practice: code, DistanceM: 100.0 * float64(i+1), TravelMinutes: math.NaN()}
+		}
+		return nearby
+	}
+	tests := []struct {
+		name      string
+		residents map[LSOACode]int
+		nearbyGPs NearbyGPs
+		// Practices in the ICB, whose list sizes are met
+		practices GPPracticeCodeSet
+		listSizes map[GPPracticeCode]int
+		careHome  int
+		expected  map[GPPracticeCode]int
+		unmet     int
+	}{
+		{
+			name:      "balanced",
+			residents: map[LSOACode]int{"E01000001": 60, "E01000002": 40},
+			nearbyGPs: NearbyGPs{"E01000001": near("G1", "G2"), "E01000002": near("G2")},
+			practices: GPPracticeCodeSet{"G1": struct{}{}, "G2": struct{}{}},
+			listSizes: map[GPPracticeCode]int{"G1": 30, "G2": 70},
+			expected:  map[GPPracticeCode]int{"G1": 30, "G2": 70},
+		},
+		{
+			// Only 60 people live near G1
+			name:      "capacity",
+			residents: map[LSOACode]int{"E01000001": 60},
+			nearbyGPs: NearbyGPs{"E01000001": near("G1")},
+			practices: GPPracticeCodeSet{"G1": struct{}{}},
+			listSizes: map[GPPracticeCode]int{"G1": 100},
+			expected:  map[GPPracticeCode]int{"G1": 60},
+			unmet:     40,
+		},
+		{
+			// G3 is outside the ICB, so takes those left over
+			name:      "unconstrained",
+			residents: map[LSOACode]int{"E01000001": 100},
+			nearbyGPs: NearbyGPs{"E01000001": near("G1", "G3")},
+			practices: GPPracticeCodeSet{"G1": struct{}{}},
+			listSizes: map[GPPracticeCode]int{"G1": 30, "G3": 1000},
+			expected:  map[GPPracticeCode]int{"G1": 30, "G3": 70},
+		},
+		{
+			// Care home residents count towards G1's list, but aren't
+			// moved
+			name:      "care homes",
+			residents: map[LSOACode]int{"E01000001": 50},
+			nearbyGPs: NearbyGPs{"E01000001": near("G1", "G2")},
+			practices: GPPracticeCodeSet{"G1": struct{}{}, "G2": struct{}{}},
+			listSizes: map[GPPracticeCode]int{"G1": 30, "G2": 30},
+			careHome:  10,
+			expected:  map[GPPracticeCode]int{"G1": 30, "G2": 30},
+		},
+	}
+	for _, test := range tests {
+		lsoas := make(map[LSOACode]*LSOA)
+		homes := make(LSOASet)
+		var people []Person
+		for code, n := range test.residents {
+			lsoas[code] = newUniformLSOA(code, n)
+			homes[code] = struct{}{}
+			for i := 0; i < n; i++ {
+				people = append(people, Person{Home: code, CareHome: CareHomeIDInvalid, GP: test.nearbyGPs[code][0].Practice})
+			}
+		}
+		for i := 0; i < test.careHome; i++ {
+			people = append(people, Person{Home: "E01000001", CareHome: "C1", GP: "G1"})
+		}
+		gps := make(map[GPPracticeCode]*GPPractice)
+		for code, size := range test.listSizes {
+			gps[code] = &GPPractice{Code: code, ListSize: size}
+		}
+		b := balanceAssignment(people, homes, test.practices, lsoas, test.nearbyGPs, gps, nil, DefaultSimulationParameters())
+		for code, expected := range test.expected {
+			if gps[code].SimulatedListSize != expected {
+				t.Errorf("%s: expected %d patients at %s, found %d", test.name, expected, code, gps[code].SimulatedListSize)
+			}
+		}
+		if b.Unmet != test.unmet {
+			t.Errorf("%s: expected %d unmet, found %d", test.name, test.unmet, b.Unmet)
+		}
+		for _, p := range people {
+			if p.CareHome != CareHomeIDInvalid {
+				if p.GP != "G1" {
+					t.Errorf("%s: expected care home residents to stay with G1, found %s", test.name, p.GP)
+				}
+				continue
+			}
+			found := false
+			for _, nearby := range test.nearbyGPs[p.Home] {
+				found = found || nearby.Practice == p.GP
+			}
+			if !found {
+				t.Errorf("%s: expected people to be assigned to a practice near %s, found %s", test.name, p.Home, p.GP)
+			}
+		}
+	}
+}
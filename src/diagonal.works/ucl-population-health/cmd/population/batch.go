@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"diagonal.works/b6"
+)
+
+// BatchRun is the outcome of simulating the population of one scope in a
+// batch.
+type BatchRun struct {
+	Scope           Scope
+	OutputDirectory string
+	Log             string
+	Duration        time.Duration
+	Err             error
+	Manifest        *Manifest
+}
+
+// readBatchScopes returns the scopes listed in filename, one per line,
+// skipping blank lines and those starting with #.
+func readBatchScopes(filename string) ([]Scope, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scopes := make([]Scope, 0)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		scope, err := ScopeFromString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, s.Err()
+}
+
+// batchScopeFlags give the scopes of a batch, shared by the batch and jobs
+// commands
+type batchScopeFlags struct {
+	scopes     *string
+	scopesFile *string
+	national   *bool
+}
+
+func addBatchScopeFlags(flags *flag.FlagSet) *batchScopeFlags {
+	return &batchScopeFlags{
+		scopes:     flags.String("scopes", "", "Comma separated scopes to simulate, eg icb:QMJ,borough:E09000007"),
+		scopesFile: flags.String("scopes-file", "", "File of scopes to simulate, one per line, with lines starting with # ignored"),
+		national:   flags.Bool("national", false, "Simulate every ICB in England, from the lsoa-icb dataset, rather than --scopes or --scopes-file"),
+	}
+}
+
+// read returns the scopes given by --scopes, followed by those of
+// --scopes-file, or every ICB in data with --national, in the geography
+// of censusYear, returning an error if there are none, or if one is given
+// more than once.
+func (b *batchScopeFlags) read(data DataManifest, censusYear int) ([]Scope, error) {
+	if *b.national {
+		if *b.scopes != "" || *b.scopesFile != "" {
+			return nil, fmt.Errorf("--national can't be used with --scopes or --scopes-file")
+		}
+		return nationalScopes(data, censusYear)
+	}
+	scopes := make([]Scope, 0)
+	if *b.scopes != "" {
+		var err error
+		if scopes, err = parseScopes(*b.scopes); err != nil {
+			return nil, err
+		}
+	}
+	if *b.scopesFile != "" {
+		fromFile, err := readBatchScopes(*b.scopesFile)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, fromFile...)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scopes, expected --scopes or --scopes-file")
+	}
+	return scopes, checkDistinctScopes(scopes)
+}
+
+// parseScopes parses comma separated scopes
+func parseScopes(s string) ([]Scope, error) {
+	scopes := make([]Scope, 0)
+	for _, s := range strings.Split(s, ",") {
+		scope, err := ScopeFromString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// checkDistinctScopes returns an error if a scope is given more than once
+func checkDistinctScopes(scopes []Scope) error {
+	seen := make(map[Scope]struct{})
+	for _, scope := range scopes {
+		if _, ok := seen[scope]; ok {
+			return fmt.Errorf("%s given more than once", scope)
+		}
+		seen[scope] = struct{}{}
+	}
+	return nil
+}
+
+// batchDirectory returns the name of the directory, within the output
+// directory of a batch, to which the population of scope is written.
+func batchDirectory(scope Scope) string {
+	return fmt.Sprintf("%s-%s", scope.Kind, scope.Code)
+}
+
+// runBatchScope simulates the population of run.Scope by running the
+// simulate command of this binary, with args, logging to run.Log. Runs are
+// separate processes, rather than calls to writePopulation, since a run
+// sets global state, like the random seed, and so that one failing doesn't
+// stop the others. If memoryLimitMiB is positive, it's given to the run as
+// GOMEMLIMIT, so that it collects garbage more aggressively as it nears it.
+func runBatchScope(run *BatchRun, args []string, cached string, memoryLimitMiB int) {
+	start := time.Now()
+	defer func() { run.Duration = time.Since(start) }()
+	executable, err := os.Executable()
+	if err != nil {
+		run.Err = err
+		return
+	}
+	l, err := os.OpenFile(run.Log, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		run.Err = err
+		return
+	}
+	defer l.Close()
+	args = append(append([]string{"simulate"}, args...), "--scope="+run.Scope.String(), "--output="+run.OutputDirectory, "--cached="+cached)
+	cmd := exec.Command(executable, args...)
+	if memoryLimitMiB > 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("GOMEMLIMIT=%dMiB", memoryLimitMiB))
+	}
+	cmd.Stdout = l
+	cmd.Stderr = l
+	if err := cmd.Run(); err != nil {
+		run.Err = fmt.Errorf("%s, see %s", err, run.Log)
+		return
+	}
+	run.Manifest, run.Err = readRunManifest(run.OutputDirectory)
+}
+
+// runBatch simulates the population of each scope, with at most parallel
+// running at once, sharing the cached directory, so that stages that don't
+// depend on the scope, like travel times, are only built once.
+func runBatch(scopes []Scope, parallel int, args []string, output string, cached string, memoryLimitMiB int) []*BatchRun {
+	runs := make([]*BatchRun, len(scopes))
+	for i, scope := range scopes {
+		runs[i] = &BatchRun{
+			Scope:           scope,
+			OutputDirectory: filepath.Join(output, batchDirectory(scope)),
+			Log:             filepath.Join(output, "logs", batchDirectory(scope)+".log"),
+		}
+	}
+	queue := make(chan *BatchRun)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	done := 0
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := range queue {
+				log.Printf("  %s: started", run.Scope)
+				runBatchScope(run, args, cached, memoryLimitMiB)
+				lock.Lock()
+				done++
+				if run.Err != nil {
+					Warningf("  %s: failed after %.0fs: %s", run.Scope, run.Duration.Seconds(), run.Err)
+				} else {
+					log.Printf("  %s: finished in %.0fs (%d of %d)", run.Scope, run.Duration.Seconds(), done, len(runs))
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, run := range runs {
+		queue <- run
+	}
+	close(queue)
+	wg.Wait()
+	return runs
+}
+
+// writeScopePopulations simulates the population of each of
+// options.Scopes in this process, reading the inputs that don't depend on
+// the scope, like national practice and LSOA data, only once. As with
+// batch, each is written to <kind>-<code> within options.OutputDirectory,
+// with a summary in batch.csv, and one failing doesn't stop the others.
+// With a single scope, it's written to options.OutputDirectory itself.
+func writeScopePopulations(world b6.World, allPrevalences AllPrevalences, options *PopulationOptions) error {
+	if len(options.Scopes) < 2 {
+		return writePopulation(world, allPrevalences, options)
+	}
+	if err := options.Profile.Check(options); err != nil {
+		return err
+	}
+	lock, err := LockDirectory(options.OutputDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	log.Printf("scopes: %d", len(options.Scopes))
+	timings := NewTimings(options.LogTimings)
+	timings.Start("read")
+	inputs, err := readPopulationInputs(world, allPrevalences, options, options.Scopes)
+	if err != nil {
+		return err
+	}
+	timings.end()
+	read := timings.Stages
+
+	runs := make([]*BatchRun, len(options.Scopes))
+	for i, scope := range options.Scopes {
+		run := &BatchRun{Scope: scope, OutputDirectory: filepath.Join(options.OutputDirectory, batchDirectory(scope))}
+		runs[i] = run
+		start := time.Now()
+		log.Printf("%s: started (%d of %d)", scope, i+1, len(runs))
+		scoped := *options
+		scoped.Scope = scope
+		scoped.OutputDirectory = run.OutputDirectory
+		if run.Err = os.MkdirAll(run.OutputDirectory, 0755); run.Err == nil {
+			timings := NewTimings(options.LogTimings)
+			// Every scope records the time taken to read the inputs they
+			// share, which isn't included in their total
+			timings.Stages = append(timings.Stages, read...)
+			if run.Err = simulateScope(world, inputs.forScope(), &scoped, timings); run.Err == nil {
+				run.Manifest, run.Err = readRunManifest(run.OutputDirectory)
+			}
+		}
+		run.Duration = time.Since(start)
+		if run.Err != nil {
+			Warningf("%s: failed after %.0fs: %s", scope, run.Duration.Seconds(), run.Err)
+		} else {
+			log.Printf("%s: finished in %.0fs", scope, run.Duration.Seconds())
+		}
+	}
+	if err := writeBatchSummary(runs, options.OutputDirectory); err != nil {
+		return err
+	}
+	if err := writeRunIndex(options.OutputDirectory); err != nil {
+		return err
+	}
+	failed := 0
+	for _, run := range runs {
+		if run.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scopes failed, see %s", failed, len(runs), filepath.Join(options.OutputDirectory, "batch.csv"))
+	}
+	return nil
+}
+
+// writeBatchSummary writes batch.csv, the status of the run of each
+// scope, and batch-outputs.csv, an index of the outputs of every scope
+// that succeeded, relative to the output directory of the batch, from
+// their manifests.
+func writeBatchSummary(runs []*BatchRun, output string) error {
+	f, err := os.OpenFile(filepath.Join(output, "batch.csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scope", "status", "seconds", "directory", "outputs", "error"})
+	for _, run := range runs {
+		status, outputs, message := "ok", 0, ""
+		if run.Err != nil {
+			status, message = "failed", run.Err.Error()
+		} else {
+			outputs = len(run.Manifest.Outputs)
+		}
+		w.Write([]string{run.Scope.String(), status, strconv.FormatFloat(run.Duration.Seconds(), 'f', 0, 64), batchDirectory(run.Scope), strconv.Itoa(outputs), message})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = os.OpenFile(filepath.Join(output, "batch-outputs.csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w = csv.NewWriter(f)
+	w.Write([]string{"scope", "filename", "description"})
+	for _, run := range runs {
+		if run.Err != nil {
+			continue
+		}
+		for _, o := range run.Manifest.Outputs {
+			w.Write([]string{run.Scope.String(), filepath.Join(batchDirectory(run.Scope), o.Filename), o.Description})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// batchMain implements population batch, which simulates the population
+// of many scopes, passing the arguments after its own flags to each run,
+// and returns an error if any failed.
+func batchMain(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	dataFlags := addDataFlags(flags)
+	scopesFlags := addBatchScopeFlags(flags)
+	parallelFlag := flags.Int("parallel", 2, "Number of scopes to simulate at once")
+	memoryLimitFlag := flags.Int("memory-limit-mib", 0, "Soft memory limit of each run, given to it as GOMEMLIMIT, or 0 for none. Together with --parallel, this bounds the memory used by the batch.")
+	mergeFlag := flags.Bool("merge", false, "Also concatenate each CSV output of every scope that succeeded into merged, with a scope column. Always done with --national.")
+	outputFlag := flags.String("output", "output", "Directory for the outputs of every scope, each written to <kind>-<code> within it, and the batch summary")
+	cachedFlag := flags.String("cached", "cached", "Directory for intermediate files, shared between scopes")
+	notify := addNotifyFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s batch [flags] [-- flags for simulate]\n\nSimulate the population of many scopes, with a summary of their outputs.\n\nFlags:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	scopes, err := scopesFlags.read(data, *dataFlags.censusYear)
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	} else if *parallelFlag < 1 {
+		return fmt.Errorf("batch: --parallel must be at least 1")
+	} else if *memoryLimitFlag < 0 {
+		return fmt.Errorf("batch: --memory-limit-mib must not be negative")
+	}
+	// Each run reads the same data as the batch, unless the flags after
+	// -- override it
+	runArgs := []string{"--data-manifest=" + *dataFlags.manifest, "--census-year=" + strconv.Itoa(*dataFlags.censusYear)}
+	if *dataFlags.lsoa11To21 != "" {
+		runArgs = append(runArgs, "--lsoa-2011-2021="+*dataFlags.lsoa11To21)
+	}
+	runArgs = append(runArgs, flags.Args()...)
+	if err := os.MkdirAll(filepath.Join(*outputFlag, "logs"), 0755); err != nil {
+		return err
+	}
+
+	return notify.run("batch", func(notification *RunNotification) error {
+		notification.OutputDirectory = *outputFlag
+		log.Printf("batch: scopes: %d parallel: %d", len(scopes), *parallelFlag)
+		runs := runBatch(scopes, *parallelFlag, runArgs, *outputFlag, *cachedFlag, *memoryLimitFlag)
+		if err := writeBatchSummary(runs, *outputFlag); err != nil {
+			return err
+		}
+		if err := writeRunIndex(*outputFlag); err != nil {
+			return err
+		}
+		if *mergeFlag || *scopesFlags.national {
+			log.Printf("batch: merge outputs")
+			if _, err := mergeBatchOutputs(runs, *outputFlag); err != nil {
+				return err
+			}
+		}
+		failed, people, residents := 0, 0.0, 0.0
+		for _, run := range runs {
+			if run.Err != nil {
+				failed++
+			} else {
+				people += run.Manifest.Metrics["people"]
+				residents += run.Manifest.Metrics["residents"]
+			}
+		}
+		notification.Metrics = map[string]float64{"scopes": float64(len(runs)), "succeeded": float64(len(runs) - failed), "failed": float64(failed), "people": people, "residents": residents}
+		log.Printf("batch: succeeded: %d failed: %d summary: %s", len(runs)-failed, failed, filepath.Join(*outputFlag, "batch.csv"))
+		if failed > 0 {
+			return fmt.Errorf("batch: %d of %d scopes failed", failed, len(runs))
+		}
+		return nil
+	})
+}
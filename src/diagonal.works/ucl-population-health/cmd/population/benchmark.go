@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// BenchmarkMetric is a practice level measure, compared with its
+// distribution across every practice in England in the national QOF and
+// appointments data.
+type BenchmarkMetric struct {
+	Name string
+	// Reported returns the value from published data, or false if the
+	// practice didn't report it
+	Reported func(gp *GPPractice) (float64, bool)
+	// Estimated returns the value estimated for the practice, by
+	// simulation, or from the prevalence model, or false if it isn't
+	// estimated
+	Estimated func(gp *GPPractice) (float64, bool)
+}
+
+// BenchmarkMetrics returns the metrics compared with their national
+// distribution, estimated from the synthetic population registered with
+// each practice.
+func BenchmarkMetrics(conditions []QOFCondition) []*BenchmarkMetric {
+	listSize := func(gp *GPPractice) (float64, bool) {
+		return float64(gp.SimulatedListSize), gp.SimulatedListSize > 0
+	}
+	return benchmarkMetrics(conditions, listSize, simulatedPrevalence)
+}
+
+// ExpectedBenchmarkMetrics returns the metrics compared with their
+// national distribution, with the prevalence of each condition estimated
+// as that expected from the registrations of the practice, as given by
+// expected, without simulation.
+func ExpectedBenchmarkMetrics(conditions []QOFCondition, expected map[GPPracticeCode]map[QOFCondition]float64) []*BenchmarkMetric {
+	listSize := func(gp *GPPractice) (float64, bool) { return 0.0, false }
+	prevalence := func(gp *GPPractice, condition QOFCondition) (float64, bool) {
+		p, ok := expected[gp.Code][condition]
+		return p, ok
+	}
+	return benchmarkMetrics(conditions, listSize, prevalence)
+}
+
+func benchmarkMetrics(conditions []QOFCondition, listSize func(gp *GPPractice) (float64, bool), prevalence func(gp *GPPractice, condition QOFCondition) (float64, bool)) []*BenchmarkMetric {
+	metrics := []*BenchmarkMetric{
+		{
+			Name:      "list_size",
+			Reported:  func(gp *GPPractice) (float64, bool) { return float64(gp.ListSize), gp.ListSize > 0 },
+			Estimated: listSize,
+		},
+		{
+			Name: "appointments_per_1000",
+			Reported: func(gp *GPPractice) (float64, bool) {
+				if gp.ListSize == 0 {
+					return 0.0, false
+				}
+				return 1000.0 * float64(gp.Appointments) / float64(gp.ListSize), true
+			},
+			Estimated: func(gp *GPPractice) (float64, bool) { return 0.0, false },
+		},
+		{
+			Name: "practioners_per_1000",
+			Reported: func(gp *GPPractice) (float64, bool) {
+				if gp.ListSize == 0 {
+					return 0.0, false
+				}
+				return 1000.0 * float64(gp.Practioners) / float64(gp.ListSize), true
+			},
+			Estimated: func(gp *GPPractice) (float64, bool) { return 0.0, false },
+		},
+	}
+	for _, c := range conditions {
+		condition := c
+		metrics = append(metrics, &BenchmarkMetric{
+			Name: fmt.Sprintf("prevalence_%s", condition),
+			Reported: func(gp *GPPractice) (float64, bool) {
+				p, ok := gp.ReportedConditionPrevalence[condition]
+				return p, ok && gp.ListSize > 0
+			},
+			Estimated: func(gp *GPPractice) (float64, bool) {
+				return prevalence(gp, condition)
+			},
+		})
+	}
+	return metrics
+}
+
+// NationalDistribution holds the reported values of a metric for every
+// practice in England that reported it, in ascending order.
+type NationalDistribution struct {
+	Metric *BenchmarkMetric
+	Values []float64
+}
+
+func buildNationalDistributions(gps map[GPPracticeCode]*GPPractice, metrics []*BenchmarkMetric) []*NationalDistribution {
+	distributions := make([]*NationalDistribution, 0, len(metrics))
+	log.Printf("national benchmark:")
+	for _, m := range metrics {
+		d := &NationalDistribution{Metric: m}
+		for _, gp := range gps {
+			if v, ok := m.Reported(gp); ok {
+				d.Values = append(d.Values, v)
+			}
+		}
+		sort.Float64s(d.Values)
+		log.Printf("  %s: practices: %d median: %f", m.Name, len(d.Values), d.Quantile(0.5))
+		distributions = append(distributions, d)
+	}
+	return distributions
+}
+
+// Percentile returns the percentage of practices with a lower value, with
+// those with an equal value counted as half, or NaN if there are none.
+func (n *NationalDistribution) Percentile(v float64) float64 {
+	if len(n.Values) == 0 {
+		return math.NaN()
+	}
+	below := sort.SearchFloat64s(n.Values, v)
+	equal := 0
+	for i := below; i < len(n.Values) && n.Values[i] == v; i++ {
+		equal++
+	}
+	return 100.0 * (float64(below) + 0.5*float64(equal)) / float64(len(n.Values))
+}
+
+// Quantile returns the value at the given quantile, between 0 and 1, using
+// the nearest rank, or NaN if there are no values.
+func (n *NationalDistribution) Quantile(q float64) float64 {
+	if len(n.Values) == 0 {
+		return math.NaN()
+	}
+	i := int(math.Ceil(q*float64(len(n.Values)))) - 1
+	return n.Values[int(clamp(float64(i), 0.0, float64(len(n.Values)-1)))]
+}
+
+func formatBenchmarkValue(v float64, ok bool) string {
+	if !ok || math.IsNaN(v) {
+		return ""
+	}
+	return fmt.Sprintf("%f", v)
+}
+
+// expectedPrevalences returns the prevalence of each condition expected
+// at each practice with published registrations, from the national
+// prevalence for each age and sex in prevalences, weighted by the number
+// of patients of that age and sex registered with it. Registrations are
+// banded by bands. Conditions without a prevalence of their own, only
+// rolled up from their sub-conditions, are left out.
+func expectedPrevalences(registrations map[GPPracticeCode]*RegistrationProfile, bands *AgeBands, conditions []QOFCondition, prevalences AllPrevalences) map[GPPracticeCode]map[QOFCondition]float64 {
+	expected := make(map[GPPracticeCode]map[QOFCondition]float64)
+	for code, profile := range registrations {
+		total := profile.Total()
+		if total == 0.0 {
+			continue
+		}
+		expected[code] = make(map[QOFCondition]float64)
+		for _, condition := range conditions {
+			given, ok := prevalences[OneCondition(condition)]
+			if !ok {
+				continue
+			}
+			e := 0.0
+			for sex := range profile {
+				for band, n := range profile[sex] {
+					e += n * given.Prevalence(Sex(sex), bands.Begins[band])
+				}
+			}
+			expected[code][condition] = e / total
+		}
+	}
+	return expected
+}
+
+// writeNationalBenchmark writes national-benchmark.csv, positioning the
+// reported and estimated values of each metric for the selected practices
+// within its national distribution, with the estimated values in columns
+// named by estimate.
+func writeNationalBenchmark(selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, distributions []*NationalDistribution, estimate string, outputDirectory string) error {
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "national-benchmark.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "metric", "reported", "reported_percentile", estimate, estimate + "_percentile", "national_p10", "national_median", "national_p90", "national_practices"})
+	for _, code := range codes {
+		gp := gps[code]
+		for _, d := range distributions {
+			reported, reportedOK := d.Metric.Reported(gp)
+			estimated, estimatedOK := d.Metric.Estimated(gp)
+			w.Write([]string{
+				code.String(),
+				gp.Name,
+				d.Metric.Name,
+				formatBenchmarkValue(reported, reportedOK),
+				formatBenchmarkValue(d.Percentile(reported), reportedOK),
+				formatBenchmarkValue(estimated, estimatedOK),
+				formatBenchmarkValue(d.Percentile(estimated), estimatedOK),
+				formatBenchmarkValue(d.Quantile(0.1), true),
+				formatBenchmarkValue(d.Quantile(0.5), true),
+				formatBenchmarkValue(d.Quantile(0.9), true),
+				strconv.Itoa(len(d.Values)),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The top coded age of the registrations used by benchmark, whose
+// prevalence is used for everyone aged it and over
+const BenchmarkRegistrationsMaxAge = 95
+
+// benchmarkMain implements population benchmark, which positions the
+// practices of an ICB against every practice in England without
+// simulating a population, estimating each condition's prevalence from
+// the national prevalences and the ages and sexes of the patients
+// registered with each practice.
+func benchmarkMain(args []string) error {
+	flags := newFlagSet("benchmark", "Position the practices of an ICB --scope against the distribution of reported values across all practices in England, writing national-benchmark.csv to --output, with the prevalence of each condition expected from "+PrevalencesFilename+" given the practice's registrations, without simulation")
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, false)
+	conditionsFlag := addConditionsFlag(flags)
+	scopeFlag := addScopeFlag(flags)
+	outputFlag := flags.String("output", "output", "Directory to which national-benchmark.csv is written")
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	conditions, err := readConditions(*conditionsFlag)
+	if err != nil {
+		return err
+	}
+	scope, err := ScopeFromString(*scopeFlag)
+	if err != nil {
+		return err
+	} else if scope.Kind != ScopeKindICB {
+		return fmt.Errorf("benchmark needs an ICB --scope")
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	prevalences, err := readPrevalences()
+	if err != nil {
+		return err
+	}
+	world, err := worldFlags.read()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("read:")
+	reported := withAncestors(conditions)
+	gps, err := readGPPractices(data.Get(DatasetGPPractices), postcodeSources(data), world)
+	if err != nil {
+		return err
+	}
+	successors, err := readGPPracticeSuccessors(data.Get(DatasetGPPracticeSuccessors))
+	if err != nil {
+		return err
+	}
+	if err := readGPPracticeListSizes(gps, successors, data.Get(DatasetQOFListSizes)); err != nil {
+		return err
+	}
+	if _, err := readGPPracticeConditionPrevalence(gps, successors, reported, data); err != nil {
+		return err
+	}
+	if err := readGPAppointments(gps, successors, data.Get(DatasetGPAppointments)); err != nil {
+		return err
+	}
+	if err := readGPPractioners(gps, successors, data.Get(DatasetGPPractioners)); err != nil {
+		return err
+	}
+	selected := make(GPPracticeCodeSet)
+	for code, gp := range gps {
+		if gp.ICB == scope.ICB() && gp.Status == GPPracticeStatusActive {
+			selected[code] = struct{}{}
+		}
+	}
+	log.Printf("  %s practices: %d", scope.ICB(), len(selected))
+	bands := SingleYearAgeBands(BenchmarkRegistrationsMaxAge)
+	registrations, err := readGPRegistrationsByAge(data.Get(DatasetGPRegistrationsMales), data.Get(DatasetGPRegistrationsFemales), selected, bands)
+	if err != nil {
+		return err
+	}
+
+	expected := expectedPrevalences(registrations, bands, reported, prevalences)
+	distributions := buildNationalDistributions(gps, ExpectedBenchmarkMetrics(reported, expected))
+	if err := os.MkdirAll(*outputFlag, 0755); err != nil {
+		return err
+	}
+	return writeNationalBenchmark(selected, gps, distributions, "expected", *outputFlag)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNationalDistributionPercentileAndQuantile(t *testing.T) {
+	d := &NationalDistribution{Values: []float64{1.0, 2.0, 2.0, 3.0, 4.0}}
+	percentiles := []struct {
+		v        float64
+		expected float64
+	}{
+		{0.5, 0.0},
+		{1.0, 10.0},
+		{2.0, 40.0},
+		{3.5, 80.0},
+		{5.0, 100.0},
+	}
+	for _, test := range percentiles {
+		if p := d.Percentile(test.v); p != test.expected {
+			t.Errorf("expected percentile %f for %f, found %f", test.expected, test.v, p)
+		}
+	}
+	quantiles := []struct {
+		q        float64
+		expected float64
+	}{
+		{0.0, 1.0},
+		{0.1, 1.0},
+		{0.5, 2.0},
+		{0.9, 4.0},
+		{1.0, 4.0},
+	}
+	for _, test := range quantiles {
+		if v := d.Quantile(test.q); v != test.expected {
+			t.Errorf("expected %f at quantile %f, found %f", test.expected, test.q, v)
+		}
+	}
+	empty := &NationalDistribution{}
+	if !math.IsNaN(empty.Percentile(1.0)) || !math.IsNaN(empty.Quantile(0.5)) {
+		t.Errorf("expected NaN from an empty distribution")
+	}
+}
+
+func TestExpectedPrevalences(t *testing.T) {
+	bands := SingleYearAgeBands(BenchmarkRegistrationsMaxAge)
+	prevalences := AllPrevalences{
+		OneCondition(QOFConditionDiabetes): {
+			Conditions: OneCondition(QOFConditionDiabetes),
+			ByAge: AgePrevalences{
+				{{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.01}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.1}},
+				{{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.01}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.05}},
+			},
+		},
+	}
+	young := NewRegistrationProfile(bands)
+	young[Male][20] = 100
+	young[Female][20] = 100
+	old := NewRegistrationProfile(bands)
+	old[Male][60] = 100
+	old[Female][BenchmarkRegistrationsMaxAge] = 300
+	registrations := map[GPPracticeCode]*RegistrationProfile{"G1": young, "G2": old, "G3": NewRegistrationProfile(bands)}
+	expected := expectedPrevalences(registrations, bands, []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}, prevalences)
+	tests := []struct {
+		code     GPPracticeCode
+		expected float64
+	}{
+		{"G1", 0.01},
+		{"G2", (100*0.1 + 300*0.05) / 400},
+	}
+	for _, test := range tests {
+		if e := expected[test.code][QOFConditionDiabetes]; math.Abs(e-test.expected) > 1e-9 {
+			t.Errorf("expected %f for %s, found %f", test.expected, test.code, e)
+		}
+		if _, ok := expected[test.code][QOFConditionHypertension]; ok {
+			t.Errorf("expected no prevalence for a condition without one")
+		}
+	}
+	if _, ok := expected["G3"]; ok {
+		t.Errorf("expected no prevalences for a practice without registrations")
+	}
+}
+
+func TestWriteNationalBenchmark(t *testing.T) {
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", Name: "One", ListSize: 1000, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionDiabetes: 0.08}},
+		"G2": {Code: "G2", Name: "Two", ListSize: 2000, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionDiabetes: 0.04}},
+		"G3": {Code: "G3", Name: "Three", ListSize: 3000, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionDiabetes: 0.06}},
+	}
+	expected := map[GPPracticeCode]map[QOFCondition]float64{"G1": {QOFConditionDiabetes: 0.05}}
+	distributions := buildNationalDistributions(gps, ExpectedBenchmarkMetrics([]QOFCondition{QOFConditionDiabetes}, expected))
+	directory := t.TempDir()
+	if err := writeNationalBenchmark(GPPracticeCodeSet{"G1": struct{}{}}, gps, distributions, "expected", directory); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(directory, "national-benchmark.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0][5] != "expected" || rows[0][6] != "expected_percentile" {
+		t.Errorf("expected columns named by the estimate, found %v", rows[0])
+	}
+	found := false
+	for _, row := range rows[1:] {
+		if row[2] == "prevalence_dm" {
+			found = true
+			if row[3] != "0.080000" || row[5] != "0.050000" || row[6] != "33.333333" {
+				t.Errorf("unexpected row %v", row)
+			}
+		} else if row[2] == "list_size" && row[5] != "" {
+			t.Errorf("expected no estimated list size, found %s", row[5])
+		}
+	}
+	if !found {
+		t.Errorf("expected a row for prevalence_dm")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	BenefitsLSOACodeColumn  = "lsoa_code"
+	BenefitsClaimantsColumn = "claimants"
+)
+
+// Benefit is a DWP benefit, whose claimants by LSOA are published through
+// Stat-Xplore.
+type Benefit int
+
+const (
+	BenefitUniversalCredit Benefit = iota
+	BenefitPIP
+	BenefitAttendanceAllowance
+
+	BenefitCount
+	BenefitInvalid Benefit = -1
+)
+
+func (b Benefit) String() string {
+	switch b {
+	case BenefitUniversalCredit:
+		return "universal_credit"
+	case BenefitPIP:
+		return "pip"
+	case BenefitAttendanceAllowance:
+		return "attendance_allowance"
+	}
+	return "invalid"
+}
+
+func BenefitFromString(s string) Benefit {
+	for b := Benefit(0); b < BenefitCount; b++ {
+		if s == b.String() {
+			return b
+		}
+	}
+	return BenefitInvalid
+}
+
+// Dataset returns the name of the dataset of claimants by LSOA
+func (b Benefit) Dataset() string {
+	switch b {
+	case BenefitUniversalCredit:
+		return DatasetDWPUniversalCredit
+	case BenefitPIP:
+		return DatasetDWPPIP
+	case BenefitAttendanceAllowance:
+		return DatasetDWPAttendanceAllowance
+	}
+	return ""
+}
+
+// Benefits is a set of Benefit, as a bitmask
+type Benefits uint8
+
+func (b Benefits) Contains(benefit Benefit) bool {
+	return b&(1<<benefit) != 0
+}
+
+func (b *Benefits) Add(benefit Benefit) {
+	*b |= 1 << benefit
+}
+
+// BenefitRates describes who claims a benefit: people within its ages,
+// with the claimants of each LSOA shared between its residents by the
+// relative rates given their conditions.
+type BenefitRates struct {
+	Description string
+	Ages        AgeRange
+	// The rate of claiming for people with each condition, relative to
+	// those without it
+	Conditions map[string]float64
+
+	conditions map[QOFCondition]float64
+}
+
+// BenefitModel assigns people a probabilistic benefits status, from the
+// claimants of each benefit in their home LSOA, so that health
+// inequalities can be linked to conditions.
+type BenefitModel struct {
+	Benefits map[string]*BenefitRates
+
+	rates [BenefitCount]*BenefitRates
+}
+
+func readBenefitModel(filename string) (*BenefitModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open benefit model: %s", err)
+	}
+	defer f.Close()
+	var model BenefitModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read benefit model: %s", err)
+	}
+	for name, rates := range model.Benefits {
+		b := BenefitFromString(name)
+		if b == BenefitInvalid {
+			return nil, fmt.Errorf("unknown benefit %q", name)
+		}
+		rates.conditions = make(map[QOFCondition]float64)
+		for c, r := range rates.Conditions {
+			condition := QOFConditionFromString(c)
+			if condition == QOFConditionInvalid {
+				return nil, fmt.Errorf("unknown condition %q for benefit %s", c, name)
+			} else if r <= 0.0 {
+				return nil, fmt.Errorf("benefit %s needs a positive relative rate for %s", name, c)
+			}
+			rates.conditions[condition] = r
+		}
+		model.rates[b] = rates
+	}
+	return &model, nil
+}
+
+// Modelled returns the benefits given by the model, in order
+func (m *BenefitModel) Modelled() []Benefit {
+	benefits := make([]Benefit, 0, BenefitCount)
+	for b, rates := range m.rates {
+		if rates != nil {
+			benefits = append(benefits, Benefit(b))
+		}
+	}
+	return benefits
+}
+
+func (r *BenefitRates) relativeRate(p *Person) float64 {
+	rate := 1.0
+	for condition, relative := range r.conditions {
+		if p.Conditions.Contains(condition) {
+			rate *= relative
+		}
+	}
+	return rate
+}
+
+// readBenefitClaimants reads the number of claimants in each LSOA from a
+// Stat-Xplore export, skipping the lines before its header. Counts for
+// 2011 LSOAs not in lsoas are translated onto the census geography,
+// shared between the LSOAs into which one was split by their populations.
+func readBenefitClaimants(dataset *Dataset, lsoas map[LSOACode]*LSOA, geography *CensusGeography) (map[LSOACode]float64, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	claimants := make(map[LSOACode]float64)
+	body := false
+	columns := make(map[string]int)
+	lsoaColumn := dataset.Column("lsoa-code")
+	unmatched := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(row) == 0 {
+			continue
+		}
+		if !body {
+			for i, header := range row {
+				columns[strings.TrimSpace(header)] = i
+			}
+			if _, ok := columns[lsoaColumn]; ok {
+				if _, ok := columns[dataset.Column("claimants")]; !ok {
+					return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("claimants"))
+				}
+				body = true
+			} else {
+				columns = make(map[string]int)
+			}
+			continue
+		}
+		if len(row) <= columns[lsoaColumn] || len(row) <= columns[dataset.Column("claimants")] {
+			continue
+		}
+		// Stat-Xplore labels LSOAs with their code followed by their name
+		fields := strings.Fields(row[columns[lsoaColumn]])
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := parseFloat(row[columns[dataset.Column("claimants")]])
+		if err != nil {
+			// Totals and footnotes, and suppressed counts
+			continue
+		}
+		code := LSOACode(fields[0])
+		if _, ok := lsoas[code]; ok {
+			claimants[code] += n
+			continue
+		}
+		translated := geography.FromLSOA11.Translate(code)
+		total := 0
+		for _, t := range translated {
+			if lsoa, ok := lsoas[t]; ok {
+				total += sum(lsoa.PersonsByAge)
+			}
+		}
+		if total == 0 {
+			unmatched++
+			continue
+		}
+		for _, t := range translated {
+			if lsoa, ok := lsoas[t]; ok {
+				claimants[t] += n * float64(sum(lsoa.PersonsByAge)) / float64(total)
+			}
+		}
+	}
+	if !body {
+		return nil, fmt.Errorf("%s: no %s column", dataset.Filename, lsoaColumn)
+	}
+	log.Printf("  %s: lsoas: %d unmatched: %d", dataset.Filename, len(claimants), unmatched)
+	return claimants, nil
+}
+
+// assignBenefits assigns each benefit to people within its ages, with the
+// probability that the claimant rate of their home LSOA is scaled by their
+// relative rate, normalised so that the expected number of simulated
+// claimants in an LSOA matches its reported claimants.
+func assignBenefits(people []Person, homes LSOASet, lsoas map[LSOACode]*LSOA, claimants [BenefitCount]map[LSOACode]float64, model *BenefitModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	byLSOA := make(map[LSOACode][]*Person)
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			byLSOA[people[i].Home] = append(byLSOA[people[i].Home], &people[i])
+		}
+	}
+	codes := make([]LSOACode, 0, len(byLSOA))
+	for code := range byLSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, b := range model.Modelled() {
+		rates := model.rates[b]
+		assigned, expected, missing := 0, 0.0, 0
+		for _, code := range codes {
+			n, ok := claimants[b][code]
+			if !ok {
+				missing++
+				continue
+			}
+			eligible := 0
+			for age, count := range lsoas[code].PersonsByAge {
+				if rates.Ages.Contains(age) {
+					eligible += count
+				}
+			}
+			relative, simulated := 0.0, 0
+			for _, p := range byLSOA[code] {
+				if rates.Ages.Contains(p.Age) {
+					relative += rates.relativeRate(p)
+					simulated++
+				}
+			}
+			if eligible == 0 || relative == 0.0 {
+				continue
+			}
+			rate := clamp(n/float64(eligible), 0.0, 1.0)
+			mean := relative / float64(simulated)
+			for _, p := range byLSOA[code] {
+				if !rates.Ages.Contains(p.Age) {
+					continue
+				}
+				probability := clamp(rate*rates.relativeRate(p)/mean, 0.0, 1.0)
+				expected += probability
+				if rng.Float64() < probability {
+					p.Benefits.Add(b)
+					assigned++
+				}
+			}
+		}
+		log.Printf("  %s: claimants: %d expected: %.0f lsoas without claimants: %d", b, assigned, expected, missing)
+	}
+}
+
+// GroupByBenefit groups people within the ages of a benefit by whether
+// they claim it, skipping those outside.
+func GroupByBenefit(b Benefit, model *BenefitModel) *GroupBy {
+	rates := model.rates[b]
+	return &GroupBy{
+		Key:   fmt.Sprintf("benefit_%s", b),
+		Fixed: []string{"claimant", "not_claimant"},
+		Group: func(p *Person) (string, bool) {
+			if !rates.Ages.Contains(p.Age) {
+				return "", false
+			} else if p.Benefits.Contains(b) {
+				return "claimant", true
+			}
+			return "not_claimant", true
+		},
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The minimum age at which BMI is simulated, since obesity in children
+	// is defined by centiles of BMI for their age, rather than a threshold
+	BMIMinAge = 16
+	// The BMI above which adults are classified as obese
+	BMIObeseThreshold = 30.0
+	// The maximum probability of obesity, to keep the lognormal
+	// distribution of BMI well defined
+	BMIMaxObeseProbability = 0.99
+)
+
+// BMIModel gives the distribution of body mass index among adults, as
+// lognormal, with a standard deviation of log BMI that's the same for
+// everyone, and a mean chosen so that the probability of a BMI of 30 or
+// more is the prevalence of obesity for a person's age, sex and
+// deprivation.
+type BMIModel struct {
+	// Prevalence of obesity by sex and age range
+	Obese AgePrevalences
+	// Standard deviation of the natural log of BMI
+	Sigma float64
+	// Prevalence of obesity in each IMD quintile, from the most deprived,
+	// relative to the average across them
+	Deprivation []float64
+	// Risk of each condition for people who are obese, relative to those
+	// who aren't
+	RelativeRisk map[string]float64 `yaml:"relativerisk"`
+
+	relativeRisk map[QOFCondition]float64
+}
+
+func readBMIModel(filename string) (*BMIModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bmi model: %s", err)
+	}
+	defer f.Close()
+	var model BMIModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read bmi model: %s", err)
+	}
+	if len(model.Obese) == 0 {
+		return nil, fmt.Errorf("bmi model needs obesity prevalence by age")
+	}
+	if model.Sigma <= 0.0 {
+		return nil, fmt.Errorf("bmi model needs a positive sigma")
+	}
+	if len(model.Deprivation) != 0 && len(model.Deprivation) != 5 {
+		return nil, fmt.Errorf("bmi model needs relative prevalence for 5 IMD quintiles, found %d", len(model.Deprivation))
+	}
+	model.relativeRisk = make(map[QOFCondition]float64)
+	for c, r := range model.RelativeRisk {
+		condition := QOFConditionFromString(c)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in bmi relative risks", c)
+		}
+		model.relativeRisk[condition] = r
+	}
+	return &model, nil
+}
+
+// ObeseProbability returns the probability that p is obese, given their
+// age, sex, and the IMD decile of their home, or 0 if unknown. The relative
+// prevalence by quintile is normalised by its mean, since quintiles
+// contain equal shares of the national population.
+func (b *BMIModel) ObeseProbability(p *Person, imdDecile int) float64 {
+	probability := b.Obese.Prevalence(p.Sex, p.Age)
+	if imdDecile > 0 && len(b.Deprivation) > 0 {
+		mean := 0.0
+		for _, r := range b.Deprivation {
+			mean += r
+		}
+		mean /= float64(len(b.Deprivation))
+		if mean > 0.0 {
+			probability *= b.Deprivation[(imdDecile-1)/2] / mean
+		}
+	}
+	return clamp(probability, 0.0, BMIMaxObeseProbability)
+}
+
+// Sample returns a BMI for p, with the given probability of obesity, or 0
+// for children, or if the probability is 0.
+func (b *BMIModel) Sample(p *Person, obese float64, rng *rand.Rand) float64 {
+	if p.Age < BMIMinAge || obese <= 0.0 {
+		return 0.0
+	}
+	// The mean of log BMI, such that P(BMI >= threshold) = obese
+	mu := math.Log(BMIObeseThreshold) - b.Sigma*math.Sqrt2*math.Erfinv(1.0-2.0*obese)
+	return math.Exp(mu + b.Sigma*rng.NormFloat64())
+}
+
+// Risk returns the multiplier applied to a person's prevalence of a
+// condition given whether they're obese. As for smoking, multipliers are
+// normalised by the expected relative risk for the person's age and sex.
+// A nil model, or a person without a simulated BMI, always returns 1.
+func (b *BMIModel) Risk(p *Person, condition QOFCondition) float64 {
+	if b == nil || p.BMI == 0.0 {
+		return 1.0
+	}
+	rr, ok := b.relativeRisk[condition]
+	if !ok {
+		return 1.0
+	}
+	obese := clamp(b.Obese.Prevalence(p.Sex, p.Age), 0.0, 1.0)
+	expected := (1.0 - obese) + obese*rr
+	if expected <= 0.0 {
+		return 1.0
+	}
+	if p.Obese() {
+		return rr / expected
+	}
+	return 1.0 / expected
+}
+
+// assignBMI samples a BMI for each adult, from the model's distribution
+// for their age, sex, and the deprivation of their home LSOA.
+func assignBMI(people []Person, model *BMIModel, lsoas map[LSOACode]*LSOA) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	adults, obese := 0, 0
+	for i := range people {
+		p := &people[i]
+		decile := 0
+		if lsoa, ok := lsoas[p.Home]; ok {
+			decile = lsoa.IMDDecile
+		}
+		p.BMI = float32(model.Sample(p, model.ObeseProbability(p, decile), rng))
+		if p.BMI > 0.0 {
+			adults++
+			if p.Obese() {
+				obese++
+			}
+		}
+	}
+	log.Printf("  adults: %d obese: %d", adults, obese)
+}
+
+// RiskFactors combines the relative risks of conditions given each of a
+// person's simulated risk factors, assuming they act independently. Nil
+// models don't change risk.
+type RiskFactors struct {
+	Smoking *SmokingModel
+	BMI     *BMIModel
+}
+
+func (r *RiskFactors) Risk(p *Person, condition QOFCondition) float64 {
+	return r.Smoking.Risk(p, condition) * r.BMI.Risk(p, condition)
+}
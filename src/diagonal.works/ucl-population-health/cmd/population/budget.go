@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// The number of years over which budget impact is assessed, unless
+	// overridden by the scenario
+	BudgetDefaultHorizon = 5
+	// The annual discount rate applied to future costs, unless overridden
+	// by the scenario, following the HM Treasury Green Book
+	BudgetDefaultDiscountRate = 0.035
+)
+
+// Intervention is delivered to some of the people registered with ICB
+// practices, changing their activity, at a cost per participant.
+type Intervention struct {
+	Name string
+	// If given, only people with this condition are eligible
+	Condition string
+	// The proportion of eligible people taking part, from 0 to 1, or
+	// everyone eligible if not given
+	Uptake float64
+	// The annual cost of delivering the intervention to each participant
+	CostPerPerson float64 `yaml:"costperperson"`
+	// The relative change in each activity for participants, keyed by
+	// Activity.String, eg emergency: -0.1 for 10% fewer emergency
+	// admissions
+	Effects map[string]float64
+
+	condition QOFCondition
+	effects   [ActivityCount]float64
+}
+
+// BudgetImpact compares the cost of a scenario's activity with that of a
+// baseline, over a horizon of years, with future years discounted.
+type BudgetImpact struct {
+	// The output directory of a run without the scenario, whose costs.csv
+	// is compared against. If not given, the baseline is the activity of
+	// this run before interventions.
+	Baseline string
+	// The number of years compared
+	Horizon int
+	// The annual discount rate
+	DiscountRate  *float64 `yaml:"discountrate"`
+	Interventions []Intervention
+}
+
+func (b *BudgetImpact) IsEmpty() bool {
+	return b.Baseline == "" && len(b.Interventions) == 0
+}
+
+func (b *BudgetImpact) validate() error {
+	if b.IsEmpty() {
+		return nil
+	}
+	if b.Horizon == 0 {
+		b.Horizon = BudgetDefaultHorizon
+	} else if b.Horizon < 0 {
+		return fmt.Errorf("budget: horizon must be positive")
+	}
+	if b.DiscountRate == nil {
+		rate := BudgetDefaultDiscountRate
+		b.DiscountRate = &rate
+	} else if *b.DiscountRate < 0.0 {
+		return fmt.Errorf("budget: discount rate must not be negative")
+	}
+	names := make(map[string]struct{})
+	for i := range b.Interventions {
+		intervention := &b.Interventions[i]
+		if _, ok := names[intervention.Name]; ok || intervention.Name == "" {
+			return fmt.Errorf("budget: intervention name %q missing, or given more than once", intervention.Name)
+		}
+		names[intervention.Name] = struct{}{}
+		intervention.condition = QOFConditionInvalid
+		if intervention.Condition != "" {
+			if intervention.condition = QOFConditionFromString(intervention.Condition); intervention.condition == QOFConditionInvalid {
+				return fmt.Errorf("budget: intervention %s: unknown condition %q", intervention.Name, intervention.Condition)
+			}
+		}
+		if intervention.Uptake == 0.0 {
+			intervention.Uptake = 1.0
+		} else if intervention.Uptake < 0.0 || intervention.Uptake > 1.0 {
+			return fmt.Errorf("budget: intervention %s: uptake must be between 0 and 1", intervention.Name)
+		}
+		if intervention.CostPerPerson < 0.0 {
+			return fmt.Errorf("budget: intervention %s: negative cost per person", intervention.Name)
+		}
+		for name, effect := range intervention.Effects {
+			a := ActivityFromString(name)
+			if a == ActivityInvalid {
+				return fmt.Errorf("budget: intervention %s: unknown activity %q", intervention.Name, name)
+			} else if effect < -1.0 {
+				return fmt.Errorf("budget: intervention %s: %s can't fall by more than 100%%", intervention.Name, name)
+			}
+			intervention.effects[a] = effect
+		}
+	}
+	return nil
+}
+
+// DiscountFactor returns the factor applied to costs in the given year of
+// the horizon, counting from 1, with the first year undiscounted.
+func (b *BudgetImpact) DiscountFactor(year int) float64 {
+	return 1.0 / math.Pow(1.0+*b.DiscountRate, float64(year-1))
+}
+
+// HorizonFactor returns the sum of the discount factors of each year of
+// the horizon, by which a constant annual cost is multiplied to give its
+// present value over the horizon.
+func (b *BudgetImpact) HorizonFactor() float64 {
+	factor := 0.0
+	for year := 1; year <= b.Horizon; year++ {
+		factor += b.DiscountFactor(year)
+	}
+	return factor
+}
+
+// BudgetCosts are the annual costs of the people registered with ICB
+// practices, for each activity, and for delivering each intervention.
+type BudgetCosts struct {
+	Activity      [ActivityCount]float64
+	Interventions map[string]float64
+}
+
+func (c *BudgetCosts) Total() float64 {
+	total := 0.0
+	for _, cost := range c.Activity {
+		total += cost
+	}
+	for _, cost := range c.Interventions {
+		total += cost
+	}
+	return total
+}
+
+// activityCosts returns the annual cost of the activity of people
+// registered with selected practices.
+func activityCosts(people []Person, activity [][ActivityCount]float64, selected GPPracticeCodeSet, model *CostModel) *BudgetCosts {
+	costs := &BudgetCosts{Interventions: make(map[string]float64)}
+	for i := range people {
+		if _, ok := selected[people[i].GP]; ok {
+			for a := Activity(0); a < ActivityCount; a++ {
+				costs.Activity[a] += activity[i][a] * model.unitCosts[a]
+			}
+		}
+	}
+	return costs
+}
+
+// applyInterventions changes the activity of eligible people registered
+// with selected practices by the effects of each intervention, scaled by
+// its uptake, so that the activity is that expected on average, rather
+// than sampling participants. Effects of interventions given to the same
+// person multiply. Returns the annual cost of delivering each
+// intervention.
+func applyInterventions(people []Person, activity [][ActivityCount]float64, selected GPPracticeCodeSet, interventions []Intervention) map[string]float64 {
+	costs := make(map[string]float64)
+	for _, intervention := range interventions {
+		eligible := 0
+		for i := range people {
+			p := &people[i]
+			if _, ok := selected[p.GP]; !ok {
+				continue
+			} else if intervention.condition != QOFConditionInvalid && !p.Conditions.Contains(intervention.condition) {
+				continue
+			}
+			eligible++
+			for a := Activity(0); a < ActivityCount; a++ {
+				activity[i][a] *= 1.0 + intervention.Uptake*intervention.effects[a]
+			}
+		}
+		participants := float64(eligible) * intervention.Uptake
+		costs[intervention.Name] = participants * intervention.CostPerPerson
+		log.Printf("  %s: eligible: %d participants: %.0f cost: £%.0f", intervention.Name, eligible, participants, costs[intervention.Name])
+	}
+	return costs
+}
+
+// readBaselineCosts reads the annual activity of people registered with
+// ICB practices from the costs.csv written by a baseline run, costing it
+// with the unit costs of model, so that both runs are compared on the same
+// basis.
+func readBaselineCosts(directory string, model *CostModel) (*BudgetCosts, error) {
+	filename := filepath.Join(directory, "costs.csv")
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"population", "breakdown", "value", "activity", "count", "unit_cost"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", filename, column)
+		}
+	}
+	costs := &BudgetCosts{Interventions: make(map[string]float64)}
+	found := false
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if row[columns["population"]] != AggregatePopulationRegistered.String() || row[columns["breakdown"]] != "condition" || row[columns["value"]] != "all" {
+			continue
+		}
+		a := ActivityFromString(row[columns["activity"]])
+		if a == ActivityInvalid {
+			continue
+		}
+		count, err := strconv.ParseFloat(row[columns["count"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad count for %s: %s", filename, a, err)
+		}
+		if cost, err := strconv.ParseFloat(row[columns["unit_cost"]], 64); err == nil && cost != model.unitCosts[a] {
+			Warningf("  baseline: %s unit cost of £%g differs from £%g, using the latter", a, cost, model.unitCosts[a])
+		}
+		costs.Activity[a] = count * model.unitCosts[a]
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no costs for everyone registered", filename)
+	}
+	return costs, nil
+}
+
+// writeBudgetImpact writes budget-impact.csv, comparing the baseline and
+// scenario cost of each activity, and intervention, in each year of the
+// horizon, with the difference discounted, followed by the same for the
+// whole horizon, as year "total".
+func writeBudgetImpact(budget *BudgetImpact, baseline *BudgetCosts, scenario *BudgetCosts, interventions []Intervention, name string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "budget-impact.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "year", "kind", "item", "baseline_cost", "scenario_cost", "difference", "discount_factor", "discounted_difference"})
+	type item struct {
+		kind, name         string
+		baseline, scenario float64
+	}
+	items := make([]item, 0, int(ActivityCount)+len(interventions)+1)
+	for a := Activity(0); a < ActivityCount; a++ {
+		items = append(items, item{"activity", a.String(), baseline.Activity[a], scenario.Activity[a]})
+	}
+	for _, intervention := range interventions {
+		items = append(items, item{"intervention", intervention.Name, baseline.Interventions[intervention.Name], scenario.Interventions[intervention.Name]})
+	}
+	items = append(items, item{"total", "total", baseline.Total(), scenario.Total()})
+	for year := 1; year <= budget.Horizon+1; year++ {
+		label, factor, years := strconv.Itoa(year), budget.DiscountFactor(year), 1.0
+		if year > budget.Horizon {
+			// The whole horizon, where the discount factor is the sum of
+			// those of each year, relative to the number of years
+			label, factor, years = "total", budget.HorizonFactor()/float64(budget.Horizon), float64(budget.Horizon)
+		}
+		for _, i := range items {
+			difference := (i.scenario - i.baseline) * years
+			w.Write([]string{
+				name,
+				label,
+				i.kind,
+				i.name,
+				fmt.Sprintf("%.2f", i.baseline*years),
+				fmt.Sprintf("%.2f", i.scenario*years),
+				fmt.Sprintf("%.2f", difference),
+				fmt.Sprintf("%f", factor),
+				fmt.Sprintf("%.2f", difference*factor),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// BufferPolicy decides which LSOAs outside the ICB are added to the homes
+// from which the population is drawn, so that the lists of practices near
+// the ICB's edge include patients living outside it.
+type BufferPolicy int
+
+const (
+	// LSOAs intersecting a fixed radius around each ICB practice
+	BufferPolicyRadius BufferPolicy = iota
+	// LSOAs in which a minimum share of residents are registered with an
+	// ICB practice, according to NHS Digital's patients registered at a
+	// GP practice by LSOA
+	BufferPolicyRegistration
+	// LSOAs within a maximum expected travel time of an ICB practice,
+	// using the mode shares and speeds from the travel assumptions
+	BufferPolicyTravelTime
+	// Only LSOAs in the ICB
+	BufferPolicyNone
+)
+
+func (b BufferPolicy) String() string {
+	switch b {
+	case BufferPolicyRadius:
+		return "radius"
+	case BufferPolicyRegistration:
+		return "registration"
+	case BufferPolicyTravelTime:
+		return "travel-time"
+	case BufferPolicyNone:
+		return "none"
+	}
+	return "invalid"
+}
+
+func BufferPolicyFromString(s string) (BufferPolicy, error) {
+	for b := BufferPolicyRadius; b <= BufferPolicyNone; b++ {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return BufferPolicyRadius, fmt.Errorf("unknown buffer policy %q, expected radius, registration, travel-time or none", s)
+}
+
+// Measure returns the name of the value recorded for each buffer LSOA
+func (b BufferPolicy) Measure() string {
+	switch b {
+	case BufferPolicyRadius:
+		return "distance_m"
+	case BufferPolicyRegistration:
+		return "registered_share"
+	case BufferPolicyTravelTime:
+		return "travel_minutes"
+	}
+	return ""
+}
+
+const (
+	GPRegistrationsPracticeCodeColumn = "PRACTICE_CODE"
+	GPRegistrationsLSOACodeColumn     = "LSOA_CODE"
+	GPRegistrationsPatientsColumn     = "NUMBER_OF_PATIENTS"
+
+	DefaultBufferMinRegisteredShare = 0.05
+	DefaultBufferMaxTravelMinutes   = 20.0
+)
+
+type BufferOptions struct {
+	Policy BufferPolicy
+	// With BufferPolicyRegistration, the minimum fraction of an LSOA's
+	// residents registered with ICB practices for it to be included
+	MinRegisteredShare float64
+	// With BufferPolicyTravelTime, the maximum expected travel time to the
+	// nearest ICB practice for an LSOA to be included
+	MaxTravelMinutes float64
+}
+
+// Buffer holds the LSOAs outside the ICB added to homes, with the value of
+// the policy's measure that led to their inclusion.
+type Buffer struct {
+	Policy BufferPolicy
+	LSOAs  map[LSOACode]float64
+}
+
+// addNearest records the value for an LSOA, keeping the smallest if it's
+// already present. NaN records an LSOA without a known value.
+func (b *Buffer) addNearest(lsoa LSOACode, value float64) {
+	if existing, ok := b.LSOAs[lsoa]; !ok || value < existing || math.IsNaN(existing) {
+		b.LSOAs[lsoa] = value
+	}
+}
+
+// buildBuffer returns the LSOAs outside icbLSOAs to add to homes, using the
+// given policy, around the selected practices.
+func buildBuffer(options *BufferOptions, parameters SimulationParameters, selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, icbLSOAs LSOASet, lsoas map[LSOACode]*LSOA, travel *TravelAssumptions, geography *CensusGeography, data DataManifest, w b6.World) (*Buffer, error) {
+	buffer := &Buffer{Policy: options.Policy, LSOAs: make(map[LSOACode]float64)}
+	switch options.Policy {
+	case BufferPolicyRadius:
+		fillRadiusBuffer(buffer, parameters.GPLSOANearbyRadiusM, selected, gps, icbLSOAs, lsoas, w)
+	case BufferPolicyRegistration:
+		registered, err := readGPRegistrationsByLSOA(data.Get(DatasetGPRegistrationsLSOA), selected, geography)
+		if err != nil {
+			return nil, err
+		}
+		for code, patients := range registered {
+			if _, ok := icbLSOAs[code]; ok {
+				continue
+			}
+			lsoa, ok := lsoas[code]
+			if !ok {
+				continue
+			}
+			if residents := sum(lsoa.PersonsByAge); residents > 0 {
+				if share := patients / float64(residents); share >= options.MinRegisteredShare {
+					buffer.LSOAs[code] = share
+				}
+			}
+		}
+	case BufferPolicyTravelTime:
+		if err := travel.CheckSpeeds(); err != nil {
+			return nil, err
+		}
+		fillTravelTimeBuffer(buffer, options.MaxTravelMinutes, selected, gps, icbLSOAs, lsoas, travel, w)
+	}
+	log.Printf("buffer: policy: %s lsoas: %d", buffer.Policy, len(buffer.LSOAs))
+	return buffer, nil
+}
+
+// fillRadiusBuffer adds LSOAs intersecting a cap of radiusM around each
+// selected practice, recording the distance from the LSOA's centre to the
+// nearest.
+func fillRadiusBuffer(buffer *Buffer, radiusM float64, selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, icbLSOAs LSOASet, lsoas map[LSOACode]*LSOA, w b6.World) {
+	r := b6.MetersToAngle(radiusM)
+	for code := range selected {
+		cap := s2.CapFromCenterAngle(gps[code].Location, r)
+		nearby := w.FindFeatures(b6.Intersection{b6.NewIntersectsCap(cap), b6.Tagged{Key: "#boundary", Value: "lsoa"}})
+		for nearby.Next() {
+			lsoa := LSOACode(nearby.Feature().Get("code").Value)
+			if _, ok := icbLSOAs[lsoa]; ok {
+				continue
+			}
+			d := math.NaN()
+			if l, ok := lsoas[lsoa]; ok {
+				d = b6.AngleToMeters(l.Center.Distance(gps[code].Location))
+			}
+			buffer.addNearest(lsoa, d)
+		}
+	}
+}
+
+// fillTravelTimeBuffer adds LSOAs whose centre is within maxMinutes of
+// expected travel time of a selected practice.
+func fillTravelTimeBuffer(buffer *Buffer, maxMinutes float64, selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, icbLSOAs LSOASet, lsoas map[LSOACode]*LSOA, travel *TravelAssumptions, w b6.World) {
+	// No journey can be any faster than the fastest mode, so limit the
+	// search to the straight line distance it could cover.
+	r := b6.MetersToAngle(travel.MaxSpeedKmh() * 1000.0 * maxMinutes / 60.0 / travel.Circuity)
+	for code := range selected {
+		cap := s2.CapFromCenterAngle(gps[code].Location, r)
+		nearby := w.FindFeatures(b6.Intersection{b6.NewIntersectsCap(cap), b6.Tagged{Key: "#boundary", Value: "lsoa"}})
+		for nearby.Next() {
+			lsoa := LSOACode(nearby.Feature().Get("code").Value)
+			if _, ok := icbLSOAs[lsoa]; ok {
+				continue
+			}
+			l, ok := lsoas[lsoa]
+			if !ok {
+				continue
+			}
+			minutes := travel.Minutes(b6.AngleToMeters(l.Center.Distance(gps[code].Location)))
+			if minutes <= maxMinutes {
+				buffer.addNearest(lsoa, minutes)
+			}
+		}
+	}
+}
+
+// readGPRegistrationsByLSOA returns the number of patients living in each
+// LSOA registered with one of the selected practices.
+func readGPRegistrationsByLSOA(dataset *Dataset, selected GPPracticeCodeSet, geography *CensusGeography) (map[LSOACode]float64, error) {
+	flows, err := readGPRegistrationFlows(dataset, selected, geography)
+	if err != nil {
+		return nil, err
+	}
+	registered := make(map[LSOACode]float64)
+	for _, byLSOA := range flows {
+		for code, patients := range byLSOA {
+			registered[code] += patients
+		}
+	}
+	return registered, nil
+}
+
+// readGPRegistrationFlows returns the number of patients living in each
+// LSOA registered with each of the selected practices, from NHS Digital's
+// patients registered at a GP practice, see
+// https://digital.nhs.uk/data-and-information/publications/statistical/patients-registered-at-a-gp-practice
+// The publication uses 2011 LSOAs, and patients in LSOAs split in other
+// geographies are divided evenly between them. If selected is nil, every
+// practice is included.
+func readGPRegistrationFlows(dataset *Dataset, selected GPPracticeCodeSet, geography *CensusGeography) (map[GPPracticeCode]map[LSOACode]float64, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"practice-code", "lsoa-code", "patients"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+	flows := make(map[GPPracticeCode]map[LSOACode]float64)
+	lsoas := make(LSOASet)
+	total := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		practice := GPPracticeCode(row[columns[dataset.Column("practice-code")]])
+		if _, ok := selected[practice]; !ok && selected != nil {
+			continue
+		}
+		patients, err := strconv.Atoi(row[columns[dataset.Column("patients")]])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad number of patients: %s", dataset.Filename, err)
+		}
+		byLSOA, ok := flows[practice]
+		if !ok {
+			byLSOA = make(map[LSOACode]float64)
+			flows[practice] = byLSOA
+		}
+		codes := geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]]))
+		for _, code := range codes {
+			byLSOA[code] += float64(patients) / float64(len(codes))
+			lsoas[code] = struct{}{}
+		}
+		total += patients
+	}
+	log.Printf("  registered patients: %d lsoas: %d", total, len(lsoas))
+	return flows, nil
+}
+
+// WriteCSV writes buffer-lsoas.csv, with a row for every LSOA added to
+// homes from outside the ICB.
+func (b *Buffer) WriteCSV(lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, outputDirectory string) error {
+	codes := make([]LSOACode, 0, len(b.LSOAs))
+	for code := range b.LSOAs {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "buffer-lsoas.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"lsoa", "name", "msoa", "msoa_name", "residents", "policy", "measure", "value"})
+	for _, code := range codes {
+		row := []string{code.String(), "", "", "", "", b.Policy.String(), b.Policy.Measure(), ""}
+		if lsoa, ok := lsoas[code]; ok {
+			row[1] = lsoa.Name
+			row[2] = lsoa.MSOACode.String()
+			if msoa, ok := msoas[lsoa.MSOACode]; ok {
+				row[3] = msoa.Name
+			}
+			row[4] = strconv.Itoa(sum(lsoa.PersonsByAge))
+		}
+		if v := b.LSOAs[code]; !math.IsNaN(v) {
+			row[7] = fmt.Sprintf("%f", v)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
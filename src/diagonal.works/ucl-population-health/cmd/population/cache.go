@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The version of the cache layout and encoding, included in every key, so
+// that changing either invalidates all existing artifacts. Changes to a
+// single stage should instead increment that stage's version.
+const CacheVersion = 2
+
+// The versions of each cached stage, to be incremented when the stage's
+// code changes in a way that alters its output
+const (
+	CacheStageLSOAs        = "lsoas"
+	CacheStageLSOAsV       = 1
+	CacheStageGPPractices  = "gp-practices"
+	CacheStageGPPracticesV = 3
+	CacheStageNearbyGPs    = "nearby-gps"
+	CacheStageNearbyGPsV   = 2
+	CacheStagePopulation   = "population"
+	CacheStagePopulationV  = 3
+	CacheStageTargetYear   = "target-year"
+	CacheStageTargetYearV  = 1
+)
+
+const cacheFileHashesFilename = "file-hashes.json"
+
+// Cache holds the output of expensive pipeline stages in a directory, as
+// artifacts keyed by a hash of the stage's version, input files and
+// parameters, allowing stages to be skipped when rerun with unchanged
+// inputs. Stages that depend on others include their keys, so changing an
+// input rebuilds everything downstream of it.
+//
+// Artifacts are also namespaced by the scope of their key: the names,
+// rather than contents, of input files, and the parameters, like the ICB
+// and search radius. Building a stage only replaces the artifacts of
+// previous keys with the same scope, so runs for different ICBs, worlds or
+// parameters can share a directory, concurrently, without rebuilding each
+// other's stages.
+type Cache struct {
+	Directory string
+	// If true, every stage is rebuilt, replacing existing artifacts
+	Force bool
+
+	// Content hashes of input files, keyed by absolute filename, reused
+	// while a file's size and modification time are unchanged, to avoid
+	// rereading large worlds on every run
+	hashes map[string]cachedFileHash
+	lock   sync.Mutex
+}
+
+type cachedFileHash struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modtime"`
+	Hash    string `json:"hash"`
+}
+
+func NewCache(directory string, force bool) *Cache {
+	c := &Cache{Directory: directory, Force: force, hashes: make(map[string]cachedFileHash)}
+	if f, err := os.Open(filepath.Join(directory, cacheFileHashesFilename)); err == nil {
+		if err := json.NewDecoder(f).Decode(&c.hashes); err != nil {
+			Warningf("cache: ignoring file hashes: %s", err)
+			c.hashes = make(map[string]cachedFileHash)
+		}
+		f.Close()
+	}
+	return c
+}
+
+// fileExists returns true if filename exists, for keys that depend on
+// optional datasets only when they're present.
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func (c *Cache) fileHash(filename string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	c.lock.Lock()
+	cached, ok := c.hashes[abs]
+	c.lock.Unlock()
+	if ok && cached.Size == info.Size() && cached.ModTime == info.ModTime().UnixNano() {
+		return cached.Hash, nil
+	}
+
+	Debugf("cache: hash %s", filename)
+	f, err := os.Open(abs)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %s", filename, err)
+	}
+	cached = cachedFileHash{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Hash: hex.EncodeToString(h.Sum(nil))}
+	c.lock.Lock()
+	c.hashes[abs] = cached
+	c.lock.Unlock()
+	return cached.Hash, nil
+}
+
+// writeFileHashes merges the file hashes with those written by other runs
+// sharing the directory since this one started, and replaces the file
+// atomically, so that concurrent runs never read a partial file.
+func (c *Cache) writeFileHashes() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	filename := filepath.Join(c.Directory, cacheFileHashesFilename)
+	if f, err := os.Open(filename); err == nil {
+		written := make(map[string]cachedFileHash)
+		if err := json.NewDecoder(f).Decode(&written); err == nil {
+			for abs, hash := range written {
+				if _, ok := c.hashes[abs]; !ok {
+					c.hashes[abs] = hash
+				}
+			}
+		}
+		f.Close()
+	}
+	f, err := os.CreateTemp(c.Directory, cacheFileHashesFilename+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(c.hashes); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// CacheKey accumulates the inputs of a stage. Errors reading input files
+// are returned by Cache.Stage. The scope accumulates the same inputs, but
+// with the names of files rather than their contents, and without the
+// versions.
+type CacheKey struct {
+	Stage string
+	cache *Cache
+	hash  hash.Hash
+	scope hash.Hash
+	err   error
+}
+
+func (c *Cache) Key(stage string, version int) *CacheKey {
+	k := &CacheKey{Stage: stage, cache: c, hash: sha256.New(), scope: sha256.New()}
+	k.AddValue("stage", stage)
+	fmt.Fprintf(k.hash, "%q=%q\n", "cache-version", strconv.Itoa(CacheVersion))
+	fmt.Fprintf(k.hash, "%q=%q\n", "stage-version", strconv.Itoa(version))
+	return k
+}
+
+func (k *CacheKey) AddValue(name string, value string) {
+	fmt.Fprintf(k.hash, "%q=%q\n", name, value)
+	fmt.Fprintf(k.scope, "%q=%q\n", name, value)
+}
+
+func (k *CacheKey) AddFile(filename string) {
+	if k.err != nil {
+		return
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		k.err = err
+		return
+	}
+	h, err := k.cache.fileHash(abs)
+	if err != nil {
+		k.err = err
+		return
+	}
+	fmt.Fprintf(k.hash, "%q=%q\n", "file", h)
+	fmt.Fprintf(k.scope, "%q=%q\n", "file", abs)
+}
+
+// AddDataset adds the contents of a dataset's file, together with its
+// column mapping, since the same file read with different columns yields
+// different results.
+func (k *CacheKey) AddDataset(dataset *Dataset) {
+	k.AddFile(dataset.Filename)
+	names := make([]string, 0, len(dataset.Columns))
+	for name := range dataset.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		k.AddValue("column:"+name, dataset.Columns[name])
+	}
+}
+
+// AddKey makes this stage depend on another
+func (k *CacheKey) AddKey(other *CacheKey) {
+	if other.err != nil && k.err == nil {
+		k.err = other.err
+	}
+	fmt.Fprintf(k.hash, "%q=%q\n", "key:"+other.Stage, other.String())
+	fmt.Fprintf(k.scope, "%q=%q\n", "key:"+other.Stage, other.Scope())
+}
+
+func (k *CacheKey) String() string {
+	return hex.EncodeToString(k.hash.Sum(nil))
+}
+
+// Scope returns the hash of the key's scope, shared by the keys of runs
+// that differ only in the contents of their input files, or in versions.
+func (k *CacheKey) Scope() string {
+	return hex.EncodeToString(k.scope.Sum(nil))
+}
+
+// Filename returns the name of a file, in the cache's directory, with the
+// given prefix and extension, namespaced by the key's scope.
+func (k *CacheKey) Filename(prefix string, extension string) string {
+	return filepath.Join(k.cache.Directory, fmt.Sprintf("%s-%s%s", prefix, k.Scope()[0:8], extension))
+}
+
+func (k *CacheKey) filename() string {
+	return filepath.Join(k.cache.Directory, fmt.Sprintf("%s-%s-%s.gob", k.Stage, k.Scope()[0:8], k.String()[0:16]))
+}
+
+// Stage reads the artifact for key into v, which must be a pointer, if it
+// exists and the cache isn't forced. Otherwise, it calls build, which is
+// expected to fill v, and writes v as the new artifact for the stage,
+// removing those for previous keys with the same scope. Artifacts are
+// written to a temporary file, then renamed, so that concurrent runs
+// building the same stage never read a partial artifact. It returns true
+// if the artifact was read from the cache.
+func (c *Cache) Stage(key *CacheKey, v interface{}, build func() error) (bool, error) {
+	if key.err != nil {
+		return false, fmt.Errorf("cache: %s: %s", key.Stage, key.err)
+	}
+	filename := key.filename()
+	if !c.Force {
+		if f, err := os.Open(filename); err == nil {
+			err = gob.NewDecoder(f).Decode(v)
+			f.Close()
+			if err == nil {
+				log.Printf("  cache: %s: reused %s", key.Stage, filepath.Base(filename))
+				return true, nil
+			}
+			Warningf("cache: %s: rebuilding, failed to read %s: %s", key.Stage, filename, err)
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	if err := build(); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(c.Directory, 0755); err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp(c.Directory, filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	temporary := f.Name()
+	if err := gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(temporary)
+		return false, fmt.Errorf("cache: %s: %s", key.Stage, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(temporary)
+		return false, err
+	}
+	if err := os.Chmod(temporary, 0644); err != nil {
+		os.Remove(temporary)
+		return false, err
+	}
+	if err := os.Rename(temporary, filename); err != nil {
+		os.Remove(temporary)
+		return false, err
+	}
+	if previous, err := filepath.Glob(filepath.Join(c.Directory, fmt.Sprintf("%s-%s-*.gob", key.Stage, key.Scope()[0:8]))); err == nil {
+		for _, p := range previous {
+			if p != filename {
+				os.Remove(p)
+			}
+		}
+	}
+	log.Printf("  cache: %s: wrote %s", key.Stage, filepath.Base(filename))
+	return false, c.writeFileHashes()
+}
+
+func lsoasCacheKey(cache *Cache, geography *CensusGeography, worlds []string) *CacheKey {
+	k := cache.Key(CacheStageLSOAs, CacheStageLSOAsV)
+	k.AddValue("census-year", strconv.Itoa(geography.Year))
+	k.AddDataset(geography.Persons)
+	k.AddDataset(geography.Males)
+	k.AddDataset(geography.Females)
+	for _, world := range worlds {
+		k.AddFile(world)
+	}
+	return k
+}
+
+// targetYearCacheKey covers the LSOAs once reweighted to the estimates of
+// a target year, and is used in place of their key by later stages.
+func targetYearCacheKey(cache *Cache, lsoas *CacheKey, year int, data DataManifest, lsoaTotals bool) *CacheKey {
+	k := cache.Key(CacheStageTargetYear, CacheStageTargetYearV)
+	k.AddKey(lsoas)
+	k.AddValue("year", strconv.Itoa(year))
+	k.AddDataset(data.Get(DatasetLSOAICB))
+	k.AddDataset(data.Get(DatasetPopulationEstimates))
+	if lsoaTotals {
+		k.AddDataset(data.Get(DatasetLSOAPopulationEstimates))
+	}
+	return k
+}
+
+func gpPracticesCacheKey(cache *Cache, data DataManifest, worlds []string) *CacheKey {
+	k := cache.Key(CacheStageGPPractices, CacheStageGPPracticesV)
+	k.AddDataset(data.Get(DatasetGPPractices))
+	if postcodes := data.Get(DatasetONSPD); fileExists(postcodes.Filename) {
+		k.AddDataset(postcodes)
+	}
+	if geocodes := data.Get(DatasetGeocodes); fileExists(geocodes.Filename) {
+		k.AddDataset(geocodes)
+	}
+	for _, world := range worlds {
+		k.AddFile(world)
+	}
+	return k
+}
+
+func nearbyGPsCacheKey(cache *Cache, practices *CacheKey, radiusM float64) *CacheKey {
+	k := cache.Key(CacheStageNearbyGPs, CacheStageNearbyGPsV)
+	k.AddKey(practices)
+	k.AddValue("radius", strconv.FormatFloat(radiusM, 'g', -1, 64))
+	return k
+}
+
+// populationCacheKey covers the inputs of buildPopulation: the LSOAs from
+// which people are drawn, and the practices, list sizes, practice changes
+// rurality model and simulation parameters used to assign them.
+func populationCacheKey(cache *Cache, lsoas *CacheKey, practices *CacheKey, nearby *CacheKey, homes LSOASet, data DataManifest, rurality *RuralityModel, parameters SimulationParameters, changes *PracticeChanges) *CacheKey {
+	k := cache.Key(CacheStagePopulation, CacheStagePopulationV)
+	k.AddKey(lsoas)
+	k.AddKey(practices)
+	k.AddKey(nearby)
+	k.AddDataset(data.Get(DatasetQOFListSizes))
+	// List sizes of predecessors are added to their successors, if the
+	// optional successors file is present
+	if successors := data.Get(DatasetGPPracticeSuccessors); fileExists(successors.Filename) {
+		k.AddDataset(successors)
+	}
+	codes := make([]string, 0, len(homes))
+	for code := range homes {
+		codes = append(codes, code.String())
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		k.AddValue("home", code)
+	}
+	k.AddValue("parameters", parameters.String())
+	if rurality != nil {
+		k.AddDataset(data.Get(DatasetLSOARuralUrban))
+		k.AddValue("rurality", fmt.Sprintf("%+v", *rurality))
+	}
+	if !changes.IsEmpty() {
+		// The baseline is only used for comparison, once people are assigned
+		applied := *changes
+		applied.Baseline = ""
+		k.AddValue("practice-changes", fmt.Sprintf("%+v", applied))
+	}
+	return k
+}
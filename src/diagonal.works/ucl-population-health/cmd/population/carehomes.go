@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// Column headers of the CQC care directory, see
+// https://www.cqc.org.uk/about-us/transparency/using-cqc-data
+const (
+	CareHomeIDColumn       = "Location ID"
+	CareHomeNameColumn     = "Location Name"
+	CareHomeCareHomeColumn = "Care home?"
+	CareHomeBedsColumn     = "Care homes beds"
+	CareHomePostcodeColumn = "Location Postal Code"
+)
+
+const (
+	// People of this age and over are placed into care homes
+	CareHomeMinAge = 75
+	// The fraction of beds occupied, in line with that reported for older
+	// people's care homes in England
+	CareHomeOccupancy = 0.87
+)
+
+// The relative likelihood of living in a care home for people aged 75 and
+// over, from the census share of each age group in communal establishments
+var careHomeAgeWeights = []AgePrevalence{
+	{Ages: AgeRange{Begin: 75, End: 85}, Prevalence: 1.0},
+	{Ages: AgeRange{Begin: 85, End: 90}, Prevalence: 3.5},
+	{Ages: AgeRange{Begin: 90, End: 200}, Prevalence: 8.0},
+}
+
+type CareHomeID string
+
+const CareHomeIDInvalid CareHomeID = ""
+
+func (c CareHomeID) String() string {
+	return string(c)
+}
+
+type CareHome struct {
+	ID       CareHomeID
+	Name     string
+	Postcode string
+	Location s2.Point
+	LSOA     LSOACode
+	Beds     int
+	// The practice with which residents are registered, in the absence of
+	// published alignments, the nearest to the home
+	GP GPPracticeCode
+
+	Residents int
+}
+
+// readCareHomes returns the care homes in the CQC care directory, located
+// by postcode, in w or among the historic postcodes of postcodes. Locations
+// that aren't care homes, or that have no beds, are skipped.
+func readCareHomes(dataset *Dataset, postcodes PostcodeSources, w b6.World) (map[CareHomeID]*CareHome, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"id", "name", "care-home", "beds", "postcode"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+
+	homes := make(map[CareHomeID]*CareHome)
+	candidates := 0
+	locator := newPostcodeLocator(worldPostcodes(w), "care-home", dataset)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if row[columns[dataset.Column("care-home")]] != "Y" {
+			continue
+		}
+		beds, err := strconv.Atoi(row[columns[dataset.Column("beds")]])
+		if err != nil || beds <= 0 {
+			continue
+		}
+		home := &CareHome{
+			ID:       CareHomeID(row[columns[dataset.Column("id")]]),
+			Name:     row[columns[dataset.Column("name")]],
+			Postcode: row[columns[dataset.Column("postcode")]],
+			Beds:     beds,
+		}
+		candidates++
+		locator.Locate(string(home.ID), home.Postcode, func(p s2.Point) {
+			home.Location = p
+			if home.LSOA = lsoaContaining(p, w); home.LSOA != "" {
+				homes[home.ID] = home
+			}
+		})
+	}
+	if err := locator.Finish(postcodes); err != nil {
+		return nil, err
+	}
+	countMissingPostcodes(dataset, locator.Missing)
+	log.Printf("  care homes: %d", len(homes))
+	log.Printf("    missing locations: %d", candidates-len(homes))
+	locator.logFallbacks("    ")
+	return homes, nil
+}
+
+// nearestGPPractice returns the nearest active practice with a list to
+// the care home, from those near its LSOA.
+func (c *CareHome) nearestGPPractice(nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice) GPPracticeCode {
+	nearest := GPPracticeCodeInvalid
+	distance := math.Inf(1)
+	for _, code := range nearbyGPs.Practices(c.LSOA) {
+		gp := gps[code]
+		if gp.Status != GPPracticeStatusActive || gp.ListSize == 0 {
+			continue
+		}
+		if d := float64(c.Location.Distance(gp.Location)); d < distance {
+			nearest, distance = code, d
+		}
+	}
+	return nearest
+}
+
+// assignCareHomes places people aged CareHomeMinAge and over into the care
+// homes in their home LSOA, filling the occupied beds, with older people
+// more likely to be chosen. Residents are registered with the practice
+// serving the home, replacing the practice assigned by distance.
+func assignCareHomes(people []Person, careHomes map[CareHomeID]*CareHome, homes LSOASet, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice) {
+	ids := make([]CareHomeID, 0, len(careHomes))
+	for id, home := range careHomes {
+		if _, ok := homes[home.LSOA]; ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Candidates by LSOA, ordered by a random key weighted by age, so that
+	// taking them in order samples without replacement
+	type candidate struct {
+		person *Person
+		key    float64
+	}
+	candidates := make(map[LSOACode][]candidate)
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := range people {
+		p := &people[i]
+		if p.Age < CareHomeMinAge {
+			continue
+		}
+		weight := 0.0
+		for _, w := range careHomeAgeWeights {
+			if w.Ages.Contains(p.Age) {
+				weight = w.Prevalence
+			}
+		}
+		if weight > 0.0 {
+			candidates[p.Home] = append(candidates[p.Home], candidate{person: p, key: math.Pow(rng.Float64(), 1.0/weight)})
+		}
+	}
+	for _, c := range candidates {
+		sort.Slice(c, func(i, j int) bool { return c[i].key > c[j].key })
+	}
+
+	placed, beds, shortfall, unserved := 0, 0, 0, 0
+	for _, id := range ids {
+		home := careHomes[id]
+		home.GP = home.nearestGPPractice(nearbyGPs, gps)
+		if home.GP == GPPracticeCodeInvalid {
+			unserved++
+		}
+		residents := int(math.Round(float64(home.Beds) * CareHomeOccupancy))
+		beds += home.Beds
+		c := candidates[home.LSOA]
+		for home.Residents < residents && len(c) > 0 {
+			p := c[0].person
+			c = c[1:]
+			p.CareHome = home.ID
+			if home.GP != GPPracticeCodeInvalid && p.GP != home.GP {
+				if p.GP != GPPracticeCodeInvalid {
+					gps[p.GP].SimulatedListSize--
+				}
+				p.GP = home.GP
+				gps[p.GP].SimulatedListSize++
+			}
+			home.Residents++
+		}
+		candidates[home.LSOA] = c
+		shortfall += residents - home.Residents
+		placed += home.Residents
+	}
+	log.Printf("  care homes: %d beds: %d residents: %d", len(ids), beds, placed)
+	if shortfall > 0 {
+		Warningf("  care homes: %d occupied beds left empty, with too few people aged %d+ in their LSOAs", shortfall, CareHomeMinAge)
+	}
+	if unserved > 0 {
+		Warningf("  care homes: %d without a nearby practice, residents keep their assigned practice", unserved)
+	}
+}
+
+// writeCareHomes writes care-homes.csv, with the residents placed in each
+// care home among homes, and the practice serving it.
+func writeCareHomes(careHomes map[CareHomeID]*CareHome, homes LSOASet, outputDirectory string) error {
+	ids := make([]CareHomeID, 0, len(careHomes))
+	for id, home := range careHomes {
+		if _, ok := homes[home.LSOA]; ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "care-homes.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"id", "name", "postcode", "lsoa", "beds", "residents", "gp"})
+	for _, id := range ids {
+		home := careHomes[id]
+		w.Write([]string{home.ID.String(), home.Name, home.Postcode, home.LSOA.String(), strconv.Itoa(home.Beds), strconv.Itoa(home.Residents), home.GP.String()})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"diagonal.works/b6"
+	"diagonal.works/b6/ingest"
+	"diagonal.works/b6/ingest/compact"
+	"github.com/golang/geo/s2"
+)
+
+const NamespaceCatchments = b6.Namespace("diagonal.works/ucl-population-health/catchment")
+
+// The default minimum share of a practice's simulated patients an LSOA
+// must contribute to be part of its catchment
+const DefaultCatchmentMinShare = 0.01
+
+type CatchmentLSOA struct {
+	LSOA     LSOACode
+	Patients int
+}
+
+// Catchment is the effective catchment of a practice, derived from the
+// simulated assignment of people to practices, rather than the boundary a
+// practice publishes: the LSOAs that each contribute at least a minimum
+// share of its simulated patients.
+type Catchment struct {
+	Practice GPPracticeCode
+	// Simulated patients living in homes, from every LSOA
+	Patients int
+	// LSOAs in the catchment, ordered by code
+	LSOAs []CatchmentLSOA
+}
+
+// Covered returns the number of the practice's simulated patients living
+// within its catchment.
+func (c *Catchment) Covered() int {
+	covered := 0
+	for _, l := range c.LSOAs {
+		covered += l.Patients
+	}
+	return covered
+}
+
+// Share returns the fraction of the practice's simulated patients living
+// in the given number of them, or 0 if it has none.
+func (c *Catchment) Share(patients int) float64 {
+	if c.Patients > 0 {
+		return float64(patients) / float64(c.Patients)
+	}
+	return 0.0
+}
+
+// buildCatchments returns the catchment of each of the selected practices,
+// ordered by practice code, from the LSOAs contributing at least minShare
+// of the practice's simulated patients living in homes.
+func buildCatchments(selected GPPracticeCodeSet, byPractice map[GPPracticeCode][]*Person, homes LSOASet, minShare float64) []*Catchment {
+	catchments := make([]*Catchment, 0, len(selected))
+	byCode := make(map[GPPracticeCode]*Catchment)
+	flows := simulatedFlows(selected, byPractice, homes)
+	for _, flow := range flows {
+		c, ok := byCode[flow.Practice]
+		if !ok {
+			c = &Catchment{Practice: flow.Practice}
+			byCode[flow.Practice] = c
+			catchments = append(catchments, c)
+		}
+		c.Patients += flow.Simulated
+	}
+	for _, flow := range flows {
+		c := byCode[flow.Practice]
+		if c.Share(flow.Simulated) >= minShare {
+			c.LSOAs = append(c.LSOAs, CatchmentLSOA{LSOA: flow.LSOA, Patients: flow.Simulated})
+		}
+	}
+	return catchments
+}
+
+// catchmentPolygons returns the boundaries of the LSOAs in a catchment,
+// without dissolving shared edges, as findMSOABoundary does, together with
+// the number of LSOAs whose boundary wasn't found in the world.
+func catchmentPolygons(c *Catchment, geography *CensusGeography, w b6.World) ([]*s2.Polygon, int) {
+	polygons := make([]*s2.Polygon, 0, len(c.LSOAs))
+	missing := 0
+	for _, l := range c.LSOAs {
+		area := findLSOABoundary(l.LSOA, geography.Year, w)
+		if area == nil {
+			missing++
+			continue
+		}
+		for i := 0; i < area.Len(); i++ {
+			polygons = append(polygons, area.Polygon(i))
+		}
+	}
+	return polygons, missing
+}
+
+// CatchmentSource emits each practice's catchment as a b6 area, tagged
+// with the number of patients it covers, so that catchments can be
+// visualised, and compared between scenarios, alongside the practices
+// written by the features command.
+type CatchmentSource struct {
+	Catchments []*Catchment
+	GPs        map[GPPracticeCode]*GPPractice
+	Polygons   map[GPPracticeCode][]*s2.Polygon
+	Scenario   string
+}
+
+func (s *CatchmentSource) Read(options ingest.ReadOptions, emit ingest.Emit, ctx context.Context) error {
+	for _, c := range s.Catchments {
+		polygons := s.Polygons[c.Practice]
+		if len(polygons) == 0 {
+			continue
+		}
+		area := ingest.NewAreaFeature(len(polygons))
+		area.AreaID = b6.AreaID{Namespace: NamespaceCatchments, Value: compact.HashString(string(c.Practice))}
+		for i, p := range polygons {
+			area.SetPolygon(i, p)
+		}
+		area.Tags = []b6.Tag{
+			{Key: "#catchment", Value: "gp"},
+			{Key: "code", Value: c.Practice.String()},
+			{Key: "name", Value: s.GPs[c.Practice].Name},
+			{Key: "catchment:patients", Value: strconv.Itoa(c.Patients)},
+			{Key: "catchment:covered", Value: strconv.Itoa(c.Covered())},
+			{Key: "catchment:lsoas", Value: strconv.Itoa(len(c.LSOAs))},
+		}
+		if s.Scenario != "" {
+			area.Tags = append(area.Tags, b6.Tag{Key: "catchment:scenario", Value: s.Scenario})
+		}
+		if err := emit(area, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCatchments writes catchments.csv, with the LSOAs in each practice's
+// catchment, catchments.geojson, with the boundary of each catchment as
+// the union of those of its LSOAs, and catchments.index, with the same
+// boundaries as a b6 compact index.
+func writeCatchments(catchments []*Catchment, gps map[GPPracticeCode]*GPPractice, geography *CensusGeography, w b6.World, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "catchments.csv"))
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"scenario", "practice", "lsoa", "patients", "share"})
+	for _, c := range catchments {
+		for _, l := range c.LSOAs {
+			cw.Write([]string{scenario, c.Practice.String(), l.LSOA.String(), strconv.Itoa(l.Patients), fmt.Sprintf("%f", c.Share(l.Patients))})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	polygons := make(map[GPPracticeCode][]*s2.Polygon)
+	missingBoundaries := 0
+	features := make([]*GeoJSONFeature, 0, len(catchments))
+	for _, c := range catchments {
+		ps, missing := catchmentPolygons(c, geography, w)
+		missingBoundaries += missing
+		if len(ps) == 0 {
+			continue
+		}
+		polygons[c.Practice] = ps
+		g := &GeoJSONGeometry{Type: "MultiPolygon"}
+		for _, p := range ps {
+			g.Coordinates = append(g.Coordinates, polygonToGeoJSON(p)...)
+		}
+		features = append(features, &GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: g,
+			Properties: map[string]interface{}{
+				"scenario": scenario,
+				"code":     c.Practice.String(),
+				"name":     gps[c.Practice].Name,
+				"patients": c.Patients,
+				"covered":  c.Covered(),
+				"share":    c.Share(c.Covered()),
+				"lsoas":    len(c.LSOAs),
+			},
+		})
+	}
+	if missingBoundaries > 0 {
+		Warningf("  catchments: %d LSOAs without boundaries omitted from catchments.geojson", missingBoundaries)
+	}
+	if err := writeGeoJSON(filepath.Join(outputDirectory, "catchments.geojson"), features); err != nil {
+		return err
+	}
+
+	source := CatchmentSource{Catchments: catchments, GPs: gps, Polygons: polygons, Scenario: scenario}
+	config := compact.Options{
+		OutputFilename:       filepath.Join(outputDirectory, "catchments.index"),
+		Goroutines:           runtime.NumCPU(),
+		WorkDirectory:        "",
+		PointsWorkOutputType: compact.OutputTypeMemory,
+	}
+	return compact.Build(&source, &config)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+const (
+	LSOA11To21LSOA11CodeColumn = "LSOA11CD"
+	LSOA11To21LSOA21CodeColumn = "LSOA21CD"
+)
+
+// LSOACodeTranslation maps 2011 LSOA codes onto the LSOA codes of another
+// census geography. LSOAs split in the new geography map to more than one
+// code, while LSOAs merged in the new geography share a code.
+type LSOACodeTranslation map[LSOACode][]LSOACode
+
+// Translate returns the codes in the target geography for the given 2011
+// LSOA code. A nil translation is the identity.
+func (l LSOACodeTranslation) Translate(code LSOACode) []LSOACode {
+	if l == nil {
+		return []LSOACode{code}
+	}
+	return l[code]
+}
+
+// Inverse returns the translation from codes of the target geography back
+// to 2011 LSOA codes. LSOAs merged in the target geography map back to
+// each of the 2011 LSOAs they were merged from.
+func (l LSOACodeTranslation) Inverse() LSOACodeTranslation {
+	inverse := make(LSOACodeTranslation)
+	for lsoa11, translated := range l {
+		for _, t := range translated {
+			inverse[t] = append(inverse[t], lsoa11)
+		}
+	}
+	for _, codes := range inverse {
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	}
+	return inverse
+}
+
+// CensusGeography describes the census year from which LSOA codes and
+// boundaries are drawn. Many of our datasets (ICB membership, MSOAs, IMD)
+// are only published against 2011 LSOAs, so for other years, we translate
+// their codes using the ONS lookup.
+type CensusGeography struct {
+	Year       int
+	Persons    *Dataset
+	Males      *Dataset
+	Females    *Dataset
+	FromLSOA11 LSOACodeTranslation
+}
+
+func censusGeographyForYear(year int, data DataManifest) (*CensusGeography, error) {
+	switch year {
+	case 2011:
+		return &CensusGeography{
+			Year:    2011,
+			Persons: data.Get(DatasetLSOAPersons),
+			Males:   data.Get(DatasetLSOAMales),
+			Females: data.Get(DatasetLSOAFemales),
+		}, nil
+	case 2021:
+		translation, err := readLSOA11To21(data.Get(DatasetLSOA11To21))
+		if err != nil {
+			return nil, err
+		}
+		return &CensusGeography{
+			Year:       2021,
+			Persons:    data.Get(DatasetLSOA21Persons),
+			Males:      data.Get(DatasetLSOA21Males),
+			Females:    data.Get(DatasetLSOA21Females),
+			FromLSOA11: translation,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported census year %d", year)
+}
+
+// FromLSOA21 returns the translation of 2021 LSOA codes, used by tables
+// of the 2021 census, onto the census geography: the identity for 2021,
+// and for 2011, the inverse of the ONS lookup, which is read from data.
+func (c *CensusGeography) FromLSOA21(data DataManifest) (LSOACodeTranslation, error) {
+	if c.Year == 2021 {
+		return nil, nil
+	}
+	dataset := data.Get(DatasetLSOA11To21)
+	if !fileExists(dataset.Filename) {
+		return nil, fmt.Errorf("%s: needed to translate 2021 LSOAs onto %d LSOAs, or use --census-year=2021", dataset.Filename, c.Year)
+	}
+	translation, err := readLSOA11To21(dataset)
+	if err != nil {
+		return nil, err
+	}
+	return translation.Inverse(), nil
+}
+
+// readLSOA11To21 reads the ONS LSOA (2011) to LSOA (2021) lookup, see
+// https://geoportal.statistics.gov.uk/datasets/ons::lsoa-2011-to-lsoa-2021-to-local-authority-district-2022-lookup-for-england-and-wales
+func readLSOA11To21(dataset *Dataset) (LSOACodeTranslation, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	lsoa11Column, lsoa21Column := dataset.Column("lsoa11-code"), dataset.Column("lsoa21-code")
+	if _, ok := columns[lsoa11Column]; !ok {
+		return nil, fmt.Errorf("%s: no %s column", dataset.Filename, lsoa11Column)
+	}
+	if _, ok := columns[lsoa21Column]; !ok {
+		return nil, fmt.Errorf("%s: no %s column", dataset.Filename, lsoa21Column)
+	}
+
+	translation := make(LSOACodeTranslation)
+	splits := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		lsoa11 := LSOACode(row[columns[lsoa11Column]])
+		lsoa21 := LSOACode(row[columns[lsoa21Column]])
+		if len(translation[lsoa11]) == 1 {
+			splits++
+		}
+		translation[lsoa11] = append(translation[lsoa11], lsoa21)
+	}
+	log.Printf("lsoa 2011 to 2021: %d lsoas split: %d", len(translation), splits)
+	return translation, nil
+}
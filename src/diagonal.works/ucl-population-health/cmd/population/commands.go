@@ -0,0 +1,757 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"diagonal.works/b6"
+	"diagonal.works/b6/ingest/compact"
+)
+
+// Command is a stage of the pipeline, run as population <name>, with its
+// own flags, so that those of one stage don't clutter the help of others.
+type Command struct {
+	Name        string
+	Description string
+	Run         func(args []string) error
+}
+
+var Commands = []Command{
+	{Name: "simulate", Description: "Simulate the population of --scope, writing it, and aggregates of it, to --output", Run: simulateMain},
+	{Name: "nearby-gps", Description: "Build the lookup of the practices near each LSOA in --cached, and write it as CSV", Run: nearbyGPsMain},
+	{Name: "features", Description: "Write nhs.index, a compact world containing healthcare features", Run: featuresMain},
+	{Name: "validate", Description: "Check that " + PrevalencesFilename + " is well formed, and gives every prevalence needed, and optionally compare data manifests", Run: validateMain},
+	{Name: "estimate-prevalences", Description: "Estimate the prevalences of conditions, alone and in pairs, by age and sex, from a person level extract, writing them in the form of " + PrevalencesFilename, Run: estimatePrevalencesMain},
+	{Name: "rpc", Description: "Answer JSON-RPC requests to run the simulation, and query its results, on stdin and stdout, keeping the world loaded between runs", Run: rpcMain},
+	{Name: "serve", Description: "Answer queries for aggregate counts and prevalences of the population previously written to --output over HTTP", Run: serveMain},
+	{Name: "batch", Description: "Simulate the population of many scopes, with a summary of their outputs", Run: batchMain},
+	{Name: "runs", Description: "Write " + RunIndexFilename + ", an index of the runs completed within --output, with their headline metrics", Run: runsMain},
+	{Name: "benchmark", Description: "Position the practices of an ICB against every practice in England, with prevalences expected from their registrations, without simulation", Run: benchmarkMain},
+	{Name: "jobs", Description: "Write a Kubernetes or Cloud Batch job manifest for each scope of a batch, with resources sized from its population", Run: jobsMain},
+}
+
+// ReplacedFlags maps the flags that chose what was run, before commands,
+// to the commands that replaced them, to help with old command lines.
+var ReplacedFlags = map[string]string{
+	"population":        "simulate",
+	"demo":              "simulate --demo",
+	"nearby-gps":        "nearby-gps",
+	"features":          "features",
+	"check-prevalences": "validate",
+	"compare-data":      "validate --compare-data",
+	"rpc":               "rpc",
+	"serve":             "serve --address",
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range Commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", c.Name, c.Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> --help for the flags of each command.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage()
+		return
+	}
+	for _, c := range Commands {
+		if c.Name == name {
+			if err := c.Run(os.Args[2:]); err != nil {
+				Fatal(err)
+			}
+			return
+		}
+	}
+	given, _, _ := strings.Cut(strings.TrimLeft(name, "-"), "=")
+	if replaced, ok := ReplacedFlags[given]; ok && strings.HasPrefix(name, "-") {
+		fmt.Fprintf(os.Stderr, "%s: --%s is replaced by %s %s\n\n", os.Args[0], given, os.Args[0], replaced)
+	} else if strings.HasPrefix(name, "-") {
+		fmt.Fprintf(os.Stderr, "%s: flags are given after a command, eg %s simulate %s\n\n", os.Args[0], os.Args[0], name)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", os.Args[0], name)
+	}
+	usage()
+	os.Exit(2)
+}
+
+// newFlagSet returns the flags of a command, with help giving its
+// description.
+func newFlagSet(name string, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n\n%s.\n\nFlags:\n", os.Args[0], name, description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// baseFlags are given to every command
+type baseFlags struct {
+	config      *string
+	logFormat   *string
+	logLevel    *string
+	progress    *bool
+	remoteCache *string
+}
+
+func addBaseFlags(flags *flag.FlagSet) *baseFlags {
+	return &baseFlags{
+		config:      flags.String("config", "", "YAML file of flag values, keyed by flag name, layered over the files it lists under include, with ${NAME} and ${NAME:-default} replaced by environment variables. Flags given on the command line take precedence."),
+		logFormat:   flags.String("log-format", "text", "Format of log output: text or json"),
+		logLevel:    flags.String("log-level", "info", "Minimum level of log output: debug, info, warning or error"),
+		progress:    flags.Bool("progress", false, "Log percentage completion, and estimated time remaining, of long running stages"),
+		remoteCache: flags.String("remote-cache", remoteFiles.Directory, "Directory to which inputs given as gs:// or s3:// URLs are downloaded, and reused while unchanged"),
+	}
+}
+
+// parse parses the flags of a command from args, then sets those not
+// given from --config, and downloads the inputs given as URLs.
+func (b *baseFlags) parse(flags *flag.FlagSet, args []string) error {
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%s: unexpected arguments: %s", flags.Name(), strings.Join(flags.Args(), " "))
+	}
+	remoteFiles.Directory = *b.remoteCache
+	if *b.config != "" {
+		config := *b.config
+		if isRemote(config) {
+			var err error
+			if config, err = remoteFiles.Fetch(config); err != nil {
+				return fmt.Errorf("config: %s", err)
+			}
+		}
+		if err := applyConfig(flags, config); err != nil {
+			return err
+		}
+		remoteFiles.Directory = *b.remoteCache
+	}
+	return fetchRemoteFlags(flags)
+}
+
+// setup configures logging, returning the progress to report
+func (b *baseFlags) setup() (Progress, error) {
+	logFormat, err := LogFormatFromString(*b.logFormat)
+	if err != nil {
+		return nil, err
+	}
+	logLevel, err := LogLevelFromString(*b.logLevel)
+	if err != nil {
+		return nil, err
+	}
+	setupLogging(logFormat, logLevel)
+	if *b.progress {
+		return &LogProgress{}, nil
+	}
+	return NoProgress{}, nil
+}
+
+// dataFlags choose the input datasets
+type dataFlags struct {
+	manifest   *string
+	censusYear *int
+	lsoa11To21 *string
+}
+
+func addDataFlags(flags *flag.FlagSet) *dataFlags {
+	return &dataFlags{
+		manifest:   flags.String("data-manifest", "", "YAML file mapping input datasets to filenames and column names, overriding the defaults"),
+		censusYear: flags.Int("census-year", 2011, "Census year of the LSOA geography to use, 2011 or 2021. Datasets published against 2011 LSOAs are translated for 2021."),
+		lsoa11To21: flags.String("lsoa-2011-2021", "", "ONS LSOA 2011 to 2021 lookup, used with --census-year=2021, overriding the lsoa11-lsoa21 dataset"),
+	}
+}
+
+func (d *dataFlags) read() (DataManifest, error) {
+	data, err := readDataManifest(*d.manifest)
+	if err != nil {
+		return nil, err
+	}
+	if *d.lsoa11To21 != "" {
+		data.Get(DatasetLSOA11To21).Filename = *d.lsoa11To21
+	}
+	return data, nil
+}
+
+// worldFlags choose the b6 world, and, for commands that cache the stages
+// built from it, the cache
+type worldFlags struct {
+	world  *string
+	cached *string
+	force  *bool
+}
+
+func addWorldFlags(flags *flag.FlagSet, cached bool) *worldFlags {
+	w := &worldFlags{world: flags.String("world", "world/codepoint-open-2023-02.index,world/lsoa-2011.index", "b6 world to load for GP nearby GP generation, as comma separated index filenames, or gs:// or s3:// URLs")}
+	if cached {
+		w.cached = flags.String("cached", "cached", "Directory for intermediate files")
+		w.force = flags.Bool("force", false, "Rebuild every cached stage, rather than reusing those with unchanged inputs")
+	}
+	return w
+}
+
+func (w *worldFlags) read() (b6.World, error) {
+	return compact.ReadWorld(*w.world, runtime.NumCPU())
+}
+
+func (w *worldFlags) filenames() []string {
+	return strings.Split(*w.world, ",")
+}
+
+func (w *worldFlags) cache() *Cache {
+	return NewCache(*w.cached, *w.force)
+}
+
+func addScopeFlag(flags *flag.FlagSet) *string {
+	return flags.String("scope", DefaultScope, "Area whose population is simulated: an ICB, as icb:<code>, or a borough, as borough:<local authority code>, eg borough:E09000007. simulate also accepts comma separated scopes")
+}
+
+func addConditionsFlag(flags *flag.FlagSet) *string {
+	return flags.String("conditions", DefaultQOFConditions, "Comma separated conditions to simulate, at any level of the hierarchy of sub-conditions, eg dm,dm1,dm2 to split diabetes by type, or dm1,dm2 to roll diabetes up from them")
+}
+
+func addTravelFlag(flags *flag.FlagSet) *string {
+	return flags.String("travel", "data/travel.yaml", "Assumptions used to estimate patient travel to GP practices")
+}
+
+func addRuralityFlag(flags *flag.FlagSet) *string {
+	return flags.String("rurality", "", "Read the rural-urban classification of LSOAs, and assign GP practices using the parameters for urban and rural LSOAs in this file, eg data/rurality.yaml. Use with nearby-gps when larger radii are given.")
+}
+
+func addParametersFlag(flags *flag.FlagSet) *string {
+	return flags.String("parameters", "", "Tune the assignment of people to GP practices with the parameters in this file, eg data/parameters.yaml, or use the built in defaults if empty")
+}
+
+func readRurality(filename string) (*RuralityModel, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	return readRuralityModel(filename)
+}
+
+// readConditions returns the conditions to simulate, after checking the
+// hierarchies and constraints between conditions are consistent.
+func readConditions(s string) ([]QOFCondition, error) {
+	if err := checkConditionHierarchies(QOFConditionHierarchies); err != nil {
+		return nil, err
+	}
+	if err := checkConditionConstraints(QOFConditionConstraints); err != nil {
+		return nil, err
+	}
+	return QOFConditionsFromString(s)
+}
+
+// addSimulationFlags adds the flags controlling the simulation to flags,
+// returning a function giving the options they describe, once parsed.
+func addSimulationFlags(flags *flag.FlagSet) func(data DataManifest, world *worldFlags, progress Progress) (*PopulationOptions, error) {
+	scopeFlag := addScopeFlag(flags)
+	outputFlag := flags.String("output", "output", "Directory for output files")
+	travelFlag := addTravelFlag(flags)
+	scenarioNameFlag := flags.String("scenario-name", "baseline", "Name of the scenario being simulated, included in outputs")
+	prescribingFlag := flags.String("prescribing", "", "Comma separated monthly English Prescribing Dataset files, optionally gzipped")
+	var setPrevalenceFlag PrevalenceOverrides
+	flags.Var(&setPrevalenceFlag, "set-prevalence", "Override a prevalence from "+PrevalencesFilename+", as <diagnosis>:<sex>:<ages>=<prevalence>, or *<factor> to scale it, eg dm:m:40-59=0.12. Can be given more than once.")
+	prevalenceOutlierFlag := flags.String("prevalence-outlier", DefaultPrevalenceOutlier, "How outlying reported QOF prevalence is adjusted: none, threshold:<prevalence>, replacing prevalence at or above it with the mean, zscore:<k>, replacing prevalence more than k standard deviations from the mean with the mean, or winsorize:<p>, clipping prevalence to the p and 1-p quantiles")
+	prescribingBiasWeightFlag := flags.Float64("prescribing-bias-weight", 0.0, "Weight given to prescribing volume, rather than reported QOF prevalence, when estimating condition bias")
+	admissionsFlag := flags.String("admissions", "", "Hospital admission rates used to estimate secondary care demand, eg data/admissions.yaml")
+	nhsNumbersFlag := flags.Bool("nhs-numbers", false, "Assign each person a valid NHS number from the range reserved for testing, for use as test data")
+	namesFlag := flags.String("names", "", "Assign each person a fake name from this file, eg data/names.yaml, and a date of birth, for use as test data")
+	profileFlag := flags.String("profile", "research", "Output profile controlling the columns, identifiers and geographies emitted: research, test-data or public")
+	scenarioFlag := flags.String("scenario", "", "YAML file describing changes to simulate against the baseline")
+	auditFlag := flags.Int("audit", 0, "Record why this many residents, sampled at random, were assigned their GP practice and each condition, writing audit.json, for reviewing the model, or 0 to skip")
+	homePointsFlag := flags.String("home-points", "none", "Sample the point at which each person lives within their home LSOA, written as home_lat and home_lng: none, uniform within its boundary, or within its residential landuse, or buildings, weighted by area")
+	conditionEncodingFlag := flags.String("condition-encoding", "onehot", "How the conditions of each person are written to population.csv: onehot, a condition_<condition> column for each, bitmask, a single conditions column, or long, a row for each of a person's conditions in "+PersonConditionsFilename)
+	aggregatePopulationFlag := flags.String("aggregate-population", "registered", "People entering aggregates: registered with an ICB practice, resident in the ICB, or both, reported separately")
+	smokingFlag := flags.String("smoking", "", "Assign each person a smoking status, and make condition risk depend on it, using this model, eg data/smoking.yaml")
+	measurementsFlag := flags.String("measurements", "", "Sample clinical measurements for people with conditions, and write the QOF achievement of each ICB practice, using this model, eg data/measurements.yaml")
+	costsFlag := flags.String("costs", "", "Attach the unit costs in this model to simulated GP appointments, prescribing, outpatient attendances and, with --admissions, admissions, eg data/costs.yaml, and write indicative spend by practice, condition, borough, MSOA and IMD decile")
+	targetYearFlag := flags.Int("target-year", 0, "Reweight the LSOA counts of the census snapshot to the ONS mid-year estimates of this year, by local authority, age and sex, from data/myeb1.csv.gz")
+	reweightFlag := flags.String("reweight", "", "After simulation, calibrate a weight for each person so that weighted totals match these external controls exactly, separated by commas: practices, for reported list sizes, boroughs, for mid-year population estimates, and conditions, for ICB QOF registers")
+	reweightYearFlag := flags.Int("reweight-year", 0, "With --reweight=boroughs, the year of the mid-year estimates used as controls, or --target-year if 0")
+	targetLSOATotalsFlag := flags.Bool("target-lsoa-totals", false, "With --target-year, also reweight to the estimated total population of each LSOA, from data/lsoa-population-estimates.csv.gz")
+	segmentsFlag := flags.String("segments", "", "Place each person into a population health segment, from healthy to end of life, using this model for frailty and end of life, eg data/segments.yaml, and write segment counts by practice and borough")
+	benefitsFlag := flags.String("benefits", "", "Assign each person the DWP benefits they claim, Universal Credit, PIP and Attendance Allowance, from claimants by LSOA, using this model for who claims them, eg data/benefits.yaml")
+	pcnsFlag := flags.Bool("pcns", false, "With --segments, also write segment counts by PCN, reading the PCN of each practice from data/epcn.csv.gz")
+	employmentFlag := flags.String("employment", "", "Assign each adult an economic activity status and NS-SEC occupation class, from census counts by LSOA, using this model for who has each, eg data/employment.yaml")
+	bmiFlag := flags.String("bmi", "", "Assign each adult a BMI, and make condition risk depend on obesity, using this model, eg data/bmi.yaml")
+	practiceSmokingFlag := flags.String("practice-smoking", "", "With --smoking, match smoking prevalence to this OHID Fingertips export of QOF smoking prevalence by practice")
+	ruralityFlag := addRuralityFlag(flags)
+	parametersFlag := addParametersFlag(flags)
+	otherSexPrevalenceFlag := flags.String("other-sex-prevalence", "average", "Rates used for people who are neither male nor female, where models don't give them: average, of males and females, male or female")
+	incidenceFlag := flags.String("incidence", "", "Sample the age at which people were diagnosed with each condition, using the incidence by age and sex in this file, eg data/incidence.yaml")
+	complicationsFlag := flags.String("complications", "", "With --incidence, also assign complications to people with a condition from the years since their diagnosis, using this model, eg data/complications.yaml, writing complications.csv")
+	detectionFlag := flags.String("detection", "", "Estimate the people living with a condition undiagnosed, from detection rates by age, sex and deprivation in this model, eg data/hypertension-detection.yaml, writing detection-gaps.csv")
+	controlFlag := flags.String("control", "", "Mark people with a condition as controlled, like diabetics with HbA1c at or below target, at the rate their practice achieved against the QOF indicators in this model, eg data/control.yaml, read from the qof-achievement dataset, writing <condition>_controlled columns")
+	backlogFlag := flags.String("backlog", "", "Estimate the backlog of a diagnostic service for people with a condition at each ICB practice, from the need and capacity in this model, eg data/spirometry.yaml, writing backlog-<service>.csv")
+	projectYearsFlag := flags.Int("project-years", 0, "With --incidence, also project the scope's residents forward this many years, with deaths, births, migration and new diagnoses, writing projection.csv, or 0 to skip")
+	projectionFlag := flags.String("projection", "data/projection.yaml", "With --project-years, the mortality, fertility and net migration by age and sex used to project the population")
+	conditionsFlag := addConditionsFlag(flags)
+	smallAreaFlag := flags.String("small-area", "", "Comma separated conditions, eg dm,copd, assigned using small area estimation from practice level prevalence, by age, sex, deprivation and ethnicity")
+	demandFlag := flags.String("demand-surface", "", "Also write GeoTIFFs of the primary care activity needed per km² for each condition, using this model, eg data/demand.yaml")
+	demandCellMetersFlag := flags.Float64("demand-cell-meters", DefaultDemandCellMeters, "With --demand-surface, the width of each cell of the grid")
+	outputFlowsFlag := flags.Bool("output-flows", false, "Also write the simulated flows of patients from LSOAs to ICB practices as CSV and GeoJSON lines")
+	outputSitesFlag := flags.Bool("output-sites", false, "Also write the capacity of trust sites from ERIC, and, with --admissions, compare it with the admission demand of ICB residents")
+	outputCatchmentsFlag := flags.Bool("output-catchments", false, "Also write each ICB practice's effective catchment, from the LSOAs of its simulated patients, as CSV, GeoJSON and a b6 compact index")
+	catchmentMinShareFlag := flags.Float64("catchment-min-share", DefaultCatchmentMinShare, "With --output-catchments, the minimum share of a practice's simulated patients an LSOA must contribute to be in its catchment")
+	careHomesFlag := flags.Bool("care-homes", false, "Place people aged 75 and over into CQC registered care homes, registered with the nearest practice to the home")
+	pharmaciesFlag := flags.String("pharmacies", "", "Assign each person the nearest community pharmacy to their home, from the pharmacies dataset, and write the items each is expected to dispense for each condition, using this model, eg data/dispensing.yaml")
+	assignmentFlag := flags.String("assignment", "probabilistic", "How people are assigned to practices: probabilistic, each choosing a nearby practice independently, or balanced, solving for the number from each LSOA at each practice so that ICB practices' simulated list sizes match those reported")
+	calibrateCrossBorderFlag := flags.Bool("calibrate-cross-border", false, "Reassign people between practices inside and outside --scope, so that the share of each home LSOA's patients registered outside it matches the gp-registrations-lsoa dataset")
+	calibrateRegistrationsFlag := flags.Int("calibrate-registrations", 0, "Reweight the assignment of people to ICB practices this many times, so that each practice's simulated age and sex profile matches its published registrations by age and sex, or 0 to skip")
+	registerAgesFlag := flags.String("register-ages", "", "Also compare the age distribution of each condition's simulated register with the published distribution in this CSV file, with condition, ages and patients columns")
+	validateFlowsFlag := flags.Bool("validate-flows", false, "Also compare the simulated home LSOAs of each ICB practice's patients with the published registrations by LSOA")
+	populationFeaturesFlag := flags.Bool("population-features", false, "Also write people and condition counts by LSOA as a b6 compact index")
+	peerGroupSizeFlag := flags.Int("peer-group-size", DefaultPeerGroupSize, "Number of similar ICB practices against which each practice's prevalence is compared, or 0 to skip")
+	nationalBenchmarkFlag := flags.Bool("national-benchmark", false, "Also compare the ICB's practices with the distribution across all practices in England")
+	ageBandsFlag := flags.String("age-bands", "decade", "Age bands used for aggregates, and to compare input and simulated prevalence: decade, ons, qof, or comma separated ages at which each band begins, like 0,18,65")
+	conditionModelFlag := flags.String("condition-model", "chain-rule", "Model used to assign conditions: chain-rule, using conditional prevalences, logistic, adjusting for deprivation and comorbidity, or joint, sampling every condition at once from their joint prevalence")
+	logisticCoefficientsFlag := flags.String("logistic-coefficients", "data/condition-logistic.yaml", "With --condition-model=logistic, log odds ratios for deprivation and comorbidity by condition")
+	bufferFlag := flags.String("buffer", "radius", "Policy for LSOAs outside the ICB from which people are also drawn: radius, registration, travel-time or none")
+	bufferMinRegisteredFlag := flags.Float64("buffer-min-registered-share", DefaultBufferMinRegisteredShare, "With --buffer=registration, the minimum fraction of an LSOA's residents registered with ICB practices")
+	bufferMaxTravelMinutesFlag := flags.Float64("buffer-max-travel-minutes", DefaultBufferMaxTravelMinutes, "With --buffer=travel-time, the maximum expected travel time from an LSOA to an ICB practice")
+	formatFlag := flags.String("format", "csv", "Formats in which people, practices and aggregates are written, separated by commas: csv, arrow, parquet, sqlite, postgis or fhir")
+	sqliteFlag := flags.String("sqlite", "", "Also write the simulation to this SQLite database, rather than population.sqlite in the output directory with --format=sqlite")
+	exportWritersFlag := flags.Int("export-writers", runtime.NumCPU(), "Maximum number of outputs written concurrently")
+	outputGeoJSONFlag := flags.Bool("output-geojson", false, "Also write condition counts by LSOA and MSOA as GeoJSON")
+	outputArrowFlag := flags.Bool("output-arrow", false, "Also write the people, practices and aggregates tables as Arrow IPC files, as --format=arrow")
+	csvProvenanceFlag := flags.Bool("csv-provenance", false, "Start each CSV output with lines beginning with #, marking it as synthetic, and crediting the datasets it's derived from. Other formats always include them in their metadata.")
+	logTimingsFlag := flags.Bool("log-timings", false, "Log the wall time, CPU time and memory used by each stage of the simulation as it completes. They're always recorded in manifest.json and metrics.json.")
+
+	return func(data DataManifest, world *worldFlags, progress Progress) (*PopulationOptions, error) {
+		otherSexPrevalence, err := OtherSexPrevalenceFromString(*otherSexPrevalenceFlag)
+		if err != nil {
+			return nil, err
+		}
+		rurality, err := readRurality(*ruralityFlag)
+		if err != nil {
+			return nil, err
+		}
+		parameters, err := readParameters(*parametersFlag)
+		if err != nil {
+			return nil, err
+		}
+		options := &PopulationOptions{
+			Cache:              world.cache(),
+			WorldFilenames:     world.filenames(),
+			OutputDirectory:    *outputFlag,
+			GeoJSON:            *outputGeoJSONFlag,
+			OtherSexPrevalence: otherSexPrevalence,
+			CSVProvenance:      *csvProvenanceFlag,
+
+			TravelAssumptionsFilename: *travelFlag,
+			Scenario:                  *scenarioNameFlag,
+			ScenarioFilename:          *scenarioFlag,
+			Data:                      data,
+			PrescribingBiasWeight:     *prescribingBiasWeightFlag,
+			AdmissionsFilename:        *admissionsFlag,
+			NHSNumbers:                *nhsNumbersFlag,
+			NamesFilename:             *namesFlag,
+			ExportWriters:             *exportWritersFlag,
+			SQLiteFilename:            *sqliteFlag,
+			Progress:                  progress,
+			Parameters:                parameters,
+			Rurality:                  rurality,
+			SmokingFilename:           *smokingFlag,
+			PracticeSmokingFilename:   *practiceSmokingFlag,
+			BMIFilename:               *bmiFlag,
+			MeasurementsFilename:      *measurementsFlag,
+			SegmentsFilename:          *segmentsFlag,
+			BenefitsFilename:          *benefitsFlag,
+			EmploymentFilename:        *employmentFlag,
+			PrevalenceOverrides:       setPrevalenceFlag,
+			CostsFilename:             *costsFlag,
+			TargetYear:                *targetYearFlag,
+			TargetLSOATotals:          *targetLSOATotalsFlag,
+			ReweightYear:              *reweightYearFlag,
+			PCNs:                      *pcnsFlag,
+			Buffer: BufferOptions{
+				MinRegisteredShare: *bufferMinRegisteredFlag,
+				MaxTravelMinutes:   *bufferMaxTravelMinutesFlag,
+			},
+			IncidenceFilename:            *incidenceFlag,
+			ComplicationsFilename:        *complicationsFlag,
+			DetectionFilename:            *detectionFlag,
+			BacklogFilename:              *backlogFlag,
+			ControlFilename:              *controlFlag,
+			ProjectYears:                 *projectYearsFlag,
+			ProjectionFilename:           *projectionFlag,
+			PopulationFeatures:           *populationFeaturesFlag,
+			FlowValidation:               *validateFlowsFlag,
+			RegisterAgesFilename:         *registerAgesFlag,
+			CareHomes:                    *careHomesFlag,
+			DispensingFilename:           *pharmaciesFlag,
+			Flows:                        *outputFlowsFlag,
+			Catchments:                   *outputCatchmentsFlag,
+			Sites:                        *outputSitesFlag,
+			CatchmentMinShare:            *catchmentMinShareFlag,
+			DemandFilename:               *demandFlag,
+			DemandCellMeters:             *demandCellMetersFlag,
+			PeerGroupSize:                *peerGroupSizeFlag,
+			NationalBenchmark:            *nationalBenchmarkFlag,
+			ConditionModel:               *conditionModelFlag,
+			LogisticCoefficientsFilename: *logisticCoefficientsFlag,
+			LogTimings:                   *logTimingsFlag,
+
+			RegistrationCalibrationIterations: *calibrateRegistrationsFlag,
+			CrossBorderCalibration:            *calibrateCrossBorderFlag,
+		}
+		if *prescribingFlag != "" {
+			options.PrescribingFilenames = strings.Split(*prescribingFlag, ",")
+		}
+		if options.Scopes, err = parseScopes(*scopeFlag); err != nil {
+			return nil, err
+		} else if err := checkDistinctScopes(options.Scopes); err != nil {
+			return nil, err
+		}
+		options.Scope = options.Scopes[0]
+		if options.Conditions, err = readConditions(*conditionsFlag); err != nil {
+			return nil, err
+		}
+		if options.AggregatePopulations, err = AggregatePopulationsFromString(*aggregatePopulationFlag); err != nil {
+			return nil, err
+		}
+		if options.ConditionEncoding, err = ConditionEncodingFromString(*conditionEncodingFlag); err != nil {
+			return nil, err
+		}
+		if options.HomePoints, err = HomePointsFromString(*homePointsFlag); err != nil {
+			return nil, err
+		}
+		if options.AuditSample = *auditFlag; options.AuditSample < 0 {
+			return nil, fmt.Errorf("--audit must not be negative")
+		}
+		if options.Profile, err = OutputProfileFromString(*profileFlag); err != nil {
+			return nil, err
+		}
+		if options.Formats, err = ExportFormatsFromString(*formatFlag); err != nil {
+			return nil, err
+		}
+		if *outputArrowFlag {
+			options.Formats = appendExportFormat(options.Formats, ExportFormatArrow)
+		}
+		if options.SQLiteFilename != "" {
+			options.Formats = appendExportFormat(options.Formats, ExportFormatSQLite)
+		}
+		if options.PrevalenceOutlier, err = PrevalenceOutlierRuleFromString(*prevalenceOutlierFlag); err != nil {
+			return nil, err
+		}
+		if options.Buffer.Policy, err = BufferPolicyFromString(*bufferFlag); err != nil {
+			return nil, err
+		}
+		if options.AgeBands, err = AgeBandsFromString(*ageBandsFlag); err != nil {
+			return nil, err
+		}
+		if options.SmallAreaConditions, err = SmallAreaConditionsFromString(*smallAreaFlag); err != nil {
+			return nil, err
+		}
+		if !isConditionModel(options.ConditionModel) {
+			return nil, fmt.Errorf("unknown condition model %q, expected one of %s", options.ConditionModel, strings.Join(ConditionModels, ", "))
+		}
+		if options.PracticeSmokingFilename != "" && options.SmokingFilename == "" {
+			return nil, fmt.Errorf("--practice-smoking requires --smoking")
+		}
+		if options.RegistrationCalibrationIterations < 0 {
+			return nil, fmt.Errorf("--calibrate-registrations must not be negative")
+		}
+		if options.Assignment, err = AssignmentModeFromString(*assignmentFlag); err != nil {
+			return nil, err
+		}
+		if options.Assignment == AssignmentBalanced && (options.RegistrationCalibrationIterations > 0 || options.CrossBorderCalibration) {
+			return nil, fmt.Errorf("--assignment=balanced can't be combined with --calibrate-registrations or --calibrate-cross-border, which reassign people probabilistically")
+		}
+		if options.CatchmentMinShare <= 0.0 || options.CatchmentMinShare > 1.0 {
+			return nil, fmt.Errorf("--catchment-min-share must be greater than 0, and at most 1")
+		}
+		if options.TargetYear < 0 {
+			return nil, fmt.Errorf("--target-year must not be negative")
+		}
+		if options.TargetLSOATotals && options.TargetYear == 0 {
+			return nil, fmt.Errorf("--target-lsoa-totals needs --target-year")
+		}
+		if options.ReweightMargins, err = ReweightMarginsFromString(*reweightFlag); err != nil {
+			return nil, err
+		}
+		if options.ReweightYear == 0 {
+			options.ReweightYear = options.TargetYear
+		}
+		if hasReweightMargin(options.ReweightMargins, ReweightMarginBoroughs) && options.ReweightYear <= 0 {
+			return nil, fmt.Errorf("--reweight=boroughs needs --reweight-year or --target-year")
+		}
+		if options.PCNs && options.SegmentsFilename == "" {
+			return nil, fmt.Errorf("--pcns needs --segments")
+		}
+		if options.ProjectYears < 0 || options.ProjectYears > ProjectionMaxYears {
+			return nil, fmt.Errorf("--project-years must be between 0 and %d", ProjectionMaxYears)
+		}
+		if options.ProjectYears > 0 && options.IncidenceFilename == "" {
+			return nil, fmt.Errorf("--project-years needs --incidence")
+		}
+		if options.ComplicationsFilename != "" && options.IncidenceFilename == "" {
+			return nil, fmt.Errorf("--complications needs --incidence")
+		}
+		if options.DemandCellMeters <= 0.0 {
+			return nil, fmt.Errorf("--demand-cell-meters must be positive")
+		}
+		if options.PrescribingBiasWeight < 0.0 || options.PrescribingBiasWeight > 1.0 {
+			return nil, fmt.Errorf("--prescribing-bias-weight must be between 0 and 1")
+		}
+		return options, nil
+	}
+}
+
+// runSimulation parses the flags of the simulate and rpc commands,
+// passing the world, prevalences and options they describe to run.
+func runSimulation(name string, description string, args []string, run func(world b6.World, prevalences AllPrevalences, options *PopulationOptions) error) error {
+	flags := newFlagSet(name, description)
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, true)
+	simulation := addSimulationFlags(flags)
+	demoFlag := flags.Bool("demo", false, "Simulate the population of a few LSOAs, from the small datasets in data/demo, written to output/demo, in seconds. Still needs --world.")
+	notify := addNotifyFlags(flags)
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if *demoFlag {
+		if err := applyDemoFlags(flags); err != nil {
+			return err
+		}
+		if err := checkDemoWorld(worldFlags.filenames()); err != nil {
+			return err
+		}
+	}
+	progress, err := base.setup()
+	if err != nil {
+		return err
+	}
+	return notify.run(name, func(notification *RunNotification) error {
+		data, err := dataFlags.read()
+		if err != nil {
+			return err
+		}
+		options, err := simulation(data, worldFlags, progress)
+		if err != nil {
+			return err
+		}
+		options.CensusYear = *dataFlags.censusYear
+		notification.Scope = options.Scope.String()
+		if len(options.Scopes) > 1 {
+			names := make([]string, len(options.Scopes))
+			for i, scope := range options.Scopes {
+				names[i] = scope.String()
+			}
+			notification.Scope = strings.Join(names, ",")
+		}
+		notification.OutputDirectory = options.OutputDirectory
+		prevalences, err := readPrevalences()
+		if err != nil {
+			return err
+		}
+		world, err := worldFlags.read()
+		if err != nil {
+			return err
+		}
+		if *demoFlag {
+			if err := os.MkdirAll(options.OutputDirectory, 0755); err != nil {
+				return err
+			}
+		}
+		if err := run(world, prevalences, options); err != nil {
+			return err
+		}
+		if manifest, err := readRunManifest(options.OutputDirectory); err == nil {
+			notification.Manifest = manifest
+			notification.Metrics = manifest.Metrics
+		}
+		return nil
+	})
+}
+
+func simulateMain(args []string) error {
+	description := "Simulate the population of --scope, writing it, and aggregates of it, to --output. With comma separated scopes, the inputs they share are read once, and each is written to <kind>-<code> within --output"
+	return runSimulation("simulate", description, args, writeScopePopulations)
+}
+
+func rpcMain(args []string) error {
+	description := "Answer JSON-RPC requests to run the simulation, and query its results, on stdin and stdout, keeping the world loaded between runs. Flags give the defaults for each run"
+	return runSimulation("rpc", description, args, func(world b6.World, prevalences AllPrevalences, options *PopulationOptions) error {
+		return serveRPC(world, prevalences, options, os.Stdin, os.Stdout)
+	})
+}
+
+func nearbyGPsMain(args []string) error {
+	flags := newFlagSet("nearby-gps", "Build the lookup of the practices near each LSOA in --cached, if needed, without running the simulation, and write it to nearby-gps-<scope>.csv within it, for use outside the pipeline")
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, true)
+	ruralityFlag := addRuralityFlag(flags)
+	parametersFlag := addParametersFlag(flags)
+	travelFlag := addTravelFlag(flags)
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	progress, err := base.setup()
+	if err != nil {
+		return err
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	rurality, err := readRurality(*ruralityFlag)
+	if err != nil {
+		return err
+	}
+	parameters, err := readParameters(*parametersFlag)
+	if err != nil {
+		return err
+	}
+	travel, err := readTravelAssumptions(*travelFlag)
+	if err != nil {
+		return err
+	}
+	world, err := worldFlags.read()
+	if err != nil {
+		return err
+	}
+	return writeNearbyGPPractices(world, data, worldFlags.cache(), worldFlags.filenames(), rurality, parameters, travel, progress)
+}
+
+func featuresMain(args []string) error {
+	flags := newFlagSet("features", "Write nhs.index, a compact world containing GP practices, trust sites and ICB boundaries")
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, false)
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	world, err := worldFlags.read()
+	if err != nil {
+		return err
+	}
+	return writeFeatures(world, data)
+}
+
+func validateMain(args []string) error {
+	flags := newFlagSet("validate", "Check that "+PrevalencesFilename+" is well formed, and gives every prevalence needed by the simulation, so that mistakes are found before a long run. With --compare-data, also compare the data of two manifests")
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, false)
+	conditionsFlag := addConditionsFlag(flags)
+	scopeFlag := addScopeFlag(flags)
+	compareDataFlag := flags.String("compare-data", "", "Compare practices, list sizes and prevalences from the data in this manifest with those of --data-manifest, writing a summary of the changes to --output")
+	outputFlag := flags.String("output", "output", "Directory for the comparison of --compare-data")
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	conditions, err := readConditions(*conditionsFlag)
+	if err != nil {
+		return err
+	}
+	problems, warnings, err := checkPrevalences(PrevalencesFilename, conditions)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		Warningf("  %s", warning)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("  %s", problem)
+		}
+		return fmt.Errorf("%s: %d problems", PrevalencesFilename, len(problems))
+	}
+	log.Printf("%s: ok", PrevalencesFilename)
+	if *compareDataFlag == "" {
+		return nil
+	}
+
+	scope, err := ScopeFromString(*scopeFlag)
+	if err != nil {
+		return err
+	} else if scope.Kind != ScopeKindICB {
+		return fmt.Errorf("--compare-data needs an ICB --scope")
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	previous, err := readDataManifest(*compareDataFlag)
+	if err != nil {
+		return err
+	}
+	world, err := worldFlags.read()
+	if err != nil {
+		return err
+	}
+	return compareData(previous, data, conditions, scope.ICB(), world, *outputFlag)
+}
+
+func serveMain(args []string) error {
+	flags := newFlagSet("serve", "Load the population previously written to --output, and answer queries for aggregate counts and prevalences over HTTP")
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	worldFlags := addWorldFlags(flags, false)
+	outputFlag := flags.String("output", "output", "Directory to which the population was written")
+	addressFlag := flags.String("address", ":8080", "Address on which to answer queries")
+	incidenceFlag := flags.String("incidence", "data/incidence.yaml", "Forecast conditions using the incidence by age and sex in this file, or not at all if empty")
+	demandFlag := flags.String("demand", "data/demand.yaml", "Include the primary care activity needed in forecasts, using this model, or not at all if empty")
+	parametersFlag := addParametersFlag(flags)
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	parameters, err := readParameters(*parametersFlag)
+	if err != nil {
+		return err
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	geography, err := censusGeographyForYear(*dataFlags.censusYear, data)
+	if err != nil {
+		return err
+	}
+	// LSOA boundaries from the world answer queries by polygon, which
+	// aren't available with --world=
+	var w b6.World
+	if *worldFlags.world != "" {
+		if w, err = worldFlags.read(); err != nil {
+			return err
+		}
+	}
+	var incidence *IncidenceModel
+	if *incidenceFlag != "" {
+		if incidence, err = readIncidenceModel(*incidenceFlag); err != nil {
+			return err
+		}
+	}
+	var demand DemandModel
+	if *demandFlag != "" {
+		if demand, err = readDemandModel(*demandFlag); err != nil {
+			return err
+		}
+	}
+	return serve(*addressFlag, *outputFlag, data, geography, w, incidence, demand, parameters)
+}
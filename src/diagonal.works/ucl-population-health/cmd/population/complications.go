@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Complication is a complication of a long term condition, like diabetes,
+// whose risk grows with the time since diagnosis.
+type Complication int
+
+const (
+	ComplicationRetinopathy Complication = iota
+	ComplicationNephropathy
+	ComplicationFootDisease
+
+	ComplicationCount
+	ComplicationInvalid Complication = -1
+)
+
+func (c Complication) String() string {
+	switch c {
+	case ComplicationRetinopathy:
+		return "retinopathy"
+	case ComplicationNephropathy:
+		return "nephropathy"
+	case ComplicationFootDisease:
+		return "foot_disease"
+	}
+	return "invalid"
+}
+
+func ComplicationFromString(s string) Complication {
+	for c := Complication(0); c < ComplicationCount; c++ {
+		if s == c.String() {
+			return c
+		}
+	}
+	return ComplicationInvalid
+}
+
+// Complications is a set of Complication, as a bitmask
+type Complications uint8
+
+func (c Complications) Contains(complication Complication) bool {
+	return c&(1<<complication) != 0
+}
+
+func (c *Complications) Add(complication Complication) {
+	*c |= 1 << complication
+}
+
+// ComplicationRates gives the annual incidence of a complication among
+// people with the condition, who don't yet have the complication, by the
+// number of years since diagnosis.
+type ComplicationRates struct {
+	Description string
+	// Annual incidence, with ranges of years since diagnosis in place of
+	// ages, and open ended if the last range has no end
+	ByDuration []AgePrevalence `yaml:"byduration"`
+}
+
+// Incidence returns the annual incidence of the complication in the given
+// year since diagnosis, or 0 if no range covers it.
+func (r *ComplicationRates) Incidence(years int) float64 {
+	for _, p := range r.ByDuration {
+		if p.Ages.Contains(years) {
+			return p.Prevalence
+		}
+	}
+	return 0.0
+}
+
+// Probability returns the chance that someone diagnosed the given number
+// of years ago has developed the complication, from the survival
+// function of its incidence in each year since diagnosis.
+func (r *ComplicationRates) Probability(years int) float64 {
+	h := 0.0
+	for y := 0; y < years; y++ {
+		h += r.Incidence(y)
+	}
+	return 1.0 - math.Exp(-h)
+}
+
+// ComplicationModel assigns complications to people with a condition,
+// from the time since their diagnosis, for planning the services that
+// screen for and treat them.
+type ComplicationModel struct {
+	// The condition whose complications are simulated
+	Condition     string
+	Complications map[string]*ComplicationRates
+
+	condition QOFCondition
+	rates     [ComplicationCount]*ComplicationRates
+}
+
+func readComplicationModel(filename string) (*ComplicationModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open complication model: %s", err)
+	}
+	defer f.Close()
+	var model ComplicationModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read complication model: %s", err)
+	}
+	if model.condition = QOFConditionFromString(model.Condition); model.condition == QOFConditionInvalid {
+		return nil, fmt.Errorf("unknown condition %q for complications", model.Condition)
+	}
+	for name, rates := range model.Complications {
+		c := ComplicationFromString(name)
+		if c == ComplicationInvalid {
+			return nil, fmt.Errorf("unknown complication %q", name)
+		}
+		for _, p := range rates.ByDuration {
+			if p.Prevalence < 0.0 || p.Prevalence > 1.0 {
+				return nil, fmt.Errorf("complication %s needs incidence between 0 and 1", name)
+			}
+		}
+		model.rates[c] = rates
+	}
+	return &model, nil
+}
+
+// Modelled returns the complications given by the model, in order
+func (m *ComplicationModel) Modelled() []Complication {
+	complications := make([]Complication, 0, ComplicationCount)
+	for c, rates := range m.rates {
+		if rates != nil {
+			complications = append(complications, Complication(c))
+		}
+	}
+	return complications
+}
+
+func (m *ComplicationModel) warnUnsimulated(simulated []QOFCondition) {
+	var included QOFConditions
+	for _, c := range simulated {
+		included.Add(c)
+	}
+	if !included.Contains(m.condition) {
+		Warningf("  %s isn't simulated, so nobody will have its complications", m.condition)
+	}
+}
+
+// assignComplications gives each person with the model's condition each of
+// its complications with the probability given by the years since their
+// diagnosis, from their onset age, which must have been assigned.
+func assignComplications(people []Person, model *ComplicationModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	modelled := model.Modelled()
+	counts := make([]int, ComplicationCount)
+	n := 0
+	for i := range people {
+		p := &people[i]
+		if !p.Conditions.Contains(model.condition) {
+			continue
+		}
+		n++
+		years := p.Age - int(p.OnsetAges[model.condition.Index()])
+		for _, c := range modelled {
+			if rng.Float64() < model.rates[c].Probability(years) {
+				p.Complications.Add(c)
+				counts[c]++
+			}
+		}
+	}
+	for _, c := range modelled {
+		share := 0.0
+		if n > 0 {
+			share = float64(counts[c]) / float64(n)
+		}
+		log.Printf("  %s: %s: %d (%.1f%%)", model.condition, c, counts[c], 100.0*share)
+	}
+}
+
+// PracticeComplications counts the people with a condition registered with
+// a practice, and those with each of its complications.
+type PracticeComplications struct {
+	Code     GPPracticeCode
+	Name     string
+	Register int
+	// The mean number of years since diagnosis of the register
+	MeanYears float64
+	Counts    [ComplicationCount]int
+}
+
+// countComplications returns the complications of the patients of each of
+// practices, in order of practice code.
+func countComplications(practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, byPractice map[GPPracticeCode][]*Person, model *ComplicationModel) []*PracticeComplications {
+	codes := make([]GPPracticeCode, 0, len(practices))
+	for code := range practices {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	modelled := model.Modelled()
+	counts := make([]*PracticeComplications, 0, len(codes))
+	for _, code := range codes {
+		pc := &PracticeComplications{Code: code, Name: gps[code].Name}
+		years := 0
+		for _, p := range byPractice[code] {
+			if !p.Conditions.Contains(model.condition) {
+				continue
+			}
+			pc.Register++
+			years += p.Age - int(p.OnsetAges[model.condition.Index()])
+			for _, c := range modelled {
+				if p.Complications.Contains(c) {
+					pc.Counts[c]++
+				}
+			}
+		}
+		if pc.Register > 0 {
+			pc.MeanYears = float64(years) / float64(pc.Register)
+		}
+		counts = append(counts, pc)
+	}
+	return counts
+}
+
+// writeComplications writes complications.csv, with the register of the
+// model's condition for each practice, the mean years since diagnosis, and
+// the number of patients with, and share of the register with, each
+// complication.
+func writeComplications(counts []*PracticeComplications, model *ComplicationModel, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "complications.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	modelled := model.Modelled()
+	header := []string{"scenario", "code", "name", "condition", "register", "mean_years_since_diagnosis"}
+	for _, c := range modelled {
+		header = append(header, c.String(), c.String()+"_share")
+	}
+	w.Write(header)
+	for _, pc := range counts {
+		row := []string{scenario, pc.Code.String(), pc.Name, model.condition.String(), strconv.Itoa(pc.Register), fmt.Sprintf("%f", pc.MeanYears)}
+		for _, c := range modelled {
+			share := 0.0
+			if pc.Register > 0 {
+				share = float64(pc.Counts[c]) / float64(pc.Register)
+			}
+			row = append(row, strconv.Itoa(pc.Counts[c]), fmt.Sprintf("%f", share))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
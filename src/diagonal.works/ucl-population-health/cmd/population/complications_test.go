@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadComplicationModel(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"valid", "condition: dm\ncomplications:\n    retinopathy:\n        byduration:\n            - ages: {begin: 0}\n              p: 0.02\n", true},
+		{"unknown condition", "condition: xx\ncomplications: {}\n", false},
+		{"unknown complication", "condition: dm\ncomplications:\n    gout:\n        byduration: []\n", false},
+		{"bad incidence", "condition: dm\ncomplications:\n    retinopathy:\n        byduration:\n            - ages: {begin: 0}\n              p: 1.5\n", false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "complications.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		model, err := readComplicationModel(filename)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+		} else if m := model.Modelled(); len(m) != 1 || m[0] != ComplicationRetinopathy {
+			t.Errorf("%s: expected retinopathy to be modelled, found %v", test.name, m)
+		}
+	}
+}
+
+func TestComplicationRatesProbability(t *testing.T) {
+	r := &ComplicationRates{ByDuration: []AgePrevalence{
+		{Ages: AgeRange{Begin: 0, End: 2}, Prevalence: 0.1},
+		{Ages: AgeRange{Begin: 2}, Prevalence: 0.2},
+	}}
+	tests := []struct {
+		years    int
+		expected float64
+	}{
+		{0, 0.0},
+		{1, 1.0 - math.Exp(-0.1)},
+		{3, 1.0 - math.Exp(-0.4)},
+		// An onset after the current age gives no risk
+		{-1, 0.0},
+	}
+	for _, test := range tests {
+		if p := r.Probability(test.years); math.Abs(p-test.expected) > 1e-9 {
+			t.Errorf("expected %f after %d years, found %f", test.expected, test.years, p)
+		}
+	}
+}
+
+func TestAssignAndCountComplications(t *testing.T) {
+	retinopathy := &ComplicationRates{ByDuration: []AgePrevalence{{Ages: AgeRange{Begin: 0}, Prevalence: 0.1}}}
+	never := &ComplicationRates{ByDuration: []AgePrevalence{{Ages: AgeRange{Begin: 0}, Prevalence: 0.0}}}
+	model := &ComplicationModel{condition: QOFConditionDiabetes}
+	model.rates[ComplicationRetinopathy] = retinopathy
+	model.rates[ComplicationFootDisease] = never
+
+	var diabetic QOFConditions
+	diabetic.Add(QOFConditionDiabetes)
+	const n = 10000
+	people := make([]Person, 0, n+1)
+	for i := 0; i < n; i++ {
+		p := Person{Age: 60, Conditions: diabetic}
+		p.OnsetAges[QOFConditionDiabetes.Index()] = 50
+		people = append(people, p)
+	}
+	people = append(people, Person{Age: 60})
+	assignComplications(people, model)
+
+	with := 0
+	for _, p := range people {
+		if p.Complications.Contains(ComplicationRetinopathy) {
+			with++
+		}
+		if p.Complications.Contains(ComplicationFootDisease) || p.Complications.Contains(ComplicationNephropathy) {
+			t.Errorf("expected no complications without incidence, found %v", p.Complications)
+		}
+	}
+	// 10 years at 0.1 a year
+	expected := 1.0 - math.Exp(-1.0)
+	if share := float64(with) / n; math.Abs(share-expected) > 0.02 {
+		t.Errorf("expected a share of about %f with retinopathy, found %f", expected, share)
+	}
+	if people[n].Complications != 0 {
+		t.Errorf("expected no complications for people without the condition")
+	}
+
+	byPractice := map[GPPracticeCode][]*Person{"G1": {&people[0], &people[1], &people[n]}}
+	gps := map[GPPracticeCode]*GPPractice{"G1": {Code: "G1", Name: "One"}, "G2": {Code: "G2", Name: "Two"}}
+	counts := countComplications(GPPracticeCodeSet{"G1": struct{}{}, "G2": struct{}{}}, gps, byPractice, model)
+	if len(counts) != 2 || counts[0].Code != "G1" || counts[1].Code != "G2" {
+		t.Fatalf("expected counts for G1 and G2, in order, found %v", counts)
+	}
+	g1 := counts[0]
+	expectedCount := 0
+	for _, p := range byPractice["G1"][:2] {
+		if p.Complications.Contains(ComplicationRetinopathy) {
+			expectedCount++
+		}
+	}
+	if g1.Register != 2 || g1.MeanYears != 10.0 || g1.Counts[ComplicationRetinopathy] != expectedCount {
+		t.Errorf("expected a register of 2, 10 years and %d with retinopathy, found %+v", expectedCount, g1)
+	}
+	if counts[1].Register != 0 || counts[1].MeanYears != 0.0 {
+		t.Errorf("expected an empty register for G2, found %+v", counts[1])
+	}
+}
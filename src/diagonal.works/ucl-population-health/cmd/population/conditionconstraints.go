@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+)
+
+type ConditionConstraintKind int
+
+const (
+	// Nobody has both conditions, eg type 1 and type 2 diabetes
+	ConditionConstraintExcludes ConditionConstraintKind = iota
+	// Everyone with the condition also has the other, eg a stage of CKD
+	// and CKD itself
+	ConditionConstraintImplies
+)
+
+func (k ConditionConstraintKind) String() string {
+	switch k {
+	case ConditionConstraintExcludes:
+		return "excludes"
+	case ConditionConstraintImplies:
+		return "implies"
+	}
+	return "invalid"
+}
+
+// ConditionConstraint restricts the combinations of conditions a person
+// can be assigned.
+type ConditionConstraint struct {
+	Condition QOFCondition
+	Kind      ConditionConstraintKind
+	Other     QOFCondition
+}
+
+func (c ConditionConstraint) String() string {
+	return fmt.Sprintf("%s %s %s", c.Condition, c.Kind, c.Other)
+}
+
+// QOFConditionConstraints lists the constraints between conditions that
+// are enforced when they're assigned, so that registers with finer
+// grained conditions, like the stages of a disease, or its mutually
+// exclusive types, don't produce impossible combinations. They're derived
+// from QOFConditionHierarchies. Exclusion applies in both directions, and
+// need only be given once.
+var QOFConditionConstraints = hierarchyConstraints(QOFConditionHierarchies)
+
+// checkConditionConstraints returns an error if the constraints refer to
+// unknown conditions, or contradict each other, such that a condition
+// could never be assigned.
+func checkConditionConstraints(constraints []ConditionConstraint) error {
+	known := make(map[QOFCondition]struct{})
+	for _, c := range AllQOFConditions() {
+		known[c] = struct{}{}
+	}
+	for _, constraint := range constraints {
+		_, ok1 := known[constraint.Condition]
+		_, ok2 := known[constraint.Other]
+		if !ok1 || !ok2 || constraint.Condition == constraint.Other {
+			return fmt.Errorf("bad condition constraint: %s", constraint)
+		}
+	}
+	for _, c := range AllQOFConditions() {
+		var conditions QOFConditions
+		conditions.Add(c)
+		implied := impliedConditions(conditions, constraints)
+		if !possibleConditions(implied, constraints) {
+			return fmt.Errorf("condition constraints make %s impossible, since it implies %s", c, Diagnosis{Present: implied})
+		}
+	}
+	return nil
+}
+
+// impliedConditions returns conditions, together with every condition
+// they imply, directly or indirectly.
+func impliedConditions(conditions QOFConditions, constraints []ConditionConstraint) QOFConditions {
+	for {
+		added := conditions
+		for _, c := range constraints {
+			if c.Kind == ConditionConstraintImplies && added.Contains(c.Condition) {
+				added.Add(c.Other)
+			}
+		}
+		if added == conditions {
+			return conditions
+		}
+		conditions = added
+	}
+}
+
+// possibleConditions returns true if a person could have all of
+// conditions, and no others.
+func possibleConditions(conditions QOFConditions, constraints []ConditionConstraint) bool {
+	for _, c := range constraints {
+		switch c.Kind {
+		case ConditionConstraintExcludes:
+			if conditions.Contains(c.Condition) && conditions.Contains(c.Other) {
+				return false
+			}
+		case ConditionConstraintImplies:
+			if conditions.Contains(c.Condition) && !conditions.Contains(c.Other) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// allowsCondition returns true if condition, and those it implies, can be
+// added to a person with conditions.
+func allowsCondition(conditions QOFConditions, condition QOFCondition, constraints []ConditionConstraint) bool {
+	added := conditions
+	added.Add(condition)
+	return possibleConditions(impliedConditions(added, constraints), constraints)
+}
+
+// addCondition adds condition to p, together with the conditions it
+// implies, if the constraints allow it, returning true if they did.
+func addCondition(p *Person, condition QOFCondition, constraints []ConditionConstraint) bool {
+	if !allowsCondition(p.Conditions, condition, constraints) {
+		return false
+	}
+	p.Conditions.Add(condition)
+	p.Conditions = impliedConditions(p.Conditions, constraints)
+	return true
+}
+
+// constrainsPair returns true if the constraints determine whether people
+// can have both c1 and c2, since one implies the other, or they're
+// mutually exclusive.
+func constrainsPair(c1 QOFCondition, c2 QOFCondition, constraints []ConditionConstraint) bool {
+	if impliedConditions(OneCondition(c1).Diagnosis.Present, constraints).Contains(c2) {
+		return true
+	} else if impliedConditions(OneCondition(c2).Diagnosis.Present, constraints).Contains(c1) {
+		return true
+	}
+	return !allowsCondition(OneCondition(c1).Diagnosis.Present, c2, constraints)
+}
+
+// constrainedPairPrevalence returns the prevalence of having both c1 and
+// c2, when it's determined by the constraints between them: zero, over
+// the age ranges of c1, if they're mutually exclusive, or that of the
+// implying condition if one implies the other. It returns false if the
+// constraints don't determine it.
+func constrainedPairPrevalence(c1 QOFCondition, c2 QOFCondition, prevalences AllPrevalences, constraints []ConditionConstraint) (Prevalences, bool) {
+	if !constrainsPair(c1, c2, constraints) {
+		return Prevalences{}, false
+	}
+	pair := Prevalences{Conditions: TwoConditions(c1, c2)}
+	if implied := impliedConditions(OneCondition(c1).Diagnosis.Present, constraints); implied.Contains(c2) {
+		pair.ByAge = prevalences[OneCondition(c1)].ByAge
+		return pair, true
+	} else if implied := impliedConditions(OneCondition(c2).Diagnosis.Present, constraints); implied.Contains(c1) {
+		pair.ByAge = prevalences[OneCondition(c2)].ByAge
+		return pair, true
+	}
+	single := prevalences[OneCondition(c1)].ByAge
+	pair.ByAge = make(AgePrevalences, len(single))
+	for sex, ranges := range single {
+		for _, r := range ranges {
+			pair.ByAge[sex] = append(pair.ByAge[sex], AgePrevalence{Ages: r.Ages, Prevalence: 0.0})
+		}
+	}
+	return pair, true
+}
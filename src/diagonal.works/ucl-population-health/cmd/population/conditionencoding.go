@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConditionEncoding chooses how the conditions of each person are written
+// to population.csv, and the other people outputs.
+type ConditionEncoding int
+
+const (
+	// A condition_<condition> column for each condition, 1 if the person
+	// has it, and 0 otherwise
+	ConditionEncodingOneHot ConditionEncoding = iota
+	// A single conditions column, with the bit of each of the person's
+	// conditions set, with the bit of a condition given by its Index
+	ConditionEncodingBitmask
+	// No condition columns, with a row for each condition of each person
+	// in population-conditions.csv instead
+	ConditionEncodingLong
+
+	ConditionEncodingInvalid ConditionEncoding = -1
+)
+
+const PersonConditionsFilename = "population-conditions.csv"
+
+func (c ConditionEncoding) String() string {
+	switch c {
+	case ConditionEncodingOneHot:
+		return "onehot"
+	case ConditionEncodingBitmask:
+		return "bitmask"
+	case ConditionEncodingLong:
+		return "long"
+	}
+	return "invalid"
+}
+
+func ConditionEncodingFromString(s string) (ConditionEncoding, error) {
+	for _, c := range []ConditionEncoding{ConditionEncodingOneHot, ConditionEncodingBitmask, ConditionEncodingLong} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return ConditionEncodingInvalid, fmt.Errorf("unknown condition encoding %q, expected onehot, bitmask or long", s)
+}
+
+// conditionsBitmask returns the bitmask of conditions, whose bits are
+// those of a person's conditions included in the bitmask column.
+func conditionsBitmask(conditions []QOFCondition) QOFConditions {
+	var mask QOFConditions
+	for _, c := range conditions {
+		mask.Add(c)
+	}
+	return mask
+}
+
+// describeConditionsBitmask returns a note giving the bit of each of
+// conditions in the bitmask column, for the manifest.
+func describeConditionsBitmask(conditions []QOFCondition) string {
+	bits := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		bits = append(bits, fmt.Sprintf("%s=%d", c, uint32(c)))
+	}
+	return fmt.Sprintf("The conditions column of the people outputs, like population.csv, is the sum of the values of each of a person's conditions: %s", strings.Join(bits, ", "))
+}
+
+// readPersonConditions reads population-conditions.csv from directory,
+// returning the conditions of each person, by id, and the conditions
+// found, in order.
+func readPersonConditions(directory string) (map[int]QOFConditions, []QOFCondition, error) {
+	filename := filepath.Join(directory, PersonConditionsFilename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	if _, err := r.Read(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	byID := make(map[int]QOFConditions)
+	var found QOFConditions
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		id, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: bad id %q", filename, row[0])
+		}
+		condition := QOFConditionFromString(row[1])
+		if condition == QOFConditionInvalid {
+			return nil, nil, fmt.Errorf("%s: unknown condition %q", filename, row[1])
+		}
+		c := byID[id]
+		c.Add(condition)
+		byID[id] = c
+		found.Add(condition)
+	}
+	conditions := make([]QOFCondition, 0)
+	for _, c := range AllQOFConditions() {
+		if found.Contains(c) {
+			conditions = append(conditions, c)
+		}
+	}
+	return byID, conditions, nil
+}
+
+// writePersonConditions writes population-conditions.csv, with a row for
+// each of conditions of each person of people, by id, in the order of
+// people, then conditions.
+func writePersonConditions(people PersonStream, conditions []QOFCondition, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, PersonConditionsFilename))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"id", "condition"})
+	err = people(func(p *Person) error {
+		for _, c := range conditions {
+			if p.Conditions.Contains(c) {
+				if err := w.Write([]string{strconv.Itoa(p.ID), c.String()}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
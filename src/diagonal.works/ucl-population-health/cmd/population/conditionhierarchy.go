@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// QOFConditionHierarchy groups sub-conditions under the condition that
+// includes them, eg type 1 and type 2 diabetes under diabetes. Everyone
+// with a sub-condition also has its parent, so the count of a parent in
+// every output rolls up those of its sub-conditions, together with people
+// for whom no sub-condition is simulated.
+type QOFConditionHierarchy struct {
+	Parent   QOFCondition
+	Children []QOFCondition
+	// True if nobody has more than one of the children
+	Exclusive bool
+}
+
+var QOFConditionHierarchies = []QOFConditionHierarchy{
+	{
+		Parent:    QOFConditionDiabetes,
+		Children:  []QOFCondition{QOFConditionType1Diabetes, QOFConditionType2Diabetes},
+		Exclusive: true,
+	},
+	{
+		Parent:   QOFConditionCVD,
+		Children: []QOFCondition{QOFConditionCHD, QOFConditionStroke, QOFConditionPAD},
+	},
+}
+
+// Parent returns the condition that includes q in QOFConditionHierarchies,
+// or QOFConditionInvalid if it has none.
+func (q QOFCondition) Parent() QOFCondition {
+	for _, h := range QOFConditionHierarchies {
+		for _, c := range h.Children {
+			if c == q {
+				return h.Parent
+			}
+		}
+	}
+	return QOFConditionInvalid
+}
+
+// Ancestors returns the parent of q, its parent, and so on.
+func (q QOFCondition) Ancestors() []QOFCondition {
+	ancestors := make([]QOFCondition, 0)
+	for parent := q.Parent(); parent != QOFConditionInvalid; parent = parent.Parent() {
+		ancestors = append(ancestors, parent)
+	}
+	return ancestors
+}
+
+// checkConditionHierarchies returns an error if a condition is given more
+// than one parent, or is its own ancestor.
+func checkConditionHierarchies(hierarchies []QOFConditionHierarchy) error {
+	parents := make(map[QOFCondition]QOFCondition)
+	for _, h := range hierarchies {
+		for _, c := range h.Children {
+			if parent, ok := parents[c]; ok {
+				return fmt.Errorf("condition %s has parents %s and %s", c, parent, h.Parent)
+			}
+			parents[c] = h.Parent
+		}
+	}
+	for c := range parents {
+		seen := QOFConditions(c)
+		for parent := parents[c]; parent != QOFConditionInvalid; parent = parents[parent] {
+			if seen.Contains(parent) {
+				return fmt.Errorf("condition %s is its own ancestor", parent)
+			}
+			seen.Add(parent)
+		}
+	}
+	return nil
+}
+
+// hierarchyConstraints returns the constraints between conditions implied
+// by the hierarchies: each child implies its parent, and the children of
+// an exclusive parent exclude each other.
+func hierarchyConstraints(hierarchies []QOFConditionHierarchy) []ConditionConstraint {
+	constraints := make([]ConditionConstraint, 0)
+	for _, h := range hierarchies {
+		for i, c := range h.Children {
+			constraints = append(constraints, ConditionConstraint{Condition: c, Kind: ConditionConstraintImplies, Other: h.Parent})
+			if h.Exclusive {
+				for _, other := range h.Children[i+1:] {
+					constraints = append(constraints, ConditionConstraint{Condition: c, Kind: ConditionConstraintExcludes, Other: other})
+				}
+			}
+		}
+	}
+	return constraints
+}
+
+// QOFConditionsFromString parses a comma separated list of the conditions
+// to simulate, at any level of QOFConditionHierarchies.
+func QOFConditionsFromString(s string) ([]QOFCondition, error) {
+	var seen QOFConditions
+	conditions := make([]QOFCondition, 0)
+	for _, name := range strings.Split(s, ",") {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q", name)
+		} else if seen.Contains(condition) {
+			return nil, fmt.Errorf("condition %s given more than once", condition)
+		}
+		seen.Add(condition)
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// withAncestors returns conditions, each preceded by those of its
+// ancestors not already included, which are reported as the roll up of
+// their sub-conditions, without being simulated themselves.
+func withAncestors(conditions []QOFCondition) []QOFCondition {
+	var included QOFConditions
+	for _, c := range conditions {
+		included.Add(c)
+	}
+	reported := make([]QOFCondition, 0, len(conditions))
+	for _, c := range conditions {
+		ancestors := c.Ancestors()
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			if !included.Contains(ancestors[i]) {
+				included.Add(ancestors[i])
+				reported = append(reported, ancestors[i])
+			}
+		}
+		reported = append(reported, c)
+	}
+	return reported
+}
+
+// splitSubConditions separates the simulated conditions into those
+// assigned by the condition model, which have no simulated ancestor, and
+// the sub-conditions that refine a simulated parent, ordered such that
+// parents come before their children.
+func splitSubConditions(conditions []QOFCondition) ([]QOFCondition, []QOFCondition) {
+	var simulated QOFConditions
+	for _, c := range conditions {
+		simulated.Add(c)
+	}
+	modelled := make([]QOFCondition, 0, len(conditions))
+	refined := make([]QOFCondition, 0)
+	for _, c := range conditions {
+		if simulated.Contains(c.Parent()) {
+			refined = append(refined, c)
+		} else {
+			modelled = append(modelled, c)
+		}
+	}
+	sort.SliceStable(refined, func(i, j int) bool {
+		return len(refined[i].Ancestors()) < len(refined[j].Ancestors())
+	})
+	return modelled, refined
+}
+
+// inheritConditionBias gives each sub-condition refining a simulated
+// parent, at practices that don't report its prevalence, the practice's
+// bias for its parent, such that its share of the parent is unchanged.
+func inheritConditionBias(gps map[GPPracticeCode]*GPPractice, refined []QOFCondition) {
+	for _, gp := range gps {
+		for _, c := range refined {
+			if gp.ConditionPrevalence[c] == 0.0 {
+				if bias, ok := gp.ConditionBias[c.Parent()]; ok {
+					gp.ConditionBias[c] = bias
+				}
+			}
+		}
+	}
+}
+
+// SubConditionModel refines the conditions assigned by Model, by assigning
+// sub-conditions to people who have their parent, with the probability of
+// each given by its prevalence relative to that of the parent, for the
+// person's age and sex, each scaled by its practice bias. For exclusive
+// sub-conditions, the prevalence of those already considered, and not
+// assigned, is removed from the parent's.
+type SubConditionModel struct {
+	Model       ConditionModel
+	Refined     []QOFCondition
+	Prevalences AllPrevalences
+}
+
+func (s *SubConditionModel) Calibrate(gp *GPPractice, people []*Person) {
+	if s.Model != nil {
+		calibrateConditionModel(s.Model, gp, people)
+	}
+}
+
+func (s *SubConditionModel) Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit) {
+	if s.Model != nil {
+		s.Model.Assign(p, gp, rng, audit)
+	}
+	for i, c := range s.Refined {
+		parent := c.Parent()
+		if !p.Conditions.Contains(parent) {
+			continue
+		} else if p.Conditions.Contains(c) || !allowsCondition(p.Conditions, c, QOFConditionConstraints) {
+			audit.RecordSkipped(p, c, "sub-condition")
+			continue
+		}
+		remaining := s.prevalence(p, gp, parent)
+		for _, sibling := range s.Refined[:i] {
+			if sibling.Parent() == parent && constrainsPair(c, sibling, QOFConditionConstraints) {
+				remaining -= s.prevalence(p, gp, sibling)
+			}
+		}
+		probability := 1.0
+		if remaining > 0.0 {
+			probability = clamp(s.prevalence(p, gp, c)/remaining, 0.0, 1.0)
+		}
+		draw := rng.Float64()
+		if draw < probability {
+			addCondition(p, c, QOFConditionConstraints)
+		}
+		audit.Record(ConditionDecision{Condition: c.String(), Model: "sub-condition", Given: fmt.Sprintf("%s|%s", c, parent), Probability: probability, Bias: gp.ConditionBias[c], Draw: draw, Outcome: conditionOutcome(draw < probability)})
+	}
+}
+
+func (s *SubConditionModel) prevalence(p *Person, gp *GPPractice, c QOFCondition) float64 {
+	bias, ok := gp.ConditionBias[c]
+	if !ok {
+		bias = 1.0
+	}
+	return s.Prevalences[OneCondition(c)].Prevalence(p.Sex, p.Age) * bias
+}
+
+// ancestorPair returns conditions a1 and a2, each either the given
+// condition or one of its ancestors, other than c1 and c2 themselves, for
+// which the prevalence of the pair, and of each of the ancestors, is
+// given, so that the prevalence of c1 and c2 together can be derived from
+// it, assuming sub-conditions share the association of their ancestors.
+// Pairs determined by QOFConditionConstraints are skipped.
+func ancestorPair(c1 QOFCondition, c2 QOFCondition, given func(d DiagonosisGiven) bool) (QOFCondition, QOFCondition, bool) {
+	for _, a1 := range append([]QOFCondition{c1}, c1.Ancestors()...) {
+		for _, a2 := range append([]QOFCondition{c2}, c2.Ancestors()...) {
+			if (a1 == c1 && a2 == c2) || a1 == a2 || constrainsPair(a1, a2, QOFConditionConstraints) {
+				continue
+			}
+			if given(TwoConditions(a1, a2)) && given(OneCondition(a1)) && given(OneCondition(a2)) {
+				return a1, a2, true
+			}
+		}
+	}
+	return QOFConditionInvalid, QOFConditionInvalid, false
+}
+
+// checkRollUps logs the number of people with each reported parent,
+// and with each of its sub-conditions, returning an error if anyone has a
+// sub-condition without its parent, which would make the roll ups in
+// outputs inconsistent.
+func checkRollUps(people []Person, reported []QOFCondition) error {
+	var included QOFConditions
+	for _, c := range reported {
+		included.Add(c)
+	}
+	for _, h := range QOFConditionHierarchies {
+		if !included.Contains(h.Parent) {
+			continue
+		}
+		counts := make(map[QOFCondition]int)
+		unspecified, inconsistent := 0, 0
+		for i := range people {
+			p := &people[i]
+			specified := false
+			for _, c := range h.Children {
+				if p.Conditions.Contains(c) {
+					counts[c]++
+					specified = true
+					if !p.Conditions.Contains(h.Parent) {
+						inconsistent++
+					}
+				}
+			}
+			if p.Conditions.Contains(h.Parent) {
+				counts[h.Parent]++
+				if !specified {
+					unspecified++
+				}
+			}
+		}
+		parts := []string{fmt.Sprintf("%s: %d", h.Parent, counts[h.Parent])}
+		for _, c := range h.Children {
+			if included.Contains(c) {
+				parts = append(parts, fmt.Sprintf("%s: %d", c, counts[c]))
+			}
+		}
+		parts = append(parts, fmt.Sprintf("unspecified: %d", unspecified))
+		log.Printf("  %s", strings.Join(parts, " "))
+		if inconsistent > 0 {
+			return fmt.Errorf("%d people have a sub-condition of %s without it", inconsistent, h.Parent)
+		}
+	}
+	return nil
+}
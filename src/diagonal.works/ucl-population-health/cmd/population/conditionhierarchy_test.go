@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestQOFConditionParentAndAncestors(t *testing.T) {
+	tests := []struct {
+		condition QOFCondition
+		parent    QOFCondition
+	}{
+		{QOFConditionType1Diabetes, QOFConditionDiabetes},
+		{QOFConditionType2Diabetes, QOFConditionDiabetes},
+		{QOFConditionPAD, QOFConditionCVD},
+		{QOFConditionDiabetes, QOFConditionInvalid},
+	}
+	for _, test := range tests {
+		if parent := test.condition.Parent(); parent != test.parent {
+			t.Errorf("expected parent %s for %s, found %s", test.parent, test.condition, parent)
+		}
+	}
+	if ancestors := QOFCondition(QOFConditionType1Diabetes).Ancestors(); !reflect.DeepEqual(ancestors, []QOFCondition{QOFConditionDiabetes}) {
+		t.Errorf("expected dm as the only ancestor of dm1, found %v", ancestors)
+	}
+}
+
+func TestCheckConditionHierarchies(t *testing.T) {
+	if err := checkConditionHierarchies(QOFConditionHierarchies); err != nil {
+		t.Errorf("expected no error, found %s", err)
+	}
+	twoParents := []QOFConditionHierarchy{
+		{Parent: QOFConditionDiabetes, Children: []QOFCondition{QOFConditionType1Diabetes}},
+		{Parent: QOFConditionCVD, Children: []QOFCondition{QOFConditionType1Diabetes}},
+	}
+	if err := checkConditionHierarchies(twoParents); err == nil {
+		t.Errorf("expected an error for a condition with two parents")
+	}
+	cycle := []QOFConditionHierarchy{
+		{Parent: QOFConditionDiabetes, Children: []QOFCondition{QOFConditionType1Diabetes}},
+		{Parent: QOFConditionType1Diabetes, Children: []QOFCondition{QOFConditionDiabetes}},
+	}
+	if err := checkConditionHierarchies(cycle); err == nil {
+		t.Errorf("expected an error for a condition that's its own ancestor")
+	}
+}
+
+func TestHierarchyConstraints(t *testing.T) {
+	for _, h := range QOFConditionHierarchies {
+		for _, c := range h.Children {
+			implied := impliedConditions(QOFConditions(c), QOFConditionConstraints)
+			if !implied.Contains(h.Parent) {
+				t.Errorf("expected %s to imply %s", c, h.Parent)
+			}
+		}
+	}
+	var both QOFConditions
+	both.Add(QOFConditionType1Diabetes)
+	both.Add(QOFConditionType2Diabetes)
+	if possibleConditions(impliedConditions(both, QOFConditionConstraints), QOFConditionConstraints) {
+		t.Errorf("expected dm1 and dm2 to exclude each other")
+	}
+	var cvd QOFConditions
+	cvd.Add(QOFConditionCHD)
+	cvd.Add(QOFConditionPAD)
+	if !possibleConditions(impliedConditions(cvd, QOFConditionConstraints), QOFConditionConstraints) {
+		t.Errorf("expected chd and pad to be allowed together")
+	}
+}
+
+func TestWithAncestorsAndSplitSubConditions(t *testing.T) {
+	tests := []struct {
+		conditions []QOFCondition
+		reported   []QOFCondition
+		modelled   []QOFCondition
+		refined    []QOFCondition
+	}{
+		{
+			[]QOFCondition{QOFConditionDiabetes, QOFConditionType1Diabetes, QOFConditionType2Diabetes},
+			[]QOFCondition{QOFConditionDiabetes, QOFConditionType1Diabetes, QOFConditionType2Diabetes},
+			[]QOFCondition{QOFConditionDiabetes},
+			[]QOFCondition{QOFConditionType1Diabetes, QOFConditionType2Diabetes},
+		},
+		{
+			[]QOFCondition{QOFConditionType1Diabetes, QOFConditionType2Diabetes, QOFConditionHypertension},
+			[]QOFCondition{QOFConditionDiabetes, QOFConditionType1Diabetes, QOFConditionType2Diabetes, QOFConditionHypertension},
+			[]QOFCondition{QOFConditionType1Diabetes, QOFConditionType2Diabetes, QOFConditionHypertension},
+			[]QOFCondition{},
+		},
+		{
+			[]QOFCondition{QOFConditionPAD, QOFConditionCHD},
+			[]QOFCondition{QOFConditionCVD, QOFConditionPAD, QOFConditionCHD},
+			[]QOFCondition{QOFConditionPAD, QOFConditionCHD},
+			[]QOFCondition{},
+		},
+	}
+	for _, test := range tests {
+		if reported := withAncestors(test.conditions); !reflect.DeepEqual(reported, test.reported) {
+			t.Errorf("%v: expected reported %v, found %v", test.conditions, test.reported, reported)
+		}
+		modelled, refined := splitSubConditions(test.conditions)
+		if !reflect.DeepEqual(modelled, test.modelled) || !reflect.DeepEqual(refined, test.refined) {
+			t.Errorf("%v: expected %v and %v, found %v and %v", test.conditions, test.modelled, test.refined, modelled, refined)
+		}
+	}
+}
+
+func TestSubConditionModelRefinesParent(t *testing.T) {
+	prevalences := constantPrevalences([]QOFCondition{QOFConditionDiabetes}, 0.1)
+	for c, p := range constantPrevalences([]QOFCondition{QOFConditionType1Diabetes}, 0.02) {
+		prevalences[c] = p
+	}
+	for c, p := range constantPrevalences([]QOFCondition{QOFConditionType2Diabetes}, 0.08) {
+		prevalences[c] = p
+	}
+	model := &SubConditionModel{Refined: []QOFCondition{QOFConditionType1Diabetes, QOFConditionType2Diabetes}, Prevalences: prevalences}
+	gp := &GPPractice{Code: "G1", ConditionBias: map[QOFCondition]float64{}}
+	rng := rand.New(rand.NewSource(42))
+	n := 20000
+	people := make([]Person, n)
+	counts := make(map[QOFCondition]int)
+	for i := range people {
+		p := &people[i]
+		p.Sex = Sex(i % 2)
+		p.Age = 50
+		// Half the people have diabetes, everyone else shouldn't be
+		// given a sub-condition
+		if i%4 < 2 {
+			p.Conditions.Add(QOFConditionDiabetes)
+		}
+		model.Assign(p, gp, rng, nil)
+		for _, c := range model.Refined {
+			if p.Conditions.Contains(c) {
+				counts[c]++
+			}
+		}
+		if p.Conditions.Contains(QOFConditionType1Diabetes) && p.Conditions.Contains(QOFConditionType2Diabetes) {
+			t.Fatalf("expected nobody to have both types of diabetes")
+		}
+	}
+	if err := checkRollUps(people, withAncestors(model.Refined)); err != nil {
+		t.Errorf("expected consistent roll ups, found %s", err)
+	}
+	// Everyone with diabetes has one of its types, in proportion to their
+	// prevalences, since they account for all of it
+	if share := float64(counts[QOFConditionType1Diabetes]) / float64(n/2); math.Abs(share-0.2) > 0.02 {
+		t.Errorf("expected about 20%% of people with diabetes to have type 1, found %.3f", share)
+	}
+	if total := counts[QOFConditionType1Diabetes] + counts[QOFConditionType2Diabetes]; total != n/2 {
+		t.Errorf("expected %d people with a type of diabetes, found %d", n/2, total)
+	}
+
+	people[0].Conditions = QOFConditions(QOFConditionType1Diabetes)
+	if err := checkRollUps(people, withAncestors(model.Refined)); err == nil {
+		t.Errorf("expected an error for a sub-condition without its parent")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConditionModel assigns conditions to people. Models are calibrated to
+// practices through GPPractice.ConditionBias, estimated beforehand from
+// the marginal prevalence of each condition.
+type ConditionModel interface {
+	// Assign adds conditions to p, who is registered with gp, recording
+	// each decision to audit, which is nil unless p is audited
+	Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit)
+}
+
+// PracticeCalibratedConditionModel is implemented by condition models that
+// need to see everyone registered with a practice before assigning any of
+// them conditions.
+type PracticeCalibratedConditionModel interface {
+	Calibrate(gp *GPPractice, people []*Person)
+}
+
+// calibrateConditionModel calibrates model to the people registered with
+// gp, if it needs it.
+func calibrateConditionModel(model ConditionModel, gp *GPPractice, people []*Person) {
+	if c, ok := model.(PracticeCalibratedConditionModel); ok {
+		c.Calibrate(gp, people)
+	}
+}
+
+// QOFConditionRiskFactors gives the conditions that are the main risk
+// factors for others, in order of precedence, so that condition models
+// that assign conditions in turn assign the risk factors first, and the
+// conditions that follow from them given their presence, rather than the
+// reverse. Hypertension and diabetes lead to each of the cardiovascular
+// conditions.
+var QOFConditionRiskFactors = map[QOFCondition][]QOFCondition{
+	QOFConditionCHD:    {QOFConditionHypertension, QOFConditionDiabetes},
+	QOFConditionStroke: {QOFConditionHypertension, QOFConditionDiabetes},
+	QOFConditionAF:     {QOFConditionHypertension, QOFConditionDiabetes},
+	QOFConditionHF:     {QOFConditionHypertension, QOFConditionDiabetes},
+}
+
+// orderAfterRiskFactors moves the conditions with risk factors after
+// those without, keeping the order of each otherwise.
+func orderAfterRiskFactors(conditions []QOFCondition) {
+	sort.SliceStable(conditions, func(i, j int) bool {
+		return len(QOFConditionRiskFactors[conditions[i]]) == 0 && len(QOFConditionRiskFactors[conditions[j]]) > 0
+	})
+}
+
+// ChainRuleConditionModel assigns conditions in a random order, with the
+// probability of each depending on the presence or absence of the
+// previous, using the conditional prevalences by age and sex. Conditions
+// with risk factors in QOFConditionRiskFactors are assigned after them,
+// depending instead on the first of their simulated risk factors that's
+// present, or the first that's absent, if none are.
+type ChainRuleConditionModel struct {
+	prevalences AllPrevalences
+	risks       *RiskFactors
+	shuffled    []QOFCondition
+	simulated   QOFConditions
+}
+
+func NewChainRuleConditionModel(conditions []QOFCondition, prevalences AllPrevalences, risks *RiskFactors) *ChainRuleConditionModel {
+	shuffled := make([]QOFCondition, len(conditions))
+	copy(shuffled, conditions)
+	var simulated QOFConditions
+	for _, condition := range conditions {
+		simulated.Add(condition)
+	}
+	return &ChainRuleConditionModel{prevalences: prevalences, risks: risks, shuffled: shuffled, simulated: simulated}
+}
+
+func (c *ChainRuleConditionModel) Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit) {
+	shuffled := c.shuffled
+	rng.Shuffle(len(shuffled), func(i int, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	orderAfterRiskFactors(shuffled)
+	c.assign(p, gp, shuffled[0], OneCondition(shuffled[0]), c.prevalences[OneCondition(shuffled[0])], rng, audit)
+	for i := 1; i < len(shuffled); i++ {
+		if p.Conditions.Contains(shuffled[i]) || !allowsCondition(p.Conditions, shuffled[i], QOFConditionConstraints) {
+			// Already implied by an earlier condition, or excluded by one
+			audit.RecordSkipped(p, shuffled[i], "chain-rule")
+			continue
+		}
+		given := c.given(p, shuffled[i], shuffled[i-1])
+		var d DiagonosisGiven
+		if p.Conditions.Contains(given) {
+			d = OneConditionGivenOtherPresent(shuffled[i], given)
+		} else {
+			d = OneConditionGivenOtherAbsent(shuffled[i], given)
+		}
+		if conditional, ok := c.prevalences[d]; ok {
+			c.assign(p, gp, shuffled[i], d, conditional, rng, audit)
+		} else {
+			panic(fmt.Sprintf("no conditional prevalences for %s", d))
+		}
+	}
+}
+
+// given returns the condition on whose presence or absence that of
+// condition depends: the first of its simulated risk factors that p has,
+// or the first of them, if p has none, or otherwise previous, the
+// condition assigned before it.
+func (c *ChainRuleConditionModel) given(p *Person, condition QOFCondition, previous QOFCondition) QOFCondition {
+	first := QOFConditionInvalid
+	for _, r := range QOFConditionRiskFactors[condition] {
+		if !c.simulated.Contains(r) {
+			continue
+		} else if p.Conditions.Contains(r) {
+			return r
+		} else if first == QOFConditionInvalid {
+			first = r
+		}
+	}
+	if first != QOFConditionInvalid {
+		return first
+	}
+	return previous
+}
+
+// assign adds condition to p with the probability given by prevalence,
+// the prevalence described by d, for their age and sex, scaled by their
+// practice's bias and their risk.
+func (c *ChainRuleConditionModel) assign(p *Person, gp *GPPractice, condition QOFCondition, d DiagonosisGiven, prevalence Prevalences, rng *rand.Rand, audit *ConditionAudit) {
+	bias, risk := gp.ConditionBias[condition], c.risks.Risk(p, condition)
+	probability := prevalence.Prevalence(p.Sex, p.Age) * bias * risk
+	draw := rng.Float64()
+	if draw < probability {
+		addCondition(p, condition, QOFConditionConstraints)
+	}
+	audit.Record(ConditionDecision{Condition: condition.String(), Model: "chain-rule", Given: d.String(), Probability: probability, Bias: bias, Risk: risk, Draw: draw, Outcome: conditionOutcome(draw < probability)})
+}
+
+// LogisticCoefficients adjust the log odds of a condition, relative to
+// the practice calibrated prevalence for a person's age and sex.
+type LogisticCoefficients struct {
+	// Log odds ratio for each IMD decile more deprived than the middle
+	// of the distribution
+	IMD float64 `yaml:"imd"`
+	// Log odds ratio for each other condition already assigned
+	Comorbidity float64 `yaml:"comorbidity"`
+}
+
+// LogisticConditionModel assigns each condition independently, in a random
+// order, with those with risk factors after them, and log odds given by the marginal prevalence for the person's
+// age and sex at their practice, adjusted for the deprivation of their home
+// LSOA, and the number of conditions they've already been assigned. An
+// intercept for each practice and condition, found by Calibrate, offsets
+// the adjustments so that the practice's prevalence is unchanged by them.
+type LogisticConditionModel struct {
+	prevalences  AllPrevalences
+	risks        *RiskFactors
+	lsoas        map[LSOACode]*LSOA
+	coefficients map[QOFCondition]LogisticCoefficients
+	intercepts   map[GPPracticeCode]map[QOFCondition]float64
+	shuffled     []QOFCondition
+}
+
+func NewLogisticConditionModel(conditions []QOFCondition, prevalences AllPrevalences, risks *RiskFactors, lsoas map[LSOACode]*LSOA, coefficients map[QOFCondition]LogisticCoefficients) *LogisticConditionModel {
+	shuffled := make([]QOFCondition, len(conditions))
+	copy(shuffled, conditions)
+	return &LogisticConditionModel{prevalences: prevalences, risks: risks, lsoas: lsoas, coefficients: coefficients, intercepts: make(map[GPPracticeCode]map[QOFCondition]float64), shuffled: shuffled}
+}
+
+func readLogisticCoefficients(filename string) (map[QOFCondition]LogisticCoefficients, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open logistic coefficients: %s", err)
+	}
+	defer f.Close()
+	var c map[string]LogisticCoefficients
+	if err := yaml.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to read logistic coefficients: %s", err)
+	}
+	coefficients := make(map[QOFCondition]LogisticCoefficients)
+	for name, cs := range c {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in logistic coefficients", name)
+		}
+		coefficients[condition] = cs
+	}
+	return coefficients, nil
+}
+
+// The middle of the IMD decile distribution, from which deprivation is
+// measured
+const LogisticIMDDecileCentre = 5.5
+
+func logit(p float64) float64 {
+	return math.Log(p / (1.0 - p))
+}
+
+func logistic(x float64) float64 {
+	return 1.0 / (1.0 + math.Exp(-x))
+}
+
+// The bounds of the search for a practice's intercept
+const LogisticMaxIntercept = 20.0
+
+// The number of bisection steps taken to find a practice's intercept
+const LogisticInterceptIterations = 50
+
+func (l *LogisticConditionModel) deprivation(p *Person) float64 {
+	if lsoa, ok := l.lsoas[p.Home]; ok && lsoa.IMDDecile > 0 {
+		return LogisticIMDDecileCentre - float64(lsoa.IMDDecile)
+	}
+	return 0.0
+}
+
+// base returns the practice calibrated prevalence of condition for p,
+// before adjustment for deprivation and comorbidity.
+func (l *LogisticConditionModel) base(p *Person, gp *GPPractice, condition QOFCondition) float64 {
+	return clamp(l.prevalences[OneCondition(condition)].Prevalence(p.Sex, p.Age)*gp.ConditionBias[condition]*l.risks.Risk(p, condition), 0.0, 1.0)
+}
+
+// Calibrate finds, for each condition, the intercept added to the log odds
+// of the people registered with gp, by bisection, so that the mean of their
+// adjusted probabilities matches the mean of their practice calibrated
+// prevalences. As the number of conditions assigned before each depends on
+// the order drawn, it's taken as its expectation: half the sum of the
+// prevalences of the other conditions.
+func (l *LogisticConditionModel) Calibrate(gp *GPPractice, people []*Person) {
+	base := make([][]float64, len(l.shuffled))
+	others := make([]float64, len(people))
+	for i, condition := range l.shuffled {
+		base[i] = make([]float64, len(people))
+		for j, p := range people {
+			base[i][j] = l.base(p, gp, condition)
+			others[j] += base[i][j]
+		}
+	}
+	intercepts := make(map[QOFCondition]float64)
+	for i, condition := range l.shuffled {
+		c := l.coefficients[condition]
+		offsets := make([]float64, 0, len(people))
+		target := 0.0
+		for j, p := range people {
+			if b := base[i][j]; b > 0.0 && b < 1.0 {
+				offsets = append(offsets, logit(b)+c.IMD*l.deprivation(p)+c.Comorbidity*(others[j]-b)/2.0)
+				target += b
+			}
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		lo, hi := -LogisticMaxIntercept, LogisticMaxIntercept
+		for k := 0; k < LogisticInterceptIterations; k++ {
+			mid := (lo + hi) / 2.0
+			total := 0.0
+			for _, offset := range offsets {
+				total += logistic(offset + mid)
+			}
+			if total < target {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		intercepts[condition] = (lo + hi) / 2.0
+	}
+	l.intercepts[gp.Code] = intercepts
+}
+
+func (l *LogisticConditionModel) Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit) {
+	shuffled := l.shuffled
+	rng.Shuffle(len(shuffled), func(i int, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	orderAfterRiskFactors(shuffled)
+	deprivation := l.deprivation(p)
+	intercepts := l.intercepts[gp.Code]
+	assigned := 0
+	for _, condition := range shuffled {
+		if p.Conditions.Contains(condition) || !allowsCondition(p.Conditions, condition, QOFConditionConstraints) {
+			audit.RecordSkipped(p, condition, "logistic")
+			continue
+		}
+		bias, risk := gp.ConditionBias[condition], l.risks.Risk(p, condition)
+		base := l.base(p, gp, condition)
+		var probability float64
+		if base <= 0.0 || base >= 1.0 {
+			probability = base
+		} else {
+			c := l.coefficients[condition]
+			probability = logistic(logit(base) + intercepts[condition] + c.IMD*deprivation + c.Comorbidity*float64(assigned))
+		}
+		draw := rng.Float64()
+		added := draw < probability && addCondition(p, condition, QOFConditionConstraints)
+		if added {
+			assigned++
+		}
+		audit.Record(ConditionDecision{Condition: condition.String(), Model: "logistic", Given: OneCondition(condition).String(), Probability: probability, Bias: bias, Risk: risk, Draw: draw, Outcome: conditionOutcome(added)})
+	}
+}
+
+// The names of condition models accepted by ConditionModelFromString
+var ConditionModels = []string{"chain-rule", "logistic", "joint"}
+
+func isConditionModel(s string) bool {
+	for _, m := range ConditionModels {
+		if m == s {
+			return true
+		}
+	}
+	return false
+}
+
+func ConditionModelFromString(s string, conditions []QOFCondition, prevalences AllPrevalences, risks *RiskFactors, lsoas map[LSOACode]*LSOA, coefficientsFilename string) (ConditionModel, error) {
+	switch s {
+	case "chain-rule":
+		return NewChainRuleConditionModel(conditions, prevalences, risks), nil
+	case "logistic":
+		coefficients, err := readLogisticCoefficients(coefficientsFilename)
+		if err != nil {
+			return nil, err
+		}
+		return NewLogisticConditionModel(conditions, prevalences, risks, lsoas, coefficients), nil
+	case "joint":
+		return NewJointConditionModel(conditions, prevalences, risks), nil
+	}
+	return nil, fmt.Errorf("unknown condition model %q, expected one of %s", s, strings.Join(ConditionModels, ", "))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func constantPrevalences(conditions []QOFCondition, p float64) AllPrevalences {
+	prevalences := make(AllPrevalences)
+	for _, c := range conditions {
+		byAge := make(AgePrevalences, 2)
+		for sex := range byAge {
+			byAge[sex] = []AgePrevalence{{Ages: AgeRange{Begin: 0}, Prevalence: p}}
+		}
+		prevalences[OneCondition(c)] = Prevalences{Conditions: OneCondition(c), ByAge: byAge}
+	}
+	return prevalences
+}
+
+func TestLogisticConditionModelMatchesPracticePrevalence(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	lsoas := make(map[LSOACode]*LSOA)
+	for decile := 1; decile <= 10; decile++ {
+		code := LSOACode(string(rune('A' + decile)))
+		lsoas[code] = &LSOA{Code: code, IMDDecile: decile}
+	}
+	tests := []struct {
+		name         string
+		prevalence   float64
+		coefficients LogisticCoefficients
+	}{
+		{"no adjustment", 0.1, LogisticCoefficients{}},
+		{"deprivation", 0.1, LogisticCoefficients{IMD: 0.3}},
+		{"comorbidity", 0.2, LogisticCoefficients{Comorbidity: 1.0}},
+		{"both", 0.05, LogisticCoefficients{IMD: -0.2, Comorbidity: 0.7}},
+	}
+	for _, test := range tests {
+		coefficients := map[QOFCondition]LogisticCoefficients{QOFConditionDiabetes: test.coefficients, QOFConditionHypertension: test.coefficients}
+		model := NewLogisticConditionModel(conditions, constantPrevalences(conditions, test.prevalence), &RiskFactors{}, lsoas, coefficients)
+		gp := &GPPractice{Code: "G1", ConditionBias: map[QOFCondition]float64{QOFConditionDiabetes: 1.0, QOFConditionHypertension: 1.0}}
+		people := make([]*Person, 0, 100000)
+		for i := 0; i < cap(people); i++ {
+			people = append(people, &Person{ID: i, Sex: Sex(i % 2), Age: 50, Home: LSOACode(string(rune('A' + 1 + i%10)))})
+		}
+		model.Calibrate(gp, people)
+		rng := rand.New(rand.NewSource(42))
+		counts := make(map[QOFCondition]int)
+		for _, p := range people {
+			model.Assign(p, gp, rng, nil)
+			for _, c := range conditions {
+				if p.Conditions.Contains(c) {
+					counts[c]++
+				}
+			}
+		}
+		for _, c := range conditions {
+			simulated := float64(counts[c]) / float64(len(people))
+			if math.Abs(simulated-test.prevalence) > 0.005 {
+				t.Errorf("%s: expected prevalence of %s close to %.3f, found %.3f", test.name, c, test.prevalence, simulated)
+			}
+		}
+	}
+}
+
+func TestLogisticConditionModelIsUncalibratedWithoutIntercept(t *testing.T) {
+	// Checks the test above is meaningful: without the intercept, a
+	// positive comorbidity coefficient raises the prevalence
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	coefficients := map[QOFCondition]LogisticCoefficients{QOFConditionDiabetes: {Comorbidity: 2.0}, QOFConditionHypertension: {Comorbidity: 2.0}}
+	model := NewLogisticConditionModel(conditions, constantPrevalences(conditions, 0.2), &RiskFactors{}, nil, coefficients)
+	gp := &GPPractice{Code: "G1", ConditionBias: map[QOFCondition]float64{QOFConditionDiabetes: 1.0, QOFConditionHypertension: 1.0}}
+	rng := rand.New(rand.NewSource(42))
+	n, count := 50000, 0
+	for i := 0; i < n; i++ {
+		p := &Person{ID: i, Sex: Male, Age: 50}
+		model.Assign(p, gp, rng, nil)
+		if p.Conditions.Contains(QOFConditionDiabetes) {
+			count++
+		}
+	}
+	if simulated := float64(count) / float64(n); simulated < 0.22 {
+		t.Errorf("expected uncalibrated prevalence above 0.22, found %.3f", simulated)
+	}
+}
+
+func TestOrderAfterRiskFactors(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionAF, QOFConditionCOPD, QOFConditionHF, QOFConditionHypertension, QOFConditionDiabetes}
+	orderAfterRiskFactors(conditions)
+	expected := []QOFCondition{QOFConditionCOPD, QOFConditionHypertension, QOFConditionDiabetes, QOFConditionAF, QOFConditionHF}
+	if !reflect.DeepEqual(conditions, expected) {
+		t.Errorf("expected %v, found %v", expected, conditions)
+	}
+}
+
+func TestChainRuleConditionModelAssignsAfterRiskFactors(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionAF, QOFConditionCOPD, QOFConditionHypertension}
+	prevalences := constantPrevalences(conditions, 0.5)
+	set := func(d DiagonosisGiven, p float64) {
+		prevalences[d] = Prevalences{Conditions: d, ByAge: constantPrevalences([]QOFCondition{QOFConditionAF}, p)[OneCondition(QOFConditionAF)].ByAge}
+	}
+	// Everyone with hypertension has AF, and nobody else, so AF must be
+	// assigned after hypertension, and given it, whatever precedes it.
+	// Hypertension given AF isn't needed, so isn't given.
+	set(OneConditionGivenOtherPresent(QOFConditionAF, QOFConditionHypertension), 1.0)
+	set(OneConditionGivenOtherAbsent(QOFConditionAF, QOFConditionHypertension), 0.0)
+	for _, c := range []QOFCondition{QOFConditionAF, QOFConditionHypertension} {
+		set(OneConditionGivenOtherPresent(c, QOFConditionCOPD), 0.5)
+		set(OneConditionGivenOtherAbsent(c, QOFConditionCOPD), 0.5)
+		set(OneConditionGivenOtherPresent(QOFConditionCOPD, c), 0.5)
+		set(OneConditionGivenOtherAbsent(QOFConditionCOPD, c), 0.5)
+	}
+	model := NewChainRuleConditionModel(conditions, prevalences, &RiskFactors{})
+	gp := &GPPractice{Code: "G1", ConditionBias: map[QOFCondition]float64{QOFConditionAF: 1.0, QOFConditionCOPD: 1.0, QOFConditionHypertension: 1.0}}
+	rng := rand.New(rand.NewSource(42))
+	hypertension := 0
+	for i := 0; i < 1000; i++ {
+		p := &Person{ID: i, Sex: Sex(i % 2), Age: 70}
+		model.Assign(p, gp, rng, nil)
+		if p.Conditions.Contains(QOFConditionAF) != p.Conditions.Contains(QOFConditionHypertension) {
+			t.Fatalf("expected AF only with hypertension, found %v", p.Conditions)
+		}
+		if p.Conditions.Contains(QOFConditionHypertension) {
+			hypertension++
+		}
+	}
+	if hypertension < 400 || hypertension > 600 {
+		t.Errorf("expected around 500 people with hypertension, found %d", hypertension)
+	}
+}
+
+func TestChainRuleConditionModelGiven(t *testing.T) {
+	var diabetes QOFConditions
+	diabetes.Add(QOFConditionDiabetes)
+	var both QOFConditions
+	both.Add(QOFConditionDiabetes)
+	both.Add(QOFConditionHypertension)
+	tests := []struct {
+		conditions []QOFCondition
+		has        QOFConditions
+		condition  QOFCondition
+		expected   QOFCondition
+	}{
+		// The first risk factor present
+		{[]QOFCondition{QOFConditionHypertension, QOFConditionDiabetes, QOFConditionHF}, diabetes, QOFConditionHF, QOFConditionDiabetes},
+		{[]QOFCondition{QOFConditionHypertension, QOFConditionDiabetes, QOFConditionHF}, both, QOFConditionHF, QOFConditionHypertension},
+		// Or the first simulated, if none are present
+		{[]QOFCondition{QOFConditionHypertension, QOFConditionDiabetes, QOFConditionHF}, 0, QOFConditionHF, QOFConditionHypertension},
+		{[]QOFCondition{QOFConditionDiabetes, QOFConditionHF}, 0, QOFConditionHF, QOFConditionDiabetes},
+		// Or the previous condition, without risk factors
+		{[]QOFCondition{QOFConditionCOPD, QOFConditionHF}, 0, QOFConditionHF, QOFConditionCOPD},
+		{[]QOFCondition{QOFConditionDiabetes, QOFConditionCOPD}, diabetes, QOFConditionCOPD, QOFConditionCOPD},
+	}
+	for _, test := range tests {
+		model := NewChainRuleConditionModel(test.conditions, nil, &RiskFactors{})
+		if given := model.given(&Person{Conditions: test.has}, test.condition, QOFConditionCOPD); given != test.expected {
+			t.Errorf("%v: expected %s given %s, found %s", test.conditions, test.condition, test.expected, given)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigIncludeKey lists, in a config or data manifest, the files it's
+// layered over, relative to its own directory, so that a base shared by
+// every run can be overlaid with what's specific to an ICB or environment.
+const ConfigIncludeKey = "include"
+
+// Keys of a config with this prefix aren't flags, but hold values for
+// anchors to refer to, as in x-defaults: &defaults.
+const ConfigExtensionPrefix = "x-"
+
+// readComposedYAML reads the YAML document in filename, layered over the
+// documents it includes, each of which can include others. Mappings are
+// merged key by key, with the including document taking precedence, while
+// other values replace those included. Anchors and aliases can be used
+// within each file. Environment variables, written ${NAME}, or
+// ${NAME:-default} when NAME may not be set, are substituted into every
+// value, including the files included, so that paths can differ between
+// running locally and in batch.
+func readComposedYAML(filename string) (*yaml.Node, error) {
+	return readIncludedYAML(filename, nil)
+}
+
+func readIncludedYAML(filename string, including []string) (*yaml.Node, error) {
+	for _, f := range including {
+		if f == filename {
+			return nil, fmt.Errorf("%s: included by itself, through %s", filename, strings.Join(including, ", "))
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var document yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&document); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(document.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expected a mapping", filename)
+	} else if err := expandEnv(root, filename); err != nil {
+		return nil, err
+	}
+
+	includes := make([]string, 0)
+	content := make([]*yaml.Node, 0, len(root.Content))
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolveAlias(root.Content[i+1])
+		if key.Value != ConfigIncludeKey {
+			content = append(content, root.Content[i], root.Content[i+1])
+			continue
+		}
+		switch value.Kind {
+		case yaml.ScalarNode:
+			includes = append(includes, value.Value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item = resolveAlias(item); item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s:%d: expected a filename to include", filename, item.Line)
+				}
+				includes = append(includes, item.Value)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a filename, or a list of them, to include", filename, value.Line)
+		}
+	}
+	root.Content = content
+
+	composed := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		included, err := readIncludedYAML(include, append(including, filename))
+		if err != nil {
+			return nil, err
+		}
+		composed = mergeYAML(composed, included)
+	}
+	return mergeYAML(composed, root), nil
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// mergeYAML returns overlay merged over base. If both are mappings, keys
+// in both are merged in turn, and those only in base are kept, otherwise
+// overlay replaces base.
+func mergeYAML(base *yaml.Node, overlay *yaml.Node) *yaml.Node {
+	b, o := resolveAlias(base), resolveAlias(overlay)
+	if b.Kind != yaml.MappingNode || o.Kind != yaml.MappingNode {
+		return overlay
+	}
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: o.Tag, Line: o.Line, Column: o.Column}
+	overlaid := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(o.Content); i += 2 {
+		overlaid[o.Content[i].Value] = o.Content[i+1]
+	}
+	for i := 0; i+1 < len(b.Content); i += 2 {
+		key, value := b.Content[i], b.Content[i+1]
+		if v, ok := overlaid[key.Value]; ok {
+			value = mergeYAML(value, v)
+			delete(overlaid, key.Value)
+		}
+		merged.Content = append(merged.Content, key, value)
+	}
+	for i := 0; i+1 < len(o.Content); i += 2 {
+		if _, ok := overlaid[o.Content[i].Value]; ok {
+			merged.Content = append(merged.Content, o.Content[i], o.Content[i+1])
+		}
+	}
+	return merged
+}
+
+// expandEnv substitutes environment variables into the value of every
+// scalar within n, returning an error for those that aren't set, and
+// have no default, rather than silently reading from the wrong path.
+func expandEnv(n *yaml.Node, filename string) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		var missing []string
+		n.Value = os.Expand(n.Value, func(name string) string {
+			name, fallback, hasDefault := strings.Cut(name, ":-")
+			if value, ok := os.LookupEnv(name); ok && (value != "" || !hasDefault) {
+				return value
+			} else if hasDefault {
+				return fallback
+			}
+			missing = append(missing, name)
+			return ""
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("%s:%d: environment variable %s isn't set", filename, n.Line, strings.Join(missing, ", "))
+		}
+	case yaml.DocumentNode, yaml.SequenceNode, yaml.MappingNode:
+		for _, c := range n.Content {
+			if err := expandEnv(c, filename); err != nil {
+				return err
+			}
+		}
+	}
+	// Aliases share the node they refer to, which is expanded where
+	// it's anchored
+	return nil
+}
+
+// repeatableFlag is implemented by the values of flags that accumulate
+// each time they're given, like --set-prevalence, which are set once for
+// each item of a list in a config, rather than once with the items
+// joined by commas.
+type repeatableFlag interface {
+	flag.Value
+	Repeatable()
+}
+
+// applyConfig sets flags of a command from the config in filename, a
+// mapping of flag names to their values, read by readComposedYAML, unless
+// they were explicitly given on the command line. Lists are joined with
+// commas, as in --conditions=dm,hyp, other than for flags that can be
+// given more than once.
+func applyConfig(flags *flag.FlagSet, filename string) error {
+	config, err := readComposedYAML(filename)
+	if err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	// Decoded, rather than walked, so that merge keys are resolved
+	values := make(map[string]yaml.Node)
+	if err := config.Decode(&values); err != nil {
+		return fmt.Errorf("config: %s: %s", filename, err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	given := make(map[string]struct{})
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = struct{}{}
+	})
+	for _, name := range names {
+		node := values[name]
+		value := resolveAlias(&node)
+		if strings.HasPrefix(name, ConfigExtensionPrefix) {
+			continue
+		}
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("config: %s: unknown flag %q for %s", filename, name, flags.Name())
+		} else if _, ok := given[name]; ok {
+			continue
+		}
+		set := make([]string, 0, 1)
+		switch value.Kind {
+		case yaml.ScalarNode:
+			set = append(set, value.Value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item = resolveAlias(item); item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("config: %s: %s: expected a list of values", filename, name)
+				}
+				set = append(set, item.Value)
+			}
+			if _, ok := f.Value.(repeatableFlag); !ok {
+				set = []string{strings.Join(set, ",")}
+			}
+		default:
+			return fmt.Errorf("config: %s: %s: expected a value, or a list of them", filename, name)
+		}
+		for _, v := range set {
+			if err := flags.Set(name, v); err != nil {
+				return fmt.Errorf("config: %s: %s", filename, err)
+			}
+		}
+	}
+	return nil
+}
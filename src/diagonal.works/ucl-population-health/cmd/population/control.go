@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The columns of the QOF achievement extract, in long form, with a row for
+// each practice, indicator and measure, as published by NHS England, and
+// written by writeQOFAchievement
+const (
+	QOFAchievementPracticeCodeColumn  = "PRACTICE_CODE"
+	QOFAchievementIndicatorCodeColumn = "INDICATOR_CODE"
+	QOFAchievementMeasureColumn       = "MEASURE"
+	QOFAchievementValueColumn         = "VALUE"
+	QOFAchievementNumeratorMeasure    = "NUMERATOR"
+	QOFAchievementDenominatorMeasure  = "DENOMINATOR"
+)
+
+// ControlIndicator is a QOF indicator of achievement measuring the control
+// of a condition, like the share of people with diabetes whose last HbA1c
+// is at or below target.
+type ControlIndicator struct {
+	Indicator   string
+	Description string
+	// The ages to which the indicator applies, or all ages if not given
+	Ages AgeRange
+}
+
+// ControlModel gives the QOF indicators measuring the control of each
+// condition, keyed by condition, from the reported achievement of which
+// people with the condition are marked as controlled, at the rate of
+// their practice.
+type ControlModel struct {
+	Conditions map[string][]*ControlIndicator
+
+	// The indicators of each condition
+	indicators map[QOFCondition][]*ControlIndicator
+	// The achievement of each indicator across England, keyed by code,
+	// used for practices that didn't report it
+	national map[string]float64
+}
+
+func readControlModel(filename string) (*ControlModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control model: %s", err)
+	}
+	defer f.Close()
+	var model ControlModel
+	if err := yaml.NewDecoder(f).Decode(&model.Conditions); err != nil {
+		return nil, fmt.Errorf("failed to read control model: %s", err)
+	}
+	model.indicators = make(map[QOFCondition][]*ControlIndicator)
+	codes := make(map[string]struct{})
+	for name, indicators := range model.Conditions {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in control model", name)
+		}
+		for _, indicator := range indicators {
+			if _, ok := codes[indicator.Indicator]; ok || indicator.Indicator == "" {
+				return nil, fmt.Errorf("indicator code %q for %s missing, or given more than once", indicator.Indicator, name)
+			}
+			codes[indicator.Indicator] = struct{}{}
+		}
+		model.indicators[condition] = indicators
+	}
+	if len(model.indicators) == 0 {
+		return nil, fmt.Errorf("control model needs indicators for at least one condition")
+	}
+	return &model, nil
+}
+
+// ControlledConditions returns the conditions with indicators, in the
+// order of AllQOFConditions.
+func (c *ControlModel) ControlledConditions() []QOFCondition {
+	conditions := make([]QOFCondition, 0, len(c.indicators))
+	for _, condition := range AllQOFConditions() {
+		if _, ok := c.indicators[condition]; ok {
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions
+}
+
+// Indicator returns the indicator measuring the control of condition that
+// applies to p, or nil if p doesn't have the condition, or none apply at
+// their age.
+func (c *ControlModel) Indicator(p *Person, condition QOFCondition) *ControlIndicator {
+	if !p.Conditions.Contains(condition) {
+		return nil
+	}
+	for _, indicator := range c.indicators[condition] {
+		if indicator.Ages.Contains(p.Age) {
+			return indicator
+		}
+	}
+	return nil
+}
+
+func (c *ControlModel) warnUnsimulated(simulated []QOFCondition) {
+	var included QOFConditions
+	for _, condition := range simulated {
+		included.Add(condition)
+	}
+	for _, condition := range c.ControlledConditions() {
+		if !included.Contains(condition) {
+			Warningf("  %s isn't simulated, so nobody will be controlled for it", condition)
+		}
+	}
+}
+
+// readGPPracticeAchievement reads the reported achievement of each
+// practice against the indicators of model, as its numerator as a share
+// of its denominator, and that across England, from every practice
+// reporting, whether or not it's in gps. Achievement reported against the
+// code of a predecessor is added to that of its successor.
+func readGPPracticeAchievement(gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors, model *ControlModel, dataset *Dataset) error {
+	indicators := make(map[string]struct{})
+	for _, is := range model.indicators {
+		for _, indicator := range is {
+			indicators[indicator.Indicator] = struct{}{}
+		}
+	}
+	r, err := openDataset(dataset)
+	if err != nil {
+		return fmt.Errorf("failed to open qof achievement: %s", err)
+	}
+	defer r.Close()
+	r.Comment = '#'
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %s", dataset.Filename, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[column] = i
+	}
+	if err := dataset.CheckColumns(columns, "practice-code", "indicator-code", "measure", "value"); err != nil {
+		return err
+	}
+	type counts struct {
+		numerator   float64
+		denominator float64
+	}
+	byPractice := make(map[GPPracticeCode]map[string]*counts)
+	national := make(map[string]*counts)
+	unknown := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", dataset.Filename, err)
+		}
+		indicator := row[columns[dataset.Column("indicator-code")]]
+		if _, ok := indicators[indicator]; !ok {
+			continue
+		}
+		measure := row[columns[dataset.Column("measure")]]
+		if measure != QOFAchievementNumeratorMeasure && measure != QOFAchievementDenominatorMeasure {
+			continue
+		}
+		value, err := parseFloat(row[columns[dataset.Column("value")]])
+		if err != nil {
+			continue
+		}
+		add := func(m map[string]*counts) {
+			c, ok := m[indicator]
+			if !ok {
+				c = &counts{}
+				m[indicator] = c
+			}
+			if measure == QOFAchievementNumeratorMeasure {
+				c.numerator += value
+			} else {
+				c.denominator += value
+			}
+		}
+		// England's achievement includes every practice reporting, not
+		// only those read into gps
+		add(national)
+		current := successors.Current(GPPracticeCode(row[columns[dataset.Column("practice-code")]]), gps)
+		if _, ok := gps[current]; !ok {
+			unknown++
+			continue
+		}
+		if _, ok := byPractice[current]; !ok {
+			byPractice[current] = make(map[string]*counts)
+		}
+		add(byPractice[current])
+	}
+	for code, achievements := range byPractice {
+		gp := gps[code]
+		gp.IndicatorAchievement = make(map[string]float64)
+		for indicator, c := range achievements {
+			if c.denominator > 0.0 {
+				gp.IndicatorAchievement[indicator] = c.numerator / c.denominator
+			}
+		}
+	}
+	model.national = make(map[string]float64)
+	codes := make([]string, 0, len(indicators))
+	for indicator := range indicators {
+		codes = append(codes, indicator)
+	}
+	sort.Strings(codes)
+	for _, indicator := range codes {
+		c, ok := national[indicator]
+		if !ok || c.denominator <= 0.0 {
+			return fmt.Errorf("%s: no achievement for indicator %s", dataset.Filename, indicator)
+		}
+		model.national[indicator] = c.numerator / c.denominator
+		log.Printf("  %s: %.1f%%", indicator, 100.0*model.national[indicator])
+	}
+	if unknown > 0 {
+		log.Printf("  unknown practices: %d rows", unknown)
+	}
+	return nil
+}
+
+// assignControlled marks each person with a condition of the model as
+// controlled with the probability given by the reported achievement, of
+// the indicator that applies to them, of their practice, or England, if
+// their practice didn't report it, with the number of such people logged.
+func assignControlled(people []Person, gps map[GPPracticeCode]*GPPractice, model *ControlModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for _, condition := range model.ControlledConditions() {
+		eligible, controlled, national := 0, 0, 0
+		for i := range people {
+			p := &people[i]
+			indicator := model.Indicator(p, condition)
+			if indicator == nil {
+				continue
+			}
+			eligible++
+			rate, ok := 0.0, false
+			if gp, found := gps[p.GP]; found {
+				rate, ok = gp.IndicatorAchievement[indicator.Indicator]
+			}
+			if !ok {
+				rate = model.national[indicator.Indicator]
+				national++
+			}
+			if rng.Float64() < rate {
+				p.Controlled.Add(condition)
+				controlled++
+			}
+		}
+		log.Printf("  %s: controlled: %d/%d", condition, controlled, eligible)
+		if national > 0 {
+			Warningf("  %s: %d people's practices didn't report achievement, so England's was used", condition, national)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadControlModel(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"valid", "dm:\n  - indicator: DM036\nhyp:\n  - indicator: HYP008\n    ages: {begin: 0, end: 80}\n", true},
+		{"unknown condition", "xyz:\n  - indicator: DM036\n", false},
+		{"missing code", "dm:\n  - description: HbA1c\n", false},
+		{"repeated code", "dm:\n  - indicator: DM036\nhyp:\n  - indicator: DM036\n", false},
+		{"no indicators", "{}\n", false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "control.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readControlModel(filename)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestControlModelIndicator(t *testing.T) {
+	model, err := readControlModel(filepath.Join("..", "..", "..", "..", "..", "data", "control.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hyp QOFConditions
+	hyp.Add(QOFConditionHypertension)
+	tests := []struct {
+		person   Person
+		expected string
+	}{
+		{Person{Age: 79, Conditions: hyp}, "HYP008"},
+		{Person{Age: 80, Conditions: hyp}, "HYP009"},
+		{Person{Age: 50}, ""},
+	}
+	for _, test := range tests {
+		indicator := model.Indicator(&test.person, QOFConditionHypertension)
+		if (indicator == nil && test.expected != "") || (indicator != nil && indicator.Indicator != test.expected) {
+			t.Errorf("expected %q at %d, found %v", test.expected, test.person.Age, indicator)
+		}
+	}
+}
+
+func TestReadGPPracticeAchievement(t *testing.T) {
+	gps, successors := newMergedPractices()
+	model := &ControlModel{indicators: map[QOFCondition][]*ControlIndicator{QOFConditionDiabetes: {{Indicator: "DM036"}}}}
+	dataset := &Dataset{
+		Filename: filepath.Join(t.TempDir(), "achievement.csv.gz"),
+		Columns: map[string]string{
+			"practice-code":  QOFAchievementPracticeCodeColumn,
+			"indicator-code": QOFAchievementIndicatorCodeColumn,
+			"measure":        QOFAchievementMeasureColumn,
+			"value":          QOFAchievementValueColumn,
+		},
+	}
+	writeGzippedCSV(t, dataset.Filename,
+		"PRACTICE_CODE,INDICATOR_CODE,MEASURE,VALUE",
+		"G1,DM036,NUMERATOR,30",
+		"G1,DM036,DENOMINATOR,60",
+		// Added to G1, its successor
+		"P1,DM036,NUMERATOR,10",
+		"P1,DM036,DENOMINATOR,20",
+		"G2,DM036,NUMERATOR,15",
+		"G2,DM036,DENOMINATOR,20",
+		"G2,DM036,ACHIEVED_POINTS,17",
+		"G2,HYP008,NUMERATOR,1",
+		"G2,HYP008,DENOMINATOR,100",
+		// Practices outside gps still count towards England's
+		"X1,DM036,NUMERATOR,5",
+		"X1,DM036,DENOMINATOR,100",
+	)
+	if err := readGPPracticeAchievement(gps, successors, model, dataset); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code     GPPracticeCode
+		expected float64
+	}{
+		{"G1", 0.5},
+		{"G2", 0.75},
+	}
+	for _, test := range tests {
+		if a := gps[test.code].IndicatorAchievement["DM036"]; math.Abs(a-test.expected) > 1e-9 {
+			t.Errorf("expected %f for %s, found %f", test.expected, test.code, a)
+		}
+	}
+	if _, ok := gps["G2"].IndicatorAchievement["HYP008"]; ok {
+		t.Errorf("expected indicators outside the model to be skipped")
+	}
+	if a := model.national["DM036"]; math.Abs(a-60.0/200.0) > 1e-9 {
+		t.Errorf("expected England's achievement to include X1, found %f", a)
+	}
+
+	missing := &ControlModel{indicators: map[QOFCondition][]*ControlIndicator{QOFConditionCOPD: {{Indicator: "COPD010"}}}}
+	if err := readGPPracticeAchievement(gps, successors, missing, dataset); err == nil {
+		t.Errorf("expected an error for an indicator without achievement")
+	}
+}
+
+func TestAssignControlled(t *testing.T) {
+	var dm QOFConditions
+	dm.Add(QOFConditionDiabetes)
+	people := []Person{
+		{GP: "G1", Conditions: dm},
+		{GP: "G2", Conditions: dm},
+		{GP: "G3", Conditions: dm},
+		{GP: "G1"},
+	}
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", IndicatorAchievement: map[string]float64{"DM036": 1.0}},
+		"G2": {Code: "G2", IndicatorAchievement: map[string]float64{"DM036": 0.0}},
+		// Without reported achievement, so England's is used
+		"G3": {Code: "G3"},
+	}
+	model := &ControlModel{
+		indicators: map[QOFCondition][]*ControlIndicator{QOFConditionDiabetes: {{Indicator: "DM036"}}},
+		national:   map[string]float64{"DM036": 1.0},
+	}
+	assignControlled(people, gps, model)
+	for i, expected := range []bool{true, false, true, false} {
+		if c := people[i].Controlled.Contains(QOFConditionDiabetes); c != expected {
+			t.Errorf("expected %v for person %d, found %v", expected, i, c)
+		}
+	}
+}
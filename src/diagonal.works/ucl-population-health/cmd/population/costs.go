@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Activity is a kind of simulated healthcare activity to which a unit
+// cost is attached.
+type Activity int
+
+const (
+	ActivityGPAppointment Activity = iota
+	// Prescription items issued in primary care
+	ActivityPrescribing
+	ActivityOutpatient
+	ActivityElective
+	ActivityEmergency
+
+	ActivityCount
+	ActivityInvalid Activity = -1
+)
+
+func (a Activity) String() string {
+	switch a {
+	case ActivityGPAppointment:
+		return "gp_appointment"
+	case ActivityPrescribing:
+		return "prescribing"
+	case ActivityOutpatient:
+		return "outpatient"
+	case ActivityElective:
+		return "elective"
+	case ActivityEmergency:
+		return "emergency"
+	}
+	return "invalid"
+}
+
+func ActivityFromString(s string) Activity {
+	for a := Activity(0); a < ActivityCount; a++ {
+		if s == a.String() {
+			return a
+		}
+	}
+	return ActivityInvalid
+}
+
+// CostModel attaches indicative unit costs to simulated activity, for
+// business case modelling. GP appointments are each practice's reported
+// appointments per registered patient, shared between its patients by the
+// relative rates of appointments given their conditions. Prescription
+// items follow from a person's conditions, taken from the dispensing
+// model, so that they match the items pharmacies are expected to dispense.
+// Both can instead be given for particular combinations of conditions.
+// Outpatient attendances are estimated from rates by age, sex, deprivation
+// and condition, like admissions, which come from the admission model.
+type CostModel struct {
+	// The cost of each activity, in pounds, keyed by Activity.String
+	UnitCosts map[string]float64 `yaml:"unitcosts"`
+	// The rate of GP appointments for people with each condition,
+	// relative to those without it
+	Appointments map[string]float64
+	// The dispensing model, in the format of demand.yaml, giving the
+	// prescription items issued per person per year for each condition,
+	// each costed at the unit cost of prescribing. Relative to the
+	// directory of the cost model.
+	Dispensing string
+	// The relative rate of appointments, and prescription items, for
+	// people with particular combinations of conditions, in place of those
+	// combined from each condition, keyed by the conditions, separated by
+	// commas, like dm,hyp. A combination applies to people whose costed
+	// conditions are exactly those given.
+	Combinations map[string]CostCombination
+	// Outpatient attendances per person per year
+	Outpatients AdmissionRates
+
+	unitCosts    [ActivityCount]float64
+	appointments map[QOFCondition]float64
+	prescribing  map[QOFCondition]float64
+	combinations map[QOFConditions]CostCombination
+	// The conditions given a rate, prescribing or a combination
+	costed QOFConditions
+	// The file from which prescribing was read
+	dispensing string
+}
+
+// CostCombination gives the activity of people with a combination of
+// conditions, which isn't necessarily that combined from each condition,
+// as treatment is shared, or complicated, by comorbidity.
+type CostCombination struct {
+	// The rate of GP appointments, relative to those without any of the
+	// costed conditions
+	Appointments float64
+	// Prescription items issued per person per year
+	Prescribing float64
+}
+
+func readCostModel(filename string) (*CostModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cost model: %s", err)
+	}
+	defer f.Close()
+	var model CostModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read cost model: %s", err)
+	}
+	for name, cost := range model.UnitCosts {
+		a := ActivityFromString(name)
+		if a == ActivityInvalid {
+			return nil, fmt.Errorf("unknown activity %q in unit costs", name)
+		} else if cost < 0.0 {
+			return nil, fmt.Errorf("negative unit cost for %s", name)
+		}
+		model.unitCosts[a] = cost
+	}
+	model.appointments = make(map[QOFCondition]float64)
+	for c, r := range model.Appointments {
+		condition := QOFConditionFromString(c)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in appointment rates", c)
+		}
+		model.appointments[condition] = r
+	}
+	model.prescribing = make(map[QOFCondition]float64)
+	if model.Dispensing != "" {
+		dispensing := model.Dispensing
+		if !filepath.IsAbs(dispensing) {
+			dispensing = filepath.Join(filepath.Dir(filename), dispensing)
+		}
+		d, err := readDemandModel(dispensing)
+		if err != nil {
+			return nil, fmt.Errorf("cost model: %s", err)
+		}
+		model.setDispensing(d, dispensing)
+	} else if model.unitCosts[ActivityPrescribing] > 0.0 {
+		return nil, fmt.Errorf("cost model needs a dispensing model to cost prescribing")
+	}
+	model.combinations = make(map[QOFConditions]CostCombination)
+	for c, combination := range model.Combinations {
+		conditions, err := QOFConditionsFromString(c)
+		if err != nil {
+			return nil, fmt.Errorf("combination %q: %s", c, err)
+		} else if combination.Appointments <= 0.0 {
+			return nil, fmt.Errorf("combination %q needs a positive appointment rate", c)
+		} else if combination.Prescribing < 0.0 {
+			return nil, fmt.Errorf("negative prescribing for combination %q", c)
+		}
+		mask := conditionsBitmask(conditions)
+		if _, ok := model.combinations[mask]; ok {
+			return nil, fmt.Errorf("combination %q given more than once", c)
+		}
+		model.combinations[mask] = combination
+	}
+	model.updateCosted()
+	if model.unitCosts[ActivityOutpatient] > 0.0 && len(model.Outpatients.ByAge) == 0 {
+		return nil, fmt.Errorf("cost model needs outpatient rates by age to cost outpatient attendances")
+	}
+	if n := len(model.Outpatients.IMD); n != 0 && n != 10 {
+		return nil, fmt.Errorf("expected 10 outpatient imd multipliers, found %d", n)
+	}
+	for c := range model.Outpatients.Conditions {
+		if QOFConditionFromString(c) == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in outpatient rates", c)
+		}
+	}
+	return &model, nil
+}
+
+// setDispensing takes the prescription items issued to people with each
+// condition from the annual items of dispensing, read from filename.
+func (c *CostModel) setDispensing(dispensing DemandModel, filename string) {
+	c.prescribing = make(map[QOFCondition]float64)
+	for condition, d := range dispensing {
+		c.prescribing[condition] = d.Annual
+	}
+	c.dispensing = filename
+	c.updateCosted()
+}
+
+// updateCosted records the conditions given an appointment rate,
+// prescribing or a combination, among which combinations are matched.
+func (c *CostModel) updateCosted() {
+	c.costed = 0
+	for condition := range c.appointments {
+		c.costed.Add(condition)
+	}
+	for condition := range c.prescribing {
+		c.costed.Add(condition)
+	}
+	for mask := range c.combinations {
+		c.costed |= mask
+	}
+}
+
+// combination returns the activity given for p's combination of costed
+// conditions, if any.
+func (c *CostModel) combination(p *Person) (CostCombination, bool) {
+	combination, ok := c.combinations[p.Conditions&c.costed]
+	return combination, ok
+}
+
+func (c *CostModel) appointmentRate(p *Person) float64 {
+	if combination, ok := c.combination(p); ok {
+		return combination.Appointments
+	}
+	rate := 1.0
+	for condition, r := range c.appointments {
+		if p.Conditions.Contains(condition) {
+			rate *= r
+		}
+	}
+	return rate
+}
+
+// prescriptionItems returns the prescription items issued to p each year
+func (c *CostModel) prescriptionItems(p *Person) float64 {
+	if combination, ok := c.combination(p); ok {
+		return combination.Prescribing
+	}
+	items := 0.0
+	for condition, n := range c.prescribing {
+		if p.Conditions.Contains(condition) {
+			items += n
+		}
+	}
+	return items
+}
+
+// estimateActivity returns the expected activity of each person per year,
+// indexed as people. Admissions are only included if they were simulated.
+func estimateActivity(people []Person, gps map[GPPracticeCode]*GPPractice, lsoas map[LSOACode]*LSOA, model *CostModel, admissions bool) [][ActivityCount]float64 {
+	activity := make([][ActivityCount]float64, len(people))
+	relative := make(map[GPPracticeCode]float64)
+	patients := make(map[GPPracticeCode]int)
+	for i := range people {
+		relative[people[i].GP] += model.appointmentRate(&people[i])
+		patients[people[i].GP]++
+	}
+	var totals [ActivityCount]float64
+	for i := range people {
+		p := &people[i]
+		if gp, ok := gps[p.GP]; ok && gp.ListSize > 0 && relative[p.GP] > 0.0 {
+			perPatient := float64(gp.Appointments*GPAppointmentsMonthsPerYear) / float64(gp.ListSize)
+			// Normalised so that the practice's simulated patients make its
+			// reported appointments per registered patient on average
+			mean := relative[p.GP] / float64(patients[p.GP])
+			activity[i][ActivityGPAppointment] = perPatient * model.appointmentRate(p) / mean
+		}
+		activity[i][ActivityPrescribing] = model.prescriptionItems(p)
+		if len(model.Outpatients.ByAge) > 0 {
+			activity[i][ActivityOutpatient] = model.Outpatients.Rate(p, lsoas)
+		}
+		if admissions {
+			activity[i][ActivityElective] = p.Admissions.Expected[AdmissionElective]
+			activity[i][ActivityEmergency] = p.Admissions.Expected[AdmissionEmergency]
+		}
+		for a := range totals {
+			totals[a] += activity[i][a]
+		}
+	}
+	for a := Activity(0); a < ActivityCount; a++ {
+		log.Printf("  %s: %.0f: £%.0f", a, totals[a], totals[a]*model.unitCosts[a])
+	}
+	return activity
+}
+
+// CostBreakdown totals the expected activity of people in each group of a
+// breakdown, from which its cost follows.
+type CostBreakdown struct {
+	Population AggregatePopulation
+	// The breakdown, one of practice, condition, borough, msoa or
+	// imd_decile
+	Key    string
+	Groups map[string]*[ActivityCount]float64
+}
+
+func (c *CostBreakdown) Add(group string, activity *[ActivityCount]float64) {
+	totals, ok := c.Groups[group]
+	if !ok {
+		totals = &[ActivityCount]float64{}
+		c.Groups[group] = totals
+	}
+	for a := range totals {
+		totals[a] += activity[a]
+	}
+}
+
+// breakdownCosts totals activity for people registered with ICB practices
+// by practice, and by condition, and for people living in the ICB by the
+// borough, MSOA and IMD decile of their home. People with more than one
+// condition are counted under each, so costs by condition aren't additive.
+func breakdownCosts(people []Person, activity [][ActivityCount]float64, selected GPPracticeCodeSet, conditions []QOFCondition, homes LSOASet, lsoas map[LSOACode]*LSOA, boroughs map[LSOACode]*LocalAuthority) []*CostBreakdown {
+	byPractice := &CostBreakdown{Population: AggregatePopulationRegistered, Key: "practice", Groups: make(map[string]*[ActivityCount]float64)}
+	byCondition := &CostBreakdown{Population: AggregatePopulationRegistered, Key: "condition", Groups: make(map[string]*[ActivityCount]float64)}
+	byBorough := &CostBreakdown{Population: AggregatePopulationResident, Key: "borough", Groups: make(map[string]*[ActivityCount]float64)}
+	byMSOA := &CostBreakdown{Population: AggregatePopulationResident, Key: "msoa", Groups: make(map[string]*[ActivityCount]float64)}
+	byIMD := &CostBreakdown{Population: AggregatePopulationResident, Key: "imd_decile", Groups: make(map[string]*[ActivityCount]float64)}
+	for i := range people {
+		p := &people[i]
+		if _, ok := selected[p.GP]; ok {
+			byPractice.Add(p.GP.String(), &activity[i])
+			byCondition.Add("all", &activity[i])
+			for _, c := range conditions {
+				if p.Conditions.Contains(c) {
+					byCondition.Add(c.String(), &activity[i])
+				}
+			}
+		}
+		if _, ok := homes[p.Home]; ok {
+			if borough, ok := boroughs[p.Home]; ok {
+				byBorough.Add(borough.Name, &activity[i])
+			}
+			if lsoa, ok := lsoas[p.Home]; ok {
+				byMSOA.Add(lsoa.MSOACode.String(), &activity[i])
+				if lsoa.IMDDecile > 0 {
+					byIMD.Add(strconv.Itoa(lsoa.IMDDecile), &activity[i])
+				}
+			}
+		}
+	}
+	return []*CostBreakdown{byPractice, byCondition, byBorough, byMSOA, byIMD}
+}
+
+// writeCosts writes costs.csv, with the expected activity per year, and
+// its indicative cost, for each group of each breakdown, in tidy form,
+// with the total cost of all activity in a row of its own.
+func writeCosts(breakdowns []*CostBreakdown, model *CostModel, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "costs.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "population", "breakdown", "value", "activity", "count", "unit_cost", "cost"})
+	for _, b := range breakdowns {
+		groups := make([]string, 0, len(b.Groups))
+		for group := range b.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			total := 0.0
+			for a := Activity(0); a < ActivityCount; a++ {
+				count := b.Groups[group][a]
+				cost := count * model.unitCosts[a]
+				total += cost
+				w.Write([]string{scenario, b.Population.String(), b.Key, group, a.String(), fmt.Sprintf("%f", count), strconv.FormatFloat(model.unitCosts[a], 'f', -1, 64), fmt.Sprintf("%.2f", cost)})
+			}
+			w.Write([]string{scenario, b.Population.String(), b.Key, group, "total", "", "", fmt.Sprintf("%.2f", total)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCostModel(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.WriteFile(filepath.Join(directory, "dispensing.yaml"), []byte("dm:\n  annual: 26\nhyp:\n  annual: 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"relative dispensing", "unitcosts:\n  prescribing: 9\ndispensing: dispensing.yaml\n", true},
+		{"absolute dispensing", "unitcosts:\n  prescribing: 9\ndispensing: " + filepath.Join(directory, "dispensing.yaml") + "\n", true},
+		{"without prescribing", "unitcosts:\n  gp_appointment: 42\n", true},
+		{"missing dispensing", "unitcosts:\n  prescribing: 9\ndispensing: missing.yaml\n", false},
+		{"prescribing without dispensing", "unitcosts:\n  prescribing: 9\n", false},
+		{"unknown activity", "unitcosts:\n  dentist: 9\n", false},
+		{"unknown condition", "appointments:\n  xyz: 1.5\n", false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(directory, "costs.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readCostModel(filename)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestCostModelPrescribingFromDispensing(t *testing.T) {
+	data := filepath.Join("..", "..", "..", "..", "..", "data")
+	model, err := readCostModel(filepath.Join(data, "costs.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispensing, err := readDemandModel(filepath.Join(data, "dispensing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.dispensing != filepath.Join(data, "dispensing.yaml") {
+		t.Errorf("expected prescribing from data/dispensing.yaml, found %s", model.dispensing)
+	}
+	for condition, d := range dispensing {
+		var p Person
+		p.Conditions.Add(condition)
+		if items := model.prescriptionItems(&p); items != d.Annual {
+			t.Errorf("expected %f items for %s, as dispensed, found %f", d.Annual, condition, items)
+		}
+	}
+}
+
+func TestCostModelPrescriptionItems(t *testing.T) {
+	var both Person
+	both.Conditions.Add(QOFConditionDiabetes)
+	both.Conditions.Add(QOFConditionHypertension)
+	var copd Person
+	copd.Conditions.Add(QOFConditionCOPD)
+	var dm Person
+	dm.Conditions.Add(QOFConditionDiabetes)
+
+	model := &CostModel{
+		appointments: map[QOFCondition]float64{QOFConditionDiabetes: 1.8},
+		combinations: map[QOFConditions]CostCombination{
+			conditionsBitmask([]QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}): {Appointments: 2.4, Prescribing: 40.0},
+		},
+	}
+	model.setDispensing(DemandModel{QOFConditionDiabetes: {Annual: 26.0}, QOFConditionHypertension: {Annual: 20.0}}, "dispensing.yaml")
+	tests := []struct {
+		name     string
+		person   *Person
+		expected float64
+	}{
+		{"combination", &both, 40.0},
+		{"single", &dm, 26.0},
+		{"not dispensed", &copd, 0.0},
+	}
+	for _, test := range tests {
+		if items := model.prescriptionItems(test.person); items != test.expected {
+			t.Errorf("%s: expected %f items, found %f", test.name, test.expected, items)
+		}
+	}
+
+	// With another dispensing model, as given by --pharmacies, people with
+	// COPD are costed, so those with it and the combination no longer
+	// match it
+	model.setDispensing(DemandModel{QOFConditionDiabetes: {Annual: 12.0}, QOFConditionCOPD: {Annual: 18.0}}, "pharmacies.yaml")
+	both.Conditions.Add(QOFConditionCOPD)
+	tests = []struct {
+		name     string
+		person   *Person
+		expected float64
+	}{
+		{"outside the combination", &both, 30.0},
+		{"single", &dm, 12.0},
+		{"dispensed", &copd, 18.0},
+	}
+	for _, test := range tests {
+		if items := model.prescriptionItems(test.person); items != test.expected {
+			t.Errorf("%s: expected %f items, found %f", test.name, test.expected, items)
+		}
+	}
+}
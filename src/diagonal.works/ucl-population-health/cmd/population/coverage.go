@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	CoverageAreaEngland = "england"
+	CoverageAreaScope   = "scope"
+)
+
+// PrevalenceRead records the QOF prevalence rows that couldn't be used
+// when reading each condition.
+type PrevalenceRead struct {
+	// Practices whose reported prevalence couldn't be parsed
+	Unparsed map[QOFCondition]GPPracticeCodeSet
+	// The number of rows for practices that aren't in the practice data
+	UnknownPractices map[QOFCondition]int
+}
+
+func newPrevalenceRead() *PrevalenceRead {
+	return &PrevalenceRead{
+		Unparsed:         make(map[QOFCondition]GPPracticeCodeSet),
+		UnknownPractices: make(map[QOFCondition]int),
+	}
+}
+
+// ConditionCoverage counts the practices of an area by how the prevalence
+// of a condition used by the simulation was obtained. Reported, Outliers,
+// Imputed and Missing are exclusive, and sum to Practices.
+type ConditionCoverage struct {
+	Area      string `json:"area"`
+	Condition string `json:"condition"`
+	Practices int    `json:"practices"`
+	// Practices with a usable reported prevalence, used as reported
+	Reported int `json:"reported"`
+	// Practices with a reported prevalence replaced as an outlier
+	Outliers int `json:"outliers"`
+	// Practices without a usable reported prevalence, given that of
+	// nearby practices
+	Imputed int `json:"imputed"`
+	// Practices left without a prevalence
+	Missing int `json:"missing"`
+	// Practices whose reported prevalence couldn't be parsed, which are
+	// also counted as imputed or missing
+	Unparsed int `json:"unparsed"`
+	// Rows of the QOF data for practices that aren't in the practice data,
+	// only counted for England
+	UnknownPractices int `json:"unknown_practices,omitempty"`
+}
+
+// UsableShare returns the share of practices with a usable reported
+// prevalence, whether or not it was replaced as an outlier, or 0 if there
+// are no practices.
+func (c *ConditionCoverage) UsableShare() float64 {
+	if c.Practices == 0 {
+		return 0.0
+	}
+	return float64(c.Reported+c.Outliers) / float64(c.Practices)
+}
+
+// measureCoverage returns the coverage of each condition with a register
+// across practices, once outliers have been adjusted, and missing
+// prevalences imputed.
+func measureCoverage(area string, practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, read *PrevalenceRead, adjustments []PrevalenceAdjustment) []*ConditionCoverage {
+	adjusted := make(map[QOFCondition]GPPracticeCodeSet)
+	for _, a := range adjustments {
+		if _, ok := adjusted[a.Condition]; !ok {
+			adjusted[a.Condition] = make(GPPracticeCodeSet)
+		}
+		adjusted[a.Condition][a.Practice] = struct{}{}
+	}
+	coverage := make([]*ConditionCoverage, 0, len(conditions))
+	for _, condition := range conditions {
+		if !condition.HasRegister() {
+			continue
+		}
+		c := &ConditionCoverage{Area: area, Condition: condition.String()}
+		if area == CoverageAreaEngland {
+			c.UnknownPractices = read.UnknownPractices[condition]
+		}
+		for code := range practices {
+			gp, ok := gps[code]
+			if !ok {
+				continue
+			}
+			c.Practices++
+			if _, ok := read.Unparsed[condition][code]; ok {
+				c.Unparsed++
+			}
+			if reported, ok := gp.ReportedConditionPrevalence[condition]; ok && reported > 0.0 {
+				if _, ok := adjusted[condition][code]; ok {
+					c.Outliers++
+				} else {
+					c.Reported++
+				}
+			} else if gp.ConditionPrevalence[condition] > 0.0 {
+				c.Imputed++
+			} else {
+				c.Missing++
+			}
+		}
+		coverage = append(coverage, c)
+	}
+	return coverage
+}
+
+func logCoverage(coverage []*ConditionCoverage) {
+	log.Printf("prevalence coverage:")
+	for _, c := range coverage {
+		log.Printf("  %s: %s: practices: %d usable: %.02f outliers: %d imputed: %d missing: %d unparsed: %d unknown practices: %d", c.Area, c.Condition, c.Practices, c.UsableShare(), c.Outliers, c.Imputed, c.Missing, c.Unparsed, c.UnknownPractices)
+	}
+}
+
+// writeCoverage writes coverage.csv and coverage.json, the coverage of
+// each condition for England and the scope.
+func writeCoverage(coverage []*ConditionCoverage, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "coverage.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"area", "condition", "practices", "reported", "outliers", "imputed", "missing", "unparsed", "unknown_practices", "usable_share"})
+	for _, c := range coverage {
+		w.Write([]string{c.Area, c.Condition, strconv.Itoa(c.Practices), strconv.Itoa(c.Reported), strconv.Itoa(c.Outliers), strconv.Itoa(c.Imputed), strconv.Itoa(c.Missing), strconv.Itoa(c.Unparsed), strconv.Itoa(c.UnknownPractices), fmt.Sprintf("%f", c.UsableShare())})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return writeJSONOutput(filepath.Join(outputDirectory, "coverage.json"), coverage, true)
+}
+
+// readCoverage reads the coverage.json written to directory, returning
+// nil if it isn't there, as for runs before it was written.
+func readCoverage(directory string) ([]*ConditionCoverage, error) {
+	input, err := os.ReadFile(filepath.Join(directory, "coverage.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var coverage []*ConditionCoverage
+	if err := json.Unmarshal(input, &coverage); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Join(directory, "coverage.json"), err)
+	}
+	return coverage, nil
+}
+
+// serveCoverage answers /coverage, with the coverage of each condition
+// written by the run, optionally filtered by area and condition.
+func (s *ServedPopulation) serveCoverage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServedJSON(w, http.StatusMethodNotAllowed, servedError{Error: "expected GET"})
+		return
+	}
+	if s.Coverage == nil {
+		writeServedJSON(w, http.StatusNotFound, servedError{Error: "no coverage.json for this population"})
+		return
+	}
+	area, condition := r.URL.Query().Get("area"), r.URL.Query().Get("condition")
+	coverage := make([]*ConditionCoverage, 0, len(s.Coverage))
+	for _, c := range s.Coverage {
+		if (area == "" || c.Area == area) && (condition == "" || c.Condition == condition) {
+			coverage = append(coverage, c)
+		}
+	}
+	writeServedJSON(w, http.StatusOK, coverage)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// CrossBorderCount counts the residents of an LSOA by where they're
+// registered: with a practice of the scope, with one outside it, or with
+// none.
+type CrossBorderCount struct {
+	Residents    int
+	Inside       int
+	Outside      int
+	Unregistered int
+}
+
+func (c *CrossBorderCount) add(p *Person, practices GPPracticeCodeSet) {
+	c.Residents++
+	if p.GP == GPPracticeCodeInvalid {
+		c.Unregistered++
+	} else if _, ok := practices[p.GP]; ok {
+		c.Inside++
+	} else {
+		c.Outside++
+	}
+}
+
+// OutsideShare returns the share of registered residents registered with
+// a practice outside the scope, or NaN if none are registered.
+func (c *CrossBorderCount) OutsideShare() float64 {
+	if c.Inside+c.Outside == 0 {
+		return math.NaN()
+	}
+	return float64(c.Outside) / float64(c.Inside+c.Outside)
+}
+
+// CrossBorder summarises registrations across the border of the scope.
+// Residents of the scope registered with practices outside it are absent
+// from practice based outputs, and residents of buffer LSOAs registered
+// with practices of the scope make up part of their lists, so both are
+// reported separately, rather than being attributed to the scope.
+type CrossBorder struct {
+	// Residents of the scope
+	Scope CrossBorderCount
+	// Residents of buffer LSOAs
+	Buffer CrossBorderCount
+	ByLSOA map[LSOACode]*CrossBorderCount
+	// Residents of the scope registered with each practice outside it
+	ByPractice map[GPPracticeCode]int
+	// The share of each LSOA's patients registered outside the scope
+	// published by NHS Digital, if read
+	Observed map[LSOACode]float64
+}
+
+func countCrossBorder(people []Person, homes LSOASet, scope LSOASet, practices GPPracticeCodeSet) *CrossBorder {
+	c := &CrossBorder{
+		ByLSOA:     make(map[LSOACode]*CrossBorderCount),
+		ByPractice: make(map[GPPracticeCode]int),
+	}
+	for home := range homes {
+		c.ByLSOA[home] = &CrossBorderCount{}
+	}
+	for i := range people {
+		p := &people[i]
+		lsoa, ok := c.ByLSOA[p.Home]
+		if !ok {
+			continue
+		}
+		lsoa.add(p, practices)
+		if _, ok := scope[p.Home]; ok {
+			c.Scope.add(p, practices)
+			if _, ok := practices[p.GP]; !ok && p.GP != GPPracticeCodeInvalid {
+				c.ByPractice[p.GP]++
+			}
+		} else {
+			c.Buffer.add(p, practices)
+		}
+	}
+	log.Printf("cross border:")
+	log.Printf("  scope residents: %d registered outside: %d (%.02f%%) with %d practices", c.Scope.Residents, c.Scope.Outside, 100.0*c.Scope.OutsideShare(), len(c.ByPractice))
+	log.Printf("  buffer residents: %d registered inside: %d", c.Buffer.Residents, c.Buffer.Inside)
+	return c
+}
+
+// readObservedCrossBorder returns the share of the patients living in each
+// of homes registered with a practice outside practices, from NHS
+// Digital's patients registered at a GP practice by LSOA.
+func readObservedCrossBorder(dataset *Dataset, homes LSOASet, practices GPPracticeCodeSet, geography *CensusGeography) (map[LSOACode]float64, error) {
+	flows, err := readGPRegistrationFlows(dataset, nil, geography)
+	if err != nil {
+		return nil, err
+	}
+	inside := make(map[LSOACode]float64)
+	total := make(map[LSOACode]float64)
+	for practice, byLSOA := range flows {
+		_, ok := practices[practice]
+		for lsoa, patients := range byLSOA {
+			if _, isHome := homes[lsoa]; !isHome {
+				continue
+			}
+			total[lsoa] += patients
+			if ok {
+				inside[lsoa] += patients
+			}
+		}
+	}
+	observed := make(map[LSOACode]float64)
+	for lsoa, patients := range total {
+		if patients > 0.0 {
+			observed[lsoa] = 1.0 - inside[lsoa]/patients
+		}
+	}
+	log.Printf("  lsoas with observed registrations: %d of %d", len(observed), len(homes))
+	return observed, nil
+}
+
+// calibrateCrossBorder reassigns registered residents of each LSOA in
+// homes between nearby practices inside and outside the scope, so that
+// the share registered outside matches that observed. People moved are
+// chosen at random, and their new practice as usual, from those nearby on
+// the other side of the border. People in care homes aren't moved, and
+// LSOAs without observed registrations, or without nearby practices on
+// one side, are left as they are. It returns the number of people moved
+// inwards and outwards.
+func calibrateCrossBorder(people []Person, homes LSOASet, practices GPPracticeCodeSet, observed map[LSOACode]float64, lsoas map[LSOACode]*LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, rurality *RuralityModel, parameters SimulationParameters) (int, int) {
+	byLSOA := make(map[LSOACode][]*Person)
+	for i := range people {
+		// People in care homes stay with the practice of their home
+		if people[i].GP == GPPracticeCodeInvalid || people[i].CareHome != CareHomeIDInvalid {
+			continue
+		}
+		if _, ok := homes[people[i].Home]; ok {
+			byLSOA[people[i].Home] = append(byLSOA[people[i].Home], &people[i])
+		}
+	}
+	codes := make([]LSOACode, 0, len(byLSOA))
+	for code := range byLSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	inwards, outwards := 0, 0
+	for _, code := range codes {
+		share, ok := observed[code]
+		if !ok {
+			continue
+		}
+		residents := byLSOA[code]
+		outside := make([]*Person, 0)
+		inside := make([]*Person, 0, len(residents))
+		for _, p := range residents {
+			if _, ok := practices[p.GP]; ok {
+				inside = append(inside, p)
+			} else {
+				outside = append(outside, p)
+			}
+		}
+		target := int(math.Round(share * float64(len(residents))))
+		move, toInside := outside, true
+		n := len(outside) - target
+		if n < 0 {
+			move, toInside, n = inside, false, -n
+		}
+		rng.Shuffle(len(move), func(i, j int) { move[i], move[j] = move[j], move[i] })
+		weight := func(gp GPPracticeCode) float64 {
+			if _, ok := practices[gp]; ok == toInside {
+				return 1.0
+			}
+			return 0.0
+		}
+		assignment := rurality.Parameters(lsoas[code], parameters)
+		for _, p := range move[0:n] {
+			gp := chooseNearbyGP(nearbyGPs[code], gps, assignment, weight, rng)
+			if gp == GPPracticeCodeInvalid || weight(gp) == 0.0 {
+				// No practices nearby on the other side of the border
+				break
+			}
+			gps[p.GP].SimulatedListSize--
+			gps[gp].SimulatedListSize++
+			p.GP = gp
+			if toInside {
+				inwards++
+			} else {
+				outwards++
+			}
+		}
+	}
+	log.Printf("  moved inside: %d outside: %d", inwards, outwards)
+	return inwards, outwards
+}
+
+// WriteLSOACSV writes cross-border-lsoa.csv, with a row for every home
+// LSOA, counting its residents by whether they're registered inside the
+// scope.
+func (c *CrossBorder) WriteLSOACSV(scope LSOASet, lsoas map[LSOACode]*LSOA, outputDirectory string) error {
+	codes := make([]LSOACode, 0, len(c.ByLSOA))
+	for code := range c.ByLSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	share := func(s float64) string {
+		if math.IsNaN(s) {
+			return ""
+		}
+		return fmt.Sprintf("%f", s)
+	}
+
+	f, err := createOutput(filepath.Join(outputDirectory, "cross-border-lsoa.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"lsoa", "name", "in_scope", "residents", "registered_inside", "registered_outside", "unregistered", "outside_share", "observed_outside_share"})
+	for _, code := range codes {
+		count := c.ByLSOA[code]
+		_, inScope := scope[code]
+		observed := math.NaN()
+		if o, ok := c.Observed[code]; ok {
+			observed = o
+		}
+		w.Write([]string{code.String(), lsoas[code].Name, presentToString(inScope), strconv.Itoa(count.Residents), strconv.Itoa(count.Inside), strconv.Itoa(count.Outside), strconv.Itoa(count.Unregistered), share(count.OutsideShare()), share(observed)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WritePracticesCSV writes cross-border-practices.csv, with a row for
+// every practice outside the scope with which its residents are
+// registered.
+func (c *CrossBorder) WritePracticesCSV(gps map[GPPracticeCode]*GPPractice, outputDirectory string) error {
+	practices := make([]GPPracticeCode, 0, len(c.ByPractice))
+	for code := range c.ByPractice {
+		practices = append(practices, code)
+	}
+	sort.Slice(practices, func(i, j int) bool {
+		if c.ByPractice[practices[i]] != c.ByPractice[practices[j]] {
+			return c.ByPractice[practices[i]] > c.ByPractice[practices[j]]
+		}
+		return practices[i] < practices[j]
+	})
+	f, err := createOutput(filepath.Join(outputDirectory, "cross-border-practices.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "icb", "scope_residents", "simulated_list_size", "list_size"})
+	for _, code := range practices {
+		gp := gps[code]
+		w.Write([]string{code.String(), gp.Name, gp.ICB.String(), strconv.Itoa(c.ByPractice[code]), strconv.Itoa(gp.SimulatedListSize), strconv.Itoa(gp.ListSize)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
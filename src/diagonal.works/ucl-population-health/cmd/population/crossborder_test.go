@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCountCrossBorder(t *testing.T) {
+	scope := LSOASet{"E01000001": struct{}{}}
+	homes := LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}}
+	practices := GPPracticeCodeSet{"G1": struct{}{}}
+	people := []Person{
+		{Home: "E01000001", GP: "G1"},
+		{Home: "E01000001", GP: "G2"},
+		{Home: "E01000001", GP: "G2"},
+		{Home: "E01000001", GP: GPPracticeCodeInvalid},
+		{Home: "E01000002", GP: "G1"},
+		{Home: "E01000002", GP: "G2"},
+		// Outside homes
+		{Home: "E01000003", GP: "G1"},
+	}
+	c := countCrossBorder(people, homes, scope, practices)
+	tests := []struct {
+		name     string
+		count    CrossBorderCount
+		expected CrossBorderCount
+	}{
+		{"scope", c.Scope, CrossBorderCount{Residents: 4, Inside: 1, Outside: 2, Unregistered: 1}},
+		{"buffer", c.Buffer, CrossBorderCount{Residents: 2, Inside: 1, Outside: 1}},
+		{"E01000001", *c.ByLSOA["E01000001"], CrossBorderCount{Residents: 4, Inside: 1, Outside: 2, Unregistered: 1}},
+	}
+	for _, test := range tests {
+		if test.count != test.expected {
+			t.Errorf("%s: expected %+v, found %+v", test.name, test.expected, test.count)
+		}
+	}
+	if len(c.ByPractice) != 1 || c.ByPractice["G2"] != 2 {
+		t.Errorf("expected 2 residents of the scope registered with G2, found %v", c.ByPractice)
+	}
+	if share := c.Scope.OutsideShare(); math.Abs(share-2.0/3.0) > 1e-9 {
+		t.Errorf("expected an outside share of 2/3, found %f", share)
+	}
+	if !math.IsNaN((&CrossBorderCount{Residents: 1, Unregistered: 1}).OutsideShare()) {
+		t.Errorf("expected NaN without registered residents")
+	}
+}
+
+func TestCalibrateCrossBorder(t *testing.T) {
+	lsoas := map[LSOACode]*LSOA{
+		"E01000001": newUniformLSOA("E01000001", 1),
+		"E01000002": newUniformLSOA("E01000002", 1),
+		"E01000003": newUniformLSOA("E01000003", 1),
+	}
+	homes := LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}, "E01000003": struct{}{}}
+	practices := GPPracticeCodeSet{"G1": struct{}{}}
+	nearby := []NearbyGP{{Practice: "G1", DistanceM: 100.0, TravelMinutes: math.NaN()}, {Practice: "G2", DistanceM: 100.0, TravelMinutes: math.NaN()}}
+	nearbyGPs := NearbyGPs{"E01000001": nearby, "E01000002": nearby, "E01000003": nearby[0:1]}
+	tests := []struct {
+		name     string
+		home     LSOACode
+		observed float64
+		// Expected residents registered outside, of 10
+		expected int
+		inwards  int
+		outwards int
+	}{
+		{"outwards", "E01000001", 0.3, 3, 0, 3},
+		{"already matching", "E01000002", 0.0, 0, 0, 0},
+		// No nearby practices outside the scope
+		{"none nearby", "E01000003", 0.5, 0, 0, 0},
+	}
+	for _, test := range tests {
+		gps := map[GPPracticeCode]*GPPractice{
+			"G1": {Code: "G1", ListSize: 1000},
+			"G2": {Code: "G2", ListSize: 1000},
+		}
+		people := make([]Person, 0, 12)
+		for i := 0; i < 10; i++ {
+			people = append(people, Person{Home: test.home, GP: "G1", CareHome: CareHomeIDInvalid})
+		}
+		// People in care homes, and those unregistered, aren't moved
+		people = append(people, Person{Home: test.home, GP: "G1", CareHome: "C1"})
+		people = append(people, Person{Home: test.home, GP: GPPracticeCodeInvalid, CareHome: CareHomeIDInvalid})
+		gps["G1"].SimulatedListSize = 11
+		inwards, outwards := calibrateCrossBorder(people, homes, practices, map[LSOACode]float64{test.home: test.observed}, lsoas, nearbyGPs, gps, nil, DefaultSimulationParameters())
+		if inwards != test.inwards || outwards != test.outwards {
+			t.Errorf("%s: expected %d inwards and %d outwards, found %d and %d", test.name, test.inwards, test.outwards, inwards, outwards)
+		}
+		outside := 0
+		for _, p := range people[0:10] {
+			if p.GP == "G2" {
+				outside++
+			}
+		}
+		if outside != test.expected {
+			t.Errorf("%s: expected %d registered outside, found %d", test.name, test.expected, outside)
+		}
+		if people[10].GP != "G1" || people[11].GP != GPPracticeCodeInvalid {
+			t.Errorf("%s: expected care home residents and unregistered people to stay", test.name)
+		}
+		if gps["G1"].SimulatedListSize != 11-test.outwards || gps["G2"].SimulatedListSize != test.outwards {
+			t.Errorf("%s: expected list sizes to follow those moved, found %d and %d", test.name, gps["G1"].SimulatedListSize, gps["G2"].SimulatedListSize)
+		}
+	}
+
+	// Moving inwards, from practices outside the scope
+	gps := map[GPPracticeCode]*GPPractice{"G1": {Code: "G1", ListSize: 1000}, "G2": {Code: "G2", ListSize: 1000, SimulatedListSize: 10}}
+	people := make([]Person, 10)
+	for i := range people {
+		people[i] = Person{Home: "E01000002", GP: "G2", CareHome: CareHomeIDInvalid}
+	}
+	if inwards, outwards := calibrateCrossBorder(people, homes, practices, map[LSOACode]float64{"E01000002": 0.6}, lsoas, nearbyGPs, gps, nil, DefaultSimulationParameters()); inwards != 4 || outwards != 0 {
+		t.Errorf("expected 4 moved inwards, found %d inwards and %d outwards", inwards, outwards)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DatasetLSOAICB                 = "lsoa-icb"
+	DatasetLSOAPersons             = "lsoa-persons"
+	DatasetLSOAMales               = "lsoa-males"
+	DatasetLSOAFemales             = "lsoa-females"
+	DatasetLSOA21Persons           = "lsoa21-persons"
+	DatasetLSOA21Males             = "lsoa21-males"
+	DatasetLSOA21Females           = "lsoa21-females"
+	DatasetLSOAMSOA                = "lsoa-msoa"
+	DatasetLSOAIMD                 = "imd"
+	DatasetLSOARuralUrban          = "lsoa-rural-urban"
+	DatasetLSOAEthnicity           = "lsoa-ethnicity"
+	DatasetLSOA11To21              = "lsoa11-lsoa21"
+	DatasetGPPractices             = "gp-practices"
+	DatasetGPPractioners           = "gp-practioners"
+	DatasetGPPracticeSuccessors    = "gp-practice-successors"
+	DatasetONSPD                   = "onspd"
+	DatasetGeocodes                = "geocodes"
+	DatasetGPAppointments          = "gp-appointments"
+	DatasetQOFListSizes            = "qof-list-sizes"
+	DatasetTrustSites              = "trust-sites"
+	DatasetEstates                 = "estates"
+	DatasetICBBoundaries           = "icb-boundaries"
+	DatasetGPRegistrationsLSOA     = "gp-registrations-lsoa"
+	DatasetGPRegistrationsMales    = "gp-registrations-males"
+	DatasetGPRegistrationsFemales  = "gp-registrations-females"
+	DatasetCareHomes               = "care-homes"
+	DatasetPharmacies              = "pharmacies"
+	DatasetGPPracticePCNs          = "gp-practice-pcns"
+	DatasetPopulationEstimates     = "population-estimates"
+	DatasetLSOAPopulationEstimates = "lsoa-population-estimates"
+	DatasetDWPUniversalCredit      = "dwp-universal-credit"
+	DatasetDWPPIP                  = "dwp-pip"
+	DatasetDWPAttendanceAllowance  = "dwp-attendance-allowance"
+	DatasetLSOAEconomicActivity    = "lsoa-economic-activity"
+	DatasetLSOAOccupation          = "lsoa-occupation"
+	DatasetQOFAchievement          = "qof-achievement"
+
+	// QOF condition datasets are named qof/<condition>, eg qof/dm
+	DatasetQOFConditionPrefix = "qof/"
+)
+
+// Dataset maps the logical columns used by a reader onto the column
+// headers of a file. For files without headers, columns are zero based
+// indices.
+type Dataset struct {
+	Filename string
+	Columns  map[string]string `yaml:",omitempty"`
+
+	// Where what's read from the file is counted, if anywhere
+	reads *DatasetReads
+}
+
+// Column returns the header of the named column. Column names are given
+// by readers, and those in a manifest are checked by readDataManifest, so
+// an unknown name is a programming error.
+func (d *Dataset) Column(name string) string {
+	if c, ok := d.Columns[name]; ok {
+		return c
+	}
+	panic(fmt.Sprintf("no column %q for %s", name, d.Filename))
+}
+
+// Index returns the index of the named column, for files without headers.
+// Indices in a manifest are checked by readDataManifest.
+func (d *Dataset) Index(name string) int {
+	i, err := strconv.Atoi(d.Column(name))
+	if err != nil {
+		panic(fmt.Sprintf("column %q for %s isn't an index", name, d.Filename))
+	}
+	return i
+}
+
+// CheckColumns returns an error if the header of any of the named columns
+// is missing from columns, which maps the headers of the file to their
+// index.
+func (d *Dataset) CheckColumns(columns map[string]int, names ...string) error {
+	for _, name := range names {
+		if _, ok := columns[d.Column(name)]; !ok {
+			return fmt.Errorf("%s: no %s column", d.Filename, d.Column(name))
+		}
+	}
+	return nil
+}
+
+// CheckIndices returns an error if row, from a file without headers, is
+// too short to include any of the named columns.
+func (d *Dataset) CheckIndices(row []string, names ...string) error {
+	for _, name := range names {
+		if i := d.Index(name); i >= len(row) {
+			return fmt.Errorf("%s: no column %d for %s, in a row of %d", d.Filename, i, name, len(row))
+		}
+	}
+	return nil
+}
+
+// DataManifest maps logical datasets onto files, allowing updated
+// releases with different filenames or headers to be used without code
+// changes.
+type DataManifest map[string]*Dataset
+
+func byAgeDataset(filename string) *Dataset {
+	return &Dataset{
+		Filename: filename,
+		Columns: map[string]string{
+			"lsoa-code":   LSOADataLSOACodeColumn,
+			"lsoa-name":   LSOADataLSOANameColumn,
+			"all-ages":    LSOADataAllAgesColumn,
+			"ninety-plus": LSOADataNinetyPlusColumn,
+		},
+	}
+}
+
+func registrationsByAgeDataset(filename string) *Dataset {
+	return &Dataset{
+		Filename: filename,
+		Columns: map[string]string{
+			"practice-code": GPRegistrationsAgePracticeCodeColumn,
+			"age":           GPRegistrationsAgeAgeColumn,
+			"patients":      GPRegistrationsAgePatientsColumn,
+		},
+	}
+}
+
+func qofDataset(filename string) *Dataset {
+	return &Dataset{
+		Filename: filename,
+		Columns: map[string]string{
+			"practice-code": GPQOFDataPracticeCodeColumn,
+			"list-size":     GPQOFDataListSizeColumn,
+			"prevalence":    GPQOFDataPrevalenceColumn,
+		},
+	}
+}
+
+func DefaultDataManifest() DataManifest {
+	return DataManifest{
+		DatasetLSOAICB: {
+			Filename: "data/lsoa-icb.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": ICBDataLSOACodeColumn,
+				"icb-code":  ICBDataICBCodeColumn,
+				"icb-name":  ICBDataICBNameColumn,
+				"lad-code":  ICBDataLADCodeColumn,
+				"lad-name":  ICBDataLADNameColumn,
+			},
+		},
+		DatasetLSOAPersons:   byAgeDataset("data/lsoa-persons.csv.gz"),
+		DatasetLSOAMales:     byAgeDataset("data/lsoa-males.csv.gz"),
+		DatasetLSOAFemales:   byAgeDataset("data/lsoa-females.csv.gz"),
+		DatasetLSOA21Persons: byAgeDataset("data/lsoa21-persons.csv.gz"),
+		DatasetLSOA21Males:   byAgeDataset("data/lsoa21-males.csv.gz"),
+		DatasetLSOA21Females: byAgeDataset("data/lsoa21-females.csv.gz"),
+		DatasetLSOAMSOA: {
+			Filename: "data/lsoa-msoa.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": LSOAToMSOALSOACodeColumn,
+				"msoa-code": LSOAToMSOAMSOACodeColumn,
+				"msoa-name": LSOAToMSOAMSOANameColumn,
+			},
+		},
+		DatasetLSOAIMD: {
+			Filename: "data/lsoa-imd.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": IMDLSOACodeColumn,
+				"score":     IMDLSOAScoreColumn,
+				"decile":    IMDLSOADecileColumn,
+			},
+		},
+		DatasetLSOARuralUrban: {
+			Filename: "data/lsoa-rural-urban.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code":  RuralUrbanLSOACodeColumn,
+				"class-code": RuralUrbanClassCodeColumn,
+			},
+		},
+		DatasetLSOAEthnicity: {
+			Filename: "data/lsoa-ethnicity.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": EthnicityLSOACodeColumn,
+				"all":       EthnicityAllColumn,
+				"white":     EthnicityWhiteColumn,
+				"mixed":     EthnicityMixedColumn,
+				"asian":     EthnicityAsianColumn,
+				"black":     EthnicityBlackColumn,
+				"other":     EthnicityOtherColumn,
+			},
+		},
+		DatasetLSOA11To21: {
+			Filename: "data/lsoa11-lsoa21.csv.gz",
+			Columns: map[string]string{
+				"lsoa11-code": LSOA11To21LSOA11CodeColumn,
+				"lsoa21-code": LSOA11To21LSOA21CodeColumn,
+			},
+		},
+		DatasetGPPractices: {
+			Filename: "data/gp-practices.csv.gz",
+			Columns: map[string]string{
+				"code":     strconv.Itoa(GPPracticeDataCodeColumn),
+				"name":     strconv.Itoa(GPPracticeDataNameColumn),
+				"icb-code": strconv.Itoa(GPPracticeDataICBCodeColumn),
+				"postcode": strconv.Itoa(GPPracticeDataPostcodeColumn),
+				"status":   strconv.Itoa(GPPracticeDataStatusColumn),
+			},
+		},
+		DatasetGPPractioners: {
+			Filename: "data/gp-practioners.csv.gz",
+			Columns: map[string]string{
+				"practice-code": strconv.Itoa(GPPractionerDataPracticeCodeColumn),
+			},
+		},
+		DatasetGPPracticeSuccessors: {
+			Filename: "data/succ.csv.gz",
+			Columns: map[string]string{
+				"predecessor-code": strconv.Itoa(GPPracticeSuccessorsPredecessorCodeColumn),
+				"successor-code":   strconv.Itoa(GPPracticeSuccessorsSuccessorCodeColumn),
+				"effective-date":   strconv.Itoa(GPPracticeSuccessorsEffectiveDateColumn),
+			},
+		},
+		DatasetONSPD: {
+			Filename: "data/onspd.csv.gz",
+			Columns: map[string]string{
+				"postcode": ONSPDPostcodeColumn,
+				"lat":      ONSPDLatColumn,
+				"lng":      ONSPDLngColumn,
+			},
+		},
+		DatasetGeocodes: {
+			Filename: "data/geocodes.csv",
+			Columns: map[string]string{
+				"postcode": "postcode",
+				"lat":      "lat",
+				"lng":      "lng",
+			},
+		},
+		DatasetGPAppointments: {
+			Filename: "data/gp-practices-appointments-03-2023.csv.gz",
+			Columns: map[string]string{
+				"practice-code":     GPAppointmentsCodeColumn,
+				"hcp-type":          GPAppointmentsHcpTypeColumn,
+				"mode":              GPAppointmentsModeColumn,
+				"status":            GPAppointmentsStatusColumn,
+				"national-category": GPAppointmentsNationalCategory,
+				"count":             GPAppointmentsCountColumn,
+			},
+		},
+		DatasetQOFListSizes: qofDataset("data/qof-condition/af.csv.gz"),
+		DatasetTrustSites: {
+			Filename: "data/ets.csv.gz",
+			Columns: map[string]string{
+				"code":        strconv.Itoa(TrustSiteCodeColumn),
+				"name":        strconv.Itoa(TrustSiteNameColumn),
+				"address-one": strconv.Itoa(TrustSiteAddressOneColumn),
+				"postcode":    strconv.Itoa(TrustSitePostcodeColumn),
+			},
+		},
+		DatasetEstates: {
+			Filename: "data/eric.csv.gz",
+			Columns: map[string]string{
+				"site-code":                 EstatesSiteCodeColumn,
+				"site-type":                 EstatesSiteTypeColumn,
+				"floor-area":                EstatesFloorAreaColumn,
+				"en-suite-bedrooms":         EstatesEnSuiteBedroomsColumn,
+				"without-en-suite-bedrooms": EstatesWithoutEnSuiteBedroomsColumn,
+				// Not in ERIC, but can be mapped by a data manifest for
+				// estates data that includes them
+				"beds":     "",
+				"theatres": "",
+			},
+		},
+		DatasetGPRegistrationsLSOA: {
+			Filename: "data/gp-reg-pat-prac-lsoa-all.csv.gz",
+			Columns: map[string]string{
+				"practice-code": GPRegistrationsPracticeCodeColumn,
+				"lsoa-code":     GPRegistrationsLSOACodeColumn,
+				"patients":      GPRegistrationsPatientsColumn,
+			},
+		},
+		DatasetGPRegistrationsMales:   registrationsByAgeDataset("data/gp-reg-pat-prac-sing-age-male.csv.gz"),
+		DatasetGPRegistrationsFemales: registrationsByAgeDataset("data/gp-reg-pat-prac-sing-age-female.csv.gz"),
+		DatasetCareHomes: {
+			Filename: "data/care-homes.csv.gz",
+			Columns: map[string]string{
+				"id":        CareHomeIDColumn,
+				"name":      CareHomeNameColumn,
+				"care-home": CareHomeCareHomeColumn,
+				"beds":      CareHomeBedsColumn,
+				"postcode":  CareHomePostcodeColumn,
+			},
+		},
+		DatasetPharmacies: {
+			Filename: "data/pharmacies.csv.gz",
+			Columns: map[string]string{
+				"code":     PharmacyCodeColumn,
+				"name":     PharmacyNameColumn,
+				"postcode": PharmacyPostcodeColumn,
+			},
+		},
+		DatasetGPPracticePCNs: {
+			Filename: "data/epcn.csv.gz",
+			Columns: map[string]string{
+				"practice-code": PracticePCNPracticeCodeColumn,
+				"pcn-code":      PracticePCNPCNCodeColumn,
+				"pcn-name":      PracticePCNPCNNameColumn,
+				"end-date":      PracticePCNEndDateColumn,
+			},
+		},
+		DatasetPopulationEstimates: {
+			Filename: "data/myeb1.csv.gz",
+			Columns: map[string]string{
+				"lad-code":          PopulationEstimatesLADCodeColumn,
+				"sex":               PopulationEstimatesSexColumn,
+				"age":               PopulationEstimatesAgeColumn,
+				"population-prefix": PopulationEstimatesPopulationPrefix,
+			},
+		},
+		DatasetLSOAPopulationEstimates: {
+			Filename: "data/lsoa-population-estimates.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": LSOAPopulationEstimatesLSOACodeColumn,
+				"total":     LSOAPopulationEstimatesTotalColumn,
+			},
+		},
+		DatasetDWPUniversalCredit: {
+			Filename: "data/dwp-universal-credit.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": BenefitsLSOACodeColumn,
+				"claimants": BenefitsClaimantsColumn,
+			},
+		},
+		DatasetDWPPIP: {
+			Filename: "data/dwp-pip.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": BenefitsLSOACodeColumn,
+				"claimants": BenefitsClaimantsColumn,
+			},
+		},
+		DatasetDWPAttendanceAllowance: {
+			Filename: "data/dwp-attendance-allowance.csv.gz",
+			Columns: map[string]string{
+				"lsoa-code": BenefitsLSOACodeColumn,
+				"claimants": BenefitsClaimantsColumn,
+			},
+		},
+		DatasetLSOAEconomicActivity: employmentDataset("data/lsoa-economic-activity.csv.gz", economicActivityCategories()),
+		DatasetLSOAOccupation:       employmentDataset("data/lsoa-occupation.csv.gz", occupationCategories()),
+		DatasetQOFAchievement: {
+			Filename: "data/qof-achievement.csv.gz",
+			Columns: map[string]string{
+				"practice-code":  QOFAchievementPracticeCodeColumn,
+				"indicator-code": QOFAchievementIndicatorCodeColumn,
+				"measure":        QOFAchievementMeasureColumn,
+				"value":          QOFAchievementValueColumn,
+			},
+		},
+		DatasetICBBoundaries: {
+			Filename: "data/icb-boundaries.zip",
+			Columns: map[string]string{
+				"code": "ICB22CD",
+				"name": "ICB22NM",
+			},
+		},
+	}
+}
+
+// Get returns the named dataset. QOF condition datasets default to
+// data/qof-condition/<condition>.csv.gz, if not otherwise specified.
+func (d DataManifest) Get(name string) *Dataset {
+	if dataset, ok := d[name]; ok {
+		return dataset
+	}
+	if strings.HasPrefix(name, DatasetQOFConditionPrefix) {
+		condition := strings.TrimPrefix(name, DatasetQOFConditionPrefix)
+		return qofDataset(fmt.Sprintf("data/qof-condition/%s.csv.gz", condition))
+	}
+	panic(fmt.Sprintf("no dataset %q", name))
+}
+
+// WithReads returns a copy of the manifest whose datasets, including the
+// default QOF datasets of every condition, count what's read from them in
+// reads.
+func (d DataManifest) WithReads(reads *DatasetReads) DataManifest {
+	counted := make(DataManifest, len(d))
+	for name, dataset := range d {
+		c := *dataset
+		c.reads = reads
+		counted[name] = &c
+	}
+	for _, condition := range AllQOFConditions() {
+		name := QOFConditionDataset(condition)
+		if _, ok := counted[name]; !ok {
+			dataset := d.Get(name)
+			dataset.reads = reads
+			counted[name] = dataset
+		}
+	}
+	return counted
+}
+
+// datasetReader reads the records of the CSV file of a dataset, counting
+// them for the metrics of the run when it's closed.
+type datasetReader struct {
+	*csv.Reader
+	dataset *Dataset
+	f       io.Closer
+	rows    int
+}
+
+// openDataset returns a reader of the file of dataset, decompressed if
+// it's gzipped.
+func openDataset(dataset *Dataset) (*datasetReader, error) {
+	f, err := openMaybeGzipped(dataset.Filename)
+	if err != nil {
+		return nil, err
+	}
+	return &datasetReader{Reader: csv.NewReader(f), dataset: dataset, f: f}, nil
+}
+
+func (r *datasetReader) Read() ([]string, error) {
+	row, err := r.Reader.Read()
+	if err == nil {
+		r.rows++
+	}
+	return row, err
+}
+
+func (r *datasetReader) Close() error {
+	countDatasetRows(r.dataset, r.rows)
+	return r.f.Close()
+}
+
+func QOFConditionDataset(condition QOFCondition) string {
+	return DatasetQOFConditionPrefix + condition.String()
+}
+
+// readDataManifest returns the default manifest, overridden by the
+// datasets in the given YAML file, if not empty. Columns not specified
+// in the file retain their defaults.
+func readDataManifest(filename string) (DataManifest, error) {
+	manifest := DefaultDataManifest()
+	if filename == "" {
+		return manifest, nil
+	}
+	composed, err := readComposedYAML(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data manifest: %s", err)
+	}
+	overrides := make(map[string]*Dataset)
+	if err := composed.Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("failed to read data manifest: %s", err)
+	}
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		override := overrides[name]
+		var dataset *Dataset
+		if strings.HasPrefix(name, DatasetQOFConditionPrefix) {
+			condition := strings.TrimPrefix(name, DatasetQOFConditionPrefix)
+			if QOFConditionFromString(condition) == QOFConditionInvalid {
+				return nil, fmt.Errorf("data manifest: unknown condition %q", condition)
+			}
+			dataset = manifest.Get(name)
+		} else if d, ok := manifest[name]; ok {
+			dataset = d
+		} else {
+			return nil, fmt.Errorf("data manifest: unknown dataset %q", name)
+		}
+		if override.Filename != "" {
+			dataset.Filename = override.Filename
+		}
+		for column, header := range override.Columns {
+			existing, ok := dataset.Columns[column]
+			if !ok {
+				return nil, fmt.Errorf("data manifest: unknown column %q for %s", column, name)
+			}
+			if header == "" {
+				return nil, fmt.Errorf("data manifest: empty header for column %q of %s", column, name)
+			}
+			if _, err := strconv.Atoi(existing); err == nil {
+				if i, err := strconv.Atoi(header); err != nil || i < 0 {
+					return nil, fmt.Errorf("data manifest: column %q of %s is read from a file without headers, so needs an index, found %q", column, name, header)
+				}
+			}
+			dataset.Columns[column] = header
+		}
+		manifest[name] = dataset
+	}
+	if err := fetchRemoteDatasets(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
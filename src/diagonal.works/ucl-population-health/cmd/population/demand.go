@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"gopkg.in/yaml.v3"
+)
+
+// The default width and height of the cells of demand surfaces
+const DefaultDemandCellMeters = 500.0
+
+// ConditionDemand is the primary care activity needed each year by a
+// person with a condition
+type ConditionDemand struct {
+	Description string  `yaml:"description"`
+	Annual      float64 `yaml:"annual"`
+}
+
+// DemandModel gives the activity needed for each condition, keyed by
+// condition
+type DemandModel map[QOFCondition]ConditionDemand
+
+func readDemandModel(filename string) (DemandModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open demand: %s", err)
+	}
+	defer f.Close()
+	var y map[string]ConditionDemand
+	if err := yaml.NewDecoder(f).Decode(&y); err != nil {
+		return nil, fmt.Errorf("failed to read demand: %s", err)
+	}
+	model := make(DemandModel)
+	for name, demand := range y {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in demand", name)
+		}
+		if demand.Annual < 0.0 {
+			return nil, fmt.Errorf("negative annual demand for %s", name)
+		}
+		model[condition] = demand
+	}
+	return model, nil
+}
+
+// Conditions returns those of conditions with modelled demand
+func (d DemandModel) Conditions(conditions []QOFCondition) []QOFCondition {
+	modelled := make([]QOFCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		if _, ok := d[condition]; ok {
+			modelled = append(modelled, condition)
+		}
+	}
+	return modelled
+}
+
+// demandCells returns the cells of the raster whose centres lie within
+// the LSOA's boundary, or the cell containing the centre of the LSOA, for
+// LSOAs smaller than a cell, or without a boundary.
+func demandCells(r *Raster, code LSOACode, lsoa *LSOA, year int, w b6.World) ([]int, bool) {
+	cells := make([]int, 0)
+	area := findLSOABoundary(code, year, w)
+	if area != nil {
+		for i := 0; i < area.Len(); i++ {
+			polygon := area.Polygon(i)
+			bound := polygon.RectBound()
+			x0, y0, _ := r.Cell(bound.Lo().Lng.Degrees(), bound.Hi().Lat.Degrees())
+			x1, y1, _ := r.Cell(bound.Hi().Lng.Degrees(), bound.Lo().Lat.Degrees())
+			for y := y0; y <= y1; y++ {
+				for x := x0; x <= x1; x++ {
+					if x < 0 || x >= r.Width || y < 0 || y >= r.Height {
+						continue
+					}
+					lng, lat := r.CellCenter(x, y)
+					if polygon.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))) {
+						cells = append(cells, y*r.Width+x)
+					}
+				}
+			}
+		}
+	}
+	if len(cells) == 0 {
+		ll := s2.LatLngFromPoint(lsoa.Center)
+		if x, y, ok := r.Cell(ll.Lng.Degrees(), ll.Lat.Degrees()); ok {
+			cells = append(cells, y*r.Width+x)
+		}
+	}
+	return cells, area != nil
+}
+
+// writeDemandSurfaces writes demand-<condition>.tif for each condition in
+// the model, with the annual activity needed by people living in homes
+// per km², on a grid of cells of the given size. People don't have
+// locations within their home LSOA, so the demand from each LSOA is
+// spread evenly across the cells within its boundary.
+func writeDemandSurfaces(people []Person, homes LSOASet, conditions []QOFCondition, model DemandModel, lsoas map[LSOACode]*LSOA, geography *CensusGeography, cellMeters float64, provenance *Provenance, w b6.World, outputDirectory string) error {
+	modelled := model.Conditions(conditions)
+	if len(modelled) == 0 {
+		return nil
+	}
+	demand := make(map[LSOACode][]float64)
+	bounds := s2.EmptyRect()
+	for home := range homes {
+		demand[home] = make([]float64, len(modelled))
+		bounds = bounds.AddPoint(s2.LatLngFromPoint(lsoas[home].Center))
+		if area := findLSOABoundary(home, geography.Year, w); area != nil {
+			for i := 0; i < area.Len(); i++ {
+				bounds = bounds.Union(area.Polygon(i).RectBound())
+			}
+		}
+	}
+	for i := range people {
+		if d, ok := demand[people[i].Home]; ok {
+			for j, condition := range modelled {
+				if people[i].Conditions.Contains(condition) {
+					d[j] += model[condition].Annual
+				}
+			}
+		}
+	}
+	if bounds.IsEmpty() {
+		return fmt.Errorf("no homes from which to build demand surfaces")
+	}
+
+	cellLat := b6.MetersToAngle(cellMeters).Degrees()
+	cellLng := cellLat / math.Cos(bounds.Center().Lat.Radians())
+	width := int(math.Ceil(bounds.Size().Lng.Degrees()/cellLng)) + 1
+	height := int(math.Ceil(bounds.Size().Lat.Degrees()/cellLat)) + 1
+	rasters := make([]*Raster, len(modelled))
+	for i := range modelled {
+		rasters[i] = NewRaster(width, height, bounds.Lo().Lng.Degrees(), bounds.Hi().Lat.Degrees(), cellLng, cellLat)
+	}
+
+	missingBoundaries := 0
+	totals := make([]float64, len(modelled))
+	for home, d := range demand {
+		cells, ok := demandCells(rasters[0], home, lsoas[home], geography.Year, w)
+		if !ok {
+			missingBoundaries++
+		}
+		for i := range modelled {
+			for _, cell := range cells {
+				rasters[i].Values[cell] += float32(d[i] / float64(len(cells)))
+			}
+			totals[i] += d[i]
+		}
+	}
+
+	// Convert from activity per cell to activity per km², since cells
+	// shrink towards the poles
+	for y := 0; y < height; y++ {
+		_, lat := rasters[0].CellCenter(0, y)
+		km2 := (cellMeters / 1000.0) * (b6.AngleToMeters(s1.Angle(cellLng)*s1.Degree) * math.Cos(lat*math.Pi/180.0) / 1000.0)
+		for _, r := range rasters {
+			for x := 0; x < width; x++ {
+				r.Values[y*width+x] /= float32(km2)
+			}
+		}
+	}
+
+	log.Printf("  demand surfaces: %dx%d cells of %.0fm, missing boundaries: %d", width, height, cellMeters, missingBoundaries)
+	for i, condition := range modelled {
+		log.Printf("    %s: %s: %.0f per year", condition, model[condition].Description, totals[i])
+		rasters[i].Description = strings.Join(provenance.Lines(), "\n")
+		if err := writeGeoTIFF(filepath.Join(outputDirectory, fmt.Sprintf("demand-%s.tif", condition)), rasters[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// DemoFlags are the defaults used by --demo, which simulates the
+// population of a few LSOAs from the small datasets in data/demo, written
+// by python/demo_data.py, rather than the full NHS and ONS releases. The
+// buffer is disabled, since the LSOAs around the ICB aren't in the demo
+// datasets, and separate cache and output directories are used, to avoid
+// mixing results with those of full runs.
+var DemoFlags = map[string]string{
+	"data-manifest": "data/demo/manifest.yaml",
+	"buffer":        "none",
+	"cached":        "cached/demo",
+	"output":        "output/demo",
+}
+
+// applyDemoFlags sets the flags in DemoFlags to their demo values, unless
+// they were explicitly given on the command line.
+func applyDemoFlags(flags *flag.FlagSet) error {
+	given := make(map[string]struct{})
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = struct{}{}
+	})
+	for name, value := range DemoFlags {
+		if _, ok := given[name]; !ok {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("demo: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDemoWorld returns an error naming the local files of the world
+// that are missing, since the demo's extracts only replace the datasets in
+// its manifest, and it still reads LSOA boundaries and postcode
+// locations from the full world.
+func checkDemoWorld(filenames []string) error {
+	missing := make([]string, 0)
+	for _, filename := range filenames {
+		if !strings.Contains(filename, "://") && !fileExists(filename) {
+			missing = append(missing, filename)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("demo: missing world %s, downloaded by make world", strings.Join(missing, ", "))
+	}
+	return nil
+}
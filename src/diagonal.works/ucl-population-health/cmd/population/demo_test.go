@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyDemoFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	manifest := flags.String("data-manifest", "", "")
+	buffer := flags.String("buffer", "nearby", "")
+	flags.String("cached", "cached", "")
+	output := flags.String("output", "output", "")
+	if err := flags.Parse([]string{"--output=elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDemoFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *manifest != DemoFlags["data-manifest"] || *buffer != "none" {
+		t.Errorf("expected demo defaults, found %q and %q", *manifest, *buffer)
+	}
+	if *output != "elsewhere" {
+		t.Errorf("expected an explicit flag to be kept, found %q", *output)
+	}
+}
+
+func TestCheckDemoWorld(t *testing.T) {
+	present := filepath.Join(t.TempDir(), "lsoa-2011.index")
+	if err := os.WriteFile(present, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDemoWorld([]string{present, "gs://bucket/world.index"}); err != nil {
+		t.Errorf("expected no error, found %s", err)
+	}
+	missing := filepath.Join(t.TempDir(), "codepoint-open-2023-02.index")
+	if err := checkDemoWorld([]string{present, missing}); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("expected an error naming %s, found %v", missing, err)
+	}
+}
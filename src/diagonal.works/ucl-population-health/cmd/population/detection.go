@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DetectionModel gives the share of the people with a condition, like
+// hypertension, who have been diagnosed with it, from which the people
+// living with it undiagnosed are estimated, alongside the simulated
+// register of those who have been.
+type DetectionModel struct {
+	// The condition whose detection is modelled
+	Condition string
+	// The share of people with the condition who are diagnosed, by sex and
+	// age range
+	Detected AgePrevalences
+	// The detection rate in each IMD quintile, from the most deprived,
+	// relative to that given by age and sex
+	Deprivation []float64
+
+	condition QOFCondition
+}
+
+func readDetectionModel(filename string) (*DetectionModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open detection model: %s", err)
+	}
+	defer f.Close()
+	var model DetectionModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read detection model: %s", err)
+	}
+	if model.condition = QOFConditionFromString(model.Condition); model.condition == QOFConditionInvalid {
+		return nil, fmt.Errorf("unknown condition %q for detection", model.Condition)
+	}
+	if len(model.Detected) == 0 {
+		return nil, fmt.Errorf("detection model needs detection rates by age")
+	}
+	for _, ranges := range model.Detected {
+		for _, p := range ranges {
+			if p.Prevalence < 0.0 || p.Prevalence > 1.0 {
+				return nil, fmt.Errorf("detection model needs detection rates between 0 and 1")
+			}
+		}
+	}
+	if len(model.Deprivation) != 0 && len(model.Deprivation) != 5 {
+		return nil, fmt.Errorf("detection model needs relative detection rates for 5 IMD quintiles, found %d", len(model.Deprivation))
+	}
+	return &model, nil
+}
+
+// Rate returns the share of people with the condition of the given sex
+// and age, living in an LSOA of the given IMD decile, or 0 if unknown, who
+// are diagnosed, or 0 if detection isn't given for their age.
+func (d *DetectionModel) Rate(sex Sex, age int, imdDecile int) float64 {
+	rate := d.Detected.Prevalence(sex, age)
+	if imdDecile > 0 && len(d.Deprivation) > 0 {
+		rate *= d.Deprivation[(imdDecile-1)/2]
+	}
+	return clamp(rate, 0.0, 1.0)
+}
+
+func (d *DetectionModel) warnUnsimulated(simulated []QOFCondition) {
+	var included QOFConditions
+	for _, c := range simulated {
+		included.Add(c)
+	}
+	if !included.Contains(d.condition) {
+		Warningf("  %s isn't simulated, so nobody will have it undiagnosed", d.condition)
+	}
+}
+
+// assignUndiagnosed marks people without the model's condition as living
+// with it undiagnosed. People are grouped by sex, age and the IMD quintile
+// of their home, and since the simulated register of each group is the
+// share of its cases given by the detection rate, r, each diagnosed person
+// implies (1-r)/r undiagnosed, who are chosen at random from those in the
+// group without the condition. Groups with too few of them are logged.
+func assignUndiagnosed(people []Person, model *DetectionModel, lsoas map[LSOACode]*LSOA) {
+	type group struct {
+		sex      Sex
+		age      int
+		quintile int
+	}
+	type cases struct {
+		rate        float64
+		diagnosed   int
+		without     int
+		undiagnosed float64
+	}
+	groups := make(map[group]*cases)
+	keys := make([]group, len(people))
+	for i := range people {
+		p := &people[i]
+		decile := 0
+		if lsoa, ok := lsoas[p.Home]; ok {
+			decile = lsoa.IMDDecile
+		}
+		g := group{sex: p.Sex, age: p.Age, quintile: (decile + 1) / 2}
+		keys[i] = g
+		c, ok := groups[g]
+		if !ok {
+			c = &cases{rate: model.Rate(p.Sex, p.Age, decile)}
+			groups[g] = c
+		}
+		if p.Conditions.Contains(model.condition) {
+			c.diagnosed++
+			if c.rate > 0.0 {
+				c.undiagnosed += (1.0 - c.rate) / c.rate
+			}
+		} else {
+			c.without++
+		}
+	}
+	short := 0.0
+	for _, c := range groups {
+		if c.undiagnosed > float64(c.without) {
+			short += c.undiagnosed - float64(c.without)
+		}
+	}
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	diagnosed, undiagnosed := 0, 0
+	for i := range people {
+		p := &people[i]
+		if p.Conditions.Contains(model.condition) {
+			diagnosed++
+			continue
+		}
+		c := groups[keys[i]]
+		if c.without > 0 && rng.Float64() < c.undiagnosed/float64(c.without) {
+			p.Undiagnosed.Add(model.condition)
+			undiagnosed++
+		}
+	}
+	log.Printf("  %s: diagnosed: %d undiagnosed: %d", model.condition, diagnosed, undiagnosed)
+	if diagnosed+undiagnosed > 0 {
+		log.Printf("  %s: detection rate: %.1f%%", model.condition, 100.0*float64(diagnosed)/float64(diagnosed+undiagnosed))
+	}
+	if short >= 1.0 {
+		Warningf("  detection: %.0f people undiagnosed with %s couldn't be assigned, since too few people of their age, sex and deprivation don't have it", short, model.condition)
+	}
+}
+
+// PracticeDetection counts the patients of a practice with a condition,
+// diagnosed and undiagnosed, alongside the register it reported.
+type PracticeDetection struct {
+	Code        GPPracticeCode
+	Name        string
+	Patients    int
+	Diagnosed   int
+	Undiagnosed int
+	// The register reported by QOF, or -1 if not reported
+	ReportedRegister float64
+}
+
+// Expected returns the patients expected to have the condition, diagnosed
+// or not.
+func (p *PracticeDetection) Expected() int {
+	return p.Diagnosed + p.Undiagnosed
+}
+
+// DetectionRate returns the share of those expected to have the condition
+// who are on the simulated register.
+func (p *PracticeDetection) DetectionRate() float64 {
+	if p.Expected() == 0 {
+		return 0.0
+	}
+	return float64(p.Diagnosed) / float64(p.Expected())
+}
+
+// countDetection returns the detection of the model's condition among the
+// patients of each of practices, in order of practice code.
+func countDetection(practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, byPractice map[GPPracticeCode][]*Person, model *DetectionModel) []*PracticeDetection {
+	codes := make([]GPPracticeCode, 0, len(practices))
+	for code := range practices {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	detections := make([]*PracticeDetection, 0, len(codes))
+	for _, code := range codes {
+		gp := gps[code]
+		d := &PracticeDetection{Code: code, Name: gp.Name, ReportedRegister: -1.0}
+		if prevalence, ok := gp.ReportedConditionPrevalence[model.condition]; ok && gp.ListSize > 0 {
+			d.ReportedRegister = prevalence * float64(gp.ListSize)
+		}
+		for _, p := range byPractice[code] {
+			d.Patients++
+			if p.Conditions.Contains(model.condition) {
+				d.Diagnosed++
+			} else if p.Undiagnosed.Contains(model.condition) {
+				d.Undiagnosed++
+			}
+		}
+		detections = append(detections, d)
+	}
+	return detections
+}
+
+// writeDetectionGaps writes detection-gaps.csv, with the simulated
+// patients of each practice diagnosed with the model's condition, those
+// estimated to have it undiagnosed, and the detection rate. Since the
+// simulated register follows prevalence by age and sex, rather than each
+// practice's own case finding, the register reported by the practice, and
+// the detection rate and gap given by it, are also written, left empty
+// where they're not reported.
+func writeDetectionGaps(detections []*PracticeDetection, model *DetectionModel, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "detection-gaps.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "code", "name", "condition", "patients", "diagnosed", "undiagnosed", "expected", "detection_rate", "reported_register", "reported_detection_rate", "reported_gap"})
+	for _, d := range detections {
+		reported, reportedRate, reportedGap := "", "", ""
+		if d.ReportedRegister >= 0.0 {
+			reported = fmt.Sprintf("%f", d.ReportedRegister)
+			reportedGap = fmt.Sprintf("%f", float64(d.Expected())-d.ReportedRegister)
+			if d.Expected() > 0 {
+				reportedRate = fmt.Sprintf("%f", d.ReportedRegister/float64(d.Expected()))
+			}
+		}
+		w.Write([]string{scenario, d.Code.String(), d.Name, model.condition.String(), strconv.Itoa(d.Patients), strconv.Itoa(d.Diagnosed), strconv.Itoa(d.Undiagnosed), strconv.Itoa(d.Expected()), fmt.Sprintf("%f", d.DetectionRate()), reported, reportedRate, reportedGap})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDetectionModel(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"valid", "condition: hyp\ndetected:\n  m:\n    - ages: {begin: 16}\n      p: 0.5\ndeprivation: [1.1, 1.0, 1.0, 1.0, 0.9]\n", true},
+		{"without deprivation", "condition: hyp\ndetected:\n  m:\n    - ages: {begin: 16}\n      p: 0.5\n", true},
+		{"unknown condition", "condition: xyz\ndetected:\n  m:\n    - ages: {begin: 16}\n      p: 0.5\n", false},
+		{"no rates", "condition: hyp\n", false},
+		{"rate above 1", "condition: hyp\ndetected:\n  m:\n    - ages: {begin: 16}\n      p: 1.5\n", false},
+		{"too few quintiles", "condition: hyp\ndetected:\n  m:\n    - ages: {begin: 16}\n      p: 0.5\ndeprivation: [1.0, 1.0]\n", false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "detection.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		model, err := readDetectionModel(filename)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: expected no error, found %s", test.name, err)
+			} else if model.condition != QOFConditionHypertension {
+				t.Errorf("%s: expected hyp, found %s", test.name, model.condition)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestReadDetectionModelFromData(t *testing.T) {
+	model, err := readDetectionModel(filepath.Join("..", "..", "..", "..", "..", "data", "hypertension-detection.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sex := range []Sex{Male, Female} {
+		if r := model.Rate(sex, 50, 0); r <= 0.0 || r >= 1.0 {
+			t.Errorf("expected a detection rate between 0 and 1 at 50, found %f", r)
+		}
+	}
+}
+
+func newDetectionModel(p float64, deprivation []float64) *DetectionModel {
+	ranges := []AgePrevalence{{Ages: AgeRange{Begin: 16}, Prevalence: p}}
+	return &DetectionModel{
+		Condition:   "hyp",
+		Detected:    AgePrevalences{ranges, ranges},
+		Deprivation: deprivation,
+		condition:   QOFConditionHypertension,
+	}
+}
+
+func TestDetectionModelRate(t *testing.T) {
+	model := newDetectionModel(0.5, []float64{1.2, 1.1, 1.0, 0.9, 0.8})
+	tests := []struct {
+		age      int
+		decile   int
+		expected float64
+	}{
+		{50, 0, 0.5},
+		{50, 1, 0.6},
+		{50, 2, 0.6},
+		{50, 5, 0.5},
+		{50, 10, 0.4},
+		// Nobody is undiagnosed outside the ranges given
+		{10, 1, 0.0},
+	}
+	for _, test := range tests {
+		if r := model.Rate(Male, test.age, test.decile); math.Abs(r-test.expected) > 1e-9 {
+			t.Errorf("expected %f at %d in decile %d, found %f", test.expected, test.age, test.decile, r)
+		}
+	}
+	if r := newDetectionModel(0.9, []float64{1.5, 1.0, 1.0, 1.0, 1.0}).Rate(Male, 50, 1); r != 1.0 {
+		t.Errorf("expected the rate to be clamped to 1, found %f", r)
+	}
+}
+
+func TestAssignUndiagnosed(t *testing.T) {
+	var hyp QOFConditions
+	hyp.Add(QOFConditionHypertension)
+	people := make([]Person, 0)
+	// Half of the 200 with hypertension at 50 are diagnosed, so 100 of the
+	// 900 without a diagnosis are expected to be undiagnosed
+	for i := 0; i < 1000; i++ {
+		p := Person{Sex: Male, Age: 50, Home: "E01000001"}
+		if i < 100 {
+			p.Conditions = hyp
+		}
+		people = append(people, p)
+	}
+	// Too few people at 60 without a diagnosis for the 9 undiagnosed
+	// implied by each diagnosed person
+	for i := 0; i < 20; i++ {
+		p := Person{Sex: Female, Age: 60, Home: "E01000001"}
+		if i < 10 {
+			p.Conditions = hyp
+		}
+		people = append(people, p)
+	}
+	// Nobody at 10 is undiagnosed
+	for i := 0; i < 100; i++ {
+		people = append(people, Person{Sex: Male, Age: 10, Home: "E01000001"})
+	}
+	model := newDetectionModel(0.5, nil)
+	model.Detected[Female] = []AgePrevalence{{Ages: AgeRange{Begin: 16}, Prevalence: 0.1}}
+	assignUndiagnosed(people, model, map[LSOACode]*LSOA{"E01000001": {IMDDecile: 3}})
+
+	undiagnosed := map[int]int{}
+	for _, p := range people {
+		if p.Undiagnosed.Contains(QOFConditionHypertension) {
+			if p.Conditions.Contains(QOFConditionHypertension) {
+				t.Errorf("expected nobody diagnosed to be undiagnosed")
+			}
+			undiagnosed[p.Age]++
+		}
+	}
+	// 3 standard deviations either side of 100
+	if n := undiagnosed[50]; n < 70 || n > 130 {
+		t.Errorf("expected around 100 undiagnosed at 50, found %d", n)
+	}
+	if n := undiagnosed[60]; n != 10 {
+		t.Errorf("expected everyone without a diagnosis at 60 to be undiagnosed, found %d", n)
+	}
+	if n := undiagnosed[10]; n != 0 {
+		t.Errorf("expected nobody undiagnosed at 10, found %d", n)
+	}
+}
+
+func TestCountAndWriteDetection(t *testing.T) {
+	var hyp QOFConditions
+	hyp.Add(QOFConditionHypertension)
+	var undiagnosed QOFConditions
+	undiagnosed.Add(QOFConditionHypertension)
+	people := []Person{
+		{GP: "G1", Conditions: hyp},
+		{GP: "G1", Conditions: hyp},
+		{GP: "G1", Undiagnosed: undiagnosed},
+		{GP: "G1"},
+		{GP: "G2"},
+	}
+	byPractice := map[GPPracticeCode][]*Person{}
+	for i := range people {
+		byPractice[people[i].GP] = append(byPractice[people[i].GP], &people[i])
+	}
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", Name: "One", ListSize: 100, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionHypertension: 0.01}},
+		"G2": {Code: "G2", Name: "Two", ListSize: 100},
+	}
+	model := newDetectionModel(0.5, nil)
+	detections := countDetection(GPPracticeCodeSet{"G2": struct{}{}, "G1": struct{}{}}, gps, byPractice, model)
+	if len(detections) != 2 || detections[0].Code != "G1" || detections[1].Code != "G2" {
+		t.Fatalf("expected detections for G1 and G2 in order, found %v", detections)
+	}
+	d := detections[0]
+	if d.Patients != 4 || d.Diagnosed != 2 || d.Undiagnosed != 1 || d.Expected() != 3 || math.Abs(d.ReportedRegister-1.0) > 1e-9 {
+		t.Errorf("unexpected detection for G1 %+v", d)
+	}
+	if r := d.DetectionRate(); math.Abs(r-2.0/3.0) > 1e-9 {
+		t.Errorf("expected a detection rate of 2/3, found %f", r)
+	}
+	if detections[1].ReportedRegister != -1.0 || detections[1].DetectionRate() != 0.0 {
+		t.Errorf("expected no reported register or detection for G2, found %+v", detections[1])
+	}
+
+	directory := t.TempDir()
+	if err := writeDetectionGaps(detections, model, "baseline", directory); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(directory, "detection-gaps.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, found %d", len(rows))
+	}
+	if rows[1][1] != "G1" || rows[1][7] != "3" || rows[1][9] != "1.000000" || rows[1][10] != "0.333333" || rows[1][11] != "2.000000" {
+		t.Errorf("unexpected row for G1 %v", rows[1])
+	}
+	if rows[2][9] != "" || rows[2][10] != "" || rows[2][11] != "" {
+		t.Errorf("expected empty reported columns for G2, found %v", rows[2])
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	NewDiagnosesAreaPractice = "practice"
+	NewDiagnosesAreaMSOA     = "msoa"
+)
+
+// NewDiagnoses is the expected number of people of an area diagnosed with
+// a condition during a year, alongside the number who already have it.
+type NewDiagnoses struct {
+	Area      string
+	Code      string
+	Name      string
+	Condition QOFCondition
+	People    int
+	Prevalent int
+	Expected  float64
+}
+
+// AtRisk returns the number of people without the condition, who could be
+// diagnosed with it.
+func (n *NewDiagnoses) AtRisk() int {
+	return n.People - n.Prevalent
+}
+
+// estimateNewDiagnoses returns the expected new diagnoses of each condition
+// with incidence, for the patients of each ICB practice, and the residents
+// of each MSOA of homes. Each person without a condition is diagnosed with
+// it during the year with the probability given by its annual incidence for
+// their sex and age, as for forecasts.
+func estimateNewDiagnoses(byPractice map[GPPracticeCode][]*Person, icbPractices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, people []Person, homes LSOASet, lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, conditions []QOFCondition, incidence *IncidenceModel) []*NewDiagnoses {
+	withIncidence := make([]QOFCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		if _, ok := incidence.ByCondition[condition]; ok {
+			withIncidence = append(withIncidence, condition)
+		}
+	}
+	add := func(d []*NewDiagnoses, p *Person) {
+		for i, condition := range withIncidence {
+			d[i].People++
+			if p.Conditions.Contains(condition) {
+				d[i].Prevalent++
+			} else {
+				d[i].Expected += 1.0 - math.Exp(-incidence.ByCondition[condition].Prevalence(p.Sex, p.Age))
+			}
+		}
+	}
+	area := func(kind string, code string, name string) []*NewDiagnoses {
+		d := make([]*NewDiagnoses, len(withIncidence))
+		for i, condition := range withIncidence {
+			d[i] = &NewDiagnoses{Area: kind, Code: code, Name: name, Condition: condition}
+		}
+		return d
+	}
+
+	codes := make([]string, 0, len(icbPractices))
+	for code := range icbPractices {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	diagnoses := make([]*NewDiagnoses, 0)
+	for _, code := range codes {
+		name := ""
+		if gp, ok := gps[GPPracticeCode(code)]; ok {
+			name = gp.Name
+		}
+		d := area(NewDiagnosesAreaPractice, code, name)
+		for _, p := range byPractice[GPPracticeCode(code)] {
+			add(d, p)
+		}
+		diagnoses = append(diagnoses, d...)
+	}
+	for i, condition := range withIncidence {
+		patients, expected := 0, 0.0
+		for j := i; j < len(diagnoses); j += len(withIncidence) {
+			patients += diagnoses[j].People
+			expected += diagnoses[j].Expected
+		}
+		log.Printf("  %s: expected new diagnoses: %.0f among %d patients of icb practices", condition, expected, patients)
+	}
+
+	byMSOA := make(map[MSOACode][]*NewDiagnoses)
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		code := lsoas[p.Home].MSOACode
+		d, ok := byMSOA[code]
+		if !ok {
+			name := ""
+			if msoa, ok := msoas[code]; ok {
+				name = msoa.Name
+			}
+			d = area(NewDiagnosesAreaMSOA, code.String(), name)
+			byMSOA[code] = d
+		}
+		add(d, p)
+	}
+	msoaCodes := make([]MSOACode, 0, len(byMSOA))
+	for code := range byMSOA {
+		msoaCodes = append(msoaCodes, code)
+	}
+	sort.Slice(msoaCodes, func(i, j int) bool { return msoaCodes[i] < msoaCodes[j] })
+	for _, code := range msoaCodes {
+		diagnoses = append(diagnoses, byMSOA[code]...)
+	}
+	return diagnoses
+}
+
+// writeNewDiagnoses writes new-diagnoses.csv, the people with, and the
+// expected new diagnoses of, each condition for each practice and MSOA.
+func writeNewDiagnoses(diagnoses []*NewDiagnoses, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "new-diagnoses.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "area", "code", "name", "condition", "people", "prevalent", "prevalence", "expected_new_diagnoses", "incidence"})
+	for _, d := range diagnoses {
+		prevalence, rate := 0.0, 0.0
+		if d.People > 0 {
+			prevalence = float64(d.Prevalent) / float64(d.People)
+		}
+		if d.AtRisk() > 0 {
+			rate = d.Expected / float64(d.AtRisk())
+		}
+		w.Write([]string{scenario, d.Area, d.Code, d.Name, d.Condition.String(), strconv.Itoa(d.People), strconv.Itoa(d.Prevalent), fmt.Sprintf("%f", prevalence), fmt.Sprintf("%f", d.Expected), fmt.Sprintf("%f", rate)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
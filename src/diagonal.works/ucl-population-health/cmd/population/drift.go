@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+)
+
+const (
+	// Practices whose list size changes by more than this fraction are
+	// reported individually
+	DriftListSizeThreshold = 0.10
+	// Practices whose reported prevalence of a condition changes by more
+	// than this, in absolute terms, are reported individually
+	DriftPrevalenceThreshold = 0.01
+	// A change in the ICB's total list size above this fraction suggests
+	// the simulation should be rerun
+	DriftICBListSizeThreshold = 0.01
+	// A change in the ICB's list size weighted prevalence of any condition
+	// above this, in absolute terms, suggests the simulation should be rerun
+	DriftICBPrevalenceThreshold = 0.001
+)
+
+// DataVintage holds the practice level inputs from one release of the
+// data, as described by a data manifest.
+type DataVintage struct {
+	GPs map[GPPracticeCode]*GPPractice
+}
+
+func readDataVintage(data DataManifest, conditions []QOFCondition, world b6.World) (*DataVintage, error) {
+	gps, err := readGPPractices(data.Get(DatasetGPPractices), postcodeSources(data), world)
+	if err != nil {
+		return nil, err
+	}
+	successors, err := readGPPracticeSuccessors(data.Get(DatasetGPPracticeSuccessors))
+	if err != nil {
+		return nil, err
+	}
+	if err := readGPPracticeListSizes(gps, successors, data.Get(DatasetQOFListSizes)); err != nil {
+		return nil, err
+	}
+	if _, err := readGPPracticeConditionPrevalence(gps, successors, conditions, data); err != nil {
+		return nil, err
+	}
+	return &DataVintage{GPs: gps}, nil
+}
+
+func (d *DataVintage) active(code GPPracticeCode) bool {
+	gp, ok := d.GPs[code]
+	return ok && gp.Status == GPPracticeStatusActive
+}
+
+// DriftChange is a change to a single practice between vintages
+type DriftChange struct {
+	Code     GPPracticeCode
+	Name     string
+	ICB      ICBCode
+	Change   string
+	Previous string
+	Current  string
+}
+
+// DriftSummary is a change to an aggregate measure between vintages, for
+// England or a single ICB
+type DriftSummary struct {
+	Scope    string
+	Metric   string
+	Previous float64
+	Current  float64
+}
+
+func (d *DriftSummary) Difference() float64 {
+	return d.Current - d.Previous
+}
+
+type Drift struct {
+	Changes   []DriftChange
+	Summaries []DriftSummary
+	// Reasons the ICB's simulation should be rerun, empty if its inputs
+	// are materially unchanged
+	Reasons []string
+}
+
+func formatDriftPrevalence(gp *GPPractice, condition QOFCondition) string {
+	if gp == nil {
+		return ""
+	}
+	if p, ok := gp.ReportedConditionPrevalence[condition]; ok {
+		return fmt.Sprintf("%f", p)
+	}
+	return ""
+}
+
+// compareDataVintages summarises the changes to practices, list sizes and
+// reported prevalence from previous to current, with aggregate measures
+// for England and the given ICB.
+func compareDataVintages(previous *DataVintage, current *DataVintage, conditions []QOFCondition, icb ICBCode) *Drift {
+	codes := make([]GPPracticeCode, 0, len(current.GPs))
+	for code := range current.GPs {
+		codes = append(codes, code)
+	}
+	for code := range previous.GPs {
+		if _, ok := current.GPs[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	drift := &Drift{}
+	icbChanges := 0
+	for _, code := range codes {
+		p, c := previous.GPs[code], current.GPs[code]
+		gp := c
+		if gp == nil {
+			gp = p
+		}
+		change := DriftChange{Code: code, Name: gp.Name, ICB: gp.ICB}
+		changes := make([]DriftChange, 0)
+		if !previous.active(code) && current.active(code) {
+			change.Change = "added"
+			changes = append(changes, change)
+		} else if previous.active(code) && !current.active(code) {
+			change.Change = "closed"
+			if c != nil {
+				change.Current = c.Status.String()
+			}
+			changes = append(changes, change)
+		} else if p != nil && c != nil {
+			if p.Postcode != c.Postcode {
+				change.Change, change.Previous, change.Current = "postcode", p.Postcode, c.Postcode
+				changes = append(changes, change)
+			}
+			if p.ICB != c.ICB {
+				change.Change, change.Previous, change.Current = "icb", p.ICB.String(), c.ICB.String()
+				changes = append(changes, change)
+			}
+			if p.ListSize > 0 && math.Abs(float64(c.ListSize-p.ListSize))/float64(p.ListSize) > DriftListSizeThreshold {
+				change.Change, change.Previous, change.Current = "list_size", strconv.Itoa(p.ListSize), strconv.Itoa(c.ListSize)
+				changes = append(changes, change)
+			}
+			for _, condition := range conditions {
+				pp, pOK := p.ReportedConditionPrevalence[condition]
+				cp, cOK := c.ReportedConditionPrevalence[condition]
+				if pOK != cOK || (pOK && math.Abs(cp-pp) > DriftPrevalenceThreshold) {
+					change.Change = fmt.Sprintf("prevalence_%s", condition)
+					change.Previous = formatDriftPrevalence(p, condition)
+					change.Current = formatDriftPrevalence(c, condition)
+					changes = append(changes, change)
+				}
+			}
+		}
+		if (p != nil && p.ICB == icb) || (c != nil && c.ICB == icb) {
+			icbChanges += len(changes)
+		}
+		drift.Changes = append(drift.Changes, changes...)
+	}
+
+	scopes := []struct {
+		Name    string
+		Include func(gp *GPPractice) bool
+	}{
+		{Name: "england", Include: func(gp *GPPractice) bool { return true }},
+		{Name: icb.String(), Include: func(gp *GPPractice) bool { return gp.ICB == icb }},
+	}
+	for _, scope := range scopes {
+		summarise := func(v *DataVintage) []float64 {
+			practices, listSize := 0.0, 0.0
+			registers := make([]float64, len(conditions))
+			for _, gp := range v.GPs {
+				if gp.Status != GPPracticeStatusActive || !scope.Include(gp) {
+					continue
+				}
+				practices++
+				listSize += float64(gp.ListSize)
+				for i, condition := range conditions {
+					registers[i] += gp.ReportedConditionPrevalence[condition] * float64(gp.ListSize)
+				}
+			}
+			values := []float64{practices, listSize}
+			for i := range conditions {
+				if listSize > 0.0 {
+					values = append(values, registers[i]/listSize)
+				} else {
+					values = append(values, 0.0)
+				}
+			}
+			return values
+		}
+		metrics := []string{"active_practices", "list_size"}
+		for _, condition := range conditions {
+			metrics = append(metrics, fmt.Sprintf("prevalence_%s", condition))
+		}
+		p, c := summarise(previous), summarise(current)
+		for i, metric := range metrics {
+			drift.Summaries = append(drift.Summaries, DriftSummary{Scope: scope.Name, Metric: metric, Previous: p[i], Current: c[i]})
+		}
+	}
+
+	for _, s := range drift.Summaries {
+		if s.Scope != icb.String() {
+			continue
+		}
+		switch {
+		case s.Metric == "active_practices":
+			if s.Difference() != 0.0 {
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("active practices changed from %.0f to %.0f", s.Previous, s.Current))
+			}
+		case s.Metric == "list_size":
+			if s.Previous > 0.0 && math.Abs(s.Difference())/s.Previous > DriftICBListSizeThreshold {
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("list size changed by %.1f%%", 100.0*s.Difference()/s.Previous))
+			}
+		default:
+			if math.Abs(s.Difference()) > DriftICBPrevalenceThreshold {
+				drift.Reasons = append(drift.Reasons, fmt.Sprintf("%s changed from %f to %f", s.Metric, s.Previous, s.Current))
+			}
+		}
+	}
+	if len(drift.Reasons) == 0 && icbChanges > 0 {
+		drift.Reasons = append(drift.Reasons, fmt.Sprintf("%d changes to individual practices", icbChanges))
+	}
+	return drift
+}
+
+// writeDataDrift writes data-drift.csv, listing the changes to individual
+// practices, and data-drift-summary.csv, with the changes to aggregate
+// measures.
+func writeDataDrift(drift *Drift, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "data-drift.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "icb", "change", "previous", "current"})
+	for _, c := range drift.Changes {
+		w.Write([]string{c.Code.String(), c.Name, c.ICB.String(), c.Change, c.Previous, c.Current})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = createOutput(filepath.Join(outputDirectory, "data-drift-summary.csv"))
+	if err != nil {
+		return err
+	}
+	w = csv.NewWriter(f)
+	w.Write([]string{"scope", "metric", "previous", "current", "difference"})
+	for _, s := range drift.Summaries {
+		w.Write([]string{s.Scope, s.Metric, fmt.Sprintf("%f", s.Previous), fmt.Sprintf("%f", s.Current), fmt.Sprintf("%f", s.Difference())})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compareData compares the practice level inputs described by previous
+// with those of current, logging a summary, and whether the ICB's
+// simulation should be rerun. Practice level prevalence is compared for
+// the simulated conditions, and those they roll up to, that have QOF
+// registers.
+func compareData(previous DataManifest, current DataManifest, simulated []QOFCondition, icb ICBCode, world b6.World, outputDirectory string) error {
+	conditions := make([]QOFCondition, 0, len(simulated))
+	for _, c := range withAncestors(simulated) {
+		if c.HasRegister() {
+			conditions = append(conditions, c)
+		}
+	}
+	log.Printf("read: previous data")
+	p, err := readDataVintage(previous, conditions, world)
+	if err != nil {
+		return err
+	}
+	log.Printf("read: current data")
+	c, err := readDataVintage(current, conditions, world)
+	if err != nil {
+		return err
+	}
+
+	drift := compareDataVintages(p, c, conditions, icb)
+	counts := make(map[string]int)
+	for _, change := range drift.Changes {
+		counts[change.Change]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	log.Printf("data drift:")
+	for _, kind := range kinds {
+		log.Printf("  %s: %d practices", kind, counts[kind])
+	}
+	for _, s := range drift.Summaries {
+		log.Printf("  %s %s: %f -> %f", s.Scope, s.Metric, s.Previous, s.Current)
+	}
+	if len(drift.Reasons) > 0 {
+		log.Printf("rerun the simulation for %s:", icb)
+		for _, reason := range drift.Reasons {
+			log.Printf("  %s", reason)
+		}
+	} else {
+		log.Printf("no material changes for %s", icb)
+	}
+	return writeDataDrift(drift, outputDirectory)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EmploymentLSOACodeColumn = "lsoa_code"
+
+	// Limits on the proportional fitting of the attributes of each LSOA's
+	// residents to its census counts
+	EmploymentFitIterations = 50
+	EmploymentFitTolerance  = 1e-6
+)
+
+// EconomicActivity is a person's economic activity status, following the
+// categories of census table TS066, with full-time students, whether
+// economically active or not, counted together.
+type EconomicActivity int
+
+const (
+	// Economic activity wasn't simulated, or the person is outside the
+	// ages of the employment model
+	EconomicActivityUnknown EconomicActivity = iota
+	EconomicActivityEmployee
+	EconomicActivitySelfEmployed
+	EconomicActivityUnemployed
+	EconomicActivityStudent
+	EconomicActivityRetired
+	EconomicActivityLookingAfterHome
+	EconomicActivityLongTermSick
+	EconomicActivityOtherInactive
+
+	EconomicActivityCount
+)
+
+func (e EconomicActivity) String() string {
+	switch e {
+	case EconomicActivityEmployee:
+		return "employee"
+	case EconomicActivitySelfEmployed:
+		return "self_employed"
+	case EconomicActivityUnemployed:
+		return "unemployed"
+	case EconomicActivityStudent:
+		return "student"
+	case EconomicActivityRetired:
+		return "retired"
+	case EconomicActivityLookingAfterHome:
+		return "looking_after_home"
+	case EconomicActivityLongTermSick:
+		return "long_term_sick"
+	case EconomicActivityOtherInactive:
+		return "other_inactive"
+	}
+	return "unknown"
+}
+
+func EconomicActivityFromString(s string) EconomicActivity {
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		if s == e.String() {
+			return e
+		}
+	}
+	return EconomicActivityUnknown
+}
+
+// Occupation is a person's occupation class, following the analytic
+// classes of the National Statistics Socio-economic Classification
+// (NS-SEC) in census table TS062, with retired people classified by their
+// last occupation, and full-time students not classified.
+type Occupation int
+
+const (
+	// Occupation wasn't simulated, or the person is outside the ages of
+	// the employment model
+	OccupationUnknown Occupation = iota
+	OccupationHigherManagerial
+	OccupationLowerManagerial
+	OccupationIntermediate
+	OccupationSmallEmployers
+	OccupationLowerSupervisory
+	OccupationSemiRoutine
+	OccupationRoutine
+	OccupationNeverWorked
+	OccupationStudent
+
+	OccupationCount
+)
+
+func (o Occupation) String() string {
+	switch o {
+	case OccupationHigherManagerial:
+		return "higher_managerial"
+	case OccupationLowerManagerial:
+		return "lower_managerial"
+	case OccupationIntermediate:
+		return "intermediate"
+	case OccupationSmallEmployers:
+		return "small_employers"
+	case OccupationLowerSupervisory:
+		return "lower_supervisory"
+	case OccupationSemiRoutine:
+		return "semi_routine"
+	case OccupationRoutine:
+		return "routine"
+	case OccupationNeverWorked:
+		return "never_worked"
+	case OccupationStudent:
+		return "student"
+	}
+	return "unknown"
+}
+
+func OccupationFromString(s string) Occupation {
+	for o := OccupationHigherManagerial; o < OccupationCount; o++ {
+		if s == o.String() {
+			return o
+		}
+	}
+	return OccupationUnknown
+}
+
+// employmentColumn returns the logical column of a category, as used by
+// the data manifest, from its name, eg self_employed to self-employed
+func employmentColumn(category fmt.Stringer) string {
+	return strings.ReplaceAll(category.String(), "_", "-")
+}
+
+func employmentDataset(filename string, categories []fmt.Stringer) *Dataset {
+	d := &Dataset{Filename: filename, Columns: map[string]string{"lsoa-code": EmploymentLSOACodeColumn}}
+	for _, c := range categories {
+		d.Columns[employmentColumn(c)] = c.String()
+	}
+	return d
+}
+
+func economicActivityCategories() []fmt.Stringer {
+	categories := make([]fmt.Stringer, 0, EconomicActivityCount)
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		categories = append(categories, e)
+	}
+	return categories
+}
+
+func occupationCategories() []fmt.Stringer {
+	categories := make([]fmt.Stringer, 0, OccupationCount)
+	for o := OccupationHigherManagerial; o < OccupationCount; o++ {
+		categories = append(categories, o)
+	}
+	return categories
+}
+
+// EmploymentAgeWeights gives the relative propensity of people within
+// ages to have each economic activity status
+type EmploymentAgeWeights struct {
+	Ages    AgeRange
+	Weights map[string]float64
+
+	weights [EconomicActivityCount]float64
+}
+
+// EmploymentModel assigns adults an economic activity status and an
+// occupation class, fitted to the census counts of their home LSOA. The
+// weights don't change the counts of an LSOA, only which of its residents
+// are given each category, so that, for example, retired people are
+// older.
+type EmploymentModel struct {
+	// The ages of people given an economic activity and occupation
+	Ages AgeRange
+	// The relative propensity for each status, by age. People whose age
+	// isn't given are equally likely to have any status.
+	Activity []*EmploymentAgeWeights
+	// The relative propensity for each occupation class, by economic
+	// activity status. Statuses that aren't given are equally likely to
+	// have any class but student.
+	Occupation map[string]map[string]float64
+
+	occupation [EconomicActivityCount][OccupationCount]float64
+}
+
+func readEmploymentModel(filename string) (*EmploymentModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open employment model: %s", err)
+	}
+	defer f.Close()
+	var model EmploymentModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read employment model: %s", err)
+	}
+	for _, a := range model.Activity {
+		for name, w := range a.Weights {
+			e := EconomicActivityFromString(name)
+			if e == EconomicActivityUnknown {
+				return nil, fmt.Errorf("unknown economic activity %q in employment model", name)
+			} else if w < 0.0 {
+				return nil, fmt.Errorf("employment model needs a non-negative weight for %s", name)
+			}
+			a.weights[e] = w
+		}
+	}
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		for o := OccupationHigherManagerial; o < OccupationStudent; o++ {
+			model.occupation[e][o] = 1.0
+		}
+	}
+	for name, weights := range model.Occupation {
+		e := EconomicActivityFromString(name)
+		if e == EconomicActivityUnknown {
+			return nil, fmt.Errorf("unknown economic activity %q in employment model occupations", name)
+		}
+		model.occupation[e] = [OccupationCount]float64{}
+		for class, w := range weights {
+			o := OccupationFromString(class)
+			if o == OccupationUnknown {
+				return nil, fmt.Errorf("unknown occupation %q for %s in employment model", class, name)
+			} else if w < 0.0 {
+				return nil, fmt.Errorf("employment model needs a non-negative weight for %s of %s", class, name)
+			}
+			model.occupation[e][o] = w
+		}
+	}
+	return &model, nil
+}
+
+// activityWeights returns the relative propensity for each status of
+// people of age, as the index of the age range, or len(m.Activity) if it
+// isn't given, and the weights.
+func (m *EmploymentModel) activityWeights(age int) (int, [EconomicActivityCount]float64) {
+	for i, a := range m.Activity {
+		if a.Ages.Contains(age) {
+			return i, a.weights
+		}
+	}
+	var uniform [EconomicActivityCount]float64
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		uniform[e] = 1.0
+	}
+	return len(m.Activity), uniform
+}
+
+// readEmploymentCounts reads the census count of residents in each
+// category for every LSOA, from a table with a column for the 2021 LSOA
+// code, as TS066 and TS062 are published, and one for each category.
+// Counts are translated onto the census geography with fromLSOA21, and
+// shared between the LSOAs a 2021 LSOA translates to by their
+// populations, while the counts of 2021 LSOAs that translate to the same
+// LSOA are summed.
+func readEmploymentCounts(dataset *Dataset, categories []fmt.Stringer, lsoas map[LSOACode]*LSOA, fromLSOA21 LSOACodeTranslation) (map[LSOACode][]float64, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+	}
+	columns := make(map[string]int)
+	for i, header := range row {
+		columns[strings.TrimSpace(header)] = i
+	}
+	indices := make([]int, len(categories)+1)
+	for i, column := range append([]string{"lsoa-code"}, categoryColumns(categories)...) {
+		header := dataset.Column(column)
+		index, ok := columns[header]
+		if !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, header)
+		}
+		indices[i] = index
+	}
+
+	counts := make(map[LSOACode][]float64)
+	unmatched := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		n := make([]float64, len(categories))
+		for i := range categories {
+			if n[i], err = parseFloat(row[indices[i+1]]); err != nil {
+				return nil, fmt.Errorf("%s: bad count %q for %s", dataset.Filename, row[indices[i+1]], categories[i])
+			}
+		}
+		code := LSOACode(strings.TrimSpace(row[indices[0]]))
+		translated := fromLSOA21.Translate(code)
+		total := 0
+		for _, t := range translated {
+			if lsoa, ok := lsoas[t]; ok {
+				total += sum(lsoa.PersonsByAge)
+			}
+		}
+		if total == 0 {
+			unmatched++
+			continue
+		}
+		for _, t := range translated {
+			lsoa, ok := lsoas[t]
+			if !ok {
+				continue
+			}
+			if _, ok := counts[t]; !ok {
+				counts[t] = make([]float64, len(categories))
+			}
+			for i := range n {
+				counts[t][i] += n[i] * float64(sum(lsoa.PersonsByAge)) / float64(total)
+			}
+		}
+	}
+	log.Printf("  %s: lsoas: %d unmatched: %d", dataset.Filename, len(counts), unmatched)
+	return counts, nil
+}
+
+func categoryColumns(categories []fmt.Stringer) []string {
+	columns := make([]string, len(categories))
+	for i, c := range categories {
+		columns[i] = employmentColumn(c)
+	}
+	return columns
+}
+
+// fitTable scales the cells of seed, in place, so that its rows sum to
+// rows, and its columns to columns, rescaled to the same total, by
+// iterative proportional fitting. Cells that are zero in seed stay zero.
+func fitTable(seed [][]float64, rows []float64, columns []float64) {
+	total, columnTotal := 0.0, 0.0
+	for _, r := range rows {
+		total += r
+	}
+	for _, c := range columns {
+		columnTotal += c
+	}
+	if total == 0.0 || columnTotal == 0.0 {
+		return
+	}
+	for iteration := 0; iteration < EmploymentFitIterations; iteration++ {
+		change := 0.0
+		for i := range seed {
+			margin := 0.0
+			for _, v := range seed[i] {
+				margin += v
+			}
+			if margin > 0.0 {
+				factor := rows[i] / margin
+				change = math.Max(change, math.Abs(factor-1.0))
+				for j := range seed[i] {
+					seed[i][j] *= factor
+				}
+			}
+		}
+		for j := range columns {
+			margin := 0.0
+			for i := range seed {
+				margin += seed[i][j]
+			}
+			if margin > 0.0 {
+				factor := columns[j] * total / columnTotal / margin
+				change = math.Max(change, math.Abs(factor-1.0))
+				for i := range seed {
+					seed[i][j] *= factor
+				}
+			}
+		}
+		if change < EmploymentFitTolerance {
+			break
+		}
+	}
+}
+
+// sampleCategory returns the index of a cell of weights, chosen with
+// probability proportional to its weight, or -1 if every weight is zero.
+func sampleCategory(weights []float64, rng *rand.Rand) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0.0 {
+		return -1
+	}
+	x := rng.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+// assignEmployment assigns residents of homes within the ages of the
+// model an economic activity status and then an occupation class. For
+// each LSOA, the weights of the model for the ages of its simulated
+// residents are fitted to its census counts of each status, and the
+// weights for each class given their status to its counts of each class,
+// and people are sampled from the fitted tables. LSOAs without counts use
+// the total counts of all LSOAs that have them.
+func assignEmployment(people []Person, homes LSOASet, activity map[LSOACode][]float64, occupation map[LSOACode][]float64, model *EmploymentModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	byLSOA := make(map[LSOACode][]*Person)
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok && model.Ages.Contains(people[i].Age) {
+			byLSOA[people[i].Home] = append(byLSOA[people[i].Home], &people[i])
+		}
+	}
+	codes := make([]LSOACode, 0, len(byLSOA))
+	for code := range byLSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	totals := func(counts map[LSOACode][]float64, n int) []float64 {
+		t := make([]float64, n)
+		for _, c := range counts {
+			for i := range c {
+				t[i] += c[i]
+			}
+		}
+		return t
+	}
+	activityTotals := totals(activity, int(EconomicActivityCount-1))
+	occupationTotals := totals(occupation, int(OccupationCount-1))
+
+	missingActivity, missingOccupation := 0, 0
+	var assignedActivity [EconomicActivityCount]int
+	var assignedOccupation [OccupationCount]int
+	for _, code := range codes {
+		residents := byLSOA[code]
+		counts, ok := activity[code]
+		if !ok {
+			counts = activityTotals
+			missingActivity++
+		}
+		seed := make([][]float64, len(model.Activity)+1)
+		rows := make([]float64, len(seed))
+		for i := range seed {
+			seed[i] = make([]float64, EconomicActivityCount-1)
+		}
+		bands := make([]int, len(residents))
+		for i, p := range residents {
+			band, weights := model.activityWeights(p.Age)
+			bands[i] = band
+			rows[band]++
+			for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+				seed[band][e-1] += weights[e]
+			}
+		}
+		fitTable(seed, rows, counts)
+		for i, p := range residents {
+			if e := sampleCategory(seed[bands[i]], rng); e >= 0 {
+				p.EconomicActivity = EconomicActivity(e + 1)
+			}
+			assignedActivity[p.EconomicActivity]++
+		}
+
+		if counts, ok = occupation[code]; !ok {
+			counts = occupationTotals
+			missingOccupation++
+		}
+		seed = make([][]float64, EconomicActivityCount)
+		rows = make([]float64, EconomicActivityCount)
+		for e := range seed {
+			seed[e] = make([]float64, OccupationCount-1)
+		}
+		for _, p := range residents {
+			rows[p.EconomicActivity]++
+			for o := OccupationHigherManagerial; o < OccupationCount; o++ {
+				seed[p.EconomicActivity][o-1] += model.occupation[p.EconomicActivity][o]
+			}
+		}
+		fitTable(seed, rows, counts)
+		for _, p := range residents {
+			if o := sampleCategory(seed[p.EconomicActivity], rng); o >= 0 {
+				p.Occupation = Occupation(o + 1)
+			}
+			assignedOccupation[p.Occupation]++
+		}
+	}
+	log.Printf("  economic activity: lsoas: %d without counts: %d", len(codes), missingActivity)
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		log.Printf("    %s: %d", e, assignedActivity[e])
+	}
+	log.Printf("  occupation: lsoas: %d without counts: %d", len(codes), missingOccupation)
+	for o := OccupationHigherManagerial; o < OccupationCount; o++ {
+		log.Printf("    %s: %d", o, assignedOccupation[o])
+	}
+	if unknown := assignedActivity[EconomicActivityUnknown] + assignedOccupation[OccupationUnknown]; unknown > 0 {
+		Warningf("  %d statuses or classes couldn't be assigned, as every weight was zero", unknown)
+	}
+}
+
+// GroupByEconomicActivity groups people within the ages of the model by
+// their economic activity status, skipping those outside.
+func GroupByEconomicActivity() *GroupBy {
+	fixed := make([]string, 0, EconomicActivityCount)
+	for e := EconomicActivityEmployee; e < EconomicActivityCount; e++ {
+		fixed = append(fixed, e.String())
+	}
+	return &GroupBy{
+		Key:   "economic_activity",
+		Fixed: fixed,
+		Group: func(p *Person) (string, bool) {
+			return p.EconomicActivity.String(), p.EconomicActivity != EconomicActivityUnknown
+		},
+	}
+}
+
+// GroupByOccupation groups people within the ages of the model by their
+// occupation class, skipping those outside.
+func GroupByOccupation() *GroupBy {
+	fixed := make([]string, 0, OccupationCount)
+	for o := OccupationHigherManagerial; o < OccupationCount; o++ {
+		fixed = append(fixed, o.String())
+	}
+	return &GroupBy{
+		Key:   "occupation",
+		Fixed: fixed,
+		Group: func(p *Person) (string, bool) {
+			return p.Occupation.String(), p.Occupation != OccupationUnknown
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLSOACodeTranslationInverse(t *testing.T) {
+	lsoa11To21 := LSOACodeTranslation{
+		"E01000001": {"E01100001", "E01100002"},
+		"E01000002": {"E01100003"},
+		"E01000003": {"E01100003"},
+	}
+	inverse := lsoa11To21.Inverse()
+	tests := []struct {
+		code     LSOACode
+		expected []LSOACode
+	}{
+		{"E01100001", []LSOACode{"E01000001"}},
+		{"E01100002", []LSOACode{"E01000001"}},
+		{"E01100003", []LSOACode{"E01000002", "E01000003"}},
+	}
+	for _, test := range tests {
+		if translated := inverse.Translate(test.code); fmt.Sprint(translated) != fmt.Sprint(test.expected) {
+			t.Errorf("expected %v for %s, found %v", test.expected, test.code, translated)
+		}
+	}
+}
+
+func TestReadEmploymentCountsTranslatesFrom2021(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "activity.csv.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	fmt.Fprintln(w, "lsoa_code,employee,self_employed,unemployed,student,retired,looking_after_home,long_term_sick,other_inactive")
+	// E01000001 was split into E01100001 and E01100002, while E01000002
+	// and E01000003 were merged into E01100003
+	fmt.Fprintln(w, "E01100001,10,0,0,0,0,0,0,0")
+	fmt.Fprintln(w, "E01100002,20,0,0,0,0,0,0,0")
+	fmt.Fprintln(w, "E01100003,30,0,0,0,0,0,0,0")
+	fmt.Fprintln(w, "E01199999,40,0,0,0,0,0,0,0")
+	w.Close()
+	f.Close()
+
+	lsoas := map[LSOACode]*LSOA{
+		"E01000001": newUniformLSOA("E01000001", 1),
+		"E01000002": newUniformLSOA("E01000002", 1),
+		"E01000003": newUniformLSOA("E01000003", 2),
+	}
+	fromLSOA21 := LSOACodeTranslation{
+		"E01000001": {"E01100001", "E01100002"},
+		"E01000002": {"E01100003"},
+		"E01000003": {"E01100003"},
+	}.Inverse()
+	categories := economicActivityCategories()
+	counts, err := readEmploymentCounts(employmentDataset(filename, categories), categories, lsoas, fromLSOA21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[LSOACode]float64{"E01000001": 30, "E01000002": 10, "E01000003": 20}
+	if len(counts) != len(expected) {
+		t.Errorf("expected counts for %d LSOAs, found %d", len(expected), len(counts))
+	}
+	for code, e := range expected {
+		if n, ok := counts[code]; !ok || math.Abs(n[0]-e) > 1e-9 {
+			t.Errorf("expected %f employees in %s, found %v", e, code, n)
+		}
+	}
+
+	// With the 2021 geography, codes are used as they are
+	counts, err = readEmploymentCounts(employmentDataset(filename, categories), categories, map[LSOACode]*LSOA{"E01100003": newUniformLSOA("E01100003", 1)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := counts["E01100003"]; len(counts) != 1 || n[0] != 30 {
+		t.Errorf("expected 30 employees in E01100003 alone, found %v", counts)
+	}
+}
+
+func TestFromLSOA21NeedsLookupFor2011(t *testing.T) {
+	data := DefaultDataManifest()
+	data.Get(DatasetLSOA11To21).Filename = filepath.Join(t.TempDir(), "missing.csv.gz")
+	if _, err := (&CensusGeography{Year: 2011}).FromLSOA21(data); err == nil {
+		t.Errorf("expected an error without the lookup")
+	}
+	if translation, err := (&CensusGeography{Year: 2021}).FromLSOA21(data); err != nil || translation != nil {
+		t.Errorf("expected the identity for 2021, found %v, %v", translation, err)
+	}
+}
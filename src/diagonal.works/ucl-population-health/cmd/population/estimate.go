@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The age bands of estimated prevalences, by default, given by the age at
+// which each begins, matching those of data/prevalences.yaml
+const DefaultEstimatedAgeBands = "16,25,35,45,55,65,75"
+
+// Estimated prevalences are rounded to this many decimal places, well
+// beyond the precision of any extract they're estimated from
+const EstimatedPrevalencePlaces = 6
+
+// observedPerson is a person of a person level extract, from which
+// prevalences are estimated
+type observedPerson struct {
+	Sex        Sex
+	AgeBegin   int
+	AgeEnd     int // Inclusive
+	Conditions QOFConditions
+}
+
+// readObservedPeople reads a person level extract in the schema of
+// population.csv, needing only sex, an age or age_band, and a column for
+// each condition, as condition_<name>, with 1 for people with it, and 0,
+// or nothing, for those without. Sexes are m, f or o. Other columns are
+// ignored, as are comments, like the provenance of population.csv. It returns the people, and the conditions with a
+// column, in the order of AllQOFConditions.
+func readObservedPeople(filename string) ([]observedPerson, []QOFCondition, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	columns := make(map[string]int)
+	conditionColumns := make(map[QOFCondition]int)
+	for i, column := range row {
+		columns[column] = i
+		if strings.HasPrefix(column, "condition_") {
+			if c := QOFConditionFromString(strings.TrimPrefix(column, "condition_")); c != QOFConditionInvalid {
+				conditionColumns[c] = i
+			}
+		}
+	}
+	age, ok := columns["age"]
+	if !ok {
+		if age, ok = columns["age_band"]; !ok {
+			return nil, nil, fmt.Errorf("%s: no age or age_band column", filename)
+		}
+	}
+	sex, ok := columns["sex"]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: no sex column", filename)
+	}
+	conditions := make([]QOFCondition, 0, len(conditionColumns))
+	for _, c := range AllQOFConditions() {
+		if _, ok := conditionColumns[c]; ok {
+			conditions = append(conditions, c)
+		}
+	}
+
+	people := make([]observedPerson, 0)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		line, _ := r.FieldPos(0)
+		p := observedPerson{Sex: SexFromString(row[sex])}
+		if p.Sex.String() != row[sex] {
+			return nil, nil, fmt.Errorf("%s:%d: unknown sex %q", filename, line, row[sex])
+		}
+		if p.AgeBegin, p.AgeEnd, err = parseAgeRange(row[age]); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: bad age: %s", filename, line, err)
+		}
+		for c, i := range conditionColumns {
+			switch row[i] {
+			case "1":
+				p.Conditions.Add(c)
+			case "0", "":
+			default:
+				return nil, nil, fmt.Errorf("%s:%d: bad value %q for %s", filename, line, row[i], c)
+			}
+		}
+		people = append(people, p)
+	}
+	return people, conditions, nil
+}
+
+// parseAgeBands parses comma separated ages at which each band begins, in
+// increasing order, returning the bands, the last of which is open ended.
+func parseAgeBands(s string) ([]AgeRange, error) {
+	begins := strings.Split(s, ",")
+	bands := make([]AgeRange, 0, len(begins))
+	for i, b := range begins {
+		begin, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("bad age band %q", b)
+		}
+		if i > 0 {
+			if begin <= bands[i-1].Begin {
+				return nil, fmt.Errorf("age bands must increase, but %d follows %d", begin, bands[i-1].Begin)
+			}
+			bands[i-1].End = begin
+		}
+		bands = append(bands, AgeRange{Begin: begin})
+	}
+	return bands, nil
+}
+
+// bandOf returns the index of the band containing every age of p, -1 if
+// p is younger than the first band, or an error if p's age band straddles
+// more than one.
+func bandOf(p *observedPerson, bands []AgeRange) (int, error) {
+	if p.AgeEnd < bands[0].Begin {
+		return -1, nil
+	}
+	for i, band := range bands {
+		if band.Contains(p.AgeBegin) {
+			if band.Contains(p.AgeEnd) {
+				return i, nil
+			}
+			break
+		}
+	}
+	return -1, fmt.Errorf("ages %d-%d don't fall within a single age band", p.AgeBegin, p.AgeEnd)
+}
+
+// estimatePrevalences returns the proportion of people with each of the
+// prevalences in diagnoses, by sex and age band. Sexes without people
+// aren't included, and bands of a sex without people have a prevalence of
+// 0, and are logged.
+func estimatePrevalences(people []observedPerson, diagnoses []DiagonosisGiven, bands []AgeRange) ([]Prevalences, error) {
+	sexes := []Sex{Male, Female, Other}
+	n := make([][]int, len(sexes))
+	for i := range n {
+		n[i] = make([]int, len(bands))
+	}
+	matches := make([][][]int, len(diagnoses))
+	for i := range matches {
+		matches[i] = make([][]int, len(sexes))
+		for j := range matches[i] {
+			matches[i][j] = make([]int, len(bands))
+		}
+	}
+	for i := range people {
+		p := &people[i]
+		band, err := bandOf(p, bands)
+		if err != nil {
+			return nil, err
+		} else if band < 0 {
+			continue
+		}
+		n[p.Sex][band]++
+		for j, d := range diagnoses {
+			if p.Conditions&d.Diagnosis.Present == d.Diagnosis.Present && p.Conditions&d.Diagnosis.Absent == 0 {
+				matches[j][p.Sex][band]++
+			}
+		}
+	}
+
+	present := make([]Sex, 0, len(sexes))
+	for _, sex := range sexes {
+		if sum(n[sex]) > 0 {
+			present = append(present, sex)
+		}
+	}
+	if len(present) == 0 {
+		return nil, fmt.Errorf("no people aged %d or over", bands[0].Begin)
+	}
+	for _, sex := range present {
+		for i, band := range bands {
+			if n[sex][i] == 0 {
+				Warningf("estimate: no people of sex %s aged %s", sex, AgePrevalence{Ages: band})
+			}
+		}
+	}
+
+	scale := math.Pow(10.0, EstimatedPrevalencePlaces)
+	estimated := make([]Prevalences, 0, len(diagnoses))
+	for i, d := range diagnoses {
+		p := Prevalences{Conditions: d, ByAge: make(AgePrevalences, present[len(present)-1]+1)}
+		for _, sex := range present {
+			p.ByAge[sex] = make([]AgePrevalence, len(bands))
+			for j, band := range bands {
+				p.ByAge[sex][j].Ages = band
+				if n[sex][j] > 0 {
+					p.ByAge[sex][j].Prevalence = math.Round(scale*float64(matches[i][sex][j])/float64(n[sex][j])) / scale
+				}
+			}
+		}
+		estimated = append(estimated, p)
+	}
+	return estimated, nil
+}
+
+// writeEstimatedPrevalences writes prevalences to filename, in the form
+// of data/prevalences.yaml, with a comment giving their source.
+func writeEstimatedPrevalences(prevalences []Prevalences, source string, people int, filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "# Condition prevalence, for single conditions and comorbidity pairs,\n# by age and sex, estimated by estimate-prevalences from the %d people\n# of %s.\n", people, source)
+	e := yaml.NewEncoder(f)
+	e.SetIndent(4)
+	for _, p := range prevalences {
+		if err := e.Encode(p); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := e.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func estimatePrevalencesMain(args []string) error {
+	flags := newFlagSet("estimate-prevalences", "Estimate the prevalences of single conditions and pairs of conditions, by age and sex, from a person level extract with the columns of population.csv, writing them in the form of "+PrevalencesFilename)
+	base := addBaseFlags(flags)
+	inputFlag := flags.String("input", "", "Person level CSV extract, with sex, age or age_band, and a condition_<name> column for each condition, with 1 for people with it")
+	conditionsFlag := flags.String("conditions", "", "Comma separated conditions whose prevalences are estimated, by default every condition with a column in --input")
+	bandsFlag := flags.String("age-bands", DefaultEstimatedAgeBands, "Comma separated ages at which each age band of the estimated prevalences begins, the last being open ended")
+	outputFlag := flags.String("output", "output/prevalences.yaml", "File to which the estimated prevalences are written")
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	if *inputFlag == "" {
+		return fmt.Errorf("--input is required")
+	}
+	bands, err := parseAgeBands(*bandsFlag)
+	if err != nil {
+		return err
+	}
+	people, columns, err := readObservedPeople(*inputFlag)
+	if err != nil {
+		return err
+	}
+	conditions := columns
+	if *conditionsFlag != "" {
+		if conditions, err = readConditions(*conditionsFlag); err != nil {
+			return err
+		}
+		var given QOFConditions
+		for _, c := range columns {
+			given.Add(c)
+		}
+		for _, c := range conditions {
+			if !given.Contains(c) {
+				return fmt.Errorf("%s: no column for %s", *inputFlag, c)
+			}
+		}
+	} else if len(conditions) == 0 {
+		return fmt.Errorf("%s: no condition columns", *inputFlag)
+	}
+	names := make([]string, len(conditions))
+	for i, c := range conditions {
+		names[i] = c.String()
+	}
+	log.Printf("estimate: people: %d conditions: %s", len(people), strings.Join(names, ","))
+
+	// The single conditions and pairs that the simulation of the
+	// conditions reads
+	prevalences, err := estimatePrevalences(people, requiredPrevalences(conditions), bands)
+	if err != nil {
+		return fmt.Errorf("%s: %s", *inputFlag, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*outputFlag), 0755); err != nil {
+		return err
+	}
+	if err := writeEstimatedPrevalences(prevalences, *inputFlag, len(people), *outputFlag); err != nil {
+		return err
+	}
+	log.Printf("estimate: wrote %d prevalences to %s", len(prevalences), *outputFlag)
+	problems, warnings, err := checkPrevalences(*outputFlag, conditions)
+	if err != nil {
+		return err
+	}
+	for _, problem := range append(problems, warnings...) {
+		Warningf("estimate: %s", problem)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeObservedPeople(t *testing.T, lines ...string) string {
+	filename := filepath.Join(t.TempDir(), "people.csv")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadObservedPeople(t *testing.T) {
+	filename := writeObservedPeople(t,
+		"# provenance",
+		"id,sex,age_band,condition_hyp,condition_dm,condition_unknown",
+		"1,m,40-44,1,0,x",
+		"2,f,75+,,1,",
+		"3,o,16,0,0,",
+	)
+	people, conditions, err := readObservedPeople(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conditions) != 2 || conditions[0] != QOFConditionDiabetes || conditions[1] != QOFConditionHypertension {
+		t.Errorf("expected dm and hyp, in the order of AllQOFConditions, found %v", conditions)
+	}
+	expected := []observedPerson{
+		{Sex: Male, AgeBegin: 40, AgeEnd: 44},
+		{Sex: Female, AgeBegin: 75, AgeEnd: ServedMaxAge},
+		{Sex: Other, AgeBegin: 16, AgeEnd: 16},
+	}
+	expected[0].Conditions.Add(QOFConditionHypertension)
+	expected[1].Conditions.Add(QOFConditionDiabetes)
+	if len(people) != len(expected) {
+		t.Fatalf("expected %d people, found %d", len(expected), len(people))
+	}
+	for i := range expected {
+		if people[i] != expected[i] {
+			t.Errorf("expected %+v, found %+v", expected[i], people[i])
+		}
+	}
+
+	bad := []struct {
+		row   string
+		error string
+	}{
+		{"male,40,1", `:2: unknown sex "male"`},
+		{",40,1", `:2: unknown sex ""`},
+		{"m,40,yes", `:2: bad value "yes" for hyp`},
+		{"m,x,1", ":2: bad age"},
+	}
+	for _, test := range bad {
+		_, _, err := readObservedPeople(writeObservedPeople(t, "sex,age,condition_hyp", test.row))
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%q: expected an error containing %q, found %v", test.row, test.error, err)
+		}
+	}
+	if _, _, err := readObservedPeople(writeObservedPeople(t, "age,condition_hyp", "40,1")); err == nil {
+		t.Errorf("expected an error without a sex column")
+	}
+}
+
+func TestParseAgeBandsAndBandOf(t *testing.T) {
+	bands, err := parseAgeBands("16, 45,65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bands) != 3 || bands[0] != (AgeRange{Begin: 16, End: 45}) || bands[2] != (AgeRange{Begin: 65}) {
+		t.Errorf("unexpected bands %v", bands)
+	}
+	for _, s := range []string{"16,16", "45,16", "16,x"} {
+		if _, err := parseAgeBands(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	tests := []struct {
+		begin    int
+		end      int
+		expected int
+		valid    bool
+	}{
+		{0, 15, -1, true},
+		{16, 16, 0, true},
+		{40, 44, 0, true},
+		{65, ServedMaxAge, 2, true},
+		{40, 49, -1, false},
+	}
+	for _, test := range tests {
+		band, err := bandOf(&observedPerson{AgeBegin: test.begin, AgeEnd: test.end}, bands)
+		if (err == nil) != test.valid || band != test.expected {
+			t.Errorf("%d-%d: expected band %d, found %d, %v", test.begin, test.end, test.expected, band, err)
+		}
+	}
+}
+
+func TestEstimatePrevalences(t *testing.T) {
+	bands, err := parseAgeBands("16,65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hyp, both QOFConditions
+	hyp.Add(QOFConditionHypertension)
+	both.Add(QOFConditionHypertension)
+	both.Add(QOFConditionDiabetes)
+	people := []observedPerson{
+		{Sex: Male, AgeBegin: 20, AgeEnd: 20, Conditions: hyp},
+		{Sex: Male, AgeBegin: 30, AgeEnd: 30},
+		{Sex: Male, AgeBegin: 70, AgeEnd: 70, Conditions: both},
+		{Sex: Female, AgeBegin: 70, AgeEnd: 70},
+		// Younger than the first band
+		{Sex: Female, AgeBegin: 10, AgeEnd: 10, Conditions: hyp},
+	}
+	diagnoses := []DiagonosisGiven{OneCondition(QOFConditionHypertension), TwoConditions(QOFConditionHypertension, QOFConditionDiabetes)}
+	estimated, err := estimatePrevalences(people, diagnoses, bands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		diagnosis int
+		sex       Sex
+		age       int
+		expected  float64
+	}{
+		{0, Male, 20, 0.5},
+		{0, Male, 70, 1.0},
+		{0, Female, 20, 0.0},
+		{0, Female, 70, 0.0},
+		{1, Male, 20, 0.0},
+		{1, Male, 70, 1.0},
+	}
+	for _, test := range tests {
+		if p := estimated[test.diagnosis].ByAge.Prevalence(test.sex, test.age); p != test.expected {
+			t.Errorf("%s: expected %f for %s aged %d, found %f", diagnoses[test.diagnosis], test.expected, test.sex, test.age, p)
+		}
+	}
+	if len(estimated[0].ByAge) != 2 {
+		t.Errorf("expected no prevalences for the other sex, without people of it")
+	}
+	if _, err := estimatePrevalences(people[4:], diagnoses, bands); err == nil {
+		t.Errorf("expected an error without people in any band")
+	}
+}
+
+func TestEstimatePrevalencesMainCreatesOutputDirectory(t *testing.T) {
+	input := writeObservedPeople(t, "sex,age,condition_hyp", "m,20,1", "m,30,0", "f,20,0", "f,30,1")
+	output := filepath.Join(t.TempDir(), "estimated", "prevalences.yaml")
+	if err := estimatePrevalencesMain([]string{"--input=" + input, "--age-bands=16", "--output=" + output}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var p Prevalences
+	if err := yaml.NewDecoder(f).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Conditions != OneCondition(QOFConditionHypertension) || p.ByAge.Prevalence(Male, 40) != 0.5 || p.ByAge.Prevalence(Female, 40) != 0.5 {
+		t.Errorf("expected a prevalence of 0.5 for hyp, found %v", p)
+	}
+}
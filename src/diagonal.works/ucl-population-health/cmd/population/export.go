@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type export struct {
+	Filenames []string
+	Write     func() error
+}
+
+// Exports collects the writers for a run's outputs, which only read the
+// simulated population, so they can be run concurrently once simulation
+// is complete. The number of concurrent writers is bounded, as each holds
+// its own aggregates in memory while writing.
+type Exports struct {
+	exports []export
+}
+
+// Add queues write, which produces the given output, recorded in the
+// manifest with description.
+func (e *Exports) Add(filename string, description string, manifest *Manifest, write func() error) {
+	manifest.AddOutput(filename, description)
+	e.exports = append(e.exports, export{Filenames: []string{filename}, Write: write})
+}
+
+// AddMany queues write, which produces several outputs, recorded in the
+// manifest with the corresponding descriptions.
+func (e *Exports) AddMany(filenames []string, descriptions []string, manifest *Manifest, write func() error) {
+	for i := range filenames {
+		manifest.AddOutput(filenames[i], descriptions[i])
+	}
+	e.exports = append(e.exports, export{Filenames: filenames, Write: write})
+}
+
+// Run calls the queued writers, with at most writers running at once,
+// returning the first error encountered, after all writers have finished.
+func (e *Exports) Run(writers int) error {
+	if writers < 1 {
+		writers = 1
+	}
+	log.Printf("write outputs: %d writers", writers)
+	c := make(chan export)
+	done := make(chan error, writers)
+	f := func() {
+		var err error
+		for ex := range c {
+			start := time.Now()
+			if e := ex.Write(); e != nil {
+				if err == nil {
+					err = fmt.Errorf("%s: %s", ex.Filenames[0], e)
+				}
+				continue
+			}
+			log.Printf("  %v: %s", ex.Filenames, time.Since(start).Round(time.Millisecond))
+		}
+		done <- err
+	}
+	for i := 0; i < writers; i++ {
+		go f()
+	}
+	for _, ex := range e.exports {
+		c <- ex
+	}
+	close(c)
+	var err error
+	for i := 0; i < writers; i++ {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
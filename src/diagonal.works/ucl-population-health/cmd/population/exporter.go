@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PersonStream calls each for every person written to outputs, in order,
+// stopping at the first error. Streams can be called more than once.
+type PersonStream func(each func(p *Person) error) error
+
+// ExportTable is a table of typed columns, whose values are given as
+// strings, as written to CSV, with empty numbers written as nulls.
+type ExportTable struct {
+	Fields []ArrowField
+	// Calls each for every row, in order, stopping at the first error
+	Rows func(each func(row []string) error) error
+}
+
+// An Exporter writes the people, practices and aggregates of a simulation
+// in one format. Each is given once, in that order, before Close, which
+// writes anything that remains.
+type Exporter interface {
+	People(columns []PersonColumn, people PersonStream) error
+	// Practices has a row for each of practices, in order
+	Practices(practices []*GPPractice, table *ExportTable) error
+	Aggregates(results []*AggregationResult, table *ExportTable) error
+	Close() error
+}
+
+// ExportData is everything, other than the tables themselves, that an
+// Exporter may need.
+type ExportData struct {
+	Scenario        string
+	Profile         *OutputProfile
+	OutputDirectory string
+	Provenance      *Provenance
+	GPs             map[GPPracticeCode]*GPPractice
+	LSOAs           map[LSOACode]*LSOA
+	MSOAs           map[MSOACode]*MSOA
+	Conditions      []QOFCondition
+	// The database written by the sqlite format, as given to --sqlite,
+	// or SQLiteDefaultFilename in OutputDirectory if empty
+	SQLiteFilename string
+}
+
+// ExportFormat is a format in which the people, practices and aggregates
+// of a simulation can be written, selected with --format.
+type ExportFormat struct {
+	Name        string
+	Description string
+	// Returns the files written, relative to the output directory unless
+	// they're absolute, with their descriptions for the manifest
+	Outputs func(data *ExportData) ([]string, []string)
+	New     func(data *ExportData) (Exporter, error)
+}
+
+var ExportFormatCSV = &ExportFormat{
+	Name:        "csv",
+	Description: "population.csv, gps.csv and aggregates.csv",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		return []string{"population.csv", "gps.csv", "aggregates.csv"}, []string{
+			"Synthetic individuals and their attributes",
+			"GP practices, with aggregate statistics for the synthetic individuals assigned to them",
+			"Aggregate statistics of the synthetic individuals, in tidy form",
+		}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return &csvExporter{data: data}, nil
+	},
+}
+
+var ExportFormatArrow = &ExportFormat{
+	Name:        "arrow",
+	Description: "The same tables as Arrow IPC files",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		return []string{"population.arrow", "gps.arrow", "aggregates.arrow"}, []string{
+			"Synthetic individuals and their attributes, as population.csv, as an Arrow IPC file",
+			"GP practices, as gps.csv, as an Arrow IPC file",
+			"Aggregate statistics, as aggregates.csv, as an Arrow IPC file",
+		}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return &tableExporter{data: data, extension: ".arrow", create: func(filename string, fields []ArrowField, metadata [][2]string) (tableWriter, error) {
+			return NewArrowWriter(filename, fields, metadata, ArrowDefaultBatchRows)
+		}}, nil
+	},
+}
+
+var ExportFormatParquet = &ExportFormat{
+	Name:        "parquet",
+	Description: "The same tables as Parquet files",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		return []string{"population.parquet", "gps.parquet", "aggregates.parquet"}, []string{
+			"Synthetic individuals and their attributes, as population.csv, as a Parquet file",
+			"GP practices, as gps.csv, as a Parquet file",
+			"Aggregate statistics, as aggregates.csv, as a Parquet file",
+		}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return &tableExporter{data: data, extension: ".parquet", create: func(filename string, fields []ArrowField, metadata [][2]string) (tableWriter, error) {
+			return NewParquetWriter(filename, fields, metadata, ParquetDefaultGroupRows)
+		}}, nil
+	},
+}
+
+var ExportFormatSQLite = &ExportFormat{
+	Name:        "sqlite",
+	Description: "A SQLite database of people, practices, LSOAs, MSOAs and aggregate breakdowns",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		filename := SQLiteDefaultFilename
+		if data.SQLiteFilename != "" {
+			filename = data.SQLiteFilename
+		}
+		return []string{filename}, []string{"SQLite database of people, practices, LSOAs, MSOAs and aggregate breakdowns"}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return &sqliteExporter{data: data}, nil
+	},
+}
+
+var ExportFormatPostGIS = &ExportFormat{
+	Name:        "postgis",
+	Description: "A psql script creating and loading the same tables in PostGIS, with practice locations as points",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		return []string{PostGISFilename}, []string{"psql script that creates and loads people, practices and aggregates tables into PostGIS"}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return newPostGISExporter(data)
+	},
+}
+
+var ExportFormatFHIR = &ExportFormat{
+	Name:        "fhir",
+	Description: "FHIR R4 Patient, Organization and Condition resources as NDJSON, marked as test data",
+	Outputs: func(data *ExportData) ([]string, []string) {
+		return []string{FHIRPatientFilename, FHIROrganizationFilename, FHIRConditionFilename}, []string{
+			"Synthetic individuals as FHIR R4 Patient resources, one per line",
+			"GP practices as FHIR R4 Organization resources, one per line",
+			"The conditions of synthetic individuals as FHIR R4 Condition resources, one per line",
+		}
+	},
+	New: func(data *ExportData) (Exporter, error) {
+		return newFHIRExporter(data)
+	},
+}
+
+// ExportFormats is every format that can be given to --format
+var ExportFormats = []*ExportFormat{ExportFormatCSV, ExportFormatArrow, ExportFormatParquet, ExportFormatSQLite, ExportFormatPostGIS, ExportFormatFHIR}
+
+// ExportFormatsFromString returns the formats named in s, separated by
+// commas, in the order given, ignoring repeats.
+func ExportFormatsFromString(s string) ([]*ExportFormat, error) {
+	formats := make([]*ExportFormat, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		format, err := ExportFormatFromString(name)
+		if err != nil {
+			return nil, err
+		}
+		formats = appendExportFormat(formats, format)
+	}
+	return formats, nil
+}
+
+func ExportFormatFromString(s string) (*ExportFormat, error) {
+	names := make([]string, 0, len(ExportFormats))
+	for _, f := range ExportFormats {
+		if f.Name == s {
+			return f, nil
+		}
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown format %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// appendExportFormat adds format to formats, if it's not already there
+func appendExportFormat(formats []*ExportFormat, format *ExportFormat) []*ExportFormat {
+	for _, f := range formats {
+		if f == format {
+			return formats
+		}
+	}
+	return append(formats, format)
+}
+
+// runExporter writes people, practices and aggregates with a new
+// exporter for format.
+func runExporter(format *ExportFormat, data *ExportData, columns []PersonColumn, people PersonStream, practices []*GPPractice, practicesTable *ExportTable, results []*AggregationResult, aggregatesTable *ExportTable) error {
+	e, err := format.New(data)
+	if err != nil {
+		return err
+	}
+	if err := e.People(columns, people); err != nil {
+		e.Close()
+		return err
+	}
+	if err := e.Practices(practices, practicesTable); err != nil {
+		e.Close()
+		return err
+	}
+	if err := e.Aggregates(results, aggregatesTable); err != nil {
+		e.Close()
+		return err
+	}
+	return e.Close()
+}
+
+// peopleTable returns the columns of people as a table
+func peopleTable(columns []PersonColumn, people PersonStream) *ExportTable {
+	fields := make([]ArrowField, len(columns))
+	for i, column := range columns {
+		fields[i] = ArrowField{Name: column.Name, Type: ArrowTypeFromSQL(column.SQLType)}
+	}
+	return &ExportTable{
+		Fields: fields,
+		Rows: func(each func(row []string) error) error {
+			return people(func(p *Person) error {
+				return each(PersonColumnsRow(columns, p))
+			})
+		},
+	}
+}
+
+// csvExporter writes each table as a CSV file, created by createOutput,
+// which starts it with the provenance, if enabled.
+type csvExporter struct {
+	data *ExportData
+}
+
+func (c *csvExporter) People(columns []PersonColumn, people PersonStream) error {
+	return c.write("population.csv", peopleTable(columns, people))
+}
+
+func (c *csvExporter) Practices(practices []*GPPractice, table *ExportTable) error {
+	return c.write("gps.csv", table)
+}
+
+func (c *csvExporter) Aggregates(results []*AggregationResult, table *ExportTable) error {
+	return c.write("aggregates.csv", table)
+}
+
+func (c *csvExporter) Close() error {
+	return nil
+}
+
+func (c *csvExporter) write(filename string, table *ExportTable) error {
+	f, err := createOutput(filepath.Join(c.data.OutputDirectory, filename))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := make([]string, len(table.Fields))
+	for i, field := range table.Fields {
+		header[i] = field.Name
+	}
+	w.Write(header)
+	err = table.Rows(func(row []string) error {
+		return w.Write(row)
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tableWriter writes the rows of a table to a file of typed columns, like
+// ArrowWriter and ParquetWriter.
+type tableWriter interface {
+	Write(row []string) error
+	Close() error
+}
+
+// tableExporter writes each table to a file of typed columns, with the
+// provenance in its metadata.
+type tableExporter struct {
+	data      *ExportData
+	extension string
+	create    func(filename string, fields []ArrowField, metadata [][2]string) (tableWriter, error)
+}
+
+func (t *tableExporter) People(columns []PersonColumn, people PersonStream) error {
+	return t.write("population", peopleTable(columns, people))
+}
+
+func (t *tableExporter) Practices(practices []*GPPractice, table *ExportTable) error {
+	return t.write("gps", table)
+}
+
+func (t *tableExporter) Aggregates(results []*AggregationResult, table *ExportTable) error {
+	return t.write("aggregates", table)
+}
+
+func (t *tableExporter) Close() error {
+	return nil
+}
+
+func (t *tableExporter) write(name string, table *ExportTable) error {
+	w, err := t.create(filepath.Join(t.data.OutputDirectory, name+t.extension), table.Fields, t.data.Provenance.Fields())
+	if err != nil {
+		return err
+	}
+	if err := table.Rows(w.Write); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The NDJSON files written by --format=fhir, named by resource type, as
+// for FHIR bulk data export
+const (
+	FHIRPatientFilename      = "Patient.ndjson"
+	FHIROrganizationFilename = "Organization.ndjson"
+	FHIRConditionFilename    = "Condition.ndjson"
+
+	FHIRSystemNHSNumber         = "https://fhir.nhs.uk/Id/nhs-number"
+	FHIRSystemODSCode           = "https://fhir.nhs.uk/Id/ods-organization-code"
+	FHIRSystemActReason         = "http://terminology.hl7.org/CodeSystem/v3-ActReason"
+	FHIRSystemConditionClinical = "http://terminology.hl7.org/CodeSystem/condition-clinical"
+	FHIRSystemSNOMED            = "http://snomed.info/sct"
+)
+
+// The SNOMED CT concepts of conditions, with their preferred terms.
+// Serious mental illness, which QOF defines as a set of diagnoses, has
+// no single concept, so is given by text alone.
+var fhirConditionCodings = map[QOFCondition]fhirCoding{
+	QOFConditionDiabetes:      {System: FHIRSystemSNOMED, Code: "73211009", Display: "Diabetes mellitus"},
+	QOFConditionType1Diabetes: {System: FHIRSystemSNOMED, Code: "46635009", Display: "Type 1 diabetes mellitus"},
+	QOFConditionType2Diabetes: {System: FHIRSystemSNOMED, Code: "44054006", Display: "Type 2 diabetes mellitus"},
+	QOFConditionHypertension:  {System: FHIRSystemSNOMED, Code: "38341003", Display: "Hypertensive disorder, systemic arterial"},
+	QOFConditionCOPD:          {System: FHIRSystemSNOMED, Code: "13645005", Display: "Chronic obstructive lung disease"},
+	QOFConditionCVD:           {System: FHIRSystemSNOMED, Code: "49601007", Display: "Disorder of cardiovascular system"},
+	QOFConditionCHD:           {System: FHIRSystemSNOMED, Code: "53741008", Display: "Coronary arteriosclerosis"},
+	QOFConditionStroke:        {System: FHIRSystemSNOMED, Code: "62914000", Display: "Cerebrovascular disease"},
+	QOFConditionPAD:           {System: FHIRSystemSNOMED, Code: "399957001", Display: "Peripheral arterial occlusive disease"},
+	QOFConditionDepression:    {System: FHIRSystemSNOMED, Code: "35489007", Display: "Depressive disorder"},
+	QOFConditionAF:            {System: FHIRSystemSNOMED, Code: "49436004", Display: "Atrial fibrillation"},
+	QOFConditionHF:            {System: FHIRSystemSNOMED, Code: "84114007", Display: "Heart failure"},
+}
+
+// fhirConditionCode returns the code of a Condition resource for
+// condition, with its SNOMED CT coding, if it has one, and the condition's
+// QOF abbreviation as text.
+func fhirConditionCode(condition QOFCondition) fhirCodeableConcept {
+	code := fhirCodeableConcept{Text: condition.String()}
+	if coding, ok := fhirConditionCodings[condition]; ok {
+		code.Coding = []fhirCoding{coding}
+	}
+	return code
+}
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+type fhirReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Identifier *fhirIdentifier `json:"identifier,omitempty"`
+}
+
+type fhirMeta struct {
+	Security []fhirCoding `json:"security"`
+}
+
+type fhirHumanName struct {
+	Family string   `json:"family"`
+	Given  []string `json:"given"`
+}
+
+type fhirAddress struct {
+	PostalCode string `json:"postalCode"`
+}
+
+type fhirPatient struct {
+	ResourceType        string           `json:"resourceType"`
+	ID                  string           `json:"id"`
+	Meta                fhirMeta         `json:"meta"`
+	Identifier          []fhirIdentifier `json:"identifier,omitempty"`
+	Name                []fhirHumanName  `json:"name,omitempty"`
+	Gender              string           `json:"gender"`
+	BirthDate           string           `json:"birthDate,omitempty"`
+	GeneralPractitioner []fhirReference  `json:"generalPractitioner,omitempty"`
+}
+
+type fhirOrganization struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id"`
+	Meta         fhirMeta         `json:"meta"`
+	Identifier   []fhirIdentifier `json:"identifier"`
+	Active       bool             `json:"active"`
+	Name         string           `json:"name"`
+	Address      []fhirAddress    `json:"address,omitempty"`
+}
+
+type fhirCondition struct {
+	ResourceType   string              `json:"resourceType"`
+	ID             string              `json:"id"`
+	Meta           fhirMeta            `json:"meta"`
+	ClinicalStatus fhirCodeableConcept `json:"clinicalStatus"`
+	Code           fhirCodeableConcept `json:"code"`
+	Subject        fhirReference       `json:"subject"`
+}
+
+// Every resource is labelled as test data, since none describe real
+// patients
+var fhirTestDataMeta = fhirMeta{
+	Security: []fhirCoding{{System: FHIRSystemActReason, Code: "HTEST", Display: "test health data"}},
+}
+
+// fhirExporter writes people as Patient resources, their conditions as
+// Condition resources, and practices as Organization resources, each as
+// NDJSON. Patients have only the identifiers permitted by the output
+// profile, and their birth year, derived from their age, unless the
+// profile includes dates of birth. Aggregates have no FHIR equivalent,
+// so aren't written.
+type fhirExporter struct {
+	data *ExportData
+}
+
+func newFHIRExporter(data *ExportData) (*fhirExporter, error) {
+	return &fhirExporter{data: data}, nil
+}
+
+func (f *fhirExporter) People(columns []PersonColumn, people PersonStream) error {
+	patients, err := newNDJSONWriter(filepath.Join(f.data.OutputDirectory, FHIRPatientFilename))
+	if err != nil {
+		return err
+	}
+	conditions, err := newNDJSONWriter(filepath.Join(f.data.OutputDirectory, FHIRConditionFilename))
+	if err != nil {
+		patients.Close()
+		return err
+	}
+	err = people(func(p *Person) error {
+		if err := patients.Write(f.patient(p)); err != nil {
+			return err
+		}
+		for _, condition := range AllQOFConditions() {
+			if !p.Conditions.Contains(condition) {
+				continue
+			}
+			c := fhirCondition{
+				ResourceType: "Condition",
+				ID:           fmt.Sprintf("%d-%s", p.ID, condition),
+				Meta:         fhirTestDataMeta,
+				ClinicalStatus: fhirCodeableConcept{
+					Coding: []fhirCoding{{System: FHIRSystemConditionClinical, Code: "active"}},
+				},
+				Code:    fhirConditionCode(condition),
+				Subject: fhirReference{Reference: "Patient/" + strconv.Itoa(p.ID)},
+			}
+			if err := conditions.Write(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		patients.Close()
+		conditions.Close()
+		return err
+	}
+	if err := patients.Close(); err != nil {
+		conditions.Close()
+		return err
+	}
+	return conditions.Close()
+}
+
+func (f *fhirExporter) patient(p *Person) *fhirPatient {
+	patient := &fhirPatient{
+		ResourceType: "Patient",
+		ID:           strconv.Itoa(p.ID),
+		Meta:         fhirTestDataMeta,
+		Gender:       "other",
+	}
+	switch p.Sex {
+	case Male:
+		patient.Gender = "male"
+	case Female:
+		patient.Gender = "female"
+	}
+	if f.data.Profile.Identifiers {
+		if p.NHSNumber != "" {
+			patient.Identifier = []fhirIdentifier{{System: FHIRSystemNHSNumber, Value: p.NHSNumber}}
+		}
+		if p.Name != nil {
+			patient.Name = []fhirHumanName{{Family: p.Name.Family, Given: []string{p.Name.Given}}}
+			patient.BirthDate = p.Name.DateOfBirth.Format("2006-01-02")
+		}
+	}
+	if patient.BirthDate == "" {
+		// FHIR dates may be given to the year alone
+		patient.BirthDate = strconv.Itoa(PopulationEstimateDate.Year() - p.Age)
+	}
+	if p.GP != "" {
+		patient.GeneralPractitioner = []fhirReference{{Identifier: &fhirIdentifier{System: FHIRSystemODSCode, Value: p.GP.String()}}}
+	}
+	return patient
+}
+
+func (f *fhirExporter) Practices(practices []*GPPractice, table *ExportTable) error {
+	w, err := newNDJSONWriter(filepath.Join(f.data.OutputDirectory, FHIROrganizationFilename))
+	if err != nil {
+		return err
+	}
+	for _, gp := range practices {
+		o := fhirOrganization{
+			ResourceType: "Organization",
+			ID:           gp.Code.String(),
+			Meta:         fhirTestDataMeta,
+			Identifier:   []fhirIdentifier{{System: FHIRSystemODSCode, Value: gp.Code.String()}},
+			Active:       gp.Status == GPPracticeStatusActive,
+			Name:         gp.Name,
+		}
+		if gp.Postcode != "" {
+			o.Address = []fhirAddress{{PostalCode: gp.Postcode}}
+		}
+		if err := w.Write(o); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (f *fhirExporter) Aggregates(results []*AggregationResult, table *ExportTable) error {
+	return nil
+}
+
+func (f *fhirExporter) Close() error {
+	return nil
+}
+
+// ndjsonWriter writes values as JSON, one per line
+type ndjsonWriter struct {
+	f *os.File
+	w *bufio.Writer
+	e *json.Encoder
+}
+
+func newNDJSONWriter(filename string) (*ndjsonWriter, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &ndjsonWriter{f: f, w: w, e: json.NewEncoder(w)}, nil
+}
+
+func (n *ndjsonWriter) Write(v interface{}) error {
+	return n.e.Encode(v)
+}
+
+func (n *ndjsonWriter) Close() error {
+	if err := n.w.Flush(); err != nil {
+		n.f.Close()
+		return err
+	}
+	return n.f.Close()
+}
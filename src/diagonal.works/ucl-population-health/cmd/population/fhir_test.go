@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFHIRExporterCodesConditions(t *testing.T) {
+	data := &ExportData{OutputDirectory: t.TempDir(), Profile: &OutputProfile{}}
+	f, err := newFHIRExporter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conditions QOFConditions
+	conditions.Add(QOFConditionDiabetes)
+	conditions.Add(QOFConditionSMI)
+	people := func(each func(p *Person) error) error {
+		return each(&Person{ID: 7, Age: 40, Sex: Female, Conditions: conditions})
+	}
+	if err := f.People(nil, people); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(filepath.Join(data.OutputDirectory, FHIRConditionFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var found []fhirCondition
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		var c fhirCondition
+		if err := json.Unmarshal(s.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, c)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 conditions, found %d", len(found))
+	}
+	tests := []struct {
+		id     string
+		text   string
+		coding []fhirCoding
+	}{
+		{"7-dm", "dm", []fhirCoding{{System: FHIRSystemSNOMED, Code: "73211009", Display: "Diabetes mellitus"}}},
+		// Without a single SNOMED CT concept
+		{"7-mh", "mh", nil},
+	}
+	for i, test := range tests {
+		c := found[i]
+		if c.ID != test.id || c.Code.Text != test.text || c.Subject.Reference != "Patient/7" {
+			t.Errorf("expected %s with text %s, found %+v", test.id, test.text, c)
+		}
+		if len(c.Code.Coding) != len(test.coding) || (len(test.coding) > 0 && c.Code.Coding[0] != test.coding[0]) {
+			t.Errorf("%s: expected coding %v, found %v", test.id, test.coding, c.Code.Coding)
+		}
+	}
+}
+
+func TestFHIRConditionCodingsAreSNOMED(t *testing.T) {
+	for _, condition := range AllQOFConditions() {
+		coding, ok := fhirConditionCodings[condition]
+		if !ok {
+			if condition != QOFConditionSMI {
+				t.Errorf("expected a coding for %s", condition)
+			}
+			continue
+		}
+		if coding.System != FHIRSystemSNOMED || coding.Code == "" || coding.Display == "" {
+			t.Errorf("%s: expected a SNOMED CT code and term, found %+v", condition, coding)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/golang/geo/s2"
+)
+
+// Flow is the number of patients living in an LSOA registered with a
+// practice, as published, and as simulated
+type Flow struct {
+	Practice  GPPracticeCode
+	LSOA      LSOACode
+	Observed  float64
+	Simulated int
+}
+
+// PracticeFlowValidation compares the LSOAs in which a practice's
+// simulated patients live with those of its registered patients.
+type PracticeFlowValidation struct {
+	Code GPPracticeCode
+	Name string
+	// Registered patients living in LSOAs from which people are drawn
+	Observed float64
+	// Registered patients living elsewhere, who can't be simulated
+	ObservedOutsideHomes float64
+	Simulated            int
+	// The Sørensen similarity of the observed and simulated flows from
+	// each LSOA, 1 if they're identical, and 0 if they share no patients.
+	// Also known as the common part of commuters.
+	Sorensen float64
+}
+
+// ObservedShareOutsideHomes returns the fraction of the practice's
+// registered patients living outside the LSOAs from which people are
+// drawn, or NaN if it has no registered patients.
+func (p *PracticeFlowValidation) ObservedShareOutsideHomes() float64 {
+	if total := p.Observed + p.ObservedOutsideHomes; total > 0.0 {
+		return p.ObservedOutsideHomes / total
+	}
+	return math.NaN()
+}
+
+type FlowValidation struct {
+	Practices []*PracticeFlowValidation
+	Flows     []Flow
+	// The Sørensen similarity over all flows at the selected practices
+	Sorensen float64
+}
+
+// sorensen returns twice the flow common to observed and simulated,
+// divided by the total of both, or NaN if both are empty.
+func sorensen(observed map[LSOACode]float64, simulated map[LSOACode]int) float64 {
+	common, total := 0.0, 0.0
+	for code, o := range observed {
+		common += math.Min(o, float64(simulated[code]))
+		total += o
+	}
+	for _, s := range simulated {
+		total += float64(s)
+	}
+	if total == 0.0 {
+		return math.NaN()
+	}
+	return 2.0 * common / total
+}
+
+// validateFlows compares the origin-destination matrix of simulated
+// patients, from home LSOA to practice, with the registrations published
+// for the selected practices. Only registered patients living in homes
+// are compared, since simulated people are drawn only from there.
+func validateFlows(selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, byPractice map[GPPracticeCode][]*Person, homes LSOASet, observed map[GPPracticeCode]map[LSOACode]float64) *FlowValidation {
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	v := &FlowValidation{}
+	common, total := 0.0, 0.0
+	for _, code := range codes {
+		p := &PracticeFlowValidation{Code: code, Name: gps[code].Name}
+		o := make(map[LSOACode]float64)
+		for lsoa, patients := range observed[code] {
+			if _, ok := homes[lsoa]; ok {
+				o[lsoa] += patients
+				p.Observed += patients
+			} else {
+				p.ObservedOutsideHomes += patients
+			}
+		}
+		s := make(map[LSOACode]int)
+		for _, person := range byPractice[code] {
+			s[person.Home]++
+			p.Simulated++
+		}
+		p.Sorensen = sorensen(o, s)
+		v.Practices = append(v.Practices, p)
+
+		lsoas := make([]LSOACode, 0, len(o)+len(s))
+		for lsoa := range o {
+			lsoas = append(lsoas, lsoa)
+		}
+		for lsoa := range s {
+			if _, ok := o[lsoa]; !ok {
+				lsoas = append(lsoas, lsoa)
+			}
+		}
+		sort.Slice(lsoas, func(i, j int) bool { return lsoas[i] < lsoas[j] })
+		for _, lsoa := range lsoas {
+			v.Flows = append(v.Flows, Flow{Practice: code, LSOA: lsoa, Observed: o[lsoa], Simulated: s[lsoa]})
+			common += math.Min(o[lsoa], float64(s[lsoa]))
+			total += o[lsoa] + float64(s[lsoa])
+		}
+	}
+	v.Sorensen = math.NaN()
+	if total > 0.0 {
+		v.Sorensen = 2.0 * common / total
+	}
+
+	log.Printf("flow validation:")
+	log.Printf("  practices: %d flows: %d sorensen: %f", len(v.Practices), len(v.Flows), v.Sorensen)
+	worst := make([]*PracticeFlowValidation, 0, len(v.Practices))
+	for _, p := range v.Practices {
+		if !math.IsNaN(p.Sorensen) {
+			worst = append(worst, p)
+		}
+	}
+	sort.SliceStable(worst, func(i, j int) bool { return worst[i].Sorensen < worst[j].Sorensen })
+	if len(worst) > ValidationWorstOffenders {
+		worst = worst[0:ValidationWorstOffenders]
+	}
+	for _, p := range worst {
+		Debugf("  %s %s: sorensen: %f", p.Code, p.Name, p.Sorensen)
+	}
+	return v
+}
+
+func formatFraction(f float64) string {
+	if math.IsNaN(f) {
+		return ""
+	}
+	return fmt.Sprintf("%f", f)
+}
+
+// WriteCSV writes flow-validation.csv, comparing flows by practice, and
+// flow-matrix.csv, with the observed and simulated patients from each
+// LSOA to each practice.
+func (v *FlowValidation) WriteCSV(outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "flow-validation.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "observed", "observed_outside_homes", "observed_share_outside_homes", "simulated", "sorensen"})
+	for _, p := range v.Practices {
+		w.Write([]string{
+			p.Code.String(),
+			p.Name,
+			fmt.Sprintf("%f", p.Observed),
+			fmt.Sprintf("%f", p.ObservedOutsideHomes),
+			formatFraction(p.ObservedShareOutsideHomes()),
+			strconv.Itoa(p.Simulated),
+			formatFraction(p.Sorensen),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = createOutput(filepath.Join(outputDirectory, "flow-matrix.csv"))
+	if err != nil {
+		return err
+	}
+	w = csv.NewWriter(f)
+	w.Write([]string{"practice", "lsoa", "observed", "simulated"})
+	for _, flow := range v.Flows {
+		w.Write([]string{flow.Practice.String(), flow.LSOA.String(), fmt.Sprintf("%f", flow.Observed), strconv.Itoa(flow.Simulated)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// simulatedFlows returns the number of simulated people living in each
+// of homes registered with each of the selected practices, ordered by
+// practice, then LSOA.
+func simulatedFlows(selected GPPracticeCodeSet, byPractice map[GPPracticeCode][]*Person, homes LSOASet) []Flow {
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	flows := make([]Flow, 0)
+	for _, code := range codes {
+		byLSOA := make(map[LSOACode]int)
+		for _, p := range byPractice[code] {
+			if _, ok := homes[p.Home]; ok {
+				byLSOA[p.Home]++
+			}
+		}
+		lsoas := make([]LSOACode, 0, len(byLSOA))
+		for lsoa := range byLSOA {
+			lsoas = append(lsoas, lsoa)
+		}
+		sort.Slice(lsoas, func(i, j int) bool { return lsoas[i] < lsoas[j] })
+		for _, lsoa := range lsoas {
+			flows = append(flows, Flow{Practice: code, LSOA: lsoa, Simulated: byLSOA[lsoa]})
+		}
+	}
+	return flows
+}
+
+// writeFlows writes flows.csv, with the simulated patients from each LSOA
+// to each of the selected practices, and flows.geojson, with the same
+// flows as lines from the centre of the LSOA to the practice, for
+// visualisation.
+func writeFlows(selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, byPractice map[GPPracticeCode][]*Person, homes LSOASet, lsoas map[LSOACode]*LSOA, outputDirectory string) error {
+	flows := simulatedFlows(selected, byPractice, homes)
+
+	f, err := createOutput(filepath.Join(outputDirectory, "flows.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"lsoa", "practice", "patients", "share_of_list"})
+	for _, flow := range flows {
+		share := 0.0
+		if gp := gps[flow.Practice]; gp.SimulatedListSize > 0 {
+			share = float64(flow.Simulated) / float64(gp.SimulatedListSize)
+		}
+		w.Write([]string{flow.LSOA.String(), flow.Practice.String(), strconv.Itoa(flow.Simulated), fmt.Sprintf("%f", share)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	invalid := s2.Point{}
+	missingLocations := 0
+	features := make([]*GeoJSONFeature, 0, len(flows))
+	for _, flow := range flows {
+		gp := gps[flow.Practice]
+		if gp.Location == invalid {
+			missingLocations++
+			continue
+		}
+		lsoa := lsoas[flow.LSOA]
+		features = append(features, &GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: lineToGeoJSON(lsoa.Center, gp.Location),
+			Properties: map[string]interface{}{
+				"lsoa":          flow.LSOA.String(),
+				"lsoa_name":     lsoa.Name,
+				"practice":      flow.Practice.String(),
+				"practice_name": gp.Name,
+				"patients":      flow.Simulated,
+			},
+		})
+	}
+	if missingLocations > 0 {
+		Warningf("  flows: %d from practices without locations omitted from flows.geojson, with the practices listed in geocoding.csv", missingLocations)
+	}
+	return writeGeoJSON(filepath.Join(outputDirectory, "flows.geojson"), features)
+}
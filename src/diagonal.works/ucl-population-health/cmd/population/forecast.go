@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// The years forecast, unless years is given, and the most that can be
+	// asked for
+	ServedForecastYears    = 5
+	ServedForecastMaxYears = 30
+)
+
+// ForecastQuery selects the people whose conditions are forecast, as for
+// PopulationQuery, and the number of years to forecast.
+type ForecastQuery struct {
+	PopulationQuery
+	Years int `json:"years,omitempty"`
+}
+
+// ServedForecastCondition is the expected number of people with a
+// condition in a year of a forecast, and the activity they need, if a
+// demand model was loaded.
+type ServedForecastCondition struct {
+	Count      float64 `json:"count"`
+	Prevalence float64 `json:"prevalence"`
+	Activity   float64 `json:"activity,omitempty"`
+}
+
+type ServedForecastYear struct {
+	// Years after the population was simulated, with 0 for the
+	// population as simulated
+	Year       int                                `json:"year"`
+	MeanAge    float64                            `json:"mean_age"`
+	Conditions map[string]ServedForecastCondition `json:"conditions"`
+}
+
+// ServedForecast is the projection of the conditions of the people
+// matching a query, as they age.
+type ServedForecast struct {
+	People int                  `json:"people"`
+	Years  []ServedForecastYear `json:"years"`
+	// Conditions without incidence, whose counts are held constant
+	WithoutIncidence []string `json:"without_incidence,omitempty"`
+	// For queries by polygon, the home LSOAs matched
+	LSOAs []string `json:"lsoas,omitempty"`
+}
+
+// servedAge returns the age used to forecast the conditions of p: their
+// age, the middle of their age band, or the beginning of a top coded band.
+func servedAge(p *servedPerson) int {
+	age := p.AgeBegin
+	if p.AgeEnd != ServedMaxAge {
+		age = (p.AgeBegin + p.AgeEnd) / 2
+	}
+	if age > OnsetMaxAge {
+		age = OnsetMaxAge
+	}
+	return age
+}
+
+// Forecast projects the conditions of the people matching the query
+// forward by the given number of years. Each year, everyone ages by a
+// year, and those without each condition are diagnosed with it according
+// to the annual incidence for their sex and age. The people are aged in
+// place, without deaths, births or migration, so the forecast shows the
+// effect of ageing and incidence on the current residents, and counts are
+// the expected number of people with each condition.
+func (s *ServedPopulation) Forecast(q *PopulationQuery, years int) (*ServedForecast, error) {
+	if s.Incidence == nil {
+		return nil, fmt.Errorf("forecasts need an incidence model, from --incidence")
+	}
+	if years < 0 || years > ServedForecastMaxYears {
+		return nil, fmt.Errorf("years must be between 0 and %d", ServedForecastMaxYears)
+	}
+	selection, err := s.selectPeople(q)
+	if err != nil {
+		return nil, err
+	}
+	forecast := &ServedForecast{People: len(selection.People), LSOAs: selection.LSOAs}
+	meanAge := 0.0
+	for _, p := range selection.People {
+		meanAge += float64(servedAge(p))
+	}
+	if len(selection.People) > 0 {
+		meanAge /= float64(len(selection.People))
+	}
+	for year := 0; year <= years; year++ {
+		forecast.Years = append(forecast.Years, ServedForecastYear{
+			Year:       year,
+			MeanAge:    meanAge + float64(year),
+			Conditions: make(map[string]ServedForecastCondition),
+		})
+	}
+
+	sexes := []Sex{Male, Female, Other}
+	for _, condition := range selection.Conditions {
+		incidence, ok := s.Incidence.ByCondition[condition]
+		if !ok {
+			forecast.WithoutIncidence = append(forecast.WithoutIncidence, condition.String())
+		}
+		// The people without the condition, by sex and age, whose
+		// expected fraction with it grows each year
+		with := 0
+		without := make([][]int, len(sexes))
+		for i := range without {
+			without[i] = make([]int, OnsetMaxAge+1)
+		}
+		for _, p := range selection.People {
+			if p.Conditions.Contains(condition) {
+				with++
+			} else {
+				without[p.Sex][servedAge(p)]++
+			}
+		}
+		diagnosed := make([]float64, years+1)
+		if ok {
+			for _, sex := range sexes {
+				for age, n := range without[sex] {
+					if n == 0 {
+						continue
+					}
+					free := 1.0
+					for year := 1; year <= years; year++ {
+						free *= math.Exp(-incidence.Prevalence(sex, age+year-1))
+						diagnosed[year] += float64(n) * (1.0 - free)
+					}
+				}
+			}
+		}
+		for year := range forecast.Years {
+			c := ServedForecastCondition{Count: float64(with) + diagnosed[year]}
+			if forecast.People > 0 {
+				c.Prevalence = c.Count / float64(forecast.People)
+			}
+			if demand, ok := s.Demand[condition]; ok {
+				c.Activity = c.Count * demand.Annual
+			}
+			forecast.Years[year].Conditions[condition.String()] = c
+		}
+	}
+	return forecast, nil
+}
+
+// serveForecast answers /forecast, with the same filters as /population,
+// and years, given as parameters of a GET, or a JSON ForecastQuery in the
+// body of a POST.
+func (s *ServedPopulation) serveForecast(w http.ResponseWriter, r *http.Request) {
+	q := &ForecastQuery{Years: ServedForecastYears}
+	switch r.Method {
+	case http.MethodGet:
+		q.PopulationQuery = *PopulationQueryFromRequest(r)
+		if v := r.URL.Query().Get("years"); v != "" {
+			years, err := strconv.Atoi(v)
+			if err != nil {
+				writeServedJSON(w, http.StatusBadRequest, servedError{Error: fmt.Sprintf("bad years %q", v)})
+				return
+			}
+			q.Years = years
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ServedMaxQueryBytes)).Decode(q); err != nil {
+			writeServedJSON(w, http.StatusBadRequest, servedError{Error: fmt.Sprintf("bad query: %s", err)})
+			return
+		}
+	default:
+		writeServedJSON(w, http.StatusMethodNotAllowed, servedError{Error: "expected GET or POST"})
+		return
+	}
+	forecast, err := s.Forecast(&q.PopulationQuery, q.Years)
+	if err != nil {
+		writeServedJSON(w, http.StatusBadRequest, servedError{Error: err.Error()})
+		return
+	}
+	writeServedJSON(w, http.StatusOK, forecast)
+}
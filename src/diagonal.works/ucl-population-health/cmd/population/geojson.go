@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+type GeoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates [][][][]float64 `json:"coordinates"`
+}
+
+type GeoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+func lineToGeoJSON(points ...s2.Point) *GeoJSONLineString {
+	l := &GeoJSONLineString{Type: "LineString"}
+	for _, p := range points {
+		ll := s2.LatLngFromPoint(p)
+		l.Coordinates = append(l.Coordinates, []float64{ll.Lng.Degrees(), ll.Lat.Degrees()})
+	}
+	return l
+}
+
+type GeoJSONFeature struct {
+	Type string `json:"type"`
+	// Either a *GeoJSONGeometry or *GeoJSONLineString
+	Geometry   interface{}            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*GeoJSONFeature `json:"features"`
+}
+
+// polygonToGeoJSON returns the coordinates of a GeoJSON MultiPolygon for
+// the given s2 polygon. s2 orders loops such that holes directly follow
+// the shell containing them, and OrientedVertex returns holes clockwise,
+// as required by RFC 7946.
+func polygonToGeoJSON(p *s2.Polygon) [][][][]float64 {
+	polygons := make([][][][]float64, 0, 1)
+	for i := 0; i < p.NumLoops(); i++ {
+		loop := p.Loop(i)
+		ring := make([][]float64, 0, loop.NumVertices()+1)
+		for j := 0; j < loop.NumVertices(); j++ {
+			ll := s2.LatLngFromPoint(loop.OrientedVertex(j))
+			ring = append(ring, []float64{ll.Lng.Degrees(), ll.Lat.Degrees()})
+		}
+		if len(ring) > 0 {
+			ring = append(ring, ring[0])
+		}
+		if !loop.IsHole() || len(polygons) == 0 {
+			polygons = append(polygons, [][][]float64{ring})
+		} else {
+			polygons[len(polygons)-1] = append(polygons[len(polygons)-1], ring)
+		}
+	}
+	return polygons
+}
+
+// polygonsFromGeoJSON returns the s2 polygons of a GeoJSON Polygon or
+// MultiPolygon, given either as a geometry, or as a Feature with one, as
+// written by most drawing tools. Rings of fewer than three distinct
+// vertices are invalid. Since not every tool writes shells anticlockwise,
+// each ring is oriented to cover the smaller area it bounds, with holes
+// found by nesting.
+func polygonsFromGeoJSON(data []byte) ([]*s2.Polygon, error) {
+	var g struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+		Geometry    json.RawMessage `json:"geometry"`
+	}
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	var coordinates [][][][]float64
+	switch g.Type {
+	case "Feature":
+		if len(g.Geometry) == 0 {
+			return nil, fmt.Errorf("feature has no geometry")
+		}
+		return polygonsFromGeoJSON(g.Geometry)
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		coordinates = [][][][]float64{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected a Polygon or MultiPolygon, found %q", g.Type)
+	}
+	polygons := make([]*s2.Polygon, 0, len(coordinates))
+	for _, rings := range coordinates {
+		loops := make([]*s2.Loop, 0, len(rings))
+		for _, ring := range rings {
+			points := make([]s2.Point, 0, len(ring))
+			for _, c := range ring {
+				if len(c) < 2 {
+					return nil, fmt.Errorf("bad coordinate %v", c)
+				}
+				p := s2.PointFromLatLng(s2.LatLngFromDegrees(c[1], c[0]))
+				if len(points) == 0 || points[len(points)-1] != p {
+					points = append(points, p)
+				}
+			}
+			if len(points) > 1 && points[0] == points[len(points)-1] {
+				points = points[0 : len(points)-1]
+			}
+			if len(points) < 3 {
+				return nil, fmt.Errorf("ring with fewer than 3 vertices")
+			}
+			loop := s2.LoopFromPoints(points)
+			loop.Normalize()
+			loops = append(loops, loop)
+		}
+		if len(loops) > 0 {
+			polygons = append(polygons, s2.PolygonFromLoops(loops))
+		}
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no polygons")
+	}
+	return polygons, nil
+}
+
+func areaToGeoJSON(area b6.AreaFeature) *GeoJSONGeometry {
+	g := &GeoJSONGeometry{Type: "MultiPolygon"}
+	for i := 0; i < area.Len(); i++ {
+		g.Coordinates = append(g.Coordinates, polygonToGeoJSON(area.Polygon(i))...)
+	}
+	return g
+}
+
+func findLSOABoundary(code LSOACode, year int, w b6.World) b6.AreaFeature {
+	id := b6.FeatureIDFromUKONSCode(code.String(), year, b6.FeatureTypeArea)
+	return b6.FindAreaByID(id.ToAreaID(), w)
+}
+
+// findMSOABoundary returns the MSOA boundary from the world if present,
+// otherwise it falls back to the union of the boundaries of the LSOAs
+// within it, without dissolving shared edges. MSOAs are always drawn from
+// the 2011 census, as that's the geography of our lookup.
+func findMSOABoundary(code MSOACode, lsoas []LSOACode, geography *CensusGeography, w b6.World) *GeoJSONGeometry {
+	id := b6.FeatureIDFromUKONSCode(code.String(), 2011, b6.FeatureTypeArea)
+	if area := b6.FindAreaByID(id.ToAreaID(), w); area != nil {
+		return areaToGeoJSON(area)
+	}
+	g := &GeoJSONGeometry{Type: "MultiPolygon"}
+	for _, lsoa := range lsoas {
+		if area := findLSOABoundary(lsoa, geography.Year, w); area != nil {
+			g.Coordinates = append(g.Coordinates, areaToGeoJSON(area).Coordinates...)
+		}
+	}
+	if len(g.Coordinates) == 0 {
+		return nil
+	}
+	return g
+}
+
+type AreaConditionCounts struct {
+	People     int
+	Conditions map[QOFCondition]int
+}
+
+func (a *AreaConditionCounts) Add(p *Person, conditions []QOFCondition) {
+	a.People++
+	for _, c := range conditions {
+		if p.Conditions.Contains(c) {
+			a.Conditions[c]++
+		}
+	}
+}
+
+func (a *AreaConditionCounts) ToProperties(conditions []QOFCondition) map[string]interface{} {
+	properties := map[string]interface{}{"people": a.People}
+	for _, c := range conditions {
+		properties[fmt.Sprintf("count_%s", c)] = a.Conditions[c]
+		prevalence := 0.0
+		if a.People > 0 {
+			prevalence = float64(a.Conditions[c]) / float64(a.People)
+		}
+		properties[fmt.Sprintf("prevalence_%s", c)] = prevalence
+	}
+	return properties
+}
+
+func writeGeoJSON(filename string, features []*GeoJSONFeature) error {
+	return writeJSONOutput(filename, &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features}, false)
+}
+
+// writeConditionGeoJSON writes the simulated condition counts and
+// prevalences for people living in homes, by LSOA and MSOA, joined to
+// their boundaries from the world.
+func writeConditionGeoJSON(people []Person, homes LSOASet, conditions []QOFCondition, lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, geography *CensusGeography, w b6.World, outputDirectory string) error {
+	byLSOA := make(map[LSOACode]*AreaConditionCounts)
+	byMSOA := make(map[MSOACode]*AreaConditionCounts)
+	msoaLSOAs := make(map[MSOACode][]LSOACode)
+	for home := range homes {
+		byLSOA[home] = &AreaConditionCounts{Conditions: make(map[QOFCondition]int)}
+		if msoa := lsoas[home].MSOACode; msoa != "" {
+			if _, ok := byMSOA[msoa]; !ok {
+				byMSOA[msoa] = &AreaConditionCounts{Conditions: make(map[QOFCondition]int)}
+			}
+			msoaLSOAs[msoa] = append(msoaLSOAs[msoa], home)
+		}
+	}
+	for i := range people {
+		if counts, ok := byLSOA[people[i].Home]; ok {
+			counts.Add(&people[i], conditions)
+			if msoa, ok := byMSOA[lsoas[people[i].Home].MSOACode]; ok {
+				msoa.Add(&people[i], conditions)
+			}
+		}
+	}
+
+	missingBoundaries := 0
+	features := make([]*GeoJSONFeature, 0, len(byLSOA))
+	for code, counts := range byLSOA {
+		area := findLSOABoundary(code, geography.Year, w)
+		if area == nil {
+			missingBoundaries++
+			continue
+		}
+		properties := counts.ToProperties(conditions)
+		properties["code"] = code.String()
+		properties["name"] = lsoas[code].Name
+		properties["msoa"] = lsoas[code].MSOACode.String()
+		features = append(features, &GeoJSONFeature{Type: "Feature", Geometry: areaToGeoJSON(area), Properties: properties})
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Properties["code"].(string) < features[j].Properties["code"].(string)
+	})
+	if err := writeGeoJSON(filepath.Join(outputDirectory, "lsoa-conditions.geojson"), features); err != nil {
+		return err
+	}
+	log.Printf("  lsoas: %d missing boundaries: %d", len(features), missingBoundaries)
+
+	missingBoundaries = 0
+	features = make([]*GeoJSONFeature, 0, len(byMSOA))
+	for code, counts := range byMSOA {
+		sort.Slice(msoaLSOAs[code], func(i, j int) bool { return msoaLSOAs[code][i] < msoaLSOAs[code][j] })
+		geometry := findMSOABoundary(code, msoaLSOAs[code], geography, w)
+		if geometry == nil {
+			missingBoundaries++
+			continue
+		}
+		properties := counts.ToProperties(conditions)
+		properties["code"] = code.String()
+		if msoa, ok := msoas[code]; ok {
+			properties["name"] = msoa.Name
+		}
+		features = append(features, &GeoJSONFeature{Type: "Feature", Geometry: geometry, Properties: properties})
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Properties["code"].(string) < features[j].Properties["code"].(string)
+	})
+	if err := writeGeoJSON(filepath.Join(outputDirectory, "msoa-conditions.geojson"), features); err != nil {
+		return err
+	}
+	log.Printf("  msoas: %d missing boundaries: %d", len(features), missingBoundaries)
+	return nil
+}
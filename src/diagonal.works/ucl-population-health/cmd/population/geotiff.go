@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// TIFF tags, and GeoTIFF keys, used by writeGeoTIFF, see
+// https://docs.ogc.org/is/19-008r4/19-008r4.html
+const (
+	tiffTagImageWidth       = 256
+	tiffTagImageLength      = 257
+	tiffTagBitsPerSample    = 258
+	tiffTagCompression      = 259
+	tiffTagPhotometric      = 262
+	tiffTagImageDescription = 270
+	tiffTagStripOffsets     = 273
+	tiffTagSamplesPerPixel  = 277
+	tiffTagRowsPerStrip     = 278
+	tiffTagStripByteCounts  = 279
+	tiffTagPlanarConfig     = 284
+	tiffTagSampleFormat     = 339
+	tiffTagModelPixelScale  = 33550
+	tiffTagModelTiepoint    = 33922
+	tiffTagGeoKeyDirectory  = 34735
+
+	tiffTypeASCII  = 2
+	tiffTypeShort  = 3
+	tiffTypeLong   = 4
+	tiffTypeDouble = 12
+
+	geoKeyModelType      = 1024
+	geoKeyRasterType     = 1025
+	geoKeyGeographicType = 2048
+
+	geoModelTypeGeographic = 2
+	geoRasterPixelIsArea   = 1
+	geoEPSGWGS84           = 4326
+)
+
+// Raster is a single band grid of values in WGS84, with rows ordered from
+// north to south, and columns from west to east.
+type Raster struct {
+	Width  int
+	Height int
+	// The longitude and latitude of the north west corner of the grid
+	West  float64
+	North float64
+	// The size of each cell, in degrees
+	CellLng float64
+	CellLat float64
+	Values  []float32
+	// Written as the TIFF ImageDescription, if not empty
+	Description string
+}
+
+func NewRaster(width int, height int, west float64, north float64, cellLng float64, cellLat float64) *Raster {
+	return &Raster{
+		Width:   width,
+		Height:  height,
+		West:    west,
+		North:   north,
+		CellLng: cellLng,
+		CellLat: cellLat,
+		Values:  make([]float32, width*height),
+	}
+}
+
+// Cell returns the column and row of the cell containing the given
+// location, and false if it lies outside the grid.
+func (r *Raster) Cell(lng float64, lat float64) (int, int, bool) {
+	x := int(math.Floor((lng - r.West) / r.CellLng))
+	y := int(math.Floor((r.North - lat) / r.CellLat))
+	return x, y, x >= 0 && x < r.Width && y >= 0 && y < r.Height
+}
+
+// CellCenter returns the longitude and latitude of the centre of a cell
+func (r *Raster) CellCenter(x int, y int) (float64, float64) {
+	return r.West + (float64(x)+0.5)*r.CellLng, r.North - (float64(y)+0.5)*r.CellLat
+}
+
+type tiffEntry struct {
+	Tag    uint16
+	Type   uint16
+	Shorts []uint16
+	Longs  []uint32
+	Double []float64
+	// NUL terminated, and padded to an even length, as values must start
+	// on a word boundary
+	ASCII []byte
+}
+
+func (e *tiffEntry) count() int {
+	return len(e.Shorts) + len(e.Longs) + len(e.Double) + len(e.ASCII)
+}
+
+func (e *tiffEntry) size() int {
+	return 2*len(e.Shorts) + 4*len(e.Longs) + 8*len(e.Double) + len(e.ASCII)
+}
+
+// writeGeoTIFF writes the raster as an uncompressed, single strip,
+// 32 bit floating point GeoTIFF, georeferenced with a tie point at the
+// north west corner, and the cell size.
+func writeGeoTIFF(filename string, r *Raster) error {
+	const headerSize = 8
+	imageSize := 4 * len(r.Values)
+	entries := []*tiffEntry{
+		{Tag: tiffTagImageWidth, Type: tiffTypeLong, Longs: []uint32{uint32(r.Width)}},
+		{Tag: tiffTagImageLength, Type: tiffTypeLong, Longs: []uint32{uint32(r.Height)}},
+		{Tag: tiffTagBitsPerSample, Type: tiffTypeShort, Shorts: []uint16{32}},
+		{Tag: tiffTagCompression, Type: tiffTypeShort, Shorts: []uint16{1}},
+		{Tag: tiffTagPhotometric, Type: tiffTypeShort, Shorts: []uint16{1}},
+	}
+	// Entries must be in order of tag
+	if r.Description != "" {
+		description := append([]byte(r.Description), 0)
+		if len(description)%2 != 0 {
+			description = append(description, 0)
+		}
+		entries = append(entries, &tiffEntry{Tag: tiffTagImageDescription, Type: tiffTypeASCII, ASCII: description})
+	}
+	entries = append(entries, []*tiffEntry{
+		{Tag: tiffTagStripOffsets, Type: tiffTypeLong, Longs: []uint32{headerSize}},
+		{Tag: tiffTagSamplesPerPixel, Type: tiffTypeShort, Shorts: []uint16{1}},
+		{Tag: tiffTagRowsPerStrip, Type: tiffTypeLong, Longs: []uint32{uint32(r.Height)}},
+		{Tag: tiffTagStripByteCounts, Type: tiffTypeLong, Longs: []uint32{uint32(imageSize)}},
+		{Tag: tiffTagPlanarConfig, Type: tiffTypeShort, Shorts: []uint16{1}},
+		{Tag: tiffTagSampleFormat, Type: tiffTypeShort, Shorts: []uint16{3}},
+		{Tag: tiffTagModelPixelScale, Type: tiffTypeDouble, Double: []float64{r.CellLng, r.CellLat, 0.0}},
+		{Tag: tiffTagModelTiepoint, Type: tiffTypeDouble, Double: []float64{0.0, 0.0, 0.0, r.West, r.North, 0.0}},
+		{Tag: tiffTagGeoKeyDirectory, Type: tiffTypeShort, Shorts: []uint16{
+			1, 1, 0, 3,
+			geoKeyModelType, 0, 1, geoModelTypeGeographic,
+			geoKeyRasterType, 0, 1, geoRasterPixelIsArea,
+			geoKeyGeographicType, 0, 1, geoEPSGWGS84,
+		}},
+	}...)
+
+	// The image follows the header, then the directory, then the values
+	// of entries too large to fit within the directory
+	directoryOffset := headerSize + imageSize
+	if directoryOffset%2 != 0 {
+		directoryOffset++
+	}
+	directorySize := 2 + 12*len(entries) + 4
+	valuesOffset := directoryOffset + directorySize
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	le := binary.LittleEndian
+	write := func(v interface{}) {
+		if err == nil {
+			err = binary.Write(w, le, v)
+		}
+	}
+	write([]byte("II"))
+	write(uint16(42))
+	write(uint32(directoryOffset))
+	write(r.Values)
+	for i := headerSize + imageSize; i < directoryOffset; i++ {
+		write(uint8(0))
+	}
+
+	write(uint16(len(entries)))
+	offset := valuesOffset
+	for _, e := range entries {
+		write(e.Tag)
+		write(e.Type)
+		write(uint32(e.count()))
+		if e.size() <= 4 {
+			value := make([]byte, 4)
+			switch {
+			case len(e.Shorts) > 0:
+				for i, s := range e.Shorts {
+					le.PutUint16(value[2*i:], s)
+				}
+			case len(e.Longs) > 0:
+				le.PutUint32(value, e.Longs[0])
+			case len(e.ASCII) > 0:
+				copy(value, e.ASCII)
+			}
+			write(value)
+		} else {
+			write(uint32(offset))
+			offset += e.size()
+		}
+	}
+	write(uint32(0)) // No further directories
+	for _, e := range entries {
+		if e.size() > 4 {
+			write(e.Shorts)
+			write(e.Longs)
+			write(e.Double)
+			write(e.ASCII)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
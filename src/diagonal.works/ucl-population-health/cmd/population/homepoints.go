@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+// HomePoints chooses how the point at which each person lives, within
+// their home LSOA, is sampled, for uses that need locations rather than
+// areas.
+type HomePoints int
+
+const (
+	// People have no point location, only their home LSOA
+	HomePointsNone HomePoints = iota
+	// Points are sampled uniformly within the LSOA's boundary
+	HomePointsUniform
+	// Points are sampled within areas of residential landuse in the LSOA,
+	// weighted by their area
+	HomePointsResidential
+	// Points are sampled within the footprints of buildings in the LSOA,
+	// weighted by their area
+	HomePointsBuildings
+
+	HomePointsInvalid HomePoints = -1
+)
+
+// HomePointMaxAttempts bounds the points sampled within the bounding box
+// of a polygon before one falls within it, after which the centre of the
+// box is used.
+const HomePointMaxAttempts = 100
+
+func (h HomePoints) String() string {
+	switch h {
+	case HomePointsNone:
+		return "none"
+	case HomePointsUniform:
+		return "uniform"
+	case HomePointsResidential:
+		return "residential"
+	case HomePointsBuildings:
+		return "buildings"
+	}
+	return "invalid"
+}
+
+func HomePointsFromString(s string) (HomePoints, error) {
+	for _, h := range []HomePoints{HomePointsNone, HomePointsUniform, HomePointsResidential, HomePointsBuildings} {
+		if s == h.String() {
+			return h, nil
+		}
+	}
+	return HomePointsInvalid, fmt.Errorf("unknown home points %q, expected none, uniform, residential or buildings", s)
+}
+
+// query returns the features within which points are sampled, or nil if
+// they're sampled within the LSOA's boundary.
+func (h HomePoints) query() b6.Query {
+	switch h {
+	case HomePointsResidential:
+		return b6.Tagged{Key: "#landuse", Value: "residential"}
+	case HomePointsBuildings:
+		return b6.Keyed{Key: "#building"}
+	}
+	return nil
+}
+
+// homeSampler samples points within the polygons of an LSOA, or of the
+// features within it, in proportion to their area.
+type homeSampler struct {
+	polygons []*s2.Polygon
+	// The cumulative area of polygons
+	cumulative []float64
+	// The sampler of the LSOA's boundary, for the features within it,
+	// which can extend beyond it, or nil
+	within *homeSampler
+}
+
+func (h *homeSampler) add(polygon *s2.Polygon) {
+	area := polygon.Area()
+	if area <= 0.0 {
+		return
+	}
+	total := 0.0
+	if len(h.cumulative) > 0 {
+		total = h.cumulative[len(h.cumulative)-1]
+	}
+	h.polygons = append(h.polygons, polygon)
+	h.cumulative = append(h.cumulative, total+area)
+}
+
+func (h *homeSampler) Empty() bool {
+	return len(h.polygons) == 0
+}
+
+func (h *homeSampler) ContainsPoint(p s2.Point) bool {
+	for _, polygon := range h.polygons {
+		if polygon.ContainsPoint(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sample returns a point chosen uniformly within the polygons. Points of
+// features that fall outside the LSOA are rejected, and sampled again,
+// with a point sampled across the LSOA used if none fall within it.
+func (h *homeSampler) Sample(rng *rand.Rand) s2.LatLng {
+	for attempt := 0; attempt < HomePointMaxAttempts; attempt++ {
+		r := rng.Float64() * h.cumulative[len(h.cumulative)-1]
+		i := sort.SearchFloat64s(h.cumulative, r)
+		if i >= len(h.polygons) {
+			i = len(h.polygons) - 1
+		}
+		ll := samplePolygon(h.polygons[i], rng)
+		if h.within == nil || h.within.ContainsPoint(s2.PointFromLatLng(ll)) {
+			return ll
+		}
+	}
+	return h.within.Sample(rng)
+}
+
+// samplePolygon returns a point chosen uniformly within polygon, by
+// sampling its bounding box uniformly by area, or the centre of the box,
+// if no sampled point falls within it.
+func samplePolygon(polygon *s2.Polygon, rng *rand.Rand) s2.LatLng {
+	bound := polygon.RectBound()
+	lo, hi := math.Sin(bound.Lo().Lat.Radians()), math.Sin(bound.Hi().Lat.Radians())
+	for i := 0; i < HomePointMaxAttempts; i++ {
+		ll := s2.LatLng{
+			Lat: s1.Angle(math.Asin(lo + rng.Float64()*(hi-lo))),
+			Lng: s1.Angle(bound.Lng.Lo + rng.Float64()*bound.Lng.Length()),
+		}
+		if polygon.ContainsPoint(s2.PointFromLatLng(ll)) {
+			return ll
+		}
+	}
+	return bound.Center()
+}
+
+// newHomeSampler returns a sampler of the points within the LSOA with the
+// given boundary, or within the features of the world given by homes that
+// lie within it, by their centroid, and whether any were found. Points
+// sampled within features are kept within the boundary.
+func newHomeSampler(boundary b6.AreaFeature, homes HomePoints, w b6.World) (*homeSampler, bool) {
+	lsoa := &homeSampler{}
+	for i := 0; i < boundary.Len(); i++ {
+		lsoa.add(boundary.Polygon(i))
+	}
+	q := homes.query()
+	if q == nil || lsoa.Empty() {
+		return lsoa, true
+	}
+	features := &homeSampler{within: lsoa}
+	for _, polygon := range lsoa.polygons {
+		found := w.FindFeatures(b6.Intersection{b6.NewIntersectsCap(polygon.CapBound()), q})
+		for found.Next() {
+			area, ok := found.Feature().(b6.AreaFeature)
+			if !ok || !lsoa.ContainsPoint(b6.Centroid(area)) {
+				continue
+			}
+			for i := 0; i < area.Len(); i++ {
+				features.add(area.Polygon(i))
+			}
+		}
+	}
+	if features.Empty() {
+		return lsoa, false
+	}
+	return features, true
+}
+
+// assignHomePoints samples the point at which each person living in homes
+// lives, within the boundary of their LSOA, from the world, as chosen by
+// points. Residents of care homes live at their care home. LSOAs without
+// a boundary in the world use their centre, and, when points are sampled
+// within features, those without any sample within the boundary instead,
+// with both logged.
+func assignHomePoints(people []Person, homes LSOASet, points HomePoints, lsoas map[LSOACode]*LSOA, careHomes map[CareHomeID]*CareHome, geography *CensusGeography, w b6.World) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	samplers := make(map[LSOACode]*homeSampler)
+	unbounded, featureless := 0, 0
+	sampled := 0
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		if home, ok := careHomes[p.CareHome]; ok {
+			p.HomePoint = s2.LatLngFromPoint(home.Location)
+			continue
+		}
+		sampler, ok := samplers[p.Home]
+		if !ok {
+			if boundary := findLSOABoundary(p.Home, geography.Year, w); boundary != nil {
+				var found bool
+				if sampler, found = newHomeSampler(boundary, points, w); !found {
+					featureless++
+				}
+			}
+			if sampler == nil || sampler.Empty() {
+				sampler = nil
+				unbounded++
+			}
+			samplers[p.Home] = sampler
+		}
+		if sampler != nil {
+			p.HomePoint = sampler.Sample(rng)
+			sampled++
+		} else if lsoa, ok := lsoas[p.Home]; ok {
+			p.HomePoint = s2.LatLngFromPoint(lsoa.Center)
+		}
+	}
+	log.Printf("  %s: sampled: %d people in %d lsoas", points, sampled, len(samplers))
+	if unbounded > 0 {
+		Warningf("  home points: %d LSOAs have no boundary in the world, so their residents live at the LSOA's centre", unbounded)
+	}
+	if featureless > 0 {
+		Warningf("  home points: %d LSOAs have no %s features in the world, so points are sampled across the LSOA", featureless, points)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+// rectanglePolygon returns the polygon bounded by the given latitudes and
+// longitudes, in degrees
+func rectanglePolygon(lat0 float64, lng0 float64, lat1 float64, lng1 float64) *s2.Polygon {
+	loop := s2.LoopFromPoints([]s2.Point{
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat0, lng0)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat0, lng1)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat1, lng1)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat1, lng0)),
+	})
+	return s2.PolygonFromLoops([]*s2.Loop{loop})
+}
+
+func TestHomePointsFromString(t *testing.T) {
+	for _, h := range []HomePoints{HomePointsNone, HomePointsUniform, HomePointsResidential, HomePointsBuildings} {
+		if parsed, err := HomePointsFromString(h.String()); err != nil || parsed != h {
+			t.Errorf("expected %s, found %s, %v", h, parsed, err)
+		}
+	}
+	if _, err := HomePointsFromString("gardens"); err == nil {
+		t.Errorf("expected an error for unknown home points")
+	}
+}
+
+func TestSamplePolygon(t *testing.T) {
+	polygon := rectanglePolygon(51.50, -0.12, 51.51, -0.10)
+	rng := rand.New(rand.NewSource(42))
+	west := 0
+	n := 2000
+	for i := 0; i < n; i++ {
+		ll := samplePolygon(polygon, rng)
+		if !polygon.ContainsPoint(s2.PointFromLatLng(ll)) {
+			t.Fatalf("expected %s to be within the polygon", ll)
+		}
+		if ll.Lng.Degrees() < -0.11 {
+			west++
+		}
+	}
+	if west < n*45/100 || west > n*55/100 {
+		t.Errorf("expected around half of the points in the western half, found %d of %d", west, n)
+	}
+}
+
+func TestHomeSamplerWeightsByArea(t *testing.T) {
+	sampler := &homeSampler{}
+	small := rectanglePolygon(51.50, -0.12, 51.501, -0.119)
+	large := rectanglePolygon(51.51, -0.12, 51.513, -0.119)
+	sampler.add(small)
+	sampler.add(large)
+	// Polygons without area are never sampled
+	sampler.add(rectanglePolygon(51.52, -0.12, 51.52, -0.12))
+	if len(sampler.polygons) != 2 {
+		t.Fatalf("expected 2 polygons, found %d", len(sampler.polygons))
+	}
+	rng := rand.New(rand.NewSource(42))
+	inSmall, n := 0, 4000
+	for i := 0; i < n; i++ {
+		if small.ContainsPoint(s2.PointFromLatLng(sampler.Sample(rng))) {
+			inSmall++
+		}
+	}
+	// A quarter of the total area
+	if inSmall < n*22/100 || inSmall > n*28/100 {
+		t.Errorf("expected around a quarter of points in the small polygon, found %d of %d", inSmall, n)
+	}
+}
+
+func TestHomeSamplerKeepsFeaturePointsWithinLSOA(t *testing.T) {
+	lsoa := &homeSampler{}
+	lsoa.add(rectanglePolygon(51.50, -0.12, 51.51, -0.10))
+	// A building whose centroid is within the LSOA, but which extends
+	// beyond its eastern edge
+	straddling := rectanglePolygon(51.504, -0.104, 51.506, -0.098)
+	features := &homeSampler{within: lsoa}
+	features.add(straddling)
+	// And one wholly outside it, which can't be sampled within the LSOA
+	outside := &homeSampler{within: lsoa}
+	outside.add(rectanglePolygon(51.60, -0.12, 51.61, -0.10))
+
+	rng := rand.New(rand.NewSource(42))
+	for i := 0; i < 500; i++ {
+		p := s2.PointFromLatLng(features.Sample(rng))
+		if !lsoa.ContainsPoint(p) || !straddling.ContainsPoint(p) {
+			t.Fatalf("expected points within both the building and the LSOA, found %s", s2.LatLngFromPoint(p))
+		}
+		if p := s2.PointFromLatLng(outside.Sample(rng)); !lsoa.ContainsPoint(p) {
+			t.Fatalf("expected points outside the LSOA to be sampled across it, found %s", s2.LatLngFromPoint(p))
+		}
+	}
+}
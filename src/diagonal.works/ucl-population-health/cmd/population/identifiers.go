@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// NHS numbers beginning 999 are reserved for testing, and those
+	// beginning 9 are only allocated to test patients in NHS Digital's
+	// non-live environments, so neither will be issued to real patients.
+	// We use the first nine digits of the range, with the tenth being the
+	// check digit, starting with those beginning 999.
+	NHSNumberTestRangeBegin    = 999000000
+	NHSNumberTestRangeEnd      = 1000000000
+	NHSNumberNonLiveRangeBegin = 900000000
+	NHSNumberNonLiveRangeEnd   = NHSNumberTestRangeBegin
+	NHSNumberLength            = 10
+)
+
+// nhsNumberCheckDigit returns the modulus 11 check digit for the given
+// first nine digits of an NHS number, or 10 if no valid check digit
+// exists, in which case the number can't be used.
+func nhsNumberCheckDigit(prefix int) int {
+	sum := 0
+	for weight := 2; weight <= 10; weight++ {
+		sum += (prefix % 10) * weight
+		prefix /= 10
+	}
+	check := 11 - (sum % 11)
+	if check == 11 {
+		return 0
+	}
+	return check
+}
+
+// IsValidNHSNumber returns true if s is a syntactically valid NHS number,
+// with a correct check digit.
+func IsValidNHSNumber(s string) bool {
+	if len(s) != NHSNumberLength {
+		return false
+	}
+	prefix := 0
+	for _, c := range s[0 : NHSNumberLength-1] {
+		if c < '0' || c > '9' {
+			return false
+		}
+		prefix = prefix*10 + int(c-'0')
+	}
+	check := int(s[NHSNumberLength-1]) - '0'
+	return check >= 0 && check <= 9 && nhsNumberCheckDigit(prefix) == check
+}
+
+// NHSNumberGenerator returns successive valid NHS numbers from the test
+// range, followed by the rest of the non-live range. Together, they have
+// space for around 91 million numbers, as one in eleven prefixes has no
+// valid check digit, more than the population of England.
+type NHSNumberGenerator struct {
+	next int
+	end  int
+	// The ranges of prefixes to use once the current one is exhausted
+	ranges [][2]int
+}
+
+func NewNHSNumberGenerator() *NHSNumberGenerator {
+	return &NHSNumberGenerator{
+		next:   NHSNumberTestRangeBegin,
+		end:    NHSNumberTestRangeEnd,
+		ranges: [][2]int{{NHSNumberNonLiveRangeBegin, NHSNumberNonLiveRangeEnd}},
+	}
+}
+
+func (n *NHSNumberGenerator) Next() (string, error) {
+	for {
+		for n.next < n.end {
+			prefix := n.next
+			n.next++
+			if check := nhsNumberCheckDigit(prefix); check < 10 {
+				return fmt.Sprintf("%09d%d", prefix, check), nil
+			}
+		}
+		if len(n.ranges) == 0 {
+			return "", fmt.Errorf("exhausted the NHS number test range")
+		}
+		n.next, n.end = n.ranges[0][0], n.ranges[0][1]
+		n.ranges = n.ranges[1:]
+	}
+}
+
+// assignNHSNumbers gives each person living in homes a valid, but
+// guaranteed not real, NHS number for use as test data.
+func assignNHSNumbers(people []Person, homes LSOASet) error {
+	g := NewNHSNumberGenerator()
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			var err error
+			if people[i].NHSNumber, err = g.Next(); err != nil {
+				return fmt.Errorf("%s after %d people: consider a smaller population", err, i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNHSNumberCheckDigit(t *testing.T) {
+	tests := []struct {
+		prefix int
+		check  int
+	}{
+		{943476591, 9},
+		{401023213, 7},
+		{900000000, 9},
+		{0, 0},
+		// 1234567890 has no valid check digit
+		{123456789, 10},
+	}
+	for _, test := range tests {
+		if check := nhsNumberCheckDigit(test.prefix); check != test.check {
+			t.Errorf("expected check digit %d for %09d, found %d", test.check, test.prefix, check)
+		}
+	}
+}
+
+func TestIsValidNHSNumber(t *testing.T) {
+	valid := []string{"9434765919", "4010232137", "9000000009"}
+	for _, n := range valid {
+		if !IsValidNHSNumber(n) {
+			t.Errorf("expected %s to be valid", n)
+		}
+	}
+	invalid := []string{"9434765918", "1234567890", "943476591", "94347659190", "943476591X", "A434765919", ""}
+	for _, n := range invalid {
+		if IsValidNHSNumber(n) {
+			t.Errorf("expected %s to be invalid", n)
+		}
+	}
+}
+
+func TestNHSNumberGeneratorMovesToNonLiveRange(t *testing.T) {
+	g := NewNHSNumberGenerator()
+	g.next = NHSNumberTestRangeEnd - 1
+	expected := []string{"9999999999", "9000000009"}
+	for _, e := range expected {
+		n, err := g.Next()
+		if err != nil {
+			t.Fatalf("expected no error, found %s", err)
+		}
+		if n != e {
+			t.Errorf("expected %s, found %s", e, n)
+		}
+		if !IsValidNHSNumber(n) {
+			t.Errorf("expected %s to be valid", n)
+		}
+	}
+}
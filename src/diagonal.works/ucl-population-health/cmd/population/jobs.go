@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JobFormat is the scheduler for which job manifests are written
+type JobFormat int
+
+const (
+	// Kubernetes Jobs, applied with kubectl apply -f
+	JobFormatKubernetes JobFormat = iota
+	// Google Cloud Batch jobs, submitted with gcloud batch jobs submit
+	JobFormatCloudBatch
+
+	JobFormatCount
+	JobFormatInvalid JobFormat = -1
+)
+
+func (j JobFormat) String() string {
+	switch j {
+	case JobFormatKubernetes:
+		return "kubernetes"
+	case JobFormatCloudBatch:
+		return "cloud-batch"
+	}
+	return "invalid"
+}
+
+func JobFormatFromString(s string) (JobFormat, error) {
+	for j := JobFormat(0); j < JobFormatCount; j++ {
+		if s == j.String() {
+			return j, nil
+		}
+	}
+	return JobFormatInvalid, fmt.Errorf("unknown job format %q, expected kubernetes or cloud-batch", s)
+}
+
+const (
+	// Where the binary, and the world and data bundled with it, are
+	// found in the docker image built by the Dockerfile
+	JobBinary         = "/diagonal/bin/population"
+	JobWorldDirectory = "/diagonal/world"
+	JobDataDirectory  = "/diagonal/data"
+	// Where the volumes for outputs and the shared cache are mounted
+	JobOutputDirectory = "/output"
+	JobCachedDirectory = "/cached"
+
+	// People drawn from the buffer around a scope, in addition to its
+	// residents, allowed for when sizing memory
+	JobBufferAllowance = 1.25
+	// Memory requests are rounded up to a multiple of this
+	JobMemoryRoundingMiB = 256
+)
+
+// JobVolumes are the volumes mounted into each job. For Kubernetes,
+// they're the names of PersistentVolumeClaims, and for Cloud Batch, Cloud
+// Storage paths, as <bucket>/<path>. World and Data, if empty, leave those
+// bundled with the image in place.
+type JobVolumes struct {
+	World  string
+	Data   string
+	Output string
+	Cached string
+}
+
+// Job is the simulation of the population of one scope
+type Job struct {
+	Name      string
+	Scope     Scope
+	Args      []string
+	People    int
+	CPUs      int
+	MemoryMiB int
+}
+
+// jobName returns a name for the job of scope valid for both Kubernetes
+// and Cloud Batch: lower case letters, digits and hyphens, starting with a
+// letter.
+func jobName(scope Scope) string {
+	name := strings.ToLower(fmt.Sprintf("population-%s-%s", scope.Kind, scope.Code))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// jobMemoryMiB returns the memory to request for simulating people,
+// rounded up to a multiple of JobMemoryRoundingMiB.
+func jobMemoryMiB(people int, baseMiB int, perPersonKiB float64) int {
+	mib := float64(baseMiB) + float64(people)*JobBufferAllowance*perPersonKiB/1024.0
+	return int(math.Ceil(mib/JobMemoryRoundingMiB)) * JobMemoryRoundingMiB
+}
+
+// scopeResidents returns the number of residents of each scope, from the
+// census, without needing the world.
+func scopeResidents(scopes []Scope, data DataManifest, geography *CensusGeography) (map[Scope]int, error) {
+	icbs, err := readICBs(data.Get(DatasetLSOAICB), geography)
+	if err != nil {
+		return nil, err
+	}
+	var boroughs map[LSOACode]*LocalAuthority
+	for _, scope := range scopes {
+		if scope.Kind == ScopeKindBorough && boroughs == nil {
+			if boroughs, err = readLocalAuthorities(data.Get(DatasetLSOAICB), geography); err != nil {
+				return nil, err
+			}
+		}
+	}
+	persons := make(map[LSOACode]int)
+	emit := func(code LSOACode, name string, counts []int) error {
+		persons[code] = sum(counts)
+		return nil
+	}
+	if err := readByAge(geography.Persons, emit); err != nil {
+		return nil, err
+	}
+	residents := make(map[Scope]int)
+	for _, scope := range scopes {
+		area, err := scopeLSOAs(scope, icbs, boroughs)
+		if err != nil {
+			return nil, err
+		}
+		for lsoa := range area.LSOAs {
+			residents[scope] += persons[lsoa]
+		}
+	}
+	return residents, nil
+}
+
+type kubernetesJob struct {
+	APIVersion string                `yaml:"apiVersion"`
+	Kind       string                `yaml:"kind"`
+	Metadata   kubernetesJobMetadata `yaml:"metadata"`
+	Spec       kubernetesJobSpec     `yaml:"spec"`
+}
+
+type kubernetesJobMetadata struct {
+	Name   string            `yaml:"name,omitempty"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type kubernetesJobSpec struct {
+	BackoffLimit int                   `yaml:"backoffLimit"`
+	Template     kubernetesPodTemplate `yaml:"template"`
+}
+
+type kubernetesPodTemplate struct {
+	Metadata kubernetesJobMetadata `yaml:"metadata"`
+	Spec     kubernetesPodSpec     `yaml:"spec"`
+}
+
+type kubernetesPodSpec struct {
+	RestartPolicy string                `yaml:"restartPolicy"`
+	Containers    []kubernetesContainer `yaml:"containers"`
+	Volumes       []kubernetesVolume    `yaml:"volumes"`
+}
+
+type kubernetesContainer struct {
+	Name         string                  `yaml:"name"`
+	Image        string                  `yaml:"image"`
+	Command      []string                `yaml:"command"`
+	Args         []string                `yaml:"args"`
+	Resources    kubernetesResources     `yaml:"resources"`
+	VolumeMounts []kubernetesVolumeMount `yaml:"volumeMounts"`
+}
+
+type kubernetesResources struct {
+	Requests map[string]string `yaml:"requests"`
+	Limits   map[string]string `yaml:"limits"`
+}
+
+type kubernetesVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type kubernetesVolume struct {
+	Name                  string                          `yaml:"name"`
+	PersistentVolumeClaim kubernetesPersistentVolumeClaim `yaml:"persistentVolumeClaim"`
+}
+
+type kubernetesPersistentVolumeClaim struct {
+	ClaimName string `yaml:"claimName"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+// jobMount is a volume, mounted into the container at a path
+type jobMount struct {
+	Name     string
+	Volume   string
+	Path     string
+	ReadOnly bool
+}
+
+func (v *JobVolumes) mounts() []jobMount {
+	mounts := make([]jobMount, 0, 4)
+	if v.World != "" {
+		mounts = append(mounts, jobMount{Name: "world", Volume: v.World, Path: JobWorldDirectory, ReadOnly: true})
+	}
+	if v.Data != "" {
+		mounts = append(mounts, jobMount{Name: "data", Volume: v.Data, Path: JobDataDirectory, ReadOnly: true})
+	}
+	mounts = append(mounts, jobMount{Name: "output", Volume: v.Output, Path: JobOutputDirectory})
+	mounts = append(mounts, jobMount{Name: "cached", Volume: v.Cached, Path: JobCachedDirectory})
+	return mounts
+}
+
+func (j *Job) kubernetes(image string, volumes *JobVolumes) *kubernetesJob {
+	labels := map[string]string{"app": "population", "scope": strings.TrimPrefix(j.Name, "population-")}
+	memory := fmt.Sprintf("%dMi", j.MemoryMiB)
+	container := kubernetesContainer{
+		Name:    "population",
+		Image:   image,
+		Command: []string{JobBinary},
+		Args:    j.Args,
+		Resources: kubernetesResources{
+			Requests: map[string]string{"cpu": strconv.Itoa(j.CPUs), "memory": memory},
+			Limits:   map[string]string{"memory": memory},
+		},
+	}
+	pod := kubernetesPodSpec{RestartPolicy: "Never", Containers: []kubernetesContainer{container}}
+	for _, m := range volumes.mounts() {
+		pod.Containers[0].VolumeMounts = append(pod.Containers[0].VolumeMounts, kubernetesVolumeMount{Name: m.Name, MountPath: m.Path, ReadOnly: m.ReadOnly})
+		pod.Volumes = append(pod.Volumes, kubernetesVolume{Name: m.Name, PersistentVolumeClaim: kubernetesPersistentVolumeClaim{ClaimName: m.Volume, ReadOnly: m.ReadOnly}})
+	}
+	return &kubernetesJob{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata:   kubernetesJobMetadata{Name: j.Name, Labels: labels},
+		Spec: kubernetesJobSpec{
+			Template: kubernetesPodTemplate{
+				Metadata: kubernetesJobMetadata{Labels: labels},
+				Spec:     pod,
+			},
+		},
+	}
+}
+
+type cloudBatchJob struct {
+	TaskGroups []cloudBatchTaskGroup `json:"taskGroups"`
+	Labels     map[string]string     `json:"labels"`
+	LogsPolicy cloudBatchLogsPolicy  `json:"logsPolicy"`
+}
+
+type cloudBatchTaskGroup struct {
+	TaskCount int            `json:"taskCount"`
+	TaskSpec  cloudBatchTask `json:"taskSpec"`
+}
+
+type cloudBatchTask struct {
+	Runnables       []cloudBatchRunnable      `json:"runnables"`
+	ComputeResource cloudBatchComputeResource `json:"computeResource"`
+	Volumes         []cloudBatchVolume        `json:"volumes"`
+	MaxRetryCount   int                       `json:"maxRetryCount"`
+}
+
+type cloudBatchRunnable struct {
+	Container cloudBatchContainer `json:"container"`
+}
+
+type cloudBatchContainer struct {
+	ImageURI   string   `json:"imageUri"`
+	Entrypoint string   `json:"entrypoint"`
+	Commands   []string `json:"commands"`
+	Volumes    []string `json:"volumes"`
+}
+
+type cloudBatchComputeResource struct {
+	CPUMilli  int `json:"cpuMilli"`
+	MemoryMiB int `json:"memoryMib"`
+}
+
+type cloudBatchVolume struct {
+	GCS       cloudBatchGCS `json:"gcs"`
+	MountPath string        `json:"mountPath"`
+}
+
+type cloudBatchGCS struct {
+	RemotePath string `json:"remotePath"`
+}
+
+type cloudBatchLogsPolicy struct {
+	Destination string `json:"destination"`
+}
+
+func (j *Job) cloudBatch(image string, volumes *JobVolumes) *cloudBatchJob {
+	task := cloudBatchTask{
+		Runnables: []cloudBatchRunnable{{Container: cloudBatchContainer{
+			ImageURI:   image,
+			Entrypoint: JobBinary,
+			Commands:   j.Args,
+		}}},
+		ComputeResource: cloudBatchComputeResource{CPUMilli: j.CPUs * 1000, MemoryMiB: j.MemoryMiB},
+	}
+	for _, m := range volumes.mounts() {
+		// Cloud Storage is mounted on the host, under /mnt/disks, then
+		// bound into the container
+		host := "/mnt/disks/" + m.Name
+		task.Volumes = append(task.Volumes, cloudBatchVolume{GCS: cloudBatchGCS{RemotePath: m.Volume}, MountPath: host})
+		bind := host + ":" + m.Path
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		task.Runnables[0].Container.Volumes = append(task.Runnables[0].Container.Volumes, bind)
+	}
+	return &cloudBatchJob{
+		TaskGroups: []cloudBatchTaskGroup{{TaskCount: 1, TaskSpec: task}},
+		Labels:     map[string]string{"app": "population", "scope": strings.TrimPrefix(j.Name, "population-")},
+		LogsPolicy: cloudBatchLogsPolicy{Destination: "CLOUD_LOGGING"},
+	}
+}
+
+// writeJob writes the manifest of the job to directory, named by the job
+func writeJob(j *Job, format JobFormat, image string, volumes *JobVolumes, directory string) (string, error) {
+	var output []byte
+	var err error
+	var filename string
+	switch format {
+	case JobFormatKubernetes:
+		filename = filepath.Join(directory, j.Name+".yaml")
+		var b bytes.Buffer
+		e := yaml.NewEncoder(&b)
+		e.SetIndent(2)
+		err = e.Encode(j.kubernetes(image, volumes))
+		output = b.Bytes()
+	case JobFormatCloudBatch:
+		filename = filepath.Join(directory, j.Name+".json")
+		output, err = json.MarshalIndent(j.cloudBatch(image, volumes), "", "  ")
+	default:
+		return "", fmt.Errorf("bad job format %s", format)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filename, os.WriteFile(filename, output, 0644)
+}
+
+// jobsMain implements population jobs, which writes a manifest for a job
+// simulating the population of each scope of a batch, passing the
+// arguments after its own flags to each, so that large runs can be
+// dispatched to a cluster.
+func jobsMain(args []string) error {
+	flags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	base := addBaseFlags(flags)
+	dataFlags := addDataFlags(flags)
+	scopesFlags := addBatchScopeFlags(flags)
+	formatFlag := flags.String("format", "kubernetes", "Scheduler for which manifests are written: kubernetes, for Jobs, or cloud-batch, for Google Cloud Batch")
+	imageFlag := flags.String("image", "europe-west1-docker.pkg.dev/diagonal-public/ucl-population-health/population", "Docker image, built by the Dockerfile, that each job runs")
+	outputFlag := flags.String("output", "jobs", "Directory to which a manifest for each scope is written")
+	worldVolumeFlag := flags.String("world-volume", "", "Volume holding the world, mounted over that bundled with the image, if given: a PersistentVolumeClaim for kubernetes, or <bucket>/<path> for cloud-batch")
+	dataVolumeFlag := flags.String("data-volume", "", "Volume holding the input data, mounted over that bundled with the image, if given")
+	outputVolumeFlag := flags.String("output-volume", "", "Volume to which the outputs of each scope are written, in <kind>-<code>")
+	cachedVolumeFlag := flags.String("cached-volume", "", "Volume for intermediate files, shared between scopes")
+	cpusFlag := flags.Int("cpus", 2, "CPUs requested by each job")
+	memoryBaseFlag := flags.Int("memory-base-mib", 4096, "Memory requested by each job, regardless of its population, for the world and input data")
+	memoryPerPersonFlag := flags.Float64("memory-per-person-kib", 2.0, "Additional memory requested for each resident of the scope, allowing for the buffer around it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s jobs [flags] [-- flags for simulate]\n\nWrite a job manifest for each scope of a batch, with resources sized from its population, so that large runs can be dispatched to a cluster.\n\nFlags:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *base.config != "" {
+		if err := applyConfig(flags, *base.config); err != nil {
+			return err
+		}
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+
+	format, err := JobFormatFromString(*formatFlag)
+	if err != nil {
+		return err
+	}
+	data, err := dataFlags.read()
+	if err != nil {
+		return err
+	}
+	scopes, err := scopesFlags.read(data, *dataFlags.censusYear)
+	if err != nil {
+		return fmt.Errorf("jobs: %s", err)
+	}
+	volumes := &JobVolumes{World: *worldVolumeFlag, Data: *dataVolumeFlag, Output: *outputVolumeFlag, Cached: *cachedVolumeFlag}
+	if volumes.Output == "" || volumes.Cached == "" {
+		return fmt.Errorf("jobs: --output-volume and --cached-volume are needed")
+	} else if *cpusFlag < 1 {
+		return fmt.Errorf("jobs: --cpus must be at least 1")
+	} else if *memoryBaseFlag < 0 || *memoryPerPersonFlag < 0.0 {
+		return fmt.Errorf("jobs: memory must not be negative")
+	}
+
+	geography, err := censusGeographyForYear(*dataFlags.censusYear, data)
+	if err != nil {
+		return err
+	}
+	residents, err := scopeResidents(scopes, data, geography)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outputFlag, 0755); err != nil {
+		return err
+	}
+	log.Printf("jobs: scopes: %d format: %s", len(scopes), format)
+	for _, scope := range scopes {
+		j := &Job{
+			Name:      jobName(scope),
+			Scope:     scope,
+			People:    residents[scope],
+			CPUs:      *cpusFlag,
+			MemoryMiB: jobMemoryMiB(residents[scope], *memoryBaseFlag, *memoryPerPersonFlag),
+		}
+		j.Args = append(append([]string{"simulate"}, flags.Args()...), "--scope="+scope.String(), "--output="+filepath.Join(JobOutputDirectory, batchDirectory(scope)), "--cached="+JobCachedDirectory)
+		filename, err := writeJob(j, format, *imageFlag, volumes, *outputFlag)
+		if err != nil {
+			return err
+		}
+		log.Printf("  %s: residents: %d memory: %dMiB: %s", scope, j.People, j.MemoryMiB, filename)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJobName(t *testing.T) {
+	tests := []struct {
+		scope    string
+		expected string
+	}{
+		{"icb:QMJ", "population-icb-qmj"},
+		{"borough:E09000007", "population-borough-e09000007"},
+	}
+	for _, test := range tests {
+		scope, err := ScopeFromString(test.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := jobName(scope); name != test.expected {
+			t.Errorf("expected %s for %s, found %s", test.expected, test.scope, name)
+		}
+	}
+	// Characters that aren't allowed in Kubernetes names are replaced
+	if name := jobName(Scope{Kind: ScopeKindICB, Code: "Q_M J"}); name != "population-icb-q-m-j" {
+		t.Errorf("expected population-icb-q-m-j, found %s", name)
+	}
+}
+
+func TestJobMemoryMiB(t *testing.T) {
+	tests := []struct {
+		people       int
+		baseMiB      int
+		perPersonKiB float64
+		expected     int
+	}{
+		{0, 1024, 2.0, 1024},
+		// 1024 + 100000 * 1.25 * 2 / 1024 = 1268.1, rounded up to 1280
+		{100000, 1024, 2.0, 1280},
+		// 1000 MiB exactly rounds up to the next multiple of 256
+		{0, 1000, 2.0, 1024},
+		{1000000, 512, 1.0, 1792},
+	}
+	for _, test := range tests {
+		if mib := jobMemoryMiB(test.people, test.baseMiB, test.perPersonKiB); mib != test.expected {
+			t.Errorf("expected %d MiB for %d people, found %d", test.expected, test.people, mib)
+		}
+	}
+}
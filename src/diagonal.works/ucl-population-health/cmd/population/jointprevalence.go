@@ -0,0 +1,253 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// The maximum number of iterations of proportional fitting used to
+	// estimate the joint prevalence of each age and sex, and the change in
+	// every fitted margin below which fitting stops early
+	JointFitIterations = 200
+	JointFitTolerance  = 1e-9
+	// The number of iterations used to adjust the joint prevalence to the
+	// calibrated marginal prevalence of each condition for a person
+	JointAdjustIterations = 20
+)
+
+// jointConstraint is a target for the total probability of the
+// combinations of conditions that match a diagnosis.
+type jointConstraint struct {
+	Diagnosis Diagnosis
+	Target    float64
+}
+
+// matches returns true if the combination of conditions, given as a bit
+// for each of conditions, is consistent with the diagnosis.
+func (j jointConstraint) matches(combination int, conditions []QOFCondition) bool {
+	for i, c := range conditions {
+		present := combination&(1<<i) != 0
+		if (j.Diagnosis.Present.Contains(c) && !present) || (j.Diagnosis.Absent.Contains(c) && present) {
+			return false
+		}
+	}
+	return true
+}
+
+// fitJoint scales the probabilities of each combination of conditions in
+// p, in place, so that the total probability of the combinations matching
+// each constraint approaches its target, by iterative proportional
+// fitting. Interactions between conditions present in p, but not
+// constrained, are preserved. It returns the largest difference between a
+// constraint and its fitted margin after the last iteration.
+func fitJoint(p []float64, conditions []QOFCondition, constraints []jointConstraint, iterations int) float64 {
+	residual := 0.0
+	for iteration := 0; iteration < iterations; iteration++ {
+		residual = 0.0
+		for _, constraint := range constraints {
+			margin := 0.0
+			for combination := range p {
+				if constraint.matches(combination, conditions) {
+					margin += p[combination]
+				}
+			}
+			residual = math.Max(residual, math.Abs(margin-constraint.Target))
+			in, out := 0.0, 0.0
+			if margin > 0.0 {
+				in = constraint.Target / margin
+			}
+			if margin < 1.0 {
+				out = (1.0 - constraint.Target) / (1.0 - margin)
+			}
+			for combination := range p {
+				if constraint.matches(combination, conditions) {
+					if margin > 0.0 {
+						p[combination] *= in
+					}
+				} else if margin < 1.0 {
+					p[combination] *= out
+				}
+			}
+		}
+		if residual < JointFitTolerance {
+			break
+		}
+	}
+	return residual
+}
+
+func countConditions(d Diagnosis) int {
+	n := 0
+	for _, c := range AllQOFConditions() {
+		if d.Present.Contains(c) || d.Absent.Contains(c) {
+			n++
+		}
+	}
+	return n
+}
+
+// JointConditionModel assigns every condition at once, sampling a
+// combination of conditions from their joint prevalence for the person's
+// age and sex, rather than chaining pairwise conditional prevalences,
+// which misrepresents people with three or more conditions. The joint
+// prevalence is estimated by iterative proportional fitting, from an
+// independent start, to every prevalence given in data/prevalences.yaml
+// that involves only the assigned conditions, and isn't conditional:
+// single conditions, pairs, and where given, triples, or combinations
+// with absent conditions. Where every combination is given, they're
+// reproduced exactly. For each person, the joint prevalence is then
+// adjusted, again by proportional fitting, so that the marginal prevalence
+// of each condition is that calibrated to their practice, and to their
+// risk factors, like smoking status, preserving the associations between
+// conditions. The model isn't changed by Assign, so people can be assigned
+// concurrently.
+type JointConditionModel struct {
+	conditions []QOFCondition
+	risks      *RiskFactors
+	// The joint prevalence, indexed by sex, age, and combination of
+	// conditions, with a bit for each of conditions
+	joint    [][][]float64
+	marginal []Prevalences
+}
+
+func NewJointConditionModel(conditions []QOFCondition, prevalences AllPrevalences, risks *RiskFactors) *JointConditionModel {
+	j := &JointConditionModel{
+		conditions: conditions,
+		risks:      risks,
+	}
+	var included QOFConditions
+	for _, c := range conditions {
+		included.Add(c)
+		j.marginal = append(j.marginal, prevalences[OneCondition(c)])
+	}
+	given := make([]Prevalences, 0)
+	for d, p := range prevalences {
+		mentioned := d.Diagnosis.Present | d.Diagnosis.Absent
+		if d.Given == (Diagnosis{}) && mentioned != 0 && mentioned&^included == 0 {
+			given = append(given, p)
+		}
+	}
+	// Fitted with combinations first, and single conditions last, so that
+	// marginal prevalences are reproduced where the constraints are
+	// inconsistent, and otherwise in a fixed order, since the order changes
+	// the fit
+	sort.Slice(given, func(a, b int) bool {
+		na, nb := countConditions(given[a].Conditions.Diagnosis), countConditions(given[b].Conditions.Diagnosis)
+		if na != nb {
+			return na > nb
+		}
+		return given[a].Conditions.String() < given[b].Conditions.String()
+	})
+	constraints := make([]jointConstraint, len(given))
+	// Fitting preserves zeros, so combinations made impossible by
+	// QOFConditionConstraints start, and remain, at zero
+	start := make([]float64, 1<<len(conditions))
+	possible := 0
+	for combination := range start {
+		if j.possible(combination) {
+			start[combination] = 1.0
+			possible++
+		}
+	}
+	for combination := range start {
+		start[combination] /= float64(possible)
+	}
+	residual := 0.0
+	sexes := []Sex{Male, Female, Other}
+	j.joint = make([][][]float64, len(sexes))
+	for _, sex := range sexes {
+		j.joint[sex] = make([][]float64, LSOADataMaxAge+1)
+		for age := range j.joint[sex] {
+			for i, p := range given {
+				target := clamp(p.Prevalence(sex, age), 0.0, 1.0)
+				if p.Conditions.Diagnosis.Absent == 0 {
+					// Combinations can't be more prevalent than any of
+					// their conditions, though the data sometimes implies
+					// they are, as fillConditionalPrevalences also allows for
+					for _, c := range conditions {
+						if p.Conditions.Diagnosis.Present.Contains(c) {
+							target = math.Min(target, clamp(prevalences[OneCondition(c)].Prevalence(sex, age), 0.0, 1.0))
+						}
+					}
+				}
+				constraints[i] = jointConstraint{Diagnosis: p.Conditions.Diagnosis, Target: target}
+			}
+			p := make([]float64, 1<<len(conditions))
+			for combination := range p {
+				p[combination] = start[combination]
+			}
+			residual = math.Max(residual, fitJoint(p, conditions, constraints, JointFitIterations))
+			j.joint[sex][age] = p
+		}
+	}
+	log.Printf("  joint prevalence: %d constraints, max residual: %f", len(given), residual)
+	return j
+}
+
+// possible returns true if the combination of conditions is allowed by
+// QOFConditionConstraints, and includes every simulated condition implied
+// by the others.
+func (j *JointConditionModel) possible(combination int) bool {
+	var conditions, simulated QOFConditions
+	for i, c := range j.conditions {
+		simulated.Add(c)
+		if combination&(1<<i) != 0 {
+			conditions.Add(c)
+		}
+	}
+	implied := impliedConditions(conditions, QOFConditionConstraints)
+	return possibleConditions(implied, QOFConditionConstraints) && implied&simulated == conditions
+}
+
+func (j *JointConditionModel) Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit) {
+	age := p.Age
+	if age > LSOADataMaxAge {
+		age = LSOADataMaxAge
+	}
+	adjusted := make([]float64, len(j.joint[p.Sex][age]))
+	copy(adjusted, j.joint[p.Sex][age])
+	constraints := make([]jointConstraint, 0, len(j.conditions))
+	for i, c := range j.conditions {
+		scale := gp.ConditionBias[c] * j.risks.Risk(p, c)
+		if scale != 1.0 {
+			var d Diagnosis
+			d.Present.Add(c)
+			constraints = append(constraints, jointConstraint{Diagnosis: d, Target: clamp(j.marginal[i].Prevalence(p.Sex, p.Age)*scale, 0.0, 1.0)})
+		}
+	}
+	if len(constraints) > 0 {
+		fitJoint(adjusted, j.conditions, constraints, JointAdjustIterations)
+	}
+	x := rng.Float64()
+	for combination, probability := range adjusted {
+		x -= probability
+		if x < 0.0 || combination == len(adjusted)-1 {
+			for i, c := range j.conditions {
+				if combination&(1<<i) != 0 {
+					addCondition(p, c, QOFConditionConstraints)
+				}
+				if audit.Enabled() {
+					j.record(p, gp, adjusted, i, combination&(1<<i) != 0, audit)
+				}
+			}
+			break
+		}
+	}
+}
+
+// record adds the decision for the ith condition to audit, with the
+// probability of the condition being the sum of those of the adjusted
+// combinations that include it, since the combination is drawn as one.
+func (j *JointConditionModel) record(p *Person, gp *GPPractice, adjusted []float64, i int, assigned bool, audit *ConditionAudit) {
+	probability := 0.0
+	for combination, q := range adjusted {
+		if combination&(1<<i) != 0 {
+			probability += q
+		}
+	}
+	c := j.conditions[i]
+	audit.Record(ConditionDecision{Condition: c.String(), Model: "joint", Given: "joint", Probability: probability, Bias: gp.ConditionBias[c], Risk: j.risks.Risk(p, c), Outcome: conditionOutcome(assigned)})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestFitJointMatchesConstraints(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	var dm, hyp, both Diagnosis
+	dm.Present.Add(QOFConditionDiabetes)
+	hyp.Present.Add(QOFConditionHypertension)
+	both.Present.Add(QOFConditionDiabetes)
+	both.Present.Add(QOFConditionHypertension)
+	constraints := []jointConstraint{{Diagnosis: both, Target: 0.05}, {Diagnosis: dm, Target: 0.1}, {Diagnosis: hyp, Target: 0.3}}
+	p := []float64{0.25, 0.25, 0.25, 0.25}
+	if residual := fitJoint(p, conditions, constraints, JointFitIterations); residual > 1e-6 {
+		t.Errorf("expected the constraints to be met, found a residual of %f", residual)
+	}
+	expected := []float64{0.65, 0.05, 0.25, 0.05}
+	for combination := range p {
+		if math.Abs(p[combination]-expected[combination]) > 1e-6 {
+			t.Errorf("expected %f for combination %d, found %f", expected[combination], combination, p[combination])
+		}
+	}
+}
+
+func TestJointConditionModelAssignsConcurrently(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	model := NewJointConditionModel(conditions, constantPrevalences(conditions, 0.2), &RiskFactors{})
+	gp := &GPPractice{Code: "G1", ConditionBias: map[QOFCondition]float64{QOFConditionDiabetes: 1.5, QOFConditionHypertension: 1.0}}
+	workers, n := 4, 20000
+	counts := make([]int, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < n; i++ {
+				p := &Person{ID: i, Sex: Sex(i % 2), Age: 50}
+				model.Assign(p, gp, rng, nil)
+				if p.Conditions.Contains(QOFConditionDiabetes) {
+					counts[w]++
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w, count := range counts {
+		// Each worker sees the practice's bias, as if assigned alone
+		if simulated := float64(count) / float64(n); math.Abs(simulated-0.3) > 0.015 {
+			t.Errorf("worker %d: expected diabetes prevalence close to 0.3, found %.3f", w, simulated)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeGzippedCSV(t *testing.T, filename string, lines ...string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	fmt.Fprint(w, strings.Join(lines, "\n")+"\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newMergedPractices() (map[GPPracticeCode]*GPPractice, GPPracticeSuccessors) {
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", Status: GPPracticeStatusActive},
+		"G2": {Code: "G2", Status: GPPracticeStatusActive},
+	}
+	for _, gp := range gps {
+		gp.ConditionPrevalence = make(map[QOFCondition]float64)
+		gp.ReportedConditionPrevalence = make(map[QOFCondition]float64)
+	}
+	// P1 and P2 closed, merging into G1, while G2 absorbed P3, which
+	// still reported its own prevalence alongside G2
+	return gps, GPPracticeSuccessors{"P1": "G1", "P2": "G1", "P3": "G2"}
+}
+
+func TestReadGPPracticeListSizes(t *testing.T) {
+	gps, successors := newMergedPractices()
+	dataset := qofDataset(filepath.Join(t.TempDir(), "list-sizes.csv.gz"))
+	writeGzippedCSV(t, dataset.Filename,
+		GPQOFDataPracticeCodeColumn+","+GPQOFDataListSizeColumn+","+GPQOFDataListSizeColumn,
+		"G1,100,1",
+		"P1,1000,2",
+		"P2,3000,3",
+		// Duplicated rows, counted once
+		"P2,3000,3",
+		"G1,100,1",
+		"G2,\"2,000\",4",
+		"P3,500,5",
+		"X1,10,6",
+	)
+	if err := readGPPracticeListSizes(gps, successors, dataset); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code         GPPracticeCode
+		listSize     int
+		predecessors map[GPPracticeCode]int
+	}{
+		{"G1", 4100, map[GPPracticeCode]int{"P1": 1000, "P2": 3000}},
+		{"G2", 2500, map[GPPracticeCode]int{"P3": 500}},
+	}
+	for _, test := range tests {
+		gp := gps[test.code]
+		if gp.ListSize != test.listSize {
+			t.Errorf("%s: expected a list size of %d, found %d", test.code, test.listSize, gp.ListSize)
+		}
+		if fmt.Sprint(gp.PredecessorListSizes) != fmt.Sprint(test.predecessors) {
+			t.Errorf("%s: expected predecessors %v, found %v", test.code, test.predecessors, gp.PredecessorListSizes)
+		}
+	}
+}
+
+func TestReadGPPracticeConditionPrevalenceWeightsPredecessors(t *testing.T) {
+	gps, successors := newMergedPractices()
+	gps["G1"].PredecessorListSizes = map[GPPracticeCode]int{"P1": 1000, "P2": 3000}
+	gps["G2"].PredecessorListSizes = map[GPPracticeCode]int{"P3": 500}
+	data := DefaultDataManifest()
+	dataset := data.Get(QOFConditionDataset(QOFConditionDiabetes))
+	dataset.Filename = filepath.Join(t.TempDir(), "dm.csv.gz")
+	data[QOFConditionDataset(QOFConditionDiabetes)] = dataset
+	writeGzippedCSV(t, dataset.Filename,
+		GPQOFDataPracticeCodeColumn+","+GPQOFDataPrevalenceColumn+","+GPQOFDataPrevalenceColumn,
+		"P1,4.0,0",
+		"P2,8.0,0",
+		"P3,20.0,0",
+		"G2,6.0,0",
+	)
+	read, err := readGPPracticeConditionPrevalence(gps, successors, []QOFCondition{QOFConditionDiabetes}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code     GPPracticeCode
+		expected float64
+	}{
+		// Weighted by the list sizes of P1 and P2
+		{"G1", (1000*0.04 + 3000*0.08) / 4000},
+		// Reported directly, in place of its predecessor's
+		{"G2", 0.06},
+	}
+	for _, test := range tests {
+		if p := gps[test.code].ConditionPrevalence[QOFConditionDiabetes]; math.Abs(p-test.expected) > 1e-9 {
+			t.Errorf("%s: expected a prevalence of %f, found %f", test.code, test.expected, p)
+		}
+		if p := gps[test.code].ReportedConditionPrevalence[QOFConditionDiabetes]; math.Abs(p-test.expected) > 1e-9 {
+			t.Errorf("%s: expected a reported prevalence of %f, found %f", test.code, test.expected, p)
+		}
+	}
+	if len(read.Unparsed[QOFConditionDiabetes]) != 0 {
+		t.Errorf("expected every row to be parsed, found %v", read.Unparsed[QOFConditionDiabetes])
+	}
+
+	// Without list sizes, predecessors are weighted equally
+	gps, successors = newMergedPractices()
+	if _, err := readGPPracticeConditionPrevalence(gps, successors, []QOFCondition{QOFConditionDiabetes}, data); err != nil {
+		t.Fatal(err)
+	}
+	if p := gps["G1"].ConditionPrevalence[QOFConditionDiabetes]; math.Abs(p-0.06) > 1e-9 {
+		t.Errorf("expected an unweighted prevalence of 0.06, found %f", p)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const directoryLockFilename = ".lock"
+
+var errLocked = errors.New("locked")
+
+// DirectoryLock is an advisory lock on a directory, held by a run while it
+// writes outputs there, so that two runs writing to the same directory
+// fail, rather than interleaving their writes to the same files. The lock
+// is released by the operating system if the process exits without
+// unlocking it.
+type DirectoryLock struct {
+	f *os.File
+}
+
+// LockDirectory takes the lock on directory, which must exist, failing
+// immediately, with the process ID of the holder, if another run holds it.
+// Locking isn't supported on all platforms, where it always succeeds.
+func LockDirectory(directory string) (*DirectoryLock, error) {
+	filename := filepath.Join(directory, directoryLockFilename)
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		var holder string
+		if b, err := os.ReadFile(filename); err == nil {
+			holder = strings.TrimSpace(string(b))
+		}
+		f.Close()
+		if err == errLocked {
+			if holder != "" {
+				return nil, fmt.Errorf("%s is in use by another run, with process ID %s", directory, holder)
+			}
+			return nil, fmt.Errorf("%s is in use by another run", directory)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %s", directory, err)
+	}
+	// The process ID is only informative, for the error above, so failing
+	// to write it isn't fatal
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &DirectoryLock{f: f}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place, since removing
+// it could allow a run that had just opened it, and another creating a new
+// one, to both hold the lock.
+func (l *DirectoryLock) Unlock() error {
+	return l.f.Close()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarning:
+		return "warning"
+	case LogLevelError:
+		return "error"
+	}
+	return "invalid"
+}
+
+func LogLevelFromString(s string) (LogLevel, error) {
+	for l := LogLevelDebug; l <= LogLevelError; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warning or error", s)
+}
+
+// Messages at levels other than info are logged with a prefix, allowing
+// existing calls to log.Printf to be logged at info level unchanged.
+func logLevelPrefix(l LogLevel) string {
+	return l.String() + ": "
+}
+
+func Debugf(format string, args ...interface{}) {
+	log.Printf(logLevelPrefix(LogLevelDebug)+format, args...)
+}
+
+func Warningf(format string, args ...interface{}) {
+	log.Printf(logLevelPrefix(LogLevelWarning)+format, args...)
+}
+
+// Fatal logs err at error level, and exits
+func Fatal(err error) {
+	log.Print(logLevelPrefix(LogLevelError) + err.Error())
+	os.Exit(1)
+}
+
+type LogFormat int
+
+const (
+	LogFormatText LogFormat = iota
+	LogFormatJSON
+)
+
+func LogFormatFromString(s string) (LogFormat, error) {
+	switch s {
+	case "text":
+		return LogFormatText, nil
+	case "json":
+		return LogFormatJSON, nil
+	}
+	return LogFormatText, fmt.Errorf("unknown log format %q, expected text or json", s)
+}
+
+type logLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+	// The last unindented message, giving context to indented lines,
+	// like the counts logged after reading each dataset
+	Section string `json:"section,omitempty"`
+	Depth   int    `json:"depth,omitempty"`
+}
+
+// logWriter receives lines from the log package, dropping those below
+// the minimum level, and formatting the remainder as text or JSON.
+type logWriter struct {
+	w       io.Writer
+	format  LogFormat
+	level   LogLevel
+	section string
+	lock    sync.Mutex
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	message := strings.TrimRight(string(b), "\n")
+	level := LogLevelInfo
+	for _, candidate := range []LogLevel{LogLevelDebug, LogLevelWarning, LogLevelError} {
+		if strings.HasPrefix(message, logLevelPrefix(candidate)) {
+			level = candidate
+			message = strings.TrimPrefix(message, logLevelPrefix(candidate))
+			break
+		}
+	}
+	if level < l.level {
+		return len(b), nil
+	}
+	trimmed := strings.TrimLeft(message, " ")
+	depth := (len(message) - len(trimmed)) / 2
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if depth == 0 {
+		l.section = trimmed
+	}
+	now := time.Now()
+	var err error
+	switch l.format {
+	case LogFormatText:
+		prefix := ""
+		if level != LogLevelInfo {
+			prefix = logLevelPrefix(level)
+		}
+		indent := message[0 : len(message)-len(trimmed)]
+		_, err = fmt.Fprintf(l.w, "%s %s%s%s\n", now.Format("2006/01/02 15:04:05"), indent, prefix, trimmed)
+	case LogFormatJSON:
+		line := logLine{
+			Time:    now.Format(time.RFC3339Nano),
+			Level:   level.String(),
+			Message: trimmed,
+			Depth:   depth,
+		}
+		if depth > 0 {
+			line.Section = l.section
+		}
+		var output []byte
+		if output, err = json.Marshal(line); err == nil {
+			output = append(output, '\n')
+			_, err = l.w.Write(output)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func setupLogging(format LogFormat, level LogLevel) {
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{w: os.Stderr, format: format, level: level})
+}
+
+// Progress reports completion of a long running stage. Implementations
+// are safe for concurrent use.
+type Progress interface {
+	Start(stage string, total int)
+	Add(n int)
+	Done()
+}
+
+type NoProgress struct{}
+
+func (NoProgress) Start(stage string, total int) {}
+func (NoProgress) Add(n int)                     {}
+func (NoProgress) Done()                         {}
+
+const (
+	// Progress is logged at every increment of this percentage, or after
+	// this interval, whichever comes first.
+	LogProgressPercentageStep = 10
+	LogProgressInterval       = 30 * time.Second
+)
+
+// LogProgress logs the percentage completion of the current stage, and
+// an estimate of the time remaining, assuming progress is linear.
+type LogProgress struct {
+	stage    string
+	total    int
+	done     int
+	start    time.Time
+	reported time.Time
+	next     int
+	lock     sync.Mutex
+}
+
+func (l *LogProgress) Start(stage string, total int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stage = stage
+	l.total = total
+	l.done = 0
+	l.start = time.Now()
+	l.reported = l.start
+	l.next = LogProgressPercentageStep
+}
+
+func (l *LogProgress) Add(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.done += n
+	if l.total <= 0 {
+		return
+	}
+	percentage := 100 * l.done / l.total
+	if percentage >= l.next || time.Since(l.reported) >= LogProgressInterval {
+		l.report(percentage)
+		l.next = (percentage/LogProgressPercentageStep + 1) * LogProgressPercentageStep
+	}
+}
+
+func (l *LogProgress) report(percentage int) {
+	l.reported = time.Now()
+	elapsed := l.reported.Sub(l.start)
+	eta := "unknown"
+	if l.done > 0 && l.done < l.total {
+		remaining := time.Duration(float64(elapsed) * float64(l.total-l.done) / float64(l.done))
+		eta = remaining.Round(time.Second).String()
+	}
+	log.Printf("  progress: %s: %d%% (%d/%d) elapsed: %s eta: %s", l.stage, percentage, l.done, l.total, elapsed.Round(time.Second), eta)
+}
+
+func (l *LogProgress) Done() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	log.Printf("  progress: %s: done in %s", l.stage, time.Since(l.start).Round(time.Second))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+type ManifestOutput struct {
+	Filename    string
+	Description string
+}
+
+// Manifest describes the outputs of a run, and is written alongside them
+// as manifest.json.
+type Manifest struct {
+	Scenario string
+	// The scope simulated, like icb:QMJ
+	Scope string `json:",omitempty"`
+	// Every person in the outputs is synthetic, and doesn't correspond
+	// to a real patient
+	Synthetic bool
+	Notes     []string
+	// The publishers and licences of the datasets the outputs are derived
+	// from
+	Sources []SourceAttribution `json:",omitempty"`
+	Outputs []ManifestOutput
+	// The time and memory used by each stage of the run
+	Timings []StageTiming `json:",omitempty"`
+	// Summary counts of the run, like the number of people simulated,
+	// keyed by name
+	Metrics map[string]float64 `json:",omitempty"`
+}
+
+func NewManifest(scenario string) *Manifest {
+	return &Manifest{
+		Scenario:  scenario,
+		Synthetic: true,
+		Notes:     []string{"All people in these outputs are synthetic, generated from aggregate published data"},
+	}
+}
+
+func (m *Manifest) AddOutput(filename string, description string) {
+	m.Outputs = append(m.Outputs, ManifestOutput{Filename: filename, Description: description})
+}
+
+func (m *Manifest) AddNote(note string) {
+	m.Notes = append(m.Notes, note)
+}
+
+func (m *Manifest) AddMetric(name string, value float64) {
+	if m.Metrics == nil {
+		m.Metrics = make(map[string]float64)
+	}
+	m.Metrics[name] = value
+}
+
+func (m *Manifest) Write(outputDirectory string) error {
+	output, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDirectory, "manifest.json"), output, 0644)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Measurement is a clinical measurement recorded for people with a
+// condition, against which QOF indicators of achievement are assessed.
+type Measurement int
+
+const (
+	MeasurementHbA1c Measurement = iota
+	MeasurementSystolicBP
+
+	MeasurementCount
+	MeasurementInvalid Measurement = -1
+)
+
+func (m Measurement) String() string {
+	switch m {
+	case MeasurementHbA1c:
+		return "hba1c"
+	case MeasurementSystolicBP:
+		return "systolic"
+	}
+	return "invalid"
+}
+
+func MeasurementFromString(s string) Measurement {
+	for m := Measurement(0); m < MeasurementCount; m++ {
+		if s == m.String() {
+			return m
+		}
+	}
+	return MeasurementInvalid
+}
+
+// MeasurementDistribution gives the distribution of a measurement among
+// people with its condition, as lognormal, with a standard deviation of the
+// log that's the same for everyone, and a mean chosen so that the
+// probability of a value at or below the target is the proportion
+// controlled for a person's age and sex, adjusted by a random effect for
+// their practice.
+type MeasurementDistribution struct {
+	Description string
+	Condition   string
+	// The value at or below which the condition is considered controlled
+	Target float64
+	// Proportion of those measured whose last value is at or below the
+	// target, by sex and age range
+	Controlled AgePrevalences
+	// Standard deviation of the natural log of the measurement
+	Sigma float64
+	// Standard deviation of the practice random effect on the log odds of
+	// control
+	PracticeSD float64 `yaml:"practicesd"`
+	// Proportion of people with the condition measured each year
+	Recorded float64
+
+	condition QOFCondition
+}
+
+// QOFIndicator is a QOF indicator of achievement assessed against a
+// measurement: the proportion of people with its condition, within its
+// ages, whose last measurement is at or below a threshold, from a
+// denominator that excludes personalised care adjustments.
+type QOFIndicator struct {
+	Code        string
+	Description string
+	Measurement string
+	// The maximum value meeting the indicator
+	Max float64
+	// The ages to which the indicator applies, or all ages if not given
+	Ages AgeRange
+	// The proportion of eligible people removed from the denominator by
+	// personalised care adjustments, which replaced exception reporting
+	PCAs float64 `yaml:"pcas"`
+
+	measurement Measurement
+}
+
+// MeasurementModel samples clinical measurements for people with
+// conditions, such that QOF achievement can be simulated for each
+// practice.
+type MeasurementModel struct {
+	Measurements map[string]*MeasurementDistribution
+	Indicators   []*QOFIndicator
+
+	distributions [MeasurementCount]*MeasurementDistribution
+}
+
+func readMeasurementModel(filename string) (*MeasurementModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open measurement model: %s", err)
+	}
+	defer f.Close()
+	var model MeasurementModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read measurement model: %s", err)
+	}
+	for name, d := range model.Measurements {
+		m := MeasurementFromString(name)
+		if m == MeasurementInvalid {
+			return nil, fmt.Errorf("unknown measurement %q", name)
+		}
+		if d.condition = QOFConditionFromString(d.Condition); d.condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q for measurement %s", d.Condition, name)
+		}
+		if d.Target <= 0.0 || d.Sigma <= 0.0 {
+			return nil, fmt.Errorf("measurement %s needs a positive target and sigma", name)
+		}
+		if d.Recorded < 0.0 || d.Recorded > 1.0 {
+			return nil, fmt.Errorf("measurement %s needs a recorded proportion between 0 and 1", name)
+		}
+		model.distributions[m] = d
+	}
+	codes := make(map[string]struct{})
+	for _, indicator := range model.Indicators {
+		if _, ok := codes[indicator.Code]; ok || indicator.Code == "" {
+			return nil, fmt.Errorf("indicator code %q missing, or given more than once", indicator.Code)
+		}
+		codes[indicator.Code] = struct{}{}
+		indicator.measurement = MeasurementFromString(indicator.Measurement)
+		if indicator.measurement == MeasurementInvalid || model.distributions[indicator.measurement] == nil {
+			return nil, fmt.Errorf("indicator %s needs a measurement given in the model, found %q", indicator.Code, indicator.Measurement)
+		}
+		if indicator.PCAs < 0.0 || indicator.PCAs >= 1.0 {
+			return nil, fmt.Errorf("indicator %s needs a proportion of personalised care adjustments between 0 and 1", indicator.Code)
+		}
+	}
+	return &model, nil
+}
+
+// warnUnsimulated warns about measurements whose condition isn't among
+// those simulated, since nobody will have them.
+func (m *MeasurementModel) warnUnsimulated(simulated []QOFCondition) {
+	var included QOFConditions
+	for _, c := range simulated {
+		included.Add(c)
+	}
+	for measurement, d := range m.distributions {
+		if d != nil && !included.Contains(d.condition) {
+			Warningf("  %s isn't simulated, so nobody will have a %s measurement", d.condition, Measurement(measurement))
+		}
+	}
+}
+
+// Sample returns a value of the measurement for p, with the given practice
+// effect on the log odds of control, or 0 if p doesn't have the condition,
+// or isn't measured.
+func (d *MeasurementDistribution) Sample(p *Person, effect float64, rng *rand.Rand) float64 {
+	if !p.Conditions.Contains(d.condition) || rng.Float64() >= d.Recorded {
+		return 0.0
+	}
+	controlled := clamp(d.Controlled.Prevalence(p.Sex, p.Age), MeasurementMinControlled, 1.0-MeasurementMinControlled)
+	controlled = logistic(logit(controlled) + effect)
+	// The mean of the log measurement, such that P(value <= target) = controlled
+	mu := math.Log(d.Target) - d.Sigma*math.Sqrt2*math.Erfinv(2.0*controlled-1.0)
+	return math.Exp(mu + d.Sigma*rng.NormFloat64())
+}
+
+// The bounds on the proportion controlled, to keep the lognormal
+// distribution well defined
+const MeasurementMinControlled = 0.01
+
+// assignMeasurements samples each measurement for the people registered
+// with each practice, with a random effect on the log odds of control for
+// each practice and measurement, so that achievement varies between
+// practices beyond the differences in their populations.
+func assignMeasurements(byPractice map[GPPracticeCode][]*Person, model *MeasurementModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	codes := make([]GPPracticeCode, 0, len(byPractice))
+	for code := range byPractice {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	var measured [MeasurementCount]int
+	for _, code := range codes {
+		if code == GPPracticeCodeInvalid {
+			continue
+		}
+		for m, d := range model.distributions {
+			if d == nil {
+				continue
+			}
+			effect := rng.NormFloat64() * d.PracticeSD
+			for _, p := range byPractice[code] {
+				p.Measurements[m] = float32(d.Sample(p, effect, rng))
+				if p.Measurements[m] > 0.0 {
+					measured[m]++
+				}
+			}
+		}
+	}
+	for m, d := range model.distributions {
+		if d != nil {
+			log.Printf("  %s: %d measured", Measurement(m), measured[m])
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const MetricsFilename = "metrics.json"
+
+// DatasetRead counts what was read from the file of a dataset
+type DatasetRead struct {
+	// The records read, including any header
+	Rows int
+	// Rows whose postcode couldn't be located, in the world, or the
+	// historic postcodes of the ONS Postcode Directory
+	MissingPostcodes int
+}
+
+// DatasetReads accumulates what's read from each dataset's file, keyed by
+// filename, since datasets that aren't in the data manifest, like most QOF
+// conditions, are recreated by each Get, and the organisations located by
+// a geocoding fallback, keyed by kind and code, since readers of practices
+// and sites are called more than once. Readers record into the
+// DatasetReads of the manifest from which their dataset came, given by
+// DataManifest.WithReads, so that each run counts only its own reads.
+type DatasetReads struct {
+	lock       sync.Mutex
+	byFilename map[string]*DatasetRead
+	fallbacks  map[string]*GeocodeFallback
+}
+
+func newDatasetReads() *DatasetReads {
+	return &DatasetReads{byFilename: make(map[string]*DatasetRead), fallbacks: make(map[string]*GeocodeFallback)}
+}
+
+// clone returns a copy of the reads so far, to which those of a scope are
+// added, without changing the reads of the inputs shared by others
+func (d *DatasetReads) clone() *DatasetReads {
+	if d == nil {
+		return newDatasetReads()
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	c := newDatasetReads()
+	for filename, r := range d.byFilename {
+		read := *r
+		c.byFilename[filename] = &read
+	}
+	for key, f := range d.fallbacks {
+		c.fallbacks[key] = f
+	}
+	return c
+}
+
+func (d *DatasetReads) record(filename string, f func(r *DatasetRead)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	r, ok := d.byFilename[filename]
+	if !ok {
+		r = &DatasetRead{}
+		d.byFilename[filename] = r
+	}
+	f(r)
+}
+
+// countDatasetRows records that rows were read from the file of dataset,
+// if it came from a manifest with reads
+func countDatasetRows(dataset *Dataset, rows int) {
+	if dataset.reads != nil {
+		dataset.reads.record(dataset.Filename, func(r *DatasetRead) { r.Rows += rows })
+	}
+}
+
+// countMissingPostcodes records that missing rows of dataset had a
+// postcode that couldn't be located
+func countMissingPostcodes(dataset *Dataset, missing int) {
+	if dataset.reads != nil {
+		dataset.reads.record(dataset.Filename, func(r *DatasetRead) { r.MissingPostcodes += missing })
+	}
+}
+
+// recordGeocodeFallback records that an organisation read from dataset
+// was located by a fallback, or not located, if dataset came from a
+// manifest with reads
+func recordGeocodeFallback(dataset *Dataset, f *GeocodeFallback) {
+	if dataset.reads != nil {
+		dataset.reads.lock.Lock()
+		dataset.reads.fallbacks[f.Kind+"/"+f.Code] = f
+		dataset.reads.lock.Unlock()
+	}
+}
+
+// GeocodeFallbacks returns the organisations located by a fallback, or
+// not located, ordered by kind and code.
+func (d *DatasetReads) GeocodeFallbacks() []*GeocodeFallback {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	fallbacks := make([]*GeocodeFallback, 0, len(d.fallbacks))
+	for _, f := range d.fallbacks {
+		fallbacks = append(fallbacks, f)
+	}
+	d.lock.Unlock()
+	sort.Slice(fallbacks, func(i, j int) bool {
+		if fallbacks[i].Kind != fallbacks[j].Kind {
+			return fallbacks[i].Kind < fallbacks[j].Kind
+		}
+		return fallbacks[i].Code < fallbacks[j].Code
+	})
+	return fallbacks
+}
+
+// DatasetMetrics is what was read from a dataset
+type DatasetMetrics struct {
+	Name     string
+	Filename string
+	DatasetRead
+}
+
+// RunMetrics is written as metrics.json at the end of a run, with the
+// resources used by each stage, what was read from each dataset, and
+// counters of the quality of the data, in a form that's stable between
+// runs, so that regressions in performance or data quality can be found
+// by comparing the files of two runs automatically.
+type RunMetrics struct {
+	Scenario string
+	Timings  []StageTiming
+	// Datasets read for the run, ordered by name, including the inputs
+	// shared by the scopes of a batch
+	Datasets []DatasetMetrics
+	// Counts of problems with the input data, keyed by name
+	Quality map[string]float64
+	// The summary counts of manifest.json
+	Metrics map[string]float64 `json:",omitempty"`
+}
+
+// newRunMetrics returns the metrics of a run, with what was read from
+// datasets, named by the data manifest, and quality counters from the
+// coverage of prevalences in the scope, and England.
+func newRunMetrics(manifest *Manifest, data DataManifest, reads *DatasetReads, coverage []*ConditionCoverage) *RunMetrics {
+	m := &RunMetrics{Scenario: manifest.Scenario, Timings: manifest.Timings, Metrics: manifest.Metrics, Quality: make(map[string]float64)}
+	names := make(map[string]string)
+	for name, dataset := range data {
+		names[dataset.Filename] = name
+	}
+
+	missingPostcodes := 0
+	if reads != nil {
+		reads.lock.Lock()
+		for filename, read := range reads.byFilename {
+			m.Datasets = append(m.Datasets, DatasetMetrics{Name: names[filename], Filename: filename, DatasetRead: *read})
+			missingPostcodes += read.MissingPostcodes
+		}
+		reads.lock.Unlock()
+	}
+	sort.Slice(m.Datasets, func(i, j int) bool {
+		if m.Datasets[i].Name != m.Datasets[j].Name {
+			return m.Datasets[i].Name < m.Datasets[j].Name
+		}
+		return m.Datasets[i].Filename < m.Datasets[j].Filename
+	})
+
+	m.Quality["missing_postcodes"] = float64(missingPostcodes)
+	for _, f := range reads.GeocodeFallbacks() {
+		if f.Method != GeocodeMissing {
+			m.Quality["geocoded_"+f.Method.String()]++
+		}
+	}
+	for _, c := range coverage {
+		m.Quality[c.Area+"_imputed_prevalences"] += float64(c.Imputed)
+		m.Quality[c.Area+"_missing_prevalences"] += float64(c.Missing)
+		m.Quality[c.Area+"_outlier_prevalences"] += float64(c.Outliers)
+		m.Quality[c.Area+"_unparsed_prevalences"] += float64(c.Unparsed)
+		if c.Area == CoverageAreaEngland {
+			m.Quality["unknown_practices"] += float64(c.UnknownPractices)
+		}
+	}
+	return m
+}
+
+func (m *RunMetrics) Write(outputDirectory string) error {
+	return writeJSONOutput(filepath.Join(outputDirectory, MetricsFilename), m, true)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenDatasetCountsRecords(t *testing.T) {
+	directory := t.TempDir()
+	gzipped := filepath.Join(directory, "gzipped.csv.gz")
+	writeGzippedCSV(t, gzipped, "code,name", "G1,One", "G2,Two")
+	// Gzipped, although its name doesn't say so
+	unnamed := filepath.Join(directory, "unnamed.csv")
+	writeGzippedCSV(t, unnamed, "code,name", "G1,One")
+	plain := filepath.Join(directory, "plain.csv")
+	if err := os.WriteFile(plain, []byte("code,name\n# A comment\nG1,One\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filename string
+		rows     int
+	}{
+		{gzipped, 3},
+		{unnamed, 2},
+		{plain, 2},
+	}
+	reads := newDatasetReads()
+	for _, test := range tests {
+		dataset := &Dataset{Filename: test.filename, reads: reads}
+		r, err := openDataset(dataset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Comment = '#'
+		for {
+			if _, err := r.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %s", test.filename, err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if read, ok := reads.byFilename[test.filename]; !ok || read.Rows != test.rows {
+			t.Errorf("%s: expected %d rows, found %v", test.filename, test.rows, read)
+		}
+	}
+
+	// Datasets outside a manifest with reads aren't counted
+	r, err := openDataset(&Dataset{Filename: plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Read()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDataset(&Dataset{Filename: filepath.Join(directory, "missing.csv")}); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to be reported as such, found %v", err)
+	}
+}
+
+func TestDataManifestWithReads(t *testing.T) {
+	data := DefaultDataManifest()
+	reads := newDatasetReads()
+	counted := data.WithReads(reads)
+	if data.Get(DatasetGPPractices).reads != nil {
+		t.Errorf("expected the original manifest to be unchanged")
+	}
+	for _, name := range []string{DatasetGPPractices, QOFConditionDataset(QOFConditionDiabetes)} {
+		if dataset := counted.Get(name); dataset.reads != reads {
+			t.Errorf("%s: expected reads to be counted", name)
+		} else if dataset.Filename != data.Get(name).Filename {
+			t.Errorf("%s: expected %s, found %s", name, data.Get(name).Filename, dataset.Filename)
+		}
+	}
+}
+
+func TestDatasetReadsPerScope(t *testing.T) {
+	directory := t.TempDir()
+	data := DefaultDataManifest()
+	successors := data.Get(DatasetGPPracticeSuccessors)
+	successors.Filename = filepath.Join(directory, "succ.csv.gz")
+	writeGzippedCSV(t, successors.Filename, "G1,G2,,20200101", "G3,G2,,20210101")
+	pharmacies := data.Get(DatasetPharmacies)
+	pharmacies.Filename = filepath.Join(directory, "pharmacies.csv")
+
+	inputs := &populationInputs{reads: newDatasetReads()}
+	if _, err := readGPPracticeSuccessors(data.WithReads(inputs.reads).Get(DatasetGPPracticeSuccessors)); err != nil {
+		t.Fatal(err)
+	}
+	// Each scope counts the shared inputs, and its own reads, but not
+	// those of other scopes
+	for i := 0; i < 2; i++ {
+		scoped := inputs.forScope()
+		countDatasetRows(data.WithReads(scoped.reads).Get(DatasetPharmacies), 5)
+		countMissingPostcodes(data.WithReads(scoped.reads).Get(DatasetPharmacies), 1)
+		recordGeocodeFallback(data.WithReads(scoped.reads).Get(DatasetPharmacies), &GeocodeFallback{Kind: "pharmacy", Code: fmt.Sprintf("F%d", i), Method: GeocodeHistoric})
+		m := newRunMetrics(NewManifest("baseline"), data, scoped.reads, nil)
+		expected := map[string]DatasetRead{
+			DatasetGPPracticeSuccessors: {Rows: 2},
+			DatasetPharmacies:           {Rows: 5, MissingPostcodes: 1},
+		}
+		if len(m.Datasets) != len(expected) {
+			t.Fatalf("scope %d: expected %d datasets, found %v", i, len(expected), m.Datasets)
+		}
+		for _, d := range m.Datasets {
+			if e, ok := expected[d.Name]; !ok || d.DatasetRead != e {
+				t.Errorf("scope %d: expected %v for %s, found %v", i, e, d.Name, d.DatasetRead)
+			}
+		}
+		if m.Quality["missing_postcodes"] != 1 {
+			t.Errorf("scope %d: expected 1 missing postcode, found %f", i, m.Quality["missing_postcodes"])
+		}
+		if m.Quality["geocoded_historic"] != 1 {
+			t.Errorf("scope %d: expected 1 postcode geocoded from historic postcodes, found %f", i, m.Quality["geocoded_historic"])
+		}
+		if m.Scenario != "baseline" {
+			t.Errorf("expected the scenario of the manifest, found %q", m.Scenario)
+		}
+	}
+	if fallbacks := inputs.reads.GeocodeFallbacks(); len(fallbacks) != 0 {
+		t.Errorf("expected the fallbacks of the inputs to be unchanged by scopes, found %v", fallbacks)
+	}
+	if read := inputs.reads.byFilename[pharmacies.Filename]; read != nil {
+		t.Errorf("expected the reads of the inputs to be unchanged by scopes, found %v", read)
+	}
+}
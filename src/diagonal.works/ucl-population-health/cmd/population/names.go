@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The reference date of the mid-year population estimates from which
+// ages are drawn, used to derive dates of birth.
+var PopulationEstimateDate = time.Date(2019, time.June, 30, 0, 0, 0, 0, time.UTC)
+
+type FirstNames struct {
+	Decade int
+	F      []string `yaml:"f"`
+	M      []string `yaml:"m"`
+}
+
+// The ethnic groups by which names are chosen, the high level categories
+// of the 2011 census, each of which is a column of the lsoa-ethnicity
+// dataset.
+var NameEthnicGroups = []string{"white", "mixed", "asian", "black", "other"}
+
+// NameGroup gives the names of people from an ethnic group, with the
+// group's share of the population of England and Wales, used for people
+// whose home LSOA's ethnic mix isn't known.
+type NameGroup struct {
+	Group      string
+	Share      float64
+	FirstNames []FirstNames `yaml:"firstnames"`
+	Surnames   []string
+}
+
+type Names struct {
+	Groups []*NameGroup
+
+	// The share of people from each group, in the order of Groups, across
+	// England and Wales, and for each LSOA, if known
+	shares    Probabilities
+	ethnicity map[LSOACode]Probabilities
+}
+
+func readNames(filename string) (*Names, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open names: %s", err)
+	}
+	defer f.Close()
+	var names Names
+	if err := yaml.NewDecoder(f).Decode(&names); err != nil {
+		return nil, fmt.Errorf("failed to read names: %s", err)
+	}
+	if len(names.Groups) == 0 {
+		return nil, fmt.Errorf("no names in %s", filename)
+	}
+	seen := make(map[string]struct{})
+	for _, g := range names.Groups {
+		known := false
+		for _, group := range NameEthnicGroups {
+			known = known || g.Group == group
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown ethnic group %q in %s, expected one of %s", g.Group, filename, strings.Join(NameEthnicGroups, ", "))
+		}
+		if _, ok := seen[g.Group]; ok {
+			return nil, fmt.Errorf("names for %s given more than once", g.Group)
+		}
+		seen[g.Group] = struct{}{}
+		if g.Share <= 0.0 {
+			return nil, fmt.Errorf("share of %s must be positive, found %f", g.Group, g.Share)
+		}
+		if len(g.FirstNames) == 0 || len(g.Surnames) == 0 {
+			return nil, fmt.Errorf("missing first names or surnames for %s", g.Group)
+		}
+		for _, n := range g.FirstNames {
+			if len(n.F) == 0 && len(n.M) == 0 {
+				return nil, fmt.Errorf("missing first names for %s in %d", g.Group, n.Decade)
+			}
+		}
+		names.shares = append(names.shares, g.Share)
+	}
+	normalise(names.shares)
+	return &names, nil
+}
+
+// readLSOAEthnicGroups returns the share of each LSOA's residents from
+// each of groups, among those from any of them, from the 2011 census.
+// Like readLSOAEthnicity, a missing file returns nil, rather than an
+// error.
+func readLSOAEthnicGroups(dataset *Dataset, groups []*NameGroup, geography *CensusGeography) (map[LSOACode]Probabilities, error) {
+	r, err := openDataset(dataset)
+	if os.IsNotExist(err) {
+		Warningf("names: no ethnicity data in %s, choosing ethnic groups by their share of England and Wales", dataset.Filename)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	required := []string{"lsoa-code"}
+	for _, group := range groups {
+		required = append(required, group.Group)
+	}
+	if err := dataset.CheckColumns(columns, required...); err != nil {
+		return nil, err
+	}
+
+	ethnicity := make(map[LSOACode]Probabilities)
+	badCounts := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		shares := make(Probabilities, len(groups))
+		total := 0
+		for i, group := range groups {
+			n, err := strconv.Atoi(row[columns[dataset.Column(group.Group)]])
+			if err != nil || n < 0 {
+				total = -1
+				break
+			}
+			shares[i] = float64(n)
+			total += n
+		}
+		if total <= 0 {
+			badCounts++
+			continue
+		}
+		normalise(shares)
+		for _, code := range geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]])) {
+			ethnicity[code] = shares
+		}
+	}
+	log.Printf("  ethnicity: lsoas: %d bad counts: %d", len(ethnicity), badCounts)
+	return ethnicity, nil
+}
+
+// forDecade returns the first names for the latest decade starting on
+// or before the given year of birth, or the earliest decade, if the year
+// is before all of them.
+func (n *NameGroup) forDecade(year int) *FirstNames {
+	var latest, earliest *FirstNames
+	for i := range n.FirstNames {
+		names := &n.FirstNames[i]
+		if names.Decade <= year && (latest == nil || names.Decade > latest.Decade) {
+			latest = names
+		}
+		if earliest == nil || names.Decade < earliest.Decade {
+			earliest = names
+		}
+	}
+	if latest != nil {
+		return latest
+	}
+	return earliest
+}
+
+// chooseGroup returns an ethnic group for a person living in home, at
+// random, in proportion to the share of its residents from each group, or
+// of the population of England and Wales, if they aren't known.
+func (n *Names) chooseGroup(home LSOACode, rng *rand.Rand) *NameGroup {
+	shares, ok := n.ethnicity[home]
+	if !ok {
+		shares = n.shares
+	}
+	return n.Groups[shares.ChooseWith(rng)]
+}
+
+func (n *Names) Choose(sex Sex, born time.Time, home LSOACode, rng *rand.Rand) (string, string) {
+	group := n.chooseGroup(home, rng)
+	first := group.forDecade(born.Year())
+	var choices []string
+	switch sex {
+	case Male:
+		choices = first.M
+	case Female:
+		choices = first.F
+	default:
+		choices = first.F
+		if rng.Intn(2) == 0 {
+			choices = first.M
+		}
+	}
+	// Decades may only list names for one sex
+	if len(choices) == 0 {
+		choices = first.F
+		if len(choices) == 0 {
+			choices = first.M
+		}
+	}
+	return choices[rng.Intn(len(choices))], group.Surnames[rng.Intn(len(group.Surnames))]
+}
+
+// chooseDateOfBirth returns a date of birth uniformly distributed over
+// the year that gives the person their age at the reference date.
+func chooseDateOfBirth(age int, reference time.Time, rng *rand.Rand) time.Time {
+	latest := reference.AddDate(-age, 0, 0)
+	earliest := reference.AddDate(-(age + 1), 0, 1)
+	days := int(latest.Sub(earliest).Hours()/24) + 1
+	return earliest.AddDate(0, 0, rng.Intn(days))
+}
+
+type PersonName struct {
+	Given       string
+	Family      string
+	DateOfBirth time.Time
+}
+
+// assignNames gives each person living in homes a fake name and a date
+// of birth consistent with their age, for use as test data.
+func assignNames(people []Person, homes LSOASet, names *Names) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			born := chooseDateOfBirth(people[i].Age, PopulationEstimateDate, rng)
+			given, family := names.Choose(people[i].Sex, born, people[i].Home, rng)
+			people[i].Name = &PersonName{Given: given, Family: family, DateOfBirth: born}
+		}
+	}
+}
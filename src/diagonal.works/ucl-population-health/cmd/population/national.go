@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The directory, within the output directory of a batch, to which the
+// outputs of every scope are merged
+const BatchMergedDirectory = "merged"
+
+// nationalScopes returns a scope for every ICB in England, from the
+// lsoa-icb dataset, translated to the geography of censusYear, in order
+// of code.
+func nationalScopes(data DataManifest, censusYear int) ([]Scope, error) {
+	geography, err := censusGeographyForYear(censusYear, data)
+	if err != nil {
+		return nil, err
+	}
+	icbs, err := readICBs(data.Get(DatasetLSOAICB), geography)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, len(icbs))
+	for code := range icbs {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	scopes := make([]Scope, 0, len(codes))
+	for _, code := range codes {
+		scopes = append(scopes, Scope{Kind: ScopeKindICB, Code: code})
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no icbs in %s", data.Get(DatasetLSOAICB).Filename)
+	}
+	return scopes, nil
+}
+
+// mergeBatchOutputs concatenates each CSV output of the scopes that
+// succeeded into BatchMergedDirectory, in the order of the runs, with a
+// scope column added before the others, returning the filenames merged.
+// Outputs are streamed, rather than read into memory, so that merging
+// population.csv for every ICB needs no more memory than one row. Runs
+// whose header for an output differs from that of the first are skipped
+// for it, and logged. Person level outputs only include residents of each
+// run's scope, and every run numbers its people from 0, so their ids are
+// offset by the people of the runs before, to be unique across the merge.
+// Practice level outputs aren't deduplicated: people drawn from the buffer
+// of a scope are also simulated as residents of their own.
+func mergeBatchOutputs(runs []*BatchRun, output string) ([]string, error) {
+	filenames := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, run := range runs {
+		if run.Err != nil {
+			continue
+		}
+		for _, o := range run.Manifest.Outputs {
+			if _, ok := seen[o.Filename]; !ok && strings.HasSuffix(o.Filename, ".csv") {
+				seen[o.Filename] = struct{}{}
+				filenames = append(filenames, o.Filename)
+			}
+		}
+	}
+	if len(filenames) == 0 {
+		return nil, nil
+	}
+	directory := filepath.Join(output, BatchMergedDirectory)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	offsets := make(map[*BatchRun]int)
+	next := 0
+	for _, run := range runs {
+		if run.Err == nil {
+			offsets[run] = next
+			next += int(run.Manifest.Metrics["people"])
+		}
+	}
+	for _, filename := range filenames {
+		var ids map[*BatchRun]int
+		if _, ok := mergedPersonOutputs[filename]; ok {
+			ids = offsets
+		}
+		rows, skipped, err := mergeBatchOutput(runs, filename, filepath.Join(directory, filename), ids)
+		if err != nil {
+			return nil, fmt.Errorf("merge %s: %s", filename, err)
+		}
+		log.Printf("  %s: rows: %d", filename, rows)
+		for _, scope := range skipped {
+			Warningf("  %s: %s has different columns, so wasn't merged", filename, scope)
+		}
+	}
+	return filenames, nil
+}
+
+// The person level outputs whose id column is offset when merged
+var mergedPersonOutputs = map[string]struct{}{
+	"population.csv":         {},
+	PersonConditionsFilename: {},
+}
+
+// mergeBatchOutput concatenates filename from the output directories of
+// runs into merged, returning the number of rows written, and the scopes
+// skipped as their header differed from the first. The provenance lines,
+// starting with #, of the first are kept, and those of the others dropped.
+// If ids isn't nil, it gives the offset added to the id column of each
+// run.
+func mergeBatchOutput(runs []*BatchRun, filename string, merged string, ids map[*BatchRun]int) (int, []Scope, error) {
+	f, err := os.OpenFile(merged, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, nil, err
+	}
+	b := bufio.NewWriter(f)
+	w := csv.NewWriter(b)
+	var header []string
+	provenance := false
+	rows := 0
+	skipped := make([]Scope, 0)
+	for _, run := range runs {
+		if run.Err != nil {
+			continue
+		}
+		in, err := os.Open(filepath.Join(run.OutputDirectory, filename))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			f.Close()
+			return 0, nil, err
+		}
+		br := bufio.NewReader(in)
+		if !provenance {
+			// Nothing has yet been written through w, so lines can be
+			// written to b directly
+			for {
+				if next, err := br.Peek(1); err != nil || next[0] != '#' {
+					break
+				}
+				line, err := br.ReadString('\n')
+				b.WriteString(line)
+				provenance = true
+				if err != nil {
+					break
+				}
+			}
+		}
+		r := csv.NewReader(br)
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.ReuseRecord = true
+		row, err := r.Read()
+		if err == io.EOF {
+			in.Close()
+			continue
+		} else if err != nil {
+			in.Close()
+			f.Close()
+			return 0, nil, fmt.Errorf("%s: %s", run.Scope, err)
+		}
+		if header == nil {
+			header = append([]string{}, row...)
+			w.Write(append([]string{"scope"}, header...))
+		} else if !sameColumns(row, header) {
+			in.Close()
+			skipped = append(skipped, run.Scope)
+			continue
+		}
+		id := -1
+		if ids != nil {
+			for i, column := range header {
+				if column == "id" {
+					id = i
+				}
+			}
+		}
+		scope := run.Scope.String()
+		out := make([]string, 0, len(header)+1)
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				in.Close()
+				f.Close()
+				return 0, nil, fmt.Errorf("%s: %s", run.Scope, err)
+			}
+			if id >= 0 && id < len(row) {
+				n, err := strconv.Atoi(row[id])
+				if err != nil {
+					in.Close()
+					f.Close()
+					return 0, nil, fmt.Errorf("%s: bad id %q", run.Scope, row[id])
+				}
+				row[id] = strconv.Itoa(n + ids[run])
+			}
+			out = append(append(out[0:0], scope), row...)
+			w.Write(out)
+			rows++
+		}
+		in.Close()
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if err := b.Flush(); err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return rows, skipped, f.Close()
+}
+
+func sameColumns(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
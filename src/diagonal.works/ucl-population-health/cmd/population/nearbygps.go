@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The identifier and version of the encoding of NearbyGPs, written at the
+// start of each cached artifact, to be incremented when the encoding
+// changes, so that artifacts in the old encoding fail to decode, and are
+// rebuilt, rather than misread.
+const (
+	NearbyGPsMagic         = "NGP"
+	NearbyGPsFormatVersion = 1
+)
+
+// NearbyGP is a practice near an LSOA, with the great circle distance
+// from the LSOA's centre to the practice, and optionally the expected
+// travel time.
+type NearbyGP struct {
+	Practice  GPPracticeCode
+	DistanceM float64
+	// NaN if not estimated
+	TravelMinutes float64
+}
+
+// NearbyGPs gives the practices near each LSOA, within the search radius
+// of the rurality model.
+type NearbyGPs map[LSOACode][]NearbyGP
+
+// Practices returns the codes of the practices near lsoa
+func (n NearbyGPs) Practices(lsoa LSOACode) []GPPracticeCode {
+	codes := make([]GPPracticeCode, len(n[lsoa]))
+	for i, gp := range n[lsoa] {
+		codes[i] = gp.Practice
+	}
+	return codes
+}
+
+// AddTravelMinutes estimates the travel time from each LSOA to each of its
+// nearby practices, from their distance.
+func (n NearbyGPs) AddTravelMinutes(travel *TravelAssumptions) {
+	for _, gps := range n {
+		for i := range gps {
+			gps[i].TravelMinutes = travel.Minutes(gps[i].DistanceM)
+		}
+	}
+}
+
+// MarshalBinary encodes the lookup compactly for the cache, since it's
+// large, and read on every run: a header giving the format version, and
+// whether travel times are included, followed by a table of practice
+// codes, then each LSOA, in order, with the index of each of its
+// practices in the table, and their distance.
+func (n NearbyGPs) MarshalBinary() ([]byte, error) {
+	lsoas := make([]LSOACode, 0, len(n))
+	indices := make(map[GPPracticeCode]int)
+	practices := make([]GPPracticeCode, 0)
+	travel := false
+	for lsoa, gps := range n {
+		lsoas = append(lsoas, lsoa)
+		for _, gp := range gps {
+			if _, ok := indices[gp.Practice]; !ok {
+				indices[gp.Practice] = len(practices)
+				practices = append(practices, gp.Practice)
+			}
+			if !math.IsNaN(gp.TravelMinutes) {
+				travel = true
+			}
+		}
+	}
+	sort.Slice(lsoas, func(i, j int) bool { return lsoas[i] < lsoas[j] })
+
+	var b bytes.Buffer
+	b.WriteString(NearbyGPsMagic)
+	writeUvarint(&b, NearbyGPsFormatVersion)
+	if travel {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	writeUvarint(&b, uint64(len(practices)))
+	for _, code := range practices {
+		writeString(&b, code.String())
+	}
+	writeUvarint(&b, uint64(len(lsoas)))
+	for _, lsoa := range lsoas {
+		writeString(&b, lsoa.String())
+		writeUvarint(&b, uint64(len(n[lsoa])))
+		for _, gp := range n[lsoa] {
+			writeUvarint(&b, uint64(indices[gp.Practice]))
+			binary.Write(&b, binary.LittleEndian, gp.DistanceM)
+			if travel {
+				binary.Write(&b, binary.LittleEndian, gp.TravelMinutes)
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func (n *NearbyGPs) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(NearbyGPsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != NearbyGPsMagic {
+		return fmt.Errorf("nearby gps: not a nearby practices lookup")
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("nearby gps: %s", err)
+	} else if version != NearbyGPsFormatVersion {
+		return fmt.Errorf("nearby gps: format version %d, expected %d", version, NearbyGPsFormatVersion)
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("nearby gps: %s", err)
+	}
+	travel := flags&1 != 0
+	invalid := func(err error) error {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("nearby gps: %s", err)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return invalid(err)
+	}
+	practices := make([]GPPracticeCode, 0, count)
+	for i := uint64(0); i < count; i++ {
+		code, err := readString(r)
+		if err != nil {
+			return invalid(err)
+		}
+		practices = append(practices, GPPracticeCode(code))
+	}
+	if count, err = binary.ReadUvarint(r); err != nil {
+		return invalid(err)
+	}
+	decoded := make(NearbyGPs, count)
+	for i := uint64(0); i < count; i++ {
+		lsoa, err := readString(r)
+		if err != nil {
+			return invalid(err)
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return invalid(err)
+		}
+		gps := make([]NearbyGP, 0, length)
+		for j := uint64(0); j < length; j++ {
+			index, err := binary.ReadUvarint(r)
+			if err != nil {
+				return invalid(err)
+			} else if index >= uint64(len(practices)) {
+				return fmt.Errorf("nearby gps: practice %d out of range", index)
+			}
+			gp := NearbyGP{Practice: practices[index], TravelMinutes: math.NaN()}
+			if err := binary.Read(r, binary.LittleEndian, &gp.DistanceM); err != nil {
+				return invalid(err)
+			}
+			if travel {
+				if err := binary.Read(r, binary.LittleEndian, &gp.TravelMinutes); err != nil {
+					return invalid(err)
+				}
+			}
+			gps = append(gps, gp)
+		}
+		decoded[LSOACode(lsoa)] = gps
+	}
+	*n = decoded
+	return nil
+}
+
+func writeUvarint(b *bytes.Buffer, v uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	b.Write(buffer[0:binary.PutUvarint(buffer[:], v)])
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	writeUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	} else if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
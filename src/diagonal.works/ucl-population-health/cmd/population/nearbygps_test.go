@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func equalNearbyGPs(a NearbyGPs, b NearbyGPs) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for lsoa, gps := range a {
+		other, ok := b[lsoa]
+		if !ok || len(other) != len(gps) {
+			return false
+		}
+		for i, gp := range gps {
+			o := other[i]
+			if o.Practice != gp.Practice || o.DistanceM != gp.DistanceM {
+				return false
+			} else if math.IsNaN(gp.TravelMinutes) != math.IsNaN(o.TravelMinutes) || (!math.IsNaN(gp.TravelMinutes) && gp.TravelMinutes != o.TravelMinutes) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestNearbyGPsBinaryRoundTrip(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name string
+		n    NearbyGPs
+	}{
+		{"empty", NearbyGPs{}},
+		{"distances", NearbyGPs{
+			"E01000001": {{Practice: "G1", DistanceM: 120.5, TravelMinutes: nan}, {Practice: "G2", DistanceM: 1800.0, TravelMinutes: nan}},
+			"E01000002": {{Practice: "G2", DistanceM: 0.0, TravelMinutes: nan}},
+			"E01000003": {},
+		}},
+		{"travel", NearbyGPs{
+			"E01000001": {{Practice: "G1", DistanceM: 120.5, TravelMinutes: 3.25}, {Practice: "G3", DistanceM: 950.0, TravelMinutes: nan}},
+		}},
+	}
+	for _, test := range tests {
+		data, err := test.n.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded NearbyGPs
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+		} else if !equalNearbyGPs(test.n, decoded) {
+			t.Errorf("%s: expected %v, found %v", test.name, test.n, decoded)
+		}
+		// Every truncation is reported, rather than misread
+		for i := 0; i < len(data); i++ {
+			var truncated NearbyGPs
+			if err := truncated.UnmarshalBinary(data[:i]); err == nil {
+				t.Errorf("%s: expected an error for data truncated to %d bytes", test.name, i)
+				break
+			}
+		}
+	}
+}
+
+func TestNearbyGPsUnmarshalBinaryRejectsOtherFormats(t *testing.T) {
+	data, err := NearbyGPs{"E01000001": {{Practice: "G1", DistanceM: 1.0, TravelMinutes: math.NaN()}}}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	magic := append([]byte("XYZ"), data[len(NearbyGPsMagic):]...)
+	version := append([]byte{}, data...)
+	version[len(NearbyGPsMagic)] = NearbyGPsFormatVersion + 1
+	for name, data := range map[string][]byte{"magic": magic, "version": version} {
+		var n NearbyGPs
+		if err := n.UnmarshalBinary(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
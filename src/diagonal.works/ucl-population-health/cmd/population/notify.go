@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The time allowed for each attempt to post a notification
+	NotifyTimeout = 10 * time.Second
+	// Attempts made to post a notification before giving up, waiting
+	// NotifyRetryDelay after the first failure, and doubling each time
+	NotifyAttempts   = 3
+	NotifyRetryDelay = 2 * time.Second
+)
+
+// RunNotification is posted, as JSON, to --notify-url when a run finishes
+// or fails, so that orchestration systems can follow long simulations.
+type RunNotification struct {
+	// A one line summary, shown by Slack incoming webhooks, which ignore
+	// the other fields
+	Text            string `json:"text"`
+	Command         string
+	Status          string
+	Error           string `json:",omitempty"`
+	Scope           string `json:",omitempty"`
+	OutputDirectory string `json:",omitempty"`
+	Host            string `json:",omitempty"`
+	Started         time.Time
+	WallSeconds     float64
+	// Summary counts of the run, from its manifest for simulate, or of
+	// its scopes for batch
+	Metrics map[string]float64 `json:",omitempty"`
+	// The manifest of the run, for simulate, if it succeeded
+	Manifest *Manifest `json:",omitempty"`
+}
+
+const (
+	RunStatusSucceeded = "succeeded"
+	RunStatusFailed    = "failed"
+)
+
+// notifyFlags give the webhook to notify when a command finishes
+type notifyFlags struct {
+	url         *string
+	failureOnly *bool
+}
+
+func addNotifyFlags(flags *flag.FlagSet) *notifyFlags {
+	return &notifyFlags{
+		url:         flags.String("notify-url", "", "POST a JSON summary of the run, with its manifest and summary metrics, to this URL when it finishes or fails, eg a Slack incoming webhook"),
+		failureOnly: flags.Bool("notify-failure-only", false, "With --notify-url, only notify when the run fails"),
+	}
+}
+
+// run calls f, posting a notification of its outcome when it returns if
+// a URL was given. A failure to notify is logged, and doesn't change the
+// error returned by f.
+func (n *notifyFlags) run(command string, f func(notification *RunNotification) error) error {
+	notification := &RunNotification{Command: command, Started: time.Now()}
+	err := f(notification)
+	if *n.url == "" || (err == nil && *n.failureOnly) {
+		return err
+	}
+	notification.WallSeconds = time.Since(notification.Started).Seconds()
+	notification.Host, _ = os.Hostname()
+	if err != nil {
+		notification.Status = RunStatusFailed
+		notification.Error = err.Error()
+	} else {
+		notification.Status = RunStatusSucceeded
+	}
+	notification.Text = notification.summary()
+	if nerr := postNotification(*n.url, notification); nerr != nil {
+		Warningf("notify: %s", nerr)
+	} else {
+		log.Printf("notify: sent %s notification", notification.Status)
+	}
+	return err
+}
+
+// summary returns a one line description of the outcome of the run
+func (r *RunNotification) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "population %s", r.Command)
+	if r.Scope != "" {
+		fmt.Fprintf(&b, " %s", r.Scope)
+	}
+	fmt.Fprintf(&b, " %s after %s", r.Status, time.Duration(r.WallSeconds*float64(time.Second)).Round(time.Second))
+	if r.Host != "" {
+		fmt.Fprintf(&b, " on %s", r.Host)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, ": %s", r.Error)
+	} else if len(r.Metrics) > 0 {
+		names := make([]string, 0, len(r.Metrics))
+		for name := range r.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]string, len(names))
+		for i, name := range names {
+			metrics[i] = fmt.Sprintf("%s: %.0f", name, r.Metrics[name])
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(metrics, ", "))
+	}
+	return b.String()
+}
+
+// readRunManifest returns the manifest written to output by a run, or an
+// error if there isn't one.
+func readRunManifest(output string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(output, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%s: %s", f.Name(), err)
+	}
+	return &manifest, nil
+}
+
+// postNotification posts the notification to target, retrying failed
+// attempts, returning an error if none succeeded. Errors don't include
+// the URL, since webhook URLs are often secrets.
+func postNotification(target string, notification *RunNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: NotifyTimeout}
+	delay := NotifyRetryDelay
+	for attempt := 1; ; attempt++ {
+		var response *http.Response
+		response, err = client.Post(target, "application/json", bytes.NewReader(body))
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		} else if err == nil {
+			response.Body.Close()
+			if response.StatusCode >= 200 && response.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("%s", response.Status)
+		}
+		if attempt == NotifyAttempts {
+			return fmt.Errorf("failed after %d attempts: %s", attempt, err)
+		}
+		Warningf("notify: %s, retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
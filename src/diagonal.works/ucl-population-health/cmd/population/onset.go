@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The oldest age for which onset is sampled, beyond the top coded ages of
+// the census population
+const OnsetMaxAge = 120
+
+// IncidenceModel gives the annual incidence of each condition, the
+// fraction of people without it who are diagnosed during each year of
+// age, by sex and age range.
+type IncidenceModel struct {
+	ByCondition map[QOFCondition]AgePrevalences
+
+	// Cumulative probability of onset by each age, given by the survival
+	// function, indexed by condition, sex, then age
+	cumulative map[QOFCondition][][]float64
+}
+
+func readIncidenceModel(filename string) (*IncidenceModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open incidence: %s", err)
+	}
+	defer f.Close()
+	var y map[string]AgePrevalences
+	if err := yaml.NewDecoder(f).Decode(&y); err != nil {
+		return nil, fmt.Errorf("failed to read incidence: %s", err)
+	}
+	model := &IncidenceModel{
+		ByCondition: make(map[QOFCondition]AgePrevalences),
+		cumulative:  make(map[QOFCondition][][]float64),
+	}
+	for name, incidence := range y {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in incidence", name)
+		}
+		model.ByCondition[condition] = incidence
+	}
+	return model, nil
+}
+
+// cumulativeOnset returns, for each age, the probability that onset
+// happened at or before that age, with the probability of onset at age a
+// being the chance of remaining free of the condition until a, multiplied
+// by the chance of diagnosis during that year.
+func (m *IncidenceModel) cumulativeOnset(condition QOFCondition, sex Sex) []float64 {
+	if byCondition, ok := m.cumulative[condition]; ok && int(sex) < len(byCondition) && byCondition[sex] != nil {
+		return byCondition[sex]
+	}
+	for len(m.cumulative[condition]) <= int(sex) {
+		m.cumulative[condition] = append(m.cumulative[condition], nil)
+	}
+	cumulative := make([]float64, OnsetMaxAge+1)
+	incidence := m.ByCondition[condition]
+	survival := 1.0
+	total := 0.0
+	for age := range cumulative {
+		h := incidence.Prevalence(sex, age)
+		onset := survival * (1.0 - math.Exp(-h))
+		survival -= onset
+		total += onset
+		cumulative[age] = total
+	}
+	m.cumulative[condition][sex] = cumulative
+	return cumulative
+}
+
+// Sample returns the age at which a person of the given sex and age, who
+// has the condition, was diagnosed with it. People for whom the model
+// gives no chance of onset by their age are diagnosed at that age.
+func (m *IncidenceModel) Sample(condition QOFCondition, sex Sex, age int, rng *rand.Rand) int {
+	if age > OnsetMaxAge {
+		age = OnsetMaxAge
+	}
+	cumulative := m.cumulativeOnset(condition, sex)
+	if cumulative[age] <= 0.0 {
+		return age
+	}
+	u := rng.Float64() * cumulative[age]
+	return sort.Search(age+1, func(a int) bool { return cumulative[a] > u })
+}
+
+// assignOnsetAges samples the age of onset of each condition a person has,
+// using the incidence given by model. Conditions without incidence are
+// treated as diagnosed at the person's current age. Parents of the
+// conditions are then given the earliest onset of their sub-conditions.
+func assignOnsetAges(people []Person, conditions []QOFCondition, model *IncidenceModel) {
+	for _, condition := range conditions {
+		if _, ok := model.ByCondition[condition]; !ok {
+			Warningf("  no incidence for %s, assuming onset at current age", condition)
+		}
+	}
+	// Build the cumulative tables before sampling
+	for _, condition := range conditions {
+		for _, sex := range AllSexes() {
+			model.cumulativeOnset(condition, sex)
+		}
+	}
+	deepest := AllQOFConditions()
+	sort.SliceStable(deepest, func(i, j int) bool {
+		return len(deepest[i].Ancestors()) > len(deepest[j].Ancestors())
+	})
+	totals := make(map[QOFCondition]int)
+	durations := make(map[QOFCondition]int)
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := range people {
+		p := &people[i]
+		var sampled QOFConditions
+		for _, condition := range conditions {
+			if p.Conditions.Contains(condition) {
+				onset := model.Sample(condition, p.Sex, p.Age, rng)
+				p.OnsetAges[condition.Index()] = int16(onset)
+				sampled.Add(condition)
+				totals[condition]++
+				durations[condition] += p.Age - onset
+			}
+		}
+		rollUpOnsetAges(p, sampled, deepest)
+	}
+	for _, condition := range conditions {
+		if totals[condition] > 0 {
+			log.Printf("  %s: mean duration: %.1f years", condition, float64(durations[condition])/float64(totals[condition]))
+		}
+	}
+}
+
+// rollUpOnsetAges sets the onset age of each parent of a condition with a
+// sampled, or rolled up, onset to the earliest of its own and those of its
+// sub-conditions, so that nobody is diagnosed with a sub-condition before
+// its parent. deepest gives every condition, with children before their
+// parents.
+func rollUpOnsetAges(p *Person, sampled QOFConditions, deepest []QOFCondition) {
+	for _, c := range deepest {
+		parent := c.Parent()
+		if parent == QOFConditionInvalid || !sampled.Contains(c) || !p.Conditions.Contains(parent) {
+			continue
+		}
+		if onset := p.OnsetAges[c.Index()]; !sampled.Contains(parent) || onset < p.OnsetAges[parent.Index()] {
+			p.OnsetAges[parent.Index()] = onset
+		}
+		sampled.Add(parent)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadRepositoryIncidence(t *testing.T) {
+	model, err := readIncidenceModel(filepath.Join("..", "..", "..", "..", "..", "data", "incidence.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions, err := readConditions("dm,hyp,copd,chd,stia,af,hf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(42))
+	for _, c := range conditions {
+		incidence, ok := model.ByCondition[c]
+		if !ok {
+			t.Errorf("expected incidence for %s", c)
+			continue
+		}
+		for _, sex := range []Sex{Male, Female} {
+			if incidence.Prevalence(sex, 75) <= incidence.Prevalence(sex, 45) {
+				t.Errorf("%s: expected incidence to rise with age", c)
+			}
+			if onset := model.Sample(c, sex, 70, rng); onset < 0 || onset > 70 {
+				t.Errorf("%s: expected onset by 70, found %d", c, onset)
+			}
+		}
+	}
+}
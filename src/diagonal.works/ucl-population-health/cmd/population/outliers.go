@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrevalenceOutlierStrategy decides how the reported QOF prevalence of
+// practices that appear not to be reporting correctly is adjusted before
+// it's used to calibrate the simulation.
+type PrevalenceOutlierStrategy int
+
+const (
+	// Prevalence at or above a fixed threshold is replaced with the mean
+	// of that of the other practices
+	PrevalenceOutlierThreshold PrevalenceOutlierStrategy = iota
+	// Prevalence more than a number of standard deviations from the mean
+	// of all practices is replaced with the mean of that of the others
+	PrevalenceOutlierZScore
+	// Prevalence beyond a quantile at either end is clipped to that
+	// quantile
+	PrevalenceOutlierWinsorize
+	// Reported prevalence is used unchanged
+	PrevalenceOutlierNone
+)
+
+func (p PrevalenceOutlierStrategy) String() string {
+	switch p {
+	case PrevalenceOutlierThreshold:
+		return "threshold"
+	case PrevalenceOutlierZScore:
+		return "zscore"
+	case PrevalenceOutlierWinsorize:
+		return "winsorize"
+	case PrevalenceOutlierNone:
+		return "none"
+	}
+	return "invalid"
+}
+
+// PrevalenceOutlierRule is a strategy, with its parameter: the threshold,
+// number of standard deviations, or quantile.
+type PrevalenceOutlierRule struct {
+	Strategy  PrevalenceOutlierStrategy
+	Parameter float64
+}
+
+// Some practices have prevalences high enough to suggest that they're not
+// reporting correctly, so by default, replace these with the average
+const DefaultPrevalenceOutlier = "threshold:0.4"
+
+func (p PrevalenceOutlierRule) String() string {
+	if p.Strategy == PrevalenceOutlierNone {
+		return p.Strategy.String()
+	}
+	return fmt.Sprintf("%s:%s", p.Strategy, strconv.FormatFloat(p.Parameter, 'g', -1, 64))
+}
+
+func PrevalenceOutlierRuleFromString(s string) (PrevalenceOutlierRule, error) {
+	expected := fmt.Errorf("unknown prevalence outlier rule %q, expected none, threshold:<prevalence>, zscore:<standard deviations> or winsorize:<quantile>", s)
+	name, value, found := strings.Cut(s, ":")
+	for strategy := PrevalenceOutlierThreshold; strategy <= PrevalenceOutlierNone; strategy++ {
+		if strategy.String() != name {
+			continue
+		}
+		if strategy == PrevalenceOutlierNone {
+			if found {
+				return PrevalenceOutlierRule{}, expected
+			}
+			return PrevalenceOutlierRule{Strategy: strategy}, nil
+		}
+		parameter, err := strconv.ParseFloat(value, 64)
+		if !found || err != nil {
+			return PrevalenceOutlierRule{}, expected
+		}
+		switch strategy {
+		case PrevalenceOutlierThreshold:
+			if parameter <= 0.0 || parameter > 1.0 {
+				return PrevalenceOutlierRule{}, fmt.Errorf("prevalence outlier threshold must be greater than 0, and at most 1")
+			}
+		case PrevalenceOutlierZScore:
+			if parameter <= 0.0 {
+				return PrevalenceOutlierRule{}, fmt.Errorf("prevalence outlier z-score must be positive")
+			}
+		case PrevalenceOutlierWinsorize:
+			if parameter <= 0.0 || parameter >= 0.5 {
+				return PrevalenceOutlierRule{}, fmt.Errorf("prevalence outlier winsorizing quantile must be greater than 0, and less than 0.5")
+			}
+		}
+		return PrevalenceOutlierRule{Strategy: strategy, Parameter: parameter}, nil
+	}
+	return PrevalenceOutlierRule{}, expected
+}
+
+// PrevalenceAdjustment records the change to the reported prevalence of a
+// condition at a practice made by the outlier rule.
+type PrevalenceAdjustment struct {
+	Practice  GPPracticeCode
+	Condition QOFCondition
+	Reported  float64
+	Adjusted  float64
+}
+
+// adjustPrevalenceOutliers applies rule to the reported prevalence of each
+// condition with a register, across every practice that reported it,
+// returning the adjustments made, ordered by condition then practice.
+func adjustPrevalenceOutliers(gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, rule PrevalenceOutlierRule) []PrevalenceAdjustment {
+	adjustments := make([]PrevalenceAdjustment, 0)
+	var average ConditionFraction
+	log.Printf("prevalence outliers: %s", rule)
+	for _, condition := range conditions {
+		if !condition.HasRegister() {
+			continue
+		}
+		codes := make([]GPPracticeCode, 0, len(gps))
+		for code, gp := range gps {
+			if _, ok := gp.ConditionPrevalence[condition]; ok {
+				codes = append(codes, code)
+			}
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		values := make([]float64, len(codes))
+		for i, code := range codes {
+			values[i] = gps[code].ConditionPrevalence[condition]
+		}
+
+		adjusted := prevalenceOutliers(values, rule)
+		n := 0
+		for i, code := range codes {
+			if adjusted[i] != values[i] {
+				gps[code].ConditionPrevalence[condition] = adjusted[i]
+				adjustments = append(adjustments, PrevalenceAdjustment{Practice: code, Condition: condition, Reported: values[i], Adjusted: adjusted[i]})
+				n++
+			}
+			average[condition.Index()] += adjusted[i]
+		}
+		if len(codes) > 0 {
+			average[condition.Index()] /= float64(len(codes))
+		}
+		log.Printf("  %s: adjusted %d of %d practices", condition, n, len(codes))
+	}
+	log.Printf("  outlying gps * conditions: %d", len(adjustments))
+	log.Printf("  average prevalence: %s", average.String())
+	return adjustments
+}
+
+// prevalenceOutliers returns values with those considered outliers by rule
+// adjusted.
+func prevalenceOutliers(values []float64, rule PrevalenceOutlierRule) []float64 {
+	adjusted := make([]float64, len(values))
+	copy(adjusted, values)
+	if len(values) == 0 {
+		return adjusted
+	}
+	var outlier func(v float64) bool
+	switch rule.Strategy {
+	case PrevalenceOutlierNone:
+		return adjusted
+	case PrevalenceOutlierThreshold:
+		outlier = func(v float64) bool { return v >= rule.Parameter }
+	case PrevalenceOutlierZScore:
+		mean, sd := 0.0, 0.0
+		for _, v := range values {
+			mean += v
+		}
+		mean /= float64(len(values))
+		for _, v := range values {
+			sd += (v - mean) * (v - mean)
+		}
+		sd = math.Sqrt(sd / float64(len(values)))
+		if sd == 0.0 {
+			return adjusted
+		}
+		outlier = func(v float64) bool { return math.Abs(v-mean)/sd > rule.Parameter }
+	case PrevalenceOutlierWinsorize:
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Float64s(sorted)
+		low := sorted[int(math.Ceil(rule.Parameter*float64(len(sorted)-1)))]
+		high := sorted[int(math.Floor((1.0-rule.Parameter)*float64(len(sorted)-1)))]
+		for i, v := range values {
+			adjusted[i] = clamp(v, low, high)
+		}
+		return adjusted
+	}
+	// Outliers are replaced with the mean of the other practices
+	mean, n := 0.0, 0
+	for _, v := range values {
+		if !outlier(v) {
+			mean += v
+			n++
+		}
+	}
+	if n == 0 {
+		return adjusted
+	}
+	mean /= float64(n)
+	for i, v := range values {
+		if outlier(v) {
+			adjusted[i] = mean
+		}
+	}
+	return adjusted
+}
+
+// writePrevalenceOutliers writes prevalence-outliers.csv, with the reported
+// and adjusted prevalence of each practice and condition changed by the
+// outlier rule.
+func writePrevalenceOutliers(adjustments []PrevalenceAdjustment, gps map[GPPracticeCode]*GPPractice, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "prevalence-outliers.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "icb", "condition", "reported_prevalence", "adjusted_prevalence", "change"})
+	for _, a := range adjustments {
+		w.Write([]string{
+			a.Practice.String(),
+			gps[a.Practice].Name,
+			gps[a.Practice].ICB.String(),
+			a.Condition.String(),
+			fmt.Sprintf("%f", a.Reported),
+			fmt.Sprintf("%f", a.Adjusted),
+			fmt.Sprintf("%f", a.Adjusted-a.Reported),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
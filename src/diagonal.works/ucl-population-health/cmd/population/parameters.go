@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultGPLSOANearbyRadiusM           = 3000.0
+	DefaultGPPracticeMaxListSize         = 20000.0
+	DefaultGPPracticeEqualDistanceLimitM = 750.0
+)
+
+// SimulationParameters tune the assignment of people to GP practices,
+// read from --parameters, so that calibration experiments don't need
+// recompiling. Parameters missing from the file keep their defaults. They're
+// passed to each simulation with its options.
+type SimulationParameters struct {
+	// The radius from a GP surgery in meters from which we'll draw
+	// patients
+	GPLSOANearbyRadiusM float64 `yaml:"nearbyradiusm"`
+	// A rough estimate on the maximum size of GP practices lists, used when
+	// calculating assignment probabilities of people to practices.
+	GPPracticeMaxListSize float64 `yaml:"maxlistsize"`
+	// GP practices closer than this value to an individual are equally likely
+	// to be chosen, after that, it follows the reciprocal, halving at twice
+	// the distance.
+	GPPracticeEqualDistanceLimitM float64 `yaml:"equaldistancem"`
+
+	// The file from which the parameters were read, or empty for the
+	// defaults
+	filename string
+}
+
+func DefaultSimulationParameters() SimulationParameters {
+	return SimulationParameters{
+		GPLSOANearbyRadiusM:           DefaultGPLSOANearbyRadiusM,
+		GPPracticeMaxListSize:         DefaultGPPracticeMaxListSize,
+		GPPracticeEqualDistanceLimitM: DefaultGPPracticeEqualDistanceLimitM,
+	}
+}
+
+func readSimulationParameters(filename string) (SimulationParameters, error) {
+	parameters := DefaultSimulationParameters()
+	f, err := os.Open(filename)
+	if err != nil {
+		return parameters, fmt.Errorf("failed to open simulation parameters: %s", err)
+	}
+	defer f.Close()
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	if err := d.Decode(&parameters); err != nil && err != io.EOF {
+		return parameters, fmt.Errorf("failed to read simulation parameters: %s", err)
+	}
+	if err := parameters.Validate(); err != nil {
+		return parameters, fmt.Errorf("%s: %s", filename, err)
+	}
+	parameters.filename = filename
+	return parameters, nil
+}
+
+// Validate returns an error if the parameters can't be used to assign
+// people to practices.
+func (s SimulationParameters) Validate() error {
+	if s.GPLSOANearbyRadiusM <= 0.0 {
+		return fmt.Errorf("nearbyradiusm must be positive, found %f", s.GPLSOANearbyRadiusM)
+	}
+	if s.GPPracticeMaxListSize <= 0.0 {
+		return fmt.Errorf("maxlistsize must be positive, found %f", s.GPPracticeMaxListSize)
+	}
+	if s.GPPracticeEqualDistanceLimitM <= 0.0 {
+		return fmt.Errorf("equaldistancem must be positive, found %f", s.GPPracticeEqualDistanceLimitM)
+	}
+	if s.GPPracticeEqualDistanceLimitM > s.GPLSOANearbyRadiusM {
+		return fmt.Errorf("equaldistancem of %.0fm is beyond nearbyradiusm of %.0fm", s.GPPracticeEqualDistanceLimitM, s.GPLSOANearbyRadiusM)
+	}
+	return nil
+}
+
+// String returns the values of the parameters, independently of the file
+// from which they were read, to key the cache.
+func (s SimulationParameters) String() string {
+	return fmt.Sprintf("nearbyradiusm=%g maxlistsize=%g equaldistancem=%g", s.GPLSOANearbyRadiusM, s.GPPracticeMaxListSize, s.GPPracticeEqualDistanceLimitM)
+}
+
+// readParameters returns the simulation parameters read from filename,
+// or the defaults, if empty.
+func readParameters(filename string) (SimulationParameters, error) {
+	if filename == "" {
+		return DefaultSimulationParameters(), nil
+	}
+	return readSimulationParameters(filename)
+}
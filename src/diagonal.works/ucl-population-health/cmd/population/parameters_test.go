@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSimulationParametersValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters SimulationParameters
+		valid      bool
+	}{
+		{"defaults", DefaultSimulationParameters(), true},
+		{"equal distance at the radius", SimulationParameters{GPLSOANearbyRadiusM: 1000.0, GPPracticeMaxListSize: 1.0, GPPracticeEqualDistanceLimitM: 1000.0}, true},
+		{"zero radius", SimulationParameters{GPLSOANearbyRadiusM: 0.0, GPPracticeMaxListSize: 20000.0, GPPracticeEqualDistanceLimitM: 750.0}, false},
+		{"negative list size", SimulationParameters{GPLSOANearbyRadiusM: 3000.0, GPPracticeMaxListSize: -1.0, GPPracticeEqualDistanceLimitM: 750.0}, false},
+		{"zero equal distance", SimulationParameters{GPLSOANearbyRadiusM: 3000.0, GPPracticeMaxListSize: 20000.0, GPPracticeEqualDistanceLimitM: 0.0}, false},
+		{"equal distance beyond the radius", SimulationParameters{GPLSOANearbyRadiusM: 3000.0, GPPracticeMaxListSize: 20000.0, GPPracticeEqualDistanceLimitM: 3500.0}, false},
+	}
+	for _, test := range tests {
+		if err := test.parameters.Validate(); test.valid && err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestReadParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected SimulationParameters
+		valid    bool
+	}{
+		{"all", "nearbyradiusm: 5000\nmaxlistsize: 15000\nequaldistancem: 1000\n", SimulationParameters{GPLSOANearbyRadiusM: 5000.0, GPPracticeMaxListSize: 15000.0, GPPracticeEqualDistanceLimitM: 1000.0}, true},
+		{"missing keep defaults", "nearbyradiusm: 5000\n", SimulationParameters{GPLSOANearbyRadiusM: 5000.0, GPPracticeMaxListSize: DefaultGPPracticeMaxListSize, GPPracticeEqualDistanceLimitM: DefaultGPPracticeEqualDistanceLimitM}, true},
+		{"empty", "", DefaultSimulationParameters(), true},
+		{"unknown", "nearbyradiusm: 5000\nradius: 10\n", SimulationParameters{}, false},
+		{"invalid", "equaldistancem: 4000\n", SimulationParameters{}, false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "parameters.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		parameters, err := readParameters(filename)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: expected no error, found %s", test.name, err)
+			} else if parameters.String() != test.expected.String() || parameters.filename != filename {
+				t.Errorf("%s: expected %s from %s, found %s from %s", test.name, test.expected, filename, parameters, parameters.filename)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	parameters, err := readParameters("")
+	if err != nil || parameters != DefaultSimulationParameters() {
+		t.Errorf("expected the defaults without a file, found %s, %v", parameters, err)
+	}
+	if _, err := readParameters(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestReadRepositoryParameters(t *testing.T) {
+	parameters, err := readParameters(filepath.Join("..", "..", "..", "..", "..", "data", "parameters.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parameters.String() != DefaultSimulationParameters().String() {
+		t.Errorf("expected data/parameters.yaml to match the defaults, found %s", parameters)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Parquet, as written by ParquetWriter, and read by pyarrow.parquet or
+// DuckDB, see https://parquet.apache.org/docs/file-format/. Columns are
+// optional, PLAIN encoded and uncompressed, with a single data page per
+// column chunk, trading size for an encoder without dependencies.
+const (
+	parquetMagic = "PAR1"
+
+	parquetTypeInt64     = 2
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+
+	parquetRepetitionOptional = 1
+	parquetConvertedTypeUTF8  = 0
+	parquetEncodingPlain      = 0
+	parquetEncodingRLE        = 3
+	parquetCodecUncompressed  = 0
+	parquetPageTypeData       = 0
+
+	// The rows of each row group, unless given
+	ParquetDefaultGroupRows = 64 * 1024
+)
+
+// parquetColumn accumulates the values of a column for a row group
+type parquetColumn struct {
+	// The definition level of each row, false for nulls
+	defined []bool
+	// The PLAIN encoding of the values that aren't null
+	values []byte
+}
+
+type parquetChunk struct {
+	Offset int64
+	Size   int64
+	Values int
+}
+
+type parquetRowGroup struct {
+	Rows   int
+	Chunks []parquetChunk
+}
+
+// ParquetWriter writes a table to a Parquet file, in row groups of a fixed
+// number of rows, so that tables can be streamed as they're produced,
+// holding only one group in memory, like ArrowWriter.
+type ParquetWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	fields    []ArrowField
+	metadata  [][2]string
+	groupRows int
+	rows      int
+	columns   []parquetColumn
+	// The position of the next byte written
+	offset int64
+	groups []parquetRowGroup
+}
+
+// NewParquetWriter creates filename, for a table with the given fields,
+// and metadata as keys and values, written in the footer. If groupRows is
+// zero, ParquetDefaultGroupRows is used.
+func NewParquetWriter(filename string, fields []ArrowField, metadata [][2]string, groupRows int) (*ParquetWriter, error) {
+	if groupRows <= 0 {
+		groupRows = ParquetDefaultGroupRows
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &ParquetWriter{f: f, w: bufio.NewWriter(f), fields: fields, metadata: metadata, groupRows: groupRows}
+	p.reset()
+	p.write([]byte(parquetMagic))
+	return p, nil
+}
+
+func (p *ParquetWriter) reset() {
+	p.rows = 0
+	p.columns = make([]parquetColumn, len(p.fields))
+}
+
+func (p *ParquetWriter) write(b []byte) {
+	p.w.Write(b)
+	p.offset += int64(len(b))
+}
+
+// Write adds a row, with a value for each field, writing a row group once
+// groupRows have been added.
+func (p *ParquetWriter) Write(row []string) error {
+	if len(row) != len(p.fields) {
+		return fmt.Errorf("row has %d values, expected %d", len(row), len(p.fields))
+	}
+	for i, v := range row {
+		c := &p.columns[i]
+		switch p.fields[i].Type {
+		case ArrowTypeInt64:
+			if v == "" {
+				c.defined = append(c.defined, false)
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: bad integer %q", p.fields[i].Name, v)
+			}
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(n))
+		case ArrowTypeFloat64:
+			if v == "" {
+				c.defined = append(c.defined, false)
+				continue
+			}
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("%s: bad number %q", p.fields[i].Name, v)
+			}
+			c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(x))
+		default:
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(v)))
+			c.values = append(c.values, v...)
+		}
+		c.defined = append(c.defined, true)
+	}
+	p.rows++
+	if p.rows == p.groupRows {
+		p.flush()
+	}
+	return nil
+}
+
+// flush writes the rows added since the last row group as a group, with a
+// single data page for each column.
+func (p *ParquetWriter) flush() {
+	if p.rows == 0 {
+		return
+	}
+	group := parquetRowGroup{Rows: p.rows, Chunks: make([]parquetChunk, len(p.columns))}
+	for i, c := range p.columns {
+		levels := parquetDefinitionLevels(c.defined)
+		page := make([]byte, 0, 4+len(levels)+len(c.values))
+		page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+		page = append(page, levels...)
+		page = append(page, c.values...)
+
+		var header thriftCompact
+		header.begin()
+		header.I32(1, parquetPageTypeData)
+		header.I32(2, int32(len(page)))
+		header.I32(3, int32(len(page)))
+		header.Struct(5, func() {
+			header.I32(1, int32(p.rows))
+			header.I32(2, parquetEncodingPlain)
+			header.I32(3, parquetEncodingRLE)
+			header.I32(4, parquetEncodingRLE)
+		})
+		header.end()
+
+		group.Chunks[i] = parquetChunk{Offset: p.offset, Size: int64(len(header.buf) + len(page)), Values: p.rows}
+		p.write(header.buf)
+		p.write(page)
+	}
+	p.groups = append(p.groups, group)
+	p.reset()
+}
+
+// parquetDefinitionLevels returns the definition levels of a column, with
+// a maximum level of 1, in the RLE hybrid encoding, as runs of the same
+// level.
+func parquetDefinitionLevels(defined []bool) []byte {
+	levels := make([]byte, 0)
+	for begin := 0; begin < len(defined); {
+		end := begin + 1
+		for end < len(defined) && defined[end] == defined[begin] {
+			end++
+		}
+		levels = binary.AppendUvarint(levels, uint64(end-begin)<<1)
+		if defined[begin] {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		begin = end
+	}
+	return levels
+}
+
+func (p *ParquetWriter) parquetType(t ArrowType) int32 {
+	switch t {
+	case ArrowTypeInt64:
+		return parquetTypeInt64
+	case ArrowTypeFloat64:
+		return parquetTypeDouble
+	}
+	return parquetTypeByteArray
+}
+
+// Close writes any remaining rows, and the footer, and closes the file.
+func (p *ParquetWriter) Close() error {
+	p.flush()
+	rows := 0
+	for _, g := range p.groups {
+		rows += g.Rows
+	}
+
+	var footer thriftCompact
+	footer.begin()
+	footer.I32(1, 1)
+	footer.List(2, thriftTypeStruct, len(p.fields)+1)
+	footer.Element(func() {
+		footer.String(4, "schema")
+		footer.I32(5, int32(len(p.fields)))
+	})
+	for _, field := range p.fields {
+		footer.Element(func() {
+			footer.I32(1, p.parquetType(field.Type))
+			footer.I32(3, parquetRepetitionOptional)
+			footer.String(4, field.Name)
+			if field.Type == ArrowTypeUtf8 {
+				footer.I32(6, parquetConvertedTypeUTF8)
+			}
+		})
+	}
+	footer.I64(3, int64(rows))
+	footer.List(4, thriftTypeStruct, len(p.groups))
+	for _, g := range p.groups {
+		footer.Element(func() {
+			size := int64(0)
+			footer.List(1, thriftTypeStruct, len(g.Chunks))
+			for i, chunk := range g.Chunks {
+				size += chunk.Size
+				footer.Element(func() {
+					footer.I64(2, chunk.Offset)
+					footer.Struct(3, func() {
+						footer.I32(1, p.parquetType(p.fields[i].Type))
+						footer.List(2, thriftTypeI32, 2)
+						footer.zigzag(parquetEncodingPlain)
+						footer.zigzag(parquetEncodingRLE)
+						footer.List(3, thriftTypeBinary, 1)
+						footer.binary(p.fields[i].Name)
+						footer.I32(4, parquetCodecUncompressed)
+						footer.I64(5, int64(chunk.Values))
+						footer.I64(6, chunk.Size)
+						footer.I64(7, chunk.Size)
+						footer.I64(9, chunk.Offset)
+					})
+				})
+			}
+			footer.I64(2, size)
+			footer.I64(3, int64(g.Rows))
+		})
+	}
+	if len(p.metadata) > 0 {
+		footer.List(5, thriftTypeStruct, len(p.metadata))
+		for _, m := range p.metadata {
+			footer.Element(func() {
+				footer.String(1, m[0])
+				footer.String(2, m[1])
+			})
+		}
+	}
+	footer.String(6, "diagonal.works/ucl-population-health")
+	footer.end()
+
+	p.write(footer.buf)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer.buf)))
+	p.write(length[:])
+	p.write([]byte(parquetMagic))
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
+
+// A minimal encoder for Thrift's compact protocol, sufficient for Parquet's
+// metadata, see
+// https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+type thriftCompact struct {
+	buf []byte
+	// The id of the last field written in each enclosing struct, since
+	// field headers are given as differences
+	last []int16
+}
+
+func (t *thriftCompact) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftCompact) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[0 : len(t.last)-1]
+}
+
+func (t *thriftCompact) field(id int16, kind byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|kind)
+	} else {
+		t.buf = append(t.buf, kind)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftCompact) zigzag(v int64) {
+	t.buf = binary.AppendUvarint(t.buf, uint64((v<<1)^(v>>63)))
+}
+
+func (t *thriftCompact) binary(s string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+func (t *thriftCompact) I32(id int16, v int32) {
+	t.field(id, thriftTypeI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftCompact) I64(id int16, v int64) {
+	t.field(id, thriftTypeI64)
+	t.zigzag(v)
+}
+
+func (t *thriftCompact) String(id int16, s string) {
+	t.field(id, thriftTypeBinary)
+	t.binary(s)
+}
+
+func (t *thriftCompact) Struct(id int16, fields func()) {
+	t.field(id, thriftTypeStruct)
+	t.Element(fields)
+}
+
+// List writes the header of a list of n elements of the given type, which
+// must follow, written with zigzag, binary or Element.
+func (t *thriftCompact) List(id int16, kind byte, n int) {
+	t.field(id, thriftTypeList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|kind)
+	} else {
+		t.buf = append(t.buf, 0xf0|kind)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+// Element writes a struct without a field header, as a list element.
+func (t *thriftCompact) Element(fields func()) {
+	t.begin()
+	fields()
+	t.end()
+}
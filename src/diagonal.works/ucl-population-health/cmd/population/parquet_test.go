@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// thriftReader decodes the subset of Thrift's compact protocol written by
+// thriftCompact, returning structs as maps from field id, lists as slices,
+// integers as int64 and binaries as strings.
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (t *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(t.buf[t.pos:])
+	if n <= 0 {
+		panic(fmt.Sprintf("bad varint at %d", t.pos))
+	}
+	t.pos += n
+	return v
+}
+
+func (t *thriftReader) zigzag() int64 {
+	v := t.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (t *thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case thriftTypeI32, thriftTypeI64:
+		return t.zigzag()
+	case thriftTypeBinary:
+		n := int(t.uvarint())
+		s := string(t.buf[t.pos : t.pos+n])
+		t.pos += n
+		return s
+	case thriftTypeList:
+		header := t.buf[t.pos]
+		t.pos++
+		n := int(header >> 4)
+		if n == 15 {
+			n = int(t.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = t.value(header & 0x0f)
+		}
+		return list
+	case thriftTypeStruct:
+		fields := make(map[int16]interface{})
+		last := int16(0)
+		for {
+			header := t.buf[t.pos]
+			t.pos++
+			if header == 0 {
+				return fields
+			}
+			id := last + int16(header>>4)
+			if header>>4 == 0 {
+				id = int16(t.zigzag())
+			}
+			fields[id] = t.value(header & 0x0f)
+			last = id
+		}
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", kind))
+}
+
+func (t *thriftReader) Struct() map[int16]interface{} {
+	return t.value(thriftTypeStruct).(map[int16]interface{})
+}
+
+// readParquet returns the rows of a file written by ParquetWriter, with
+// nulls as empty strings, and its footer.
+func readParquet(t *testing.T, filename string) ([][]string, map[int16]interface{}) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[0:4]) != parquetMagic || string(b[len(b)-4:]) != parquetMagic {
+		t.Fatalf("expected %s at the beginning and end of the file", parquetMagic)
+	}
+	length := int(binary.LittleEndian.Uint32(b[len(b)-8 : len(b)-4]))
+	r := &thriftReader{buf: b[len(b)-8-length : len(b)-8]}
+	footer := r.Struct()
+	if r.pos != length {
+		t.Fatalf("expected a footer of %d bytes, read %d", length, r.pos)
+	}
+	schema := footer[2].([]interface{})
+	rows := make([][]string, 0)
+	for _, g := range footer[4].([]interface{}) {
+		group := g.(map[int16]interface{})
+		n := int(group[3].(int64))
+		begin := len(rows)
+		for i := 0; i < n; i++ {
+			rows = append(rows, make([]string, len(schema)-1))
+		}
+		for i, c := range group[1].([]interface{}) {
+			metadata := c.(map[int16]interface{})[3].(map[int16]interface{})
+			page := &thriftReader{buf: b, pos: int(metadata[9].(int64))}
+			header := page.Struct()
+			if header[1].(int64) != parquetPageTypeData {
+				t.Fatalf("expected a data page, found %d", header[1])
+			}
+			data := b[page.pos : page.pos+int(header[3].(int64))]
+			levels := int(binary.LittleEndian.Uint32(data[0:4]))
+			definitions := &thriftReader{buf: data[4 : 4+levels]}
+			defined := make([]bool, 0, n)
+			for definitions.pos < levels {
+				run := int(definitions.uvarint() >> 1)
+				level := definitions.buf[definitions.pos]
+				definitions.pos++
+				for j := 0; j < run; j++ {
+					defined = append(defined, level == 1)
+				}
+			}
+			if len(defined) != n {
+				t.Fatalf("expected %d definition levels, found %d", n, len(defined))
+			}
+			values := data[4+levels:]
+			for j := 0; j < n; j++ {
+				if !defined[j] {
+					continue
+				}
+				var v string
+				switch metadata[1].(int64) {
+				case parquetTypeInt64:
+					v = strconv.FormatInt(int64(binary.LittleEndian.Uint64(values)), 10)
+					values = values[8:]
+				case parquetTypeDouble:
+					v = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(values)), 'g', -1, 64)
+					values = values[8:]
+				default:
+					l := int(binary.LittleEndian.Uint32(values))
+					v = string(values[4 : 4+l])
+					values = values[4+l:]
+				}
+				rows[begin+j][i] = v
+			}
+		}
+	}
+	return rows, footer
+}
+
+func TestParquetWriterRoundTrip(t *testing.T) {
+	fields := []ArrowField{
+		{Name: "id", Type: ArrowTypeInt64},
+		{Name: "weight", Type: ArrowTypeFloat64},
+		{Name: "name", Type: ArrowTypeUtf8},
+	}
+	rows := [][]string{
+		{"1", "0.5", "Camden"},
+		{"", "", "Islington"},
+		{"-3", "", ""},
+		{"4", "1e+20", "Barnet"},
+		{"", "2.25", "Enfield"},
+	}
+	filename := filepath.Join(t.TempDir(), "test.parquet")
+	// Two rows per group, to write more than one, and a final partial
+	// group
+	w, err := NewParquetWriter(filename, fields, [][2]string{{"scenario", "baseline"}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, footer := readParquet(t, filename)
+	if n := footer[3].(int64); n != int64(len(rows)) {
+		t.Errorf("expected %d rows in the footer, found %d", len(rows), n)
+	}
+	if n := len(footer[4].([]interface{})); n != 3 {
+		t.Errorf("expected 3 row groups, found %d", n)
+	}
+	schema := footer[2].([]interface{})
+	for i, field := range fields {
+		if name := schema[i+1].(map[int16]interface{})[4]; name != field.Name {
+			t.Errorf("expected column %d to be %s, found %s", i, field.Name, name)
+		}
+	}
+	metadata := footer[5].([]interface{})[0].(map[int16]interface{})
+	if metadata[1] != "scenario" || metadata[2] != "baseline" {
+		t.Errorf("expected scenario metadata, found %v", metadata)
+	}
+	if len(read) != len(rows) {
+		t.Fatalf("expected %d rows, found %d", len(rows), len(read))
+	}
+	for i := range rows {
+		for j := range rows[i] {
+			if read[i][j] != rows[i][j] {
+				t.Errorf("expected %q for %s of row %d, found %q", rows[i][j], fields[j].Name, i, read[i][j])
+			}
+		}
+	}
+}
+
+func TestParquetWriterRejectsBadValues(t *testing.T) {
+	fields := []ArrowField{{Name: "id", Type: ArrowTypeInt64}}
+	w, err := NewParquetWriter(filepath.Join(t.TempDir(), "test.parquet"), fields, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Write([]string{"one"}); err == nil {
+		t.Error("expected an error for a bad integer")
+	}
+	if err := w.Write([]string{"1", "2"}); err == nil {
+		t.Error("expected an error for a row with too many values")
+	}
+}
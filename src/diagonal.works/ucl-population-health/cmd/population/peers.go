@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// The default number of practices in each practice's peer group
+const DefaultPeerGroupSize = 10
+
+// The age from which patients are counted as older, when comparing the age
+// profile of practices
+const PeerGroupOlderAge = 65
+
+// PracticeProfile holds the characteristics by which practices are
+// compared when building peer groups, standardised across the practices
+// being compared.
+type PracticeProfile struct {
+	Code GPPracticeCode
+	// Log of the list size, since practices of 5,000 and 10,000 patients
+	// differ more than those with 20,000 and 25,000
+	LogListSize float64
+	// Average IMD score of the homes of registered people
+	IMD float64
+	// Fraction of registered people aged PeerGroupOlderAge and over
+	Older float64
+}
+
+func (p *PracticeProfile) features() []float64 {
+	return []float64{p.LogListSize, p.IMD, p.Older}
+}
+
+type Peer struct {
+	Code     GPPracticeCode
+	Distance float64
+}
+
+// buildPeerGroups returns the size practices most similar to each selected
+// practice, by list size, deprivation and age profile, with each feature
+// standardised to zero mean and unit variance across the selected
+// practices.
+func buildPeerGroups(selected GPPracticeCodeSet, byPractice map[GPPracticeCode][]*Person, gps map[GPPracticeCode]*GPPractice, lsoas map[LSOACode]*LSOA, size int) map[GPPracticeCode][]Peer {
+	profiles := make([]*PracticeProfile, 0, len(selected))
+	for code := range selected {
+		people := byPractice[code]
+		if len(people) == 0 || gps[code].ListSize == 0 {
+			continue
+		}
+		older := 0
+		for _, p := range people {
+			if p.Age >= PeerGroupOlderAge {
+				older++
+			}
+		}
+		profiles = append(profiles, &PracticeProfile{
+			Code:        code,
+			LogListSize: math.Log(float64(gps[code].ListSize)),
+			IMD:         averageIMD(people, lsoas),
+			Older:       float64(older) / float64(len(people)),
+		})
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Code < profiles[j].Code })
+
+	features := make([][]float64, len(profiles))
+	for i, p := range profiles {
+		features[i] = p.features()
+	}
+	if len(features) > 0 {
+		for j := range features[0] {
+			mean, variance := 0.0, 0.0
+			for i := range features {
+				mean += features[i][j]
+			}
+			mean /= float64(len(features))
+			for i := range features {
+				variance += math.Pow(features[i][j]-mean, 2.0)
+			}
+			sd := math.Sqrt(variance / float64(len(features)))
+			for i := range features {
+				if sd > 0.0 {
+					features[i][j] = (features[i][j] - mean) / sd
+				} else {
+					features[i][j] = 0.0
+				}
+			}
+		}
+	}
+
+	groups := make(map[GPPracticeCode][]Peer)
+	for i, p := range profiles {
+		peers := make([]Peer, 0, len(profiles)-1)
+		for j, other := range profiles {
+			if i == j {
+				continue
+			}
+			d := 0.0
+			for k := range features[i] {
+				d += math.Pow(features[i][k]-features[j][k], 2.0)
+			}
+			peers = append(peers, Peer{Code: other.Code, Distance: math.Sqrt(d)})
+		}
+		sort.SliceStable(peers, func(a, b int) bool { return peers[a].Distance < peers[b].Distance })
+		if len(peers) > size {
+			peers = peers[0:size]
+		}
+		groups[p.Code] = peers
+	}
+	return groups
+}
+
+func simulatedPrevalence(gp *GPPractice, condition QOFCondition) (float64, bool) {
+	if gp.SimulatedListSize == 0 {
+		return 0.0, false
+	}
+	return float64(gp.SimulatedConditionCounts[condition]) / float64(gp.SimulatedListSize), true
+}
+
+// peerMean returns the mean of a value over the peers that have it
+func peerMean(peers []Peer, gps map[GPPracticeCode]*GPPractice, value func(gp *GPPractice) (float64, bool)) (float64, bool) {
+	total, n := 0.0, 0
+	for _, peer := range peers {
+		if v, ok := value(gps[peer.Code]); ok {
+			total += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0.0, false
+	}
+	return total / float64(n), true
+}
+
+func formatRatio(v float64, peers float64, ok bool) string {
+	if !ok || peers <= 0.0 {
+		return ""
+	}
+	return fmt.Sprintf("%f", v/peers)
+}
+
+// writePeerGroups writes peer-groups.csv, listing the peers of each
+// practice, and peer-comparison.csv, comparing the reported and simulated
+// prevalence of each condition at each practice with the mean of its
+// peers.
+func writePeerGroups(groups map[GPPracticeCode][]Peer, gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, outputDirectory string) error {
+	codes := make([]GPPracticeCode, 0, len(groups))
+	for code := range groups {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "peer-groups.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "rank", "peer", "peer_name", "distance"})
+	for _, code := range codes {
+		for i, peer := range groups[code] {
+			w.Write([]string{code.String(), gps[code].Name, strconv.Itoa(i + 1), peer.Code.String(), gps[peer.Code].Name, fmt.Sprintf("%f", peer.Distance)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = createOutput(filepath.Join(outputDirectory, "peer-comparison.csv"))
+	if err != nil {
+		return err
+	}
+	w = csv.NewWriter(f)
+	w.Write([]string{"code", "name", "condition", "peers", "reported_prevalence", "peer_reported_prevalence", "reported_ratio", "simulated_prevalence", "peer_simulated_prevalence", "simulated_ratio"})
+	for _, code := range codes {
+		gp := gps[code]
+		peers := groups[code]
+		for _, c := range conditions {
+			condition := c
+			reported := func(gp *GPPractice) (float64, bool) {
+				p, ok := gp.ReportedConditionPrevalence[condition]
+				return p, ok
+			}
+			simulated := func(gp *GPPractice) (float64, bool) {
+				return simulatedPrevalence(gp, condition)
+			}
+			r, rOK := reported(gp)
+			peerR, peerROK := peerMean(peers, gps, reported)
+			s, sOK := simulated(gp)
+			peerS, peerSOK := peerMean(peers, gps, simulated)
+			w.Write([]string{
+				code.String(),
+				gp.Name,
+				condition.String(),
+				strconv.Itoa(len(peers)),
+				formatBenchmarkValue(r, rOK),
+				formatBenchmarkValue(peerR, peerROK),
+				formatRatio(r, peerR, rOK && peerROK),
+				formatBenchmarkValue(s, sOK),
+				formatBenchmarkValue(peerS, peerSOK),
+				formatRatio(s, peerS, sOK && peerSOK),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// Column headers of the NHSBSA consolidated pharmaceutical list, see
+// https://opendata.nhsbsa.net/dataset/consolidated-pharmaceutical-list
+const (
+	PharmacyCodeColumn     = "PHARMACY_ODS_CODE_F_CODE"
+	PharmacyNameColumn     = "PHARMACY_TRADING_NAME"
+	PharmacyPostcodeColumn = "POST_CODE"
+)
+
+type Pharmacy struct {
+	Code     ODSCode
+	Name     string
+	Postcode string
+	Location s2.Point
+
+	People int
+	// Indexed by the position of the condition in the modelled conditions
+	// of the dispensing model
+	Conditions []int
+	Items      []float64
+}
+
+// readPharmacies returns the community pharmacies of the NHSBSA
+// consolidated pharmaceutical list, located by postcode, in w or among the
+// historic postcodes of postcodes. Pharmacies that can't be located are
+// skipped.
+func readPharmacies(dataset *Dataset, postcodes PostcodeSources, w b6.World) (map[ODSCode]*Pharmacy, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	row, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"code", "name", "postcode"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+
+	pharmacies := make(map[ODSCode]*Pharmacy)
+	candidates := 0
+	locator := newPostcodeLocator(worldPostcodes(w), "pharmacy", dataset)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		pharmacy := &Pharmacy{
+			Code:     ODSCode(row[columns[dataset.Column("code")]]),
+			Name:     row[columns[dataset.Column("name")]],
+			Postcode: row[columns[dataset.Column("postcode")]],
+		}
+		if pharmacy.Code == "" {
+			continue
+		}
+		candidates++
+		locator.Locate(string(pharmacy.Code), pharmacy.Postcode, func(p s2.Point) {
+			pharmacy.Location = p
+			pharmacies[pharmacy.Code] = pharmacy
+		})
+	}
+	if err := locator.Finish(postcodes); err != nil {
+		return nil, err
+	}
+	countMissingPostcodes(dataset, locator.Missing)
+	log.Printf("  pharmacies: %d", len(pharmacies))
+	log.Printf("    missing locations: %d", candidates-len(pharmacies))
+	locator.logFallbacks("    ")
+	return pharmacies, nil
+}
+
+// assignPharmacies gives each person a nominal pharmacy, the nearest to
+// the care home in which they live, if any, or otherwise to the centre of
+// their home LSOA, since people don't have locations within it, found once
+// for each care home and LSOA. For the residents of homes, it counts the
+// people with each condition of the dispensing model, and the items
+// they're expected to have dispensed each year, for each pharmacy.
+func assignPharmacies(people []Person, homes LSOASet, pharmacies map[ODSCode]*Pharmacy, lsoas map[LSOACode]*LSOA, careHomes map[CareHomeID]*CareHome, conditions []QOFCondition, dispensing DemandModel) {
+	codes := make([]ODSCode, 0, len(pharmacies))
+	for code := range pharmacies {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	nearest := func(p s2.Point) ODSCode {
+		n := ODSCode("")
+		distance := math.Inf(1)
+		for _, code := range codes {
+			if d := float64(p.Distance(pharmacies[code].Location)); d < distance {
+				n, distance = code, d
+			}
+		}
+		return n
+	}
+
+	modelled := dispensing.Conditions(conditions)
+	for _, pharmacy := range pharmacies {
+		pharmacy.People = 0
+		pharmacy.Conditions = make([]int, len(modelled))
+		pharmacy.Items = make([]float64, len(modelled))
+	}
+	byLSOA := make(map[LSOACode]ODSCode)
+	byCareHome := make(map[CareHomeID]ODSCode)
+	unassigned := 0
+	for i := range people {
+		p := &people[i]
+		code := ODSCode("")
+		if c, ok := byCareHome[p.CareHome]; ok {
+			code = c
+		} else if home, ok := careHomes[p.CareHome]; ok {
+			code = nearest(home.Location)
+			byCareHome[p.CareHome] = code
+		} else if c, ok := byLSOA[p.Home]; ok {
+			code = c
+		} else if lsoa, ok := lsoas[p.Home]; ok {
+			code = nearest(lsoa.Center)
+			byLSOA[p.Home] = code
+		}
+		p.Pharmacy = code
+		if code == "" {
+			unassigned++
+			continue
+		} else if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		pharmacy := pharmacies[code]
+		pharmacy.People++
+		for j, condition := range modelled {
+			if p.Conditions.Contains(condition) {
+				pharmacy.Conditions[j]++
+				pharmacy.Items[j] += dispensing[condition].Annual
+			}
+		}
+	}
+	used := 0
+	for _, pharmacy := range pharmacies {
+		if pharmacy.People > 0 {
+			used++
+		}
+	}
+	log.Printf("  pharmacies serving residents: %d of %d", used, len(pharmacies))
+	if unassigned > 0 {
+		Warningf("  pharmacies: %d people without a pharmacy", unassigned)
+	}
+}
+
+// writePharmacies writes pharmacies.csv, with the people assigned to each
+// pharmacy, the number of them with each condition of the dispensing
+// model, and the items they're expected to have dispensed each year.
+// Pharmacies without people are omitted.
+func writePharmacies(pharmacies map[ODSCode]*Pharmacy, conditions []QOFCondition, dispensing DemandModel, scenario string, outputDirectory string) error {
+	codes := make([]ODSCode, 0, len(pharmacies))
+	for code, pharmacy := range pharmacies {
+		if pharmacy.People > 0 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "pharmacies.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	modelled := dispensing.Conditions(conditions)
+	header := []string{"scenario", "code", "name", "postcode", "people"}
+	for _, condition := range modelled {
+		header = append(header, "condition_"+condition.String())
+	}
+	for _, condition := range modelled {
+		header = append(header, "items_"+condition.String())
+	}
+	header = append(header, "items")
+	w.Write(header)
+	for _, code := range codes {
+		pharmacy := pharmacies[code]
+		row := []string{scenario, string(code), pharmacy.Name, pharmacy.Postcode, strconv.Itoa(pharmacy.People)}
+		for _, n := range pharmacy.Conditions {
+			row = append(row, strconv.Itoa(n))
+		}
+		total := 0.0
+		for _, items := range pharmacy.Items {
+			row = append(row, fmt.Sprintf("%f", items))
+			total += items
+		}
+		row = append(row, fmt.Sprintf("%f", total))
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
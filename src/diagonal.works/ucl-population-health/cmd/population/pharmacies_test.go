@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+func TestAssignPharmacies(t *testing.T) {
+	pharmacies := map[ODSCode]*Pharmacy{
+		"FA001": {Code: "FA001", Location: s2.PointFromLatLng(s2.LatLngFromDegrees(51.50, -0.10))},
+		"FA002": {Code: "FA002", Location: s2.PointFromLatLng(s2.LatLngFromDegrees(51.60, -0.10))},
+	}
+	lsoas := map[LSOACode]*LSOA{
+		"E01000001": {Center: s2.PointFromLatLng(s2.LatLngFromDegrees(51.51, -0.10))},
+		"E01000002": {Center: s2.PointFromLatLng(s2.LatLngFromDegrees(51.59, -0.10))},
+	}
+	careHomes := map[CareHomeID]*CareHome{
+		// A home in the first LSOA, nearer the second pharmacy
+		"C1": {ID: "C1", LSOA: "E01000001", Location: s2.PointFromLatLng(s2.LatLngFromDegrees(51.58, -0.10))},
+	}
+	var diabetic QOFConditions
+	diabetic.Add(QOFConditionDiabetes)
+	people := []Person{
+		{Home: "E01000001", CareHome: CareHomeIDInvalid, Conditions: diabetic},
+		{Home: "E01000001", CareHome: CareHomeIDInvalid},
+		{Home: "E01000001", CareHome: "C1", Conditions: diabetic},
+		{Home: "E01000001", CareHome: "C1", Conditions: diabetic},
+		// Outside homes, so assigned but not counted
+		{Home: "E01000002", CareHome: CareHomeIDInvalid, Conditions: diabetic},
+		// Without a location
+		{Home: "E01000003", CareHome: CareHomeIDInvalid},
+	}
+	dispensing := DemandModel{QOFConditionDiabetes: {Annual: 12.0}}
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	homes := LSOASet{"E01000001": struct{}{}}
+	assignPharmacies(people, homes, pharmacies, lsoas, careHomes, conditions, dispensing)
+
+	expected := []ODSCode{"FA001", "FA001", "FA002", "FA002", "FA002", ""}
+	for i, code := range expected {
+		if people[i].Pharmacy != code {
+			t.Errorf("expected pharmacy %q for person %d, found %q", code, i, people[i].Pharmacy)
+		}
+	}
+	counts := []struct {
+		code       ODSCode
+		people     int
+		conditions int
+		items      float64
+	}{
+		{"FA001", 2, 1, 12.0},
+		{"FA002", 2, 2, 24.0},
+	}
+	for _, c := range counts {
+		p := pharmacies[c.code]
+		if len(p.Conditions) != 1 || len(p.Items) != 1 {
+			t.Errorf("%s: expected counts for the modelled condition only, found %v, %v", c.code, p.Conditions, p.Items)
+			continue
+		}
+		if p.People != c.people || p.Conditions[0] != c.conditions || math.Abs(p.Items[0]-c.items) > 1e-9 {
+			t.Errorf("%s: expected %d people, %d with diabetes and %f items, found %d, %d and %f", c.code, c.people, c.conditions, c.items, p.People, p.Conditions[0], p.Items[0])
+		}
+	}
+
+	// Assigning again resets the counts
+	assignPharmacies(people, homes, pharmacies, lsoas, careHomes, conditions, dispensing)
+	if p := pharmacies["FA001"]; p.People != 2 {
+		t.Errorf("expected counts to be reset, found %d people", p.People)
+	}
+}
+
+func TestPopulationInputsForScopeCopiesPharmacies(t *testing.T) {
+	in := &populationInputs{
+		pharmacies: map[ODSCode]*Pharmacy{"FA001": {Code: "FA001", Name: "One", People: 3}},
+	}
+	scoped := in.forScope()
+	p := scoped.pharmacies["FA001"]
+	if p == nil || p == in.pharmacies["FA001"] {
+		t.Fatalf("expected a copy of the pharmacy, found %v", p)
+	}
+	if p.Name != "One" || p.People != 0 {
+		t.Errorf("expected the pharmacy's details without its counts, found %+v", p)
+	}
+	p.People = 5
+	if in.pharmacies["FA001"].People != 3 {
+		t.Errorf("expected the inputs' pharmacy to be unchanged")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"diagonal.works/b6"
+	"diagonal.works/b6/ingest"
+	"diagonal.works/b6/ingest/compact"
+	"github.com/golang/geo/s2"
+)
+
+const NamespaceSyntheticPopulation = b6.Namespace("diagonal.works/ucl-population-health/lsoa")
+
+// PopulationSource emits the synthetic population as b6 features, with a
+// point at the centre of each home LSOA, tagged with the number of people
+// living there, and the number with each condition, so that it can be
+// queried alongside the NHS estate written by the features command.
+type PopulationSource struct {
+	People     []Person
+	Homes      LSOASet
+	LSOAs      map[LSOACode]*LSOA
+	Conditions []QOFCondition
+}
+
+type lsoaPopulation struct {
+	People       int
+	Unregistered int
+	Conditions   map[QOFCondition]int
+}
+
+func (s *PopulationSource) Read(options ingest.ReadOptions, emit ingest.Emit, ctx context.Context) error {
+	byLSOA := make(map[LSOACode]*lsoaPopulation)
+	for i := range s.People {
+		p := &s.People[i]
+		if _, ok := s.Homes[p.Home]; !ok {
+			continue
+		}
+		l, ok := byLSOA[p.Home]
+		if !ok {
+			l = &lsoaPopulation{Conditions: make(map[QOFCondition]int)}
+			byLSOA[p.Home] = l
+		}
+		l.People++
+		if p.GP == GPPracticeCodeInvalid {
+			l.Unregistered++
+		}
+		for _, condition := range s.Conditions {
+			if p.Conditions.Contains(condition) {
+				l.Conditions[condition]++
+			}
+		}
+	}
+
+	point := ingest.PointFeature{
+		PointID: b6.PointID{
+			Namespace: NamespaceSyntheticPopulation,
+		},
+		Tags: []b6.Tag{{Key: "#population", Value: "lsoa"}},
+	}
+	for code, l := range byLSOA {
+		lsoa := s.LSOAs[code]
+		point.PointID.Value = compact.HashString(string(code))
+		point.Location = s2.LatLngFromPoint(lsoa.Center)
+		point.Tags = point.Tags[0:1] // Keep #population=lsoa
+		point.Tags = append(point.Tags, b6.Tag{Key: "code", Value: code.String()})
+		point.Tags = append(point.Tags, b6.Tag{Key: "name", Value: lsoa.Name})
+		point.Tags = append(point.Tags, b6.Tag{Key: "population:people", Value: strconv.Itoa(l.People)})
+		point.Tags = append(point.Tags, b6.Tag{Key: "population:unregistered", Value: strconv.Itoa(l.Unregistered)})
+		for _, condition := range s.Conditions {
+			point.Tags = append(point.Tags, b6.Tag{Key: "#population:condition:" + condition.String(), Value: strconv.Itoa(l.Conditions[condition])})
+		}
+		if err := emit(&point, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePopulationFeatures writes population.index, a b6 compact index of
+// the synthetic population by home LSOA.
+func writePopulationFeatures(source *PopulationSource, outputDirectory string) error {
+	config := compact.Options{
+		OutputFilename:       filepath.Join(outputDirectory, "population.index"),
+		Goroutines:           runtime.NumCPU(),
+		WorkDirectory:        "",
+		PointsWorkOutputType: compact.OutputTypeMemory,
+	}
+	return compact.Build(source, &config)
+}
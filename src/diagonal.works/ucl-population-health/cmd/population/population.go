@@ -1,15 +1,13 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/csv"
-	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/bits"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -53,6 +51,12 @@ func (a AgePrevalence) String() string {
 type AgePrevalences [][]AgePrevalence
 
 func (a AgePrevalences) Prevalence(sex Sex, age int) float64 {
+	if int(sex) >= len(a) || len(a[sex]) == 0 {
+		if sex == Other {
+			return OtherSexPrevalenceAverage.Prevalence(a, age)
+		}
+		return 0.0
+	}
 	for _, p := range a[sex] {
 		if p.Ages.Contains(age) {
 			return p.Prevalence
@@ -61,6 +65,20 @@ func (a AgePrevalences) Prevalence(sex Sex, age int) float64 {
 	return 0.0
 }
 
+// ForSex returns the prevalences for sex, using the average of males and
+// females, as for Prevalence, for the Other sex when none are given for it.
+func (a AgePrevalences) ForSex(sex Sex) []AgePrevalence {
+	if int(sex) < len(a) && len(a[sex]) > 0 {
+		return a[sex]
+	} else if sex != Other {
+		return nil
+	}
+	if resolved := a.WithOtherSex(OtherSexPrevalenceAverage); len(resolved) > int(Other) {
+		return resolved[Other]
+	}
+	return nil
+}
+
 func (a AgePrevalences) Log() {
 	for sex, ranges := range a {
 		log.Printf("%s", Sex(sex))
@@ -128,6 +146,19 @@ func (d *Diagnosis) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
+	parsed, err := DiagnosisFromString(s)
+	if err != nil {
+		return err
+	}
+	d.Present |= parsed.Present
+	d.Absent |= parsed.Absent
+	return nil
+}
+
+// DiagnosisFromString parses comma separated conditions, each prefixed
+// with ! if absent, as written by Diagnosis.String.
+func DiagnosisFromString(s string) (Diagnosis, error) {
+	var d Diagnosis
 	for _, cs := range strings.Split(s, ",") {
 		present := true
 		if strings.HasPrefix(cs, "!") {
@@ -136,7 +167,7 @@ func (d *Diagnosis) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 		c := QOFConditionFromString(cs)
 		if c == QOFConditionInvalid {
-			return fmt.Errorf("unknown condition %q", cs)
+			return Diagnosis{}, fmt.Errorf("unknown condition %q", cs)
 		}
 		if present {
 			d.Present.Add(c)
@@ -144,7 +175,7 @@ func (d *Diagnosis) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			d.Absent.Add(c)
 		}
 	}
-	return nil
+	return d, nil
 }
 
 type DiagonosisGiven struct {
@@ -186,6 +217,11 @@ func OneConditionGivenOtherAbsent(c1 QOFCondition, c2 QOFCondition) DiagonosisGi
 type Prevalences struct {
 	Conditions DiagonosisGiven
 	ByAge      AgePrevalences
+	// If set for a pair of conditions, in place of ByAge, the prevalence
+	// of either among people with the other, relative to its prevalence
+	// among everyone of the same age and sex, from which the prevalence
+	// of the pair is derived by deriveRelativeRatePairs
+	RelativeRate float64 `yaml:"relativerate,omitempty"`
 }
 
 func (p Prevalences) Prevalence(sex Sex, age int) float64 {
@@ -221,6 +257,8 @@ const (
 	ICBDataLSOACodeColumn = "LSOA11CD"
 	ICBDataICBCodeColumn  = "ICB22CDH"
 	ICBDataICBNameColumn  = "ICB22NM"
+	ICBDataLADCodeColumn  = "LAD22CD"
+	ICBDataLADNameColumn  = "LAD22NM"
 
 	LSOADataLSOACodeColumn   = "LSOA Code"
 	LSOADataLSOANameColumn   = "LSOA Name"
@@ -243,19 +281,27 @@ const (
 
 	GPAppointmentsCodeColumn       = "GP_CODE"
 	GPAppointmentsHcpTypeColumn    = "HCP_TYPE"
+	GPAppointmentsModeColumn       = "APPT_MODE"
 	GPAppointmentsStatusColumn     = "APPT_STATUS"
 	GPAppointmentsNationalCategory = "NATIONAL_CATEGORY"
 	GPAppointmentsCountColumn      = "COUNT_OF_APPOINTMENTS"
 
 	GPAppointmentsStatusAttended = "Attended"
+	GPAppointmentsModeFaceToFace = "Face-to-Face"
+
+	// The appointments data covers a single month
+	GPAppointmentsMonthsPerYear = 12
 
 	TrustSiteCodeColumn       = 0
 	TrustSiteNameColumn       = 1
 	TrustSiteAddressOneColumn = 4
 	TrustSitePostcodeColumn   = 9
 
-	EstatesSiteCodeColumn = "Site Code"
-	EstatesSiteTypeColumn = "Site Type"
+	EstatesSiteCodeColumn               = "Site Code"
+	EstatesSiteTypeColumn               = "Site Type"
+	EstatesFloorAreaColumn              = "Gross internal floor area (m²)"
+	EstatesEnSuiteBedroomsColumn        = "Single bedrooms for patients with en-suite facilities (No.)"
+	EstatesWithoutEnSuiteBedroomsColumn = "Single bedrooms for patients without en-suite facilities (No.)"
 
 	LSOAToMSOALSOACodeColumn = "LSOA11CD"
 	LSOAToMSOAMSOACodeColumn = "MSOA11CD"
@@ -269,17 +315,6 @@ const (
 	Camden007FLSOACode        = LSOACode("E01000927")
 )
 
-const (
-	// The radius from a GP surgery in meters from which we'll draw
-	// patients
-	GPLSOANearbyRadiusM = 3000.0
-
-	// Some practices have prevalences high enough to suggest that they're
-	// not reporting correctly, so replace these with the average
-	// TODO: Consider using a number of standard deviations or similar.
-	QPQOFDataPrevalenceOutlier = 0.40
-)
-
 type GPPracticeStatus string
 
 func (g GPPracticeStatus) String() string {
@@ -299,8 +334,30 @@ const (
 	QOFConditionDiabetes     QOFCondition = 1 << 0
 	QOFConditionHypertension              = 1 << 1
 	QOFConditionCOPD                      = 1 << 2
-
-	QOFConditionLast = QOFConditionCOPD
+	// Sub-conditions of diabetes, grouped by QOFConditionHierarchies
+	QOFConditionType1Diabetes = 1 << 3
+	QOFConditionType2Diabetes = 1 << 4
+	// Cardiovascular disease, which has no QOF register of its own, and
+	// its sub-conditions: coronary heart disease, stroke and TIA, and
+	// peripheral arterial disease
+	QOFConditionCVD    = 1 << 5
+	QOFConditionCHD    = 1 << 6
+	QOFConditionStroke = 1 << 7
+	QOFConditionPAD    = 1 << 8
+	// Mental health conditions: depression, and severe mental illness,
+	// QOF's mental health register of schizophrenia, bipolar affective
+	// disorder and other psychoses
+	QOFConditionDepression = 1 << 9
+	QOFConditionSMI        = 1 << 10
+	// Atrial fibrillation and heart failure, which, with coronary heart
+	// disease and stroke, are closely associated with hypertension and
+	// diabetes
+	QOFConditionAF = 1 << 11
+	QOFConditionHF = 1 << 12
+
+	QOFConditionLast = QOFConditionHF
+	// The number of conditions, for arrays indexed by QOFCondition.Index
+	QOFConditionCount = 13
 
 	QOFConditionBegin = QOFConditionDiabetes
 	QOFConditionEnd   = QOFConditionLast << 1
@@ -316,6 +373,10 @@ func AllQOFConditions() []QOFCondition {
 	return conditions
 }
 
+// The conditions assigned to people unless --conditions is given, for
+// which prevalences by age and sex, alone and in pairs, are needed.
+const DefaultQOFConditions = "dm,hyp,copd"
+
 type QOFConditions uint32
 
 func (c QOFConditions) Contains(condition QOFCondition) bool {
@@ -340,14 +401,49 @@ func (q QOFCondition) String() string {
 		return "hyp"
 	case QOFConditionCOPD:
 		return "copd"
+	case QOFConditionType1Diabetes:
+		return "dm1"
+	case QOFConditionType2Diabetes:
+		return "dm2"
+	case QOFConditionCVD:
+		return "cvd"
+	case QOFConditionCHD:
+		return "chd"
+	case QOFConditionStroke:
+		return "stia"
+	case QOFConditionPAD:
+		return "pad"
+	case QOFConditionDepression:
+		return "dep"
+	case QOFConditionSMI:
+		return "mh"
+	case QOFConditionAF:
+		return "af"
+	case QOFConditionHF:
+		return "hf"
 	}
 	return "invalid"
 }
 
+// Index returns the position of the condition in AllQOFConditions
+func (q QOFCondition) Index() int {
+	return bits.TrailingZeros32(uint32(q))
+}
+
+// HasRegister returns true if QOF publishes a register for the condition,
+// and so its prevalence at each practice, read from data/qof-condition.
+func (q QOFCondition) HasRegister() bool {
+	switch q {
+	case QOFConditionDiabetes, QOFConditionHypertension, QOFConditionCOPD, QOFConditionCHD, QOFConditionStroke, QOFConditionPAD, QOFConditionDepression, QOFConditionSMI, QOFConditionAF, QOFConditionHF:
+		return true
+	}
+	return false
+}
+
 func QOFConditionFromString(s string) QOFCondition {
-	for i := QOFCondition(0); i <= QOFConditionLast; i++ {
-		if s == i.String() {
-			return i
+	for _, c := range AllQOFConditions() {
+		if s == c.String() {
+			return c
 		}
 	}
 	return QOFConditionInvalid
@@ -420,57 +516,106 @@ type LSOA struct {
 	FemalesByAge []int
 	IMD          float64
 	IMDDecile    int
+	RuralUrban   RuralUrbanClass
+}
+
+func (l *LSOA) clone() *LSOA {
+	c := *l
+	c.PersonsByAge = append([]int{}, l.PersonsByAge...)
+	c.MalesByAge = append([]int{}, l.MalesByAge...)
+	c.FemalesByAge = append([]int{}, l.FemalesByAge...)
+	return &c
 }
 
-type ConditionFraction [QOFConditionLast + 1]float64
+type ConditionFraction [QOFConditionCount]float64
 
 func (c ConditionFraction) String() string {
 	parts := make([]string, 0, len(c))
-	var condition QOFCondition
-	for condition = 0; condition <= QOFConditionLast; condition++ {
-		parts = append(parts, fmt.Sprintf("%s: %.02f", condition, c[condition]))
+	for _, condition := range AllQOFConditions() {
+		parts = append(parts, fmt.Sprintf("%s: %.02f", condition, c[condition.Index()]))
 	}
 	return strings.Join(parts, " ")
 }
 
 type GPPractice struct {
-	Code                GPPracticeCode
-	Name                string
-	ICB                 ICBCode
-	Status              GPPracticeStatus
-	Practioners         int
-	Postcode            string
-	Location            s2.Point
-	LSOA                LSOACode
-	ListSize            int
-	ConditionPrevalence map[QOFCondition]float64
-	ConditionBias       map[QOFCondition]float64
-	Appointments        int
-	AppointmentsByType  [HcpTypeLast + 1]int
+	Code        GPPracticeCode
+	Name        string
+	ICB         ICBCode
+	Status      GPPracticeStatus
+	Practioners int
+	Postcode    string
+	Location    s2.Point
+	// How the location was found from the postcode
+	Geocoded GeocodeMethod
+	LSOA     LSOACode
+	ListSize int
+	// The list sizes reported against the codes of closed predecessors,
+	// included in ListSize, nil if there were none
+	PredecessorListSizes map[GPPracticeCode]int
+	ConditionPrevalence  map[QOFCondition]float64
+	// Prevalence as reported by QOF, before outliers are replaced, and
+	// missing values imputed or adjusted
+	ReportedConditionPrevalence map[QOFCondition]float64
+	ConditionBias               map[QOFCondition]float64
+	Appointments                int
+	AppointmentsByType          [HcpTypeLast + 1]int
+	// Appointments attended in person at the practice
+	AppointmentsFaceToFace int
+	// Monthly average prescribing, nil if not read
+	Prescribing *Prescribing
+	// Reported prevalence of current smoking among patients aged 15 and
+	// over, 0 if not read
+	SmokingPrevalence float64
+	// Reported QOF achievement against indicators of control, as the
+	// numerator as a share of the denominator, keyed by indicator code, nil
+	// if not read
+	IndicatorAchievement map[string]float64
 
 	SimulatedListSize        int
 	SimulatedConditionCounts map[QOFCondition]int
 }
 
-func readICBs() (map[ICBCode]*ICB, error) {
-	f, err := os.Open("data/lsoa-icb.csv.gz")
-	if err != nil {
-		return nil, err
+// clone returns a copy of the practice, sharing only its prescribing,
+// achievement and predecessors' list sizes, which aren't changed once
+// read.
+func (g *GPPractice) clone() *GPPractice {
+	c := *g
+	c.ConditionPrevalence = cloneConditionFloats(g.ConditionPrevalence)
+	c.ReportedConditionPrevalence = cloneConditionFloats(g.ReportedConditionPrevalence)
+	c.ConditionBias = cloneConditionFloats(g.ConditionBias)
+	if g.SimulatedConditionCounts != nil {
+		c.SimulatedConditionCounts = make(map[QOFCondition]int, len(g.SimulatedConditionCounts))
+		for condition, count := range g.SimulatedConditionCounts {
+			c.SimulatedConditionCounts[condition] = count
+		}
+	}
+	return &c
+}
+
+func cloneConditionFloats(m map[QOFCondition]float64) map[QOFCondition]float64 {
+	if m == nil {
+		return nil
 	}
-	defer f.Close()
+	c := make(map[QOFCondition]float64, len(m))
+	for condition, v := range m {
+		c[condition] = v
+	}
+	return c
+}
 
-	g, err := gzip.NewReader(f)
+func readICBs(dataset *Dataset, geography *CensusGeography) (map[ICBCode]*ICB, error) {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return nil, err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	r.FieldsPerRecord = -1
 
 	icbs := make(map[ICBCode]*ICB)
 	body := false
 	columns := make(map[string]int)
+	lsoaColumn := dataset.Column("lsoa-code")
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -479,36 +624,43 @@ func readICBs() (map[ICBCode]*ICB, error) {
 			return icbs, err
 		}
 		if len(row) > 0 {
-			if !body && row[0] == ICBDataLSOACodeColumn {
+			if !body && row[0] == lsoaColumn {
 				for i, header := range row {
 					columns[header] = i
 				}
+				if err := dataset.CheckColumns(columns, "icb-code", "icb-name"); err != nil {
+					return nil, err
+				}
 				body = true
 			} else if body {
-				code := ICBCode(row[columns[ICBDataICBCodeColumn]])
+				code := ICBCode(row[columns[dataset.Column("icb-code")]])
 				icb, ok := icbs[code]
 				if !ok {
-					icb = &ICB{Name: row[columns[ICBDataICBNameColumn]], LSOAs: make(LSOASet)}
+					icb = &ICB{Name: row[columns[dataset.Column("icb-name")]], LSOAs: make(LSOASet)}
 					icbs[code] = icb
 				}
-				lsoa := LSOACode(row[columns[ICBDataLSOACodeColumn]])
-				icb.LSOAs[lsoa] = struct{}{}
+				for _, lsoa := range geography.FromLSOA11.Translate(LSOACode(row[columns[lsoaColumn]])) {
+					icb.LSOAs[lsoa] = struct{}{}
+				}
 			}
 		}
 	}
+	if !body {
+		return nil, fmt.Errorf("%s: no %s column", dataset.Filename, lsoaColumn)
+	}
 	return icbs, nil
 }
 
-func parseAgeHeaders(row []string) ([]int, error) {
+func parseAgeHeaders(row []string, allAgesColumn string, ninetyPlusColumn string) ([]int, error) {
 	columns := make([]int, LSOADataMaxAge+1)
 	ages := false
 	for i, header := range row {
 		if !ages {
-			if header == LSOADataAllAgesColumn {
+			if header == allAgesColumn {
 				ages = true
 			}
 		} else if ages {
-			if header == LSOADataNinetyPlusColumn {
+			if header == ninetyPlusColumn {
 				columns[LSOADataMaxAge] = i
 				break
 			} else {
@@ -525,19 +677,12 @@ func parseAgeHeaders(row []string) ([]int, error) {
 
 // readByAge reads populations counts that have been broken down by age,
 // as the male/female/persons files have the same format
-func readByAge(filename string, emit func(LSOACode, string, []int) error) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+func readByAge(dataset *Dataset, emit func(LSOACode, string, []int) error) error {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	r.FieldsPerRecord = -1
 	body := false
@@ -551,17 +696,20 @@ func readByAge(filename string, emit func(LSOACode, string, []int) error) error
 			return err
 		}
 		if len(row) > 0 {
-			if !body && row[0] == LSOADataLSOACodeColumn {
-				ageColumns, err = parseAgeHeaders(row)
+			if !body && row[0] == dataset.Column("lsoa-code") {
+				ageColumns, err = parseAgeHeaders(row, dataset.Column("all-ages"), dataset.Column("ninety-plus"))
 				if err != nil {
 					return err
 				}
 				for i, column := range row {
-					if column == LSOADataLSOANameColumn {
+					if column == dataset.Column("lsoa-name") {
 						nameColumn = i
 						break
 					}
 				}
+				if nameColumn < 0 {
+					return fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("lsoa-name"))
+				}
 				body = true
 			} else if body {
 				counts := make([]int, LSOADataMaxAge+1)
@@ -578,35 +726,37 @@ func readByAge(filename string, emit func(LSOACode, string, []int) error) error
 			}
 		}
 	}
+	if !body {
+		return fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("lsoa-code"))
+	}
 	return nil
 }
 
-func readLSOAs(w b6.World) (map[LSOACode]*LSOA, error) {
+func readLSOAs(geography *CensusGeography, w b6.World) (map[LSOACode]*LSOA, error) {
 	lsoas := make(map[LSOACode]*LSOA)
 	emit := func(code LSOACode, name string, counts []int) error {
 		lsoas[code] = &LSOA{Code: code, Name: name, PersonsByAge: counts}
 		return nil
 	}
-	if err := readByAge("data/lsoa-persons.csv.gz", emit); err != nil {
+	if err := readByAge(geography.Persons, emit); err != nil {
 		return nil, err
 	}
 	emit = func(code LSOACode, name string, counts []int) error {
 		lsoas[code].MalesByAge = counts
 		return nil
 	}
-	if err := readByAge("data/lsoa-males.csv.gz", emit); err != nil {
+	if err := readByAge(geography.Males, emit); err != nil {
 		return nil, err
 	}
 	emit = func(code LSOACode, name string, counts []int) error {
 		lsoas[code].FemalesByAge = counts
 		return nil
 	}
-	if err := readByAge("data/lsoa-females.csv.gz", emit); err != nil {
+	if err := readByAge(geography.Females, emit); err != nil {
 		return nil, err
 	}
 	for _, lsoa := range lsoas {
-		id := b6.FeatureIDFromUKONSCode(lsoa.Code.String(), 2011, b6.FeatureTypeArea)
-		if f := b6.FindAreaByID(id.ToAreaID(), w); f != nil {
+		if f := findLSOABoundary(lsoa.Code, geography.Year, w); f != nil {
 			lsoa.Center = b6.Centroid(f)
 		} else {
 			return nil, fmt.Errorf("No LSOA boundary for %s", lsoa.Code)
@@ -615,19 +765,12 @@ func readLSOAs(w b6.World) (map[LSOACode]*LSOA, error) {
 	return lsoas, nil
 }
 
-func fillMSOAs(lsoas map[LSOACode]*LSOA) (map[MSOACode]*MSOA, error) {
-	f, err := os.Open("data/lsoa-msoa.csv.gz")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+func fillMSOAs(lsoas map[LSOACode]*LSOA, dataset *Dataset, geography *CensusGeography) (map[MSOACode]*MSOA, error) {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return nil, err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 
 	msoas := make(map[MSOACode]*MSOA)
@@ -639,6 +782,9 @@ func fillMSOAs(lsoas map[LSOACode]*LSOA) (map[MSOACode]*MSOA, error) {
 	for i, column := range row {
 		columns[column] = i
 	}
+	if err := dataset.CheckColumns(columns, "msoa-code", "msoa-name", "lsoa-code"); err != nil {
+		return nil, err
+	}
 
 	for {
 		row, err := r.Read()
@@ -647,34 +793,28 @@ func fillMSOAs(lsoas map[LSOACode]*LSOA) (map[MSOACode]*MSOA, error) {
 		} else if err != nil {
 			return nil, err
 		}
-		msoa := MSOACode(row[columns[LSOAToMSOAMSOACodeColumn]])
+		msoa := MSOACode(row[columns[dataset.Column("msoa-code")]])
 		if _, ok := msoas[msoa]; !ok {
 			msoas[msoa] = &MSOA{
 				Code: msoa,
-				Name: row[columns[LSOAToMSOAMSOANameColumn]],
+				Name: row[columns[dataset.Column("msoa-name")]],
 			}
 		}
-		lsoa := LSOACode(row[columns[LSOAToMSOALSOACodeColumn]])
-		if _, ok := lsoas[lsoa]; ok {
-			lsoas[lsoa].MSOACode = msoa
+		for _, lsoa := range geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]])) {
+			if _, ok := lsoas[lsoa]; ok {
+				lsoas[lsoa].MSOACode = msoa
+			}
 		}
 	}
 	return msoas, nil
 }
 
-func fillIMDs(lsoas map[LSOACode]*LSOA) error {
-	f, err := os.Open("data/lsoa-imd.csv.gz")
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+func fillIMDs(lsoas map[LSOACode]*LSOA, dataset *Dataset, geography *CensusGeography) error {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 
 	columns := make(map[string]int)
@@ -685,12 +825,25 @@ func fillIMDs(lsoas map[LSOACode]*LSOA) error {
 	for i, column := range row {
 		columns[column] = i
 	}
+	if err := dataset.CheckColumns(columns, "lsoa-code", "score", "decile"); err != nil {
+		return err
+	}
 
+	// 2011 LSOAs merged in the 2021 geography share a code, so the scores
+	// of their sources are averaged. The dataset doesn't give populations,
+	// so each source is weighted equally.
+	type sources struct {
+		scores  float64
+		scored  int
+		deciles []int
+	}
+	read := make(map[LSOACode]*sources)
+	// The lowest score in each decile, from which those of merged LSOAs
+	// are derived
+	lowest := make(map[int]float64)
 	badLSOA := 0
 	badScore := 0
 	badDecile := 0
-	n := 0
-	total := 0.0
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -698,48 +851,92 @@ func fillIMDs(lsoas map[LSOACode]*LSOA) error {
 		} else if err != nil {
 			return err
 		}
-		code := LSOACode(row[columns[IMDLSOACodeColumn]])
-		if lsoa, ok := lsoas[code]; ok {
-			if score, err := parseFloat(row[columns[IMDLSOAScoreColumn]]); err == nil {
-				lsoa.IMD = score
-				total += score
-			} else {
-				badScore++
+		score, scoreErr := parseFloat(row[columns[dataset.Column("score")]])
+		decile, decileErr := strconv.Atoi(row[columns[dataset.Column("decile")]])
+		if scoreErr == nil && decileErr == nil {
+			if l, ok := lowest[decile]; !ok || score < l {
+				lowest[decile] = score
 			}
-			if decile, err := strconv.Atoi(row[columns[IMDLSOADecileColumn]]); err == nil {
-				lsoa.IMDDecile = decile
+		}
+		for _, code := range geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]])) {
+			if _, ok := lsoas[code]; ok {
+				s, ok := read[code]
+				if !ok {
+					s = &sources{}
+					read[code] = s
+				}
+				if scoreErr == nil {
+					s.scores += score
+					s.scored++
+				} else {
+					badScore++
+				}
+				if decileErr == nil {
+					s.deciles = append(s.deciles, decile)
+				} else {
+					badDecile++
+				}
 			} else {
-				badDecile++
+				badLSOA++
+			}
+		}
+	}
+	deciles := make([]int, 0, len(lowest))
+	for decile := range lowest {
+		deciles = append(deciles, decile)
+	}
+	sort.Ints(deciles)
+	merged := 0
+	scored := 0
+	total := 0.0
+	for code, s := range read {
+		lsoa := lsoas[code]
+		if s.scored > 0 {
+			lsoa.IMD = s.scores / float64(s.scored)
+			total += lsoa.IMD
+			scored++
+		}
+		if len(s.deciles) > 0 {
+			lsoa.IMDDecile = s.deciles[0]
+		}
+		if len(s.deciles) > 1 {
+			merged++
+			if s.scored > 0 {
+				// Decile 1 is the most deprived, with the highest scores
+				lsoa.IMDDecile = deciles[len(deciles)-1]
+				for _, decile := range deciles {
+					if lsoa.IMD >= lowest[decile] {
+						lsoa.IMDDecile = decile
+						break
+					}
+				}
 			}
-			n++
-		} else {
-			badLSOA++
 		}
 	}
-	log.Printf("imd: bad lsoa: %d bad score: %d bad decile: %d imd average: %f", badLSOA, badScore, badDecile, total/float64(n))
+	log.Printf("imd: bad lsoa: %d bad score: %d bad decile: %d merged: %d imd average: %f", badLSOA, badScore, badDecile, merged, total/float64(scored))
 	return nil
 }
 
-func readGPPracticeListSizes(gps map[GPPracticeCode]*GPPractice) error {
-	f, err := os.Open("data/qof-condition/af.csv.gz")
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+// readGPPracticeListSizes reads the list size of each practice, adding
+// those reported against the codes of predecessors to their successors.
+// Only the first row for each code is used, so that duplicated rows
+// aren't counted twice.
+func readGPPracticeListSizes(gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors, dataset *Dataset) error {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	r.FieldsPerRecord = -1
 	code := -1
 	listSize := -1
 	missingGPs := 0
+	remapped := 0
 	badListSize := 0
+	duplicates := 0
 	totalListSize := 0
+	seen := make(GPPracticeCodeSet)
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -750,19 +947,33 @@ func readGPPracticeListSizes(gps map[GPPracticeCode]*GPPractice) error {
 		if code < 0 {
 			for i, col := range row {
 				switch col {
-				case GPQOFDataPracticeCodeColumn:
+				case dataset.Column("practice-code"):
 					code = i
-				case GPQOFDataListSizeColumn:
+				case dataset.Column("list-size"):
 					if listSize < 0 { // Second occurance is year-on-year change
 						listSize = i
 					}
 				}
 			}
 		} else if listSize > 0 {
-			if gp, ok := gps[GPPracticeCode(row[code])]; ok {
-				var err error
-				if gp.ListSize, err = strconv.Atoi(strings.Replace(strings.TrimSpace(row[listSize]), ",", "", -1)); err == nil {
-					totalListSize += gp.ListSize
+			reported := GPPracticeCode(row[code])
+			if _, ok := seen[reported]; ok {
+				duplicates++
+				continue
+			}
+			seen[reported] = struct{}{}
+			current := successors.Current(reported, gps)
+			if gp, ok := gps[current]; ok {
+				if n, err := strconv.Atoi(strings.Replace(strings.TrimSpace(row[listSize]), ",", "", -1)); err == nil {
+					if current != reported {
+						remapped++
+						if gp.PredecessorListSizes == nil {
+							gp.PredecessorListSizes = make(map[GPPracticeCode]int)
+						}
+						gp.PredecessorListSizes[reported] = n
+					}
+					gp.ListSize += n
+					totalListSize += n
 				} else {
 					badListSize++
 				}
@@ -771,96 +982,123 @@ func readGPPracticeListSizes(gps map[GPPracticeCode]*GPPractice) error {
 			}
 		}
 	}
+	if code < 0 {
+		return fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("practice-code"))
+	} else if listSize < 0 {
+		return fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("list-size"))
+	}
 	log.Printf("list size assignment:")
 	log.Printf("  bad list size: %d", badListSize)
+	log.Printf("  duplicate rows: %d", duplicates)
 	log.Printf("  missing gps: %d", missingGPs)
+	log.Printf("  remapped to successors: %d", remapped)
 	log.Printf("  total list size: %d", totalListSize)
 	return nil
 }
 
-func readGPPracticeConditionPrevalence(gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition) error {
-	badPrevalence := 0
-	missingGPs := 0
-	outlierGPs := 0
-	var average ConditionFraction
-	var coverage ConditionFraction
+// readGPPracticeConditionPrevalence reads the reported prevalence of each
+// condition with a register, returning the rows that couldn't be used.
+// Prevalence reported against the code of a predecessor is given to its
+// successor, unless the successor reported its own, averaged across
+// predecessors sharing a successor, weighted by their list sizes.
+func readGPPracticeConditionPrevalence(gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors, conditions []QOFCondition, data DataManifest) (*PrevalenceRead, error) {
+	read := newPrevalenceRead()
+	remapped := 0
 	for _, condition := range conditions {
-		outliers := make([]*GPPractice, 0)
-		f, err := os.Open(fmt.Sprintf("data/qof-condition/%s.csv.gz", condition.String()))
-		if err != nil {
-			return err
+		if !condition.HasRegister() {
+			continue
 		}
-		defer f.Close()
-
-		g, err := gzip.NewReader(f)
+		read.Unparsed[condition] = make(GPPracticeCodeSet)
+		dataset := data.Get(QOFConditionDataset(condition))
+		r, err := openDataset(dataset)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		r := csv.NewReader(g)
+		defer r.Close()
 		r.Comment = '#'
 		r.FieldsPerRecord = -1
 		code := -1
 		prevalence := -1
-		n := 0
+		direct := make(GPPracticeCodeSet)
+		// The prevalence of predecessors, weighted by their list sizes,
+		// and unweighted, for those without them, by successor
+		weighted, weights := make(map[GPPracticeCode]float64), make(map[GPPracticeCode]float64)
+		unweighted, n := make(map[GPPracticeCode]float64), make(map[GPPracticeCode]float64)
 		for {
 			row, err := r.Read()
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				return err
+				return nil, err
 			}
 			if code < 0 {
 				for i, col := range row {
 					switch col {
-					case GPQOFDataPracticeCodeColumn:
+					case dataset.Column("practice-code"):
 						code = i
-					case GPQOFDataPrevalenceColumn:
+					case dataset.Column("prevalence"):
 						if prevalence < 0 { // Second occurance is year-on-year change
 							prevalence = i
 						}
 					}
 				}
 			} else if prevalence > 0 {
-				if gp, ok := gps[GPPracticeCode(row[code])]; ok {
-					coverage[condition]++
-					if p, err := parseFloat(row[prevalence]); err == nil {
-						gp.ConditionPrevalence[condition] = p / 100.0
-						if p/100.0 < QPQOFDataPrevalenceOutlier {
-							average[condition] += (p / 100.0)
-							n++
+				reported := GPPracticeCode(row[code])
+				current := successors.Current(reported, gps)
+				if gp, ok := gps[current]; ok {
+					p, err := parseFloat(row[prevalence])
+					if current == reported {
+						direct[current] = struct{}{}
+						delete(read.Unparsed[condition], current)
+						if err == nil {
+							gp.ConditionPrevalence[condition] = p / 100.0
+							gp.ReportedConditionPrevalence[condition] = p / 100.0
 						} else {
-							outliers = append(outliers, gp)
+							read.Unparsed[condition][gp.Code] = struct{}{}
 						}
-					} else {
-						badPrevalence++
+					} else if err == nil {
+						remapped++
+						w := float64(gp.PredecessorListSizes[reported])
+						weighted[current] += w * p / 100.0
+						weights[current] += w
+						unweighted[current] += p / 100.0
+						n[current]++
+					} else if _, ok := n[current]; !ok {
+						read.Unparsed[condition][gp.Code] = struct{}{}
 					}
 				} else {
-					missingGPs++
+					read.UnknownPractices[condition]++
 				}
 			}
 		}
-		if n > 0 {
-			average[condition] /= float64(n)
-			for _, gp := range outliers {
-				gp.ConditionPrevalence[condition] = average[condition]
-				outlierGPs++
+		if code < 0 {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("practice-code"))
+		} else if prevalence < 0 {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column("prevalence"))
+		}
+		for current, count := range n {
+			if _, ok := direct[current]; ok {
+				continue
+			}
+			p := unweighted[current] / count
+			if weights[current] > 0.0 {
+				p = weighted[current] / weights[current]
 			}
+			gps[current].ConditionPrevalence[condition] = p
+			gps[current].ReportedConditionPrevalence[condition] = p
+			delete(read.Unparsed[condition], current)
 		}
 	}
-	log.Printf("prevalence assignment:")
-	log.Printf("  bad prevalence: %d", badPrevalence)
-	log.Printf("  missing gps: %d", missingGPs)
-	log.Printf("  outlying gps * conditions: %d", outlierGPs)
-	log.Printf("  average prevalence: %s", average.String())
-	log.Printf("  coverage:")
-	for _, condition := range conditions {
-		log.Printf("    %s: %.02f", condition, coverage[condition]/float64(len(gps)))
+	if remapped > 0 {
+		log.Printf("  prevalence remapped to successors: %d", remapped)
 	}
-	return nil
+	return read, nil
 }
 
-func imputeMissingPrevalenceFromNearby(gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, nearby map[LSOACode][]GPPracticeCode) {
+// imputeMissingPrevalenceFromNearby gives practices without a reported
+// prevalence the average of nearby practices, weighted by the inverse of
+// their distance, returning the number missing, and the number imputed.
+func imputeMissingPrevalenceFromNearby(gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, nearby NearbyGPs) (int, int) {
 	log.Printf("impute missing prevalences")
 	missing := 0
 	imputed := 0
@@ -871,7 +1109,7 @@ func imputeMissingPrevalenceFromNearby(gps map[GPPracticeCode]*GPPractice, condi
 				n := 0.0
 				p := 0.0
 				for _, neighbour := range nearby[gp.LSOA] {
-					other := gps[neighbour]
+					other := gps[neighbour.Practice]
 					if other != gp && other.ConditionPrevalence[condition] > 0.0 {
 						f := float64(1.0 / gp.Location.Distance(other.Location))
 						n += f
@@ -887,26 +1125,23 @@ func imputeMissingPrevalenceFromNearby(gps map[GPPracticeCode]*GPPractice, condi
 	}
 	log.Printf("  missing: %d", missing)
 	log.Printf("  imputed: %d", imputed)
+	return missing, imputed
 }
 
-func readGPPractices(w b6.World) (map[GPPracticeCode]*GPPractice, error) {
-	f, err := os.Open("data/gp-practices.csv.gz")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+// readGPPractices reads every practice, located by its postcode in w, or
+// among the historic postcodes of postcodes. If w is nil, practices are
+// read without locations or LSOAs.
+func readGPPractices(dataset *Dataset, postcodes PostcodeSources, w b6.World) (map[GPPracticeCode]*GPPractice, error) {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return nil, err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	r.FieldsPerRecord = -1
 
 	gps := make(map[GPPracticeCode]*GPPractice)
-	missingLocations := 0
+	locator := newPostcodeLocator(worldPostcodes(w), "practice", dataset)
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -914,50 +1149,60 @@ func readGPPractices(w b6.World) (map[GPPracticeCode]*GPPractice, error) {
 		} else if err != nil {
 			return nil, err
 		}
-		var location s2.Point
-		var lsoa LSOACode
-		postcode := row[GPPracticeDataPostcodeColumn]
-		if p := b6.FindPointByID(b6.PointIDFromGBPostcode(postcode), w); p != nil {
-			location = p.Point()
-			lsoas := w.FindFeatures(b6.Intersection{b6.IntersectsPoint{Point: location}, b6.Tagged{Key: "#boundary", Value: "lsoa"}})
-			for lsoas.Next() {
-				lsoa = LSOACode(lsoas.Feature().Get("code").Value)
-				break
-			}
-		} else {
-			missingLocations++
-		}
-		code := GPPracticeCode(row[GPPracticeDataCodeColumn])
-		gps[code] = &GPPractice{
-			Code:                     code,
-			Name:                     row[GPPracticeDataNameColumn],
-			ICB:                      ICBCode(row[GPPracticeDataICBCodeColumn]),
-			Status:                   GPPracticeStatus(row[GPPracticeDataStatusColumn]),
-			Postcode:                 postcode,
-			Location:                 location,
-			LSOA:                     lsoa,
-			ConditionPrevalence:      make(map[QOFCondition]float64),
-			ConditionBias:            make(map[QOFCondition]float64),
-			SimulatedConditionCounts: make(map[QOFCondition]int),
+		if err := dataset.CheckIndices(row, "code", "name", "icb-code", "status", "postcode"); err != nil {
+			return nil, err
+		}
+		code := GPPracticeCode(row[dataset.Index("code")])
+		gp := &GPPractice{
+			Code:                        code,
+			Name:                        row[dataset.Index("name")],
+			ICB:                         ICBCode(row[dataset.Index("icb-code")]),
+			Status:                      GPPracticeStatus(row[dataset.Index("status")]),
+			Postcode:                    row[dataset.Index("postcode")],
+			ConditionPrevalence:         make(map[QOFCondition]float64),
+			ReportedConditionPrevalence: make(map[QOFCondition]float64),
+			ConditionBias:               make(map[QOFCondition]float64),
+			SimulatedConditionCounts:    make(map[QOFCondition]int),
+		}
+		gps[code] = gp
+		// Practices aren't located without a world
+		if w != nil {
+			locator.Locate(code.String(), gp.Postcode, func(p s2.Point) {
+				gp.Location = p
+				gp.LSOA = lsoaContaining(p, w)
+			})
+		}
+	}
+	if w != nil {
+		if err := locator.Finish(postcodes); err != nil {
+			return nil, err
+		}
+		for _, f := range locator.Fallbacks {
+			gps[GPPracticeCode(f.Code)].Geocoded = f.Method
 		}
 	}
+	countMissingPostcodes(dataset, locator.Missing)
 	log.Printf("practices: %d", len(gps))
-	log.Printf("  missing locations: %d", missingLocations)
+	locator.Log()
 	return gps, nil
 }
 
-func buildNearbyGPs(gps map[GPPracticeCode]*GPPractice, radius s1.Angle, w b6.World, cores int) (map[LSOACode][]GPPracticeCode, error) {
+// buildNearbyGPs returns the practices within radius of each LSOA, with
+// their distance from its centre.
+func buildNearbyGPs(gps map[GPPracticeCode]*GPPractice, radius s1.Angle, w b6.World, cores int, progress Progress) (NearbyGPs, error) {
+	progress.Start("nearby gps", len(gps))
+	defer progress.Done()
 	c := make(chan *GPPractice)
 	done := make(chan error, 2*cores)
 	invalid := s2.Point{}
 	seen := make(map[b6.FeatureID]struct{})
-	nearby := make(map[LSOACode][]GPPracticeCode)
+	nearby := make(NearbyGPs)
 	practices := 0
 	var lock sync.Mutex
 	f := func() {
 		for gp := range c {
 			if gp.Location != invalid {
-				cap := s2.CapFromCenterAngle(gp.Location, b6.MetersToAngle(GPLSOANearbyRadiusM))
+				cap := s2.CapFromCenterAngle(gp.Location, radius)
 				lsoas := w.FindFeatures(b6.Intersection{b6.NewIntersectsCap(cap), b6.Tagged{Key: "#boundary", Value: "lsoa"}})
 				for lsoas.Next() {
 					code := LSOACode(lsoas.Feature().Get("code").Value)
@@ -965,8 +1210,9 @@ func buildNearbyGPs(gps map[GPPracticeCode]*GPPractice, radius s1.Angle, w b6.Wo
 						done <- fmt.Errorf("No code for %s", lsoas.FeatureID())
 						return
 					}
+					d := b6.AngleToMeters(b6.Centroid(lsoas.Feature()).Distance(gp.Location))
 					lock.Lock()
-					nearby[code] = append(nearby[code], gp.Code)
+					nearby[code] = append(nearby[code], NearbyGP{Practice: gp.Code, DistanceM: d, TravelMinutes: math.NaN()})
 					seen[lsoas.FeatureID()] = struct{}{}
 					lock.Unlock()
 				}
@@ -974,6 +1220,7 @@ func buildNearbyGPs(gps map[GPPracticeCode]*GPPractice, radius s1.Angle, w b6.Wo
 			lock.Lock()
 			practices++
 			lock.Unlock()
+			progress.Add(1)
 		}
 		done <- nil
 	}
@@ -994,23 +1241,17 @@ func buildNearbyGPs(gps map[GPPracticeCode]*GPPractice, radius s1.Angle, w b6.Wo
 	return nearby, err
 }
 
-func readGPPractioners(gps map[GPPracticeCode]*GPPractice) error {
-	f, err := os.Open("data/gp-practioners.csv.gz")
+func readGPPractioners(gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors, dataset *Dataset) error {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
-	if err != nil {
-		return err
-	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	r.FieldsPerRecord = -1
 	practioners := 0
 	unassigned := 0
+	remapped := 0
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -1019,31 +1260,31 @@ func readGPPractioners(gps map[GPPracticeCode]*GPPractice) error {
 			return err
 		}
 		practioners++
-		code := GPPracticeCode(row[GPPractionerDataPracticeCodeColumn])
-		if gp, ok := gps[code]; ok {
+		if err := dataset.CheckIndices(row, "practice-code"); err != nil {
+			return err
+		}
+		code := GPPracticeCode(row[dataset.Index("practice-code")])
+		current := successors.Current(code, gps)
+		if gp, ok := gps[current]; ok {
 			gp.Practioners++
+			if current != code {
+				remapped++
+			}
 		} else {
 			unassigned++
 		}
 	}
-	log.Printf("practioners: %d unassigned: %d", practioners, unassigned)
+	log.Printf("practioners: %d unassigned: %d remapped to successors: %d", practioners, unassigned, remapped)
 	return nil
 }
 
-func readGPAppointments(gps map[GPPracticeCode]*GPPractice) error {
+func readGPAppointments(gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors, dataset *Dataset) error {
 	log.Printf("read GP appointments")
-	f, err := os.Open("data/gp-practices-appointments-03-2023.csv.gz")
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	columns := make(map[string]int)
 	row, err := r.Read()
@@ -1053,8 +1294,12 @@ func readGPAppointments(gps map[GPPracticeCode]*GPPractice) error {
 	for i, column := range row {
 		columns[column] = i
 	}
+	if err := dataset.CheckColumns(columns, "practice-code", "hcp-type", "mode", "status", "national-category", "count"); err != nil {
+		return err
+	}
 	appointments := 0
 	matched := 0
+	remapped := 0
 	byType := make(map[string]int)
 	byCategory := make(map[string]int)
 	for {
@@ -1065,29 +1310,36 @@ func readGPAppointments(gps map[GPPracticeCode]*GPPractice) error {
 			return err
 		}
 		appointments++
-		code := GPPracticeCode(row[columns[GPAppointmentsCodeColumn]])
-		t := row[columns[GPAppointmentsHcpTypeColumn]]
-		if gp, ok := gps[code]; ok {
+		code := GPPracticeCode(row[columns[dataset.Column("practice-code")]])
+		t := row[columns[dataset.Column("hcp-type")]]
+		current := successors.Current(code, gps)
+		if gp, ok := gps[current]; ok {
 			matched++
-			if row[columns[GPAppointmentsStatusColumn]] == GPAppointmentsStatusAttended {
-				count, err := strconv.Atoi(row[columns[GPAppointmentsCountColumn]])
+			if current != code {
+				remapped++
+			}
+			if row[columns[dataset.Column("status")]] == GPAppointmentsStatusAttended {
+				count, err := strconv.Atoi(row[columns[dataset.Column("count")]])
 				if err == nil {
 					gp.Appointments += count
 					gp.AppointmentsByType[HcpTypeFromString(t)]++
+					if row[columns[dataset.Column("mode")]] == GPAppointmentsModeFaceToFace {
+						gp.AppointmentsFaceToFace += count
+					}
 				}
 			}
 		}
 		byType[t]++
-		byCategory[row[columns[GPAppointmentsNationalCategory]]]++
+		byCategory[row[columns[dataset.Column("national-category")]]]++
 	}
-	log.Printf("  %d appointments, %d matched", appointments, matched)
-	log.Printf("  staff")
+	log.Printf("  %d appointments, %d matched, %d remapped to successors", appointments, matched, remapped)
+	Debugf("  staff")
 	for t, count := range byType {
-		log.Printf("    %s: %d", t, count)
+		Debugf("    %s: %d", t, count)
 	}
-	log.Printf("  category")
+	Debugf("  category")
 	for c, count := range byCategory {
-		log.Printf("    %s: %d", c, count)
+		Debugf("    %s: %d", c, count)
 	}
 	return nil
 }
@@ -1095,7 +1347,16 @@ func readGPAppointments(gps map[GPPracticeCode]*GPPractice) error {
 type Probabilities []float64
 
 func (p Probabilities) Choose() int {
-	sample := rand.Float64()
+	return p.choose(rand.Float64())
+}
+
+// ChooseWith is like Choose, but draws from rng rather than the global
+// source.
+func (p Probabilities) ChooseWith(rng *rand.Rand) int {
+	return p.choose(rng.Float64())
+}
+
+func (p Probabilities) choose(sample float64) int {
 	for i := range p {
 		if sample < p[i] {
 			return i
@@ -1127,7 +1388,7 @@ func (s Sex) String() string {
 }
 
 func SexFromString(s string) Sex {
-	for _, sex := range Sexes() {
+	for _, sex := range AllSexes() {
 		if sex.String() == s {
 			return sex
 		}
@@ -1135,10 +1396,6 @@ func SexFromString(s string) Sex {
 	return Other
 }
 
-func Sexes() []Sex {
-	return []Sex{Male, Female}
-}
-
 func sum(xs []int) int {
 	s := 0
 	for _, x := range xs {
@@ -1227,16 +1484,53 @@ func makeAgeProbabilities(lsoa *LSOA) []Probabilities {
 }
 
 type Person struct {
-	ID         int
-	Sex        Sex
-	Age        int
-	Home       LSOACode
+	ID   int
+	Sex  Sex
+	Age  int
+	Home LSOACode
+	// The point at which the person lives within Home, or zero if points
+	// weren't sampled
+	HomePoint  s2.LatLng
 	GP         GPPracticeCode
 	Conditions QOFConditions
-}
-
-func PersonHeaderRow() []string {
-	return []string{"id", "sex", "age", "home", "gp", "condition_dm", "condition_hyp", "condition_copd"}
+	Admissions Admissions
+	NHSNumber  string
+	Name       *PersonName
+	Smoking    SmokingStatus
+	// Body mass index, or 0 if it wasn't simulated, or for children
+	BMI float32
+	// Age at diagnosis, indexed by QOFCondition.Index, for conditions the
+	// person has, when incidence is simulated
+	OnsetAges [QOFConditionCount]int16
+	// The last value of each clinical measurement, or 0 if it wasn't
+	// simulated, or the person wasn't measured
+	Measurements [MeasurementCount]float32
+	// The population health segment, SegmentHealthy if not simulated
+	Segment Segment
+	// The care home in which the person lives, if any
+	CareHome CareHomeID
+	// The nearest community pharmacy to the person's home, if simulated
+	Pharmacy ODSCode
+	// The DWP benefits the person claims, if simulated
+	Benefits Benefits
+	// The complications of a condition the person has, if simulated
+	Complications Complications
+	// The conditions the person is estimated to have undiagnosed, if
+	// detection is simulated
+	Undiagnosed QOFConditions
+	// The conditions the person has that are controlled, by the QOF
+	// indicators of their practice, if control is simulated
+	Controlled QOFConditions
+	// The weight calibrated to external totals, or 0 if not reweighted
+	Weight float32
+	// Unknown if not simulated, or for children
+	EconomicActivity EconomicActivity
+	Occupation       Occupation
+}
+
+// Obese returns true if the person has a simulated BMI of 30 or more.
+func (p *Person) Obese() bool {
+	return p.BMI >= BMIObeseThreshold
 }
 
 func presentToString(present bool) string {
@@ -1246,75 +1540,100 @@ func presentToString(present bool) string {
 	return "0"
 }
 
-func (p *Person) ToRow(conditions []QOFCondition) []string {
-	row := []string{
-		strconv.Itoa(p.ID),
-		p.Sex.String(),
-		strconv.Itoa(p.Age),
-		p.Home.String(),
-		p.GP.String(),
+// chooseNearbyGP chooses a practice for a person living in an LSOA, from
+// those near it, more likely closer, and with a larger list. If weight
+// isn't nil, it further scales the likelihood of each practice.
+func chooseNearbyGP(nearbyGPs []NearbyGP, gps map[GPPracticeCode]*GPPractice, parameters AssignmentParameters, weight func(GPPracticeCode) float64, rng *rand.Rand) GPPracticeCode {
+	filtered, p := nearbyGPProbabilities(nearbyGPs, gps, parameters, weight)
+	if len(filtered) == 0 {
+		return GPPracticeCodeInvalid
 	}
-	for _, c := range conditions {
-		row = append(row, presentToString(p.Conditions.Contains(c)))
+	return filtered[Probabilities(p).ChooseWith(rng)].Practice
+}
+
+// nearbyGPProbabilities returns the practices near an LSOA that
+// chooseNearbyGP can choose for a person living in it, with the
+// probability of choosing each.
+func nearbyGPProbabilities(nearbyGPs []NearbyGP, gps map[GPPracticeCode]*GPPractice, parameters AssignmentParameters, weight func(GPPracticeCode) float64) ([]NearbyGP, []float64) {
+	filtered, distances, sizes := nearbyGPWeights(nearbyGPs, gps, parameters, weight)
+	if len(filtered) == 0 {
+		return nil, nil
 	}
-	return row
+	return filtered, choiceProbabilities(distances, sizes)
 }
 
-const (
-	// A rough estimate on the maximum size of GP practices lists, used when
-	// calculating assignment probabilities of people to practices.
-	GPPracticeMaxListSize = 20000
-	// GP practices closer than this value to an individual are equally likely
-	// to be chosen, after that, it follows the reciprocal, halving at twice
-	// the distance.
-	GPPracticeEqualDistanceLimitM = 750.0
-)
+// choiceProbabilities returns the probability of choosing each practice
+// from the weights returned by nearbyGPWeights.
+func choiceProbabilities(distances []float64, sizes []float64) []float64 {
+	p := mulf(distances, sizes)
+	normalise(p)
+	return p
+}
 
-func chooseNearbyGP(lsoa *LSOA, nearbyGPs []GPPracticeCode, gps map[GPPracticeCode]*GPPractice) GPPracticeCode {
+// nearbyGPWeights returns the practices near an LSOA that chooseNearbyGP
+// can choose, with the weight given to each by its distance, and by its
+// list size, scaled by weight, if given, whose product is the likelihood
+// of choosing it. The parameters are expected to have their defaults
+// filled with withDefaults.
+func nearbyGPWeights(nearbyGPs []NearbyGP, gps map[GPPracticeCode]*GPPractice, parameters AssignmentParameters, weight func(GPPracticeCode) float64) ([]NearbyGP, []float64, []float64) {
 	// Remove GPs that don't have any patients (according to the data we have),
 	// as many (but not all) seem to be special-case facilities, eg
 	// "PARKINSON'S DAY UNIT-CLCH" or "PILOT SE LOCALITY TELEPHONE APPOINTMENTS"
-	filtered := make([]GPPracticeCode, 0, len(nearbyGPs))
+	filtered := make([]NearbyGP, 0, len(nearbyGPs))
 	for _, gp := range nearbyGPs {
-		if gps[gp].ListSize > 0 {
-			filtered = append(filtered, gp)
+		if gps[gp.Practice].ListSize > 0 {
+			if parameters.RadiusM <= 0.0 || gp.DistanceM <= parameters.RadiusM {
+				filtered = append(filtered, gp)
+			}
 		}
 	}
 	if len(filtered) == 0 {
-		return GPPracticeCodeInvalid
+		return nil, nil, nil
 	}
+	limit := parameters.EqualDistanceM
 	distances := make([]float64, len(filtered))
-	for i, code := range filtered {
-		d := b6.AngleToMeters(lsoa.Center.Distance(gps[code].Location))
-		if d < GPPracticeEqualDistanceLimitM {
+	for i, gp := range filtered {
+		d := gp.DistanceM
+		if d < limit {
 			distances[i] = 1.0
 		} else {
 			// Half the likelyhood at twice the distance limit away
-			distances[i] = 1.0 / (d / GPPracticeEqualDistanceLimitM)
+			distances[i] = 1.0 / (d / limit)
 		}
 	}
 	sizes := make([]float64, len(filtered))
-	for i, code := range filtered {
-		sizes[i] = clamp(float64(gps[code].ListSize)/GPPracticeMaxListSize, 0.01, 1.0)
+	for i, gp := range filtered {
+		sizes[i] = clamp(float64(gps[gp.Practice].ListSize)/parameters.maxListSize, 0.01, 1.0)
+		if weight != nil {
+			sizes[i] *= weight(gp.Practice)
+		}
 	}
-	p := mulf(distances, sizes)
-	normalise(p)
-	return filtered[Probabilities(p).Choose()]
+	return filtered, distances, sizes
 }
 
-func buildPopulation(homes LSOASet, lsoas map[LSOACode]*LSOA, nearbyGPs map[LSOACode][]GPPracticeCode, gps map[GPPracticeCode]*GPPractice) ([]Person, error) {
+func buildPopulation(homes LSOASet, lsoas map[LSOACode]*LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, rurality *RuralityModel, parameters SimulationParameters, progress Progress) ([]Person, error) {
 	people := make([]Person, 0, 1024)
 	noPossibleGPs := 0
+	total := 0
+	for home := range homes {
+		if lsoa, ok := lsoas[home]; ok {
+			total += sum(lsoa.PersonsByAge)
+		}
+	}
+	progress.Start("build population", total)
+	defer progress.Done()
+	rng := rand.New(rand.NewSource(rand.Int63()))
 	for home := range homes {
 		if lsoa, ok := lsoas[home]; ok {
 			sp := makeSexProbabilities(lsoa)
 			ap := makeAgeProbabilities(lsoa)
 			possibleGPs := nearbyGPs[home]
+			assignment := rurality.Parameters(lsoa, parameters)
 			n := sum(lsoa.PersonsByAge)
 			for i := 0; i < n; i++ {
-				sex := Sex(sp.Choose())
-				age := ap[sex].Choose()
-				gp := chooseNearbyGP(lsoa, possibleGPs, gps)
+				sex := Sex(sp.ChooseWith(rng))
+				age := ap[sex].ChooseWith(rng)
+				gp := chooseNearbyGP(possibleGPs, gps, assignment, nil, rng)
 				if gp == GPPracticeCodeInvalid {
 					noPossibleGPs++
 				} else {
@@ -1322,13 +1641,16 @@ func buildPopulation(homes LSOASet, lsoas map[LSOACode]*LSOA, nearbyGPs map[LSOA
 				}
 				people = append(people, Person{ID: len(people), Sex: sex, Age: age, Home: home, GP: gp})
 			}
+			progress.Add(n)
 		} else {
 			return nil, fmt.Errorf("no LSOA %s", home)
 		}
 	}
 	log.Printf("population:")
 	log.Printf("  people: %d", len(people))
-	log.Printf("  no possible gps: %d people", noPossibleGPs)
+	if noPossibleGPs > 0 {
+		Warningf("  no possible gps: %d people", noPossibleGPs)
+	}
 	return people, nil
 }
 
@@ -1344,7 +1666,10 @@ func estimateListSizeError(selected GPPracticeCodeSet, gps map[GPPracticeCode]*G
 }
 
 // Add estimates for c1|c2 and c1|!c2 to prevalences, using Bayes based on
-// existing entries in prevalences for c1, c2 and c1&c2.
+// existing entries in prevalences for c1, c2 and c1&c2. If c1&c2 isn't
+// given, or determined by QOFConditionConstraints, it's derived from the
+// prevalence of a pair of their ancestors, scaled by the prevalence of
+// each sub-condition relative to its ancestor, and added to prevalences.
 func fillConditionalPrevalences(c1 QOFCondition, c2 QOFCondition, population []Person, prevalences AllPrevalences) {
 	c1p, ok := prevalences[OneCondition(c1)]
 	if !ok {
@@ -1355,33 +1680,69 @@ func fillConditionalPrevalences(c1 QOFCondition, c2 QOFCondition, population []P
 		panic(fmt.Sprintf("no prevalences for %s", OneCondition(c2)))
 	}
 	c1c2p, ok := prevalences[TwoConditions(c1, c2)]
+	a1, a2 := c1, c2
+	var derived *Prevalences
 	if !ok {
-		panic(fmt.Sprintf("no prevalences for %s", TwoConditions(c1, c2)))
+		if c1c2p, ok = constrainedPairPrevalence(c1, c2, prevalences, QOFConditionConstraints); !ok {
+			given := func(d DiagonosisGiven) bool {
+				_, ok := prevalences[d]
+				return ok
+			}
+			if a1, a2, ok = ancestorPair(c1, c2, given); !ok {
+				panic(fmt.Sprintf("no prevalences for %s, or a pair of their ancestors", TwoConditions(c1, c2)))
+			}
+			c1c2p = prevalences[TwoConditions(a1, a2)]
+			derived = &Prevalences{Conditions: TwoConditions(c1, c2), ByAge: make([][]AgePrevalence, len(AllSexes()))}
+		}
 	}
+	a1p, a2p := prevalences[OneCondition(a1)], prevalences[OneCondition(a2)]
 	givenC2Present := Prevalences{
 		Conditions: OneConditionGivenOtherPresent(c1, c2),
-		ByAge:      make([][]AgePrevalence, len(Sexes())),
+		ByAge:      make([][]AgePrevalence, len(AllSexes())),
 	}
 	givenC2Absent := Prevalences{
 		Conditions: OneConditionGivenOtherAbsent(c1, c2),
-		ByAge:      make([][]AgePrevalence, len(Sexes())),
+		ByAge:      make([][]AgePrevalence, len(AllSexes())),
 	}
-	for _, sex := range Sexes() {
-		for _, a := range c1c2p.ByAge[sex] {
+	for _, sex := range AllSexes() {
+		for _, a := range c1c2p.ByAge.ForSex(sex) {
 			ec1 := 0.0
 			ec2 := 0.0
+			ea1 := 0.0
+			ea2 := 0.0
 			n := 0.0
 			for _, person := range population {
 				if person.Sex == sex && a.Ages.Contains(person.Age) {
 					n += 1.0
 					ec1 += c1p.Prevalence(person.Sex, person.Age)
 					ec2 += c2p.Prevalence(person.Sex, person.Age)
+					ea1 += a1p.Prevalence(person.Sex, person.Age)
+					ea2 += a2p.Prevalence(person.Sex, person.Age)
 				}
 			}
+			if n == 0.0 {
+				// No people in the range, which happens for the Other sex
+				continue
+			}
 			pc1 := ec1 / n
 			pc2 := ec2 / n
-			pc1c2 := math.Min(math.Min(a.Prevalence, pc1), pc2)
-			p := pc1c2 / pc2
+			pair := a.Prevalence
+			if derived != nil {
+				if ea1 > 0.0 && ea2 > 0.0 {
+					pair *= (ec1 / ea1) * (ec2 / ea2)
+				} else {
+					pair = 0.0
+				}
+				derived.ByAge[sex] = append(derived.ByAge[sex], AgePrevalence{Ages: a.Ages, Prevalence: pair})
+			}
+			pc1c2 := math.Min(math.Min(pair, pc1), pc2)
+			// Nobody has c2 in ranges where it has no prevalence, as in
+			// pairs derived from relative rates, which cover the ages of
+			// both conditions
+			p := pc1
+			if pc2 > 0.0 {
+				p = pc1c2 / pc2
+			}
 			givenC2Present.ByAge[sex] = append(givenC2Present.ByAge[sex], AgePrevalence{Ages: a.Ages, Prevalence: p})
 			p = (pc1 - pc1c2) / (1.0 - pc2)
 			givenC2Absent.ByAge[sex] = append(givenC2Absent.ByAge[sex], AgePrevalence{Ages: a.Ages, Prevalence: p})
@@ -1389,16 +1750,19 @@ func fillConditionalPrevalences(c1 QOFCondition, c2 QOFCondition, population []P
 	}
 	prevalences[givenC2Present.Conditions] = givenC2Present
 	prevalences[givenC2Absent.Conditions] = givenC2Absent
+	if derived != nil {
+		prevalences[derived.Conditions] = *derived
+	}
 }
 
-func estimateGPPracticeConditionBias(population map[GPPracticeCode][]*Person, condition QOFCondition, prevalence Prevalences, gps map[GPPracticeCode]*GPPractice) {
+func estimateGPPracticeConditionBias(population map[GPPracticeCode][]*Person, condition QOFCondition, prevalence Prevalences, gps map[GPPracticeCode]*GPPractice, risks *RiskFactors) {
 	for code, people := range population {
 		gp := gps[code]
 		gp.ConditionBias[condition] = 1.0
 		if gp.ConditionPrevalence[condition] > 0.0 {
 			expected := 0.0
 			for _, p := range people {
-				expected += prevalence.Prevalence(p.Sex, p.Age)
+				expected += prevalence.Prevalence(p.Sex, p.Age) * risks.Risk(p, condition)
 			}
 			if expected > 0.0 {
 				gp.ConditionBias[condition] = (float64(len(people)) * gp.ConditionPrevalence[condition]) / float64(expected)
@@ -1407,113 +1771,138 @@ func estimateGPPracticeConditionBias(population map[GPPracticeCode][]*Person, co
 	}
 }
 
-func assignConditions(population map[GPPracticeCode][]*Person, conditions []QOFCondition, prevalences AllPrevalences, gps map[GPPracticeCode]*GPPractice) {
-	shuffled := make([]QOFCondition, len(conditions))
-	for i, condition := range conditions {
-		shuffled[i] = condition
-	}
-	swap := func(i int, j int) {
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+// assignConditions assigns conditions to the people registered with each
+// practice using model, recording the decisions for people in audits.
+func assignConditions(population map[GPPracticeCode][]*Person, conditions []QOFCondition, model ConditionModel, gps map[GPPracticeCode]*GPPractice, audits Audits, progress Progress) {
+	total := 0
+	for _, people := range population {
+		total += len(people)
 	}
+	progress.Start("assign conditions", total)
+	defer progress.Done()
+	rng := rand.New(rand.NewSource(rand.Int63()))
 	for code, people := range population {
 		gp := gps[code]
+		calibrateConditionModel(model, gp, people)
 		for _, p := range people {
-			rand.Shuffle(len(shuffled), swap)
-			if rand.Float64() < (prevalences[OneCondition(shuffled[0])].Prevalence(p.Sex, p.Age) * gp.ConditionBias[shuffled[0]]) {
-				p.Conditions.Add(shuffled[0])
-			}
-			for i := 1; i < len(shuffled); i++ {
-				var d DiagonosisGiven
-				if p.Conditions.Contains(shuffled[i-1]) {
-					d = OneConditionGivenOtherPresent(shuffled[i], shuffled[i-1])
-				} else {
-					d = OneConditionGivenOtherAbsent(shuffled[i], shuffled[i-1])
-				}
-				if conditional, ok := prevalences[d]; ok {
-					if rand.Float64() < (conditional.Prevalence(p.Sex, p.Age) * gp.ConditionBias[shuffled[i]]) {
-						p.Conditions.Add(shuffled[i])
-					}
-				} else {
-					panic(fmt.Sprintf("no conditional prevalences for %s", d))
-				}
-			}
+			model.Assign(p, gp, rng, audits.Conditions(p))
 			for _, condition := range conditions {
 				if p.Conditions.Contains(condition) {
 					gp.SimulatedConditionCounts[condition]++
 				}
 			}
 		}
+		progress.Add(len(people))
+	}
+}
+
+// readGPPracticesCached returns the practices read from the gp-practices
+// dataset, geocoded using the world, reusing the cached result when neither
+// has changed.
+func readGPPracticesCached(cache *Cache, data DataManifest, worlds []string, world b6.World) (map[GPPracticeCode]*GPPractice, *CacheKey, error) {
+	key := gpPracticesCacheKey(cache, data, worlds)
+	var gps map[GPPracticeCode]*GPPractice
+	_, err := cache.Stage(key, &gps, func() error {
+		var err error
+		gps, err = readGPPractices(data.Get(DatasetGPPractices), postcodeSources(data), world)
+		return err
+	})
+	// Practices read from the cache weren't located in this process, so
+	// their fallbacks are recorded from how they were located
+	for code, gp := range gps {
+		if gp.Geocoded != GeocodeWorld {
+			recordGeocodeFallback(data.Get(DatasetGPPractices), &GeocodeFallback{Kind: "practice", Code: code.String(), Postcode: gp.Postcode, Method: gp.Geocoded})
+		}
+	}
+	return gps, key, err
+}
+
+// buildNearbyGPsCached returns the practices near each LSOA, within the
+// largest search radius of the rurality model, reusing the cached result
+// when the practices and radius are unchanged.
+func buildNearbyGPsCached(cache *Cache, practices *CacheKey, gps map[GPPracticeCode]*GPPractice, rurality *RuralityModel, parameters SimulationParameters, world b6.World, progress Progress) (NearbyGPs, *CacheKey, error) {
+	radius := rurality.SearchRadiusM(parameters)
+	key := nearbyGPsCacheKey(cache, practices, radius)
+	var nearbyGPs NearbyGPs
+	_, err := cache.Stage(key, &nearbyGPs, func() error {
+		var err error
+		nearbyGPs, err = buildNearbyGPs(gps, b6.MetersToAngle(radius), world, runtime.NumCPU(), progress)
+		return err
+	})
+	if err == nil {
+		log.Printf("  %d lsoas with nearby practices", len(nearbyGPs))
 	}
+	return nearbyGPs, key, err
 }
 
-func writeNearbyGPPractices(world b6.World, cachedDirectory string) error {
+// writeNearbyGPPractices builds the nearby practices lookup in the cache,
+// if needed, and additionally writes it to nearby-gps-<scope>.csv, for use
+// outside the pipeline, named by the scope of its cache key so that lookups
+// for different worlds and radii don't replace each other. Travel times are
+// estimated from distances with the given assumptions, and aren't cached,
+// so that changing the assumptions doesn't rebuild the lookup.
+func writeNearbyGPPractices(world b6.World, data DataManifest, cache *Cache, worlds []string, rurality *RuralityModel, parameters SimulationParameters, travel *TravelAssumptions, progress Progress) error {
 	log.Printf("build nearby GPs")
 
-	gps, err := readGPPractices(world)
+	gps, practices, err := readGPPracticesCached(cache, data, worlds, world)
 	if err != nil {
 		return err
 	}
 
-	nearbyGPs, err := buildNearbyGPs(gps, b6.MetersToAngle(GPLSOANearbyRadiusM), world, runtime.NumCPU())
+	nearbyGPs, nearbyKey, err := buildNearbyGPsCached(cache, practices, gps, rurality, parameters, world, progress)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(filepath.Join(cachedDirectory, "nearby-gps.csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	nearbyGPs.AddTravelMinutes(travel)
+	lsoas := make([]LSOACode, 0, len(nearbyGPs))
+	for lsoa := range nearbyGPs {
+		lsoas = append(lsoas, lsoa)
+	}
+	sort.Slice(lsoas, func(i, j int) bool { return lsoas[i] < lsoas[j] })
+
+	filename := nearbyKey.Filename("nearby-gps", ".csv")
+	log.Printf("  write %s", filename)
+	// Written to a temporary file, then renamed, since concurrent runs with
+	// the same scope write the same file
+	f, err := os.CreateTemp(cache.Directory, filepath.Base(filename)+".*.tmp")
 	if err != nil {
 		return err
 	}
 	w := csv.NewWriter(f)
-	for lsoa, gps := range nearbyGPs {
-		for _, gp := range gps {
-			if err := w.Write([]string{lsoa.String(), gp.String()}); err != nil {
+	w.Write([]string{"lsoa_code", "practice_code", "distance_m", "travel_minutes"})
+	for _, lsoa := range lsoas {
+		for _, gp := range nearbyGPs[lsoa] {
+			row := []string{lsoa.String(), gp.Practice.String(), fmt.Sprintf("%.0f", gp.DistanceM), fmt.Sprintf("%.1f", gp.TravelMinutes)}
+			if err := w.Write(row); err != nil {
+				f.Close()
+				os.Remove(f.Name())
 				return err
 			}
 		}
 	}
 	w.Flush()
-	return f.Close()
-}
-
-func readNearbyGPPracticess(cachedDirectory string) (map[LSOACode][]GPPracticeCode, error) {
-	log.Printf("read: nearby practices")
-	f, err := os.Open(filepath.Join(cachedDirectory, "nearby-gps.csv"))
-	if err != nil {
-		return nil, err
+	if err := w.Error(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
 	}
-	defer f.Close()
-	nearbyGPs := make(map[LSOACode][]GPPracticeCode)
-	r := csv.NewReader(f)
-	for {
-		row, err := r.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		lsoa := LSOACode(row[0])
-		gp := GPPracticeCode(row[1])
-		nearbyGPs[lsoa] = append(nearbyGPs[lsoa], gp)
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
 	}
-	log.Printf("  %d lsoas", len(nearbyGPs))
-	return nearbyGPs, nil
-}
-
-func fillCatchmentLSOA(selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, w b6.World, lsoas LSOASet) {
-	r := b6.MetersToAngle(GPLSOANearbyRadiusM)
-	for code := range selected {
-		cap := s2.CapFromCenterAngle(gps[code].Location, r)
-		nearby := w.FindFeatures(b6.Intersection{b6.NewIntersectsCap(cap), b6.Tagged{Key: "#boundary", Value: "lsoa"}})
-		for nearby.Next() {
-			lsoa := LSOACode(nearby.Feature().Get("code").Value)
-			lsoas[lsoa] = struct{}{}
-		}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
 	}
+	return os.Rename(f.Name(), filename)
 }
 
 type Source struct {
-	GPs   map[GPPracticeCode]*GPPractice
-	Sites map[ODSCode]*Site
+	GPs        map[GPPracticeCode]*GPPractice
+	Sites      map[ODSCode]*Site
+	Pharmacies map[ODSCode]*Pharmacy
+	Boundaries *Dataset
 }
 
 func toTagValue(v string) string {
@@ -1568,13 +1957,26 @@ func (s *Source) Read(options ingest.ReadOptions, emit ingest.Emit, ctx context.
 		}
 	}
 
+	point.Tags[0].Value = "pharmacy"
+	for code, pharmacy := range s.Pharmacies {
+		point.PointID.Value = compact.HashString(string(code))
+		point.Location = s2.LatLngFromPoint(pharmacy.Location)
+		point.Tags = point.Tags[0:1] // Keep #nhs=pharmacy
+		point.Tags = append(point.Tags, b6.Tag{Key: "code", Value: strings.ToLower(string(code))})
+		point.Tags = append(point.Tags, b6.Tag{Key: "name", Value: strings.Title(strings.ToLower(pharmacy.Name))})
+		point.Tags = append(point.Tags, b6.Tag{Key: "addr:postcode", Value: pharmacy.Postcode})
+		if err := emit(&point, 0); err != nil {
+			return err
+		}
+	}
+
 	boundaries := gdal.Source{
-		Filename:   "/vsizip/data/icb-boundaries.zip",
+		Filename:   "/vsizip/" + s.Boundaries.Filename,
 		Namespace:  b6.NamespaceUKONSBoundaries,
-		IDField:    "ICB22CD",
+		IDField:    s.Boundaries.Column("code"),
 		IDStrategy: gdal.UKONS2022IDStrategy,
 		Bounds:     s2.FullRect(),
-		CopyTags:   []gdal.CopyTag{{Key: "name", Field: "ICB22NM"}},
+		CopyTags:   []gdal.CopyTag{{Key: "name", Field: s.Boundaries.Column("name")}},
 		AddTags:    []b6.Tag{{Key: "#boundary", Value: "nhs_icb"}, {Key: "#nhs", Value: "icb"}},
 	}
 	return boundaries.Read(options, emit, ctx)
@@ -1588,23 +1990,27 @@ type Site struct {
 	Postcode string
 	Location s2.Point
 	Type     string
-}
-
-func readSites(w b6.World) (map[ODSCode]*Site, error) {
-	f, err := os.Open("data/ets.csv.gz")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+	// True if the site was found in the estates return, from which the
+	// type, and the capacity below, are read
+	Estates bool
+	// Gross internal floor area, in square metres
+	FloorAreaM2 float64
+	// Single bedrooms for patients, with or without en-suite facilities
+	SingleBedrooms int
+	// Beds and operating theatres, 0 unless the estates dataset maps
+	// columns for them, since ERIC doesn't report them by site
+	Beds     int
+	Theatres int
+}
+
+func readSites(dataset *Dataset, postcodes PostcodeSources, w b6.World) (map[ODSCode]*Site, error) {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return nil, err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
-	missingLocations := 0
+	locator := newPostcodeLocator(worldPostcodes(w), "site", dataset)
 	sites := make(map[ODSCode]*Site)
 	for {
 		row, err := r.Read()
@@ -1613,39 +2019,33 @@ func readSites(w b6.World) (map[ODSCode]*Site, error) {
 		} else if err != nil {
 			return nil, err
 		}
-		var location s2.Point
-		postcode := row[TrustSitePostcodeColumn]
-		if p := b6.FindPointByID(b6.PointIDFromGBPostcode(postcode), w); p != nil {
-			location = p.Point()
-		} else {
-			missingLocations++
+		if err := dataset.CheckIndices(row, "code", "name", "address-one", "postcode"); err != nil {
+			return nil, err
 		}
-		code := ODSCode(row[TrustSiteCodeColumn])
-		sites[code] = &Site{
-			Name:     row[TrustSiteNameColumn],
-			Address:  strings.Title(strings.ToLower(row[TrustSiteAddressOneColumn])),
-			Postcode: row[TrustSitePostcodeColumn],
-			Location: location,
+		code := ODSCode(row[dataset.Index("code")])
+		site := &Site{
+			Name:     row[dataset.Index("name")],
+			Address:  strings.Title(strings.ToLower(row[dataset.Index("address-one")])),
+			Postcode: row[dataset.Index("postcode")],
 		}
+		sites[code] = site
+		locator.Locate(string(code), site.Postcode, func(p s2.Point) { site.Location = p })
+	}
+	if err := locator.Finish(postcodes); err != nil {
+		return nil, err
 	}
+	countMissingPostcodes(dataset, locator.Missing)
 	log.Printf("sites: %d", len(sites))
-	log.Printf("  missing locations: %d", missingLocations)
+	locator.Log()
 	return sites, nil
 }
 
-func readEstates(sites map[ODSCode]*Site) error {
-	f, err := os.Open("data/eric.csv.gz")
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	g, err := gzip.NewReader(f)
+func readEstates(sites map[ODSCode]*Site, dataset *Dataset) error {
+	r, err := openDataset(dataset)
 	if err != nil {
 		return err
 	}
-
-	r := csv.NewReader(g)
+	defer r.Close()
 	r.Comment = '#'
 	columns := make(map[string]int)
 	row, err := r.Read()
@@ -1655,6 +2055,9 @@ func readEstates(sites map[ODSCode]*Site) error {
 	for i, column := range row {
 		columns[column] = i
 	}
+	if err := dataset.CheckColumns(columns, "site-code", "site-type"); err != nil {
+		return err
+	}
 
 	n := 0
 	missingSites := 0
@@ -1666,8 +2069,13 @@ func readEstates(sites map[ODSCode]*Site) error {
 		} else if err != nil {
 			return err
 		}
-		if site, ok := sites[ODSCode(row[columns[EstatesSiteCodeColumn]])]; ok {
-			site.Type = row[columns[EstatesSiteTypeColumn]]
+		if site, ok := sites[ODSCode(row[columns[dataset.Column("site-code")]])]; ok {
+			site.Estates = true
+			site.Type = row[columns[dataset.Column("site-type")]]
+			site.FloorAreaM2 = estatesValue(row, columns, dataset, "floor-area")
+			site.SingleBedrooms = int(estatesValue(row, columns, dataset, "en-suite-bedrooms") + estatesValue(row, columns, dataset, "without-en-suite-bedrooms"))
+			site.Beds = int(estatesValue(row, columns, dataset, "beds"))
+			site.Theatres = int(estatesValue(row, columns, dataset, "theatres"))
 		} else {
 			missingSites++
 		}
@@ -1677,21 +2085,48 @@ func readEstates(sites map[ODSCode]*Site) error {
 	return nil
 }
 
-func writeFeatures(world b6.World) error {
-	log.Printf("write features")
-	var err error
-	var source Source
-	source.GPs, err = readGPPractices(world)
-	if err != nil {
-		return err
+// estatesValue returns the value of a numeric column of an estates
+// return, which are formatted with thousands separators, or 0 if the
+// column isn't mapped, or isn't applicable to the site.
+func estatesValue(row []string, columns map[string]int, dataset *Dataset, column string) float64 {
+	header := dataset.Column(column)
+	if header == "" {
+		return 0.0
+	}
+	i, ok := columns[header]
+	if !ok || i >= len(row) {
+		return 0.0
 	}
-	source.Sites, err = readSites(world)
+	v, err := strconv.ParseFloat(strings.ReplaceAll(row[i], ",", ""), 64)
+	if err != nil {
+		return 0.0
+	}
+	return v
+}
+
+func writeFeatures(world b6.World, data DataManifest) error {
+	log.Printf("write features")
+	var err error
+	source := Source{Boundaries: data.Get(DatasetICBBoundaries)}
+	source.GPs, err = readGPPractices(data.Get(DatasetGPPractices), postcodeSources(data), world)
 	if err != nil {
 		return err
 	}
-	if err := readEstates(source.Sites); err != nil {
+	source.Sites, err = readSites(data.Get(DatasetTrustSites), postcodeSources(data), world)
+	if err != nil {
 		return err
 	}
+	if err := readEstates(source.Sites, data.Get(DatasetEstates)); err != nil {
+		return err
+	}
+	if fileExists(data.Get(DatasetPharmacies).Filename) {
+		source.Pharmacies, err = readPharmacies(data.Get(DatasetPharmacies), postcodeSources(data), world)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Printf("  no pharmacies in %s", data.Get(DatasetPharmacies).Filename)
+	}
 
 	config := compact.Options{
 		OutputFilename:       "nhs.index",
@@ -1720,86 +2155,120 @@ type BreakdownJSON struct {
 
 type Breakdowns []BreakdownJSON
 
+// SexJSON gives the counts of each combination of conditions by single
+// year of age, as ByAgeThenCondition, for people of one sex.
+type SexJSON struct {
+	Sex                string
+	ByAgeThenCondition [][]int
+}
+
 type PopulationJSON struct {
+	// The rule for which people entered the aggregates, and the number of
+	// people included, and excluded, by it
+	Population             string
+	Included               int
+	Excluded               int
 	TotalListSize          int
 	TotalSimulatedListSize int
 	Conditions             []string
 	Breakdowns             Breakdowns
 	ByAgeThenCondition     [][]int
+	// ByAgeThenCondition for each sex simulated, in order
+	BySexThenAgeThenCondition []SexJSON
+}
+
+// aggregatePopulation computes the breakdowns used by population.json and
+// aggregates.csv, for people entering the given population of the ICB.
+func aggregatePopulation(population AggregatePopulation, people []Person, homes LSOASet, practices GPPracticeCodeSet, lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, gps map[GPPracticeCode]*GPPractice, bands *AgeBands, benefits *BenefitModel, employment bool) *AggregationResult {
+	// People of this age and over are together in the single year breakdowns
+	const topAge = 99
+	singleYear := SingleYearAgeBands(topAge)
+	sexes := sexesOf(people)
+	var filter Filter
+	switch population {
+	case AggregatePopulationRegistered:
+		filter = FilterRegisteredWith(practices)
+	case AggregatePopulationResident:
+		filter = FilterResidentIn(homes)
+	}
+	aggregation := Aggregation{
+		Filter: filter,
+		GroupBy: []*GroupBy{
+			GroupByAll(),
+			GroupByPracticeMSOA(lsoas, msoas, gps),
+			GroupByAgeBands("age", bands),
+			GroupBySex(sexes),
+			GroupByIMDDecile(lsoas),
+			GroupByAgeBands("single_year_age", singleYear),
+			GroupBySexThenAgeBand("sex_single_year_age", sexes, singleYear),
+			GroupByRurality(lsoas),
+		},
+		Measure: MeasureConditions,
+	}
+	if benefits != nil {
+		for _, b := range benefits.Modelled() {
+			aggregation.GroupBy = append(aggregation.GroupBy, GroupByBenefit(b, benefits))
+		}
+	}
+	if employment {
+		aggregation.GroupBy = append(aggregation.GroupBy, GroupByEconomicActivity(), GroupByOccupation())
+	}
+	result := aggregation.Run(people)
+	result.Population = population
+	log.Printf("aggregate %s: included: %d excluded: %d", population, result.Included, result.Excluded)
+	log.Printf("  skipped: no msoa: %d", result.Get("msoa").Skipped)
+	return result
 }
 
-func toJSON(people []Person, lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, gps map[GPPracticeCode]*GPPractice) *PopulationJSON {
-	const maxAge = 100
+func toJSON(result *AggregationResult, practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice) *PopulationJSON {
 	output := &PopulationJSON{
-		Conditions:         make([]string, len(AllQOFConditions())),
-		ByAgeThenCondition: aggregateByAgeThenCondition(people, maxAge, gps),
-	}
-	all := BreakdownJSON{Key: "all", ByValue: []CountJSON{{Value: "all", Counts: make([]int, QOFConditionsMaxUint32+1)}}}
-	byMSOA := make(map[MSOACode]*CountJSON)
-	byAge := make(CountJSONs, maxAge/10)
-	for i := range byAge {
-		byAge[i].Value = fmt.Sprintf("%d", i*10)
-		byAge[i].Counts = make([]int, QOFConditionsMaxUint32+1)
-	}
-	byIMDDecile := make(CountJSONs, 10)
-	for i := range byIMDDecile {
-		byIMDDecile[i].Value = fmt.Sprintf("%d", i+1)
-		byIMDDecile[i].Counts = make([]int, QOFConditionsMaxUint32+1)
-	}
-	byIMDDecile[0].Value = "1 (most deprived 10%)"
-	byIMDDecile[9].Value = "10 (least deprived 10%)"
-	skippedNoMSOA := 0
-	icbPeopleByGP := make(map[GPPracticeCode]int)
-	for _, p := range people {
-		if gps[p.GP].ICB != NorthCentralLondonICBCode {
-			continue
-		}
-		icbPeopleByGP[p.GP]++
-		all.ByValue[0].Counts[p.Conditions.ToUint32()]++
-		if msoa, ok := msoas[lsoas[gps[p.GP].LSOA].MSOACode]; ok {
-			b, ok := byMSOA[msoa.Code]
-			if !ok {
-				b = &CountJSON{Value: msoa.Name, Counts: make([]int, QOFConditionsMaxUint32+1)}
-				byMSOA[msoa.Code] = b
-			}
-			b.Counts[p.Conditions.ToUint32()]++
-		} else {
-			skippedNoMSOA++
-		}
-		if a := p.Age / 10; a < len(byAge) {
-			byAge[a].Counts[p.Conditions.ToUint32()]++
-		} else {
-			byAge[len(byAge)-1].Counts[p.Conditions.ToUint32()]++
-		}
-		byIMDDecile[lsoas[p.Home].IMDDecile-1].Counts[p.Conditions.ToUint32()]++
+		Population: result.Population.String(),
+		Included:   result.Included,
+		Excluded:   result.Excluded,
+		Conditions: make([]string, len(AllQOFConditions())),
 	}
-	log.Printf("skipped: no msoa: %d", skippedNoMSOA)
 	for i, condition := range AllQOFConditions() {
 		output.Conditions[i] = condition.String()
 	}
-	output.Breakdowns = append(output.Breakdowns, all)
-	msoaBreakdown := BreakdownJSON{
-		Key:     "msoa",
-		ByValue: make(CountJSONs, 0, len(byMSOA)),
+	for _, key := range []string{"all", "msoa", "age", "sex", "imd"} {
+		breakdown := BreakdownJSON{Key: key}
+		for _, g := range result.Get(key).Groups {
+			breakdown.ByValue = append(breakdown.ByValue, CountJSON{Value: g.Value, Counts: g.Counts})
+		}
+		output.Breakdowns = append(output.Breakdowns, breakdown)
+	}
+	imd := output.Breakdowns[len(output.Breakdowns)-1].ByValue
+	imd[0].Value = "1 (most deprived 10%)"
+	imd[len(imd)-1].Value = "10 (least deprived 10%)"
+	keys := make([]string, 0, BenefitCount+2)
+	for b := Benefit(0); b < BenefitCount; b++ {
+		keys = append(keys, fmt.Sprintf("benefit_%s", b))
+	}
+	for _, key := range append(keys, "economic_activity", "occupation") {
+		if a := result.Get(key); a != nil {
+			breakdown := BreakdownJSON{Key: a.Key}
+			for _, g := range a.Groups {
+				breakdown.ByValue = append(breakdown.ByValue, CountJSON{Value: g.Value, Counts: g.Counts})
+			}
+			output.Breakdowns = append(output.Breakdowns, breakdown)
+		}
 	}
-	for _, b := range byMSOA {
-		msoaBreakdown.ByValue = append(msoaBreakdown.ByValue, *b)
+	for _, g := range result.Get("single_year_age").Groups {
+		output.ByAgeThenCondition = append(output.ByAgeThenCondition, g.Counts)
 	}
-	sort.Sort(msoaBreakdown.ByValue)
-	output.Breakdowns = append(output.Breakdowns, msoaBreakdown)
-	output.Breakdowns = append(output.Breakdowns, BreakdownJSON{
-		Key:     "age",
-		ByValue: byAge,
-	})
-	output.Breakdowns = append(output.Breakdowns, BreakdownJSON{
-		Key:     "imd",
-		ByValue: byIMDDecile,
-	})
-
-	for _, gp := range gps {
-		if gp.ICB != NorthCentralLondonICBCode {
-			continue
+	groups := result.Get("sex_single_year_age").Groups
+	for _, sex := range result.Get("sex").Groups {
+		bySex := SexJSON{Sex: sex.Value}
+		for _, g := range groups {
+			if s, _, _ := strings.Cut(g.Value, ":"); s == sex.Value {
+				bySex.ByAgeThenCondition = append(bySex.ByAgeThenCondition, g.Counts)
+			}
 		}
+		output.BySexThenAgeThenCondition = append(output.BySexThenAgeThenCondition, bySex)
+	}
+
+	for code := range practices {
+		gp := gps[code]
 		output.TotalListSize += gp.ListSize
 		output.TotalSimulatedListSize += gp.SimulatedListSize
 	}
@@ -1836,79 +2305,707 @@ func medianAge(people []*Person) int {
 	return 0
 }
 
-func aggregateByAgeThenCondition(people []Person, maxAge int, gps map[GPPracticeCode]*GPPractice) [][]int {
-	ageThenCondition := make([][]int, maxAge)
-	for i := range ageThenCondition {
-		ageThenCondition[i] = make([]int, QOFConditionsMaxUint32+1)
+type PopulationOptions struct {
+	// Cache of the output of expensive stages, reused when their inputs
+	// are unchanged
+	Cache *Cache
+	// The files from which the world was read, forming part of the inputs
+	// of cached stages that use it
+	WorldFilenames  []string
+	OutputDirectory string
+	// If true, additionally write condition counts by LSOA and MSOA as
+	// GeoJSON
+	GeoJSON bool
+	// The formats in which people, practices and aggregates are written
+	Formats []*ExportFormat
+	// If true, start each CSV output with lines beginning with #, marking
+	// it as synthetic, and crediting its sources
+	CSVProvenance bool
+	// Assumptions used to estimate patient travel to practices
+	TravelAssumptionsFilename string
+	// The name of the scenario being simulated, included in outputs
+	// that are compared between runs
+	Scenario string
+	// If set, a YAML file describing changes to simulate against the
+	// baseline, whose name overrides Scenario
+	ScenarioFilename string
+	// The files, and their columns, from which input datasets are read
+	Data DataManifest
+	// The census year from which LSOA codes and boundaries are drawn
+	CensusYear int
+	// Monthly files from the English Prescribing Dataset, not read if
+	// empty
+	PrescribingFilenames []string
+	// The weight given to prescribing volume, rather than reported QOF
+	// prevalence, when estimating condition bias
+	PrescribingBiasWeight float64
+	// How practices whose reported QOF prevalence appears not to be
+	// reported correctly are adjusted
+	PrevalenceOutlier PrevalenceOutlierRule
+	// The rates used for people of the Other sex, where models don't
+	// give them
+	OtherSexPrevalence OtherSexPrevalence
+	// Patches to the prevalences read from PrevalencesFilename, applied
+	// before those of the scenario
+	PrevalenceOverrides PrevalenceOverrides
+	// Rates of hospital admission, used to estimate secondary care
+	// demand. Not estimated if empty.
+	AdmissionsFilename string
+	// If true, assign each person a valid NHS number from the range
+	// reserved for testing
+	NHSNumbers bool
+	// If set, assign each person a fake name from this file, and a date
+	// of birth, for use as test data
+	NamesFilename string
+	// Controls which columns, identifiers and geographies are emitted
+	Profile *OutputProfile
+	// The maximum number of outputs written concurrently
+	ExportWriters int
+	// If set, the database written by the sqlite format, rather than
+	// SQLiteDefaultFilename in the output directory
+	SQLiteFilename string
+	// The rules for which people enter aggregates, each reported
+	// separately. population.json uses the first.
+	AggregatePopulations []AggregatePopulation
+	// How the conditions of each person are written
+	ConditionEncoding ConditionEncoding
+	// How the point at which each person lives within their home LSOA is
+	// sampled, if at all
+	HomePoints HomePoints
+	// The number of residents, sampled at random, for whom the reasons for
+	// their practice and each condition are written to audit.json, or 0
+	AuditSample int
+	// Reports completion of long running stages
+	Progress Progress
+	// The ICB or borough whose population is simulated
+	Scope Scope
+	// If there's more than one, simulate the population of each, reading
+	// the inputs that don't depend on the scope once. Scope is the first.
+	Scopes []Scope
+	// Decides which LSOAs outside the ICB people are also drawn from
+	Buffer BufferOptions
+	// If set, sample the age at onset of each condition from this
+	// incidence model
+	IncidenceFilename string
+	// If set, assign complications to people with a condition, from the
+	// years since their diagnosis, using this model, which needs
+	// IncidenceFilename
+	ComplicationsFilename string
+	// If set, estimate the people living with a condition undiagnosed, and
+	// the detection gap of each practice, using this model
+	DetectionFilename string
+	// If set, estimate the backlog of a diagnostic service, like
+	// spirometry, for people with a condition at each practice, using this
+	// model, counting new diagnoses with IncidenceFilename
+	BacklogFilename string
+	// If set, mark people with a condition as controlled, from the QOF
+	// achievement of their practice against the indicators in this model
+	ControlFilename string
+	// If positive, project the scope's residents forward this many years,
+	// with the mortality, fertility and migration of ProjectionFilename,
+	// and the incidence of IncidenceFilename
+	ProjectYears       int
+	ProjectionFilename string
+	// The conditions simulated, at any level of QOFConditionHierarchies.
+	// Sub-conditions refine a simulated parent, and parents of those
+	// simulated alone are reported as their roll up.
+	Conditions []QOFCondition
+	// Conditions assigned using small area estimation, rather than
+	// ConditionModel
+	SmallAreaConditions []QOFCondition
+	// If true, additionally write people and condition counts by home LSOA
+	// as a b6 compact index
+	PopulationFeatures bool
+	// If set, write surfaces of the demand given by this model for each
+	// condition, on a grid of cells DemandCellMeters wide
+	DemandFilename   string
+	DemandCellMeters float64
+	// If true, additionally write the simulated flows of patients from
+	// home LSOAs to ICB practices, as CSV and GeoJSON lines
+	Flows bool
+	// If true, additionally write the effective catchment of each ICB
+	// practice, the LSOAs contributing at least CatchmentMinShare of its
+	// simulated patients, as CSV, GeoJSON and a b6 compact index
+	Catchments        bool
+	CatchmentMinShare float64
+	// If true, additionally write the capacity of trust sites from their
+	// estates returns, and, with AdmissionsFilename, compare the capacity
+	// of admitting sites with the admission demand of ICB residents
+	Sites bool
+	// If true, place people aged 75 and over into CQC registered care
+	// homes, registering them with the practice serving the home
+	CareHomes bool
+	// If set, assign each person the nearest community pharmacy, and
+	// estimate the items each is expected to dispense using this model
+	DispensingFilename string
+	// If true, compare the simulated flows of patients from home LSOAs to
+	// practices with the published registrations by LSOA
+	FlowValidation bool
+	// If set, compare the age distribution of each condition's simulated
+	// register with the published distribution in this file
+	RegisterAgesFilename string
+	// The number of similar practices against which each ICB practice is
+	// compared, or 0 to skip the comparison
+	PeerGroupSize int
+	// If true, compare the ICB's practices with the distribution of
+	// practice level measures across England
+	NationalBenchmark bool
+	// The age bands used for the age breakdown of aggregates, and to
+	// compare input and simulated prevalence
+	AgeBands *AgeBands
+	// The name of the model used to assign conditions, one of
+	// ConditionModels
+	ConditionModel string
+	// Coefficients for the logistic condition model
+	LogisticCoefficientsFilename string
+	// The parameters of the assignment of people to GP practices, used
+	// where the rurality model doesn't override them
+	Parameters SimulationParameters
+	// If set, read the rural-urban classification of LSOAs, and use
+	// these GP practice assignment parameters for urban and rural LSOAs
+	Rurality *RuralityModel
+	// If set, assign each person a smoking status using this model, which
+	// also gives the relative risk of conditions given smoking status
+	SmokingFilename string
+	// If set, the reported prevalence of current smoking by practice, to
+	// which simulated smoking status is matched
+	PracticeSmokingFilename string
+	// If set, assign each adult a BMI using this model, which also gives
+	// the relative risk of conditions for those who are obese
+	BMIFilename string
+	// If set, sample clinical measurements for people with conditions
+	// using this model, and write the achievement of each ICB practice
+	// against its QOF indicators
+	MeasurementsFilename string
+	// If set, place each person into a population health segment, using
+	// this model for frailty and end of life, and write the number of
+	// people in each segment by practice and borough
+	SegmentsFilename string
+	// If set, assign each person the DWP benefits they claim, from the
+	// claimants in their home LSOA, using this model for who claims them
+	BenefitsFilename string
+	// If set, assign each adult an economic activity status and
+	// occupation class, from the census counts of their home LSOA, using
+	// this model for who has each
+	EmploymentFilename string
+	// If true, with SegmentsFilename, also read the PCN of each practice,
+	// and write segments by PCN
+	PCNs bool
+	// If set, attach the unit costs in this model to simulated activity,
+	// and write indicative spend by practice, condition and borough
+	CostsFilename string
+	// If positive, reweight the LSOA counts of the census snapshot to the
+	// mid-year estimates of this year, by local authority, age and sex
+	TargetYear int
+	// If true, with TargetYear, also reweight to the estimated total of
+	// each LSOA
+	TargetLSOATotals bool
+	// If given, after simulation, calibrate a weight for each person to
+	// match the external totals of these margins
+	ReweightMargins []ReweightMargin
+	// The year of the mid-year estimates used as borough controls
+	ReweightYear int
+	// How people are assigned to practices
+	Assignment AssignmentMode
+	// If positive, the number of times the assignment of people to ICB
+	// practices is reweighted to match their published registrations by
+	// age and sex
+	RegistrationCalibrationIterations int
+	// If true, reassign people between practices inside and outside the
+	// scope, so that the share of each home LSOA's patients registered
+	// outside it matches published registrations by LSOA
+	CrossBorderCalibration bool
+	// If true, log the time and memory used by each stage as it completes,
+	// as well as recording them in the manifest
+	LogTimings bool
+}
+
+func writePopulation(world b6.World, allPrevalences AllPrevalences, options *PopulationOptions) error {
+	if err := options.Profile.Check(options); err != nil {
+		return err
 	}
-	for _, p := range people {
-		if gps[p.GP].ICB != NorthCentralLondonICBCode {
-			continue
+	lock, err := LockDirectory(options.OutputDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	timings := NewTimings(options.LogTimings)
+	timings.Start("read")
+	inputs, err := readPopulationInputs(world, allPrevalences, options, []Scope{options.Scope})
+	if err != nil {
+		return err
+	}
+	return simulateScope(world, inputs, options, timings)
+}
+
+// populationInputs are the inputs of a simulation that don't depend on its
+// scope, like national practice and LSOA data, and the models read, so
+// that they can be read once for many scopes.
+type populationInputs struct {
+	travel        *TravelAssumptions
+	admissions    *AdmissionModel
+	smoking       *SmokingModel
+	bmi           *BMIModel
+	measurements  *MeasurementModel
+	segments      *SegmentModel
+	pcns          map[GPPracticeCode]*PCN
+	benefits      *BenefitModel
+	employment    *EmploymentModel
+	costs         *CostModel
+	incidence     *IncidenceModel
+	complications *ComplicationModel
+	detection     *DetectionModel
+	control       *ControlModel
+	backlog       *ServiceModel
+	registerAges  map[QOFCondition][]PublishedRegisterAgeBand
+	projection    *ProjectionModel
+	demand        DemandModel
+	dispensing    DemandModel
+	pharmacies    map[ODSCode]*Pharmacy
+	// What was read from each dataset
+	reads                 *DatasetReads
+	names                 *Names
+	scenario              *Scenario
+	overrides             PrevalenceOverrides
+	allPrevalences        AllPrevalences
+	geography             *CensusGeography
+	icbs                  map[ICBCode]*ICB
+	boroughs              map[LSOACode]*LocalAuthority
+	lsoasKey              *CacheKey
+	lsoas                 map[LSOACode]*LSOA
+	msoas                 map[MSOACode]*MSOA
+	gps                   map[GPPracticeCode]*GPPractice
+	practicesKey          *CacheKey
+	nearbyGPs             NearbyGPs
+	nearbyKey             *CacheKey
+	conditions            []QOFCondition
+	reported              []QOFCondition
+	modelled              []QOFCondition
+	refined               []QOFCondition
+	prevalenceRead        *PrevalenceRead
+	prevalenceAdjustments []PrevalenceAdjustment
+}
+
+// anyBorough returns true if any of scopes is a borough
+func anyBorough(scopes []Scope) bool {
+	for _, scope := range scopes {
+		if scope.Kind == ScopeKindBorough {
+			return true
+		}
+	}
+	return false
+}
+
+// readPopulationInputs reads the inputs needed to simulate the population
+// of each of scopes with options.
+func readPopulationInputs(world b6.World, allPrevalences AllPrevalences, options *PopulationOptions, scopes []Scope) (*populationInputs, error) {
+	var err error
+	// Counted separately from the reads of each scope, which start from
+	// these
+	reads := newDatasetReads()
+	counted := *options
+	counted.Data = options.Data.WithReads(reads)
+	options = &counted
+	log.Printf("read:")
+	log.Printf("  travel assumptions")
+	travel, err := readTravelAssumptions(options.TravelAssumptionsFilename)
+	if err != nil {
+		return nil, err
+	}
+	var admissions *AdmissionModel
+	if options.AdmissionsFilename != "" {
+		log.Printf("  admission rates")
+		if admissions, err = readAdmissionModel(options.AdmissionsFilename); err != nil {
+			return nil, err
 		}
-		if p.Age < len(ageThenCondition) {
-			ageThenCondition[p.Age][p.Conditions.ToUint32()]++
-		} else {
-			ageThenCondition[len(ageThenCondition)-1][p.Conditions.ToUint32()]++
+	}
+	var smoking *SmokingModel
+	if options.SmokingFilename != "" {
+		log.Printf("  smoking")
+		if smoking, err = readSmokingModel(options.SmokingFilename); err != nil {
+			return nil, err
+		}
+	}
+	var bmi *BMIModel
+	if options.BMIFilename != "" {
+		log.Printf("  bmi")
+		if bmi, err = readBMIModel(options.BMIFilename); err != nil {
+			return nil, err
+		}
+	}
+	var measurements *MeasurementModel
+	if options.MeasurementsFilename != "" {
+		log.Printf("  measurements")
+		if measurements, err = readMeasurementModel(options.MeasurementsFilename); err != nil {
+			return nil, err
+		}
+	}
+	var segments *SegmentModel
+	var pcns map[GPPracticeCode]*PCN
+	if options.SegmentsFilename != "" {
+		log.Printf("  segments")
+		if segments, err = readSegmentModel(options.SegmentsFilename); err != nil {
+			return nil, err
+		}
+		if options.PCNs {
+			if pcns, err = readPracticePCNs(options.Data.Get(DatasetGPPracticePCNs)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var benefits *BenefitModel
+	if options.BenefitsFilename != "" {
+		log.Printf("  benefits")
+		if benefits, err = readBenefitModel(options.BenefitsFilename); err != nil {
+			return nil, err
+		}
+	}
+	var employment *EmploymentModel
+	if options.EmploymentFilename != "" {
+		log.Printf("  employment")
+		if employment, err = readEmploymentModel(options.EmploymentFilename); err != nil {
+			return nil, err
+		}
+	}
+	var costs *CostModel
+	if options.CostsFilename != "" {
+		log.Printf("  costs")
+		if costs, err = readCostModel(options.CostsFilename); err != nil {
+			return nil, err
+		}
+		if admissions == nil && (costs.unitCosts[ActivityElective] > 0.0 || costs.unitCosts[ActivityEmergency] > 0.0) {
+			Warningf("  admissions aren't simulated, so won't be costed")
+		}
+	}
+	var incidence *IncidenceModel
+	if options.IncidenceFilename != "" {
+		log.Printf("  incidence")
+		if incidence, err = readIncidenceModel(options.IncidenceFilename); err != nil {
+			return nil, err
+		}
+	}
+	var complications *ComplicationModel
+	if options.ComplicationsFilename != "" {
+		log.Printf("  complications")
+		if complications, err = readComplicationModel(options.ComplicationsFilename); err != nil {
+			return nil, err
+		}
+	}
+	var detection *DetectionModel
+	if options.DetectionFilename != "" {
+		log.Printf("  detection")
+		if detection, err = readDetectionModel(options.DetectionFilename); err != nil {
+			return nil, err
+		}
+	}
+	var control *ControlModel
+	if options.ControlFilename != "" {
+		log.Printf("  control")
+		if control, err = readControlModel(options.ControlFilename); err != nil {
+			return nil, err
+		}
+	}
+	var backlog *ServiceModel
+	if options.BacklogFilename != "" {
+		log.Printf("  backlog")
+		if backlog, err = readServiceModel(options.BacklogFilename); err != nil {
+			return nil, err
+		}
+	}
+	var registerAges map[QOFCondition][]PublishedRegisterAgeBand
+	if options.RegisterAgesFilename != "" {
+		log.Printf("  register ages")
+		if registerAges, err = readPublishedRegisterAges(options.RegisterAgesFilename); err != nil {
+			return nil, err
+		}
+	}
+	var projection *ProjectionModel
+	if options.ProjectYears > 0 {
+		log.Printf("  projection")
+		if projection, err = readProjectionModel(options.ProjectionFilename); err != nil {
+			return nil, err
+		}
+	}
+	var demand DemandModel
+	if options.DemandFilename != "" {
+		log.Printf("  demand")
+		if demand, err = readDemandModel(options.DemandFilename); err != nil {
+			return nil, err
+		}
+	}
+	var dispensing DemandModel
+	if options.DispensingFilename != "" {
+		log.Printf("  dispensing")
+		if dispensing, err = readDemandModel(options.DispensingFilename); err != nil {
+			return nil, err
+		}
+		// Prescribing is costed with the items dispensed by pharmacies, so
+		// that the two agree
+		if costs != nil && costs.dispensing != filepath.Clean(options.DispensingFilename) {
+			log.Printf("  costs: prescribing from %s, rather than %s", options.DispensingFilename, costs.dispensing)
+			costs.setDispensing(dispensing, options.DispensingFilename)
+		}
+	}
+	var pharmacies map[ODSCode]*Pharmacy
+	if dispensing != nil {
+		log.Printf("  pharmacies")
+		if pharmacies, err = readPharmacies(options.Data.Get(DatasetPharmacies), postcodeSources(options.Data), world); err != nil {
+			return nil, err
+		}
+	}
+	var names *Names
+	if options.NamesFilename != "" {
+		log.Printf("  names")
+		if names, err = readNames(options.NamesFilename); err != nil {
+			return nil, err
+		}
+	}
+	scenario := &Scenario{Name: options.Scenario}
+	if options.ScenarioFilename != "" {
+		log.Printf("  scenario")
+		if scenario, err = readScenario(options.ScenarioFilename); err != nil {
+			return nil, err
+		}
+		if !scenario.Budget.IsEmpty() && costs == nil {
+			return nil, fmt.Errorf("scenario %s: budget impact needs --costs", scenario.Name)
+		}
+	}
+	overrides := append(append(PrevalenceOverrides{}, options.PrevalenceOverrides...), scenario.Prevalences...)
+	if len(overrides) > 0 {
+		log.Printf("  prevalence overrides")
+		if allPrevalences, err = overrides.Apply(allPrevalences); err != nil {
+			return nil, err
+		}
+	}
+	// After overrides, so that pairs follow changes to their conditions
+	if allPrevalences, err = deriveRelativeRatePairs(allPrevalences); err != nil {
+		return nil, err
+	}
+
+	geography, err := censusGeographyForYear(options.CensusYear, options.Data)
+	if err != nil {
+		return nil, err
+	}
+	if names != nil {
+		if names.ethnicity, err = readLSOAEthnicGroups(options.Data.Get(DatasetLSOAEthnicity), names.Groups, geography); err != nil {
+			return nil, err
 		}
 	}
-	return ageThenCondition
-}
 
-func writePopulation(world b6.World, allPrevalences AllPrevalences, cachedDirectory string, outputDirectory string) error {
-	log.Printf("read:")
 	log.Printf("  icbs")
-	icbs, err := readICBs()
+	icbs, err := readICBs(options.Data.Get(DatasetLSOAICB), geography)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var boroughs map[LSOACode]*LocalAuthority
+	if segments != nil || costs != nil || options.TargetYear > 0 || anyBorough(scopes) || hasReweightMargin(options.ReweightMargins, ReweightMarginBoroughs) {
+		log.Printf("  boroughs")
+		if boroughs, err = readLocalAuthorities(options.Data.Get(DatasetLSOAICB), geography); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Printf("  lsoas")
-	lsoas, err := readLSOAs(world)
-	if err != nil {
+	lsoasKey := lsoasCacheKey(options.Cache, geography, options.WorldFilenames)
+	var lsoas map[LSOACode]*LSOA
+	if _, err := options.Cache.Stage(lsoasKey, &lsoas, func() error {
+		var err error
+		lsoas, err = readLSOAs(geography, world)
 		return err
+	}); err != nil {
+		return nil, err
 	}
-	msoas, err := fillMSOAs(lsoas)
+	msoas, err := fillMSOAs(lsoas, options.Data.Get(DatasetLSOAMSOA), geography)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := fillIMDs(lsoas); err != nil {
-		return err
+	if err := fillIMDs(lsoas, options.Data.Get(DatasetLSOAIMD), geography); err != nil {
+		return nil, err
+	}
+	if options.Rurality != nil {
+		if err := fillRuralUrban(lsoas, options.Data.Get(DatasetLSOARuralUrban), geography); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Printf("  gp practices")
-	gps, err := readGPPractices(world)
+	gps, practicesKey, err := readGPPracticesCached(options.Cache, options.Data, options.WorldFilenames, world)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	successors, err := readGPPracticeSuccessors(options.Data.Get(DatasetGPPracticeSuccessors))
+	if err != nil {
+		return nil, err
 	}
 
 	log.Printf("  lists sizes")
-	if err := readGPPracticeListSizes(gps); err != nil {
-		return err
+	if err := readGPPracticeListSizes(gps, successors, options.Data.Get(DatasetQOFListSizes)); err != nil {
+		return nil, err
 	}
 
 	log.Printf("  nearby gp practices")
-	nearbyGPs, err := readNearbyGPPracticess(cachedDirectory)
+	nearbyGPs, nearbyKey, err := buildNearbyGPsCached(options.Cache, practicesKey, gps, options.Rurality, options.Parameters, world, options.Progress)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("  condition prevalence")
-	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension, QOFConditionCOPD}
-	if err := readGPPracticeConditionPrevalence(gps, conditions); err != nil {
-		return err
+	conditions := options.Conditions
+	// Simulated conditions, together with the ancestors they roll up to
+	reported := withAncestors(conditions)
+	modelled, refined := splitSubConditions(conditions)
+	given := func(d DiagonosisGiven) bool {
+		_, ok := allPrevalences[d]
+		return ok
+	}
+	if missing := missingPrevalences(conditions, given); len(missing) > 0 {
+		return nil, fmt.Errorf("no prevalence for %s in %s", describePrevalence(missing[0]), PrevalencesFilename)
+	}
+	prevalenceRead, err := readGPPracticeConditionPrevalence(gps, successors, reported, options.Data)
+	if err != nil {
+		return nil, err
 	}
+	prevalenceAdjustments := adjustPrevalenceOutliers(gps, reported, options.PrevalenceOutlier)
 
 	log.Printf("  condition appointments")
-	if err := readGPAppointments(gps); err != nil {
-		return err
+	if err := readGPAppointments(gps, successors, options.Data.Get(DatasetGPAppointments)); err != nil {
+		return nil, err
 	}
 
 	log.Printf("  gp practioners")
-	if err := readGPPractioners(gps); err != nil {
-		return err
+	if err := readGPPractioners(gps, successors, options.Data.Get(DatasetGPPractioners)); err != nil {
+		return nil, err
+	}
+
+	if options.PracticeSmokingFilename != "" {
+		log.Printf("  practice smoking prevalence")
+		if err := readPracticeSmokingPrevalence(options.PracticeSmokingFilename, gps); err != nil {
+			return nil, err
+		}
+	}
+
+	if control != nil {
+		log.Printf("  qof achievement")
+		if err := readGPPracticeAchievement(gps, successors, control, options.Data.Get(DatasetQOFAchievement)); err != nil {
+			return nil, err
+		}
 	}
 
-	icb := icbs[NorthCentralLondonICBCode]
+	if len(options.PrescribingFilenames) > 0 {
+		log.Printf("  prescribing")
+		if err := readPrescribing(options.PrescribingFilenames, gps, successors); err != nil {
+			return nil, err
+		}
+	}
+
+	inputs := &populationInputs{
+		travel:                travel,
+		admissions:            admissions,
+		smoking:               smoking,
+		bmi:                   bmi,
+		measurements:          measurements,
+		segments:              segments,
+		pcns:                  pcns,
+		benefits:              benefits,
+		employment:            employment,
+		costs:                 costs,
+		incidence:             incidence,
+		complications:         complications,
+		detection:             detection,
+		control:               control,
+		backlog:               backlog,
+		registerAges:          registerAges,
+		projection:            projection,
+		demand:                demand,
+		dispensing:            dispensing,
+		pharmacies:            pharmacies,
+		reads:                 reads,
+		names:                 names,
+		scenario:              scenario,
+		overrides:             overrides,
+		allPrevalences:        allPrevalences,
+		geography:             geography,
+		icbs:                  icbs,
+		boroughs:              boroughs,
+		lsoasKey:              lsoasKey,
+		lsoas:                 lsoas,
+		msoas:                 msoas,
+		gps:                   gps,
+		practicesKey:          practicesKey,
+		nearbyGPs:             nearbyGPs,
+		nearbyKey:             nearbyKey,
+		conditions:            conditions,
+		reported:              reported,
+		modelled:              modelled,
+		refined:               refined,
+		prevalenceRead:        prevalenceRead,
+		prevalenceAdjustments: prevalenceAdjustments,
+	}
+	inputs.resolveOtherSex(options.OtherSexPrevalence)
+	return inputs, nil
+}
+
+// forScope returns inputs that can be used to simulate one scope, with
+// copies of the practices, LSOAs and nearby practices, which simulation
+// changes.
+func (in *populationInputs) forScope() *populationInputs {
+	scoped := *in
+	scoped.gps = make(map[GPPracticeCode]*GPPractice, len(in.gps))
+	for code, gp := range in.gps {
+		scoped.gps[code] = gp.clone()
+	}
+	scoped.lsoas = make(map[LSOACode]*LSOA, len(in.lsoas))
+	for code, lsoa := range in.lsoas {
+		scoped.lsoas[code] = lsoa.clone()
+	}
+	scoped.nearbyGPs = make(NearbyGPs, len(in.nearbyGPs))
+	for code, nearby := range in.nearbyGPs {
+		scoped.nearbyGPs[code] = append([]NearbyGP{}, nearby...)
+	}
+	scoped.reads = in.reads.clone()
+	if in.pharmacies != nil {
+		scoped.pharmacies = make(map[ODSCode]*Pharmacy, len(in.pharmacies))
+		for code, pharmacy := range in.pharmacies {
+			scoped.pharmacies[code] = &Pharmacy{Code: pharmacy.Code, Name: pharmacy.Name, Postcode: pharmacy.Postcode, Location: pharmacy.Location}
+		}
+	}
+	return &scoped
+}
+
+// simulateScope simulates the population of options.Scope from inputs,
+// writing outputs to options.OutputDirectory.
+func simulateScope(world b6.World, inputs *populationInputs, options *PopulationOptions, timings *Timings) error {
+	var err error
+	counted := *options
+	counted.Data = options.Data.WithReads(inputs.reads)
+	options = &counted
+	travel, admissions, smoking, bmi := inputs.travel, inputs.admissions, inputs.smoking, inputs.bmi
+	measurements, segments, pcns, benefits := inputs.measurements, inputs.segments, inputs.pcns, inputs.benefits
+	employment, costs, incidence, demand, names := inputs.employment, inputs.costs, inputs.incidence, inputs.demand, inputs.names
+	projectionModel, dispensing := inputs.projection, inputs.dispensing
+	scenario, overrides, allPrevalences := inputs.scenario, inputs.overrides, inputs.allPrevalences
+	geography, icbs, boroughs := inputs.geography, inputs.icbs, inputs.boroughs
+	lsoasKey, lsoas, msoas := inputs.lsoasKey, inputs.lsoas, inputs.msoas
+	gps, practicesKey, nearbyGPs, nearbyKey := inputs.gps, inputs.practicesKey, inputs.nearbyGPs, inputs.nearbyKey
+	conditions, reported, modelled, refined := inputs.conditions, inputs.reported, inputs.modelled, inputs.refined
+	prevalenceRead, prevalenceAdjustments := inputs.prevalenceRead, inputs.prevalenceAdjustments
+
+	var practiceChanges map[GPPracticeCode]*PracticeChange
+	if !scenario.Practices.IsEmpty() {
+		log.Printf("apply practice changes:")
+		if practiceChanges, err = applyPracticeChanges(&scenario.Practices, options.Scope.ICB(), gps, nearbyGPs, options.Rurality, options.Parameters, world); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("scope: %s", options.Scope)
+	icb, icbPractices, err := resolveScope(options.Scope, icbs, boroughs, gps, geography, world)
+	if err != nil {
+		return err
+	}
+	log.Printf("  %s", icb.Name)
 	icbPopulation := 0
 	for code := range icb.LSOAs {
 		for _, count := range lsoas[code].PersonsByAge {
@@ -1916,37 +3013,146 @@ func writePopulation(world b6.World, allPrevalences AllPrevalences, cachedDirect
 		}
 	}
 	log.Printf("icb population: %d", icbPopulation)
-	icbPractices := make(GPPracticeCodeSet, 0)
 	icbPractioners := 0
-	for _, gp := range gps {
-		if gp.ICB == NorthCentralLondonICBCode {
-			icbPractices[gp.Code] = struct{}{}
-			icbPractioners += gp.Practioners
-		}
+	for code := range icbPractices {
+		icbPractioners += gps[code].Practioners
 	}
 	log.Printf("icb practices: %d", len(icbPractices))
 	log.Printf("icb practioners: %d", icbPractioners)
 
-	imputeMissingPrevalenceFromNearby(gps, conditions, nearbyGPs)
+	applied := &AppliedAssumptions{PrevalenceOverrides: overrides, OutlierAdjustments: len(prevalenceAdjustments)}
+	applied.MissingPrevalences, applied.ImputedPrevalences = imputeMissingPrevalenceFromNearby(gps, conditions, nearbyGPs)
+	if len(options.PrescribingFilenames) > 0 && options.PrescribingBiasWeight > 0.0 {
+		blendPrescribingPrevalence(gps, conditions, options.PrescribingBiasWeight)
+	}
+	allPractices := make(GPPracticeCodeSet, len(gps))
+	for code := range gps {
+		allPractices[code] = struct{}{}
+	}
+	coverage := measureCoverage(CoverageAreaEngland, allPractices, gps, reported, prevalenceRead, prevalenceAdjustments)
+	coverage = append(coverage, measureCoverage(CoverageAreaScope, icbPractices, gps, reported, prevalenceRead, prevalenceAdjustments)...)
+	logCoverage(coverage)
 
+	timings.Start("buffer")
 	homes := make(LSOASet)
 	for icb := range icb.LSOAs {
 		homes[icb] = struct{}{}
 	}
 	log.Printf("homes from icb lsoas: %d", len(homes))
-	fillCatchmentLSOA(icbPractices, gps, world, homes)
+	buffer, err := buildBuffer(&options.Buffer, options.Parameters, icbPractices, gps, icb.LSOAs, lsoas, travel, geography, options.Data, world)
+	if err != nil {
+		return err
+	}
+	for lsoa := range buffer.LSOAs {
+		homes[lsoa] = struct{}{}
+	}
 	log.Printf("homes from icb lsoas+buffer: %d", len(homes))
+	if options.TargetYear > 0 {
+		timings.Start("target year")
+		log.Printf("reweight to %d:", options.TargetYear)
+		targets, err := readPopulationTargets(options.Data.Get(DatasetPopulationEstimates), options.TargetYear)
+		if err != nil {
+			return err
+		}
+		if options.TargetLSOATotals {
+			if err := readLSOAPopulationTargets(options.Data.Get(DatasetLSOAPopulationEstimates), targets); err != nil {
+				return err
+			}
+		}
+		reweightLSOAs(homes, lsoas, boroughs, targets)
+		lsoasKey = targetYearCacheKey(options.Cache, lsoasKey, options.TargetYear, options.Data, options.TargetLSOATotals)
+	}
+	applied.Buffer = buffer
+	applied.OtherSexPeople = countOtherSex(homes, lsoas, options.OtherSexPrevalence)
+
+	// Sites are only needed by outputs, so read them while the population
+	// is simulated
+	var sites map[ODSCode]*Site
+	sitesDone := make(chan error, 1)
+	if len(scenario.Services) > 0 || options.Sites {
+		go func() {
+			var err error
+			if sites, err = readSites(options.Data.Get(DatasetTrustSites), postcodeSources(options.Data), world); err == nil {
+				err = readEstates(sites, options.Data.Get(DatasetEstates))
+			}
+			sitesDone <- err
+		}()
+	}
 
+	timings.Start("build population")
 	log.Printf("build population")
-	people, err := buildPopulation(homes, lsoas, nearbyGPs, gps)
+	var people []Person
+	populationKey := populationCacheKey(options.Cache, lsoasKey, practicesKey, nearbyKey, homes, options.Data, options.Rurality, options.Parameters, &scenario.Practices)
+	cached, err := options.Cache.Stage(populationKey, &people, func() error {
+		var err error
+		people, err = buildPopulation(homes, lsoas, nearbyGPs, gps, options.Rurality, options.Parameters, options.Progress)
+		return err
+	})
 	if err != nil {
 		return err
+	} else if cached {
+		for i := range people {
+			if people[i].GP != GPPracticeCodeInvalid {
+				gps[people[i].GP].SimulatedListSize++
+			}
+		}
+		log.Printf("  people: %d", len(people))
 	}
 
-	log.Printf("list size rmsd: %f", estimateListSizeError(icbPractices, gps))
+	var calibration *RegistrationCalibration
+	if options.RegistrationCalibrationIterations > 0 {
+		log.Printf("calibrate registrations")
+		bands, err := AgeBandsFromString("ons")
+		if err != nil {
+			return err
+		}
+		published, err := readGPRegistrationsByAge(options.Data.Get(DatasetGPRegistrationsMales), options.Data.Get(DatasetGPRegistrationsFemales), icbPractices, bands)
+		if err != nil {
+			return err
+		}
+		calibration = calibrateRegistrations(people, published, bands, options.RegistrationCalibrationIterations, lsoas, nearbyGPs, gps, options.Rurality, options.Parameters, options.Progress)
+	}
 
-	for _, condition := range conditions {
-		for _, other := range conditions {
+	var careHomes map[CareHomeID]*CareHome
+	if options.CareHomes {
+		log.Printf("assign care homes")
+		if careHomes, err = readCareHomes(options.Data.Get(DatasetCareHomes), postcodeSources(options.Data), world); err != nil {
+			return err
+		}
+		assignCareHomes(people, careHomes, homes, nearbyGPs, gps)
+	}
+
+	if options.Assignment == AssignmentBalanced {
+		log.Printf("balance assignment")
+		applied.BalancedAssignment = balanceAssignment(people, homes, icbPractices, lsoas, nearbyGPs, gps, options.Rurality, options.Parameters)
+	}
+
+	pharmacies := inputs.pharmacies
+	if dispensing != nil {
+		log.Printf("assign pharmacies")
+		assignPharmacies(people, homes, pharmacies, lsoas, careHomes, reported, dispensing)
+	}
+
+	if options.HomePoints != HomePointsNone {
+		log.Printf("sample home points")
+		assignHomePoints(people, icb.LSOAs, options.HomePoints, lsoas, careHomes, geography, world)
+	}
+
+	var observedCrossBorder map[LSOACode]float64
+	if options.CrossBorderCalibration {
+		log.Printf("calibrate cross border registrations")
+		if observedCrossBorder, err = readObservedCrossBorder(options.Data.Get(DatasetGPRegistrationsLSOA), homes, icbPractices, geography); err != nil {
+			return err
+		}
+		applied.CrossBorderInwards, applied.CrossBorderOutwards = calibrateCrossBorder(people, homes, icbPractices, observedCrossBorder, lsoas, nearbyGPs, gps, options.Rurality, options.Parameters)
+	}
+
+	listSizeRMSD := estimateListSizeError(icbPractices, gps)
+	log.Printf("list size rmsd: %f", listSizeRMSD)
+
+	timings.Start("estimate bias")
+	for _, condition := range modelled {
+		for _, other := range modelled {
 			if other != condition {
 				fillConditionalPrevalences(condition, other, people, allPrevalences)
 				allPrevalences[OneConditionGivenOtherPresent(condition, other)].Log()
@@ -1961,37 +3167,636 @@ func writePopulation(world b6.World, allPrevalences AllPrevalences, cachedDirect
 		byPractice[people[i].GP] = append(byPractice[people[i].GP], &people[i])
 	}
 
+	if smoking != nil {
+		log.Printf("assign smoking status")
+		assignSmokingStatus(byPractice, smoking, gps)
+	}
+	if bmi != nil {
+		log.Printf("assign bmi")
+		assignBMI(people, bmi, lsoas)
+	}
+	risks := &RiskFactors{Smoking: smoking, BMI: bmi}
+
 	log.Printf("estimate bias:")
 	for _, condition := range conditions {
 		log.Printf("  %s", condition)
-		estimateGPPracticeConditionBias(byPractice, condition, allPrevalences[OneCondition(condition)], gps)
+		estimateGPPracticeConditionBias(byPractice, condition, allPrevalences[OneCondition(condition)], gps, risks)
 	}
+	inheritConditionBias(gps, refined)
 
-	log.Printf("assign conditions")
-	assignConditions(byPractice, conditions, allPrevalences, gps)
+	others := modelled
+	var estimates []*SmallAreaEstimate
+	if len(options.SmallAreaConditions) > 0 {
+		log.Printf("small area estimation:")
+		ethnicity, err := readLSOAEthnicity(options.Data.Get(DatasetLSOAEthnicity), geography)
+		if err != nil {
+			return err
+		}
+		bands, err := AgeBandsFromString("qof")
+		if err != nil {
+			return err
+		}
+		others = make([]QOFCondition, 0, len(modelled))
+		for _, condition := range modelled {
+			estimated := false
+			for _, c := range options.SmallAreaConditions {
+				estimated = estimated || c == condition
+			}
+			if !estimated {
+				others = append(others, condition)
+			}
+		}
+		for _, condition := range options.SmallAreaConditions {
+			if !condition.HasRegister() {
+				return fmt.Errorf("small area estimation of %s needs practice level prevalence from a QOF register", condition)
+			}
+			simulated := false
+			for _, c := range modelled {
+				simulated = simulated || c == condition
+			}
+			if !simulated {
+				return fmt.Errorf("small area estimation of %s needs it to be simulated, without a simulated parent", condition)
+			}
+			estimate, err := fitSmallAreaEstimate(condition, byPractice, gps, lsoas, ethnicity, allPrevalences, bands)
+			if err != nil {
+				return err
+			}
+			estimate.Log()
+			estimates = append(estimates, estimate)
+		}
+	}
 
-	log.Printf("write population")
-	f, err := os.OpenFile(filepath.Join(outputDirectory, "population.csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+	timings.Start("assign conditions")
+	log.Printf("assign conditions: %s", options.ConditionModel)
+	var model ConditionModel
+	if len(others) > 0 {
+		if model, err = ConditionModelFromString(options.ConditionModel, others, allPrevalences, risks, lsoas, options.LogisticCoefficientsFilename); err != nil {
+			return err
+		}
+	}
+	if len(estimates) > 0 {
+		model = &SmallAreaConditionModel{Estimates: estimates, Others: model}
+	}
+	if len(refined) > 0 {
+		model = &SubConditionModel{Model: model, Refined: refined, Prevalences: allPrevalences}
+	}
+	var audits Audits
+	if options.AuditSample > 0 {
+		audits = sampleAudits(people, homes, options.AuditSample, lsoas, nearbyGPs, gps, careHomes, options)
+	}
+	assignConditions(byPractice, reported, model, gps, audits, options.Progress)
+	if err := checkRollUps(people, reported); err != nil {
 		return err
 	}
-	w := csv.NewWriter(f)
-	w.Write(PersonHeaderRow())
-	for _, person := range people {
-		if _, ok := icb.LSOAs[person.Home]; ok {
-			w.Write(person.ToRow(conditions))
+	validation := validatePrevalence(icbPractices, gps, reported)
+	validation.Coverage = coverage
+	var flows *FlowValidation
+	if options.FlowValidation {
+		log.Printf("read: registrations by lsoa")
+		observed, err := readGPRegistrationFlows(options.Data.Get(DatasetGPRegistrationsLSOA), icbPractices, geography)
+		if err != nil {
+			return err
 		}
+		flows = validateFlows(icbPractices, gps, byPractice, homes, observed)
 	}
-	w.Flush()
-	f.Close()
 
-	log.Printf("write gps")
-	f, err = os.OpenFile(filepath.Join(outputDirectory, "gps.csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+	if incidence != nil {
+		log.Printf("assign onset ages")
+		assignOnsetAges(people, conditions, incidence)
+	}
+	complications := inputs.complications
+	if complications != nil {
+		log.Printf("assign complications")
+		complications.warnUnsimulated(reported)
+		assignComplications(people, complications)
+	}
+	detection := inputs.detection
+	if detection != nil {
+		log.Printf("assign undiagnosed")
+		detection.warnUnsimulated(reported)
+		assignUndiagnosed(people, detection, lsoas)
+	}
+	control := inputs.control
+	if control != nil {
+		log.Printf("assign controlled")
+		control.warnUnsimulated(reported)
+		assignControlled(people, gps, control)
+	}
+	registerAges := compareRegisterAges(byPractice, icbPractices, reported, options.AgeBands, inputs.registerAges, incidence)
+
+	var achievements []*IndicatorAchievement
+	if measurements != nil {
+		log.Printf("assign measurements")
+		measurements.warnUnsimulated(conditions)
+		assignMeasurements(byPractice, measurements)
+		log.Printf("simulate qof achievement")
+		achievements = simulateAchievement(icbPractices, byPractice, measurements)
+	}
+
+	if segments != nil {
+		log.Printf("assign segments")
+		assignSegments(people, reported, segments)
+	}
+
+	if benefits != nil {
+		log.Printf("assign benefits")
+		var claimants [BenefitCount]map[LSOACode]float64
+		for _, b := range benefits.Modelled() {
+			if claimants[b], err = readBenefitClaimants(options.Data.Get(b.Dataset()), lsoas, geography); err != nil {
+				return err
+			}
+		}
+		assignBenefits(people, homes, lsoas, claimants, benefits)
+	}
+
+	if employment != nil {
+		log.Printf("assign employment")
+		fromLSOA21, err := geography.FromLSOA21(options.Data)
+		if err != nil {
+			return err
+		}
+		activity, err := readEmploymentCounts(options.Data.Get(DatasetLSOAEconomicActivity), economicActivityCategories(), lsoas, fromLSOA21)
+		if err != nil {
+			return err
+		}
+		occupation, err := readEmploymentCounts(options.Data.Get(DatasetLSOAOccupation), occupationCategories(), lsoas, fromLSOA21)
+		if err != nil {
+			return err
+		}
+		assignEmployment(people, homes, activity, occupation, employment)
+	}
+
+	if admissions != nil {
+		log.Printf("assign admissions")
+		assignAdmissions(people, admissions, lsoas)
+	}
+
+	var activity [][ActivityCount]float64
+	if costs != nil {
+		log.Printf("estimate activity")
+		activity = estimateActivity(people, gps, lsoas, costs, admissions != nil)
+	}
+
+	var baselineCosts, scenarioCosts *BudgetCosts
+	if !scenario.Budget.IsEmpty() {
+		log.Printf("budget impact:")
+		if scenario.Budget.Baseline != "" {
+			if baselineCosts, err = readBaselineCosts(scenario.Budget.Baseline, costs); err != nil {
+				return err
+			}
+		} else {
+			baselineCosts = activityCosts(people, activity, icbPractices, costs)
+		}
+		interventions := applyInterventions(people, activity, icbPractices, scenario.Budget.Interventions)
+		scenarioCosts = activityCosts(people, activity, icbPractices, costs)
+		scenarioCosts.Interventions = interventions
+		log.Printf("  annual cost: baseline: £%.0f scenario: £%.0f", baselineCosts.Total(), scenarioCosts.Total())
+		log.Printf("  difference over %d years, discounted: £%.0f", scenario.Budget.Horizon, (scenarioCosts.Total()-baselineCosts.Total())*scenario.Budget.HorizonFactor())
+	}
+
+	if options.NHSNumbers {
+		log.Printf("assign nhs numbers")
+		if err := assignNHSNumbers(people, icb.LSOAs); err != nil {
+			return err
+		}
+	}
+
+	if names != nil {
+		log.Printf("assign names")
+		assignNames(people, icb.LSOAs, names)
+	}
+
+	var reweighting *Reweighting
+	if len(options.ReweightMargins) > 0 {
+		timings.Start("reweight")
+		log.Printf("reweight people")
+		var targets *PopulationTargets
+		if hasReweightMargin(options.ReweightMargins, ReweightMarginBoroughs) {
+			if targets, err = readPopulationTargets(options.Data.Get(DatasetPopulationEstimates), options.ReweightYear); err != nil {
+				return err
+			}
+		}
+		controls := reweightControls(options.ReweightMargins, people, homes, icbPractices, gps, reported, boroughs, targets)
+		reweighting = reweightPeople(people, homes, controls)
+		applied.Reweighting = reweighting
+	}
+
+	timings.Start("aggregate")
+	manifest := NewManifest(scenario.Name)
+	manifest.Scope = options.Scope.String()
+	manifest.AddNote(fmt.Sprintf("Output profile %s: %s", options.Profile.Name, options.Profile.Description))
+	manifest.AddNote(fmt.Sprintf("People are drawn from %d LSOAs in %s, %s, and %d buffer LSOAs outside it chosen by the %s policy", len(icb.LSOAs), options.Scope, icb.Name, len(buffer.LSOAs), buffer.Policy))
+	if len(overrides) > 0 {
+		manifest.AddNote(fmt.Sprintf("Prevalences from %s were overridden by %s", PrevalencesFilename, overrides.String()))
+	}
+	manifest.AddNote(fmt.Sprintf("Reported QOF prevalence was adjusted for %d practices and conditions, as outliers by the %s rule, listed in prevalence-outliers.csv", len(prevalenceAdjustments), options.PrevalenceOutlier))
+	if options.NHSNumbers {
+		manifest.AddNote("NHS numbers are drawn from the range reserved for testing, and are not issued to real patients")
+	}
+	if names != nil {
+		manifest.AddNote("Names and dates of birth are fake, chosen at random for use as test data")
+	}
+
+	columns := options.Profile.Apply(PersonColumns(&PersonColumnOptions{
+		Conditions:        reported,
+		ConditionEncoding: options.ConditionEncoding,
+		HomePoints:        options.HomePoints != HomePointsNone,
+		Admissions:        admissions != nil,
+		NHSNumbers:        options.NHSNumbers,
+		Names:             names != nil,
+		Smoking:           smoking != nil,
+		BMI:               bmi != nil,
+		OnsetAges:         incidence != nil,
+		Complications:     complications,
+		Detection:         detection,
+		Control:           control,
+		Measurements:      measurements != nil,
+		Segments:          segments != nil,
+		Benefits:          benefits,
+		Employment:        employment != nil,
+		CareHomes:         careHomes != nil,
+		Pharmacies:        pharmacies != nil,
+		RuralUrban:        options.Rurality != nil,
+		Weights:           reweighting != nil,
+		LSOAs:             lsoas,
+	}), lsoas)
+	prescribing := len(options.PrescribingFilenames) > 0
+	provenance := newProvenance(options.Data, conditions, prescribing)
+	manifest.Sources = provenance.Sources
+	defer markOutputs(options.OutputDirectory, provenance, options.CSVProvenance)()
+
+	var exports Exports
+	assumptions := collectAssumptions(options, applied)
+	exports.AddMany(
+		[]string{"assumptions.md", "assumptions.json"},
+		[]string{"Register of the assumptions made by this run, from built in constants, flags and models, and the adjustments applied to its inputs", "The assumptions register, as JSON"},
+		manifest,
+		func() error {
+			if err := assumptions.WriteMarkdown(scenario.Name, options.OutputDirectory); err != nil {
+				return err
+			}
+			return assumptions.WriteJSON(options.OutputDirectory)
+		},
+	)
+	exports.AddMany(
+		[]string{"coverage.csv", "coverage.json"},
+		[]string{"Practices in England and the scope by how the prevalence of each condition was obtained: reported, replaced as an outlier, imputed, or missing", "Prevalence coverage, as JSON, for dashboards and serve"},
+		manifest,
+		func() error {
+			return writeCoverage(coverage, options.OutputDirectory)
+		},
+	)
+	exports.Add("prevalence-outliers.csv", "Practices whose reported QOF prevalence was adjusted as an outlier, and by how much", manifest, func() error {
+		return writePrevalenceOutliers(prevalenceAdjustments, gps, options.OutputDirectory)
+	})
+	exports.Add("validation.csv", "Simulated condition registers by practice, compared to those reported by QOF", manifest, func() error {
+		return validation.WriteCSV(options.OutputDirectory)
+	})
+	exports.Add("validation.html", "Summary of simulated vs reported condition registers, with the worst matching practices", manifest, func() error {
+		return validation.WriteHTML(options.OutputDirectory)
+	})
+	if careHomes != nil {
+		exports.Add("care-homes.csv", "CQC registered care homes, with the residents placed in them, and the practice serving them", manifest, func() error {
+			return writeCareHomes(careHomes, homes, options.OutputDirectory)
+		})
+	}
+	if pharmacies != nil {
+		exports.Add("pharmacies.csv", "Community pharmacies nearest the homes of ICB residents, with the items they're expected to dispense each year for each condition", manifest, func() error {
+			return writePharmacies(pharmacies, reported, dispensing, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if flows != nil {
+		exports.AddMany(
+			[]string{"flow-validation.csv", "flow-matrix.csv"},
+			[]string{"Similarity of simulated and registered patients' home LSOAs, by practice", "Simulated and registered patients by practice and home LSOA"},
+			manifest,
+			func() error {
+				return flows.WriteCSV(options.OutputDirectory)
+			},
+		)
+	}
+	if len(demand.Conditions(reported)) > 0 {
+		filenames := make([]string, 0, len(reported))
+		descriptions := make([]string, 0, len(reported))
+		for _, condition := range demand.Conditions(reported) {
+			filenames = append(filenames, fmt.Sprintf("demand-%s.tif", condition))
+			descriptions = append(descriptions, fmt.Sprintf("GeoTIFF of %s needed per km² each year by residents of the ICB", demand[condition].Description))
+		}
+		exports.AddMany(filenames, descriptions, manifest, func() error {
+			return writeDemandSurfaces(people, icb.LSOAs, reported, demand, lsoas, geography, options.DemandCellMeters, provenance, world, options.OutputDirectory)
+		})
+	}
+	if projectionModel != nil {
+		log.Printf("project population: %d years", options.ProjectYears)
+		baseYear := options.CensusYear
+		if options.TargetYear > 0 {
+			baseYear = options.TargetYear
+		}
+		projection := projectPopulation(people, icb.LSOAs, conditions, reported, projectionModel, incidence, baseYear, options.ProjectYears)
+		projection.Log()
+		exports.AddMany(
+			[]string{"projection.csv", "projection-conditions.csv"},
+			[]string{"Residents, births, deaths, net migration and condition counts by LSOA, for each year of the projection", "Condition counts, prevalence and, with --demand-surface, activity across the scope, for each year of the projection"},
+			manifest,
+			func() error {
+				return projection.WriteCSV(scenario.Name, demand, options.OutputDirectory)
+			},
+		)
+	}
+	if options.Flows {
+		exports.AddMany(
+			[]string{"flows.csv", "flows.geojson"},
+			[]string{"Simulated patients by home LSOA and ICB practice", "Simulated patients by home LSOA and ICB practice, as lines for visualisation"},
+			manifest,
+			func() error {
+				return writeFlows(icbPractices, gps, byPractice, homes, lsoas, options.OutputDirectory)
+			},
+		)
+	}
+	exports.Add("travel.csv", "Estimated annual patient travel to GP practices, and resulting emissions", manifest, func() error {
+		return writeTravelFootprints(icbPractices, byPractice, gps, lsoas, travel, scenario.Name, options.OutputDirectory)
+	})
+	var diagnoses []*NewDiagnoses
+	if incidence != nil {
+		log.Printf("estimate new diagnoses")
+		diagnoses = estimateNewDiagnoses(byPractice, icbPractices, gps, people, icb.LSOAs, lsoas, msoas, reported, incidence)
+		exports.Add("new-diagnoses.csv", "Expected new diagnoses of each condition in a year, alongside the people with it, by ICB practice and home MSOA", manifest, func() error {
+			return writeNewDiagnoses(diagnoses, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if complications != nil {
+		counts := countComplications(icbPractices, gps, byPractice, complications)
+		exports.Add("complications.csv", fmt.Sprintf("Simulated complications of %s, from the years since diagnosis, by ICB practice", complications.condition), manifest, func() error {
+			return writeComplications(counts, complications, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if fallbacks := inputs.reads.GeocodeFallbacks(); len(fallbacks) > 0 {
+		exports.Add("geocoding.csv", "Practices, sites, care homes and pharmacies whose postcodes weren't in the world as given, and how they were located, if at all", manifest, func() error {
+			return writeGeocodeFallbacks(fallbacks, options.OutputDirectory)
+		})
+	}
+	if detection != nil {
+		detections := countDetection(icbPractices, gps, byPractice, detection)
+		exports.Add("detection-gaps.csv", fmt.Sprintf("Patients diagnosed with %s, and estimated to have it undiagnosed, with the detection rate, by ICB practice", detection.condition), manifest, func() error {
+			return writeDetectionGaps(detections, detection, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if backlog := inputs.backlog; backlog != nil {
+		log.Printf("estimate %s backlog", backlog.Service)
+		backlog.warnUnsimulated(reported)
+		backlogs := estimateBacklogs(icbPractices, gps, byPractice, diagnoses, backlog)
+		exports.Add(backlog.Filename(), fmt.Sprintf("The backlog of %s for patients with %s, the need for it and capacity each year, and the years to clear the backlog, by ICB practice", backlog.Service, backlog.condition), manifest, func() error {
+			return writeBacklogs(backlogs, backlog, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if admissions != nil {
+		exports.Add("admissions-msoa.csv", "Expected and sampled hospital admissions by home MSOA", manifest, func() error {
+			return writeAdmissionsByMSOA(people, icb.LSOAs, lsoas, msoas, options.OutputDirectory)
+		})
+	}
+	if calibration != nil {
+		exports.Add("registration-profile.csv", "The share of each ICB practice's simulated patients in each age band and sex, compared with published registrations", manifest, func() error {
+			return calibration.writeRegistrationProfiles(gps, options.OutputDirectory)
+		})
+	}
+	if practiceChanges != nil {
+		exports.Add("practice-changes.csv", "Simulated list sizes and condition counts of practices closed, merged or opened by the scenario, and their neighbours", manifest, func() error {
+			return writePracticeChanges(&scenario.Practices, practiceChanges, scenario.Name, nearbyGPs, gps, reported, options.OutputDirectory)
+		})
+	}
+	if len(scenario.Services) > 0 || options.Sites {
+		if err := <-sitesDone; err != nil {
+			return err
+		}
+	}
+	if options.Sites {
+		exports.Add("sites.csv", "The capacity of each trust site, from its estates return", manifest, func() error {
+			return writeSites(sites, options.OutputDirectory)
+		})
+		if admissions != nil {
+			log.Printf("estimate site demand")
+			demand := estimateSiteDemand(people, icb.LSOAs, lsoas, sites, admissions)
+			exports.Add("site-capacity.csv", "Expected admissions and bed days of ICB residents at their nearest admitting site, compared with its capacity", manifest, func() error {
+				return writeSiteCapacity(demand, sites, scenario.Name, options.OutputDirectory)
+			})
+		}
+	}
+	if len(scenario.Services) > 0 {
+		exports.Add("services.csv", "Access to relocated services, compared to the baseline", manifest, func() error {
+			return writeServiceScenarios(scenario, people, icb.LSOAs, lsoas, sites, travel, options.OutputDirectory)
+		})
+	}
+	if options.GeoJSON {
+		exports.AddMany(
+			[]string{"lsoa-conditions.geojson", "msoa-conditions.geojson"},
+			[]string{"Simulated condition counts and prevalences by LSOA", "Simulated condition counts and prevalences by MSOA"},
+			manifest,
+			func() error {
+				return writeConditionGeoJSON(people, icb.LSOAs, reported, lsoas, msoas, geography, world, options.OutputDirectory)
+			},
+		)
+	}
+	if options.Catchments {
+		catchments := buildCatchments(icbPractices, byPractice, homes, options.CatchmentMinShare)
+		exports.AddMany(
+			[]string{"catchments.csv", "catchments.geojson", "catchments.index"},
+			[]string{"The LSOAs in each ICB practice's effective catchment, from simulated registrations", "Each ICB practice's effective catchment, as the union of its LSOAs' boundaries", "b6 compact index of each ICB practice's effective catchment, as an area"},
+			manifest,
+			func() error {
+				return writeCatchments(catchments, gps, geography, world, scenario.Name, options.OutputDirectory)
+			},
+		)
+	}
+	if reweighting != nil {
+		manifest.AddNote(fmt.Sprintf("People are weighted to match the external totals of %d controls, in the weight column of population.csv. Aggregates are unweighted", len(reweighting.Controls)))
+		manifest.AddMetric("reweight_max_difference", reweighting.MaxDifference())
+		exports.Add("reweight-controls.csv", "The external totals to which people were weighted, with the unweighted and weighted totals of each", manifest, func() error {
+			return writeReweightControls(reweighting, options.OutputDirectory)
+		})
+	}
+	if segments != nil {
+		counts := countSegments(people, icbPractices, pcns, icb.LSOAs, boroughs)
+		exports.Add("segments.csv", "People in each population health segment by ICB practice, PCN and borough", manifest, func() error {
+			return writeSegments(counts, options.OutputDirectory)
+		})
+	}
+	if costs != nil {
+		breakdowns := breakdownCosts(people, activity, icbPractices, reported, icb.LSOAs, lsoas, boroughs)
+		exports.Add("costs.csv", "Indicative cost of simulated activity by ICB practice, condition, and the borough, MSOA and IMD decile of residents", manifest, func() error {
+			return writeCosts(breakdowns, costs, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if scenarioCosts != nil {
+		exports.Add("budget-impact.csv", "Cost of activity and interventions in the scenario, compared with the baseline, over the scenario's horizon", manifest, func() error {
+			return writeBudgetImpact(&scenario.Budget, baselineCosts, scenarioCosts, scenario.Budget.Interventions, scenario.Name, options.OutputDirectory)
+		})
+	}
+	if achievements != nil {
+		exports.Add("qof-achievement.csv", "Simulated achievement of each ICB practice against QOF indicators, from simulated clinical measurements", manifest, func() error {
+			return writeQOFAchievement(achievements, options.OutputDirectory)
+		})
+	}
+	if options.PopulationFeatures {
+		source := PopulationSource{People: people, Homes: icb.LSOAs, LSOAs: lsoas, Conditions: reported}
+		exports.Add("population.index", "b6 compact index of people and condition counts by home LSOA, for use alongside the healthcare features index", manifest, func() error {
+			return writePopulationFeatures(&source, options.OutputDirectory)
+		})
+	}
+	if options.PeerGroupSize > 0 {
+		peers := buildPeerGroups(icbPractices, byPractice, gps, lsoas, options.PeerGroupSize)
+		exports.AddMany(
+			[]string{"peer-groups.csv", "peer-comparison.csv"},
+			[]string{"The practices most similar to each ICB practice by list size, deprivation and age profile", "Reported and simulated prevalence at each ICB practice, relative to its peers"},
+			manifest,
+			func() error {
+				return writePeerGroups(peers, gps, reported, options.OutputDirectory)
+			},
+		)
+	}
+	if options.NationalBenchmark {
+		distributions := buildNationalDistributions(gps, BenchmarkMetrics(reported))
+		exports.Add("national-benchmark.csv", "ICB practices' reported and simulated values, positioned against the distribution across all practices in England", manifest, func() error {
+			return writeNationalBenchmark(icbPractices, gps, distributions, "simulated", options.OutputDirectory)
+		})
+	}
+	if len(estimates) > 0 {
+		exports.Add("small-area-prevalence.csv", "Expected prevalence of conditions by home LSOA from small area estimation, with that simulated", manifest, func() error {
+			return writeSmallAreaPrevalence(people, icb.LSOAs, estimates, options.OutputDirectory)
+		})
+	}
+	exports.Add("prevalence-age.csv", fmt.Sprintf("Input and simulated prevalence of each condition by sex and age band (%s)", options.AgeBands.Name), manifest, func() error {
+		return writePrevalenceByAgeBand(people, icb.LSOAs, reported, allPrevalences, options.AgeBands, options.OutputDirectory)
+	})
+	exports.Add("register-ages.csv", "Age distribution of each condition's simulated register across ICB practices, compared to published distributions where given", manifest, func() error {
+		return writeRegisterAges(registerAges, options.OutputDirectory)
+	})
+	if audits != nil {
+		exports.Add(AuditFilename, fmt.Sprintf("Why each of %d residents sampled at random was assigned their GP practice, with the candidates and their weights, and each condition, with the probability, bias and prevalence used", len(audits)), manifest, func() error {
+			return writeAudits(audits, options.OutputDirectory)
+		})
+	}
+	exports.Add("buffer-lsoas.csv", "LSOAs outside the ICB from which people are drawn, with the measure that led to their inclusion", manifest, func() error {
+		return buffer.WriteCSV(lsoas, msoas, options.OutputDirectory)
+	})
+	unregistered := countUnregistered(people, icb.LSOAs, options.AgeBands)
+	manifest.AddNote(fmt.Sprintf("%d of %d residents of the ICB couldn't be assigned a GP practice, and are absent from practice based outputs", unregistered.Total.Unregistered, unregistered.Total.Residents))
+	manifest.AddMetric("people", float64(len(people)))
+	manifest.AddMetric("residents", float64(unregistered.Total.Residents))
+	manifest.AddMetric("unregistered", float64(unregistered.Total.Unregistered))
+	manifest.AddMetric("lsoas", float64(len(icb.LSOAs)))
+	manifest.AddMetric("buffer_lsoas", float64(len(buffer.LSOAs)))
+	manifest.AddMetric("practices", float64(len(icbPractices)))
+	manifest.AddMetric("list_size_rmsd", listSizeRMSD)
+	for condition, prevalence := range residentPrevalences(people, icb.LSOAs, reported) {
+		manifest.AddMetric(fmt.Sprintf("prevalence_%s", condition), prevalence)
+	}
+	for _, r := range registerAges {
+		if r.Published {
+			manifest.AddMetric(fmt.Sprintf("register_ages_max_difference_%s", r.Condition), r.MaxDifference())
+		}
+	}
+	crossBorder := countCrossBorder(people, homes, icb.LSOAs, icbPractices)
+	crossBorder.Observed = observedCrossBorder
+	manifest.AddNote(fmt.Sprintf("%d residents of the scope are registered with %d practices outside it, and are absent from practice based outputs, while %d residents of buffer LSOAs are registered with practices inside it", crossBorder.Scope.Outside, len(crossBorder.ByPractice), crossBorder.Buffer.Inside))
+	manifest.AddMetric("registered_outside", float64(crossBorder.Scope.Outside))
+	manifest.AddMetric("buffer_registered_inside", float64(crossBorder.Buffer.Inside))
+	if options.Profile.LSOAOutputs {
+		exports.Add("cross-border-lsoa.csv", "Residents of each home LSOA by whether they're registered with a practice inside or outside the scope", manifest, func() error {
+			return crossBorder.WriteLSOACSV(icb.LSOAs, lsoas, options.OutputDirectory)
+		})
+	}
+	exports.Add("cross-border-practices.csv", "Practices outside the scope with which its residents are registered", manifest, func() error {
+		return crossBorder.WritePracticesCSV(gps, options.OutputDirectory)
+	})
+	if options.Profile.LSOAOutputs {
+		exports.Add("unregistered-lsoa.csv", "Residents not assigned a GP practice, by LSOA", manifest, func() error {
+			return unregistered.WriteLSOACSV(lsoas, msoas, options.OutputDirectory)
+		})
+	}
+	exports.Add("unregistered-age.csv", "Residents not assigned a GP practice, by age band", manifest, func() error {
+		return unregistered.WriteAgeCSV(options.OutputDirectory)
+	})
+	aggregates := make([]*AggregationResult, 0, len(options.AggregatePopulations))
+	for _, population := range options.AggregatePopulations {
+		result := aggregatePopulation(population, people, icb.LSOAs, icbPractices, lsoas, msoas, gps, options.AgeBands, benefits, employment != nil)
+		manifest.AddNote(fmt.Sprintf("Aggregates of the %s population include %d people, and exclude %d", population, result.Included, result.Excluded))
+		manifest.AddMetric(fmt.Sprintf("%s_included", population), float64(result.Included))
+		aggregates = append(aggregates, result)
+	}
+	exports.Add("population.json", fmt.Sprintf("Aggregate statistics of the %s population, for web based visualisation", aggregates[0].Population), manifest, func() error {
+		return writePopulationJSON(aggregates[0], icbPractices, gps, options.OutputDirectory)
+	})
+	data := &ExportData{
+		Scenario:        scenario.Name,
+		Profile:         options.Profile,
+		OutputDirectory: options.OutputDirectory,
+		Provenance:      provenance,
+		GPs:             gps,
+		LSOAs:           lsoas,
+		MSOAs:           msoas,
+		Conditions:      reported,
+		SQLiteFilename:  options.SQLiteFilename,
+	}
+	stream := func(each func(p *Person) error) error {
+		for i := range people {
+			if _, ok := icb.LSOAs[people[i].Home]; ok {
+				if err := each(&people[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	switch options.ConditionEncoding {
+	case ConditionEncodingBitmask:
+		manifest.AddNote(describeConditionsBitmask(reported))
+	case ConditionEncodingLong:
+		exports.Add(PersonConditionsFilename, "The conditions of each synthetic individual, by id, with a row for each of a person's conditions", manifest, func() error {
+			return writePersonConditions(stream, reported, options.OutputDirectory)
+		})
+	}
+	practices := make([]*GPPractice, 0, len(icbPractices))
+	totalSimulatedListSize := 0
+	for code := range icbPractices {
+		practices = append(practices, gps[code])
+		totalSimulatedListSize += gps[code].SimulatedListSize
+	}
+	sort.Slice(practices, func(i, j int) bool { return practices[i].Code < practices[j].Code })
+	log.Printf("total simulated list size: %d", totalSimulatedListSize)
+	practicesTable := &ExportTable{
+		Fields: gpsArrowFields(reported, prescribing),
+		Rows: func(each func(row []string) error) error {
+			for _, gp := range practices {
+				if err := each(gpsRow(gp, byPractice, lsoas, reported, prescribing)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	for _, format := range options.Formats {
+		format := format
+		filenames, descriptions := format.Outputs(data)
+		exports.AddMany(filenames, descriptions, manifest, func() error {
+			return runExporter(format, data, columns, stream, practices, practicesTable, aggregates, aggregatesTable(aggregates))
+		})
+	}
+	timings.Start("write outputs")
+	if err := exports.Run(options.ExportWriters); err != nil {
+		return err
+	}
+	manifest.AddOutput(MetricsFilename, "Wall time, CPU time and peak memory by stage, rows read by dataset, and data quality counters, for automated comparisons between runs")
+	manifest.Timings = timings.Done()
+	// Written after the other outputs, to include the time taken to write
+	// them
+	if err := newRunMetrics(manifest, options.Data, inputs.reads, coverage).Write(options.OutputDirectory); err != nil {
 		return err
 	}
+	return manifest.Write(options.OutputDirectory)
+}
 
-	w = csv.NewWriter(f)
+// gpsHeaderRow returns the columns of gps.csv
+func gpsHeaderRow(conditions []QOFCondition, prescribing bool) []string {
 	header := []string{"code", "name", "simulated_list_size", "list_size", "appointments", "appointments_gp", "appointments_other", "population_imd", "median_age"}
 	for _, condition := range conditions {
 		header = append(header, fmt.Sprintf("prevalence_%s", condition))
@@ -2002,57 +3807,80 @@ func writePopulation(world b6.World, allPrevalences AllPrevalences, cachedDirect
 	for _, condition := range conditions {
 		header = append(header, fmt.Sprintf("simulated_prevalence_%s", condition))
 	}
-	w.Write(header)
-	totalSimulatedListSize := 0
-	for code := range icbPractices {
-		gp := gps[code]
-		if gp.ICB != NorthCentralLondonICBCode {
-			continue
+	if prescribing {
+		for _, chapter := range BNFChapters() {
+			header = append(header, fmt.Sprintf("prescribing_items_%s", BNFChapterString(chapter)))
 		}
-		totalSimulatedListSize += gp.SimulatedListSize
-		row := []string{
-			code.String(),
-			gp.Name,
-			strconv.Itoa(gp.SimulatedListSize),
-			strconv.Itoa(gp.ListSize),
-			strconv.Itoa(gp.Appointments),
-			strconv.Itoa(gp.AppointmentsByType[HcpTypeGP]),
-			strconv.Itoa(gp.AppointmentsByType[HcpTypeOther]),
-			fmt.Sprintf("%f", averageIMD(byPractice[gp.Code], lsoas)),
-			strconv.Itoa(medianAge(byPractice[gp.Code])),
-		}
-		for _, condition := range conditions {
-			row = append(row, fmt.Sprintf("%f", gp.ConditionPrevalence[condition]))
+		for _, chapter := range BNFChapters() {
+			header = append(header, fmt.Sprintf("prescribing_cost_%s", BNFChapterString(chapter)))
 		}
-		for _, condition := range conditions {
-			row = append(row, fmt.Sprintf("%f", gp.ConditionBias[condition]))
-		}
-		for _, condition := range conditions {
-			row = append(row, fmt.Sprintf("%f", float64(gp.SimulatedConditionCounts[condition])/float64(gp.SimulatedListSize)))
-		}
-		w.Write(row)
 	}
-	w.Flush()
-	if err := f.Close(); err != nil {
-		return err
+	return header
+}
+
+// gpsArrowFields returns the columns of gps.csv, with their types
+func gpsArrowFields(conditions []QOFCondition, prescribing bool) []ArrowField {
+	header := gpsHeaderRow(conditions, prescribing)
+	fields := make([]ArrowField, len(header))
+	for i, name := range header {
+		fields[i] = ArrowField{Name: name, Type: ArrowTypeFloat64}
+		switch name {
+		case "code", "name":
+			fields[i].Type = ArrowTypeUtf8
+		case "simulated_list_size", "list_size", "appointments", "appointments_gp", "appointments_other", "median_age":
+			fields[i].Type = ArrowTypeInt64
+		}
 	}
-	log.Printf("total simulated list size: %d", totalSimulatedListSize)
+	return fields
+}
 
-	output, err := json.Marshal(toJSON(people, lsoas, msoas, gps))
-	if err != nil {
-		return err
+func gpsRow(gp *GPPractice, byPractice map[GPPracticeCode][]*Person, lsoas map[LSOACode]*LSOA, conditions []QOFCondition, prescribing bool) []string {
+	row := []string{
+		gp.Code.String(),
+		gp.Name,
+		strconv.Itoa(gp.SimulatedListSize),
+		strconv.Itoa(gp.ListSize),
+		strconv.Itoa(gp.Appointments),
+		strconv.Itoa(gp.AppointmentsByType[HcpTypeGP]),
+		strconv.Itoa(gp.AppointmentsByType[HcpTypeOther]),
+		fmt.Sprintf("%f", averageIMD(byPractice[gp.Code], lsoas)),
+		strconv.Itoa(medianAge(byPractice[gp.Code])),
 	}
-	f, err = os.OpenFile(filepath.Join(outputDirectory, "population.json"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	for _, condition := range conditions {
+		row = append(row, fmt.Sprintf("%f", gp.ConditionPrevalence[condition]))
 	}
-	f.Write(output)
-	return f.Close()
+	for _, condition := range conditions {
+		row = append(row, fmt.Sprintf("%f", gp.ConditionBias[condition]))
+	}
+	for _, condition := range conditions {
+		row = append(row, fmt.Sprintf("%f", float64(gp.SimulatedConditionCounts[condition])/float64(gp.SimulatedListSize)))
+	}
+	if prescribing {
+		p := gp.Prescribing
+		if p == nil {
+			p = NewPrescribing()
+		}
+		for _, chapter := range BNFChapters() {
+			row = append(row, fmt.Sprintf("%f", p.ItemsByChapter[chapter]))
+		}
+		for _, chapter := range BNFChapters() {
+			row = append(row, fmt.Sprintf("%f", p.CostByChapter[chapter]))
+		}
+	}
+	return row
 }
 
+// writePopulationJSON streams the encoded aggregates to the file, rather
+// than holding both the aggregates and their encoding in memory.
+func writePopulationJSON(aggregates *AggregationResult, practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, outputDirectory string) error {
+	return writeJSONOutput(filepath.Join(outputDirectory, "population.json"), toJSON(aggregates, practices, gps), false)
+}
+
+const PrevalencesFilename = "data/prevalences.yaml"
+
 func readPrevalences() (AllPrevalences, error) {
 	allPrevalences := make(AllPrevalences)
-	r, err := os.Open("data/prevalences.yaml")
+	r, err := os.Open(PrevalencesFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open prevalences: %s", err)
 	}
@@ -2071,39 +3899,3 @@ func readPrevalences() (AllPrevalences, error) {
 	}
 	return allPrevalences, nil
 }
-
-func main() {
-	nearbyGPsFlag := flag.Bool("nearby-gps", false, "Write a mapping to LSOA to nearby GPs to --cached")
-	populationFlag := flag.Bool("population", false, "Write Population")
-	featuresFlag := flag.Bool("features", false, "Write a compact world containing healthcare features")
-	worldFlag := flag.String("world", "world/codepoint-open-2023-02.index,world/lsoa-2011.index", "b6 world to load for GP nearby GP generation")
-	cachedFlag := flag.String("cached", "cached", "Directory for intermediate files")
-	outputFlag := flag.String("output", "output", "Directory for output files")
-	flag.Parse()
-
-	allPrevalences, err := readPrevalences()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	world, err := compact.ReadWorld(*worldFlag, runtime.NumCPU())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if *nearbyGPsFlag {
-		if err := writeNearbyGPPractices(world, *cachedFlag); err != nil {
-			log.Fatal(err)
-		}
-	}
-	if *featuresFlag {
-		if err := writeFeatures(world); err != nil {
-			log.Fatal(err)
-		}
-	}
-	if *populationFlag {
-		if err := writePopulation(world, allPrevalences, *cachedFlag, *outputFlag); err != nil {
-			log.Fatal(err)
-		}
-	}
-}
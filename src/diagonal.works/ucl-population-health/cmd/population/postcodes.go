@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+const (
+	ONSPDPostcodeColumn = "pcds"
+	ONSPDLatColumn      = "lat"
+	ONSPDLngColumn      = "long"
+
+	// ONSPD gives postcodes without a grid reference this latitude
+	ONSPDMissingLat = 99.999999
+)
+
+// formatGBPostcode returns postcode in the form used by the ONS Postcode
+// Directory, in upper case, with a single space before the three character
+// inward code, and without other spaces or punctuation, so that postcodes
+// written with different spacing or case match.
+func formatGBPostcode(postcode string) string {
+	var b strings.Builder
+	for _, r := range postcode {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	s := b.String()
+	if len(s) < 5 {
+		return s
+	}
+	return s[0:len(s)-3] + " " + s[len(s)-3:]
+}
+
+// locatePostcode returns the location of postcode in w, as it's given, or
+// formatted by formatGBPostcode.
+func locatePostcode(postcode string, w b6.World) (s2.Point, bool) {
+	if p := b6.FindPointByID(b6.PointIDFromGBPostcode(postcode), w); p != nil {
+		return p.Point(), true
+	}
+	if formatted := formatGBPostcode(postcode); formatted != postcode {
+		if p := b6.FindPointByID(b6.PointIDFromGBPostcode(formatted), w); p != nil {
+			return p.Point(), true
+		}
+	}
+	return s2.Point{}, false
+}
+
+// GeocodeMethod is how the location of an organisation's postcode was
+// found
+type GeocodeMethod int
+
+const (
+	// The postcode is in the world, as it's given
+	GeocodeWorld GeocodeMethod = iota
+	// The postcode is in the world, once formatted by formatGBPostcode
+	GeocodeFormatted
+	// The postcode is in the supplementary geocodes dataset
+	GeocodeSupplementary
+	// The postcode is among the historic postcodes of the ONS Postcode
+	// Directory
+	GeocodeHistoric
+	// The postcode isn't known, and is placed at the centre of the
+	// postcodes of its sector in the world
+	GeocodeSector
+	// The postcode couldn't be located
+	GeocodeMissing
+
+	GeocodeMethodCount
+)
+
+func (g GeocodeMethod) String() string {
+	switch g {
+	case GeocodeWorld:
+		return "world"
+	case GeocodeFormatted:
+		return "formatted"
+	case GeocodeSupplementary:
+		return "supplementary"
+	case GeocodeHistoric:
+		return "historic"
+	case GeocodeSector:
+		return "sector"
+	case GeocodeMissing:
+		return "missing"
+	}
+	return "invalid"
+}
+
+// The letters used in the unit of a postcode, the last two characters of
+// its inward code
+const PostcodeUnitLetters = "ABDEFGHJLNPQRSTUWXYZ"
+
+// postcodeSector returns the sector of a postcode formatted by
+// formatGBPostcode, its outward code and the first digit of its inward
+// code, like N1 9, or false if it isn't well formed.
+func postcodeSector(formatted string) (string, bool) {
+	outward, inward, ok := strings.Cut(formatted, " ")
+	if !ok || outward == "" || len(inward) != 3 || !unicode.IsDigit(rune(inward[0])) {
+		return "", false
+	}
+	return outward + " " + inward[0:1], true
+}
+
+// PostcodePoints returns the location of a postcode, exactly as it's
+// given, or false if it isn't known.
+type PostcodePoints func(postcode string) (s2.Point, bool)
+
+// worldPostcodes returns the locations of the postcodes in w
+func worldPostcodes(w b6.World) PostcodePoints {
+	return func(postcode string) (s2.Point, bool) {
+		if p := b6.FindPointByID(b6.PointIDFromGBPostcode(postcode), w); p != nil {
+			return p.Point(), true
+		}
+		return s2.Point{}, false
+	}
+}
+
+// locateSector returns the centre of the postcodes of sector in points,
+// found by trying each of its possible units, or false if none are there.
+func locateSector(sector string, points PostcodePoints) (s2.Point, bool) {
+	lat, lng, n := 0.0, 0.0, 0
+	for _, a := range PostcodeUnitLetters {
+		for _, b := range PostcodeUnitLetters {
+			if p, ok := points(sector + string(a) + string(b)); ok {
+				ll := s2.LatLngFromPoint(p)
+				lat += ll.Lat.Degrees()
+				lng += ll.Lng.Degrees()
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return s2.Point{}, false
+	}
+	return s2.PointFromLatLng(s2.LatLngFromDegrees(lat/float64(n), lng/float64(n))), true
+}
+
+// PostcodeSources are the datasets used to locate postcodes missing from
+// the world, both of which are optional.
+type PostcodeSources struct {
+	// Locations given for postcodes that are missing, or wrong
+	Supplementary *Dataset
+	// The ONS Postcode Directory, which includes terminated postcodes
+	Historic *Dataset
+}
+
+func postcodeSources(data DataManifest) PostcodeSources {
+	return PostcodeSources{Supplementary: data.Get(DatasetGeocodes), Historic: data.Get(DatasetONSPD)}
+}
+
+// A GeocodeFallback records an organisation whose postcode wasn't found in
+// the world as it was given.
+type GeocodeFallback struct {
+	// The kind of organisation, like practice, or pharmacy
+	Kind     string
+	Code     string
+	Postcode string
+	Method   GeocodeMethod
+}
+
+// writeGeocodeFallbacks writes geocoding.csv, with the kind, code and
+// postcode of each organisation that was located by a fallback, or not
+// located, and how.
+func writeGeocodeFallbacks(fallbacks []*GeocodeFallback, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "geocoding.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"kind", "code", "postcode", "method"})
+	for _, fallback := range fallbacks {
+		w.Write([]string{fallback.Kind, fallback.Code, fallback.Postcode, fallback.Method.String()})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type pendingPostcode struct {
+	code     string
+	postcode string
+	located  func(s2.Point)
+}
+
+// PostcodeLocator locates the postcodes of organisations of a kind in a
+// world, as given, and then formatted by formatGBPostcode. Those that
+// aren't there are located, in turn, from supplementary geocodes, the
+// historic postcodes of the ONS Postcode Directory, which includes
+// postcodes that have since been terminated, and the centre of the
+// postcodes of their sector in the world. Since the directory is large,
+// postcodes missing from the world are collected, and looked up together
+// by Finish. Organisations located by a fallback, or not at all, are
+// recorded in the reads of the dataset from which they came, for
+// geocoding.csv.
+type PostcodeLocator struct {
+	points  PostcodePoints
+	kind    string
+	dataset *Dataset
+	pending map[string][]pendingPostcode
+
+	Located int
+	// Counts of the organisations located by each method
+	Methods [GeocodeMethodCount]int
+	Missing int
+	// The organisations located by a fallback, or not located
+	Fallbacks []*GeocodeFallback
+}
+
+func newPostcodeLocator(points PostcodePoints, kind string, dataset *Dataset) *PostcodeLocator {
+	return &PostcodeLocator{points: points, kind: kind, dataset: dataset, pending: make(map[string][]pendingPostcode)}
+}
+
+// Locate calls located with the location of the postcode of the
+// organisation with the given code, immediately if it's in the world, or
+// from Finish, if it's found by a fallback.
+func (l *PostcodeLocator) Locate(code string, postcode string, located func(s2.Point)) {
+	if p, ok := l.points(postcode); ok {
+		l.Located++
+		l.Methods[GeocodeWorld]++
+		located(p)
+		return
+	}
+	formatted := formatGBPostcode(postcode)
+	if formatted != postcode {
+		if p, ok := l.points(formatted); ok {
+			l.Located++
+			l.record(code, postcode, GeocodeFormatted)
+			located(p)
+			return
+		}
+	}
+	l.pending[formatted] = append(l.pending[formatted], pendingPostcode{code: code, postcode: postcode, located: located})
+}
+
+func (l *PostcodeLocator) record(code string, postcode string, method GeocodeMethod) {
+	l.Methods[method]++
+	f := &GeocodeFallback{Kind: l.kind, Code: code, Postcode: postcode, Method: method}
+	l.Fallbacks = append(l.Fallbacks, f)
+	recordGeocodeFallback(l.dataset, f)
+}
+
+// Finish locates the postcodes missing from the world using the fallbacks,
+// of which the datasets of sources are optional. Postcodes that none of
+// them locate remain missing.
+func (l *PostcodeLocator) Finish(sources PostcodeSources) error {
+	if len(l.pending) > 0 {
+		supplementary, err := readSupplementaryGeocodes(sources.Supplementary, l.pending)
+		if err != nil {
+			return err
+		}
+		wanted := make(map[string][]pendingPostcode)
+		for postcode, pending := range l.pending {
+			if _, ok := supplementary[postcode]; !ok {
+				wanted[postcode] = pending
+			}
+		}
+		historic := make(map[string]s2.Point)
+		if len(wanted) > 0 {
+			if historic, err = readHistoricPostcodes(sources.Historic, wanted); err != nil {
+				return err
+			}
+		}
+		sectors := make(map[string]s2.Point)
+		for postcode, pending := range l.pending {
+			method := GeocodeMissing
+			var p s2.Point
+			if g, ok := supplementary[postcode]; ok {
+				method, p = GeocodeSupplementary, g
+			} else if h, ok := historic[postcode]; ok {
+				method, p = GeocodeHistoric, h
+			} else if sector, ok := postcodeSector(postcode); ok {
+				s, ok := sectors[sector]
+				if !ok {
+					if s, ok = locateSector(sector, l.points); ok {
+						sectors[sector] = s
+					}
+				}
+				if ok {
+					method, p = GeocodeSector, s
+				}
+			}
+			for _, pp := range pending {
+				l.record(pp.code, pp.postcode, method)
+				if method == GeocodeMissing {
+					l.Missing++
+				} else {
+					pp.located(p)
+				}
+			}
+		}
+	}
+	l.pending = make(map[string][]pendingPostcode)
+	return nil
+}
+
+// readSupplementaryGeocodes returns the locations of the postcodes of
+// wanted from a CSV file with postcode, lat and lng columns, by postcode
+// in the form given by formatGBPostcode, or nothing if the file isn't
+// there. It's used for new postcodes, and those of organisations whose
+// location in the world is known to be wrong.
+func readSupplementaryGeocodes(dataset *Dataset, wanted map[string][]pendingPostcode) (map[string]s2.Point, error) {
+	r, err := openDataset(dataset)
+	if os.IsNotExist(err) {
+		Debugf("  no supplementary geocodes in %s", dataset.Filename)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"postcode", "lat", "lng"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+	located := make(map[string]s2.Point)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+		}
+		line, _ := r.FieldPos(0)
+		postcode := formatGBPostcode(row[columns[dataset.Column("postcode")]])
+		lat, err := parseFloat(row[columns[dataset.Column("lat")]])
+		if err != nil || lat < -90.0 || lat > 90.0 {
+			return nil, fmt.Errorf("%s:%d: bad latitude %q", dataset.Filename, line, row[columns[dataset.Column("lat")]])
+		}
+		lng, err := parseFloat(row[columns[dataset.Column("lng")]])
+		if err != nil || lng < -180.0 || lng > 180.0 {
+			return nil, fmt.Errorf("%s:%d: bad longitude %q", dataset.Filename, line, row[columns[dataset.Column("lng")]])
+		}
+		if _, ok := wanted[postcode]; ok {
+			located[postcode] = s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+		}
+	}
+	return located, nil
+}
+
+// readHistoricPostcodes returns the locations of the postcodes of wanted
+// from the ONS Postcode Directory, by postcode in the form given by
+// formatGBPostcode, or nothing if the directory isn't there.
+func readHistoricPostcodes(dataset *Dataset, wanted map[string][]pendingPostcode) (map[string]s2.Point, error) {
+	r, err := openDataset(dataset)
+	if os.IsNotExist(err) {
+		Debugf("  no historic postcodes in %s", dataset.Filename)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.ReuseRecord = true
+	row, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"postcode", "lat", "lng"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+	located := make(map[string]s2.Point)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", dataset.Filename, err)
+		}
+		postcode := formatGBPostcode(row[columns[dataset.Column("postcode")]])
+		if _, ok := wanted[postcode]; !ok {
+			continue
+		}
+		lat, err := parseFloat(row[columns[dataset.Column("lat")]])
+		if err != nil || lat >= ONSPDMissingLat {
+			continue
+		}
+		lng, err := parseFloat(row[columns[dataset.Column("lng")]])
+		if err != nil {
+			continue
+		}
+		located[postcode] = s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+	}
+	return located, nil
+}
+
+func (l *PostcodeLocator) Log() {
+	log.Printf("  missing locations: %d", l.Missing)
+	l.logFallbacks("  ")
+}
+
+// logFallbacks logs the number of organisations located by each fallback
+func (l *PostcodeLocator) logFallbacks(indent string) {
+	descriptions := map[GeocodeMethod]string{
+		GeocodeFormatted:     "located after formatting postcodes",
+		GeocodeSupplementary: "located from supplementary geocodes",
+		GeocodeHistoric:      "located from historic postcodes",
+		GeocodeSector:        "located at the centre of their postcode sector",
+	}
+	for method := GeocodeFormatted; method < GeocodeMissing; method++ {
+		if l.Methods[method] > 0 {
+			log.Printf("%s%s: %d", indent, descriptions[method], l.Methods[method])
+		}
+	}
+}
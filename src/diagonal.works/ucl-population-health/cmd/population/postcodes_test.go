@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/geo/s2"
+)
+
+// mapPostcodes returns the locations of the postcodes of points, in
+// place of those of a world
+func mapPostcodes(points map[string]s2.LatLng) PostcodePoints {
+	return func(postcode string) (s2.Point, bool) {
+		if ll, ok := points[postcode]; ok {
+			return s2.PointFromLatLng(ll), true
+		}
+		return s2.Point{}, false
+	}
+}
+
+func expectLatLng(t *testing.T, what string, p s2.Point, lat float64, lng float64) {
+	t.Helper()
+	ll := s2.LatLngFromPoint(p)
+	if math.Abs(ll.Lat.Degrees()-lat) > 1e-6 || math.Abs(ll.Lng.Degrees()-lng) > 1e-6 {
+		t.Errorf("%s: expected %f,%f, found %s", what, lat, lng, ll)
+	}
+}
+
+func TestPostcodeSector(t *testing.T) {
+	tests := []struct {
+		postcode string
+		sector   string
+		ok       bool
+	}{
+		{"N1 9AA", "N1 9", true},
+		{"SW1A 1AA", "SW1A 1", true},
+		{"E14 5AB", "E14 5", true},
+		{"N19AA", "", false},
+		{"N1 AAA", "", false},
+		{"N1 9A", "", false},
+		{" 9AA", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		sector, ok := postcodeSector(test.postcode)
+		if ok != test.ok || sector != test.sector {
+			t.Errorf("%q: expected %q, %v, found %q, %v", test.postcode, test.sector, test.ok, sector, ok)
+		}
+	}
+}
+
+func TestLocateSector(t *testing.T) {
+	points := mapPostcodes(map[string]s2.LatLng{
+		"N1 9AA": s2.LatLngFromDegrees(51.530, -0.120),
+		"N1 9ZZ": s2.LatLngFromDegrees(51.540, -0.100),
+		// In another sector
+		"N1 8AA": s2.LatLngFromDegrees(51.000, -1.000),
+	})
+	p, ok := locateSector("N1 9", points)
+	if !ok {
+		t.Fatalf("expected N1 9 to be located")
+	}
+	expectLatLng(t, "N1 9", p, 51.535, -0.110)
+	if _, ok := locateSector("N1 7", points); ok {
+		t.Errorf("expected a sector without postcodes not to be located")
+	}
+}
+
+func TestPostcodeLocatorFinish(t *testing.T) {
+	directory := t.TempDir()
+	supplementary := filepath.Join(directory, "geocodes.csv")
+	if err := os.WriteFile(supplementary, []byte("postcode,lat,lng\n# Corrected\nsw1a1aa,51.501,-0.141\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	historic := filepath.Join(directory, "onspd.csv")
+	writeGzippedCSV(t, historic,
+		"pcds,lat,long",
+		// Also supplementary, which takes precedence
+		"SW1A 1AA,50.000,-1.000",
+		"SW1A 2AA,51.503,-0.127",
+		// Without a grid reference, so located by its sector
+		"N1 9ZZ,99.999999,0.000000",
+	)
+	reads := newDatasetReads()
+	sources := PostcodeSources{
+		Supplementary: &Dataset{Filename: supplementary, Columns: map[string]string{"postcode": "postcode", "lat": "lat", "lng": "lng"}, reads: reads},
+		Historic:      &Dataset{Filename: historic, Columns: map[string]string{"postcode": "pcds", "lat": "lat", "lng": "long"}, reads: reads},
+	}
+	points := mapPostcodes(map[string]s2.LatLng{
+		"N1 9AA": s2.LatLngFromDegrees(51.530, -0.120),
+		"N1 9AB": s2.LatLngFromDegrees(51.540, -0.100),
+	})
+	locator := newPostcodeLocator(points, "practice", &Dataset{Filename: "gp-practices.csv", reads: reads})
+	located := make(map[string]s2.Point)
+	for _, o := range []struct {
+		code     string
+		postcode string
+	}{
+		{"G1", "N1 9AA"},
+		{"G2", "n19ab"},
+		{"G3", "SW1A 1AA"},
+		{"G4", "SW1A 2AA"},
+		{"G5", "N1 9ZZ"},
+		{"G6", "NOWHERE"},
+	} {
+		code := o.code
+		locator.Locate(code, o.postcode, func(p s2.Point) { located[code] = p })
+	}
+	if len(located) != 2 {
+		t.Errorf("expected postcodes in the world to be located immediately, found %d", len(located))
+	}
+	if err := locator.Finish(sources); err != nil {
+		t.Fatal(err)
+	}
+
+	expectLatLng(t, "G1", located["G1"], 51.530, -0.120)
+	expectLatLng(t, "G2", located["G2"], 51.540, -0.100)
+	expectLatLng(t, "G3", located["G3"], 51.501, -0.141)
+	expectLatLng(t, "G4", located["G4"], 51.503, -0.127)
+	expectLatLng(t, "G5", located["G5"], 51.535, -0.110)
+	if _, ok := located["G6"]; ok {
+		t.Errorf("expected G6 not to be located")
+	}
+	if locator.Located != 2 || locator.Missing != 1 {
+		t.Errorf("expected 2 located in the world, and 1 missing, found %d and %d", locator.Located, locator.Missing)
+	}
+
+	methods := map[string]GeocodeMethod{"G2": GeocodeFormatted, "G3": GeocodeSupplementary, "G4": GeocodeHistoric, "G5": GeocodeSector, "G6": GeocodeMissing}
+	fallbacks := reads.GeocodeFallbacks()
+	if len(fallbacks) != len(methods) {
+		t.Fatalf("expected %d fallbacks, found %d", len(methods), len(fallbacks))
+	}
+	for i, f := range fallbacks {
+		if i > 0 && fallbacks[i-1].Code >= f.Code {
+			t.Errorf("expected fallbacks in order of code")
+		}
+		if f.Kind != "practice" || f.Method != methods[f.Code] {
+			t.Errorf("%s: expected %s, found %s %s", f.Code, methods[f.Code], f.Kind, f.Method)
+		}
+	}
+	if f := fallbacks[0]; f.Code != "G2" || f.Postcode != "n19ab" {
+		t.Errorf("expected the postcode as given, found %s for %s", f.Postcode, f.Code)
+	}
+	if reads.clone().GeocodeFallbacks()[0].Code != "G2" {
+		t.Errorf("expected fallbacks to be cloned with reads")
+	}
+	if fallbacks := newDatasetReads().GeocodeFallbacks(); len(fallbacks) != 0 {
+		t.Errorf("expected fallbacks to be recorded only in the reads of the run, found %d elsewhere", len(fallbacks))
+	}
+}
+
+func TestPostcodeLocatorFinishWithoutSources(t *testing.T) {
+	directory := t.TempDir()
+	missing := &Dataset{Filename: filepath.Join(directory, "missing.csv"), Columns: map[string]string{"postcode": "postcode", "lat": "lat", "lng": "lng"}}
+	sources := PostcodeSources{Supplementary: missing, Historic: missing}
+	points := mapPostcodes(map[string]s2.LatLng{"N1 9AA": s2.LatLngFromDegrees(51.530, -0.120)})
+	locator := newPostcodeLocator(points, "pharmacy", &Dataset{Filename: "pharmacies.csv"})
+	var location s2.Point
+	locator.Locate("F1", "N1 9XX", func(p s2.Point) { location = p })
+	if err := locator.Finish(sources); err != nil {
+		t.Fatal(err)
+	}
+	expectLatLng(t, "F1", location, 51.530, -0.120)
+	if locator.Methods[GeocodeSector] != 1 || len(locator.Fallbacks) != 1 {
+		t.Errorf("expected F1 to be located by its sector, found %v", locator.Methods)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/geo/s2"
+)
+
+// The psql script written by --format=postgis, loaded with
+// psql -f population.sql
+const PostGISFilename = "population.sql"
+
+// postgisExporter writes a psql script that replaces the people, practices
+// and aggregates tables in a single transaction, loading them with COPY,
+// so that loading needs no more than psql. Practices have their location
+// as a PostGIS point, and each table has the provenance as its comment.
+type postgisExporter struct {
+	data *ExportData
+	f    *os.File
+	w    *bufio.Writer
+	// The error with which a table failed, if any, after which Close
+	// removes the script, rather than committing a partial load
+	err error
+	// The fields of each table written, so that Close indexes only the
+	// tables, and columns, that are there
+	written map[string][]ArrowField
+}
+
+func newPostGISExporter(data *ExportData) (*postgisExporter, error) {
+	f, err := os.OpenFile(filepath.Join(data.OutputDirectory, PostGISFilename), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &postgisExporter{data: data, f: f, w: bufio.NewWriter(f), written: make(map[string][]ArrowField)}
+	for _, line := range data.Provenance.Lines() {
+		p.w.WriteString("-- " + strings.ReplaceAll(line, "\n", " ") + "\n")
+	}
+	p.w.WriteString("\\set ON_ERROR_STOP on\nBEGIN;\nCREATE EXTENSION IF NOT EXISTS postgis;\n")
+	return p, nil
+}
+
+func postgisType(t ArrowType) string {
+	switch t {
+	case ArrowTypeInt64:
+		return "BIGINT"
+	case ArrowTypeFloat64:
+		return "DOUBLE PRECISION"
+	}
+	return "TEXT"
+}
+
+// postgisEscape returns v as a value in COPY's text format, with empty
+// numbers as nulls.
+func postgisEscape(v string, t ArrowType) string {
+	if v == "" && t != ArrowTypeUtf8 {
+		return `\N`
+	}
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(v)
+}
+
+func postgisQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// table writes the statements that create and load table as name. If
+// geometry isn't nil, it's called with the index of each row, and its
+// result added as a final geom column.
+func (p *postgisExporter) table(name string, table *ExportTable, geometry func(i int) (s2.Point, bool)) error {
+	names := make([]string, 0, len(table.Fields)+1)
+	definitions := make([]string, 0, len(table.Fields)+1)
+	for _, field := range table.Fields {
+		names = append(names, fmt.Sprintf("%q", field.Name))
+		definitions = append(definitions, fmt.Sprintf("%q %s", field.Name, postgisType(field.Type)))
+	}
+	if geometry != nil {
+		names = append(names, "geom")
+		definitions = append(definitions, "geom geometry(Point, 4326)")
+	}
+	fmt.Fprintf(p.w, "DROP TABLE IF EXISTS %s;\n", name)
+	fmt.Fprintf(p.w, "CREATE TABLE %s (%s);\n", name, strings.Join(definitions, ", "))
+	fmt.Fprintf(p.w, "COMMENT ON TABLE %s IS %s;\n", name, postgisQuote(strings.Join(p.data.Provenance.Lines(), "\n")))
+	fmt.Fprintf(p.w, "COPY %s (%s) FROM stdin;\n", name, strings.Join(names, ", "))
+	values := make([]string, 0, len(table.Fields)+1)
+	i := 0
+	err := table.Rows(func(row []string) error {
+		values = values[0:0]
+		for j, v := range row {
+			values = append(values, postgisEscape(v, table.Fields[j].Type))
+		}
+		if geometry != nil {
+			if point, ok := geometry(i); ok {
+				ll := s2.LatLngFromPoint(point)
+				values = append(values, fmt.Sprintf("SRID=4326;POINT(%f %f)", ll.Lng.Degrees(), ll.Lat.Degrees()))
+			} else {
+				values = append(values, `\N`)
+			}
+		}
+		i++
+		_, err := p.w.WriteString(strings.Join(values, "\t") + "\n")
+		return err
+	})
+	if err != nil {
+		p.err = err
+		return err
+	}
+	p.w.WriteString("\\.\n")
+	p.written[name] = table.Fields
+	return nil
+}
+
+func (p *postgisExporter) People(columns []PersonColumn, people PersonStream) error {
+	return p.table("people", peopleTable(columns, people), nil)
+}
+
+func (p *postgisExporter) Practices(practices []*GPPractice, table *ExportTable) error {
+	var invalid s2.Point
+	return p.table("practices", table, func(i int) (s2.Point, bool) {
+		return practices[i].Location, practices[i].Location != invalid
+	})
+}
+
+func (p *postgisExporter) Aggregates(results []*AggregationResult, table *ExportTable) error {
+	return p.table("aggregates", table, nil)
+}
+
+func (p *postgisExporter) Close() error {
+	if p.err != nil {
+		p.f.Close()
+		return os.Remove(p.f.Name())
+	}
+	for _, field := range p.written["people"] {
+		if field.Name == "gp" {
+			p.w.WriteString("CREATE INDEX people_gp ON people (gp);\n")
+		}
+	}
+	if _, ok := p.written["practices"]; ok {
+		p.w.WriteString("CREATE INDEX practices_geom ON practices USING GIST (geom);\n")
+	}
+	p.w.WriteString("COMMIT;\n")
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPostGISTable(rows [][]string, err error) *ExportTable {
+	return &ExportTable{
+		Fields: []ArrowField{{Name: "id", Type: ArrowTypeInt64}, {Name: "name", Type: ArrowTypeUtf8}},
+		Rows: func(each func(row []string) error) error {
+			for _, row := range rows {
+				if err := each(row); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+	}
+}
+
+func TestPostGISExporterWritesScript(t *testing.T) {
+	data := &ExportData{OutputDirectory: t.TempDir(), Provenance: &Provenance{Synthetic: true, Notice: ProvenanceNotice}}
+	p, err := newPostGISExporter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Aggregates(nil, testPostGISTable([][]string{{"1", "a\tb"}, {"", ""}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(data.OutputDirectory, PostGISFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(b)
+	for _, expected := range []string{"BEGIN;\n", "CREATE TABLE aggregates (\"id\" BIGINT, \"name\" TEXT);\n", "1\ta\\tb\n\\N\t\n\\.\n", "COMMIT;\n"} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected script to contain %q", expected)
+		}
+	}
+}
+
+func TestPostGISExporterRemovesScriptAfterError(t *testing.T) {
+	data := &ExportData{OutputDirectory: t.TempDir(), Provenance: &Provenance{Synthetic: true, Notice: ProvenanceNotice}}
+	p, err := newPostGISExporter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Aggregates(nil, testPostGISTable([][]string{{"1", "a"}}, fmt.Errorf("failed"))); err == nil {
+		t.Fatal("expected an error from the table")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(data.OutputDirectory, PostGISFilename)); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, found %v", PostGISFilename, err)
+	}
+}
+
+func TestPostGISExporterIndexesWrittenTables(t *testing.T) {
+	gp := PersonColumn{Name: "gp", Value: func(p *Person) string { return p.GP.String() }}
+	age := PersonColumn{Name: "age", SQLType: "INTEGER", Value: func(p *Person) string { return fmt.Sprintf("%d", p.Age) }}
+	people := func(each func(p *Person) error) error {
+		return each(&Person{Age: 40, GP: "G1"})
+	}
+	tests := []struct {
+		columns   []PersonColumn
+		practices bool
+		indexes   []string
+	}{
+		{nil, false, nil},
+		{[]PersonColumn{age, gp}, false, []string{"people_gp"}},
+		// Profiles may leave out the practice
+		{[]PersonColumn{age}, true, []string{"practices_geom"}},
+		{[]PersonColumn{gp}, true, []string{"people_gp", "practices_geom"}},
+	}
+	for i, test := range tests {
+		data := &ExportData{OutputDirectory: t.TempDir(), Provenance: &Provenance{Synthetic: true, Notice: ProvenanceNotice}}
+		p, err := newPostGISExporter(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.columns != nil {
+			if err := p.People(test.columns, people); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.practices {
+			table := &ExportTable{
+				Fields: []ArrowField{{Name: "code", Type: ArrowTypeUtf8}},
+				Rows: func(each func(row []string) error) error {
+					return each([]string{"G1"})
+				},
+			}
+			if err := p.Practices([]*GPPractice{{Code: "G1"}}, table); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Aggregates(nil, testPostGISTable(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(data.OutputDirectory, PostGISFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(b), "CREATE INDEX"); n != len(test.indexes) {
+			t.Errorf("%d: expected %d indexes, found %d", i, len(test.indexes), n)
+		}
+		for _, index := range test.indexes {
+			if !strings.Contains(string(b), "CREATE INDEX "+index+" ") {
+				t.Errorf("%d: expected index %s", i, index)
+			}
+		}
+	}
+}
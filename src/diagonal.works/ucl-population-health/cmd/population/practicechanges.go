@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// PracticeMerge closes one practice, moving its list, and the capacity to
+// serve it, into another.
+type PracticeMerge struct {
+	From GPPracticeCode
+	Into GPPracticeCode
+}
+
+// PracticeOpening adds a practice that isn't in the GP practices dataset,
+// located by postcode, or by lat and lng if it has none yet.
+type PracticeOpening struct {
+	Code     GPPracticeCode
+	Name     string
+	Postcode string
+	Lat      float64
+	Lng      float64
+	// The number of patients the practice is expected to register, used in
+	// place of the reported list size when assigning people
+	ListSize    int `yaml:"listsize"`
+	Practioners int
+	// Defaults to North Central London
+	ICB ICBCode
+}
+
+// PracticeChanges are applied to the GP practices before people are
+// assigned to them, allowing the effect of closures, mergers and new
+// practices on their neighbours to be simulated.
+type PracticeChanges struct {
+	Close []GPPracticeCode
+	Merge []PracticeMerge
+	Open  []PracticeOpening
+	// The output directory of a run without the changes, whose gps.csv is
+	// compared against in practice-changes.csv, if given
+	Baseline string
+}
+
+func (p *PracticeChanges) IsEmpty() bool {
+	return len(p.Close) == 0 && len(p.Merge) == 0 && len(p.Open) == 0
+}
+
+func (p *PracticeChanges) validate() error {
+	changed := make(map[GPPracticeCode]struct{})
+	change := func(code GPPracticeCode) error {
+		if code == GPPracticeCodeInvalid {
+			return fmt.Errorf("practices: missing practice code")
+		} else if _, ok := changed[code]; ok {
+			return fmt.Errorf("practices: %s is changed more than once", code)
+		}
+		changed[code] = struct{}{}
+		return nil
+	}
+	for _, code := range p.Close {
+		if err := change(code); err != nil {
+			return err
+		}
+	}
+	for _, m := range p.Merge {
+		if m.From == m.Into {
+			return fmt.Errorf("practices: can't merge %s into itself", m.From)
+		}
+		if err := change(m.From); err != nil {
+			return err
+		}
+	}
+	for _, m := range p.Merge {
+		if _, ok := changed[m.Into]; ok {
+			return fmt.Errorf("practices: can't merge %s into %s, as it's also closed or merged", m.From, m.Into)
+		}
+	}
+	for _, o := range p.Open {
+		if err := change(o.Code); err != nil {
+			return err
+		}
+		if o.ListSize <= 0 {
+			return fmt.Errorf("practices: new practice %s needs a positive listsize", o.Code)
+		}
+		if o.Postcode == "" && o.Lat == 0.0 && o.Lng == 0.0 {
+			return fmt.Errorf("practices: new practice %s needs a postcode, or lat and lng", o.Code)
+		}
+	}
+	return nil
+}
+
+// PracticeChange records how a practice was changed by the scenario, and
+// its reported list size beforehand.
+type PracticeChange struct {
+	Change   string
+	ListSize int
+}
+
+// mergePrevalence returns the prevalence of the combined list of two
+// practices, or that of one alone, if the other's is unknown.
+func mergePrevalence(p1 float64, n1 int, p2 float64, n2 int) float64 {
+	if p1 == 0.0 || n1 == 0 {
+		return p2
+	} else if p2 == 0.0 || n2 == 0 {
+		return p1
+	}
+	return (p1*float64(n1) + p2*float64(n2)) / float64(n1+n2)
+}
+
+func mergePractice(from *GPPractice, into *GPPractice) {
+	for condition := range from.ConditionPrevalence {
+		into.ConditionPrevalence[condition] = mergePrevalence(from.ConditionPrevalence[condition], from.ListSize, into.ConditionPrevalence[condition], into.ListSize)
+	}
+	for condition := range from.ReportedConditionPrevalence {
+		into.ReportedConditionPrevalence[condition] = mergePrevalence(from.ReportedConditionPrevalence[condition], from.ListSize, into.ReportedConditionPrevalence[condition], into.ListSize)
+	}
+	into.SmokingPrevalence = mergePrevalence(from.SmokingPrevalence, from.ListSize, into.SmokingPrevalence, into.ListSize)
+	if from.Prescribing != nil {
+		if into.Prescribing == nil {
+			into.Prescribing = NewPrescribing()
+		}
+		for chapter, items := range from.Prescribing.ItemsByChapter {
+			into.Prescribing.ItemsByChapter[chapter] += items
+		}
+		for chapter, cost := range from.Prescribing.CostByChapter {
+			into.Prescribing.CostByChapter[chapter] += cost
+		}
+		for condition, items := range from.Prescribing.ItemsByConditionDrug {
+			into.Prescribing.ItemsByConditionDrug[condition] += items
+		}
+	}
+	into.ListSize += from.ListSize
+	into.Practioners += from.Practioners
+	into.Appointments += from.Appointments
+	into.AppointmentsFaceToFace += from.AppointmentsFaceToFace
+	for i := range from.AppointmentsByType {
+		into.AppointmentsByType[i] += from.AppointmentsByType[i]
+	}
+}
+
+func closePractice(gp *GPPractice) {
+	gp.Status = GPPracticeStatusClosed
+	gp.ListSize = 0
+}
+
+// applyPracticeChanges closes, merges and opens practices, before people
+// are assigned to them. Since practices without a list aren't assigned
+// people, the patients of closed practices are divided between their
+// neighbours, in proportion to their list sizes. New practices are added
+// to the nearby practices of the LSOAs around them, and their condition
+// prevalences are imputed from their neighbours.
+func applyPracticeChanges(changes *PracticeChanges, icb ICBCode, gps map[GPPracticeCode]*GPPractice, nearbyGPs NearbyGPs, rurality *RuralityModel, parameters SimulationParameters, w b6.World) (map[GPPracticeCode]*PracticeChange, error) {
+	applied := make(map[GPPracticeCode]*PracticeChange)
+	for _, code := range changes.Close {
+		gp, ok := gps[code]
+		if !ok {
+			return nil, fmt.Errorf("practices: can't close %s, as it doesn't exist", code)
+		}
+		applied[code] = &PracticeChange{Change: "close", ListSize: gp.ListSize}
+		log.Printf("  close %s %s: list size: %d", code, gp.Name, gp.ListSize)
+		closePractice(gp)
+	}
+	for _, m := range changes.Merge {
+		from, ok := gps[m.From]
+		if !ok {
+			return nil, fmt.Errorf("practices: can't merge %s, as it doesn't exist", m.From)
+		}
+		into, ok := gps[m.Into]
+		if !ok {
+			return nil, fmt.Errorf("practices: can't merge into %s, as it doesn't exist", m.Into)
+		}
+		applied[m.From] = &PracticeChange{Change: "merge", ListSize: from.ListSize}
+		if _, ok := applied[m.Into]; !ok {
+			applied[m.Into] = &PracticeChange{Change: "merged", ListSize: into.ListSize}
+		}
+		log.Printf("  merge %s %s into %s %s: list size: %d + %d", m.From, from.Name, m.Into, into.Name, from.ListSize, into.ListSize)
+		mergePractice(from, into)
+		closePractice(from)
+	}
+
+	opened := make(map[GPPracticeCode]*GPPractice)
+	invalid := s2.Point{}
+	for _, o := range changes.Open {
+		if _, ok := gps[o.Code]; ok {
+			return nil, fmt.Errorf("practices: can't open %s, as it already exists", o.Code)
+		}
+		gp := &GPPractice{
+			Code:                        o.Code,
+			Name:                        o.Name,
+			ICB:                         o.ICB,
+			Status:                      GPPracticeStatusActive,
+			Practioners:                 o.Practioners,
+			Postcode:                    o.Postcode,
+			ListSize:                    o.ListSize,
+			ConditionPrevalence:         make(map[QOFCondition]float64),
+			ReportedConditionPrevalence: make(map[QOFCondition]float64),
+			ConditionBias:               make(map[QOFCondition]float64),
+			SimulatedConditionCounts:    make(map[QOFCondition]int),
+		}
+		if gp.ICB == "" {
+			gp.ICB = icb
+		}
+		if o.Postcode != "" {
+			if p, ok := locatePostcode(o.Postcode, w); ok {
+				gp.Location = p
+			}
+		}
+		if gp.Location == invalid && (o.Lat != 0.0 || o.Lng != 0.0) {
+			gp.Location = s2.PointFromLatLng(s2.LatLngFromDegrees(o.Lat, o.Lng))
+		}
+		if gp.Location == invalid {
+			return nil, fmt.Errorf("practices: no location for new practice %s at %q", o.Code, o.Postcode)
+		}
+		gp.LSOA = lsoaContaining(gp.Location, w)
+		gps[o.Code] = gp
+		opened[o.Code] = gp
+		applied[o.Code] = &PracticeChange{Change: "open"}
+		log.Printf("  open %s %s: list size: %d", o.Code, o.Name, o.ListSize)
+	}
+	if len(opened) > 0 {
+		nearby, err := buildNearbyGPs(opened, b6.MetersToAngle(rurality.SearchRadiusM(parameters)), w, 1, NoProgress{})
+		if err != nil {
+			return nil, err
+		}
+		for lsoa, added := range nearby {
+			nearbyGPs[lsoa] = append(nearbyGPs[lsoa], added...)
+		}
+	}
+	return applied, nil
+}
+
+// practiceNeighbours returns the practices sharing an LSOA, in their
+// nearby practices, with a changed practice, and so likely to be affected
+// by the change.
+func practiceNeighbours(applied map[GPPracticeCode]*PracticeChange, nearbyGPs NearbyGPs) GPPracticeCodeSet {
+	neighbours := make(GPPracticeCodeSet)
+	for _, gps := range nearbyGPs {
+		affected := false
+		for _, gp := range gps {
+			if _, ok := applied[gp.Practice]; ok {
+				affected = true
+				break
+			}
+		}
+		if affected {
+			for _, gp := range gps {
+				if _, ok := applied[gp.Practice]; !ok {
+					neighbours[gp.Practice] = struct{}{}
+				}
+			}
+		}
+	}
+	return neighbours
+}
+
+// baselinePractice holds the simulated list size and condition counts of
+// a practice in gps.csv, as written by a baseline run.
+type baselinePractice struct {
+	SimulatedListSize int
+	ConditionCounts   map[QOFCondition]int
+}
+
+func readBaselinePractices(directory string, conditions []QOFCondition) (map[GPPracticeCode]*baselinePractice, error) {
+	filename := filepath.Join(directory, "gps.csv")
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, column := range row {
+		columns[column] = i
+	}
+	required := []string{"code", "simulated_list_size"}
+	for _, condition := range conditions {
+		required = append(required, fmt.Sprintf("simulated_prevalence_%s", condition))
+	}
+	for _, column := range required {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", filename, column)
+		}
+	}
+	baseline := make(map[GPPracticeCode]*baselinePractice)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		b := &baselinePractice{ConditionCounts: make(map[QOFCondition]int)}
+		if b.SimulatedListSize, err = strconv.Atoi(row[columns["simulated_list_size"]]); err != nil {
+			return nil, fmt.Errorf("%s: bad simulated_list_size: %s", filename, err)
+		}
+		for _, condition := range conditions {
+			column := fmt.Sprintf("simulated_prevalence_%s", condition)
+			if prevalence, err := strconv.ParseFloat(row[columns[column]], 64); err == nil && !math.IsNaN(prevalence) {
+				b.ConditionCounts[condition] = int(math.Round(prevalence * float64(b.SimulatedListSize)))
+			}
+		}
+		baseline[GPPracticeCode(row[columns["code"]])] = b
+	}
+	return baseline, nil
+}
+
+// writePracticeChanges writes practice-changes.csv, with the simulated
+// list size and condition counts of each changed practice, and its
+// neighbours, alongside those of the baseline run, if given.
+func writePracticeChanges(changes *PracticeChanges, applied map[GPPracticeCode]*PracticeChange, scenario string, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, outputDirectory string) error {
+	var baseline map[GPPracticeCode]*baselinePractice
+	if changes.Baseline != "" {
+		var err error
+		if baseline, err = readBaselinePractices(changes.Baseline, conditions); err != nil {
+			return err
+		}
+	}
+	codes := make([]GPPracticeCode, 0, len(applied))
+	for code := range applied {
+		codes = append(codes, code)
+	}
+	for code := range practiceNeighbours(applied, nearbyGPs) {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "practice-changes.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"scenario", "code", "name", "change", "list_size", "scenario_list_size", "baseline_simulated_list_size", "simulated_list_size"}
+	for _, condition := range conditions {
+		header = append(header, fmt.Sprintf("baseline_simulated_%s", condition), fmt.Sprintf("simulated_%s", condition))
+	}
+	w.Write(header)
+	gained := 0
+	for _, code := range codes {
+		gp := gps[code]
+		change, listSize := "neighbour", gp.ListSize
+		if a, ok := applied[code]; ok {
+			change, listSize = a.Change, a.ListSize
+		}
+		row := []string{scenario, code.String(), gp.Name, change, strconv.Itoa(listSize), strconv.Itoa(gp.ListSize), "", strconv.Itoa(gp.SimulatedListSize)}
+		b, ok := baseline[code]
+		if ok {
+			row[6] = strconv.Itoa(b.SimulatedListSize)
+			if change == "neighbour" {
+				gained += gp.SimulatedListSize - b.SimulatedListSize
+			}
+		}
+		for _, condition := range conditions {
+			if ok {
+				row = append(row, strconv.Itoa(b.ConditionCounts[condition]))
+			} else {
+				row = append(row, "")
+			}
+			row = append(row, strconv.Itoa(gp.SimulatedConditionCounts[condition]))
+		}
+		w.Write(row)
+	}
+	log.Printf("  practice changes: %d changed, %d neighbours", len(applied), len(codes)-len(applied))
+	if baseline != nil {
+		log.Printf("    neighbours gained %d patients from the baseline", gained)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
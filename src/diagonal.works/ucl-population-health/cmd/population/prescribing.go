@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	EPDYearMonthColumn         = "YEAR_MONTH"
+	EPDPracticeCodeColumn      = "PRACTICE_CODE"
+	EPDBNFCodeColumn           = "BNF_CODE"
+	EPDChemicalSubstanceColumn = "BNF_CHEMICAL_SUBSTANCE"
+	EPDItemsColumn             = "ITEMS"
+	EPDActualCostColumn        = "ACTUAL_COST"
+
+	// BNF chapters 1 to 15 cover medicines, higher chapters cover
+	// appliances and dressings, which we combine into one
+	BNFChapterFirst  = 1
+	BNFChapterLast   = 15
+	BNFChapterOther  = 0
+	BNFChapterLength = 2
+)
+
+func BNFChapters() []int {
+	chapters := make([]int, 0, BNFChapterLast-BNFChapterFirst+2)
+	for c := BNFChapterFirst; c <= BNFChapterLast; c++ {
+		chapters = append(chapters, c)
+	}
+	return append(chapters, BNFChapterOther)
+}
+
+func BNFChapterFromCode(code string) int {
+	if len(code) >= BNFChapterLength {
+		var chapter int
+		if _, err := fmt.Sscanf(code[0:BNFChapterLength], "%d", &chapter); err == nil {
+			if chapter >= BNFChapterFirst && chapter <= BNFChapterLast {
+				return chapter
+			}
+		}
+	}
+	return BNFChapterOther
+}
+
+func BNFChapterString(chapter int) string {
+	if chapter == BNFChapterOther {
+		return "other"
+	}
+	return fmt.Sprintf("%02d", chapter)
+}
+
+// Chemical substances whose prescribing volume indicates the presence of
+// a condition. Metformin is also prescribed for non-diabetic
+// hyperglycaemia, and salbutamol and terbutaline (short acting beta
+// agonists) for asthma, so the signal is noisy.
+var PrescribingConditionSubstances = map[QOFCondition][]string{
+	QOFConditionDiabetes: {"0601022B0"},              // Metformin hydrochloride
+	QOFConditionCOPD:     {"0301011R0", "0301011V0"}, // Salbutamol, terbutaline sulfate
+}
+
+// Prescribing holds monthly average prescribing for a GP practice
+type Prescribing struct {
+	ItemsByChapter       map[int]float64
+	CostByChapter        map[int]float64
+	ItemsByConditionDrug map[QOFCondition]float64
+}
+
+func NewPrescribing() *Prescribing {
+	return &Prescribing{
+		ItemsByChapter:       make(map[int]float64),
+		CostByChapter:        make(map[int]float64),
+		ItemsByConditionDrug: make(map[QOFCondition]float64),
+	}
+}
+
+// openMaybeGzipped opens filename, decompressing it if it's gzipped, as
+// judged by its first bytes rather than its name.
+func openMaybeGzipped(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	b := bufio.NewReader(f)
+	if magic, err := b.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{b, f}, nil
+	}
+	g, err := gzip.NewReader(b)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{g, f}, nil
+}
+
+// readPrescribing reads one or more monthly files from the NHSBSA English
+// Prescribing Dataset, see
+// https://opendata.nhsbsa.net/dataset/english-prescribing-data-epd
+// and assigns the monthly average items and cost by BNF chapter to
+// each GP practice, or the successor of practices that have since closed.
+func readPrescribing(filenames []string, gps map[GPPracticeCode]*GPPractice, successors GPPracticeSuccessors) error {
+	substances := make(map[string]QOFCondition)
+	for condition, codes := range PrescribingConditionSubstances {
+		for _, code := range codes {
+			substances[code] = condition
+		}
+	}
+	months := make(map[string]struct{})
+	rows := 0
+	missingGPs := 0
+	remapped := 0
+	badRows := 0
+	for _, filename := range filenames {
+		f, err := openMaybeGzipped(filename)
+		if err != nil {
+			return err
+		}
+		r := csv.NewReader(f)
+		r.ReuseRecord = true
+		columns := make(map[string]int)
+		row, err := r.Read()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		for i, column := range row {
+			columns[strings.TrimSpace(column)] = i
+		}
+		for _, column := range []string{EPDYearMonthColumn, EPDPracticeCodeColumn, EPDBNFCodeColumn, EPDChemicalSubstanceColumn, EPDItemsColumn, EPDActualCostColumn} {
+			if _, ok := columns[column]; !ok {
+				f.Close()
+				return fmt.Errorf("%s: no %s column", filename, column)
+			}
+		}
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return err
+			}
+			rows++
+			months[row[columns[EPDYearMonthColumn]]] = struct{}{}
+			code := GPPracticeCode(row[columns[EPDPracticeCodeColumn]])
+			current := successors.Current(code, gps)
+			gp, ok := gps[current]
+			if !ok {
+				missingGPs++
+				continue
+			} else if current != code {
+				remapped++
+			}
+			items, err := parseFloat(row[columns[EPDItemsColumn]])
+			if err != nil {
+				badRows++
+				continue
+			}
+			cost, err := parseFloat(row[columns[EPDActualCostColumn]])
+			if err != nil {
+				badRows++
+				continue
+			}
+			if gp.Prescribing == nil {
+				gp.Prescribing = NewPrescribing()
+			}
+			chapter := BNFChapterFromCode(row[columns[EPDBNFCodeColumn]])
+			gp.Prescribing.ItemsByChapter[chapter] += items
+			gp.Prescribing.CostByChapter[chapter] += cost
+			if condition, ok := substances[row[columns[EPDChemicalSubstanceColumn]]]; ok {
+				gp.Prescribing.ItemsByConditionDrug[condition] += items
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if len(months) > 0 {
+		n := float64(len(months))
+		for _, gp := range gps {
+			if gp.Prescribing != nil {
+				for chapter := range gp.Prescribing.ItemsByChapter {
+					gp.Prescribing.ItemsByChapter[chapter] /= n
+					gp.Prescribing.CostByChapter[chapter] /= n
+				}
+				for condition := range gp.Prescribing.ItemsByConditionDrug {
+					gp.Prescribing.ItemsByConditionDrug[condition] /= n
+				}
+			}
+		}
+	}
+	log.Printf("prescribing: %d rows over %d months", rows, len(months))
+	log.Printf("  missing gps: %d", missingGPs)
+	log.Printf("  remapped to successors: %d", remapped)
+	log.Printf("  bad rows: %d", badRows)
+	return nil
+}
+
+// blendPrescribingPrevalence adjusts the reported prevalence of conditions
+// with an indicative prescribing signal towards the prevalence implied by
+// the practice's prescribing volume per patient, relative to the average
+// across practices. A weight of 0 leaves reported prevalences unchanged,
+// while 1 replaces them entirely.
+func blendPrescribingPrevalence(gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, weight float64) {
+	log.Printf("blend prescribing prevalence: weight %.02f", weight)
+	for _, condition := range conditions {
+		if _, ok := PrescribingConditionSubstances[condition]; !ok {
+			continue
+		}
+		items := 0.0
+		patients := 0.0
+		prevalence := 0.0
+		for _, gp := range gps {
+			if gp.Prescribing != nil && gp.ListSize > 0 && gp.ConditionPrevalence[condition] > 0.0 {
+				items += gp.Prescribing.ItemsByConditionDrug[condition]
+				patients += float64(gp.ListSize)
+				prevalence += gp.ConditionPrevalence[condition] * float64(gp.ListSize)
+			}
+		}
+		if items == 0.0 {
+			log.Printf("  %s: no prescribing", condition)
+			continue
+		}
+		itemsPerPatient := items / patients
+		prevalence /= patients
+		adjusted := 0
+		change := 0.0
+		for _, gp := range gps {
+			if gp.Prescribing != nil && gp.ListSize > 0 && gp.ConditionPrevalence[condition] > 0.0 {
+				relative := (gp.Prescribing.ItemsByConditionDrug[condition] / float64(gp.ListSize)) / itemsPerPatient
+				implied := clamp(relative*prevalence, 0.0, 1.0)
+				blended := (1.0-weight)*gp.ConditionPrevalence[condition] + weight*implied
+				change += blended - gp.ConditionPrevalence[condition]
+				gp.ConditionPrevalence[condition] = blended
+				adjusted++
+			}
+		}
+		log.Printf("  %s: adjusted: %d mean change: %f", condition, adjusted, change/float64(adjusted))
+	}
+}
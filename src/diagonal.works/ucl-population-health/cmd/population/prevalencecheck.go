@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkPrevalences reads each document of the prevalences in filename, as
+// readPrevalences does, and returns a description of each problem found
+// with them, prefixed by the line at which the document starts, followed
+// by warnings, of age ranges that leave gaps, whose ages are simulated
+// with a prevalence of zero. Problems
+// are unknown fields, diagnoses that can't be parsed or that contradict
+// themselves, age ranges for a sex that overlap, prevalences
+// outside [0,1], relative rates given for anything other than a pair of
+// conditions, or alongside age ranges, documents that don't survive a round trip through YAML
+// unchanged, and the single conditions, and pairs of conditions, that the
+// simulation of the given conditions needs but that aren't given. An error
+// is returned only if the file can't be read as YAML at all.
+func checkPrevalences(filename string, conditions []QOFCondition) ([]string, []string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open prevalences: %s", err)
+	}
+	defer f.Close()
+
+	problems := make([]string, 0)
+	warnings := make([]string, 0)
+	seen := make(map[DiagonosisGiven]int)
+	d := yaml.NewDecoder(f)
+	for {
+		var node yaml.Node
+		if err := d.Decode(&node); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("%s:%d: ", filename, node.Line)+fmt.Sprintf(format, args...))
+		}
+		for _, key := range unknownKeys(&node, "conditions", "byage", "relativerate") {
+			report("unknown field %q", key)
+		}
+		if conditions := mappingValue(&node, "conditions"); conditions != nil {
+			for _, key := range unknownKeys(conditions, "diagnosis", "given") {
+				report("unknown field conditions.%s", key)
+			}
+		}
+		var p Prevalences
+		if err := node.Decode(&p); err != nil {
+			report("%s", err)
+			continue
+		}
+		if line, ok := seen[p.Conditions]; ok {
+			report("%s already given at line %d", describePrevalence(p.Conditions), line)
+		} else {
+			seen[p.Conditions] = node.Line
+		}
+		for _, problem := range checkDiagnosis(p.Conditions) {
+			report("%s", problem)
+		}
+		if p.RelativeRate != 0.0 {
+			if _, _, ok := pairConditions(p.Conditions); !ok {
+				report("%s: relative rate given for other than a pair of conditions", describePrevalence(p.Conditions))
+			}
+			if p.RelativeRate < 0.0 {
+				report("%s: negative relative rate", describePrevalence(p.Conditions))
+			}
+			if len(p.ByAge) > 0 {
+				report("%s: both a relative rate and age ranges given", describePrevalence(p.Conditions))
+			}
+		} else {
+			ageProblems, gaps := checkAgePrevalences(p.ByAge, byAgeKeys(&node))
+			for _, problem := range ageProblems {
+				report("%s: %s", describePrevalence(p.Conditions), problem)
+			}
+			for _, gap := range gaps {
+				warnings = append(warnings, fmt.Sprintf("%s:%d: %s: %s", filename, node.Line, describePrevalence(p.Conditions), gap))
+			}
+		}
+		if b, err := yaml.Marshal(p); err != nil {
+			report("%s: %s", describePrevalence(p.Conditions), err)
+		} else {
+			var reread Prevalences
+			if err := yaml.Unmarshal(b, &reread); err != nil || !reflect.DeepEqual(p, reread) {
+				report("%s: changed by a round trip through YAML", describePrevalence(p.Conditions))
+			}
+		}
+	}
+
+	given := func(d DiagonosisGiven) bool {
+		_, ok := seen[d]
+		return ok
+	}
+	for _, missing := range missingPrevalences(conditions, given) {
+		problems = append(problems, fmt.Sprintf("%s: missing %s", filename, describePrevalence(missing)))
+	}
+	return problems, warnings, nil
+}
+
+// missingPrevalences returns those of requiredPrevalences that aren't
+// given, and for pairs, can't be derived from a pair of their ancestors.
+func missingPrevalences(conditions []QOFCondition, given func(d DiagonosisGiven) bool) []DiagonosisGiven {
+	missing := make([]DiagonosisGiven, 0)
+	for _, required := range requiredPrevalences(conditions) {
+		if given(required) {
+			continue
+		}
+		if c1, c2, ok := pairConditions(required); ok {
+			if _, _, ok := ancestorPair(c1, c2, given); ok {
+				continue
+			}
+		}
+		missing = append(missing, required)
+	}
+	return missing
+}
+
+// requiredPrevalences returns the prevalences that the simulation of the
+// given conditions reads from data/prevalences.yaml: each condition alone,
+// and each pair of those assigned by the condition model, rather than
+// refining a simulated parent, from which prevalences conditional on the
+// presence or absence of the other are derived, other than those
+// determined by QOFConditionConstraints. A missing pair can instead be
+// derived from a pair of their ancestors.
+func requiredPrevalences(conditions []QOFCondition) []DiagonosisGiven {
+	required := make([]DiagonosisGiven, 0, len(conditions)*(len(conditions)+1)/2)
+	for _, c := range conditions {
+		required = append(required, OneCondition(c))
+	}
+	modelled, _ := splitSubConditions(conditions)
+	for i, c1 := range modelled {
+		for _, c2 := range modelled[i+1:] {
+			if !constrainsPair(c1, c2, QOFConditionConstraints) {
+				required = append(required, TwoConditions(c1, c2))
+			}
+		}
+	}
+	return required
+}
+
+// pairConditions returns the two conditions diagnosed by d, if it
+// diagnoses exactly two, and is unconditional.
+func pairConditions(d DiagonosisGiven) (QOFCondition, QOFCondition, bool) {
+	if d.Given != (Diagnosis{}) || d.Diagnosis.Absent != 0 {
+		return QOFConditionInvalid, QOFConditionInvalid, false
+	}
+	pair := make([]QOFCondition, 0, 2)
+	for _, c := range AllQOFConditions() {
+		if d.Diagnosis.Present.Contains(c) {
+			pair = append(pair, c)
+		}
+	}
+	if len(pair) != 2 {
+		return QOFConditionInvalid, QOFConditionInvalid, false
+	}
+	return pair[0], pair[1], true
+}
+
+func describePrevalence(d DiagonosisGiven) string {
+	if d.Given == (Diagnosis{}) {
+		return fmt.Sprintf("diagnosis %q", d.Diagnosis)
+	}
+	return fmt.Sprintf("diagnosis %q given %q", d.Diagnosis, d.Given)
+}
+
+func checkDiagnosis(d DiagonosisGiven) []string {
+	problems := make([]string, 0)
+	if d.Diagnosis.Present == 0 {
+		problems = append(problems, fmt.Sprintf("%s: no condition is diagnosed", describePrevalence(d)))
+	}
+	for _, diagnosis := range []Diagnosis{d.Diagnosis, d.Given} {
+		if both := diagnosis.Present & diagnosis.Absent; both != 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s both present and absent", describePrevalence(d), Diagnosis{Present: both}))
+		}
+	}
+	given := d.Given.Present | d.Given.Absent
+	if both := (d.Diagnosis.Present | d.Diagnosis.Absent) & given; both != 0 {
+		problems = append(problems, fmt.Sprintf("%s: %s both diagnosed and given", describePrevalence(d), Diagnosis{Present: both}))
+	}
+	return problems
+}
+
+// checkAgePrevalences checks that the age ranges given for males and
+// females, and for the other sex if given, start at the same age, don't
+// overlap, and end with an open range, and that each prevalence is a
+// probability, returning the gaps between ranges separately, since
+// published tables, like the comorbidity pairs in prevalences.yaml, can
+// leave them. keys are the sexes as written in the document, so that
+// unknown sexes, which SexFromString reads as Other, are reported.
+func checkAgePrevalences(a AgePrevalences, keys []string) ([]string, []string) {
+	problems := make([]string, 0)
+	gaps := make([]string, 0)
+	for _, key := range keys {
+		if key != Male.String() && key != Female.String() && key != Other.String() {
+			problems = append(problems, fmt.Sprintf("unknown sex %q", key))
+		}
+	}
+	begin := -1
+	for _, sex := range []Sex{Male, Female, Other} {
+		if int(sex) >= len(a) || len(a[sex]) == 0 {
+			if sex != Other {
+				problems = append(problems, fmt.Sprintf("%s: no age ranges", sex))
+			}
+			continue
+		}
+		ranges := a[sex]
+		if begin < 0 {
+			begin = ranges[0].Ages.Begin
+		} else if ranges[0].Ages.Begin != begin {
+			problems = append(problems, fmt.Sprintf("%s: ages begin at %d, rather than %d", sex, ranges[0].Ages.Begin, begin))
+		}
+		for i, p := range ranges {
+			if p.Ages.Begin < 0 {
+				problems = append(problems, fmt.Sprintf("%s: %s: negative age", sex, p))
+			}
+			if p.Ages.End == 0 {
+				if i != len(ranges)-1 {
+					problems = append(problems, fmt.Sprintf("%s: %s: open range isn't last", sex, p))
+				}
+			} else if p.Ages.End <= p.Ages.Begin {
+				problems = append(problems, fmt.Sprintf("%s: %s: range is empty", sex, p))
+			} else if i == len(ranges)-1 {
+				problems = append(problems, fmt.Sprintf("%s: %s: last range isn't open, so ages %d and over have no prevalence", sex, p, p.Ages.End))
+			}
+			if i > 0 {
+				previous := ranges[i-1]
+				if previous.Ages.End == 0 || p.Ages.Begin < previous.Ages.End {
+					problems = append(problems, fmt.Sprintf("%s: %s: overlaps %s", sex, p, previous))
+				} else if p.Ages.Begin > previous.Ages.End {
+					gaps = append(gaps, fmt.Sprintf("%s: %s: gap after %s, with a prevalence of 0 from %d to %d", sex, p, previous, previous.Ages.End, p.Ages.Begin-1))
+				}
+			}
+			if math.IsNaN(p.Prevalence) || p.Prevalence < 0.0 || p.Prevalence > 1.0 {
+				problems = append(problems, fmt.Sprintf("%s: %s: prevalence outside [0,1]", sex, p))
+			}
+		}
+	}
+	return problems, gaps
+}
+
+// mappingValue returns the value of key in the mapping at the root of
+// document, or nil if there isn't one.
+func mappingValue(document *yaml.Node, key string) *yaml.Node {
+	root := document
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			return root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// unknownKeys returns the keys of the mapping at the root of document
+// other than those given, since decoding ignores them, leaving a
+// misspelt field without prevalences.
+func unknownKeys(document *yaml.Node, known ...string) []string {
+	root := document
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	unknown := make([]string, 0)
+	if root.Kind != yaml.MappingNode {
+		return unknown
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		ok := false
+		for _, k := range known {
+			if root.Content[i].Value == k {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			unknown = append(unknown, root.Content[i].Value)
+		}
+	}
+	return unknown
+}
+
+func byAgeKeys(document *yaml.Node) []string {
+	keys := make([]string, 0)
+	if byAge := mappingValue(document, "byage"); byAge != nil && byAge.Kind == yaml.MappingNode {
+		for i := 0; i < len(byAge.Content); i += 2 {
+			keys = append(keys, byAge.Content[i].Value)
+		}
+	}
+	return keys
+}
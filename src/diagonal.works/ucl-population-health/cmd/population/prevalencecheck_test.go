@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAgePrevalences(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   []AgePrevalence
+		problems int
+		gaps     int
+	}{
+		{"contiguous", []AgePrevalence{{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.1}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.2}}, 0, 0},
+		{"gap", []AgePrevalence{{Ages: AgeRange{Begin: 20, End: 29}, Prevalence: 0.1}, {Ages: AgeRange{Begin: 30}, Prevalence: 0.2}}, 0, 1},
+		{"overlap", []AgePrevalence{{Ages: AgeRange{Begin: 0, End: 41}, Prevalence: 0.1}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.2}}, 1, 0},
+		{"closed", []AgePrevalence{{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.1}}, 1, 0},
+		{"probability", []AgePrevalence{{Ages: AgeRange{Begin: 0}, Prevalence: 1.2}}, 1, 0},
+	}
+	for _, test := range tests {
+		problems, gaps := checkAgePrevalences(AgePrevalences{test.ranges, test.ranges}, []string{"m", "f"})
+		// Each problem is found for both sexes
+		if len(problems) != 2*test.problems || len(gaps) != 2*test.gaps {
+			t.Errorf("%s: expected %d problems and %d gaps, found %v and %v", test.name, 2*test.problems, 2*test.gaps, problems, gaps)
+		}
+	}
+	if problems, _ := checkAgePrevalences(AgePrevalences{{{Ages: AgeRange{Begin: 0}}}, {{Ages: AgeRange{Begin: 0}}}}, []string{"m", "f", "x"}); len(problems) != 1 {
+		t.Errorf("expected an unknown sex to be reported, found %v", problems)
+	}
+}
+
+func TestCheckPrevalencesReportsGapsAsWarnings(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prevalences.yaml")
+	yaml := `conditions:
+    diagnosis: dm
+byage:
+    m:
+        - ages:
+            begin: 0
+            end: 29
+          p: 0.01
+        - ages:
+            begin: 30
+          p: 0.1
+    f:
+        - ages:
+            begin: 0
+          p: 0.05
+`
+	if err := os.WriteFile(filename, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, warnings, err := checkPrevalences(filename, []QOFCondition{QOFConditionDiabetes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, found %v", problems)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "from 29 to 29") {
+		t.Errorf("expected a warning for the gap at 29, found %v", warnings)
+	}
+}
+
+func TestCheckRepositoryPrevalences(t *testing.T) {
+	filename := filepath.Join("..", "..", "..", "..", "..", PrevalencesFilename)
+	// The conditions listed in the README's examples
+	tests := []struct {
+		conditions string
+		valid      bool
+	}{
+		{DefaultQOFConditions, true},
+		{"dm,dm1,dm2", true},
+		{"dm1,dm2,hyp,copd", true},
+		{"dm,hyp,copd,dep,mh", true},
+		{"dm,hyp,copd,chd,stia,af,hf", true},
+		{"dm,hyp,copd,chd,stia,pad,af,hf,dep,mh", true},
+		// cvd has no prevalence of its own
+		{"cvd,hyp", false},
+	}
+	for _, test := range tests {
+		conditions, err := readConditions(test.conditions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, _, err := checkPrevalences(filename, conditions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.valid {
+			for _, problem := range problems {
+				t.Errorf("%s: %s", test.conditions, problem)
+			}
+		} else if len(problems) == 0 {
+			t.Errorf("%s: expected missing prevalences", test.conditions)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// PrevalenceOverride patches the prevalence of a diagnosis for some sexes
+// and ages, for quick sensitivity checks without editing prevalences.yaml.
+// It's written as <diagnosis>:<sex>:<ages>=<prevalence> to set the
+// prevalence, or *<factor> instead of =<prevalence> to scale it, where sex
+// is m, f, o or * for every sex given, and ages are an inclusive range
+// like 40-59, an open range like 85+, a single age, or * for all ages. For
+// example, dm:m:40-59=0.12, or hyp:*:**1.1 to scale hypertension by 1.1
+// for everyone.
+type PrevalenceOverride struct {
+	Diagnosis Diagnosis
+	// The sexes overridden, or every sex given, if empty
+	Sexes []Sex
+	Ages  AgeRange
+	// If true, prevalence is multiplied by Value, otherwise replaced by it
+	Scale bool
+	Value float64
+
+	text string
+}
+
+func (o *PrevalenceOverride) String() string {
+	return o.text
+}
+
+func PrevalenceOverrideFromString(s string) (*PrevalenceOverride, error) {
+	expected := fmt.Errorf("bad prevalence override %q, expected <diagnosis>:<sex>:<ages>=<prevalence> or <diagnosis>:<sex>:<ages>*<factor>, eg dm:m:40-59=0.12", s)
+	o := &PrevalenceOverride{text: s}
+	i := strings.LastIndexAny(s, "=*")
+	if i < 0 {
+		return nil, expected
+	}
+	target, value := s[:i], s[i+1:]
+	o.Scale = s[i] == '*'
+	var err error
+	if o.Value, err = strconv.ParseFloat(value, 64); err != nil || o.Value < 0.0 {
+		return nil, expected
+	} else if !o.Scale && o.Value > 1.0 {
+		return nil, fmt.Errorf("prevalence override %q: prevalence must be between 0 and 1", s)
+	}
+	parts := strings.Split(target, ":")
+	if len(parts) != 3 {
+		return nil, expected
+	}
+	if o.Diagnosis, err = DiagnosisFromString(parts[0]); err != nil {
+		return nil, fmt.Errorf("prevalence override %q: %s", s, err)
+	}
+	switch parts[1] {
+	case "*":
+	case Male.String(), Female.String(), Other.String():
+		for sex := Male; sex <= LastSex; sex++ {
+			if sex.String() == parts[1] {
+				o.Sexes = []Sex{sex}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("prevalence override %q: unknown sex %q, expected m, f, o or *", s, parts[1])
+	}
+	if o.Ages, err = prevalenceOverrideAges(parts[2]); err != nil {
+		return nil, fmt.Errorf("prevalence override %q: %s", s, err)
+	}
+	return o, nil
+}
+
+// prevalenceOverrideAges parses an inclusive range of ages, like 40-59,
+// an open range, like 85+, a single age, or * for all ages.
+func prevalenceOverrideAges(s string) (AgeRange, error) {
+	if s == "*" {
+		return AgeRange{}, nil
+	} else if strings.HasSuffix(s, "+") {
+		begin, err := strconv.Atoi(strings.TrimSuffix(s, "+"))
+		if err != nil || begin < 0 {
+			return AgeRange{}, fmt.Errorf("bad ages %q", s)
+		}
+		return AgeRange{Begin: begin}, nil
+	}
+	begin, end, found := strings.Cut(s, "-")
+	if !found {
+		end = begin
+	}
+	b, err := strconv.Atoi(begin)
+	if err != nil || b < 0 {
+		return AgeRange{}, fmt.Errorf("bad ages %q", s)
+	}
+	e, err := strconv.Atoi(end)
+	if err != nil || e < b {
+		return AgeRange{}, fmt.Errorf("bad ages %q", s)
+	}
+	return AgeRange{Begin: b, End: e + 1}, nil
+}
+
+func (o *PrevalenceOverride) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := PrevalenceOverrideFromString(s)
+	if err != nil {
+		return err
+	}
+	*o = *parsed
+	return nil
+}
+
+// overrideAgePrevalences returns ranges with the prevalence of ages within
+// r replaced by f of their prevalence, splitting ranges that partially
+// overlap r.
+func overrideAgePrevalences(ranges []AgePrevalence, r AgeRange, f func(p float64) float64) []AgePrevalence {
+	// An End of 0 is open ended, so compare ends with this in its place
+	const open = int(^uint(0) >> 1)
+	end := func(a AgeRange) int {
+		if a.End == 0 {
+			return open
+		}
+		return a.End
+	}
+	overridden := make([]AgePrevalence, 0, len(ranges)+2)
+	for _, p := range ranges {
+		begin, finish := p.Ages.Begin, end(p.Ages)
+		if finish <= r.Begin || begin >= end(r) {
+			overridden = append(overridden, p)
+			continue
+		}
+		if begin < r.Begin {
+			overridden = append(overridden, AgePrevalence{Ages: AgeRange{Begin: begin, End: r.Begin}, Prevalence: p.Prevalence})
+			begin = r.Begin
+		}
+		within := AgePrevalence{Ages: AgeRange{Begin: begin, End: p.Ages.End}, Prevalence: f(p.Prevalence)}
+		if finish > end(r) {
+			within.Ages.End = r.End
+		}
+		overridden = append(overridden, within)
+		if finish > end(r) {
+			overridden = append(overridden, AgePrevalence{Ages: AgeRange{Begin: r.End, End: p.Ages.End}, Prevalence: p.Prevalence})
+		}
+	}
+	return overridden
+}
+
+// Apply returns the prevalences with the override applied, leaving
+// prevalences unchanged, returning an error if the diagnosis has no
+// prevalence to override for a sex, or if the result lies outside [0,1].
+func (o *PrevalenceOverride) Apply(prevalences AllPrevalences) (AllPrevalences, error) {
+	key := DiagonosisGiven{Diagnosis: o.Diagnosis}
+	p, ok := prevalences[key]
+	if !ok {
+		return nil, fmt.Errorf("prevalence override %s: no prevalence for %s in %s", o, o.Diagnosis, PrevalencesFilename)
+	}
+	sexes := o.Sexes
+	if len(sexes) == 0 {
+		for sex := range p.ByAge {
+			if len(p.ByAge[sex]) > 0 {
+				sexes = append(sexes, Sex(sex))
+			}
+		}
+	}
+	byAge := make(AgePrevalences, len(p.ByAge))
+	copy(byAge, p.ByAge)
+	var invalid error
+	f := func(prevalence float64) float64 {
+		if o.Scale {
+			prevalence *= o.Value
+		} else {
+			prevalence = o.Value
+		}
+		if prevalence > 1.0 && invalid == nil {
+			invalid = fmt.Errorf("prevalence override %s: prevalence of %f is greater than 1", o, prevalence)
+		}
+		return prevalence
+	}
+	for _, sex := range sexes {
+		if int(sex) >= len(byAge) || len(byAge[sex]) == 0 {
+			return nil, fmt.Errorf("prevalence override %s: no prevalence for %s for sex %s", o, o.Diagnosis, sex)
+		}
+		byAge[sex] = overrideAgePrevalences(byAge[sex], o.Ages, f)
+	}
+	if invalid != nil {
+		return nil, invalid
+	}
+	overridden := make(AllPrevalences, len(prevalences))
+	for k, v := range prevalences {
+		overridden[k] = v
+	}
+	overridden[key] = Prevalences{Conditions: p.Conditions, ByAge: byAge}
+	return overridden, nil
+}
+
+// PrevalenceOverrides are applied in order, and can be given more than
+// once on the command line, with --set-prevalence.
+type PrevalenceOverrides []*PrevalenceOverride
+
+func (p *PrevalenceOverrides) String() string {
+	overrides := make([]string, len(*p))
+	for i, o := range *p {
+		overrides[i] = o.String()
+	}
+	return strings.Join(overrides, " ")
+}
+
+// Repeatable marks --set-prevalence as accumulating, for applyConfig
+func (p *PrevalenceOverrides) Repeatable() {}
+
+func (p *PrevalenceOverrides) Set(s string) error {
+	o, err := PrevalenceOverrideFromString(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, o)
+	return nil
+}
+
+// Apply returns prevalences with every override applied, leaving
+// prevalences unchanged, so that runs sharing them aren't affected.
+func (p PrevalenceOverrides) Apply(prevalences AllPrevalences) (AllPrevalences, error) {
+	for _, o := range p {
+		var err error
+		if prevalences, err = o.Apply(prevalences); err != nil {
+			return nil, err
+		}
+		log.Printf("    %s", o)
+	}
+	return prevalences, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPrevalenceOverrideFromString(t *testing.T) {
+	tests := []struct {
+		s     string
+		sexes []Sex
+		ages  AgeRange
+		scale bool
+		value float64
+		valid bool
+	}{
+		{"dm:m:40-59=0.12", []Sex{Male}, AgeRange{Begin: 40, End: 60}, false, 0.12, true},
+		{"hyp:*:**1.1", nil, AgeRange{}, true, 1.1, true},
+		{"hyp:f:85+*0.5", []Sex{Female}, AgeRange{Begin: 85}, true, 0.5, true},
+		{"copd:o:70=0.2", []Sex{Other}, AgeRange{Begin: 70, End: 71}, false, 0.2, true},
+		{"dm,hyp:*:*=0.05", nil, AgeRange{}, false, 0.05, true},
+		// A prevalence greater than 1, rather than a factor
+		{"hyp:*:*=1.1", nil, AgeRange{}, false, 0.0, false},
+		{"dm:m:40-59=-0.1", nil, AgeRange{}, false, 0.0, false},
+		{"dm:x:40-59=0.1", nil, AgeRange{}, false, 0.0, false},
+		{"dm:m:59-40=0.1", nil, AgeRange{}, false, 0.0, false},
+		{"dm:m=0.1", nil, AgeRange{}, false, 0.0, false},
+		{"xx:m:40=0.1", nil, AgeRange{}, false, 0.0, false},
+		{"dm:m:40", nil, AgeRange{}, false, 0.0, false},
+		{"dm:*:*", nil, AgeRange{}, false, 0.0, false},
+	}
+	for _, test := range tests {
+		o, err := PrevalenceOverrideFromString(test.s)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.s)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: expected no error, found %s", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(o.Sexes, test.sexes) || o.Ages != test.ages || o.Scale != test.scale || o.Value != test.value {
+			t.Errorf("%q: unexpected override %+v", test.s, *o)
+		}
+		if o.String() != test.s {
+			t.Errorf("%q: expected the override to be described as given, found %q", test.s, o.String())
+		}
+	}
+}
+
+func TestOverrideAgePrevalences(t *testing.T) {
+	ranges := []AgePrevalence{{Ages: AgeRange{Begin: 0, End: 50}, Prevalence: 0.1}, {Ages: AgeRange{Begin: 50}, Prevalence: 0.2}}
+	double := func(p float64) float64 { return p * 2.0 }
+	tests := []struct {
+		r        AgeRange
+		expected []AgePrevalence
+	}{
+		{AgeRange{}, []AgePrevalence{{Ages: AgeRange{Begin: 0, End: 50}, Prevalence: 0.2}, {Ages: AgeRange{Begin: 50}, Prevalence: 0.4}}},
+		{AgeRange{Begin: 40, End: 60}, []AgePrevalence{
+			{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.1},
+			{Ages: AgeRange{Begin: 40, End: 50}, Prevalence: 0.2},
+			{Ages: AgeRange{Begin: 50, End: 60}, Prevalence: 0.4},
+			{Ages: AgeRange{Begin: 60}, Prevalence: 0.2},
+		}},
+		{AgeRange{Begin: 85}, []AgePrevalence{
+			{Ages: AgeRange{Begin: 0, End: 50}, Prevalence: 0.1},
+			{Ages: AgeRange{Begin: 50, End: 85}, Prevalence: 0.2},
+			{Ages: AgeRange{Begin: 85}, Prevalence: 0.4},
+		}},
+	}
+	for _, test := range tests {
+		if overridden := overrideAgePrevalences(ranges, test.r, double); !reflect.DeepEqual(overridden, test.expected) {
+			t.Errorf("%+v: expected %v, found %v", test.r, test.expected, overridden)
+		}
+	}
+}
+
+func TestPrevalenceOverridesApply(t *testing.T) {
+	conditions := []QOFCondition{QOFConditionHypertension}
+	prevalences := constantPrevalences(conditions, 0.5)
+	var overrides PrevalenceOverrides
+	for _, s := range []string{"hyp:m:40+=0.6", "hyp:*:**1.5"} {
+		if err := overrides.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overridden, err := overrides.Apply(prevalences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sex      Sex
+		age      int
+		expected float64
+	}{
+		{Male, 30, 0.75},
+		{Male, 40, 0.9},
+		{Female, 40, 0.75},
+	}
+	for _, test := range tests {
+		if p := overridden[OneCondition(QOFConditionHypertension)].ByAge.Prevalence(test.sex, test.age); math.Abs(p-test.expected) > 1e-9 {
+			t.Errorf("expected %f for %s aged %d, found %f", test.expected, test.sex, test.age, p)
+		}
+	}
+	if p := prevalences[OneCondition(QOFConditionHypertension)].ByAge.Prevalence(Male, 40); p != 0.5 {
+		t.Errorf("expected the original prevalences to be unchanged, found %f", p)
+	}
+
+	var invalid PrevalenceOverrides
+	invalid.Set("hyp:*:**2.5")
+	if _, err := invalid.Apply(prevalences); err == nil {
+		t.Errorf("expected an error for a prevalence greater than 1")
+	}
+	var unknown PrevalenceOverrides
+	unknown.Set("dm:*:*=0.1")
+	if _, err := unknown.Apply(prevalences); err == nil {
+		t.Errorf("expected an error for a diagnosis without a prevalence")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type PersonColumnKind int
+
+const (
+	// Attributes of people that don't identify them, or their location
+	PersonColumnAttribute PersonColumnKind = iota
+	// Identifiers that would be sensitive for real people, like NHS
+	// numbers and names
+	PersonColumnIdentifier
+	// The location of a person's home
+	PersonColumnHome
+	// A person's age
+	PersonColumnAge
+)
+
+type PersonColumn struct {
+	Name string
+	Kind PersonColumnKind
+	// The type of the column in SQL outputs, TEXT if empty
+	SQLType string
+	Value   func(p *Person) string
+	// For PersonColumnAge, the age from which Value is formatted, or
+	// false if there isn't one
+	Age func(p *Person) (int, bool)
+}
+
+// PersonColumnOptions describes which optional attributes were simulated
+type PersonColumnOptions struct {
+	Conditions []QOFCondition
+	// How Conditions are written
+	ConditionEncoding ConditionEncoding
+	HomePoints        bool
+	Admissions        bool
+	NHSNumbers        bool
+	Names             bool
+	Smoking           bool
+	BMI               bool
+	OnsetAges         bool
+	// The complications modelled, if any
+	Complications *ComplicationModel
+	// The detection modelled, if any
+	Detection *DetectionModel
+	// The control modelled, if any
+	Control      *ControlModel
+	Measurements bool
+	Segments     bool
+	// The benefits modelled, if any
+	Benefits   *BenefitModel
+	Employment bool
+	CareHomes  bool
+	Pharmacies bool
+	RuralUrban bool
+	Weights    bool
+	// Used for attributes of a person's home LSOA
+	LSOAs map[LSOACode]*LSOA
+}
+
+// PersonColumns returns all the columns available for people, given the
+// attributes simulated, before filtering by an output profile.
+func PersonColumns(options *PersonColumnOptions) []PersonColumn {
+	columns := []PersonColumn{
+		{Name: "id", Kind: PersonColumnAttribute, SQLType: "INTEGER", Value: func(p *Person) string { return strconv.Itoa(p.ID) }},
+		{Name: "sex", Kind: PersonColumnAttribute, Value: func(p *Person) string { return p.Sex.String() }},
+		{Name: "age", Kind: PersonColumnAge, SQLType: "INTEGER", Value: func(p *Person) string { return strconv.Itoa(p.Age) }, Age: func(p *Person) (int, bool) { return p.Age, true }},
+		{Name: "home", Kind: PersonColumnHome, Value: func(p *Person) string { return p.Home.String() }},
+		{Name: "gp", Kind: PersonColumnAttribute, Value: func(p *Person) string { return p.GP.String() }},
+	}
+	if options.HomePoints {
+		columns = append(columns, []PersonColumn{
+			{Name: "home_lat", Kind: PersonColumnAttribute, SQLType: "REAL", Value: func(p *Person) string { return fmt.Sprintf("%.6f", p.HomePoint.Lat.Degrees()) }},
+			{Name: "home_lng", Kind: PersonColumnAttribute, SQLType: "REAL", Value: func(p *Person) string { return fmt.Sprintf("%.6f", p.HomePoint.Lng.Degrees()) }},
+		}...)
+	}
+	switch options.ConditionEncoding {
+	case ConditionEncodingOneHot:
+		for _, c := range options.Conditions {
+			condition := c
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("condition_%s", condition),
+				Kind:    PersonColumnAttribute,
+				SQLType: "INTEGER",
+				Value:   func(p *Person) string { return presentToString(p.Conditions.Contains(condition)) },
+			})
+		}
+	case ConditionEncodingBitmask:
+		mask := conditionsBitmask(options.Conditions)
+		columns = append(columns, PersonColumn{
+			Name:    "conditions",
+			Kind:    PersonColumnAttribute,
+			SQLType: "INTEGER",
+			Value:   func(p *Person) string { return strconv.FormatUint(uint64((p.Conditions & mask).ToUint32()), 10) },
+		})
+	}
+	if options.OnsetAges {
+		for _, c := range options.Conditions {
+			condition := c
+			age := func(p *Person) (int, bool) {
+				return int(p.OnsetAges[condition.Index()]), p.Conditions.Contains(condition)
+			}
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("onset_age_%s", condition),
+				Kind:    PersonColumnAge,
+				SQLType: "INTEGER",
+				Value: func(p *Person) string {
+					if a, ok := age(p); ok {
+						return strconv.Itoa(a)
+					}
+					return ""
+				},
+				Age: age,
+			})
+		}
+	}
+	if options.Complications != nil {
+		condition := options.Complications.condition
+		for _, c := range options.Complications.Modelled() {
+			complication := c
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("complication_%s", complication),
+				Kind:    PersonColumnAttribute,
+				SQLType: "INTEGER",
+				Value: func(p *Person) string {
+					if !p.Conditions.Contains(condition) {
+						return ""
+					}
+					return presentToString(p.Complications.Contains(complication))
+				},
+			})
+		}
+	}
+	if options.Detection != nil {
+		condition := options.Detection.condition
+		columns = append(columns, PersonColumn{
+			Name:    fmt.Sprintf("%s_undiagnosed", condition),
+			Kind:    PersonColumnAttribute,
+			SQLType: "INTEGER",
+			Value:   func(p *Person) string { return presentToString(p.Undiagnosed.Contains(condition)) },
+		})
+	}
+	if options.Control != nil {
+		control := options.Control
+		for _, c := range control.ControlledConditions() {
+			condition := c
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("%s_controlled", condition),
+				Kind:    PersonColumnAttribute,
+				SQLType: "INTEGER",
+				Value: func(p *Person) string {
+					if control.Indicator(p, condition) == nil {
+						return ""
+					}
+					return presentToString(p.Controlled.Contains(condition))
+				},
+			})
+		}
+	}
+	if options.Admissions {
+		for _, t := range AdmissionTypes() {
+			admission := t
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("expected_admissions_%s", admission),
+				Kind:    PersonColumnAttribute,
+				SQLType: "REAL",
+				Value:   func(p *Person) string { return fmt.Sprintf("%f", p.Admissions.Expected[admission]) },
+			})
+		}
+		for _, t := range AdmissionTypes() {
+			admission := t
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("admissions_%s", admission),
+				Kind:    PersonColumnAttribute,
+				SQLType: "INTEGER",
+				Value:   func(p *Person) string { return strconv.Itoa(p.Admissions.Sampled[admission]) },
+			})
+		}
+	}
+	if options.Weights {
+		columns = append(columns, PersonColumn{Name: "weight", Kind: PersonColumnAttribute, SQLType: "REAL", Value: func(p *Person) string { return fmt.Sprintf("%f", p.Weight) }})
+	}
+	if options.RuralUrban {
+		columns = append(columns, PersonColumn{Name: "rural_urban", Kind: PersonColumnAttribute, Value: func(p *Person) string { return options.LSOAs[p.Home].RuralUrban.String() }})
+	}
+	if options.Smoking {
+		columns = append(columns, PersonColumn{Name: "smoking", Kind: PersonColumnAttribute, Value: func(p *Person) string { return p.Smoking.String() }})
+	}
+	if options.BMI {
+		columns = append(columns, []PersonColumn{
+			{Name: "bmi", Kind: PersonColumnAttribute, SQLType: "REAL", Value: func(p *Person) string {
+				if p.BMI == 0.0 {
+					return ""
+				}
+				return fmt.Sprintf("%.1f", p.BMI)
+			}},
+			{Name: "obese", Kind: PersonColumnAttribute, SQLType: "INTEGER", Value: func(p *Person) string {
+				if p.BMI == 0.0 {
+					return ""
+				}
+				return presentToString(p.Obese())
+			}},
+		}...)
+	}
+	if options.Measurements {
+		for m := Measurement(0); m < MeasurementCount; m++ {
+			measurement := m
+			columns = append(columns, PersonColumn{
+				Name:    measurement.String(),
+				Kind:    PersonColumnAttribute,
+				SQLType: "REAL",
+				Value: func(p *Person) string {
+					if p.Measurements[measurement] == 0.0 {
+						return ""
+					}
+					return fmt.Sprintf("%.1f", p.Measurements[measurement])
+				},
+			})
+		}
+	}
+	if options.Segments {
+		columns = append(columns, PersonColumn{Name: "segment", Kind: PersonColumnAttribute, Value: func(p *Person) string { return p.Segment.String() }})
+	}
+	if options.Benefits != nil {
+		for _, b := range options.Benefits.Modelled() {
+			benefit := b
+			columns = append(columns, PersonColumn{
+				Name:    fmt.Sprintf("benefit_%s", benefit),
+				Kind:    PersonColumnAttribute,
+				SQLType: "INTEGER",
+				Value:   func(p *Person) string { return presentToString(p.Benefits.Contains(benefit)) },
+			})
+		}
+	}
+	if options.Employment {
+		columns = append(columns, []PersonColumn{
+			{Name: "economic_activity", Kind: PersonColumnAttribute, Value: func(p *Person) string {
+				if p.EconomicActivity == EconomicActivityUnknown {
+					return ""
+				}
+				return p.EconomicActivity.String()
+			}},
+			{Name: "occupation", Kind: PersonColumnAttribute, Value: func(p *Person) string {
+				if p.Occupation == OccupationUnknown {
+					return ""
+				}
+				return p.Occupation.String()
+			}},
+		}...)
+	}
+	if options.CareHomes {
+		columns = append(columns, PersonColumn{Name: "care_home", Kind: PersonColumnAttribute, SQLType: "INTEGER", Value: func(p *Person) string { return presentToString(p.CareHome != CareHomeIDInvalid) }})
+	}
+	if options.Pharmacies {
+		columns = append(columns, PersonColumn{Name: "pharmacy", Kind: PersonColumnAttribute, Value: func(p *Person) string { return string(p.Pharmacy) }})
+	}
+	if options.NHSNumbers {
+		columns = append(columns, PersonColumn{Name: "nhs_number", Kind: PersonColumnIdentifier, Value: func(p *Person) string { return p.NHSNumber }})
+	}
+	if options.Names {
+		columns = append(columns, []PersonColumn{
+			{Name: "given_name", Kind: PersonColumnIdentifier, Value: func(p *Person) string { return p.Name.Given }},
+			{Name: "family_name", Kind: PersonColumnIdentifier, Value: func(p *Person) string { return p.Name.Family }},
+			{Name: "date_of_birth", Kind: PersonColumnIdentifier, Value: func(p *Person) string { return p.Name.DateOfBirth.Format("2006-01-02") }},
+		}...)
+	}
+	return columns
+}
+
+func PersonColumnsHeaderRow(columns []PersonColumn) []string {
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		row[i] = c.Name
+	}
+	return row
+}
+
+func PersonColumnsRow(columns []PersonColumn, p *Person) []string {
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		row[i] = c.Value(p)
+	}
+	return row
+}
+
+type HomeGeography int
+
+const (
+	HomeGeographyLSOA HomeGeography = iota
+	HomeGeographyMSOA
+)
+
+// OutputProfile controls which columns, identifiers and geographies are
+// emitted in outputs. Profiles are enforced when columns are chosen, and
+// when options are validated, rather than by individual writers.
+type OutputProfile struct {
+	Name          string
+	Description   string
+	Identifiers   bool
+	HomeGeography HomeGeography
+	// If non-zero, ages are emitted as bands of this width, otherwise as
+	// single years
+	AgeBandYears int
+	// Ages at or above this are emitted together, if non-zero
+	AgeTopCode int
+	// Whether outputs aggregated by LSOA are emitted
+	LSOAOutputs bool
+}
+
+var OutputProfiles = []*OutputProfile{
+	{
+		Name:          "research",
+		Description:   "Person level attributes, with homes at LSOA level, and no identifiers",
+		HomeGeography: HomeGeographyLSOA,
+		LSOAOutputs:   true,
+	},
+	{
+		Name:          "test-data",
+		Description:   "Everything generated, including test NHS numbers, names and dates of birth",
+		Identifiers:   true,
+		HomeGeography: HomeGeographyLSOA,
+		LSOAOutputs:   true,
+	},
+	{
+		Name:          "public",
+		Description:   "Person level attributes, with homes at MSOA level, 5 year age bands, and no identifiers or LSOA level outputs",
+		HomeGeography: HomeGeographyMSOA,
+		AgeBandYears:  5,
+		AgeTopCode:    90,
+	},
+}
+
+func OutputProfileFromString(s string) (*OutputProfile, error) {
+	names := make([]string, 0, len(OutputProfiles))
+	for _, p := range OutputProfiles {
+		if p.Name == s {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown output profile %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// Check returns an error if options request attributes the profile
+// doesn't permit, so that mistakes are caught before a long run, rather
+// than silently dropped.
+func (o *OutputProfile) Check(options *PopulationOptions) error {
+	if !o.Identifiers {
+		if options.NHSNumbers {
+			return fmt.Errorf("output profile %s doesn't permit NHS numbers", o.Name)
+		}
+		if options.NamesFilename != "" {
+			return fmt.Errorf("output profile %s doesn't permit names", o.Name)
+		}
+	}
+	if !o.LSOAOutputs && options.GeoJSON {
+		return fmt.Errorf("output profile %s doesn't permit LSOA level GeoJSON", o.Name)
+	}
+	if !o.LSOAOutputs && options.PopulationFeatures {
+		return fmt.Errorf("output profile %s doesn't permit LSOA level features", o.Name)
+	}
+	if !o.LSOAOutputs && options.DemandFilename != "" {
+		return fmt.Errorf("output profile %s doesn't permit demand surfaces, which resolve LSOAs", o.Name)
+	}
+	if !o.LSOAOutputs && options.Flows {
+		return fmt.Errorf("output profile %s doesn't permit LSOA level flows", o.Name)
+	}
+	if !o.LSOAOutputs && options.Catchments {
+		return fmt.Errorf("output profile %s doesn't permit catchments, which resolve LSOAs", o.Name)
+	}
+	if o.HomeGeography != HomeGeographyLSOA && options.HomePoints != HomePointsNone {
+		return fmt.Errorf("output profile %s doesn't permit home points, which resolve LSOAs", o.Name)
+	}
+	if (o.HomeGeography != HomeGeographyLSOA || o.AgeBandYears > 0 || o.AgeTopCode > 0) && options.AuditSample > 0 {
+		return fmt.Errorf("output profile %s doesn't permit audits, which resolve the LSOAs and ages of the people sampled", o.Name)
+	}
+	if !o.LSOAOutputs && len(options.SmallAreaConditions) > 0 {
+		return fmt.Errorf("output profile %s doesn't permit small area estimation, whose prevalence is by LSOA", o.Name)
+	}
+	if !o.LSOAOutputs && options.FlowValidation {
+		return fmt.Errorf("output profile %s doesn't permit LSOA level flows", o.Name)
+	}
+	if o.AgeBandYears > 0 || o.AgeTopCode > 0 {
+		for _, format := range options.Formats {
+			if format == ExportFormatFHIR {
+				return fmt.Errorf("output profile %s doesn't permit FHIR, whose birth dates would resolve banded ages", o.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *OutputProfile) ageToString(age int) string {
+	if o.AgeTopCode > 0 && age >= o.AgeTopCode {
+		return fmt.Sprintf("%d+", o.AgeTopCode)
+	}
+	if o.AgeBandYears > 0 {
+		begin := (age / o.AgeBandYears) * o.AgeBandYears
+		return fmt.Sprintf("%d-%d", begin, begin+o.AgeBandYears-1)
+	}
+	return strconv.Itoa(age)
+}
+
+// Apply returns the columns permitted by the profile, with ages and home
+// locations coarsened as required.
+func (o *OutputProfile) Apply(columns []PersonColumn, lsoas map[LSOACode]*LSOA) []PersonColumn {
+	applied := make([]PersonColumn, 0, len(columns))
+	for _, c := range columns {
+		switch c.Kind {
+		case PersonColumnIdentifier:
+			if !o.Identifiers {
+				continue
+			}
+		case PersonColumnHome:
+			if o.HomeGeography == HomeGeographyMSOA {
+				c = PersonColumn{
+					Name:  "home_msoa",
+					Kind:  c.Kind,
+					Value: func(p *Person) string { return lsoas[p.Home].MSOACode.String() },
+				}
+			}
+		case PersonColumnAge:
+			if o.AgeBandYears > 0 || o.AgeTopCode > 0 {
+				age := c.Age
+				c = PersonColumn{
+					Name: c.Name + "_band",
+					Kind: c.Kind,
+					Value: func(p *Person) string {
+						if a, ok := age(p); ok {
+							return o.ageToString(a)
+						}
+						return ""
+					},
+					Age: age,
+				}
+			}
+		}
+		applied = append(applied, c)
+	}
+	return applied
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The most years a population can be projected forward
+const ProjectionMaxYears = 30
+
+// ProjectionModel gives the rates at which the population changes each
+// year, by sex and age range, as in prevalences.yaml.
+type ProjectionModel struct {
+	// The probability of death within a year
+	Mortality AgePrevalences `yaml:"mortality"`
+	// Live births per woman per year, by the age of the mother
+	Fertility AgePrevalences `yaml:"fertility"`
+	// Net migration per person per year, negative where more people leave
+	// than arrive
+	Migration AgePrevalences `yaml:"migration"`
+	// The share of births that are male
+	MaleBirths float64 `yaml:"malebirths"`
+}
+
+func readProjectionModel(filename string) (*ProjectionModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open projection: %s", err)
+	}
+	defer f.Close()
+	var model ProjectionModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read projection: %s", err)
+	}
+	if len(model.Mortality) == 0 {
+		return nil, fmt.Errorf("%s: no mortality", filename)
+	}
+	if model.MaleBirths < 0.0 || model.MaleBirths > 1.0 {
+		return nil, fmt.Errorf("%s: malebirths must be between 0 and 1", filename)
+	}
+	return &model, nil
+}
+
+// projectedPerson is a resident of a projected population, carrying only
+// what changes from year to year.
+type projectedPerson struct {
+	Sex        Sex
+	Age        int
+	Home       LSOACode
+	GP         GPPracticeCode
+	Conditions QOFConditions
+}
+
+// ProjectedLSOA is the population of an LSOA in a year of a projection,
+// and the change in it since the year before.
+type ProjectedLSOA struct {
+	People       int
+	Births       int
+	Deaths       int
+	NetMigration int
+	// Indexed by the position of the condition in Projection.Conditions
+	Conditions []int
+}
+
+type ProjectedYear struct {
+	Year  int
+	LSOAs map[LSOACode]*ProjectedLSOA
+}
+
+// Projection is the population of the scope's residents, projected forward
+// from the year it was simulated for.
+type Projection struct {
+	Conditions []QOFCondition
+	// Conditions without incidence, which no one is newly diagnosed with
+	WithoutIncidence []QOFCondition
+	Years            []ProjectedYear
+}
+
+// projectPopulation ages the residents of homes forward by years. Each
+// year people die with the probability given by mortality for their sex
+// and age, women give birth with that given by fertility, with the
+// newborn living in their mother's LSOA, and registering with her
+// practice, and people leave, or people like them arrive, with that given
+// by net migration. Everyone then ages by a year, and those without each
+// simulated condition are diagnosed with it according to its annual
+// incidence, as for forecasts. Conditions are counted for the reported
+// conditions, rolling up sub-conditions to their parents.
+func projectPopulation(people []Person, homes LSOASet, conditions []QOFCondition, reported []QOFCondition, model *ProjectionModel, incidence *IncidenceModel, baseYear int, years int) *Projection {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	projected := make([]projectedPerson, 0, len(people))
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			p := &people[i]
+			projected = append(projected, projectedPerson{Sex: p.Sex, Age: p.Age, Home: p.Home, GP: p.GP, Conditions: p.Conditions})
+		}
+	}
+	projection := &Projection{Conditions: reported}
+	for _, condition := range conditions {
+		if _, ok := incidence.ByCondition[condition]; !ok {
+			projection.WithoutIncidence = append(projection.WithoutIncidence, condition)
+		}
+	}
+
+	count := func(year ProjectedYear, people []projectedPerson) {
+		for i := range people {
+			l := year.lsoa(people[i].Home, len(reported))
+			l.People++
+			for j, condition := range reported {
+				if people[i].Conditions.Contains(condition) {
+					l.Conditions[j]++
+				}
+			}
+		}
+	}
+	base := ProjectedYear{Year: baseYear, LSOAs: make(map[LSOACode]*ProjectedLSOA)}
+	count(base, projected)
+	projection.Years = append(projection.Years, base)
+
+	for y := 1; y <= years; y++ {
+		year := ProjectedYear{Year: baseYear + y, LSOAs: make(map[LSOACode]*ProjectedLSOA)}
+		next := make([]projectedPerson, 0, len(projected))
+		for _, p := range projected {
+			if rng.Float64() < model.Mortality.Prevalence(p.Sex, p.Age) {
+				year.lsoa(p.Home, len(reported)).Deaths++
+				continue
+			}
+			if p.Sex == Female && rng.Float64() < model.Fertility.Prevalence(Female, p.Age) {
+				sex := Female
+				if rng.Float64() < model.MaleBirths {
+					sex = Male
+				}
+				// Aged to 0 with everyone else below
+				next = append(next, projectedPerson{Sex: sex, Age: -1, Home: p.Home, GP: p.GP})
+				year.lsoa(p.Home, len(reported)).Births++
+			}
+			if migration := model.Migration.Prevalence(p.Sex, p.Age); migration < 0.0 && rng.Float64() < -migration {
+				year.lsoa(p.Home, len(reported)).NetMigration--
+				continue
+			} else if migration > 0.0 && rng.Float64() < migration {
+				// An arrival like p
+				next = append(next, p)
+				year.lsoa(p.Home, len(reported)).NetMigration++
+			}
+			next = append(next, p)
+		}
+		for i := range next {
+			p := &next[i]
+			p.Age++
+			for _, condition := range conditions {
+				if p.Conditions.Contains(condition) {
+					continue
+				}
+				if rates, ok := incidence.ByCondition[condition]; ok {
+					if rng.Float64() < 1.0-math.Exp(-rates.Prevalence(p.Sex, p.Age)) {
+						p.Conditions.Add(condition)
+						for _, ancestor := range condition.Ancestors() {
+							p.Conditions.Add(ancestor)
+						}
+					}
+				}
+			}
+		}
+		projected = next
+		count(year, projected)
+		projection.Years = append(projection.Years, year)
+	}
+	return projection
+}
+
+func (y ProjectedYear) lsoa(code LSOACode, conditions int) *ProjectedLSOA {
+	l, ok := y.LSOAs[code]
+	if !ok {
+		l = &ProjectedLSOA{Conditions: make([]int, conditions)}
+		y.LSOAs[code] = l
+	}
+	return l
+}
+
+func (p *Projection) Log() {
+	log.Printf("projection:")
+	for _, year := range p.Years {
+		var total ProjectedLSOA
+		for _, l := range year.LSOAs {
+			total.People += l.People
+			total.Births += l.Births
+			total.Deaths += l.Deaths
+			total.NetMigration += l.NetMigration
+		}
+		log.Printf("  %d: people: %d births: %d deaths: %d net migration: %d", year.Year, total.People, total.Births, total.Deaths, total.NetMigration)
+	}
+	for _, condition := range p.WithoutIncidence {
+		Warningf("  no incidence for %s, so no one is newly diagnosed with it", condition)
+	}
+}
+
+// WriteCSV writes projection.csv, the people, change and condition counts
+// of each LSOA in each year, and projection-conditions.csv, the count,
+// prevalence and, with a demand model, activity of each condition across
+// the scope in each year.
+func (p *Projection) WriteCSV(scenario string, demand DemandModel, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "projection.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"scenario", "year", "lsoa", "people", "births", "deaths", "net_migration"}
+	for _, condition := range p.Conditions {
+		header = append(header, "condition_"+condition.String())
+	}
+	w.Write(header)
+	for _, year := range p.Years {
+		codes := make([]string, 0, len(year.LSOAs))
+		for code := range year.LSOAs {
+			codes = append(codes, string(code))
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			l := year.LSOAs[LSOACode(code)]
+			row := []string{scenario, strconv.Itoa(year.Year), code, strconv.Itoa(l.People), strconv.Itoa(l.Births), strconv.Itoa(l.Deaths), strconv.Itoa(l.NetMigration)}
+			for _, n := range l.Conditions {
+				row = append(row, strconv.Itoa(n))
+			}
+			w.Write(row)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	f, err = createOutput(filepath.Join(outputDirectory, "projection-conditions.csv"))
+	if err != nil {
+		return err
+	}
+	w = csv.NewWriter(f)
+	w.Write([]string{"scenario", "year", "condition", "people", "count", "prevalence", "activity"})
+	for _, year := range p.Years {
+		people := 0
+		counts := make([]int, len(p.Conditions))
+		for _, l := range year.LSOAs {
+			people += l.People
+			for i, n := range l.Conditions {
+				counts[i] += n
+			}
+		}
+		for i, condition := range p.Conditions {
+			prevalence := 0.0
+			if people > 0 {
+				prevalence = float64(counts[i]) / float64(people)
+			}
+			activity := ""
+			if d, ok := demand[condition]; ok {
+				activity = fmt.Sprintf("%f", float64(counts[i])*d.Annual)
+			}
+			w.Write([]string{scenario, strconv.Itoa(year.Year), condition.String(), strconv.Itoa(people), strconv.Itoa(counts[i]), fmt.Sprintf("%f", prevalence), activity})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProjectPopulationAgesAndDies(t *testing.T) {
+	model := &ProjectionModel{
+		Mortality: AgePrevalences{
+			{{Ages: AgeRange{Begin: 0, End: 85}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 85}, Prevalence: 1.0}},
+			{{Ages: AgeRange{Begin: 0, End: 85}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 85}, Prevalence: 1.0}},
+		},
+	}
+	// Diagnosed from 31, so only those aged from 30 before incidence
+	incidence := &IncidenceModel{ByCondition: map[QOFCondition]AgePrevalences{
+		QOFConditionHypertension: {
+			{{Ages: AgeRange{Begin: 0, End: 31}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 31}, Prevalence: 1000.0}},
+			{{Ages: AgeRange{Begin: 0, End: 31}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 31}, Prevalence: 1000.0}},
+		},
+	}}
+	people := []Person{
+		{Sex: Male, Age: 30, Home: "E01000001"},
+		{Sex: Female, Age: 29, Home: "E01000001"},
+		{Sex: Female, Age: 90, Home: "E01000001"},
+		{Sex: Male, Age: 84, Home: "E01000002"},
+		// Outside homes
+		{Sex: Male, Age: 90, Home: "E01000003"},
+	}
+	homes := LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}}
+	conditions := []QOFCondition{QOFConditionHypertension, QOFConditionCOPD}
+	projection := projectPopulation(people, homes, conditions, conditions, model, incidence, 2021, 2)
+	if len(projection.Years) != 3 || projection.Years[0].Year != 2021 || projection.Years[2].Year != 2023 {
+		t.Fatalf("expected years 2021 to 2023, found %v", projection.Years)
+	}
+	if len(projection.WithoutIncidence) != 1 || projection.WithoutIncidence[0] != QOFConditionCOPD {
+		t.Errorf("expected copd to be without incidence, found %v", projection.WithoutIncidence)
+	}
+	tests := []struct {
+		year         int
+		lsoa         LSOACode
+		people       int
+		deaths       int
+		hypertension int
+	}{
+		{0, "E01000001", 3, 0, 0},
+		{0, "E01000002", 1, 0, 0},
+		// Those aged 85 or over die, and the rest age by a year
+		{1, "E01000001", 2, 1, 1},
+		{1, "E01000002", 1, 0, 1},
+		{2, "E01000001", 2, 0, 2},
+		// Aged 85 at the start of the year
+		{2, "E01000002", 0, 1, 0},
+	}
+	for _, test := range tests {
+		l, ok := projection.Years[test.year].LSOAs[test.lsoa]
+		if !ok {
+			t.Errorf("%d %s: expected a projected LSOA", test.year, test.lsoa)
+			continue
+		}
+		if l.People != test.people || l.Deaths != test.deaths || l.Conditions[0] != test.hypertension {
+			t.Errorf("%d %s: expected %d people, %d deaths and %d with hypertension, found %d, %d and %d", test.year, test.lsoa, test.people, test.deaths, test.hypertension, l.People, l.Deaths, l.Conditions[0])
+		}
+	}
+	if _, ok := projection.Years[0].LSOAs["E01000003"]; ok {
+		t.Errorf("expected people outside homes not to be projected")
+	}
+}
+
+func TestProjectPopulationBirthsAndMigration(t *testing.T) {
+	model := &ProjectionModel{
+		Mortality: AgePrevalences{{{Ages: AgeRange{Begin: 0}, Prevalence: 0.0}}, {{Ages: AgeRange{Begin: 0}, Prevalence: 0.0}}},
+		Fertility: AgePrevalences{nil, {{Ages: AgeRange{Begin: 0, End: 20}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 20, End: 40}, Prevalence: 1.0}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.0}}},
+		Migration: AgePrevalences{
+			{{Ages: AgeRange{Begin: 0, End: 60}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 60}, Prevalence: -1.0}},
+			{{Ages: AgeRange{Begin: 0, End: 60}, Prevalence: 0.0}, {Ages: AgeRange{Begin: 60}, Prevalence: 1.0}},
+		},
+		MaleBirths: 1.0,
+	}
+	people := []Person{
+		{Sex: Female, Age: 25, Home: "E01000001"},
+		{Sex: Male, Age: 25, Home: "E01000001"},
+		{Sex: Male, Age: 70, Home: "E01000001"},
+		{Sex: Female, Age: 70, Home: "E01000001"},
+	}
+	projection := projectPopulation(people, LSOASet{"E01000001": struct{}{}}, nil, nil, model, &IncidenceModel{}, 2021, 1)
+	l := projection.Years[1].LSOAs["E01000001"]
+	// The woman of 25 gives birth, the man of 70 leaves, and a woman like
+	// the woman of 70 arrives
+	if l.Births != 1 || l.NetMigration != 0 || l.People != 5 {
+		t.Errorf("expected 1 birth, no net migration, and 5 people, found %d, %d and %d", l.Births, l.NetMigration, l.People)
+	}
+}
+
+func TestProjectPopulationOtherSex(t *testing.T) {
+	model := &ProjectionModel{
+		Mortality: AgePrevalences{{{Ages: AgeRange{Begin: 0}, Prevalence: 1.0}}, {{Ages: AgeRange{Begin: 0}, Prevalence: 0.0}}},
+	}
+	people := []Person{{Sex: Other, Age: 40, Home: "E01000001"}, {Sex: Other, Age: 50, Home: "E01000001"}}
+	tests := []struct {
+		o      OtherSexPrevalence
+		deaths int
+	}{
+		{OtherSexPrevalenceMale, 2},
+		{OtherSexPrevalenceFemale, 0},
+	}
+	for _, test := range tests {
+		in := &populationInputs{projection: &ProjectionModel{Mortality: model.Mortality}}
+		in.resolveOtherSex(test.o)
+		projection := projectPopulation(people, LSOASet{"E01000001": struct{}{}}, nil, nil, in.projection, &IncidenceModel{}, 2021, 1)
+		if d := projection.Years[1].LSOAs["E01000001"].Deaths; d != test.deaths {
+			t.Errorf("%s: expected %d deaths of people of the other sex, found %d", test.o, test.deaths, d)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const ProvenanceNotice = "All people in this file are synthetic, generated from aggregate published data, and don't correspond to real patients"
+
+// SourceAttribution credits the publisher of datasets from which the
+// outputs are derived, under the terms of their licence. Datasets ending
+// in / match every dataset with that prefix.
+type SourceAttribution struct {
+	Publisher   string   `json:"publisher"`
+	Datasets    []string `json:"datasets"`
+	Licence     string   `json:"licence"`
+	Attribution string   `json:"attribution"`
+}
+
+const (
+	LicenceOGL3  = "Open Government Licence v3.0"
+	LicenceODbL1 = "Open Database License v1.0"
+)
+
+// SourceAttributions credit the publishers of the datasets of
+// DefaultDataManifest. The world is always used, and so always credited.
+var SourceAttributions = []SourceAttribution{
+	{
+		Publisher:   "Office for National Statistics",
+		Datasets:    []string{DatasetLSOAPersons, DatasetLSOAMales, DatasetLSOAFemales, DatasetLSOA21Persons, DatasetLSOA21Males, DatasetLSOA21Females, DatasetLSOAMSOA, DatasetLSOAICB, DatasetLSOA11To21, DatasetLSOARuralUrban, DatasetLSOAEthnicity, DatasetLSOAEconomicActivity, DatasetLSOAOccupation, DatasetPopulationEstimates, DatasetLSOAPopulationEstimates, DatasetICBBoundaries},
+		Licence:     LicenceOGL3,
+		Attribution: "Source: Office for National Statistics licensed under the Open Government Licence v.3.0. Contains OS data © Crown copyright and database right",
+	},
+	{
+		Publisher:   "Office for National Statistics",
+		Datasets:    []string{DatasetONSPD},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains OS data © Crown copyright and database right. Contains Royal Mail data © Royal Mail copyright and database right. Source: Office for National Statistics licensed under the Open Government Licence v.3.0",
+	},
+	{
+		Publisher:   "Ministry of Housing, Communities and Local Government",
+		Datasets:    []string{DatasetLSOAIMD},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains public sector information from the English Indices of Deprivation licensed under the Open Government Licence v3.0",
+	},
+	{
+		Publisher:   "NHS England",
+		Datasets:    []string{DatasetGPPractices, DatasetGPPractioners, DatasetGPPracticeSuccessors, DatasetGPAppointments, DatasetQOFListSizes, DatasetQOFConditionPrefix, DatasetQOFAchievement, DatasetGPRegistrationsLSOA, DatasetGPRegistrationsMales, DatasetGPRegistrationsFemales, DatasetGPPracticePCNs, DatasetTrustSites, DatasetEstates},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains public sector information published by NHS England licensed under the Open Government Licence v3.0",
+	},
+	{
+		Publisher:   "NHS Business Services Authority",
+		Datasets:    []string{DatasetPharmacies},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains public sector information from the NHSBSA consolidated pharmaceutical list licensed under the Open Government Licence v3.0",
+	},
+	{
+		Publisher:   "Care Quality Commission",
+		Datasets:    []string{DatasetCareHomes},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains public sector information published by the Care Quality Commission licensed under the Open Government Licence v3.0",
+	},
+	{
+		Publisher:   "Department for Work and Pensions",
+		Datasets:    []string{DatasetDWPUniversalCredit, DatasetDWPPIP, DatasetDWPAttendanceAllowance},
+		Licence:     LicenceOGL3,
+		Attribution: "Contains public sector information from DWP Stat-Xplore licensed under the Open Government Licence v3.0",
+	},
+}
+
+var PrescribingAttribution = SourceAttribution{
+	Publisher:   "NHS Business Services Authority",
+	Datasets:    []string{"english-prescribing-dataset"},
+	Licence:     LicenceOGL3,
+	Attribution: "Contains public sector information from the English Prescribing Dataset licensed under the Open Government Licence v3.0",
+}
+
+var WorldAttribution = SourceAttribution{
+	Publisher:   "OpenStreetMap contributors",
+	Datasets:    []string{"world"},
+	Licence:     LicenceODbL1,
+	Attribution: "© OpenStreetMap contributors, available under the Open Database License",
+}
+
+// Provenance marks outputs as synthetic, and credits the datasets from
+// which they were derived, so that both travel with the files when they're
+// shared.
+type Provenance struct {
+	Synthetic bool                `json:"synthetic"`
+	Notice    string              `json:"notice"`
+	Sources   []SourceAttribution `json:"sources"`
+}
+
+// newProvenance credits the datasets of data whose files exist, including
+// the QOF prevalences of conditions, with prescribing, if prescribing data
+// was read, and the world.
+func newProvenance(data DataManifest, conditions []QOFCondition, prescribing bool) *Provenance {
+	names := make([]string, 0, len(data)+len(conditions))
+	for name := range data {
+		names = append(names, name)
+	}
+	for _, condition := range conditions {
+		names = append(names, QOFConditionDataset(condition))
+	}
+	p := &Provenance{Synthetic: true, Notice: ProvenanceNotice}
+	for _, attribution := range SourceAttributions {
+		used := make([]string, 0, len(attribution.Datasets))
+		for _, dataset := range attribution.Datasets {
+			for _, name := range names {
+				matches := name == dataset || (strings.HasSuffix(dataset, "/") && strings.HasPrefix(name, dataset))
+				if matches && fileExists(data.Get(name).Filename) {
+					used = append(used, dataset)
+					break
+				}
+			}
+		}
+		if len(used) > 0 {
+			a := attribution
+			a.Datasets = used
+			p.Sources = append(p.Sources, a)
+		}
+	}
+	if prescribing {
+		p.Sources = append(p.Sources, PrescribingAttribution)
+	}
+	p.Sources = append(p.Sources, WorldAttribution)
+	return p
+}
+
+// Fields returns the provenance as keys and values, for the metadata of
+// formats that have it, like Arrow and SQLite. Sources are numbered from
+// 1, as source_1, source_2, etc, so keys are unique.
+func (p *Provenance) Fields() [][2]string {
+	fields := [][2]string{
+		{"synthetic", fmt.Sprintf("%v", p.Synthetic)},
+		{"notice", p.Notice},
+	}
+	for i, s := range p.Sources {
+		fields = append(fields, [2]string{fmt.Sprintf("source_%d", i+1), fmt.Sprintf("%s: %s (%s): %s", s.Publisher, strings.Join(s.Datasets, ", "), s.Licence, s.Attribution)})
+	}
+	return fields
+}
+
+// Lines returns the fields of the provenance as "key: value" lines.
+func (p *Provenance) Lines() []string {
+	fields := p.Fields()
+	lines := make([]string, len(fields))
+	for i, f := range fields {
+		lines[i] = f[0] + ": " + f[1]
+	}
+	return lines
+}
+
+// outputProvenances holds the provenance with which the outputs created
+// in each directory are marked, by markOutputs, so that each output is
+// marked as it's created, without the provenance being passed to every
+// writer.
+var outputProvenances = struct {
+	sync.Mutex
+	byDirectory map[string]*outputProvenance
+}{byDirectory: make(map[string]*outputProvenance)}
+
+type outputProvenance struct {
+	provenance *Provenance
+	csv        bool
+}
+
+// markOutputs marks the outputs created in directory, and its
+// subdirectories, by createOutput and writeJSONOutput, with p, until the
+// returned function is called. CSV outputs are only marked if csv is
+// true.
+func markOutputs(directory string, p *Provenance, csv bool) func() {
+	directory = absoluteDirectory(directory)
+	marked := &outputProvenance{provenance: p, csv: csv}
+	outputProvenances.Lock()
+	outputProvenances.byDirectory[directory] = marked
+	outputProvenances.Unlock()
+	return func() {
+		outputProvenances.Lock()
+		if outputProvenances.byDirectory[directory] == marked {
+			delete(outputProvenances.byDirectory, directory)
+		}
+		outputProvenances.Unlock()
+	}
+}
+
+func absoluteDirectory(directory string) string {
+	if abs, err := filepath.Abs(directory); err == nil {
+		return abs
+	}
+	return filepath.Clean(directory)
+}
+
+// provenanceOf returns the provenance with which filename is marked, from
+// the closest of its directories marked by markOutputs, or nil.
+func provenanceOf(filename string) *outputProvenance {
+	outputProvenances.Lock()
+	defer outputProvenances.Unlock()
+	if len(outputProvenances.byDirectory) == 0 {
+		return nil
+	}
+	directory := absoluteDirectory(filepath.Dir(filename))
+	for {
+		if p, ok := outputProvenances.byDirectory[directory]; ok {
+			return p
+		}
+		parent := filepath.Dir(directory)
+		if parent == directory {
+			return nil
+		}
+		directory = parent
+	}
+}
+
+// createOutput creates filename, truncating it if it exists, and, if its
+// directory was marked by markOutputs, starts it with the provenance: a
+// block of lines starting with # for CSV files, if enabled, and a leading
+// comment for HTML and Markdown. Other outputs carry their provenance in
+// the metadata of their format, like Arrow, Parquet, GeoTIFF and SQLite,
+// or, for JSON, a member written by writeJSONOutput.
+func createOutput(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	marked := provenanceOf(filename)
+	if marked == nil {
+		return f, nil
+	}
+	var header strings.Builder
+	switch filepath.Ext(filename) {
+	case ".csv":
+		if marked.csv {
+			for _, line := range marked.provenance.Lines() {
+				header.WriteString("# " + line + "\n")
+			}
+		}
+	case ".html", ".md":
+		header.WriteString("<!--\n")
+		for _, line := range marked.provenance.Lines() {
+			header.WriteString(strings.ReplaceAll(line, "--", "-") + "\n")
+		}
+		header.WriteString("-->\n")
+	}
+	if _, err := f.WriteString(header.String()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeJSONOutput creates filename, and writes v to it as JSON, indented
+// if indent is true. If its directory was marked by markOutputs, and v is
+// encoded as an object, a provenance member is added at its start.
+func writeJSONOutput(filename string, v interface{}, indent bool) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(f)
+	var w io.Writer = b
+	if marked := provenanceOf(filename); marked != nil {
+		provenance, err := json.Marshal(marked.provenance)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w = &jsonProvenanceWriter{w: b, provenance: provenance}
+	}
+	e := json.NewEncoder(w)
+	if indent {
+		e.SetIndent("", "  ")
+	}
+	if err := e.Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := b.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// jsonProvenanceWriter passes JSON through to w, adding the provenance
+// member at the start of its top level object as it's written. JSON whose
+// top level isn't an object, like an array, is passed through unchanged,
+// as there's nowhere to add it.
+type jsonProvenanceWriter struct {
+	w          io.Writer
+	provenance []byte
+	// Whether the top level object has begun, and the whitespace since
+	opened bool
+	space  []byte
+	done   bool
+}
+
+func (j *jsonProvenanceWriter) Write(b []byte) (int, error) {
+	for i, c := range b {
+		if j.done {
+			if _, err := j.w.Write(b[i:]); err != nil {
+				return i, err
+			}
+			break
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if j.opened {
+				j.space = append(j.space, c)
+			} else if _, err := j.w.Write([]byte{c}); err != nil {
+				return i, err
+			}
+		case !j.opened && c == '{':
+			j.opened = true
+			if _, err := j.w.Write([]byte{c}); err != nil {
+				return i, err
+			}
+		case !j.opened:
+			j.done = true
+			if _, err := j.w.Write([]byte{c}); err != nil {
+				return i, err
+			}
+		default:
+			next := append(append(append([]byte{}, j.space...), `"provenance":`...), j.provenance...)
+			if c != '}' {
+				next = append(append(next, ','), j.space...)
+			}
+			next = append(next, c)
+			j.done = true
+			if _, err := j.w.Write(next); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testProvenance() *Provenance {
+	return &Provenance{Synthetic: true, Notice: ProvenanceNotice, Sources: []SourceAttribution{WorldAttribution}}
+}
+
+func TestCreateOutputMarksOutputsAsTheyreCreated(t *testing.T) {
+	directory := t.TempDir()
+	if err := os.Mkdir(filepath.Join(directory, "surfaces"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string) string {
+		f, err := createOutput(filepath.Join(directory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("content\n")
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(directory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if s := write("unmarked.csv"); s != "content\n" {
+		t.Errorf("expected outputs of unmarked directories to be unchanged, found %q", s)
+	}
+
+	unmark := markOutputs(directory, testProvenance(), true)
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{"people.csv", "# synthetic: true\n# notice: " + ProvenanceNotice + "\n# source_1: OpenStreetMap contributors"},
+		{"surfaces/counts.csv", "# synthetic: true\n"},
+		{"validation.html", "<!--\nsynthetic: true\n"},
+		{"assumptions.md", "<!--\nsynthetic: true\n"},
+		{"population.index", "content\n"},
+	}
+	for _, test := range tests {
+		s := write(test.name)
+		if !strings.HasPrefix(s, test.prefix) || !strings.HasSuffix(s, "content\n") {
+			t.Errorf("%s: expected to start with %q, found %q", test.name, test.prefix, s)
+		}
+	}
+	unmark()
+	if s := write("people.csv"); s != "content\n" {
+		t.Errorf("expected outputs to be unmarked after unmarking, found %q", s)
+	}
+
+	defer markOutputs(directory, testProvenance(), false)()
+	if s := write("people.csv"); s != "content\n" {
+		t.Errorf("expected CSV outputs not to be marked without csv, found %q", s)
+	}
+	if s := write("validation.html"); !strings.HasPrefix(s, "<!--\n") {
+		t.Errorf("expected HTML outputs to be marked without csv, found %q", s)
+	}
+}
+
+func TestWriteJSONOutput(t *testing.T) {
+	directory := t.TempDir()
+	defer markOutputs(directory, testProvenance(), false)()
+	tests := []struct {
+		name     string
+		v        interface{}
+		indent   bool
+		marked   bool
+		expected string
+	}{
+		{"object.json", map[string]int{"a": 1, "b": 2}, true, true, `{"a":1,"b":2}`},
+		{"compact.geojson", map[string]int{"a": 1}, false, true, `{"a":1}`},
+		{"empty.json", map[string]int{}, true, true, `{}`},
+		{"array.json", []int{1, 2}, true, false, `[1,2]`},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(directory, test.name)
+		if err := writeJSONOutput(filename, test.v, test.indent); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(b, &members); (err == nil) != test.marked {
+			t.Errorf("%s: expected an object: %v, found %q", test.name, test.marked, b)
+			continue
+		}
+		if test.marked {
+			if !bytes.HasPrefix(bytes.TrimLeft(b, "{ \n"), []byte(`"provenance":`)) {
+				t.Errorf("%s: expected provenance first, found %q", test.name, b)
+			}
+			var p Provenance
+			if err := json.Unmarshal(members["provenance"], &p); err != nil || !p.Synthetic || len(p.Sources) != 1 {
+				t.Errorf("%s: expected the provenance, found %s", test.name, members["provenance"])
+			}
+			delete(members, "provenance")
+			b, _ = json.Marshal(members)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, b); err != nil {
+			t.Fatal(err)
+		}
+		if compact.String() != test.expected {
+			t.Errorf("%s: expected %s, found %s", test.name, test.expected, compact.String())
+		}
+	}
+}
+
+func TestJSONProvenanceWriterAcrossWrites(t *testing.T) {
+	var b bytes.Buffer
+	w := &jsonProvenanceWriter{w: &b, provenance: []byte(`{"synthetic":true}`)}
+	// One byte at a time, as an encoder might flush
+	for _, c := range []byte("  {\n  \"a\": [1, {\"b\": 2}]\n}\n") {
+		if _, err := w.Write([]byte{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "  {\n  \"provenance\":{\"synthetic\":true},\n  \"a\": [1, {\"b\": 2}]\n}\n"
+	if b.String() != expected {
+		t.Errorf("expected %q, found %q", expected, b.String())
+	}
+}
+
+func TestTableExportersIncludeProvenance(t *testing.T) {
+	data := &ExportData{OutputDirectory: t.TempDir(), Provenance: testProvenance()}
+	table := &ExportTable{
+		Fields: []ArrowField{{Name: "code", Type: ArrowTypeUtf8}},
+		Rows: func(each func(row []string) error) error {
+			return each([]string{"G1"})
+		},
+	}
+	for _, format := range []*ExportFormat{ExportFormatArrow, ExportFormatParquet} {
+		e, err := format.New(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Practices(nil, table); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, _, metadata := readArrow(t, filepath.Join(data.OutputDirectory, "gps.arrow"))
+	if metadata["synthetic"] != "true" || metadata["notice"] != ProvenanceNotice || !strings.HasPrefix(metadata["source_1"], "OpenStreetMap") {
+		t.Errorf("expected the provenance in the Arrow metadata, found %v", metadata)
+	}
+	_, footer := readParquet(t, filepath.Join(data.OutputDirectory, "gps.parquet"))
+	found := make(map[string]string)
+	for _, kv := range footer[5].([]interface{}) {
+		m := kv.(map[int16]interface{})
+		found[m[1].(string)] = m[2].(string)
+	}
+	if found["synthetic"] != "true" || found["notice"] != ProvenanceNotice {
+		t.Errorf("expected the provenance in the Parquet metadata, found %v", found)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// The largest difference between the simulated and published share of a
+// condition's register in an age band before a warning is logged
+const RegisterAgesWarningDifference = 0.05
+
+// PublishedRegisterAgeBand is the share of a condition's register within a
+// range of ages, from a published distribution, like that of the National
+// Diabetes Audit.
+type PublishedRegisterAgeBand struct {
+	Ages  AgeRange
+	Share float64
+}
+
+// readPublishedRegisterAges reads the age distribution of condition
+// registers from a CSV file with condition, ages and patients columns,
+// where ages are given as for prevalence overrides, like 40-59, or 85+,
+// and patients are counts or shares, normalised to shares of the
+// condition's total. The ranges of each condition must cover every age
+// once, so that each person on the register falls in one. Lines starting
+// with # are ignored.
+func readPublishedRegisterAges(filename string) (map[QOFCondition][]PublishedRegisterAgeBand, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open register ages: %s", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read header: %s", filename, err)
+	}
+	columns := map[string]int{"condition": -1, "ages": -1, "patients": -1}
+	for i, name := range header {
+		if _, ok := columns[name]; ok {
+			columns[name] = i
+		}
+	}
+	for name, i := range columns {
+		if i < 0 {
+			return nil, fmt.Errorf("%s: no %s column", filename, name)
+		}
+	}
+	published := make(map[QOFCondition][]PublishedRegisterAgeBand)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		line, _ := r.FieldPos(0)
+		condition := QOFConditionFromString(row[columns["condition"]])
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("%s:%d: unknown condition %q", filename, line, row[columns["condition"]])
+		}
+		ages, err := prevalenceOverrideAges(row[columns["ages"]])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+		patients, err := strconv.ParseFloat(row[columns["patients"]], 64)
+		if err != nil || patients < 0.0 {
+			return nil, fmt.Errorf("%s:%d: bad patients %q", filename, line, row[columns["patients"]])
+		}
+		published[condition] = append(published[condition], PublishedRegisterAgeBand{Ages: ages, Share: patients})
+	}
+	for condition, bands := range published {
+		total := 0.0
+		for _, b := range bands {
+			total += b.Share
+		}
+		if total <= 0.0 {
+			return nil, fmt.Errorf("%s: no patients for %s", filename, condition)
+		}
+		for i := range bands {
+			bands[i].Share /= total
+		}
+		sort.Slice(bands, func(i, j int) bool { return bands[i].Ages.Begin < bands[j].Ages.Begin })
+		next := 0
+		for i, b := range bands {
+			if i > 0 && bands[i-1].Ages.End == 0 {
+				return nil, fmt.Errorf("%s: ages for %s overlap, as %s follows %s", filename, condition, registerAgesLabel(b.Ages), registerAgesLabel(bands[i-1].Ages))
+			} else if b.Ages.Begin != next {
+				return nil, fmt.Errorf("%s: ages for %s don't cover every age once, expected a range from %d, found %s", filename, condition, next, registerAgesLabel(b.Ages))
+			}
+			next = b.Ages.End
+		}
+		if next != 0 {
+			return nil, fmt.Errorf("%s: ages for %s don't cover every age, expected a range from %d, like %d+", filename, condition, next, next)
+		}
+	}
+	return published, nil
+}
+
+// RegisterAgeBand compares the simulated and published share of a
+// condition's register within a range of ages.
+type RegisterAgeBand struct {
+	Ages           AgeRange
+	Simulated      int
+	SimulatedShare float64
+	// The share of the register diagnosed at ages within the band, if
+	// onset ages are simulated
+	DiagnosedShare float64
+	Published      float64
+	HasPublished   bool
+}
+
+// Difference returns the simulated share of the register in the band,
+// less the published share.
+func (r *RegisterAgeBand) Difference() float64 {
+	return r.SimulatedShare - r.Published
+}
+
+// RegisterAges is the age distribution of the simulated register of a
+// condition across the ICB's practices.
+type RegisterAges struct {
+	Condition QOFCondition
+	Register  int
+	Bands     []*RegisterAgeBand
+	// Whether the bands are those of a published distribution
+	Published bool
+	// Whether onset ages are simulated for the condition, giving the
+	// share of the register diagnosed in each band
+	Onset bool
+}
+
+// MaxDifference returns the largest absolute difference between the
+// simulated and published share of the register in a band, or 0 without
+// a published distribution.
+func (r *RegisterAges) MaxDifference() float64 {
+	d := 0.0
+	for _, b := range r.Bands {
+		if b.HasPublished {
+			d = math.Max(d, math.Abs(b.Difference()))
+		}
+	}
+	return d
+}
+
+// registerAgesLabel returns a label for ages, as used for age bands
+func registerAgesLabel(ages AgeRange) string {
+	if ages.End == 0 {
+		return fmt.Sprintf("%d+", ages.Begin)
+	}
+	return fmt.Sprintf("%d-%d", ages.Begin, ages.End-1)
+}
+
+// compareRegisterAges returns the age distribution of the register of each
+// condition, over everyone registered with the given practices, as QOF
+// registers are counted, wherever they live. Conditions with a published
+// distribution use its ranges of ages, and others the given bands. Since
+// conditions are assigned using prevalences given for bands of ages, the
+// distribution within a register is the part of the simulation most
+// sensitive to the choice of bands, and the comparison with a published
+// distribution is logged, with a warning for bands that differ by more
+// than RegisterAgesWarningDifference. With an incidence model, the share
+// of the register of each condition it models diagnosed within each band
+// is also given. Other conditions have no onset ages.
+func compareRegisterAges(byPractice map[GPPracticeCode][]*Person, practices GPPracticeCodeSet, conditions []QOFCondition, bands *AgeBands, published map[QOFCondition][]PublishedRegisterAgeBand, incidence *IncidenceModel) []*RegisterAges {
+	for condition := range published {
+		found := false
+		for _, c := range conditions {
+			found = found || c == condition
+		}
+		if !found {
+			Debugf("  register ages: %s isn't simulated, so isn't compared", condition)
+		}
+	}
+	registers := make([]*RegisterAges, 0, len(conditions))
+	log.Printf("register ages:")
+	for _, condition := range conditions {
+		r := &RegisterAges{Condition: condition}
+		if incidence != nil {
+			_, r.Onset = incidence.ByCondition[condition]
+		}
+		if given, ok := published[condition]; ok {
+			r.Published = true
+			for _, p := range given {
+				r.Bands = append(r.Bands, &RegisterAgeBand{Ages: p.Ages, Published: p.Share, HasPublished: true})
+			}
+		} else {
+			for band := range bands.Begins {
+				r.Bands = append(r.Bands, &RegisterAgeBand{Ages: bands.Range(band)})
+			}
+		}
+		diagnosed := make([]int, len(r.Bands))
+		for code := range practices {
+			for _, p := range byPractice[code] {
+				if !p.Conditions.Contains(condition) {
+					continue
+				}
+				r.Register++
+				for i, b := range r.Bands {
+					if b.Ages.Contains(p.Age) {
+						b.Simulated++
+					}
+					if r.Onset && b.Ages.Contains(int(p.OnsetAges[condition.Index()])) {
+						diagnosed[i]++
+					}
+				}
+			}
+		}
+		if r.Register > 0 {
+			for i, b := range r.Bands {
+				b.SimulatedShare = float64(b.Simulated) / float64(r.Register)
+				b.DiagnosedShare = float64(diagnosed[i]) / float64(r.Register)
+			}
+		}
+		if r.Published {
+			log.Printf("  %s: max difference in share: %.1f%%", condition, 100.0*r.MaxDifference())
+			for _, b := range r.Bands {
+				if math.Abs(b.Difference()) > RegisterAgesWarningDifference {
+					Warningf("  register ages: %s %s: simulated %.1f%% of the register, published %.1f%%", condition, registerAgesLabel(b.Ages), 100.0*b.SimulatedShare, 100.0*b.Published)
+				}
+			}
+		}
+		registers = append(registers, r)
+	}
+	return registers
+}
+
+// writeRegisterAges writes register-ages.csv, with the simulated and
+// published share of each condition's register in each range of ages,
+// leaving published shares empty for conditions without them, and shares
+// diagnosed empty for conditions without onset ages.
+func writeRegisterAges(registers []*RegisterAges, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "register-ages.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"condition", "age_band", "simulated", "simulated_share", "published_share", "difference", "diagnosed_share"})
+	for _, r := range registers {
+		for _, b := range r.Bands {
+			published, difference, diagnosed := "", "", ""
+			if b.HasPublished {
+				published = fmt.Sprintf("%f", b.Published)
+				difference = fmt.Sprintf("%f", b.Difference())
+			}
+			if r.Onset {
+				diagnosed = fmt.Sprintf("%f", b.DiagnosedShare)
+			}
+			w.Write([]string{r.Condition.String(), registerAgesLabel(b.Ages), strconv.Itoa(b.Simulated), fmt.Sprintf("%f", b.SimulatedShare), published, difference, diagnosed})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
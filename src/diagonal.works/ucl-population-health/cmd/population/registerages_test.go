@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPublishedRegisterAges(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		valid bool
+	}{
+		{"valid", []string{"dm,40-59,30", "dm,0-39,10", "# A comment", "dm,60+,60"}, true},
+		{"all ages", []string{"dm,*,1"}, true},
+		{"not from 0", []string{"dm,18-59,10", "dm,60+,10"}, false},
+		{"gap", []string{"dm,0-39,10", "dm,50+,10"}, false},
+		{"overlap", []string{"dm,0-39,10", "dm,30+,10"}, false},
+		{"not open ended", []string{"dm,0-39,10", "dm,40-89,10"}, false},
+		{"after open ended", []string{"dm,0+,10", "dm,40+,10"}, false},
+		{"unknown condition", []string{"xx,0+,10"}, false},
+		{"negative", []string{"dm,0+,-1"}, false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "register-ages.csv")
+		content := "condition,ages,patients\n" + strings.Join(test.lines, "\n") + "\n"
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		published, err := readPublishedRegisterAges(filename)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: expected no error, found %s", test.name, err)
+			continue
+		}
+		total := 0.0
+		for i, b := range published[QOFConditionDiabetes] {
+			if i > 0 && b.Ages.Begin < published[QOFConditionDiabetes][i-1].Ages.Begin {
+				t.Errorf("%s: expected ranges to be sorted", test.name)
+			}
+			total += b.Share
+		}
+		if math.Abs(total-1.0) > 1e-9 {
+			t.Errorf("%s: expected shares to total 1, found %f", test.name, total)
+		}
+	}
+}
+
+func TestCompareRegisterAges(t *testing.T) {
+	bands, err := AgeBandsFromString("0,40,65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var both QOFConditions
+	both.Add(QOFConditionDiabetes)
+	both.Add(QOFConditionHypertension)
+	person := func(age int, diabetesOnset int) *Person {
+		p := &Person{Age: age, Conditions: both}
+		p.OnsetAges[QOFConditionDiabetes.Index()] = int16(diabetesOnset)
+		return p
+	}
+	byPractice := map[GPPracticeCode][]*Person{
+		"G1": {person(30, 20), person(50, 45), person(70, 30), person(80, 70)},
+		// Not an ICB practice
+		"G2": {person(30, 20)},
+	}
+	published := map[QOFCondition][]PublishedRegisterAgeBand{
+		QOFConditionDiabetes: {{Ages: AgeRange{Begin: 0, End: 60}, Share: 0.4}, {Ages: AgeRange{Begin: 60}, Share: 0.6}},
+	}
+	// Only diabetes has an incidence model, so hypertension has no onset
+	// ages
+	incidence := &IncidenceModel{ByCondition: map[QOFCondition]AgePrevalences{QOFConditionDiabetes: nil}}
+	conditions := []QOFCondition{QOFConditionDiabetes, QOFConditionHypertension}
+	registers := compareRegisterAges(byPractice, GPPracticeCodeSet{"G1": struct{}{}}, conditions, bands, published, incidence)
+	if len(registers) != 2 {
+		t.Fatalf("expected 2 registers, found %d", len(registers))
+	}
+	dm, hyp := registers[0], registers[1]
+	if dm.Register != 4 || !dm.Published || !dm.Onset {
+		t.Errorf("expected a published register of 4 for dm, with onset, found %+v", dm)
+	}
+	dmExpected := []struct {
+		simulated int
+		diagnosed float64
+	}{
+		{2, 0.75},
+		{2, 0.25},
+	}
+	for i, e := range dmExpected {
+		b := dm.Bands[i]
+		if b.Simulated != e.simulated || math.Abs(b.DiagnosedShare-e.diagnosed) > 1e-9 {
+			t.Errorf("dm %s: expected %d people, %f diagnosed, found %d, %f", registerAgesLabel(b.Ages), e.simulated, e.diagnosed, b.Simulated, b.DiagnosedShare)
+		}
+	}
+	if d := dm.MaxDifference(); math.Abs(d-0.1) > 1e-9 {
+		t.Errorf("expected a max difference of 0.1 for dm, found %f", d)
+	}
+	if hyp.Published || hyp.Onset || len(hyp.Bands) != 3 {
+		t.Errorf("expected hyp in unpublished bands, without onset, found %+v", hyp)
+	}
+	for _, b := range hyp.Bands {
+		if b.DiagnosedShare != 0.0 {
+			t.Errorf("expected no diagnosed share for hyp, found %f", b.DiagnosedShare)
+		}
+	}
+
+	directory := t.TempDir()
+	if err := writeRegisterAges(registers, directory); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(directory, "register-ages.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows[1:] {
+		if (row[0] == "dm") != (row[6] != "") {
+			t.Errorf("expected a diagnosed share only for dm, found %v", row)
+		}
+	}
+}
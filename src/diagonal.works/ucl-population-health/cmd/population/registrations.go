@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	GPRegistrationsAgePracticeCodeColumn = "ORG_CODE"
+	GPRegistrationsAgeAgeColumn          = "AGE"
+	GPRegistrationsAgePatientsColumn     = "NUMBER_OF_PATIENTS"
+
+	// Calibration weights are clamped to within this factor of 1, to
+	// avoid a practice with few registrations in an age band dominating
+	// the choices of people in it
+	RegistrationCalibrationMaxWeight = 10.0
+)
+
+// RegistrationProfile is the number of patients registered with a practice
+// in each age band, by sex, indexed by Male and Female.
+type RegistrationProfile [2][]float64
+
+func NewRegistrationProfile(bands *AgeBands) *RegistrationProfile {
+	var p RegistrationProfile
+	for i := range p {
+		p[i] = make([]float64, len(bands.Begins))
+	}
+	return &p
+}
+
+func (p *RegistrationProfile) Total() float64 {
+	total := 0.0
+	for _, counts := range p {
+		for _, n := range counts {
+			total += n
+		}
+	}
+	return total
+}
+
+// Dissimilarity returns half the sum of the absolute differences between
+// the shares of the two profiles in each band, so 0 if they're identical,
+// and 1 if they don't overlap.
+func (p *RegistrationProfile) Dissimilarity(other *RegistrationProfile) float64 {
+	t1, t2 := p.Total(), other.Total()
+	if t1 == 0.0 || t2 == 0.0 {
+		return 1.0
+	}
+	d := 0.0
+	for sex := range p {
+		for band := range p[sex] {
+			d += math.Abs(p[sex][band]/t1 - other[sex][band]/t2)
+		}
+	}
+	return d / 2.0
+}
+
+// readGPRegistrationsByAge reads the number of patients registered with
+// each selected practice by single year of age, from the males and
+// females files of NHS Digital's Patients Registered at a GP Practice
+// publication, grouped into bands. The publication's top coded age, 95+,
+// falls in the last band.
+// https://digital.nhs.uk/data-and-information/publications/statistical/patients-registered-at-a-gp-practice
+func readGPRegistrationsByAge(males *Dataset, females *Dataset, selected GPPracticeCodeSet, bands *AgeBands) (map[GPPracticeCode]*RegistrationProfile, error) {
+	profiles := make(map[GPPracticeCode]*RegistrationProfile)
+	for sex, dataset := range []*Dataset{males, females} {
+		r, err := openDataset(dataset)
+		if err != nil {
+			return nil, err
+		}
+		r.Comment = '#'
+		row, err := r.Read()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		columns := make(map[string]int)
+		for i, column := range row {
+			columns[column] = i
+		}
+		for _, column := range []string{"practice-code", "age", "patients"} {
+			if _, ok := columns[dataset.Column(column)]; !ok {
+				r.Close()
+				return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+			}
+		}
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				r.Close()
+				return nil, err
+			}
+			practice := GPPracticeCode(row[columns[dataset.Column("practice-code")]])
+			if _, ok := selected[practice]; !ok {
+				continue
+			}
+			a := row[columns[dataset.Column("age")]]
+			if a == "ALL" {
+				continue
+			}
+			age, err := strconv.Atoi(strings.TrimSuffix(a, "+"))
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s: bad age %q", dataset.Filename, a)
+			}
+			patients, err := strconv.Atoi(row[columns[dataset.Column("patients")]])
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s: bad number of patients: %s", dataset.Filename, err)
+			}
+			profile, ok := profiles[practice]
+			if !ok {
+				profile = NewRegistrationProfile(bands)
+				profiles[practice] = profile
+			}
+			profile[sex][bands.Band(age)] += float64(patients)
+		}
+		r.Close()
+	}
+	log.Printf("  registrations by age: %d practices", len(profiles))
+	return profiles, nil
+}
+
+// RegistrationCalibration holds the published, and simulated, registration
+// profiles of the calibrated practices, and the weights applied to the
+// likelihood of choosing each practice for people in each age band, by
+// sex.
+type RegistrationCalibration struct {
+	Published map[GPPracticeCode]*RegistrationProfile
+	Simulated map[GPPracticeCode]*RegistrationProfile
+	Weights   map[GPPracticeCode]*RegistrationProfile
+	Bands     *AgeBands
+	// The mean dissimilarity between simulated and published profiles
+	// before calibration, and after each iteration
+	Dissimilarity []float64
+}
+
+func (c *RegistrationCalibration) simulate(people []Person) float64 {
+	c.Simulated = make(map[GPPracticeCode]*RegistrationProfile)
+	for code := range c.Published {
+		c.Simulated[code] = NewRegistrationProfile(c.Bands)
+	}
+	for i := range people {
+		p := &people[i]
+		if profile, ok := c.Simulated[p.GP]; ok && (p.Sex == Male || p.Sex == Female) {
+			profile[p.Sex][c.Bands.Band(p.Age)]++
+		}
+	}
+	d := 0.0
+	n := 0
+	for code, simulated := range c.Simulated {
+		if simulated.Total() > 0.0 {
+			d += simulated.Dissimilarity(c.Published[code])
+			n++
+		}
+	}
+	if n > 0 {
+		d /= float64(n)
+	}
+	c.Dissimilarity = append(c.Dissimilarity, d)
+	return d
+}
+
+// reweight scales the weight of each practice in each band by the ratio
+// of its published to simulated share, then normalises the weights so
+// that their mean, weighted by the published profile, is 1, leaving the
+// overall likelihood of choosing the practice to its list size.
+func (c *RegistrationCalibration) reweight() {
+	for code, published := range c.Published {
+		simulated := c.Simulated[code]
+		tp, ts := published.Total(), simulated.Total()
+		if tp == 0.0 || ts == 0.0 {
+			continue
+		}
+		weights := c.Weights[code]
+		mean := 0.0
+		for sex := range weights {
+			for band := range weights[sex] {
+				target := published[sex][band] / tp
+				if s := simulated[sex][band] / ts; s > 0.0 {
+					weights[sex][band] *= target / s
+				} else if target > 0.0 {
+					weights[sex][band] *= RegistrationCalibrationMaxWeight
+				}
+				weights[sex][band] = clamp(weights[sex][band], 1.0/RegistrationCalibrationMaxWeight, RegistrationCalibrationMaxWeight)
+				mean += weights[sex][band] * target
+			}
+		}
+		if mean > 0.0 {
+			for sex := range weights {
+				for band := range weights[sex] {
+					weights[sex][band] /= mean
+				}
+			}
+		}
+	}
+}
+
+// calibrateRegistrations reassigns people to nearby practices, weighting
+// the choice by age and sex, for the given number of iterations, so that
+// the simulated age and sex profile of each practice with published
+// registrations approaches the published profile, rather than only its
+// list size. Profiles are matched within the given age bands, since single
+// years are too noisy at most practices. People who are neither male nor
+// female aren't reweighted.
+func calibrateRegistrations(people []Person, published map[GPPracticeCode]*RegistrationProfile, bands *AgeBands, iterations int, lsoas map[LSOACode]*LSOA, nearbyGPs NearbyGPs, gps map[GPPracticeCode]*GPPractice, rurality *RuralityModel, parameters SimulationParameters, progress Progress) *RegistrationCalibration {
+	c := &RegistrationCalibration{
+		Published: published,
+		Weights:   make(map[GPPracticeCode]*RegistrationProfile),
+		Bands:     bands,
+	}
+	for code := range published {
+		weights := NewRegistrationProfile(c.Bands)
+		for sex := range weights {
+			for band := range weights[sex] {
+				weights[sex][band] = 1.0
+			}
+		}
+		c.Weights[code] = weights
+	}
+	log.Printf("  dissimilarity: before: %.4f", c.simulate(people))
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for i := 0; i < iterations; i++ {
+		c.reweight()
+		progress.Start(fmt.Sprintf("calibrate registrations %d", i+1), len(people))
+		for _, gp := range gps {
+			gp.SimulatedListSize = 0
+		}
+		for j := range people {
+			p := &people[j]
+			if p.Sex == Male || p.Sex == Female {
+				lsoa := lsoas[p.Home]
+				band := c.Bands.Band(p.Age)
+				weight := func(code GPPracticeCode) float64 {
+					if weights, ok := c.Weights[code]; ok {
+						return weights[p.Sex][band]
+					}
+					return 1.0
+				}
+				p.GP = chooseNearbyGP(nearbyGPs[p.Home], gps, rurality.Parameters(lsoa, parameters), weight, rng)
+			}
+			if p.GP != GPPracticeCodeInvalid {
+				gps[p.GP].SimulatedListSize++
+			}
+		}
+		progress.Add(len(people))
+		progress.Done()
+		log.Printf("  dissimilarity: iteration %d: %.4f", i+1, c.simulate(people))
+	}
+	return c
+}
+
+// writeRegistrationProfiles writes registration-profile.csv, comparing the
+// share of each calibrated practice's patients in each age band and sex
+// with the published registrations.
+func (c *RegistrationCalibration) writeRegistrationProfiles(gps map[GPPracticeCode]*GPPractice, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "registration-profile.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "sex", "age_band", "published", "simulated", "published_share", "simulated_share", "weight"})
+	codes := make([]GPPracticeCode, 0, len(c.Published))
+	for code := range c.Published {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	share := func(n float64, total float64) string {
+		if total > 0.0 {
+			return fmt.Sprintf("%f", n/total)
+		}
+		return ""
+	}
+	for _, code := range codes {
+		published, simulated, weights := c.Published[code], c.Simulated[code], c.Weights[code]
+		tp, ts := published.Total(), simulated.Total()
+		for _, sex := range []Sex{Male, Female} {
+			for band := range c.Bands.Begins {
+				w.Write([]string{
+					code.String(),
+					gps[code].Name,
+					sex.String(),
+					strconv.Itoa(c.Bands.Begins[band]),
+					strconv.Itoa(int(published[sex][band])),
+					strconv.Itoa(int(simulated[sex][band])),
+					share(published[sex][band], tp),
+					share(simulated[sex][band], ts),
+					fmt.Sprintf("%f", weights[sex][band]),
+				})
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+)
+
+// deriveRelativeRatePairs returns prevalences with the prevalence by age
+// and sex of each pair of conditions given as a relative rate derived from
+// those of its conditions, leaving prevalences unchanged. Pairs are given
+// this way where, as for mental health conditions and physical conditions,
+// an association is known but not its variation with age and sex.
+func deriveRelativeRatePairs(prevalences AllPrevalences) (AllPrevalences, error) {
+	relative := make([]DiagonosisGiven, 0)
+	for d, p := range prevalences {
+		if p.RelativeRate != 0.0 {
+			relative = append(relative, d)
+		}
+	}
+	if len(relative) == 0 {
+		return prevalences, nil
+	}
+	sort.Slice(relative, func(i, j int) bool { return relative[i].String() < relative[j].String() })
+	log.Printf("  pairs from relative rates")
+	derived := make(AllPrevalences, len(prevalences))
+	for d, p := range prevalences {
+		derived[d] = p
+	}
+	for _, d := range relative {
+		p := prevalences[d]
+		c1, c2, ok := pairConditions(d)
+		if !ok {
+			return nil, fmt.Errorf("%s: a relative rate can only be given for a pair of conditions", describePrevalence(d))
+		} else if p.RelativeRate < 0.0 {
+			return nil, fmt.Errorf("%s: negative relative rate", describePrevalence(d))
+		} else if len(p.ByAge) > 0 {
+			return nil, fmt.Errorf("%s: both a relative rate and prevalence by age given", describePrevalence(d))
+		}
+		p1, ok := prevalences[OneCondition(c1)]
+		if !ok {
+			return nil, fmt.Errorf("%s: no prevalence for %s in %s", describePrevalence(d), c1, PrevalencesFilename)
+		}
+		p2, ok := prevalences[OneCondition(c2)]
+		if !ok {
+			return nil, fmt.Errorf("%s: no prevalence for %s in %s", describePrevalence(d), c2, PrevalencesFilename)
+		}
+		derived[d] = Prevalences{Conditions: d, ByAge: relativeRatePairPrevalences(p1.ByAge, p2.ByAge, p.RelativeRate)}
+		log.Printf("    %s: relative rate %.2f", d.Diagnosis, p.RelativeRate)
+	}
+	return derived, nil
+}
+
+// relativeRatePairPrevalences returns the prevalence of a pair of
+// conditions with prevalences p1 and p2, as rate times the product of
+// their prevalences, over ranges split at the ages at which either
+// changes. The prevalence of the pair is capped at that of each
+// condition, since it can't be more prevalent than either.
+func relativeRatePairPrevalences(p1 AgePrevalences, p2 AgePrevalences, rate float64) AgePrevalences {
+	sexes := len(p1)
+	if len(p2) > sexes {
+		sexes = len(p2)
+	}
+	pair := make(AgePrevalences, sexes)
+	for sex := 0; sex < sexes; sex++ {
+		if sex >= len(p1) || sex >= len(p2) || len(p1[sex]) == 0 || len(p2[sex]) == 0 {
+			// The other sex, when it's not given for both conditions, is
+			// left to be derived from males and females
+			pair[sex] = make([]AgePrevalence, 0)
+			continue
+		}
+		boundaries := make(map[int]struct{})
+		for _, ranges := range [][]AgePrevalence{p1[sex], p2[sex]} {
+			for _, r := range ranges {
+				boundaries[r.Ages.Begin] = struct{}{}
+				if r.Ages.End != 0 {
+					boundaries[r.Ages.End] = struct{}{}
+				}
+			}
+		}
+		ages := make([]int, 0, len(boundaries))
+		for age := range boundaries {
+			ages = append(ages, age)
+		}
+		sort.Ints(ages)
+		for i, begin := range ages {
+			r := AgeRange{Begin: begin}
+			if i+1 < len(ages) {
+				r.End = ages[i+1]
+			}
+			a, b := p1.Prevalence(Sex(sex), begin), p2.Prevalence(Sex(sex), begin)
+			p := math.Min(rate*a*b, math.Min(a, b))
+			pair[sex] = append(pair[sex], AgePrevalence{Ages: r, Prevalence: p})
+		}
+	}
+	return pair
+}
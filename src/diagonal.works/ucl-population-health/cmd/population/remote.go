@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RemoteSchemeGCS = "gs"
+	RemoteSchemeS3  = "s3"
+
+	// The time allowed to fetch an access token from the GCE metadata
+	// server, which fails quickly away from Google Cloud
+	GCEMetadataTimeout  = 2 * time.Second
+	GCEMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// The time before an access token from the metadata server expires at
+	// which it's replaced, so that it doesn't expire during a request
+	GCEMetadataTokenMargin = 5 * time.Minute
+
+	// The time allowed for a bucket to begin responding to a request, and
+	// for the whole request, including downloading the largest datasets
+	RemoteResponseTimeout = 1 * time.Minute
+	RemoteRequestTimeout  = 1 * time.Hour
+)
+
+var remoteClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: RemoteResponseTimeout,
+	},
+	Timeout: RemoteRequestTimeout,
+}
+
+// RemoteOutputFlags are flags naming files or directories that are
+// written, rather than read, and so can't be URLs
+var RemoteOutputFlags = map[string]bool{
+	"output": true,
+	"cached": true,
+	"sqlite": true,
+}
+
+// isRemote returns true if filename is a gs:// or s3:// URL
+func isRemote(filename string) bool {
+	return strings.HasPrefix(filename, RemoteSchemeGCS+"://") || strings.HasPrefix(filename, RemoteSchemeS3+"://")
+}
+
+// RemoteObject is an object in a Cloud Storage or S3 bucket
+type RemoteObject struct {
+	Scheme string
+	Bucket string
+	Key    string
+}
+
+func RemoteObjectFromURL(s string) (RemoteObject, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok || (scheme != RemoteSchemeGCS && scheme != RemoteSchemeS3) {
+		return RemoteObject{}, fmt.Errorf("%s: expected a gs:// or s3:// URL", s)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return RemoteObject{}, fmt.Errorf("%s: expected %s://<bucket>/<object>", s, scheme)
+	}
+	// Objects are downloaded to a path formed from the bucket and key, which
+	// mustn't be able to escape the download directory
+	if bucket == "." || bucket == ".." {
+		return RemoteObject{}, fmt.Errorf("%s: bad bucket name %q", s, bucket)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return RemoteObject{}, fmt.Errorf("%s: object names can't have empty, . or .. segments", s)
+		}
+	}
+	return RemoteObject{Scheme: scheme, Bucket: bucket, Key: key}, nil
+}
+
+func (r RemoteObject) String() string {
+	return r.Scheme + "://" + r.Bucket + "/" + r.Key
+}
+
+// RemoteFiles downloads the inputs given as gs:// or s3:// URLs, like the
+// world indexes and the datasets of a data manifest, to a local directory,
+// so that the pipeline can run in batch jobs without a disk seeded with
+// them. A downloaded file is kept, with its ETag, and reused while the
+// ETag of the object is unchanged.
+//
+// Cloud Storage requests use the access token in GOOGLE_OAUTH_ACCESS_TOKEN,
+// or that of the default service account from the GCE metadata server, and
+// S3 requests are signed with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, in AWS_REGION, with AWS_ENDPOINT_URL used in place of
+// Amazon's for S3 compatible stores. Without credentials, requests are
+// anonymous, for public buckets.
+type RemoteFiles struct {
+	Directory string
+
+	lock        sync.Mutex
+	gcsToken    string
+	gcsExpiry   time.Time
+	gcsFailed   bool
+	gcsTokenURL string // GCEMetadataTokenURL if empty
+}
+
+var remoteFiles = &RemoteFiles{Directory: defaultRemoteCacheDirectory()}
+
+func defaultRemoteCacheDirectory() string {
+	if d, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(d, "ucl-population-health", "remote")
+	}
+	return filepath.Join(os.TempDir(), "ucl-population-health", "remote")
+}
+
+// Filename returns the local filename to which the object is downloaded
+func (r *RemoteFiles) Filename(object RemoteObject) string {
+	return filepath.Join(r.Directory, object.Scheme, object.Bucket, filepath.FromSlash(object.Key))
+}
+
+// Fetch downloads the object at the URL given by filename, if it isn't
+// already downloaded, returning its local filename. Objects that don't
+// exist return an error for which os.IsNotExist is true, allowing
+// optional datasets to be missing, as for local files.
+func (r *RemoteFiles) Fetch(filename string) (string, error) {
+	object, err := RemoteObjectFromURL(filename)
+	if err != nil {
+		return "", err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	local := r.Filename(object)
+	if etag, err := os.ReadFile(local + ".etag"); err == nil {
+		if _, err := os.Stat(local); err == nil {
+			response, err := r.do(http.MethodHead, object)
+			if err != nil {
+				Warningf("  %s: %s, so using the copy downloaded previously", object, err)
+				return local, nil
+			}
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK && response.Header.Get("ETag") == string(etag) {
+				Debugf("  %s: unchanged since downloaded to %s", object, local)
+				return local, nil
+			}
+		}
+	}
+
+	response, err := r.do(http.MethodGet, object)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", object, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return "", &os.PathError{Op: "open", Path: object.String(), Err: os.ErrNotExist}
+	} else if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return "", fmt.Errorf("%s: %s: %s", object, response.Status, strings.TrimSpace(string(body)))
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return "", err
+	}
+	// Downloaded alongside, then renamed, so that an interrupted download
+	// is never mistaken for a complete one
+	f, err := os.CreateTemp(filepath.Dir(local), ".download-*")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, response.Body)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), local)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("%s: failed to download: %s", object, err)
+	}
+	if etag := response.Header.Get("ETag"); etag != "" {
+		if err := os.WriteFile(local+".etag", []byte(etag), 0644); err != nil {
+			return "", err
+		}
+	} else {
+		os.Remove(local + ".etag")
+	}
+	log.Printf("  downloaded %s: %.1fMiB", object, float64(n)/(1024.0*1024.0))
+	return local, nil
+}
+
+func (r *RemoteFiles) do(method string, object RemoteObject) (*http.Response, error) {
+	var request *http.Request
+	var err error
+	switch object.Scheme {
+	case RemoteSchemeGCS:
+		request, err = r.gcsRequest(method, object)
+	case RemoteSchemeS3:
+		request, err = s3Request(method, object, time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return remoteClient.Do(request)
+}
+
+// remoteURL returns a URL for the object at path on host, escaped as
+// expected by S3's request signing, which Cloud Storage also accepts.
+func remoteURL(scheme string, host string, path string) *url.URL {
+	escaped := make([]string, 0)
+	for _, segment := range strings.Split(path, "/") {
+		var b strings.Builder
+		for i := 0; i < len(segment); i++ {
+			c := segment[i]
+			if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		escaped = append(escaped, b.String())
+	}
+	return &url.URL{Scheme: scheme, Host: host, Path: path, RawPath: strings.Join(escaped, "/")}
+}
+
+func (r *RemoteFiles) gcsRequest(method string, object RemoteObject) (*http.Request, error) {
+	request, err := http.NewRequest(method, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.URL = remoteURL("https", "storage.googleapis.com", "/"+object.Bucket+"/"+object.Key)
+	request.Host = request.URL.Host
+	if token := r.gcsAccessToken(); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request, nil
+}
+
+// gcsAccessToken returns the access token for Cloud Storage requests, or
+// an empty string for anonymous requests. The token from the metadata
+// server is replaced shortly before it expires, since long runs can
+// download datasets after the token fetched at the start has expired.
+// Once the metadata server can't be reached, the requests are anonymous.
+func (r *RemoteFiles) gcsAccessToken() string {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token
+	}
+	if r.gcsFailed || (r.gcsToken != "" && time.Now().Before(r.gcsExpiry.Add(-GCEMetadataTokenMargin))) {
+		return r.gcsToken
+	}
+	token, expiry, err := r.fetchGCSAccessToken()
+	if err != nil {
+		if r.gcsToken == "" {
+			r.gcsFailed = true
+			Debugf("  no access token from the GCE metadata server, so Cloud Storage requests are anonymous: %s", err)
+		} else {
+			Warningf("  failed to refresh the access token from the GCE metadata server: %s", err)
+		}
+		return r.gcsToken
+	}
+	r.gcsToken, r.gcsExpiry = token, expiry
+	return r.gcsToken
+}
+
+func (r *RemoteFiles) fetchGCSAccessToken() (string, time.Time, error) {
+	u := r.gcsTokenURL
+	if u == "" {
+		u = GCEMetadataTokenURL
+	}
+	request, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: GCEMetadataTimeout}
+	requested := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("%s", response.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", time.Time{}, err
+	} else if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access_token in response")
+	}
+	return token.AccessToken, requested.Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// s3Request returns a request for the object, signed with AWS Signature
+// Version 4 if credentials are given in the environment.
+func s3Request(method string, object RemoteObject, now time.Time) (*http.Request, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	request, err := http.NewRequest(method, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return nil, fmt.Errorf("bad AWS_ENDPOINT_URL %q", endpoint)
+		}
+		request.URL = remoteURL(e.Scheme, e.Host, strings.TrimSuffix(e.Path, "/")+"/"+object.Bucket+"/"+object.Key)
+	} else if strings.Contains(object.Bucket, ".") {
+		// Bucket names with dots don't match the certificate of virtual
+		// hosted buckets
+		request.URL = remoteURL("https", "s3."+region+".amazonaws.com", "/"+object.Bucket+"/"+object.Key)
+	} else {
+		request.URL = remoteURL("https", object.Bucket+".s3."+region+".amazonaws.com", "/"+object.Key)
+	}
+	request.Host = request.URL.Host
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+			request.Header.Set("X-Amz-Security-Token", token)
+		}
+		signS3Request(request, key, os.Getenv("AWS_SECRET_ACCESS_KEY"), region, now)
+	}
+	return request, nil
+}
+
+// signS3Request adds the Authorization header of AWS Signature Version 4
+// to a request without a body, signing its host, and each of the headers
+// already set.
+func signS3Request(request *http.Request, key string, secret string, region string, now time.Time) {
+	const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	date := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", emptyPayload)
+
+	headers := map[string]string{"host": request.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	canonical.WriteString(request.Method + "\n" + request.URL.EscapedPath() + "\n" + request.URL.RawQuery + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + emptyPayload)
+
+	scope := date[0:8] + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	signing := []byte("AWS4" + secret)
+	for _, part := range []string{date[0:8], region, "s3", "aws4_request", toSign} {
+		h := hmac.New(sha256.New, signing)
+		h.Write([]byte(part))
+		signing = h.Sum(nil)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", key, scope, signed, hex.EncodeToString(signing)))
+}
+
+// fetchRemoteFlags replaces the values of flags that are gs:// or s3://
+// URLs with the filenames to which they're downloaded, including those
+// within comma separated lists, like --world. Output flags can't be URLs.
+func fetchRemoteFlags(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || !strings.Contains(f.Value.String(), "://") {
+			return
+		}
+		if _, ok := f.Value.(repeatableFlag); ok {
+			return
+		}
+		values := strings.Split(f.Value.String(), ",")
+		fetched := false
+		for i, v := range values {
+			if !isRemote(v) {
+				continue
+			} else if RemoteOutputFlags[f.Name] {
+				err = fmt.Errorf("--%s: gs:// and s3:// URLs are only supported for inputs", f.Name)
+				return
+			}
+			if values[i], err = remoteFiles.Fetch(v); err != nil {
+				err = fmt.Errorf("--%s: %s", f.Name, err)
+				return
+			}
+			fetched = true
+		}
+		if fetched {
+			err = flags.Set(f.Name, strings.Join(values, ","))
+		}
+	})
+	return err
+}
+
+// fetchRemoteDatasets downloads the datasets of manifest whose filenames
+// are gs:// or s3:// URLs, replacing them with the downloaded filenames.
+// Datasets whose objects don't exist keep their URL, so that readers of
+// optional datasets find them missing.
+func fetchRemoteDatasets(manifest DataManifest) error {
+	names := make([]string, 0, len(manifest))
+	for name, dataset := range manifest {
+		if isRemote(dataset.Filename) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		local, err := remoteFiles.Fetch(manifest[name].Filename)
+		if os.IsNotExist(err) {
+			Debugf("  %s: %s not found", name, manifest[name].Filename)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("data manifest: %s: %s", name, err)
+		}
+		manifest[name].Filename = local
+	}
+	return nil
+}
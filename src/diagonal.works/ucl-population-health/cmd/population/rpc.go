@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"diagonal.works/b6"
+)
+
+// RunArgs overrides the options given on the command line for a single
+// run of the simulation. Empty fields keep the command line value.
+type RunArgs struct {
+	OutputDirectory     string
+	Scope               string
+	Scenario            string
+	ScenarioFilename    string
+	Profile             string
+	Buffer              string
+	ConditionModel      string
+	AggregatePopulation string
+	SmokingFilename     string
+	BMIFilename         string
+	AdmissionsFilename  string
+}
+
+type RunResult struct {
+	OutputDirectory string
+	Manifest        *Manifest
+}
+
+type QueryArgs struct {
+	// The directory to which the population was written by Run
+	OutputDirectory string
+	PopulationQuery
+}
+
+// PopulationService drives the simulation over JSON-RPC, keeping the
+// world and prevalences loaded between runs, so that analysts can run
+// scenarios from notebooks without the cost of starting a new process
+// each time.
+type PopulationService struct {
+	World       b6.World
+	Prevalences AllPrevalences
+	// The options given on the command line, on which runs are based
+	Options *PopulationOptions
+
+	// Runs share global state, so are made one at a time
+	lock   sync.Mutex
+	served map[string]*ServedPopulation
+}
+
+func (s *PopulationService) options(args *RunArgs) (*PopulationOptions, error) {
+	options := *s.Options
+	var err error
+	if args.OutputDirectory != "" {
+		options.OutputDirectory = args.OutputDirectory
+	}
+	if args.Scope != "" {
+		if options.Scope, err = ScopeFromString(args.Scope); err != nil {
+			return nil, err
+		}
+	}
+	if args.Scenario != "" {
+		options.Scenario = args.Scenario
+	}
+	if args.ScenarioFilename != "" {
+		options.ScenarioFilename = args.ScenarioFilename
+	}
+	if args.Profile != "" {
+		if options.Profile, err = OutputProfileFromString(args.Profile); err != nil {
+			return nil, err
+		}
+	}
+	if args.Buffer != "" {
+		if options.Buffer.Policy, err = BufferPolicyFromString(args.Buffer); err != nil {
+			return nil, err
+		}
+	}
+	if args.ConditionModel != "" {
+		if !isConditionModel(args.ConditionModel) {
+			return nil, fmt.Errorf("unknown condition model %q", args.ConditionModel)
+		}
+		options.ConditionModel = args.ConditionModel
+	}
+	if args.AggregatePopulation != "" {
+		if options.AggregatePopulations, err = AggregatePopulationsFromString(args.AggregatePopulation); err != nil {
+			return nil, err
+		}
+	}
+	if args.SmokingFilename != "" {
+		options.SmokingFilename = args.SmokingFilename
+	}
+	if args.BMIFilename != "" {
+		options.BMIFilename = args.BMIFilename
+	}
+	if args.AdmissionsFilename != "" {
+		options.AdmissionsFilename = args.AdmissionsFilename
+	}
+	return &options, nil
+}
+
+// Run simulates the population with the given options, writing outputs
+// to the output directory, and returns the manifest describing them.
+func (s *PopulationService) Run(args *RunArgs, result *RunResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	options, err := s.options(args)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(options.OutputDirectory, 0755); err != nil {
+		return err
+	}
+	log.Printf("rpc: run: scenario: %s output: %s", options.Scenario, options.OutputDirectory)
+	if err := writePopulation(s.World, s.Prevalences, options); err != nil {
+		return err
+	}
+	delete(s.served, options.OutputDirectory)
+
+	f, err := os.Open(filepath.Join(options.OutputDirectory, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result.OutputDirectory = options.OutputDirectory
+	result.Manifest = &Manifest{}
+	return json.NewDecoder(f).Decode(result.Manifest)
+}
+
+// Query returns aggregate counts and prevalences from the population
+// written to the given directory, as with serve.
+func (s *PopulationService) Query(args *QueryArgs, result *ServedResult) error {
+	s.lock.Lock()
+	population, ok := s.served[args.OutputDirectory]
+	if !ok {
+		geography, err := censusGeographyForYear(s.Options.CensusYear, s.Options.Data)
+		if err == nil {
+			population, err = readServedPopulation(args.OutputDirectory, s.Options.Data, geography)
+		}
+		if err == nil && len(population.People) == 0 {
+			err = fmt.Errorf("no people in %s", filepath.Join(args.OutputDirectory, "population.csv"))
+		}
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		population.Parameters = s.Options.Parameters
+		s.served[args.OutputDirectory] = population
+	}
+	s.lock.Unlock()
+	r, err := population.Query(&args.PopulationQuery)
+	if err != nil {
+		return err
+	}
+	*result = *r
+	return nil
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	return nil
+}
+
+// serveRPC answers JSON-RPC requests for PopulationService methods, like
+// {"method": "Population.Run", "params": [{"Scenario": "..."}], "id": 1},
+// read from r, until it's closed. Logs continue to be written to stderr,
+// leaving w for responses.
+func serveRPC(world b6.World, prevalences AllPrevalences, options *PopulationOptions, r io.Reader, w io.Writer) error {
+	service := &PopulationService{
+		World:       world,
+		Prevalences: prevalences,
+		Options:     options,
+		served:      make(map[string]*ServedPopulation),
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Population", service); err != nil {
+		return err
+	}
+	log.Printf("rpc: ready")
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{Reader: r, Writer: w}))
+	return nil
+}
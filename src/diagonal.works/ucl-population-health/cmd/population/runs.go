@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const RunIndexFilename = "runs.json"
+
+// RunSummary gives the headline metrics of a completed run, from its
+// manifest, for choosing between and comparing runs without reading
+// their outputs.
+type RunSummary struct {
+	// The directory of the run, relative to that of the index, or . for
+	// the directory itself
+	Directory string    `json:"directory"`
+	Scenario  string    `json:"scenario"`
+	Scope     string    `json:"scope,omitempty"`
+	Finished  time.Time `json:"finished"`
+	People    float64   `json:"people"`
+	Residents float64   `json:"residents"`
+	Practices float64   `json:"practices"`
+	// The root mean square difference between the simulated and
+	// published list sizes of the scope's practices, or 0 for runs that
+	// didn't record it
+	ListSizeRMSD float64 `json:"list_size_rmsd"`
+	// The simulated prevalence among residents of each condition, keyed by
+	// condition
+	Prevalence map[string]float64 `json:"prevalence,omitempty"`
+	Outputs    int                `json:"outputs"`
+}
+
+// residentPrevalences returns the simulated prevalence of each of
+// conditions among the people living in homes, recorded in the manifest,
+// for the index of runs.
+func residentPrevalences(people []Person, homes LSOASet, conditions []QOFCondition) map[QOFCondition]float64 {
+	counts := make(map[QOFCondition]int)
+	residents := 0
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok {
+			continue
+		}
+		residents++
+		for _, condition := range conditions {
+			if p.Conditions.Contains(condition) {
+				counts[condition]++
+			}
+		}
+	}
+	prevalences := make(map[QOFCondition]float64)
+	if residents > 0 {
+		for _, condition := range conditions {
+			prevalences[condition] = float64(counts[condition]) / float64(residents)
+		}
+	}
+	return prevalences
+}
+
+// RunIndex lists the completed runs within a directory
+type RunIndex struct {
+	Generated time.Time     `json:"generated"`
+	Runs      []*RunSummary `json:"runs"`
+}
+
+func newRunSummary(directory string, manifest *Manifest, finished time.Time) *RunSummary {
+	s := &RunSummary{
+		Directory:    directory,
+		Scenario:     manifest.Scenario,
+		Scope:        manifest.Scope,
+		Finished:     finished,
+		People:       manifest.Metrics["people"],
+		Residents:    manifest.Metrics["residents"],
+		Practices:    manifest.Metrics["practices"],
+		ListSizeRMSD: manifest.Metrics["list_size_rmsd"],
+		Outputs:      len(manifest.Outputs),
+	}
+	for name, value := range manifest.Metrics {
+		if condition, ok := strings.CutPrefix(name, "prevalence_"); ok {
+			if s.Prevalence == nil {
+				s.Prevalence = make(map[string]float64)
+			}
+			s.Prevalence[condition] = value
+		}
+	}
+	return s
+}
+
+// indexRuns returns the runs completed within root, or in root itself,
+// found by their manifest.json, which is written last, ordered by
+// directory. Runs whose manifest can't be read are logged, and skipped.
+func indexRuns(root string) (*RunIndex, error) {
+	index := &RunIndex{Generated: time.Now().UTC(), Runs: []*RunSummary{}}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "manifest.json" {
+			return nil
+		}
+		directory := filepath.Dir(path)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		manifest, err := readRunManifest(directory)
+		if err != nil {
+			Warningf("  runs: %s", err)
+			return nil
+		}
+		relative, err := filepath.Rel(root, directory)
+		if err != nil {
+			return err
+		}
+		index.Runs = append(index.Runs, newRunSummary(filepath.ToSlash(relative), manifest, info.ModTime().UTC()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(index.Runs, func(i, j int) bool { return index.Runs[i].Directory < index.Runs[j].Directory })
+	return index, nil
+}
+
+// writeRunIndex writes runs.json to root, listing the runs completed
+// within it.
+func writeRunIndex(root string) error {
+	index, err := indexRuns(root)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("runs: %d in %s", len(index.Runs), filepath.Join(root, RunIndexFilename))
+	return os.WriteFile(filepath.Join(root, RunIndexFilename), output, 0644)
+}
+
+// runsMain implements population runs, which writes the index of the
+// runs completed within --output.
+func runsMain(args []string) error {
+	flags := newFlagSet("runs", "Write "+RunIndexFilename+", listing the runs completed within --output, with their headline metrics, for choosing between and comparing them")
+	base := addBaseFlags(flags)
+	outputFlag := flags.String("output", "output", "Directory within which to find runs, to which the index is written")
+	if err := base.parse(flags, args); err != nil {
+		return err
+	}
+	if _, err := base.setup(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(*outputFlag); err != nil {
+		return fmt.Errorf("runs: %s", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("runs: %s isn't a directory", *outputFlag)
+	}
+	return writeRunIndex(*outputFlag)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RuralUrbanLSOACodeColumn  = "LSOA11CD"
+	RuralUrbanClassCodeColumn = "RUC11CD"
+)
+
+// RuralUrbanClass is a code from the ONS 2011 rural-urban classification,
+// from A1 (urban major conurbation) to E2 (rural village and dispersed in a
+// sparse setting), see
+// https://www.gov.uk/government/collections/rural-urban-classification
+type RuralUrbanClass string
+
+const RuralUrbanClassInvalid RuralUrbanClass = ""
+
+func (r RuralUrbanClass) String() string {
+	return string(r)
+}
+
+// Classes beginning D or E are rural, while the remainder are urban
+func (r RuralUrbanClass) Rurality() Rurality {
+	switch {
+	case r == RuralUrbanClassInvalid:
+		return RuralityUnknown
+	case strings.HasPrefix(string(r), "D") || strings.HasPrefix(string(r), "E"):
+		return RuralityRural
+	}
+	return RuralityUrban
+}
+
+type Rurality int
+
+const (
+	RuralityUnknown Rurality = iota
+	RuralityUrban
+	RuralityRural
+)
+
+func (r Rurality) String() string {
+	switch r {
+	case RuralityUrban:
+		return "urban"
+	case RuralityRural:
+		return "rural"
+	}
+	return "unknown"
+}
+
+// fillRuralUrban sets the rural-urban classification of each LSOA.
+func fillRuralUrban(lsoas map[LSOACode]*LSOA, dataset *Dataset, geography *CensusGeography) error {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.Comment = '#'
+
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{dataset.Column("lsoa-code"), dataset.Column("class-code")} {
+		if _, ok := columns[column]; !ok {
+			return fmt.Errorf("%s: no %s column", dataset.Filename, column)
+		}
+	}
+
+	badLSOA := 0
+	counts := make(map[Rurality]int)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		for _, code := range geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]])) {
+			if lsoa, ok := lsoas[code]; ok {
+				lsoa.RuralUrban = RuralUrbanClass(strings.TrimSpace(row[columns[dataset.Column("class-code")]]))
+				counts[lsoa.RuralUrban.Rurality()]++
+			} else {
+				badLSOA++
+			}
+		}
+	}
+	log.Printf("rural-urban: urban: %d rural: %d bad lsoa: %d", counts[RuralityUrban], counts[RuralityRural], badLSOA)
+	return nil
+}
+
+// AssignmentParameters control the choice of GP practice for people
+// living in an LSOA. Zero values use the simulation parameters.
+type AssignmentParameters struct {
+	// The maximum distance from the centre of the LSOA to a practice.
+	// If zero, any practice in the nearby practices lookup, which covers
+	// the largest radius in the model when written with it.
+	RadiusM float64 `yaml:"radiusm"`
+	// Practices closer than this are equally likely to be chosen, with
+	// those further away decaying in likelihood with distance.
+	EqualDistanceM float64 `yaml:"equaldistancem"`
+
+	// The estimate of the largest list, by which list sizes are scaled,
+	// from the simulation parameters
+	maxListSize float64
+}
+
+// withDefaults returns the parameters, taking those left unset from
+// the simulation parameters.
+func (a AssignmentParameters) withDefaults(s SimulationParameters) AssignmentParameters {
+	if a.EqualDistanceM <= 0.0 {
+		a.EqualDistanceM = s.GPPracticeEqualDistanceLimitM
+	}
+	a.maxListSize = s.GPPracticeMaxListSize
+	return a
+}
+
+// RuralityModel gives the assignment parameters for urban and rural
+// LSOAs. LSOAs without a classification use the urban parameters.
+type RuralityModel struct {
+	Urban AssignmentParameters
+	Rural AssignmentParameters
+}
+
+func readRuralityModel(filename string) (*RuralityModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rurality model: %s", err)
+	}
+	defer f.Close()
+	var model RuralityModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read rurality model: %s", err)
+	}
+	for _, p := range []AssignmentParameters{model.Urban, model.Rural} {
+		if p.RadiusM < 0.0 || p.EqualDistanceM < 0.0 {
+			return nil, fmt.Errorf("rurality model: distances can't be negative")
+		}
+	}
+	return &model, nil
+}
+
+// Parameters returns the assignment parameters for an LSOA, taking those
+// the model leaves unset, or all of them, if the model is nil, from the
+// simulation parameters.
+func (r *RuralityModel) Parameters(lsoa *LSOA, s SimulationParameters) AssignmentParameters {
+	var p AssignmentParameters
+	if r != nil {
+		if lsoa.RuralUrban.Rurality() == RuralityRural {
+			p = r.Rural
+		} else {
+			p = r.Urban
+		}
+	}
+	return p.withDefaults(s)
+}
+
+// SearchRadiusM returns the radius around practices from which nearby
+// LSOAs need to be found, to cover the largest assignment radius, and
+// at least the nearby radius of the simulation parameters.
+func (r *RuralityModel) SearchRadiusM(s SimulationParameters) float64 {
+	radius := s.GPLSOANearbyRadiusM
+	if r != nil {
+		for _, p := range []AssignmentParameters{r.Urban, r.Rural} {
+			if p.RadiusM > radius {
+				radius = p.RadiusM
+			}
+		}
+	}
+	return radius
+}
+
+func GroupByRurality(lsoas map[LSOACode]*LSOA) *GroupBy {
+	return &GroupBy{
+		Key:   "rurality",
+		Fixed: []string{RuralityUrban.String(), RuralityRural.String()},
+		Group: func(p *Person) (string, bool) {
+			if r := lsoas[p.Home].RuralUrban.Rurality(); r != RuralityUnknown {
+				return r.String(), true
+			}
+			return "", false
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRuralUrbanClassRurality(t *testing.T) {
+	tests := []struct {
+		class    RuralUrbanClass
+		expected Rurality
+	}{
+		{"A1", RuralityUrban},
+		{"B1", RuralityUrban},
+		{"C2", RuralityUrban},
+		{"D1", RuralityRural},
+		{"E2", RuralityRural},
+		{RuralUrbanClassInvalid, RuralityUnknown},
+	}
+	for _, test := range tests {
+		if r := test.class.Rurality(); r != test.expected {
+			t.Errorf("expected %s for %q, found %s", test.expected, test.class, r)
+		}
+	}
+}
+
+func TestRuralityModelParameters(t *testing.T) {
+	model := &RuralityModel{
+		Urban: AssignmentParameters{RadiusM: 2000.0},
+		Rural: AssignmentParameters{RadiusM: 15000.0, EqualDistanceM: 3000.0},
+	}
+	parameters := SimulationParameters{GPLSOANearbyRadiusM: 4000.0, GPPracticeMaxListSize: 10000.0, GPPracticeEqualDistanceLimitM: 1000.0}
+	tests := []struct {
+		model    *RuralityModel
+		class    RuralUrbanClass
+		expected AssignmentParameters
+	}{
+		// Equal distances the model leaves unset come from the simulation
+		// parameters
+		{model, "A1", AssignmentParameters{RadiusM: 2000.0, EqualDistanceM: 1000.0, maxListSize: 10000.0}},
+		{model, "E1", AssignmentParameters{RadiusM: 15000.0, EqualDistanceM: 3000.0, maxListSize: 10000.0}},
+		// LSOAs without a classification are treated as urban
+		{model, RuralUrbanClassInvalid, AssignmentParameters{RadiusM: 2000.0, EqualDistanceM: 1000.0, maxListSize: 10000.0}},
+		// Without a model, any practice in the lookup can be chosen
+		{nil, "E1", AssignmentParameters{EqualDistanceM: 1000.0, maxListSize: 10000.0}},
+	}
+	for _, test := range tests {
+		if p := test.model.Parameters(&LSOA{RuralUrban: test.class}, parameters); p != test.expected {
+			t.Errorf("expected %+v for %q, found %+v", test.expected, test.class, p)
+		}
+	}
+	if r := model.SearchRadiusM(parameters); r != 15000.0 {
+		t.Errorf("expected the search radius to cover the rural radius, found %f", r)
+	}
+	if r := (*RuralityModel)(nil).SearchRadiusM(parameters); r != 4000.0 {
+		t.Errorf("expected the nearby radius of the parameters from a nil model, found %f", r)
+	}
+	small := &RuralityModel{Urban: AssignmentParameters{RadiusM: 1000.0}}
+	if r := small.SearchRadiusM(parameters); r != 4000.0 {
+		t.Errorf("expected the search radius to cover at least the nearby radius, found %f", r)
+	}
+}
+
+func TestReadRuralityModel(t *testing.T) {
+	tests := []struct {
+		yaml  string
+		valid bool
+	}{
+		{"urban:\n  radiusm: 2000\nrural:\n  radiusm: 15000\n  equaldistancem: 3000\n", true},
+		{"urban:\n  radiusm: -1\n", false},
+		{"rural:\n  equaldistancem: -1\n", false},
+	}
+	for i, test := range tests {
+		filename := filepath.Join(t.TempDir(), "rurality.yaml")
+		if err := os.WriteFile(filename, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		model, err := readRuralityModel(filename)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%d: expected no error, found %s", i, err)
+			} else if model.Rural.RadiusM != 15000.0 || model.Rural.EqualDistanceM != 3000.0 || model.Urban.RadiusM != 2000.0 {
+				t.Errorf("%d: unexpected model %+v", i, *model)
+			}
+		} else if err == nil {
+			t.Errorf("%d: expected an error for negative distances", i)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"time"
+)
+
+// resourceUsage isn't available outside unix, so CPU time and peak
+// memory are recorded as zero.
+func resourceUsage() (time.Duration, int64) {
+	return 0, 0
+}
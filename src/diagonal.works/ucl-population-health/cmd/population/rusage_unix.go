@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// resourceUsage returns the user and system CPU time used by the process,
+// and its peak resident memory in bytes.
+func resourceUsage() (time.Duration, int64) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	rss := int64(usage.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// Linux, and most other unixes, report kilobytes, rather than bytes
+		rss *= 1024
+	}
+	return cpu, rss
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	EthnicityLSOACodeColumn = "LSOA11CD"
+	EthnicityAllColumn      = "ALL_USUAL_RESIDENTS"
+	EthnicityWhiteColumn    = "WHITE"
+	EthnicityMixedColumn    = "MIXED"
+	EthnicityAsianColumn    = "ASIAN"
+	EthnicityBlackColumn    = "BLACK"
+	EthnicityOtherColumn    = "OTHER"
+)
+
+const (
+	// Standard deviation of the priors on the log odds of each sex and age
+	// band around the national curve, and on the coefficients for
+	// deprivation and ethnicity around zero
+	SmallAreaPriorSD = 1.0
+	// Initial standard deviation of the practice random effects, which is
+	// then estimated from the data
+	SmallAreaInitialPracticeSD = 0.3
+	// Lower bound on the estimated practice variance, to keep the practice
+	// effects identifiable when practices are very similar
+	SmallAreaMinPracticeVariance = 0.0001
+	// The largest change to any fixed effect in a single iteration, since
+	// full Newton steps overshoot when starting far from the optimum
+	SmallAreaMaxStep       = 0.5
+	SmallAreaMaxIterations = 200
+	SmallAreaTolerance     = 1e-6
+)
+
+// readLSOAEthnicity returns the fraction of each LSOA's residents from
+// ethnic groups other than White, from the 2011 census. Since the dataset
+// isn't distributed with the repository, a missing file returns nil,
+// rather than an error, and estimation continues without ethnicity.
+func readLSOAEthnicity(dataset *Dataset, geography *CensusGeography) (map[LSOACode]float64, error) {
+	r, err := openDataset(dataset)
+	if os.IsNotExist(err) {
+		Warningf("small area estimation: no ethnicity data in %s, continuing without it", dataset.Filename)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{dataset.Column("lsoa-code"), dataset.Column("all"), dataset.Column("white")} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, column)
+		}
+	}
+
+	ethnicity := make(map[LSOACode]float64)
+	badCounts := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		all, err := strconv.Atoi(row[columns[dataset.Column("all")]])
+		if err != nil || all <= 0 {
+			badCounts++
+			continue
+		}
+		white, err := strconv.Atoi(row[columns[dataset.Column("white")]])
+		if err != nil {
+			badCounts++
+			continue
+		}
+		for _, code := range geography.FromLSOA11.Translate(LSOACode(row[columns[dataset.Column("lsoa-code")]])) {
+			ethnicity[code] = 1.0 - float64(white)/float64(all)
+		}
+	}
+	log.Printf("ethnicity: lsoas: %d bad counts: %d", len(ethnicity), badCounts)
+	return ethnicity, nil
+}
+
+// SmallAreaEstimate is a multilevel logistic model of a condition, fitted
+// to the crude prevalence reported by each practice, with fixed effects for
+// sex and age band, the deprivation and ethnic mix of a person's home LSOA,
+// and a random effect for their practice.
+type SmallAreaEstimate struct {
+	Condition QOFCondition
+	Bands     *AgeBands
+	// The sexes of the registered population the model was fitted to
+	Sexes []Sex
+	// Log odds, indexed by sex, then age band
+	AgeSex [][]float64
+	// Log odds ratio for each IMD decile more deprived than the middle of
+	// the distribution
+	IMD float64
+	// Log odds ratio for an LSOA entirely of ethnic minority residents,
+	// relative to one with EthnicityCentre
+	Ethnicity       float64
+	EthnicityCentre float64
+	// Practice effects on the log odds, zero for practices that don't
+	// report the condition
+	Practices  map[GPPracticeCode]float64
+	PracticeSD float64
+	// The number of practices to which the model was fitted
+	Fitted int
+
+	lsoas     map[LSOACode]*LSOA
+	ethnicity map[LSOACode]float64
+}
+
+func (s *SmallAreaEstimate) covariates(home LSOACode) (float64, float64) {
+	deprivation := 0.0
+	if lsoa, ok := s.lsoas[home]; ok && lsoa.IMDDecile > 0 {
+		deprivation = LogisticIMDDecileCentre - float64(lsoa.IMDDecile)
+	}
+	ethnicity := 0.0
+	if e, ok := s.ethnicity[home]; ok {
+		ethnicity = e - s.EthnicityCentre
+	}
+	return deprivation, ethnicity
+}
+
+// Probability returns the probability that p has the condition
+func (s *SmallAreaEstimate) Probability(p *Person) float64 {
+	deprivation, ethnicity := s.covariates(p.Home)
+	return logistic(s.AgeSex[p.Sex][s.Bands.Band(p.Age)] + s.IMD*deprivation + s.Ethnicity*ethnicity + s.Practices[p.GP])
+}
+
+// smallAreaCell groups people registered with a practice who share the
+// same covariates
+type smallAreaCell struct {
+	Index       int
+	Deprivation float64
+	Ethnicity   float64
+	N           float64
+}
+
+type smallAreaPractice struct {
+	Code     GPPracticeCode
+	Observed float64
+	Cells    []smallAreaCell
+}
+
+// expected returns the expected register size of the practice, and its
+// derivative with respect to each of the fixed effects, followed by the
+// practice effect.
+func (s *smallAreaPractice) expected(parameters []float64, u float64) (float64, []float64) {
+	k := len(parameters) - 2
+	mu := 0.0
+	d := make([]float64, len(parameters)+1)
+	for _, c := range s.Cells {
+		p := logistic(parameters[c.Index] + parameters[k]*c.Deprivation + parameters[k+1]*c.Ethnicity + u)
+		mu += c.N * p
+		w := c.N * p * (1.0 - p)
+		d[c.Index] += w
+		d[k] += w * c.Deprivation
+		d[k+1] += w * c.Ethnicity
+		d[k+2] += w
+	}
+	return mu, d
+}
+
+// solveLinear solves a x = b by Gaussian elimination with partial
+// pivoting, overwriting a and b.
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for i := 0; i < n; i++ {
+		pivot := i
+		for j := i + 1; j < n; j++ {
+			if math.Abs(a[j][i]) > math.Abs(a[pivot][i]) {
+				pivot = j
+			}
+		}
+		if a[pivot][i] == 0.0 {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		a[i], a[pivot] = a[pivot], a[i]
+		b[i], b[pivot] = b[pivot], b[i]
+		for j := i + 1; j < n; j++ {
+			f := a[j][i] / a[i][i]
+			for k := i; k < n; k++ {
+				a[j][k] -= f * a[i][k]
+			}
+			b[j] -= f * b[i]
+		}
+	}
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		x[i] = b[i]
+		for j := i + 1; j < n; j++ {
+			x[i] -= a[i][j] * x[j]
+		}
+		x[i] /= a[i][i]
+	}
+	return x, nil
+}
+
+func logitClamped(p float64) float64 {
+	return logit(clamp(p, 0.0001, 0.9999))
+}
+
+// fitSmallAreaEstimate fits the model for condition to the reported
+// prevalence of each practice, treating its register size as Poisson, with
+// the expected size summed over the simulated people registered with it.
+// Practice effects are estimated with the fixed effects by penalised
+// quasi-likelihood, with the log odds of each sex and age band shrunk
+// towards the national curve for the condition, when one is available, or
+// towards the overall crude prevalence when it isn't.
+func fitSmallAreaEstimate(condition QOFCondition, byPractice map[GPPracticeCode][]*Person, gps map[GPPracticeCode]*GPPractice, lsoas map[LSOACode]*LSOA, ethnicity map[LSOACode]float64, prevalences AllPrevalences, bands *AgeBands) (*SmallAreaEstimate, error) {
+	s := &SmallAreaEstimate{
+		Condition: condition,
+		Bands:     bands,
+		Practices: make(map[GPPracticeCode]float64),
+		lsoas:     lsoas,
+		ethnicity: ethnicity,
+	}
+	if len(ethnicity) > 0 {
+		for _, e := range ethnicity {
+			s.EthnicityCentre += e
+		}
+		s.EthnicityCentre /= float64(len(ethnicity))
+	}
+
+	codes := make([]GPPracticeCode, 0, len(byPractice))
+	for code := range byPractice {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	s.Sexes = []Sex{Male, Female}
+	for _, people := range byPractice {
+		for _, p := range people {
+			if p.Sex == Other {
+				s.Sexes = AllSexes()
+			}
+		}
+	}
+	nBands := len(bands.Begins)
+	k := len(s.Sexes) * nBands
+	practices := make([]*smallAreaPractice, 0, len(codes))
+	observed, registered := 0.0, 0.0
+	for _, code := range codes {
+		gp, ok := gps[code]
+		if !ok {
+			continue
+		}
+		prevalence, ok := gp.ReportedConditionPrevalence[condition]
+		if !ok || gp.ListSize == 0 || len(byPractice[code]) == 0 {
+			continue
+		}
+		type cellKey struct {
+			Index int
+			Home  LSOACode
+		}
+		cells := make(map[cellKey]*smallAreaCell)
+		for _, p := range byPractice[code] {
+			key := cellKey{Index: int(p.Sex)*nBands + bands.Band(p.Age), Home: p.Home}
+			c, ok := cells[key]
+			if !ok {
+				deprivation, ethnicity := s.covariates(p.Home)
+				c = &smallAreaCell{Index: key.Index, Deprivation: deprivation, Ethnicity: ethnicity}
+				cells[key] = c
+			}
+			c.N++
+		}
+		practice := &smallAreaPractice{Code: code, Observed: prevalence * float64(len(byPractice[code]))}
+		for _, c := range cells {
+			practice.Cells = append(practice.Cells, *c)
+		}
+		sort.Slice(practice.Cells, func(i, j int) bool { return practice.Cells[i].Index < practice.Cells[j].Index })
+		practices = append(practices, practice)
+		observed += practice.Observed
+		registered += float64(len(byPractice[code]))
+	}
+	s.Fitted = len(practices)
+	if len(practices) == 0 {
+		return nil, fmt.Errorf("small area estimation: no practices report %s", condition)
+	}
+
+	prior := make([]float64, k+2)
+	national, hasNational := prevalences[OneCondition(condition)]
+	for _, sex := range s.Sexes {
+		for band := range bands.Begins {
+			if hasNational {
+				r := bands.Range(band)
+				end := r.End
+				if end == 0 {
+					end = LSOADataMaxAge + 1
+				}
+				total := 0.0
+				for age := r.Begin; age < end; age++ {
+					total += national.Prevalence(sex, age)
+				}
+				prior[int(sex)*nBands+band] = logitClamped(total / float64(end-r.Begin))
+			} else {
+				prior[int(sex)*nBands+band] = logitClamped(observed / registered)
+			}
+		}
+	}
+	parameters := make([]float64, len(prior))
+	copy(parameters, prior)
+	effects := make([]float64, len(practices))
+	variance := SmallAreaInitialPracticeSD * SmallAreaInitialPracticeSD
+	precision := 1.0 / (SmallAreaPriorSD * SmallAreaPriorSD)
+
+	for iteration := 0; iteration < SmallAreaMaxIterations; iteration++ {
+		gradient := make([]float64, len(parameters))
+		information := make([][]float64, len(parameters))
+		for i := range information {
+			information[i] = make([]float64, len(parameters))
+		}
+		for j, practice := range practices {
+			mu, d := practice.expected(parameters, effects[j])
+			if mu <= 0.0 {
+				continue
+			}
+			residual := practice.Observed/mu - 1.0
+			for a := range parameters {
+				gradient[a] += residual * d[a]
+				for b := range parameters {
+					information[a][b] += d[a] * d[b] / mu
+				}
+			}
+		}
+		for a := range parameters {
+			gradient[a] -= (parameters[a] - prior[a]) * precision
+			information[a][a] += precision
+		}
+		step, err := solveLinear(information, gradient)
+		if err != nil {
+			return nil, fmt.Errorf("small area estimation: %s: %s", condition, err)
+		}
+		change := 0.0
+		for a := range parameters {
+			change = math.Max(change, math.Abs(step[a]))
+		}
+		scale := 1.0
+		if change > SmallAreaMaxStep {
+			scale = SmallAreaMaxStep / change
+		}
+		for a := range parameters {
+			parameters[a] += scale * step[a]
+		}
+
+		squares := 0.0
+		for j, practice := range practices {
+			mu, d := practice.expected(parameters, effects[j])
+			du := d[len(d)-1]
+			h := 1.0 / variance
+			if mu > 0.0 {
+				h += du * du / mu
+			}
+			g := -effects[j] / variance
+			if mu > 0.0 {
+				g += (practice.Observed/mu - 1.0) * du
+			}
+			effects[j] += g / h
+			change = math.Max(change, math.Abs(g/h))
+			squares += effects[j]*effects[j] + 1.0/h
+		}
+		variance = math.Max(SmallAreaMinPracticeVariance, squares/float64(len(practices)))
+		// The mean practice effect is confounded with the log odds of
+		// every sex and age band, so move it onto them
+		mean := 0.0
+		for _, e := range effects {
+			mean += e
+		}
+		mean /= float64(len(effects))
+		for j := range effects {
+			effects[j] -= mean
+		}
+		for a := 0; a < k; a++ {
+			parameters[a] += mean
+		}
+		if change < SmallAreaTolerance {
+			break
+		}
+	}
+
+	s.AgeSex = make([][]float64, len(s.Sexes))
+	for _, sex := range s.Sexes {
+		s.AgeSex[sex] = parameters[int(sex)*nBands : (int(sex)+1)*nBands]
+	}
+	s.IMD = parameters[k]
+	s.Ethnicity = parameters[k+1]
+	for j, practice := range practices {
+		s.Practices[practice.Code] = effects[j]
+	}
+	s.PracticeSD = math.Sqrt(variance)
+	return s, nil
+}
+
+func (s *SmallAreaEstimate) Log() {
+	log.Printf("  %s: practices: %d imd: %f ethnicity: %f practice sd: %f", s.Condition, s.Fitted, s.IMD, s.Ethnicity, s.PracticeSD)
+	for _, sex := range s.Sexes {
+		parts := make([]string, 0, len(s.Bands.Begins))
+		for band := range s.Bands.Begins {
+			parts = append(parts, fmt.Sprintf("%s: %.04f", s.Bands.Label(band), logistic(s.AgeSex[sex][band])))
+		}
+		log.Printf("    %s: %s", sex, strings.Join(parts, " "))
+	}
+}
+
+// SmallAreaConditionModel assigns conditions estimated by small area
+// estimation independently, with the probability given by the model for a
+// person's age, sex, home and practice, and delegates the remaining
+// conditions to another model.
+type SmallAreaConditionModel struct {
+	Estimates []*SmallAreaEstimate
+	// Model for the conditions without small area estimates, or nil if
+	// every condition has one
+	Others ConditionModel
+}
+
+func (s *SmallAreaConditionModel) Calibrate(gp *GPPractice, people []*Person) {
+	if s.Others != nil {
+		calibrateConditionModel(s.Others, gp, people)
+	}
+}
+
+func (s *SmallAreaConditionModel) Assign(p *Person, gp *GPPractice, rng *rand.Rand, audit *ConditionAudit) {
+	if s.Others != nil {
+		s.Others.Assign(p, gp, rng, audit)
+	}
+	for _, e := range s.Estimates {
+		if p.Conditions.Contains(e.Condition) {
+			audit.RecordSkipped(p, e.Condition, "small-area")
+			continue
+		}
+		probability := e.Probability(p)
+		draw := rng.Float64()
+		if draw < probability {
+			addCondition(p, e.Condition, QOFConditionConstraints)
+		}
+		audit.Record(ConditionDecision{Condition: e.Condition.String(), Model: "small-area", Probability: probability, Draw: draw, Outcome: conditionOutcome(draw < probability)})
+	}
+}
+
+// SmallAreaConditionsFromString parses a comma separated list of QOF
+// condition names
+func SmallAreaConditionsFromString(s string) ([]QOFCondition, error) {
+	if s == "" {
+		return nil, nil
+	}
+	conditions := make([]QOFCondition, 0)
+	for _, name := range strings.Split(s, ",") {
+		condition := QOFConditionFromString(name)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q for small area estimation", name)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// writeSmallAreaPrevalence writes small-area-prevalence.csv, with the
+// expected prevalence of each estimated condition among the residents of
+// each home LSOA, averaging the model's probability over them, and the
+// prevalence then simulated.
+func writeSmallAreaPrevalence(people []Person, homes LSOASet, estimates []*SmallAreaEstimate, outputDirectory string) error {
+	type lsoaTotals struct {
+		People    int
+		Expected  []float64
+		Simulated []int
+	}
+	totals := make(map[LSOACode]*lsoaTotals)
+	for i := range people {
+		p := &people[i]
+		if _, ok := homes[p.Home]; !ok || p.GP == GPPracticeCodeInvalid {
+			continue
+		}
+		t, ok := totals[p.Home]
+		if !ok {
+			t = &lsoaTotals{Expected: make([]float64, len(estimates)), Simulated: make([]int, len(estimates))}
+			totals[p.Home] = t
+		}
+		t.People++
+		for j, e := range estimates {
+			t.Expected[j] += e.Probability(p)
+			if p.Conditions.Contains(e.Condition) {
+				t.Simulated[j]++
+			}
+		}
+	}
+	codes := make([]LSOACode, 0, len(totals))
+	for code := range totals {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "small-area-prevalence.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"lsoa", "condition", "people", "expected_prevalence", "simulated_prevalence"})
+	for _, code := range codes {
+		t := totals[code]
+		for j, e := range estimates {
+			w.Write([]string{
+				code.String(),
+				e.Condition.String(),
+				strconv.Itoa(t.People),
+				fmt.Sprintf("%f", t.Expected[j]/float64(t.People)),
+				fmt.Sprintf("%f", float64(t.Simulated[j])/float64(t.People)),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// People further than this from the nearest site offering a service
+	// are counted as lacking access, unless overridden by the scenario
+	ServiceDefaultAccessDistanceM = 5000.0
+)
+
+// ServiceRelocation moves a service from one site to another, for example
+// moving phlebotomy from one hospital to another.
+type ServiceRelocation struct {
+	From ODSCode
+	To   ODSCode
+}
+
+type ServiceScenario struct {
+	Name string
+	// The sites offering the service in the baseline
+	Sites []ODSCode
+	Move  []ServiceRelocation
+	// Annual visits to the service per person
+	VisitsPerPerson float64 `yaml:"visitsperperson"`
+	// People further than this from their nearest site lack access
+	AccessDistanceM float64 `yaml:"accessdistancem"`
+}
+
+func (s *ServiceScenario) ScenarioSites() []ODSCode {
+	moved := make(map[ODSCode]ODSCode)
+	for _, m := range s.Move {
+		moved[m.From] = m.To
+	}
+	seen := make(map[ODSCode]struct{})
+	sites := make([]ODSCode, 0, len(s.Sites))
+	for _, site := range s.Sites {
+		if to, ok := moved[site]; ok {
+			site = to
+		}
+		if _, ok := seen[site]; !ok {
+			sites = append(sites, site)
+			seen[site] = struct{}{}
+		}
+	}
+	return sites
+}
+
+// Scenario describes changes applied to the baseline before simulation.
+type Scenario struct {
+	Name      string
+	Services  []ServiceScenario
+	Practices PracticeChanges
+	Budget    BudgetImpact
+	// Applied after any given with --set-prevalence
+	Prevalences PrevalenceOverrides
+}
+
+func readScenario(filename string) (*Scenario, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario: %s", err)
+	}
+	defer f.Close()
+	var scenario Scenario
+	if err := yaml.NewDecoder(f).Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %s", err)
+	}
+	if scenario.Name == "" {
+		return nil, fmt.Errorf("scenario %s has no name", filename)
+	}
+	for i := range scenario.Services {
+		s := &scenario.Services[i]
+		if len(s.Sites) == 0 {
+			return nil, fmt.Errorf("service %s isn't offered at any sites", s.Name)
+		}
+		if s.AccessDistanceM == 0.0 {
+			s.AccessDistanceM = ServiceDefaultAccessDistanceM
+		}
+		offered := make(map[ODSCode]struct{})
+		for _, site := range s.Sites {
+			offered[site] = struct{}{}
+		}
+		for _, m := range s.Move {
+			if _, ok := offered[m.From]; !ok {
+				return nil, fmt.Errorf("service %s: can't move from %s, as it isn't offered there", s.Name, m.From)
+			}
+		}
+	}
+	if err := scenario.Practices.validate(); err != nil {
+		return nil, err
+	}
+	if err := scenario.Budget.validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+type ServiceSiteAccess struct {
+	People    int
+	DistanceM float64
+}
+
+type ServiceAccess struct {
+	BySite        map[ODSCode]*ServiceSiteAccess
+	People        int
+	DistanceM     float64
+	WithoutAccess int
+	AnnualKgCO2   float64
+}
+
+func nearestSite(from s2.Point, sites []ODSCode, all map[ODSCode]*Site) (ODSCode, float64) {
+	nearest := ODSCode("")
+	distance := 0.0
+	for _, code := range sites {
+		d := b6.AngleToMeters(from.Distance(all[code].Location))
+		if nearest == "" || d < distance {
+			nearest = code
+			distance = d
+		}
+	}
+	return nearest, distance
+}
+
+// evaluateServiceAccess assigns the population of each LSOA to the nearest
+// site offering the service, and estimates the resulting travel.
+func evaluateServiceAccess(service *ServiceScenario, offered []ODSCode, residents map[LSOACode]int, lsoas map[LSOACode]*LSOA, sites map[ODSCode]*Site, travel *TravelAssumptions) (*ServiceAccess, map[LSOACode]ODSCode) {
+	access := &ServiceAccess{BySite: make(map[ODSCode]*ServiceSiteAccess)}
+	for _, site := range offered {
+		access.BySite[site] = &ServiceSiteAccess{}
+	}
+	emissions := make(map[string]float64)
+	for _, m := range travel.Modes {
+		emissions[m.Name] = m.KgCO2PerKm
+	}
+	assigned := make(map[LSOACode]ODSCode)
+	for code, n := range residents {
+		site, d := nearestSite(lsoas[code].Center, offered, sites)
+		assigned[code] = site
+		d *= travel.Circuity
+		access.BySite[site].People += n
+		access.BySite[site].DistanceM += d * float64(n)
+		access.People += n
+		access.DistanceM += d * float64(n)
+		if d > service.AccessDistanceM {
+			access.WithoutAccess += n
+		}
+		km := 2.0 * service.VisitsPerPerson * d * float64(n) / 1000.0
+		for mode, share := range travel.Band(d).Shares {
+			access.AnnualKgCO2 += km * share * emissions[mode]
+		}
+	}
+	return access, assigned
+}
+
+func meanDistanceKm(people int, distanceM float64) float64 {
+	if people > 0 {
+		return distanceM / float64(people) / 1000.0
+	}
+	return 0.0
+}
+
+// writeServiceScenarios compares access to each service in the scenario
+// against the baseline, for people living in homes.
+func writeServiceScenarios(scenario *Scenario, people []Person, homes LSOASet, lsoas map[LSOACode]*LSOA, sites map[ODSCode]*Site, travel *TravelAssumptions, outputDirectory string) error {
+	residents := make(map[LSOACode]int)
+	for _, p := range people {
+		if _, ok := homes[p.Home]; ok {
+			residents[p.Home]++
+		}
+	}
+
+	f, err := createOutput(filepath.Join(outputDirectory, "services.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"scenario", "service", "site", "name", "type", "baseline_people", "scenario_people", "baseline_mean_distance_km", "scenario_mean_distance_km", "baseline_without_access", "scenario_without_access", "baseline_annual_kg_co2", "scenario_annual_kg_co2", "people_reassigned"})
+	invalid := s2.Point{}
+	for i := range scenario.Services {
+		service := &scenario.Services[i]
+		for _, offered := range [][]ODSCode{service.Sites, service.ScenarioSites()} {
+			for _, code := range offered {
+				if site, ok := sites[code]; !ok || site.Location == invalid {
+					f.Close()
+					return fmt.Errorf("service %s: no location for site %s", service.Name, code)
+				}
+			}
+		}
+		baseline, baselineAssigned := evaluateServiceAccess(service, service.Sites, residents, lsoas, sites, travel)
+		changed, changedAssigned := evaluateServiceAccess(service, service.ScenarioSites(), residents, lsoas, sites, travel)
+		reassigned := 0
+		for code, site := range baselineAssigned {
+			if changedAssigned[code] != site {
+				reassigned += residents[code]
+			}
+		}
+		w.Write([]string{
+			scenario.Name,
+			service.Name,
+			"all",
+			"",
+			"",
+			strconv.Itoa(baseline.People),
+			strconv.Itoa(changed.People),
+			fmt.Sprintf("%f", meanDistanceKm(baseline.People, baseline.DistanceM)),
+			fmt.Sprintf("%f", meanDistanceKm(changed.People, changed.DistanceM)),
+			strconv.Itoa(baseline.WithoutAccess),
+			strconv.Itoa(changed.WithoutAccess),
+			fmt.Sprintf("%f", baseline.AnnualKgCO2),
+			fmt.Sprintf("%f", changed.AnnualKgCO2),
+			strconv.Itoa(reassigned),
+		})
+		codes := make([]ODSCode, 0, len(baseline.BySite)+len(changed.BySite))
+		for code := range baseline.BySite {
+			codes = append(codes, code)
+		}
+		for code := range changed.BySite {
+			if _, ok := baseline.BySite[code]; !ok {
+				codes = append(codes, code)
+			}
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		empty := &ServiceSiteAccess{}
+		for _, code := range codes {
+			b, ok := baseline.BySite[code]
+			if !ok {
+				b = empty
+			}
+			c, ok := changed.BySite[code]
+			if !ok {
+				c = empty
+			}
+			w.Write([]string{
+				scenario.Name,
+				service.Name,
+				string(code),
+				sites[code].Name,
+				sites[code].Type,
+				strconv.Itoa(b.People),
+				strconv.Itoa(c.People),
+				fmt.Sprintf("%f", meanDistanceKm(b.People, b.DistanceM)),
+				fmt.Sprintf("%f", meanDistanceKm(c.People, c.DistanceM)),
+				"",
+				"",
+				"",
+				"",
+				"",
+			})
+		}
+		log.Printf("  %s: reassigned: %d without access: %d -> %d", service.Name, reassigned, baseline.WithoutAccess, changed.WithoutAccess)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// ScopeKind is the kind of area whose population is simulated
+type ScopeKind int
+
+const (
+	// An ICB, whose LSOAs and practices are given by the lsoa-icb and
+	// gp-practices datasets
+	ScopeKindICB ScopeKind = iota
+	// A borough, or other local authority district, whose LSOAs are given
+	// by the lsoa-icb dataset, and whose practices are those located in
+	// them
+	ScopeKindBorough
+
+	ScopeKindCount
+	ScopeKindInvalid ScopeKind = -1
+)
+
+func (s ScopeKind) String() string {
+	switch s {
+	case ScopeKindICB:
+		return "icb"
+	case ScopeKindBorough:
+		return "borough"
+	}
+	return "invalid"
+}
+
+func ScopeKindFromString(s string) ScopeKind {
+	for k := ScopeKind(0); k < ScopeKindCount; k++ {
+		if s == k.String() {
+			return k
+		}
+	}
+	return ScopeKindInvalid
+}
+
+// Scope is the area whose population is simulated: people are drawn from
+// its LSOAs, and those of the buffer around it, and its practices are
+// calibrated against and reported on.
+type Scope struct {
+	Kind ScopeKind
+	Code string
+}
+
+const DefaultScope = "icb:" + string(NorthCentralLondonICBCode)
+
+func (s Scope) String() string {
+	return fmt.Sprintf("%s:%s", s.Kind, s.Code)
+}
+
+// ScopeFromString parses scopes written as <kind>:<code>, like icb:QMJ or
+// borough:E09000007, or as an ICB code alone.
+func ScopeFromString(s string) (Scope, error) {
+	kind, code, found := strings.Cut(s, ":")
+	if !found {
+		kind, code = ScopeKindICB.String(), s
+	}
+	scope := Scope{Kind: ScopeKindFromString(kind), Code: code}
+	if scope.Kind == ScopeKindInvalid || code == "" {
+		return Scope{}, fmt.Errorf("bad scope %q, expected icb:<code> or borough:<local authority code>", s)
+	}
+	return scope, nil
+}
+
+// ICB returns the code of the ICB, or the empty code if the scope
+// isn't an ICB.
+func (s Scope) ICB() ICBCode {
+	if s.Kind == ScopeKindICB {
+		return ICBCode(s.Code)
+	}
+	return ""
+}
+
+// scopeLSOAs returns the LSOAs of the scope, as an ICB. boroughs are only
+// needed for borough scopes.
+func scopeLSOAs(scope Scope, icbs map[ICBCode]*ICB, boroughs map[LSOACode]*LocalAuthority) (*ICB, error) {
+	switch scope.Kind {
+	case ScopeKindICB:
+		icb, ok := icbs[scope.ICB()]
+		if !ok {
+			return nil, fmt.Errorf("scope %s: no LSOAs in the ICB", scope)
+		}
+		return icb, nil
+	case ScopeKindBorough:
+		area := &ICB{LSOAs: make(LSOASet)}
+		for code, authority := range boroughs {
+			if authority.Code == scope.Code {
+				area.Name = authority.Name
+				area.LSOAs[code] = struct{}{}
+			}
+		}
+		if len(area.LSOAs) == 0 {
+			return nil, fmt.Errorf("scope %s: no LSOAs in the borough", scope)
+		}
+		return area, nil
+	}
+	return nil, fmt.Errorf("bad scope %s", scope)
+}
+
+// resolveScope returns the LSOAs of the scope, as an ICB, and its
+// practices. The practices of a borough are found by locating those of
+// the ICBs that overlap it, that haven't already been, in the LSOA
+// boundaries of the world.
+func resolveScope(scope Scope, icbs map[ICBCode]*ICB, boroughs map[LSOACode]*LocalAuthority, gps map[GPPracticeCode]*GPPractice, geography *CensusGeography, w b6.World) (*ICB, GPPracticeCodeSet, error) {
+	area, err := scopeLSOAs(scope, icbs, boroughs)
+	if err != nil {
+		return nil, nil, err
+	}
+	practices := make(GPPracticeCodeSet)
+	switch scope.Kind {
+	case ScopeKindICB:
+		for _, gp := range gps {
+			if gp.ICB == scope.ICB() {
+				practices[gp.Code] = struct{}{}
+			}
+		}
+	case ScopeKindBorough:
+		overlapping := make(map[ICBCode]struct{})
+		for code, icb := range icbs {
+			for lsoa := range area.LSOAs {
+				if _, ok := icb.LSOAs[lsoa]; ok {
+					overlapping[code] = struct{}{}
+					break
+				}
+			}
+		}
+		located := 0
+		for _, gp := range gps {
+			if _, ok := overlapping[gp.ICB]; !ok && gp.LSOA == "" {
+				continue
+			}
+			if gp.LSOA == "" && gp.Location != (s2.Point{}) {
+				gp.LSOA = lsoaContaining(gp.Location, w)
+				located++
+			}
+			for _, lsoa := range geography.FromLSOA11.Translate(gp.LSOA) {
+				if _, ok := area.LSOAs[lsoa]; ok {
+					practices[gp.Code] = struct{}{}
+					break
+				}
+			}
+		}
+		log.Printf("  %s: icbs: %d practices located: %d", scope, len(overlapping), located)
+	}
+	return area, practices, nil
+}
+
+// lsoaContaining returns the code of the LSOA whose boundary in the world
+// contains point, or the empty code if there isn't one.
+func lsoaContaining(point s2.Point, w b6.World) LSOACode {
+	lsoas := w.FindFeatures(b6.Intersection{b6.IntersectsPoint{Point: point}, b6.Tagged{Key: "#boundary", Value: "lsoa"}})
+	for lsoas.Next() {
+		return LSOACode(lsoas.Feature().Get("code").Value)
+	}
+	return ""
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PracticePCNPracticeCodeColumn = "Partner Organisation Code"
+	PracticePCNPCNCodeColumn      = "PCN Code"
+	PracticePCNPCNNameColumn      = "PCN Name"
+	PracticePCNEndDateColumn      = "Practice to PCN Relationship End Date"
+)
+
+// Segment is a population health segment, following the segmentation
+// frameworks used by ICBs, like Bridges to Health, simplified to the
+// attributes simulated. Each person is placed in the most severe segment
+// for which they qualify.
+type Segment int
+
+const (
+	SegmentHealthy Segment = iota
+	// People with a single long term condition
+	SegmentSingleLTC
+	// People with two or more long term conditions
+	SegmentMultimorbid
+	// People with moderate or severe frailty
+	SegmentFrail
+	// People expected to be in their last year of life
+	SegmentEndOfLife
+
+	SegmentCount
+	SegmentInvalid Segment = -1
+)
+
+func (s Segment) String() string {
+	switch s {
+	case SegmentHealthy:
+		return "healthy"
+	case SegmentSingleLTC:
+		return "single-ltc"
+	case SegmentMultimorbid:
+		return "multimorbid"
+	case SegmentFrail:
+		return "frail"
+	case SegmentEndOfLife:
+		return "end-of-life"
+	}
+	return "invalid"
+}
+
+// SegmentModel gives the probabilities used to place people into the
+// frail and end of life segments, which, unlike the others, don't follow
+// from the conditions simulated. Relative risks are normalised by the
+// simulated share of people at each age and sex with the risk factor, so
+// that the overall probabilities match those given.
+type SegmentModel struct {
+	// Prevalence of moderate or severe frailty by sex and age range
+	Frail AgePrevalences
+	// Risk of frailty for people with two or more long term conditions,
+	// relative to those with fewer
+	MultimorbidFrailty float64 `yaml:"multimorbidfrailty"`
+	// Probability of death within a year by sex and age range, used as the
+	// probability of being in the last year of life
+	EndOfLife AgePrevalences `yaml:"endoflife"`
+	// Risk of being in the last year of life for people who are frail,
+	// relative to those who aren't
+	FrailEndOfLife float64 `yaml:"frailendoflife"`
+}
+
+func readSegmentModel(filename string) (*SegmentModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment model: %s", err)
+	}
+	defer f.Close()
+	var model SegmentModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read segment model: %s", err)
+	}
+	if len(model.Frail) == 0 || len(model.EndOfLife) == 0 {
+		return nil, fmt.Errorf("segment model needs frailty and end of life probabilities by age")
+	}
+	if model.MultimorbidFrailty <= 0.0 || model.FrailEndOfLife <= 0.0 {
+		return nil, fmt.Errorf("segment model needs positive relative risks")
+	}
+	return &model, nil
+}
+
+// countLongTermConditions returns the number of distinct conditions p has,
+// counting only the most specific of a condition and its sub-conditions,
+// so that, eg, type 2 diabetes isn't counted again as diabetes.
+func countLongTermConditions(p *Person, conditions []QOFCondition) int {
+	n := 0
+	for _, c := range conditions {
+		if !p.Conditions.Contains(c) {
+			continue
+		}
+		specific := true
+		for _, other := range conditions {
+			if other != c && p.Conditions.Contains(other) && other.Parent() == c {
+				specific = false
+				break
+			}
+		}
+		if specific {
+			n++
+		}
+	}
+	return n
+}
+
+// segmentRiskShares returns, for each sex and age, the share of people
+// for whom has returns true, called with their index, used to normalise
+// relative risks.
+func segmentRiskShares(people []Person, has func(i int) bool) [][]float64 {
+	shares := make([][]float64, LastSex+1)
+	counts := make([][]int, LastSex+1)
+	for sex := range shares {
+		shares[sex] = make([]float64, LSOADataMaxAge+1)
+		counts[sex] = make([]int, LSOADataMaxAge+1)
+	}
+	for i := range people {
+		p := &people[i]
+		age := segmentAge(p)
+		counts[p.Sex][age]++
+		if has(i) {
+			shares[p.Sex][age]++
+		}
+	}
+	for sex := range shares {
+		for age := range shares[sex] {
+			if counts[sex][age] > 0 {
+				shares[sex][age] /= float64(counts[sex][age])
+			}
+		}
+	}
+	return shares
+}
+
+func segmentAge(p *Person) int {
+	if p.Age > LSOADataMaxAge {
+		return LSOADataMaxAge
+	}
+	return p.Age
+}
+
+// scaledProbability returns the probability for a person with or without
+// a risk factor, given the overall probability, the relative risk, and
+// the share of people with the risk factor.
+func scaledProbability(probability float64, rr float64, share float64, has bool) float64 {
+	expected := (1.0 - share) + share*rr
+	if expected <= 0.0 {
+		return clamp(probability, 0.0, 1.0)
+	}
+	if has {
+		probability *= rr
+	}
+	return clamp(probability/expected, 0.0, 1.0)
+}
+
+// assignSegments places each person into a segment, from the number of
+// long term conditions they have, and whether they're sampled as frail,
+// or as being in their last year of life. Care home residents are always
+// frail.
+func assignSegments(people []Person, conditions []QOFCondition, model *SegmentModel) {
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	ltcs := make([]int, len(people))
+	for i := range people {
+		ltcs[i] = countLongTermConditions(&people[i], conditions)
+	}
+	multimorbid := segmentRiskShares(people, func(i int) bool { return ltcs[i] >= 2 })
+	frail := make([]bool, len(people))
+	for i := range people {
+		p := &people[i]
+		probability := scaledProbability(model.Frail.Prevalence(p.Sex, p.Age), model.MultimorbidFrailty, multimorbid[p.Sex][segmentAge(p)], ltcs[i] >= 2)
+		frail[i] = p.CareHome != CareHomeIDInvalid || rng.Float64() < probability
+	}
+	frailShares := segmentRiskShares(people, func(i int) bool { return frail[i] })
+	var totals [SegmentCount]int
+	for i := range people {
+		p := &people[i]
+		endOfLife := scaledProbability(model.EndOfLife.Prevalence(p.Sex, p.Age), model.FrailEndOfLife, frailShares[p.Sex][segmentAge(p)], frail[i])
+		switch {
+		case rng.Float64() < endOfLife:
+			p.Segment = SegmentEndOfLife
+		case frail[i]:
+			p.Segment = SegmentFrail
+		case ltcs[i] >= 2:
+			p.Segment = SegmentMultimorbid
+		case ltcs[i] == 1:
+			p.Segment = SegmentSingleLTC
+		default:
+			p.Segment = SegmentHealthy
+		}
+		totals[p.Segment]++
+	}
+	for s := Segment(0); s < SegmentCount; s++ {
+		log.Printf("  %s: %d", s, totals[s])
+	}
+}
+
+// PCN is a primary care network, a group of practices working together.
+type PCN struct {
+	Code string
+	Name string
+}
+
+// readPracticePCNs returns the current PCN of each practice, from the
+// core partner details of the ePCN file published by NHS Digital.
+func readPracticePCNs(dataset *Dataset) (map[GPPracticeCode]*PCN, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[column] = i
+	}
+	for _, column := range []string{"practice-code", "pcn-code", "pcn-name", "end-date"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+
+	pcns := make(map[string]*PCN)
+	practices := make(map[GPPracticeCode]*PCN)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if row[columns[dataset.Column("end-date")]] != "" {
+			continue
+		}
+		code := row[columns[dataset.Column("pcn-code")]]
+		pcn, ok := pcns[code]
+		if !ok {
+			pcn = &PCN{Code: code, Name: row[columns[dataset.Column("pcn-name")]]}
+			pcns[code] = pcn
+		}
+		practices[GPPracticeCode(row[columns[dataset.Column("practice-code")]])] = pcn
+	}
+	log.Printf("  pcns: %d practices: %d", len(pcns), len(practices))
+	return practices, nil
+}
+
+// LocalAuthority is a local authority district, or borough.
+type LocalAuthority struct {
+	Code string
+	Name string
+}
+
+// readLocalAuthorities returns the local authority district containing
+// each LSOA.
+func readLocalAuthorities(dataset *Dataset, geography *CensusGeography) (map[LSOACode]*LocalAuthority, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+
+	byCode := make(map[string]*LocalAuthority)
+	authorities := make(map[LSOACode]*LocalAuthority)
+	body := false
+	columns := make(map[string]int)
+	lsoaColumn := dataset.Column("lsoa-code")
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(row) > 0 {
+			if !body && row[0] == lsoaColumn {
+				for i, header := range row {
+					columns[header] = i
+				}
+				for _, column := range []string{"lad-code", "lad-name"} {
+					if _, ok := columns[dataset.Column(column)]; !ok {
+						return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+					}
+				}
+				body = true
+			} else if body {
+				code := row[columns[dataset.Column("lad-code")]]
+				authority, ok := byCode[code]
+				if !ok {
+					authority = &LocalAuthority{Code: code, Name: row[columns[dataset.Column("lad-name")]]}
+					byCode[code] = authority
+				}
+				for _, lsoa := range geography.FromLSOA11.Translate(LSOACode(row[columns[lsoaColumn]])) {
+					authorities[lsoa] = authority
+				}
+			}
+		}
+	}
+	return authorities, nil
+}
+
+// SegmentCounts counts the people in each segment, for each group of a
+// breakdown, like practices.
+type SegmentCounts struct {
+	Population AggregatePopulation
+	// The breakdown, one of practice, pcn or borough
+	Key    string
+	Groups map[string]*[SegmentCount]int
+}
+
+func (s *SegmentCounts) Add(group string, segment Segment) {
+	counts, ok := s.Groups[group]
+	if !ok {
+		counts = &[SegmentCount]int{}
+		s.Groups[group] = counts
+	}
+	counts[segment]++
+}
+
+// countSegments counts the people registered with ICB practices in each
+// segment by practice, and, if pcns isn't nil, by PCN, and the people
+// living in the ICB by the borough of their home, since boroughs plan
+// for their residents.
+func countSegments(people []Person, selected GPPracticeCodeSet, pcns map[GPPracticeCode]*PCN, homes LSOASet, boroughs map[LSOACode]*LocalAuthority) []*SegmentCounts {
+	byPractice := &SegmentCounts{Population: AggregatePopulationRegistered, Key: "practice", Groups: make(map[string]*[SegmentCount]int)}
+	byPCN := &SegmentCounts{Population: AggregatePopulationRegistered, Key: "pcn", Groups: make(map[string]*[SegmentCount]int)}
+	byBorough := &SegmentCounts{Population: AggregatePopulationResident, Key: "borough", Groups: make(map[string]*[SegmentCount]int)}
+	withoutPCN := make(GPPracticeCodeSet)
+	for i := range people {
+		p := &people[i]
+		if _, ok := selected[p.GP]; ok {
+			byPractice.Add(p.GP.String(), p.Segment)
+			if pcns != nil {
+				if pcn, ok := pcns[p.GP]; ok {
+					byPCN.Add(pcn.Code, p.Segment)
+				} else {
+					withoutPCN[p.GP] = struct{}{}
+				}
+			}
+		}
+		if _, ok := homes[p.Home]; ok {
+			if borough, ok := boroughs[p.Home]; ok {
+				byBorough.Add(borough.Name, p.Segment)
+			}
+		}
+	}
+	if len(withoutPCN) > 0 {
+		Warningf("  segments: %d ICB practices without a PCN omitted from PCN counts", len(withoutPCN))
+	}
+	counts := []*SegmentCounts{byPractice}
+	if pcns != nil {
+		counts = append(counts, byPCN)
+	}
+	return append(counts, byBorough)
+}
+
+// writeSegments writes segments.csv, with the number and share of people
+// in each segment, for each group of each breakdown, in tidy form.
+func writeSegments(counts []*SegmentCounts, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "segments.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"population", "breakdown", "value", "segment", "people", "share"})
+	for _, c := range counts {
+		groups := make([]string, 0, len(c.Groups))
+		for group := range c.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			total := 0
+			for _, n := range c.Groups[group] {
+				total += n
+			}
+			for s := Segment(0); s < SegmentCount; s++ {
+				n := c.Groups[group][s]
+				w.Write([]string{c.Population.String(), c.Key, group, s.String(), strconv.Itoa(n), fmt.Sprintf("%f", float64(n)/float64(total))})
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+// The oldest age represented by a top coded age band, like 90+
+const ServedMaxAge = 200
+
+// The largest body accepted for a query posted with a polygon
+const ServedMaxQueryBytes = 16 << 20
+
+// PolygonMatch is how the home LSOAs of people are matched with a
+// polygon given with a query
+type PolygonMatch int
+
+const (
+	// LSOAs whose boundary intersects the polygon
+	PolygonMatchIntersects PolygonMatch = iota
+	// LSOAs whose centroid is within the polygon, so that LSOAs
+	// neighbouring the polygon aren't included
+	PolygonMatchCentroid
+
+	PolygonMatchCount
+	PolygonMatchInvalid PolygonMatch = -1
+)
+
+func (p PolygonMatch) String() string {
+	switch p {
+	case PolygonMatchIntersects:
+		return "intersects"
+	case PolygonMatchCentroid:
+		return "centroid"
+	}
+	return "invalid"
+}
+
+func PolygonMatchFromString(s string) (PolygonMatch, error) {
+	if s == "" {
+		return PolygonMatchIntersects, nil
+	}
+	for p := PolygonMatch(0); p < PolygonMatchCount; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return PolygonMatchInvalid, fmt.Errorf("bad polygon match %q, expected intersects or centroid", s)
+}
+
+// servedPerson holds the attributes of a person in population.csv by
+// which queries can filter. Ages are ranges, since they may be banded by
+// the output profile used to write the population.
+type servedPerson struct {
+	LSOA       LSOACode
+	MSOA       MSOACode
+	GP         GPPracticeCode
+	Sex        Sex
+	AgeBegin   int
+	AgeEnd     int // Inclusive
+	Conditions QOFConditions
+}
+
+// ServedPopulation is a population written by simulate, loaded to
+// answer aggregate queries.
+type ServedPopulation struct {
+	People     []servedPerson
+	Conditions []QOFCondition
+	// The boundary of each home LSOA, from the world, if loaded, to
+	// answer queries by polygon
+	Boundaries map[LSOACode]*servedBoundary
+	// Every practice, with the number of simulated patients registered
+	// with it as SimulatedListSize
+	Practices map[GPPracticeCode]*GPPractice
+	// The incidence of conditions, to answer forecasts, and the activity
+	// they need, if loaded
+	Incidence *IncidenceModel
+	Demand    DemandModel
+	// The coverage of each condition's reported prevalence, from
+	// coverage.json, if it was written
+	Coverage []*ConditionCoverage
+	// The parameters with which the assignment model ranks alternative
+	// practices
+	Parameters SimulationParameters
+}
+
+type servedBoundary struct {
+	Polygons []*s2.Polygon
+	Bound    s2.Rect
+	Centroid s2.Point
+}
+
+// parseAgeRange parses a single age, like 65, an inclusive range, like
+// 65-79, or a top coded range, like 90+. Since + is decoded as a space in
+// URLs, open ended ranges can also be given as 90-.
+func parseAgeRange(s string) (int, int, error) {
+	if strings.HasSuffix(s, "+") || strings.HasSuffix(s, "-") {
+		begin, err := strconv.Atoi(s[0 : len(s)-1])
+		return begin, ServedMaxAge, err
+	}
+	if i := strings.Index(s, "-"); i > 0 {
+		begin, err := strconv.Atoi(s[0:i])
+		if err != nil {
+			return 0, 0, err
+		}
+		end, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if end < begin {
+			return 0, 0, fmt.Errorf("age range %q ends before it begins", s)
+		}
+		return begin, end, nil
+	}
+	age, err := strconv.Atoi(s)
+	return age, age, err
+}
+
+// readServedPopulation reads population.csv from directory. Homes are
+// mapped to MSOAs using the lsoa-msoa dataset, unless the population was
+// written with homes at MSOA level. Conditions are read from whichever
+// encoding they were written in, with those written as a bitmask, or in
+// population-conditions.csv, served if anyone has them.
+func readServedPopulation(directory string, data DataManifest, geography *CensusGeography) (*ServedPopulation, error) {
+	filename := filepath.Join(directory, "population.csv")
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	population := &ServedPopulation{}
+	conditionColumns := make(map[QOFCondition]int)
+	for i, column := range row {
+		columns[column] = i
+		if strings.HasPrefix(column, "condition_") {
+			condition := QOFConditionFromString(strings.TrimPrefix(column, "condition_"))
+			if condition != QOFConditionInvalid {
+				population.Conditions = append(population.Conditions, condition)
+				conditionColumns[condition] = i
+			}
+		}
+	}
+	age, ok := columns["age"]
+	if !ok {
+		if age, ok = columns["age_band"]; !ok {
+			return nil, fmt.Errorf("%s: no age or age_band column", filename)
+		}
+	}
+	for _, column := range []string{"sex", "gp"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", filename, column)
+		}
+	}
+	bitmask, isBitmask := columns["conditions"]
+	var byID map[int]QOFConditions
+	var found QOFConditions
+	if len(conditionColumns) == 0 && !isBitmask {
+		if byID, population.Conditions, err = readPersonConditions(directory); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if byID != nil {
+			if _, ok := columns["id"]; !ok {
+				return nil, fmt.Errorf("%s: no id column for %s", filename, PersonConditionsFilename)
+			}
+		}
+	}
+	home, lsoaHomes := columns["home"]
+	if !lsoaHomes {
+		if home, ok = columns["home_msoa"]; !ok {
+			return nil, fmt.Errorf("%s: no home or home_msoa column", filename)
+		}
+	}
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		p := servedPerson{
+			GP:  GPPracticeCode(row[columns["gp"]]),
+			Sex: SexFromString(row[columns["sex"]]),
+		}
+		if p.AgeBegin, p.AgeEnd, err = parseAgeRange(row[age]); err != nil {
+			return nil, fmt.Errorf("%s: bad age: %s", filename, err)
+		}
+		if lsoaHomes {
+			p.LSOA = LSOACode(row[home])
+		} else {
+			p.MSOA = MSOACode(row[home])
+		}
+		for condition, i := range conditionColumns {
+			if row[i] == "1" {
+				p.Conditions |= QOFConditions(condition)
+			}
+		}
+		if isBitmask {
+			mask, err := strconv.ParseUint(row[bitmask], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad conditions: %s", filename, err)
+			}
+			p.Conditions = QOFConditions(mask)
+			found |= p.Conditions
+		} else if byID != nil {
+			id, err := strconv.Atoi(row[columns["id"]])
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad id: %s", filename, err)
+			}
+			p.Conditions = byID[id]
+		}
+		population.People = append(population.People, p)
+	}
+
+	if isBitmask {
+		for _, c := range AllQOFConditions() {
+			if found.Contains(c) {
+				population.Conditions = append(population.Conditions, c)
+			}
+		}
+	}
+
+	if lsoaHomes {
+		lsoas := make(map[LSOACode]*LSOA)
+		for _, p := range population.People {
+			if _, ok := lsoas[p.LSOA]; !ok {
+				lsoas[p.LSOA] = &LSOA{Code: p.LSOA}
+			}
+		}
+		if _, err := fillMSOAs(lsoas, data.Get(DatasetLSOAMSOA), geography); err != nil {
+			return nil, err
+		}
+		for i := range population.People {
+			population.People[i].MSOA = lsoas[population.People[i].LSOA].MSOACode
+		}
+	}
+	log.Printf("serve: people: %d conditions: %d", len(population.People), len(population.Conditions))
+	return population, nil
+}
+
+type ServedConditionResult struct {
+	Count      int     `json:"count"`
+	Prevalence float64 `json:"prevalence"`
+}
+
+type ServedResult struct {
+	People     int                              `json:"people"`
+	Conditions map[string]ServedConditionResult `json:"conditions"`
+	// For queries by polygon, the home LSOAs matched
+	LSOAs []string `json:"lsoas,omitempty"`
+}
+
+type servedError struct {
+	Error string `json:"error"`
+}
+
+func writeServedJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Warningf("serve: %s", err)
+	}
+}
+
+// PopulationQuery filters the people whose conditions are counted. Empty
+// filters match everyone. Age is a single age, or a range, as accepted by
+// parseAgeRange. Polygon is a GeoJSON Polygon or MultiPolygon, or a Feature
+// with one, matched against home LSOAs as given by Match.
+type PopulationQuery struct {
+	MSOAs      []string        `json:"msoa,omitempty"`
+	LSOAs      []string        `json:"lsoa,omitempty"`
+	GPs        []string        `json:"gp,omitempty"`
+	Sexes      []string        `json:"sex,omitempty"`
+	Age        string          `json:"age,omitempty"`
+	Conditions []string        `json:"condition,omitempty"`
+	Polygon    json.RawMessage `json:"polygon,omitempty"`
+	Match      string          `json:"match,omitempty"`
+}
+
+// PopulationQueryFromRequest reads a query from the parameters of an HTTP
+// request, where each filter other than age takes comma separated values.
+func PopulationQueryFromRequest(r *http.Request) *PopulationQuery {
+	values := func(name string) []string {
+		if v := r.URL.Query().Get(name); v != "" {
+			return strings.Split(v, ",")
+		}
+		return nil
+	}
+	return &PopulationQuery{
+		MSOAs:      values("msoa"),
+		LSOAs:      values("lsoa"),
+		GPs:        values("gp"),
+		Sexes:      values("sex"),
+		Age:        r.URL.Query().Get("age"),
+		Conditions: values("condition"),
+	}
+}
+
+// toSet returns the values as a set, or nil if there are none, matching
+// everything.
+func toSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{})
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// servedSelection is the people matching the filters of a query, with the
+// conditions it asks for.
+type servedSelection struct {
+	People     []*servedPerson
+	Conditions []QOFCondition
+	// For queries by polygon, the home LSOAs matched
+	LSOAs []string
+}
+
+// Query returns the number of people matching the filters of the query,
+// and the count and prevalence of conditions among them, or every
+// condition in the population if none are given. If the population's ages
+// are banded, age ranges must align with the bands.
+func (s *ServedPopulation) Query(q *PopulationQuery) (*ServedResult, error) {
+	selection, err := s.selectPeople(q)
+	if err != nil {
+		return nil, err
+	}
+	result := &ServedResult{
+		People:     len(selection.People),
+		Conditions: make(map[string]ServedConditionResult),
+		LSOAs:      selection.LSOAs,
+	}
+	counts := make([]int, len(selection.Conditions))
+	for _, p := range selection.People {
+		for j, condition := range selection.Conditions {
+			if p.Conditions.Contains(condition) {
+				counts[j]++
+			}
+		}
+	}
+	for i, condition := range selection.Conditions {
+		c := ServedConditionResult{Count: counts[i]}
+		if result.People > 0 {
+			c.Prevalence = float64(counts[i]) / float64(result.People)
+		}
+		result.Conditions[condition.String()] = c
+	}
+	return result, nil
+}
+
+// selectPeople returns the people matching the filters of the query, and
+// the conditions it asks for, or every condition in the population if
+// none are given.
+func (s *ServedPopulation) selectPeople(q *PopulationQuery) (*servedSelection, error) {
+	msoas, lsoas, gps, sexes := toSet(q.MSOAs), toSet(q.LSOAs), toSet(q.GPs), toSet(q.Sexes)
+	ageBegin, ageEnd := 0, ServedMaxAge
+	if q.Age != "" {
+		var err error
+		if ageBegin, ageEnd, err = parseAgeRange(q.Age); err != nil {
+			return nil, fmt.Errorf("bad age: %s", err)
+		}
+	}
+	conditions := s.Conditions
+	if len(q.Conditions) > 0 {
+		conditions = make([]QOFCondition, 0, len(q.Conditions))
+		for name := range toSet(q.Conditions) {
+			condition := QOFConditionFromString(name)
+			found := false
+			for _, available := range s.Conditions {
+				found = found || available == condition
+			}
+			if !found {
+				return nil, fmt.Errorf("condition %q isn't in the population", name)
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	if (lsoas != nil || len(q.Polygon) > 0) && s.People[0].LSOA == "" {
+		return nil, fmt.Errorf("the population doesn't include homes at LSOA level")
+	}
+
+	selection := &servedSelection{Conditions: conditions}
+	if len(q.Polygon) > 0 {
+		match, err := PolygonMatchFromString(q.Match)
+		if err != nil {
+			return nil, err
+		}
+		polygons, err := polygonsFromGeoJSON(q.Polygon)
+		if err != nil {
+			return nil, fmt.Errorf("bad polygon: %s", err)
+		}
+		within, err := s.lsoasInPolygons(polygons, match)
+		if err != nil {
+			return nil, err
+		}
+		// Intersected with any LSOAs given, so that both apply
+		matched := make(map[string]struct{})
+		for code := range within {
+			if _, ok := lsoas[code]; ok || lsoas == nil {
+				matched[code] = struct{}{}
+				selection.LSOAs = append(selection.LSOAs, code)
+			}
+		}
+		sort.Strings(selection.LSOAs)
+		lsoas = matched
+	}
+	for i := range s.People {
+		p := &s.People[i]
+		if msoas != nil {
+			if _, ok := msoas[p.MSOA.String()]; !ok {
+				continue
+			}
+		}
+		if lsoas != nil {
+			if _, ok := lsoas[p.LSOA.String()]; !ok {
+				continue
+			}
+		}
+		if gps != nil {
+			if _, ok := gps[p.GP.String()]; !ok {
+				continue
+			}
+		}
+		if sexes != nil {
+			if _, ok := sexes[p.Sex.String()]; !ok {
+				continue
+			}
+		}
+		if p.AgeEnd < ageBegin || p.AgeBegin > ageEnd {
+			continue
+		} else if p.AgeBegin < ageBegin || p.AgeEnd > ageEnd {
+			return nil, fmt.Errorf("age range %d-%d doesn't align with the population's age bands", ageBegin, ageEnd)
+		}
+		selection.People = append(selection.People, p)
+	}
+	return selection, nil
+}
+
+// lsoasInPolygons returns the codes of the home LSOAs matching any of
+// polygons.
+func (s *ServedPopulation) lsoasInPolygons(polygons []*s2.Polygon, match PolygonMatch) (map[string]struct{}, error) {
+	if s.Boundaries == nil {
+		return nil, fmt.Errorf("queries by polygon need LSOA boundaries, from --world")
+	}
+	lsoas := make(map[string]struct{})
+	for code, boundary := range s.Boundaries {
+		for _, polygon := range polygons {
+			if !polygon.RectBound().Intersects(boundary.Bound) {
+				continue
+			}
+			found := false
+			switch match {
+			case PolygonMatchIntersects:
+				for _, p := range boundary.Polygons {
+					if polygon.Intersects(p) {
+						found = true
+						break
+					}
+				}
+			case PolygonMatchCentroid:
+				found = polygon.ContainsPoint(boundary.Centroid)
+			}
+			if found {
+				lsoas[code.String()] = struct{}{}
+				break
+			}
+		}
+	}
+	return lsoas, nil
+}
+
+// readServedBoundaries reads the boundary of each home LSOA of the
+// population from the world.
+func (s *ServedPopulation) readServedBoundaries(geography *CensusGeography, w b6.World) {
+	s.Boundaries = make(map[LSOACode]*servedBoundary)
+	missing := 0
+	for i := range s.People {
+		code := s.People[i].LSOA
+		if _, ok := s.Boundaries[code]; ok {
+			continue
+		}
+		area := findLSOABoundary(code, geography.Year, w)
+		if area == nil {
+			s.Boundaries[code] = &servedBoundary{Bound: s2.EmptyRect()}
+			missing++
+			continue
+		}
+		boundary := &servedBoundary{Bound: s2.EmptyRect(), Centroid: b6.Centroid(area)}
+		for j := 0; j < area.Len(); j++ {
+			boundary.Polygons = append(boundary.Polygons, area.Polygon(j))
+			boundary.Bound = boundary.Bound.Union(area.Polygon(j).RectBound())
+		}
+		s.Boundaries[code] = boundary
+	}
+	log.Printf("serve: lsoa boundaries: %d missing: %d", len(s.Boundaries)-missing, missing)
+}
+
+func (s *ServedPopulation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var q *PopulationQuery
+	switch r.Method {
+	case http.MethodGet:
+		q = PopulationQueryFromRequest(r)
+	case http.MethodPost:
+		q = &PopulationQuery{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ServedMaxQueryBytes)).Decode(q); err != nil {
+			writeServedJSON(w, http.StatusBadRequest, servedError{Error: fmt.Sprintf("bad query: %s", err)})
+			return
+		}
+	default:
+		writeServedJSON(w, http.StatusMethodNotAllowed, servedError{Error: "expected GET or POST"})
+		return
+	}
+	result, err := s.Query(q)
+	if err != nil {
+		writeServedJSON(w, http.StatusBadRequest, servedError{Error: err.Error()})
+		return
+	}
+	writeServedJSON(w, http.StatusOK, result)
+}
+
+// serve loads the population written to directory, and answers queries
+// for aggregate counts and prevalences at /population, for practices at
+// /practices, for forecasts at /forecast, and for the coverage of reported
+// prevalence at /coverage, until the server fails. If
+// w isn't nil, the boundaries of home LSOAs, and the locations of
+// practices, are read from it, to answer queries by polygon, and rank
+// alternative practices with the assignment model's parameters. Forecasts
+// need incidence, and include activity if demand isn't nil.
+func serve(address string, directory string, data DataManifest, geography *CensusGeography, w b6.World, incidence *IncidenceModel, demand DemandModel, parameters SimulationParameters) error {
+	population, err := readServedPopulation(directory, data, geography)
+	if err != nil {
+		return err
+	}
+	population.Parameters = parameters
+	if len(population.People) == 0 {
+		return fmt.Errorf("no people in %s", filepath.Join(directory, "population.csv"))
+	}
+	if w != nil {
+		if population.People[0].LSOA == "" {
+			Warningf("serve: homes aren't at LSOA level, so queries by polygon aren't available")
+		} else {
+			population.readServedBoundaries(geography, w)
+		}
+	}
+	if err := population.readServedPractices(data, w); err != nil {
+		return err
+	}
+	population.Incidence, population.Demand = incidence, demand
+	if population.Coverage, err = readCoverage(directory); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/population", population)
+	mux.HandleFunc("/practices", population.servePracticeSearch)
+	mux.HandleFunc("/practices/", population.servePracticeProfile)
+	mux.HandleFunc("/forecast", population.serveForecast)
+	mux.HandleFunc("/coverage", population.serveCoverage)
+	log.Printf("serve: listening on %s", address)
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"diagonal.works/b6"
+	"github.com/golang/geo/s2"
+)
+
+const (
+	// The practices returned by a search, unless limit is given, and the
+	// most that can be asked for
+	ServedPracticeSearchLimit    = 20
+	ServedPracticeSearchMaxLimit = 100
+	// The alternatives returned with a practice's profile, unless
+	// alternatives is given
+	ServedPracticeAlternatives = 5
+)
+
+// ServedPractice describes a practice with simulated patients
+type ServedPractice struct {
+	Code              string `json:"code"`
+	Name              string `json:"name"`
+	Postcode          string `json:"postcode"`
+	ICB               string `json:"icb"`
+	ListSize          int    `json:"list_size"`
+	SimulatedListSize int    `json:"simulated_list_size"`
+}
+
+func newServedPractice(gp *GPPractice) ServedPractice {
+	return ServedPractice{
+		Code:              gp.Code.String(),
+		Name:              gp.Name,
+		Postcode:          gp.Postcode,
+		ICB:               gp.ICB.String(),
+		ListSize:          gp.ListSize,
+		SimulatedListSize: gp.SimulatedListSize,
+	}
+}
+
+// ServedAlternative is a practice near the homes of another's simulated
+// patients, with the share of those patients the assignment model gives
+// it, and the mean distance from it of those for whom it's nearby.
+type ServedAlternative struct {
+	ServedPractice
+	Share     float64 `json:"share"`
+	DistanceM float64 `json:"distance_m"`
+}
+
+// ServedPracticeProfile is the simulated profile of a practice's patients
+type ServedPracticeProfile struct {
+	ServedPractice
+	Sexes      map[string]int                   `json:"sexes"`
+	Conditions map[string]ServedConditionResult `json:"conditions"`
+	// The share of the practice's patients the assignment model gives
+	// the practice itself, and the alternatives with the largest shares,
+	// if practices and homes are located
+	Share        float64             `json:"share,omitempty"`
+	Alternatives []ServedAlternative `json:"alternatives,omitempty"`
+}
+
+// readServedPractices reads the practices, and their list sizes, from
+// data, counting the simulated patients of each. Practices are located
+// with w, if it isn't nil, to rank alternatives.
+func (s *ServedPopulation) readServedPractices(data DataManifest, w b6.World) error {
+	gps, err := readGPPractices(data.Get(DatasetGPPractices), postcodeSources(data), w)
+	if err != nil {
+		return err
+	}
+	successors, err := readGPPracticeSuccessors(data.Get(DatasetGPPracticeSuccessors))
+	if err != nil {
+		return err
+	}
+	if err := readGPPracticeListSizes(gps, successors, data.Get(DatasetQOFListSizes)); err != nil {
+		return err
+	}
+	missing := 0
+	for i := range s.People {
+		if gp, ok := gps[s.People[i].GP]; ok {
+			gp.SimulatedListSize++
+		} else if s.People[i].GP != GPPracticeCodeInvalid {
+			missing++
+		}
+	}
+	if missing > 0 {
+		Warningf("serve: %d people registered with practices that aren't in %s", missing, data.Get(DatasetGPPractices).Filename)
+	}
+	s.Practices = gps
+	return nil
+}
+
+// normalisePostcode returns a postcode in upper case, without spaces, so
+// that partial postcodes match however they're written.
+func normalisePostcode(postcode string) string {
+	return strings.ReplaceAll(strings.ToUpper(postcode), " ", "")
+}
+
+// SearchPractices returns up to limit practices with simulated patients
+// matching text, by code, postcode or name, ignoring case and, for
+// postcodes, spaces. Exact codes come first, then codes, postcodes and
+// names beginning with text, then names containing it.
+func (s *ServedPopulation) SearchPractices(text string, limit int) []ServedPractice {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	if text == "" {
+		return []ServedPractice{}
+	}
+	postcode := normalisePostcode(text)
+	type match struct {
+		gp   *GPPractice
+		rank int
+	}
+	matches := make([]match, 0)
+	for _, gp := range s.Practices {
+		if gp.SimulatedListSize == 0 {
+			continue
+		}
+		name := strings.ToUpper(gp.Name)
+		rank := -1
+		if gp.Code.String() == text {
+			rank = 0
+		} else if strings.HasPrefix(gp.Code.String(), text) {
+			rank = 1
+		} else if strings.HasPrefix(normalisePostcode(gp.Postcode), postcode) {
+			rank = 2
+		} else if strings.HasPrefix(name, text) {
+			rank = 3
+		} else if strings.Contains(name, text) {
+			rank = 4
+		}
+		if rank >= 0 {
+			matches = append(matches, match{gp: gp, rank: rank})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank < matches[j].rank
+		} else if matches[i].gp.Name != matches[j].gp.Name {
+			return matches[i].gp.Name < matches[j].gp.Name
+		}
+		return matches[i].gp.Code < matches[j].gp.Code
+	})
+	if len(matches) > limit {
+		matches = matches[0:limit]
+	}
+	practices := make([]ServedPractice, len(matches))
+	for i, m := range matches {
+		practices[i] = newServedPractice(m.gp)
+	}
+	return practices
+}
+
+// PracticeProfile returns the simulated profile of the patients of the
+// practice with the given code, with up to alternatives of the other
+// practices to which the assignment model would send them.
+func (s *ServedPopulation) PracticeProfile(code GPPracticeCode, alternatives int) (*ServedPracticeProfile, error) {
+	gp, ok := s.Practices[code]
+	if !ok || gp.SimulatedListSize == 0 {
+		return nil, fmt.Errorf("no simulated patients for practice %q", code)
+	}
+	result, err := s.Query(&PopulationQuery{GPs: []string{code.String()}})
+	if err != nil {
+		return nil, err
+	}
+	profile := &ServedPracticeProfile{
+		ServedPractice: newServedPractice(gp),
+		Sexes:          make(map[string]int),
+		Conditions:     result.Conditions,
+	}
+	homes := make(map[LSOACode]int)
+	for i := range s.People {
+		if p := &s.People[i]; p.GP == code {
+			profile.Sexes[p.Sex.String()]++
+			homes[p.LSOA]++
+		}
+	}
+	if s.Boundaries != nil && gp.Location != (s2.Point{}) {
+		profile.Share, profile.Alternatives = s.rankAlternatives(code, homes, alternatives)
+	}
+	return profile, nil
+}
+
+// rankAlternatives returns the share of the patients living in homes,
+// by the number in each LSOA, that the assignment model gives the
+// practice with code, and up to n other practices, ranked by the share it
+// gives them. Practices are considered within the nearby radius of the
+// simulation parameters of the centre of each LSOA, with the default
+// assignment parameters.
+func (s *ServedPopulation) rankAlternatives(code GPPracticeCode, homes map[LSOACode]int, n int) (float64, []ServedAlternative) {
+	located := make([]*GPPractice, 0)
+	for _, gp := range s.Practices {
+		if gp.Location != (s2.Point{}) && gp.ListSize > 0 {
+			located = append(located, gp)
+		}
+	}
+	shares := make(map[GPPracticeCode]float64)
+	// The total distance of, and number of, patients for whom each
+	// practice is nearby
+	distances := make(map[GPPracticeCode]float64)
+	nearbyPatients := make(map[GPPracticeCode]int)
+	patients := 0
+	for lsoa, count := range homes {
+		boundary, ok := s.Boundaries[lsoa]
+		if !ok || boundary.Polygons == nil {
+			continue
+		}
+		patients += count
+		nearby := make([]NearbyGP, 0)
+		for _, gp := range located {
+			d := b6.AngleToMeters(boundary.Centroid.Distance(gp.Location))
+			if d <= s.Parameters.GPLSOANearbyRadiusM {
+				nearby = append(nearby, NearbyGP{Practice: gp.Code, DistanceM: d})
+			}
+		}
+		filtered, p := nearbyGPProbabilities(nearby, s.Practices, AssignmentParameters{}.withDefaults(s.Parameters), nil)
+		for i, gp := range filtered {
+			shares[gp.Practice] += p[i] * float64(count)
+			distances[gp.Practice] += gp.DistanceM * float64(count)
+			nearbyPatients[gp.Practice] += count
+		}
+	}
+	if patients == 0 {
+		return 0.0, nil
+	}
+	ranked := make([]GPPracticeCode, 0, len(shares))
+	for c := range shares {
+		if c != code {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if shares[ranked[i]] != shares[ranked[j]] {
+			return shares[ranked[i]] > shares[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > n {
+		ranked = ranked[0:n]
+	}
+	alternatives := make([]ServedAlternative, len(ranked))
+	for i, c := range ranked {
+		alternatives[i] = ServedAlternative{
+			ServedPractice: newServedPractice(s.Practices[c]),
+			Share:          shares[c] / float64(patients),
+			DistanceM:      distances[c] / float64(nearbyPatients[c]),
+		}
+	}
+	return shares[code] / float64(patients), alternatives
+}
+
+// limitFromRequest returns the integer parameter name of r, or value if
+// it isn't given, capped at max.
+func limitFromRequest(r *http.Request, name string, value int, max int) (int, error) {
+	if v := r.URL.Query().Get(name); v != "" {
+		var err error
+		if value, err = strconv.Atoi(v); err != nil || value < 0 {
+			return 0, fmt.Errorf("bad %s %q", name, v)
+		}
+	}
+	if value > max {
+		value = max
+	}
+	return value, nil
+}
+
+// servePracticeSearch answers /practices?q=<text>, with the practices
+// matching text.
+func (s *ServedPopulation) servePracticeSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServedJSON(w, http.StatusMethodNotAllowed, servedError{Error: "expected GET"})
+		return
+	}
+	limit, err := limitFromRequest(r, "limit", ServedPracticeSearchLimit, ServedPracticeSearchMaxLimit)
+	if err != nil {
+		writeServedJSON(w, http.StatusBadRequest, servedError{Error: err.Error()})
+		return
+	}
+	writeServedJSON(w, http.StatusOK, s.SearchPractices(r.URL.Query().Get("q"), limit))
+}
+
+// servePracticeProfile answers /practices/<code>, with the profile of the
+// practice.
+func (s *ServedPopulation) servePracticeProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeServedJSON(w, http.StatusMethodNotAllowed, servedError{Error: "expected GET"})
+		return
+	}
+	alternatives, err := limitFromRequest(r, "alternatives", ServedPracticeAlternatives, ServedPracticeSearchMaxLimit)
+	if err != nil {
+		writeServedJSON(w, http.StatusBadRequest, servedError{Error: err.Error()})
+		return
+	}
+	code := GPPracticeCode(strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/practices/")))
+	profile, err := s.PracticeProfile(code, alternatives)
+	if err != nil {
+		writeServedJSON(w, http.StatusNotFound, servedError{Error: err.Error()})
+		return
+	}
+	writeServedJSON(w, http.StatusOK, profile)
+}
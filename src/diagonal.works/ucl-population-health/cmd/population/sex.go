@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// OtherSexPrevalence chooses the rates used for people whose sex is
+// neither male nor female, by models that don't give rates for them
+// explicitly, with an "o" entry alongside "m" and "f". Rates are chosen
+// by resolveOtherSex when the models are read, and prevalences that
+// haven't been resolved use the average.
+type OtherSexPrevalence int
+
+const (
+	// The average of the rates for males and females
+	OtherSexPrevalenceAverage OtherSexPrevalence = iota
+	OtherSexPrevalenceMale
+	OtherSexPrevalenceFemale
+)
+
+func (o OtherSexPrevalence) String() string {
+	switch o {
+	case OtherSexPrevalenceAverage:
+		return "average"
+	case OtherSexPrevalenceMale:
+		return "male"
+	case OtherSexPrevalenceFemale:
+		return "female"
+	}
+	return "invalid"
+}
+
+func OtherSexPrevalenceFromString(s string) (OtherSexPrevalence, error) {
+	switch s {
+	case "average":
+		return OtherSexPrevalenceAverage, nil
+	case "male":
+		return OtherSexPrevalenceMale, nil
+	case "female":
+		return OtherSexPrevalenceFemale, nil
+	}
+	return OtherSexPrevalenceAverage, fmt.Errorf("unknown other sex prevalence %q, expected average, male or female", s)
+}
+
+func (o OtherSexPrevalence) Prevalence(a AgePrevalences, age int) float64 {
+	switch o {
+	case OtherSexPrevalenceMale:
+		return a.Prevalence(Male, age)
+	case OtherSexPrevalenceFemale:
+		return a.Prevalence(Female, age)
+	}
+	return (a.Prevalence(Male, age) + a.Prevalence(Female, age)) / 2.0
+}
+
+// WithOtherSex returns a, with rates for the Other sex chosen by o, over
+// ranges split at the ages at which the rates for males or females change,
+// if a gives rates for males or females, but not the Other sex.
+func (a AgePrevalences) WithOtherSex(o OtherSexPrevalence) AgePrevalences {
+	if len(a) > int(Other) && len(a[Other]) > 0 {
+		return a
+	}
+	boundaries := make(map[int]struct{})
+	for _, sex := range []Sex{Male, Female} {
+		if int(sex) < len(a) {
+			for _, r := range a[sex] {
+				boundaries[r.Ages.Begin] = struct{}{}
+				if r.Ages.End != 0 {
+					boundaries[r.Ages.End] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(boundaries) == 0 {
+		return a
+	}
+	ages := make([]int, 0, len(boundaries))
+	for age := range boundaries {
+		ages = append(ages, age)
+	}
+	sort.Ints(ages)
+	resolved := make(AgePrevalences, int(Other)+1)
+	copy(resolved, a)
+	resolved[Other] = make([]AgePrevalence, 0, len(ages))
+	for i, begin := range ages {
+		r := AgeRange{Begin: begin}
+		if i+1 < len(ages) {
+			r.End = ages[i+1]
+		}
+		resolved[Other] = append(resolved[Other], AgePrevalence{Ages: r, Prevalence: o.Prevalence(a, begin)})
+	}
+	return resolved
+}
+
+// resolveOtherSex gives the prevalences, and each model's rates by age and
+// sex, explicit rates for the Other sex, chosen by o, where they aren't
+// given. Fertility, which is only given for women, is left as it is.
+func (in *populationInputs) resolveOtherSex(o OtherSexPrevalence) {
+	resolved := make(AllPrevalences, len(in.allPrevalences))
+	for d, p := range in.allPrevalences {
+		p.ByAge = p.ByAge.WithOtherSex(o)
+		resolved[d] = p
+	}
+	in.allPrevalences = resolved
+	if in.admissions != nil {
+		for _, t := range AdmissionTypes() {
+			rates := in.admissions.Rates(t)
+			rates.ByAge = rates.ByAge.WithOtherSex(o)
+		}
+	}
+	if in.smoking != nil {
+		in.smoking.Current = in.smoking.Current.WithOtherSex(o)
+		in.smoking.Former = in.smoking.Former.WithOtherSex(o)
+	}
+	if in.bmi != nil {
+		in.bmi.Obese = in.bmi.Obese.WithOtherSex(o)
+	}
+	if in.measurements != nil {
+		for _, d := range in.measurements.Measurements {
+			d.Controlled = d.Controlled.WithOtherSex(o)
+		}
+	}
+	if in.segments != nil {
+		in.segments.Frail = in.segments.Frail.WithOtherSex(o)
+		in.segments.EndOfLife = in.segments.EndOfLife.WithOtherSex(o)
+	}
+	if in.incidence != nil {
+		for c, a := range in.incidence.ByCondition {
+			in.incidence.ByCondition[c] = a.WithOtherSex(o)
+		}
+	}
+	if in.detection != nil {
+		in.detection.Detected = in.detection.Detected.WithOtherSex(o)
+	}
+	if in.projection != nil {
+		in.projection.Mortality = in.projection.Mortality.WithOtherSex(o)
+		in.projection.Migration = in.projection.Migration.WithOtherSex(o)
+	}
+}
+
+// AllSexes returns every sex, in order.
+func AllSexes() []Sex {
+	return []Sex{Male, Female, Other}
+}
+
+// sexesOf returns the sexes of people, being Male and Female, and Other
+// only when there are people to whom it applies, so that outputs by sex
+// don't gain empty rows for it.
+func sexesOf(people []Person) []Sex {
+	for i := range people {
+		if people[i].Sex == Other {
+			return AllSexes()
+		}
+	}
+	return []Sex{Male, Female}
+}
+
+// countOtherSex returns the number of residents of the LSOAs in homes who
+// aren't accounted for by their male and female populations, and so are
+// simulated as the Other sex.
+func countOtherSex(homes LSOASet, lsoas map[LSOACode]*LSOA, o OtherSexPrevalence) int {
+	other := 0
+	for home := range homes {
+		if lsoa, ok := lsoas[home]; ok {
+			if n := sum(lsoa.PersonsByAge) - sum(lsoa.MalesByAge) - sum(lsoa.FemalesByAge); n > 0 {
+				other += n
+			}
+		}
+	}
+	if other > 0 {
+		log.Printf("other sex: %d people, using %s prevalence where not given", other, o)
+	}
+	return other
+}
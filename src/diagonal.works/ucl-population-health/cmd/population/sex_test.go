@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAgePrevalencesWithOtherSex(t *testing.T) {
+	a := AgePrevalences{
+		{{Ages: AgeRange{Begin: 0, End: 40}, Prevalence: 0.1}, {Ages: AgeRange{Begin: 40}, Prevalence: 0.3}},
+		{{Ages: AgeRange{Begin: 0, End: 50}, Prevalence: 0.2}, {Ages: AgeRange{Begin: 50}, Prevalence: 0.5}},
+	}
+	tests := []struct {
+		o        OtherSexPrevalence
+		expected []float64
+	}{
+		// Ranges are split at 40 and 50, where either rate changes
+		{OtherSexPrevalenceAverage, []float64{0.15, 0.25, 0.4}},
+		{OtherSexPrevalenceMale, []float64{0.1, 0.3, 0.3}},
+		{OtherSexPrevalenceFemale, []float64{0.2, 0.2, 0.5}},
+	}
+	for _, test := range tests {
+		resolved := a.WithOtherSex(test.o)
+		if len(resolved) != 3 || len(resolved[Other]) != len(test.expected) {
+			t.Errorf("%s: expected %d ranges for the other sex, found %v", test.o, len(test.expected), resolved)
+			continue
+		}
+		for i, r := range resolved[Other] {
+			if math.Abs(r.Prevalence-test.expected[i]) > 1e-9 {
+				t.Errorf("%s: expected %f for %v, found %f", test.o, test.expected[i], r.Ages, r.Prevalence)
+			}
+		}
+		if !reflect.DeepEqual(resolved[:2], a) {
+			t.Errorf("%s: expected male and female rates to be unchanged", test.o)
+		}
+		if p := resolved.Prevalence(Other, 45); math.Abs(p-test.expected[1]) > 1e-9 {
+			t.Errorf("%s: expected %f at 45, found %f", test.o, test.expected[1], p)
+		}
+	}
+	if len(a) != 2 {
+		t.Errorf("expected the original prevalences to be unchanged")
+	}
+
+	explicit := append(AgePrevalences{}, a...)
+	explicit = append(explicit, []AgePrevalence{{Ages: AgeRange{Begin: 0}, Prevalence: 0.9}})
+	if resolved := explicit.WithOtherSex(OtherSexPrevalenceMale); !reflect.DeepEqual(resolved, explicit) {
+		t.Errorf("expected explicit rates for the other sex to be kept, found %v", resolved)
+	}
+	if resolved := (AgePrevalences{}).WithOtherSex(OtherSexPrevalenceMale); len(resolved) != 0 {
+		t.Errorf("expected no rates from none, found %v", resolved)
+	}
+}
+
+func TestSexesOf(t *testing.T) {
+	tests := []struct {
+		people   []Person
+		expected []Sex
+	}{
+		{[]Person{{Sex: Male}, {Sex: Female}}, []Sex{Male, Female}},
+		{[]Person{{Sex: Female}, {Sex: Other}}, []Sex{Male, Female, Other}},
+		{nil, []Sex{Male, Female}},
+	}
+	for _, test := range tests {
+		if sexes := sexesOf(test.people); !reflect.DeepEqual(sexes, test.expected) {
+			t.Errorf("expected %v, found %v", test.expected, sexes)
+		}
+	}
+}
+
+func TestCountOtherSex(t *testing.T) {
+	lsoas := map[LSOACode]*LSOA{
+		"E01000001": {PersonsByAge: []int{10, 10}, MalesByAge: []int{5, 5}, FemalesByAge: []int{5, 4}},
+		"E01000002": {PersonsByAge: []int{10}, MalesByAge: []int{5}, FemalesByAge: []int{5}},
+	}
+	if n := countOtherSex(LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}}, lsoas, OtherSexPrevalenceAverage); n != 1 {
+		t.Errorf("expected 1 person of the other sex, found %d", n)
+	}
+	if n := countOtherSex(LSOASet{"E01000002": struct{}{}}, lsoas, OtherSexPrevalenceAverage); n != 0 {
+		t.Errorf("expected no people of the other sex, found %d", n)
+	}
+}
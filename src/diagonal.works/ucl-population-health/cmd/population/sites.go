@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/golang/geo/s2"
+)
+
+// The site types from the estates return that admit the demand estimated
+// by the admission model. Specialist hospitals are excluded, since their
+// patients aren't drawn from the nearest population.
+var SiteCapacityAdmittingTypes = []string{"General acute hospital", "Mixed service hospital"}
+
+// SiteDemand is the admission demand of the ICB's residents at a site,
+// from assigning each resident to their nearest admitting site.
+type SiteDemand struct {
+	Site   ODSCode
+	People int
+	// Expected admissions per year, by AdmissionType
+	Admissions [AdmissionTypeLast + 1]float64
+	// Expected bed days per year, from the length of stay of each
+	// admission type
+	BedDays float64
+}
+
+// Occupancy returns the share of the site's bed days per year taken by
+// the demand, or NaN if the site's beds aren't known.
+func (d *SiteDemand) Occupancy(site *Site) float64 {
+	if site.Beds > 0 {
+		return d.BedDays / (float64(site.Beds) * 365.0)
+	}
+	return math.NaN()
+}
+
+func (d *SiteDemand) TotalAdmissions() float64 {
+	total := 0.0
+	for _, a := range d.Admissions {
+		total += a
+	}
+	return total
+}
+
+// admittingSites returns the sites with a location, and an estates return
+// with an admitting site type, ordered by code.
+func admittingSites(sites map[ODSCode]*Site) []ODSCode {
+	types := make(map[string]struct{})
+	for _, t := range SiteCapacityAdmittingTypes {
+		types[t] = struct{}{}
+	}
+	admitting := make([]ODSCode, 0)
+	for code, site := range sites {
+		if _, ok := types[site.Type]; ok && site.Location != (s2.Point{}) {
+			admitting = append(admitting, code)
+		}
+	}
+	sort.Slice(admitting, func(i, j int) bool { return admitting[i] < admitting[j] })
+	return admitting
+}
+
+// estimateSiteDemand assigns the expected admissions of each person living
+// in homes to the admitting site nearest the centre of their LSOA, ordered
+// by site code. The demand at each site is only that of the ICB's
+// residents, not the site's whole catchment.
+func estimateSiteDemand(people []Person, homes LSOASet, lsoas map[LSOACode]*LSOA, sites map[ODSCode]*Site, model *AdmissionModel) []*SiteDemand {
+	admitting := admittingSites(sites)
+	if len(admitting) == 0 {
+		Warningf("  site capacity: no admitting sites")
+		return nil
+	}
+	nearest := make(map[LSOACode]ODSCode)
+	for code := range homes {
+		if lsoa, ok := lsoas[code]; ok {
+			nearest[code], _ = nearestSite(lsoa.Center, admitting, sites)
+		}
+	}
+	bySite := make(map[ODSCode]*SiteDemand)
+	for i := range people {
+		p := &people[i]
+		code, ok := nearest[p.Home]
+		if !ok {
+			continue
+		}
+		d, ok := bySite[code]
+		if !ok {
+			d = &SiteDemand{Site: code}
+			bySite[code] = d
+		}
+		d.People++
+		for _, t := range AdmissionTypes() {
+			d.Admissions[t] += p.Admissions.Expected[t]
+			d.BedDays += p.Admissions.Expected[t] * model.Rates(t).LengthOfStay
+		}
+	}
+	demand := make([]*SiteDemand, 0, len(bySite))
+	for _, d := range bySite {
+		demand = append(demand, d)
+	}
+	sort.Slice(demand, func(i, j int) bool { return demand[i].Site < demand[j].Site })
+	for _, d := range demand {
+		log.Printf("  %s: %s: people: %d admissions: %.0f bed days: %.0f", d.Site, sites[d.Site].Name, d.People, d.TotalAdmissions(), d.BedDays)
+	}
+	return demand
+}
+
+// writeSites writes sites.csv, with the capacity of each site found in the
+// estates return, ordered by code.
+func writeSites(sites map[ODSCode]*Site, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "sites.csv"))
+	if err != nil {
+		return err
+	}
+	codes := make([]ODSCode, 0, len(sites))
+	for code, site := range sites {
+		if site.Estates {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	w := csv.NewWriter(f)
+	w.Write([]string{"code", "name", "type", "postcode", "floor_area_m2", "single_bedrooms", "beds", "theatres"})
+	for _, code := range codes {
+		site := sites[code]
+		w.Write([]string{
+			string(code),
+			site.Name,
+			site.Type,
+			site.Postcode,
+			fmt.Sprintf("%.0f", site.FloorAreaM2),
+			strconv.Itoa(site.SingleBedrooms),
+			strconv.Itoa(site.Beds),
+			strconv.Itoa(site.Theatres),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSiteCapacity writes site-capacity.csv, comparing the admission
+// demand of the ICB's residents at each admitting site with its capacity.
+// Occupancy is empty for sites whose beds aren't known.
+func writeSiteCapacity(demand []*SiteDemand, sites map[ODSCode]*Site, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "site-capacity.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"scenario", "site", "name", "type", "people"}
+	for _, t := range AdmissionTypes() {
+		header = append(header, fmt.Sprintf("expected_%s_admissions", t))
+	}
+	header = append(header, "expected_bed_days", "floor_area_m2", "single_bedrooms", "beds", "theatres", "bed_occupancy", "admissions_per_1000_m2")
+	w.Write(header)
+	for _, d := range demand {
+		site := sites[d.Site]
+		row := []string{scenario, string(d.Site), site.Name, site.Type, strconv.Itoa(d.People)}
+		for _, t := range AdmissionTypes() {
+			row = append(row, fmt.Sprintf("%f", d.Admissions[t]))
+		}
+		occupancy := ""
+		if o := d.Occupancy(site); !math.IsNaN(o) {
+			occupancy = fmt.Sprintf("%f", o)
+		}
+		density := ""
+		if site.FloorAreaM2 > 0.0 {
+			density = fmt.Sprintf("%f", d.TotalAdmissions()/site.FloorAreaM2*1000.0)
+		}
+		row = append(row,
+			fmt.Sprintf("%f", d.BedDays),
+			fmt.Sprintf("%.0f", site.FloorAreaM2),
+			strconv.Itoa(site.SingleBedrooms),
+			strconv.Itoa(site.Beds),
+			strconv.Itoa(site.Theatres),
+			occupancy,
+			density,
+		)
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type SmokingStatus int
+
+const (
+	// Smoking status wasn't simulated
+	SmokingStatusUnknown SmokingStatus = iota
+	SmokingStatusNever
+	SmokingStatusFormer
+	SmokingStatusCurrent
+)
+
+func (s SmokingStatus) String() string {
+	switch s {
+	case SmokingStatusNever:
+		return "never"
+	case SmokingStatusFormer:
+		return "former"
+	case SmokingStatusCurrent:
+		return "current"
+	}
+	return "unknown"
+}
+
+func SmokingStatusFromString(s string) SmokingStatus {
+	for _, status := range []SmokingStatus{SmokingStatusNever, SmokingStatusFormer, SmokingStatusCurrent} {
+		if status.String() == s {
+			return status
+		}
+	}
+	return SmokingStatusUnknown
+}
+
+const (
+	// Columns of the OHID Fingertips export of the indicator "Smoking
+	// prevalence in adults (15+) (QOF)", by GP practice
+	FingertipsAreaCodeColumn = "Area Code"
+	FingertipsAreaTypeColumn = "Area Type"
+	FingertipsValueColumn    = "Value"
+	FingertipsAreaTypeGP     = "GPs"
+
+	// The minimum age included in the QOF smoking indicator
+	QOFSmokingMinAge = 15
+)
+
+type SmokingModel struct {
+	Current AgePrevalences
+	Former  AgePrevalences
+	// Risk of each condition for former and current smokers, relative
+	// to those who have never smoked
+	RelativeRisk map[string]map[string]float64 `yaml:"relativerisk"`
+
+	relativeRisk map[QOFCondition][SmokingStatusCurrent + 1]float64
+}
+
+func readSmokingModel(filename string) (*SmokingModel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open smoking model: %s", err)
+	}
+	defer f.Close()
+	var model SmokingModel
+	if err := yaml.NewDecoder(f).Decode(&model); err != nil {
+		return nil, fmt.Errorf("failed to read smoking model: %s", err)
+	}
+	if len(model.Current) == 0 || len(model.Former) == 0 {
+		return nil, fmt.Errorf("smoking model needs current and former prevalence by age")
+	}
+	model.relativeRisk = make(map[QOFCondition][SmokingStatusCurrent + 1]float64)
+	for c, risks := range model.RelativeRisk {
+		condition := QOFConditionFromString(c)
+		if condition == QOFConditionInvalid {
+			return nil, fmt.Errorf("unknown condition %q in smoking relative risks", c)
+		}
+		rr := [SmokingStatusCurrent + 1]float64{1.0, 1.0, 1.0, 1.0}
+		for s, r := range risks {
+			status := SmokingStatusFromString(s)
+			if status == SmokingStatusUnknown {
+				return nil, fmt.Errorf("unknown smoking status %q in %s relative risks", s, c)
+			}
+			rr[status] = r
+		}
+		model.relativeRisk[condition] = rr
+	}
+	return &model, nil
+}
+
+// Risk returns the multiplier applied to a person's prevalence of a
+// condition given their smoking status. Multipliers are normalised by the
+// expected relative risk for the person's age and sex, so the prevalence
+// of the condition across the population is unchanged. A nil model
+// always returns 1.
+func (s *SmokingModel) Risk(p *Person, condition QOFCondition) float64 {
+	if s == nil || p.Smoking == SmokingStatusUnknown {
+		return 1.0
+	}
+	rr, ok := s.relativeRisk[condition]
+	if !ok {
+		return 1.0
+	}
+	current := s.Current.Prevalence(p.Sex, p.Age)
+	former := s.Former.Prevalence(p.Sex, p.Age)
+	expected := (1.0-current-former)*rr[SmokingStatusNever] + former*rr[SmokingStatusFormer] + current*rr[SmokingStatusCurrent]
+	if expected <= 0.0 {
+		return 1.0
+	}
+	return rr[p.Smoking] / expected
+}
+
+// readPracticeSmokingPrevalence reads the prevalence of current smoking
+// for each GP practice from an OHID Fingertips export, see
+// https://fingertips.phe.org.uk/search/smoking%20prevalence%20in%20adults%20(15+)%20(QOF)
+func readPracticeSmokingPrevalence(filename string, gps map[GPPracticeCode]*GPPractice) error {
+	f, err := openMaybeGzipped(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return err
+	}
+	for i, column := range row {
+		columns[strings.TrimSpace(column)] = i
+	}
+	for _, column := range []string{FingertipsAreaCodeColumn, FingertipsAreaTypeColumn, FingertipsValueColumn} {
+		if _, ok := columns[column]; !ok {
+			return fmt.Errorf("%s: no %s column", filename, column)
+		}
+	}
+	matched := 0
+	badValues := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if row[columns[FingertipsAreaTypeColumn]] != FingertipsAreaTypeGP {
+			continue
+		}
+		if gp, ok := gps[GPPracticeCode(row[columns[FingertipsAreaCodeColumn]])]; ok {
+			if v, err := parseFloat(row[columns[FingertipsValueColumn]]); err == nil {
+				gp.SmokingPrevalence = v / 100.0
+				matched++
+			} else {
+				badValues++
+			}
+		}
+	}
+	log.Printf("practice smoking prevalence: matched: %d bad values: %d", matched, badValues)
+	return nil
+}
+
+// assignSmokingStatus samples a smoking status for each person, from the
+// national prevalence for their age and sex. If their practice reported
+// a prevalence of current smoking, the probability of current smoking is
+// scaled so the simulated prevalence among the practice's patients
+// matches.
+func assignSmokingStatus(byPractice map[GPPracticeCode][]*Person, model *SmokingModel, gps map[GPPracticeCode]*GPPractice) {
+	counts := make(map[SmokingStatus]int)
+	scaled := 0
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	for code, people := range byPractice {
+		scale := 1.0
+		if gp, ok := gps[code]; ok && gp.SmokingPrevalence > 0.0 {
+			expected := 0.0
+			n := 0
+			for _, p := range people {
+				if p.Age >= QOFSmokingMinAge {
+					expected += model.Current.Prevalence(p.Sex, p.Age)
+					n++
+				}
+			}
+			if expected > 0.0 {
+				scale = gp.SmokingPrevalence * float64(n) / expected
+				scaled++
+			}
+		}
+		for _, p := range people {
+			current := clamp(model.Current.Prevalence(p.Sex, p.Age)*scale, 0.0, 1.0)
+			former := clamp(model.Former.Prevalence(p.Sex, p.Age), 0.0, 1.0-current)
+			u := rng.Float64()
+			if u < current {
+				p.Smoking = SmokingStatusCurrent
+			} else if u < current+former {
+				p.Smoking = SmokingStatusFormer
+			} else {
+				p.Smoking = SmokingStatusNever
+			}
+			counts[p.Smoking]++
+		}
+	}
+	log.Printf("  practices scaled to reported prevalence: %d", scaled)
+	for _, status := range []SmokingStatus{SmokingStatusNever, SmokingStatusFormer, SmokingStatusCurrent} {
+		log.Printf("  %s: %d", status, counts[status])
+	}
+}
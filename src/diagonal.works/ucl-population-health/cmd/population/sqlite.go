@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Increment when the schema changes in a way that would break existing
+// queries
+const SQLiteSchemaVersion = 2
+
+// The database written within the output directory by --format=sqlite,
+// unless --sqlite gives another
+const SQLiteDefaultFilename = "population.sqlite"
+
+var sqliteSchema = []string{
+	`CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT NOT NULL)`,
+	`CREATE TABLE conditions (bit INTEGER PRIMARY KEY, name TEXT NOT NULL)`,
+	`CREATE TABLE practices (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		icb TEXT NOT NULL,
+		postcode TEXT NOT NULL,
+		lsoa TEXT NOT NULL,
+		list_size INTEGER NOT NULL,
+		simulated_list_size INTEGER NOT NULL,
+		appointments INTEGER NOT NULL,
+		practioners INTEGER NOT NULL
+	)`,
+	`CREATE TABLE practice_conditions (
+		practice TEXT NOT NULL REFERENCES practices(code),
+		condition TEXT NOT NULL,
+		reported_prevalence REAL,
+		prevalence REAL NOT NULL,
+		bias REAL NOT NULL,
+		simulated_register INTEGER NOT NULL,
+		PRIMARY KEY (practice, condition)
+	)`,
+	`CREATE TABLE msoas (code TEXT PRIMARY KEY, name TEXT NOT NULL)`,
+	`CREATE TABLE lsoas (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		msoa TEXT NOT NULL,
+		imd REAL NOT NULL,
+		imd_decile INTEGER NOT NULL,
+		population INTEGER NOT NULL
+	)`,
+	`CREATE TABLE breakdowns (
+		population TEXT NOT NULL,
+		breakdown TEXT NOT NULL,
+		value TEXT NOT NULL,
+		conditions INTEGER NOT NULL,
+		people INTEGER NOT NULL
+	)`,
+	`CREATE INDEX breakdowns_breakdown_value ON breakdowns (population, breakdown, value)`,
+}
+
+// SQLiteOutput holds everything written to the SQLite database
+type SQLiteOutput struct {
+	Scenario   string
+	Profile    *OutputProfile
+	People     PersonStream
+	Columns    []PersonColumn
+	Practices  []*GPPractice
+	GPs        map[GPPracticeCode]*GPPractice
+	LSOAs      map[LSOACode]*LSOA
+	MSOAs      map[MSOACode]*MSOA
+	Conditions []QOFCondition
+	Aggregates []*AggregationResult
+	Provenance *Provenance
+}
+
+func peopleSchema(columns []PersonColumn) []string {
+	definitions := make([]string, 0, len(columns)+1)
+	home := ""
+	for _, c := range columns {
+		t := c.SQLType
+		if t == "" {
+			t = "TEXT"
+		}
+		if c.Name == "id" {
+			t += " PRIMARY KEY"
+		}
+		definitions = append(definitions, fmt.Sprintf("%s %s", c.Name, t))
+		if c.Kind == PersonColumnHome {
+			home = c.Name
+		}
+	}
+	definitions = append(definitions, "conditions INTEGER NOT NULL")
+	schema := []string{
+		fmt.Sprintf("CREATE TABLE people (%s)", strings.Join(definitions, ", ")),
+		"CREATE INDEX people_gp ON people (gp)",
+		"CREATE INDEX people_conditions ON people (conditions)",
+	}
+	if home != "" {
+		schema = append(schema, fmt.Sprintf("CREATE INDEX people_%s ON people (%s)", home, home))
+	}
+	return schema
+}
+
+func insert(tx *sql.Tx, table string, columns int, rows func(insert func(values ...interface{}) error) error) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", columns), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, placeholders))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return rows(func(values ...interface{}) error {
+		_, err := stmt.Exec(values...)
+		return err
+	})
+}
+
+// writeSQLite writes people, practices, LSOAs, MSOAs and aggregate
+// breakdowns into a single SQLite database, replacing any existing file.
+func writeSQLite(filename string, output *SQLiteOutput) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fillSQLite(tx, output); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func fillSQLite(tx *sql.Tx, output *SQLiteOutput) error {
+	for _, statement := range append(sqliteSchema, peopleSchema(output.Columns)...) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("%s: %s", statement, err)
+		}
+	}
+
+	err := insert(tx, "metadata", 2, func(insert func(values ...interface{}) error) error {
+		metadata := [][2]string{
+			{"schema_version", fmt.Sprintf("%d", SQLiteSchemaVersion)},
+			{"scenario", output.Scenario},
+			{"profile", output.Profile.Name},
+		}
+		metadata = append(metadata, output.Provenance.Fields()...)
+		for _, m := range metadata {
+			if err := insert(m[0], m[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "conditions", 2, func(insert func(values ...interface{}) error) error {
+		for _, condition := range AllQOFConditions() {
+			if err := insert(int(condition), condition.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "people", len(output.Columns)+1, func(insert func(values ...interface{}) error) error {
+		values := make([]interface{}, len(output.Columns)+1)
+		return output.People(func(p *Person) error {
+			for j, c := range output.Columns {
+				values[j] = c.Value(p)
+			}
+			values[len(output.Columns)] = int(p.Conditions.ToUint32())
+			return insert(values...)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "practices", 9, func(insert func(values ...interface{}) error) error {
+		for _, gp := range output.Practices {
+			if err := insert(gp.Code.String(), gp.Name, string(gp.ICB), gp.Postcode, gp.LSOA.String(), gp.ListSize, gp.SimulatedListSize, gp.Appointments, gp.Practioners); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "practice_conditions", 6, func(insert func(values ...interface{}) error) error {
+		for _, gp := range output.Practices {
+			for _, condition := range output.Conditions {
+				var reported sql.NullFloat64
+				reported.Float64, reported.Valid = gp.ReportedConditionPrevalence[condition]
+				if err := insert(gp.Code.String(), condition.String(), reported, gp.ConditionPrevalence[condition], gp.ConditionBias[condition], gp.SimulatedConditionCounts[condition]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "msoas", 2, func(insert func(values ...interface{}) error) error {
+		for code, msoa := range output.MSOAs {
+			if err := insert(code.String(), msoa.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = insert(tx, "lsoas", 6, func(insert func(values ...interface{}) error) error {
+		for code, lsoa := range output.LSOAs {
+			population := 0
+			for _, count := range lsoa.PersonsByAge {
+				population += count
+			}
+			if err := insert(code.String(), lsoa.Name, lsoa.MSOACode.String(), lsoa.IMD, lsoa.IMDDecile, population); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return insert(tx, "breakdowns", 5, func(insert func(values ...interface{}) error) error {
+		for _, result := range output.Aggregates {
+			for _, a := range result.Aggregates {
+				for _, g := range a.Groups {
+					for index, count := range g.Counts {
+						if count > 0 {
+							if err := insert(result.Population.String(), a.Key, g.Value, index, count); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// sqliteExporter writes the database once it has been given the people,
+// practices and aggregates, since its schema is fixed by
+// SQLiteSchemaVersion, and richer than the tables of other formats.
+type sqliteExporter struct {
+	data   *ExportData
+	output SQLiteOutput
+}
+
+func (s *sqliteExporter) People(columns []PersonColumn, people PersonStream) error {
+	s.output.Columns = columns
+	s.output.People = people
+	return nil
+}
+
+func (s *sqliteExporter) Practices(practices []*GPPractice, table *ExportTable) error {
+	s.output.Practices = practices
+	return nil
+}
+
+func (s *sqliteExporter) Aggregates(results []*AggregationResult, table *ExportTable) error {
+	s.output.Aggregates = results
+	return nil
+}
+
+func (s *sqliteExporter) Close() error {
+	if s.output.People == nil {
+		// Abandoned before being given the people
+		return nil
+	}
+	s.output.Scenario = s.data.Scenario
+	s.output.Profile = s.data.Profile
+	s.output.GPs = s.data.GPs
+	s.output.LSOAs = s.data.LSOAs
+	s.output.MSOAs = s.data.MSOAs
+	s.output.Conditions = s.data.Conditions
+	s.output.Provenance = s.data.Provenance
+	filename := s.data.SQLiteFilename
+	if filename == "" {
+		filename = filepath.Join(s.data.OutputDirectory, SQLiteDefaultFilename)
+	}
+	return writeSQLite(filename, &s.output)
+}
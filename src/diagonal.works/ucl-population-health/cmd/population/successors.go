@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	GPPracticeSuccessorsPredecessorCodeColumn = 0
+	GPPracticeSuccessorsSuccessorCodeColumn   = 1
+	GPPracticeSuccessorsEffectiveDateColumn   = 3
+)
+
+// GPPracticeSuccessors maps the codes of practices that closed or merged
+// onto those of the practices that succeeded them, from the ODS successor
+// organisations file, so that data published against a predecessor's code
+// can be joined to the current practice.
+type GPPracticeSuccessors map[GPPracticeCode]GPPracticeCode
+
+// Current returns code, if it's an active practice in gps, or otherwise
+// the first active practice in gps reached by following its successors,
+// and their successors in turn. Codes without an active successor are
+// returned unchanged.
+func (s GPPracticeSuccessors) Current(code GPPracticeCode, gps map[GPPracticeCode]*GPPractice) GPPracticeCode {
+	current := code
+	for i := 0; i <= len(s); i++ {
+		if gp, ok := gps[current]; ok && gp.Status == GPPracticeStatusActive {
+			return current
+		}
+		successor, ok := s[current]
+		if !ok {
+			break
+		}
+		current = successor
+	}
+	return code
+}
+
+// readGPPracticeSuccessors reads the successor of each practice from the
+// ODS successor organisations file, succ.csv, optionally gzipped, taking
+// the most recent where a practice has more than one, as when it was
+// split. The file is optional, since it's only needed to remap old codes,
+// and if it isn't there, no codes are remapped.
+func readGPPracticeSuccessors(dataset *Dataset) (GPPracticeSuccessors, error) {
+	r, err := openDataset(dataset)
+	if os.IsNotExist(err) {
+		log.Printf("  no practice successors in %s, so old practice codes won't be remapped", dataset.Filename)
+		return GPPracticeSuccessors{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	successors := make(GPPracticeSuccessors)
+	effective := make(map[GPPracticeCode]string)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		predecessor := GPPracticeCode(strings.TrimSpace(row[dataset.Index("predecessor-code")]))
+		successor := GPPracticeCode(strings.TrimSpace(row[dataset.Index("successor-code")]))
+		if predecessor == "" || successor == "" || predecessor == successor {
+			continue
+		}
+		// Effective dates are YYYYMMDD, so compare in order as strings
+		date := strings.TrimSpace(row[dataset.Index("effective-date")])
+		if _, ok := successors[predecessor]; !ok || date >= effective[predecessor] {
+			successors[predecessor] = successor
+			effective[predecessor] = date
+		}
+	}
+	log.Printf("  practice successors: %d", len(successors))
+	return successors, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PopulationEstimatesLADCodeColumn = "ladcode23"
+	PopulationEstimatesSexColumn     = "sex"
+	PopulationEstimatesAgeColumn     = "age"
+	// Followed by the year, eg population_2023
+	PopulationEstimatesPopulationPrefix = "population_"
+
+	LSOAPopulationEstimatesLSOACodeColumn = "LSOA 2021 Code"
+	LSOAPopulationEstimatesTotalColumn    = "Total"
+)
+
+// The bounds on reweighting towards a target year: the maximum number of
+// passes over the targets, and the largest relative change to a cell in a
+// pass at which reweighting is considered converged.
+const (
+	ReweightIterations = 50
+	ReweightTolerance  = 1e-4
+)
+
+// LAD23Successors gives the 2023 local authority district of each 2022
+// district abolished in the reorganisation of April 2023, when the
+// districts of Cumbria, North Yorkshire and Somerset were merged into
+// unitary authorities. The LSOA lookup gives 2022 districts (LAD22CD),
+// while the mid-year estimates from 2023 give the current ones
+// (ladcode23).
+var LAD23Successors = map[string]string{
+	// Cumberland
+	"E07000026": "E06000063",
+	"E07000028": "E06000063",
+	"E07000029": "E06000063",
+	// Westmorland and Furness
+	"E07000027": "E06000064",
+	"E07000030": "E06000064",
+	"E07000031": "E06000064",
+	// North Yorkshire
+	"E07000163": "E06000065",
+	"E07000164": "E06000065",
+	"E07000165": "E06000065",
+	"E07000166": "E06000065",
+	"E07000167": "E06000065",
+	"E07000168": "E06000065",
+	"E07000169": "E06000065",
+	// Somerset
+	"E07000187": "E06000066",
+	"E07000188": "E06000066",
+	"E07000189": "E06000066",
+	"E07000246": "E06000066",
+}
+
+// normaliseLADCode returns the 2023 local authority district that
+// includes the district with the given code, from 2022 or 2023, so that
+// datasets keyed by either can be joined.
+func normaliseLADCode(code string) string {
+	code = strings.TrimSpace(code)
+	if successor, ok := LAD23Successors[code]; ok {
+		return successor
+	}
+	return code
+}
+
+// PopulationTargets are the mid-year estimates of the population of a
+// target year, to which the LSOA counts of the census snapshot are
+// reweighted.
+type PopulationTargets struct {
+	Year int
+	// Population by 2023 local authority code, as normalised by
+	// normaliseLADCode, indexed by sex, male or female, then single year of
+	// age, with the last age including all older
+	ByAuthority map[string]*[Female + 1][]float64
+	// If set, the total population of each LSOA, for the same year
+	ByLSOA map[LSOACode]float64
+}
+
+func (p *PopulationTargets) Total() float64 {
+	total := 0.0
+	for _, bySex := range p.ByAuthority {
+		for _, byAge := range bySex {
+			for _, n := range byAge {
+				total += n
+			}
+		}
+	}
+	return total
+}
+
+func populationEstimatesSex(s string) (Sex, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "1", "M", "MALE":
+		return Male, true
+	case "2", "F", "FEMALE":
+		return Female, true
+	}
+	return Other, false
+}
+
+// readPopulationTargets reads the ONS mid-year estimates by local
+// authority, single year of age and sex, in long form, with one column of
+// population for each year.
+func readPopulationTargets(dataset *Dataset, year int) (*PopulationTargets, error) {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range row {
+		columns[strings.TrimSpace(column)] = i
+	}
+	for _, column := range []string{"lad-code", "sex", "age"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return nil, fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+	populationColumn := dataset.Column("population-prefix") + strconv.Itoa(year)
+	population, ok := columns[populationColumn]
+	if !ok {
+		return nil, fmt.Errorf("%s: no %s column, for estimates in %d", dataset.Filename, populationColumn, year)
+	}
+
+	targets := &PopulationTargets{Year: year, ByAuthority: make(map[string]*[Female + 1][]float64)}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		sex, ok := populationEstimatesSex(row[columns[dataset.Column("sex")]])
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown sex %q", dataset.Filename, row[columns[dataset.Column("sex")]])
+		}
+		age, err := strconv.Atoi(strings.TrimRight(row[columns[dataset.Column("age")]], "+"))
+		if err != nil || age < 0 {
+			return nil, fmt.Errorf("%s: bad age %q", dataset.Filename, row[columns[dataset.Column("age")]])
+		} else if age > LSOADataMaxAge {
+			age = LSOADataMaxAge
+		}
+		n, err := strconv.ParseFloat(strings.ReplaceAll(row[population], ",", ""), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad population %q", dataset.Filename, row[population])
+		}
+		code := normaliseLADCode(row[columns[dataset.Column("lad-code")]])
+		authority, ok := targets.ByAuthority[code]
+		if !ok {
+			authority = &[Female + 1][]float64{make([]float64, LSOADataMaxAge+1), make([]float64, LSOADataMaxAge+1)}
+			targets.ByAuthority[code] = authority
+		}
+		authority[sex][age] += n
+	}
+	log.Printf("  population estimates: %d: %d local authorities: %.0f people", year, len(targets.ByAuthority), targets.Total())
+	return targets, nil
+}
+
+// readLSOAPopulationTargets reads the total population of each LSOA in the
+// target year. The LSOAs are expected to be those of the census geography,
+// since the estimates follow the most recent census.
+func readLSOAPopulationTargets(dataset *Dataset, targets *PopulationTargets) error {
+	r, err := openDataset(dataset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	columns := make(map[string]int)
+	row, err := r.Read()
+	if err != nil {
+		return err
+	}
+	for i, column := range row {
+		columns[strings.TrimSpace(column)] = i
+	}
+	for _, column := range []string{"lsoa-code", "total"} {
+		if _, ok := columns[dataset.Column(column)]; !ok {
+			return fmt.Errorf("%s: no %s column", dataset.Filename, dataset.Column(column))
+		}
+	}
+	targets.ByLSOA = make(map[LSOACode]float64)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		total := row[columns[dataset.Column("total")]]
+		n, err := strconv.ParseFloat(strings.ReplaceAll(total, ",", ""), 64)
+		if err != nil {
+			return fmt.Errorf("%s: bad total %q", dataset.Filename, total)
+		}
+		targets.ByLSOA[LSOACode(row[columns[dataset.Column("lsoa-code")]])] = n
+	}
+	log.Printf("  lsoa population estimates: %d lsoas", len(targets.ByLSOA))
+	return nil
+}
+
+// reweightLSOAs scales the male and female counts by age of the LSOAs in
+// homes to match the target year, by iterative proportional fitting. The
+// counts of every LSOA in a local authority containing a home are fitted
+// together to the authority's estimates by sex and age and, if given, to
+// the total of each LSOA, alternately, until the changes within a pass fall
+// below ReweightTolerance. Only the LSOAs in homes are updated, by rounding
+// the fitted counts, keeping the number of people who are neither male nor
+// female from the snapshot.
+func reweightLSOAs(homes LSOASet, lsoas map[LSOACode]*LSOA, authorities map[LSOACode]*LocalAuthority, targets *PopulationTargets) {
+	included := make(map[string]struct{})
+	for home := range homes {
+		authority, ok := authorities[home]
+		if !ok {
+			Warningf("  %s: no local authority, keeping snapshot counts", home)
+			continue
+		}
+		if _, ok := targets.ByAuthority[normaliseLADCode(authority.Code)]; !ok {
+			Warningf("  %s: no estimates for %s (%s), keeping snapshot counts", home, authority.Name, authority.Code)
+			continue
+		}
+		included[normaliseLADCode(authority.Code)] = struct{}{}
+	}
+
+	// Keyed by the normalised code, so that the LSOAs of 2022 districts
+	// merged in 2023 are fitted together, to the estimates of the merged
+	// authority
+	byAuthority := make(map[string][]LSOACode)
+	cells := make(map[LSOACode]*[Female + 1][]float64)
+	for code, authority := range authorities {
+		if _, ok := included[normaliseLADCode(authority.Code)]; !ok {
+			continue
+		}
+		lsoa, ok := lsoas[code]
+		if !ok {
+			continue
+		}
+		c := &[Female + 1][]float64{make([]float64, LSOADataMaxAge+1), make([]float64, LSOADataMaxAge+1)}
+		for age := 0; age <= LSOADataMaxAge; age++ {
+			c[Male][age] = float64(lsoa.MalesByAge[age])
+			c[Female][age] = float64(lsoa.FemalesByAge[age])
+		}
+		cells[code] = c
+		lad := normaliseLADCode(authority.Code)
+		byAuthority[lad] = append(byAuthority[lad], code)
+	}
+	// Ordered, so that the fitted counts don't depend on map iteration
+	for _, codes := range byAuthority {
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	}
+
+	for code, codes := range byAuthority {
+		for _, sex := range []Sex{Male, Female} {
+			for age := 0; age <= LSOADataMaxAge; age++ {
+				total := 0.0
+				for _, lsoa := range codes {
+					total += cells[lsoa][sex][age]
+				}
+				if total == 0.0 && targets.ByAuthority[code][sex][age] > 0.0 {
+					Warningf("  %s: nobody of sex %s aged %d in the snapshot, so none in %d", code, sex, age, targets.Year)
+				}
+			}
+		}
+	}
+
+	iterations := 0
+	for iterations < ReweightIterations {
+		iterations++
+		change := 0.0
+		for code, codes := range byAuthority {
+			for _, sex := range []Sex{Male, Female} {
+				for age := 0; age <= LSOADataMaxAge; age++ {
+					total := 0.0
+					for _, lsoa := range codes {
+						total += cells[lsoa][sex][age]
+					}
+					if total > 0.0 {
+						factor := targets.ByAuthority[code][sex][age] / total
+						change = math.Max(change, math.Abs(factor-1.0))
+						for _, lsoa := range codes {
+							cells[lsoa][sex][age] *= factor
+						}
+					}
+				}
+			}
+		}
+		if targets.ByLSOA != nil {
+			for code, c := range cells {
+				target, ok := targets.ByLSOA[code]
+				if !ok {
+					continue
+				}
+				// People who are neither male nor female aren't reweighted,
+				// so are removed from the LSOA's target
+				lsoa := lsoas[code]
+				target -= float64(sum(lsoa.PersonsByAge) - sum(lsoa.MalesByAge) - sum(lsoa.FemalesByAge))
+				total := 0.0
+				for _, byAge := range c {
+					for _, n := range byAge {
+						total += n
+					}
+				}
+				if total > 0.0 && target > 0.0 {
+					factor := target / total
+					change = math.Max(change, math.Abs(factor-1.0))
+					for _, byAge := range c {
+						for age := range byAge {
+							byAge[age] *= factor
+						}
+					}
+				}
+			}
+		} else {
+			// Without LSOA totals, a single pass matches the estimates
+			break
+		}
+		if change < ReweightTolerance {
+			break
+		}
+	}
+
+	before, after := 0, 0
+	for home := range homes {
+		c, ok := cells[home]
+		if !ok {
+			continue
+		}
+		lsoa := lsoas[home]
+		before += sum(lsoa.PersonsByAge)
+		for age := 0; age <= LSOADataMaxAge; age++ {
+			other := lsoa.PersonsByAge[age] - lsoa.MalesByAge[age] - lsoa.FemalesByAge[age]
+			if other < 0 {
+				other = 0
+			}
+			lsoa.MalesByAge[age] = int(math.Round(c[Male][age]))
+			lsoa.FemalesByAge[age] = int(math.Round(c[Female][age]))
+			lsoa.PersonsByAge[age] = lsoa.MalesByAge[age] + lsoa.FemalesByAge[age] + other
+		}
+		after += sum(lsoa.PersonsByAge)
+	}
+	residual := 0.0
+	for code, codes := range byAuthority {
+		for _, sex := range []Sex{Male, Female} {
+			for age := 0; age <= LSOADataMaxAge; age++ {
+				total := 0.0
+				for _, lsoa := range codes {
+					total += cells[lsoa][sex][age]
+				}
+				residual += math.Abs(total - targets.ByAuthority[code][sex][age])
+			}
+		}
+	}
+	log.Printf("  local authorities: %d iterations: %d", len(byAuthority), iterations)
+	log.Printf("  homes: snapshot: %d %d: %d residual: %.0f", before, targets.Year, after, residual)
+}
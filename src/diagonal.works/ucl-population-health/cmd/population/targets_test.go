@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormaliseLADCode(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		// Harrogate and Selby, merged into North Yorkshire
+		{"E07000165", "E06000065"},
+		{"E07000169", "E06000065"},
+		{"E06000065", "E06000065"},
+		// Camden, unchanged
+		{"E09000007", "E09000007"},
+		{" E09000007 ", "E09000007"},
+	}
+	for _, test := range tests {
+		if code := normaliseLADCode(test.code); code != test.expected {
+			t.Errorf("expected %s for %q, found %s", test.expected, test.code, code)
+		}
+	}
+}
+
+func TestReadPopulationTargetsNormalisesCodes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "myeb1.csv")
+	csv := "ladcode23,sex,age,population_2023\nE07000165,1,40,100\nE07000169,1,40,50\nE06000065,2,90+,\"1,000\"\n"
+	if err := os.WriteFile(filename, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dataset := DefaultDataManifest().Get(DatasetPopulationEstimates)
+	dataset.Filename = filename
+	targets, err := readPopulationTargets(dataset, 2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets.ByAuthority) != 1 {
+		t.Fatalf("expected a single authority, found %d", len(targets.ByAuthority))
+	}
+	yorkshire := targets.ByAuthority["E06000065"]
+	if yorkshire[Male][40] != 150 || yorkshire[Female][LSOADataMaxAge] != 1000 {
+		t.Errorf("expected the rows to be summed into E06000065, found %v and %v", yorkshire[Male][40], yorkshire[Female][LSOADataMaxAge])
+	}
+}
+
+func newUniformLSOA(code LSOACode, n int) *LSOA {
+	l := &LSOA{Code: code, PersonsByAge: make([]int, LSOADataMaxAge+1), MalesByAge: make([]int, LSOADataMaxAge+1), FemalesByAge: make([]int, LSOADataMaxAge+1)}
+	for age := range l.PersonsByAge {
+		l.MalesByAge[age] = n
+		l.FemalesByAge[age] = n
+		l.PersonsByAge[age] = 2 * n
+	}
+	return l
+}
+
+func TestReweightLSOAsAcrossMergedAuthorities(t *testing.T) {
+	lsoas := map[LSOACode]*LSOA{
+		"E01000001": newUniformLSOA("E01000001", 10),
+		"E01000002": newUniformLSOA("E01000002", 30),
+		"E01000003": newUniformLSOA("E01000003", 10),
+	}
+	// 2022 districts, as given by the LSOA lookup, of which the first two
+	// were merged into North Yorkshire
+	authorities := map[LSOACode]*LocalAuthority{
+		"E01000001": {Code: "E07000165", Name: "Harrogate"},
+		"E01000002": {Code: "E07000169", Name: "Selby"},
+		"E01000003": {Code: "E09000007", Name: "Camden"},
+	}
+	targets := &PopulationTargets{Year: 2023, ByAuthority: make(map[string]*[Female + 1][]float64)}
+	for code, n := range map[string]float64{"E06000065": 80, "E08000001": 5} {
+		byAge := &[Female + 1][]float64{make([]float64, LSOADataMaxAge+1), make([]float64, LSOADataMaxAge+1)}
+		for age := 0; age <= LSOADataMaxAge; age++ {
+			byAge[Male][age] = n
+			byAge[Female][age] = n
+		}
+		targets.ByAuthority[code] = byAge
+	}
+	homes := LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}, "E01000003": struct{}{}}
+	reweightLSOAs(homes, lsoas, authorities, targets)
+
+	// The two LSOAs of North Yorkshire are scaled together from 40 to 80,
+	// keeping their relative sizes
+	tests := []struct {
+		code     LSOACode
+		expected int
+	}{
+		{"E01000001", 20},
+		{"E01000002", 60},
+		// Camden has no estimates, so keeps its snapshot counts
+		{"E01000003", 10},
+	}
+	for _, test := range tests {
+		l := lsoas[test.code]
+		if l.MalesByAge[40] != test.expected || l.FemalesByAge[40] != test.expected {
+			t.Errorf("%s: expected %d at 40, found %d and %d", test.code, test.expected, l.MalesByAge[40], l.FemalesByAge[40])
+		}
+		if total := sum(l.PersonsByAge); math.Abs(float64(total-2*test.expected*(LSOADataMaxAge+1))) > 0 {
+			t.Errorf("%s: expected persons to follow the reweighted counts, found %d", test.code, total)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+// StageTiming records the resources used by a stage of the pipeline.
+type StageTiming struct {
+	Stage       string
+	WallSeconds float64
+	// User and system time of the whole process, across every thread, so
+	// it can exceed the wall time of parallel stages
+	CPUSeconds float64
+	// The peak resident memory of the process by the end of the stage.
+	// It never falls, so a stage using more memory than any before it is
+	// the one at which it rises.
+	PeakRSSMB float64
+	// The Go heap in use at the end of the stage
+	HeapMB float64
+}
+
+// Timings records the wall time, CPU time and memory of each stage of a
+// run, for the manifest, so that performance regressions between releases
+// and data updates are visible without external profiling.
+type Timings struct {
+	Stages []StageTiming
+	// If true, log each stage as it completes
+	Log bool
+
+	stage    string
+	start    time.Time
+	cpu      time.Duration
+	runStart time.Time
+	runCPU   time.Duration
+}
+
+func NewTimings(log bool) *Timings {
+	t := &Timings{Log: log, runStart: time.Now()}
+	t.runCPU, _ = resourceUsage()
+	return t
+}
+
+// Start ends the current stage, if any, and begins the next.
+func (t *Timings) Start(stage string) {
+	t.end()
+	t.stage = stage
+	t.start = time.Now()
+	t.cpu, _ = resourceUsage()
+}
+
+func (t *Timings) record(stage string, start time.Time, startCPU time.Duration) {
+	cpu, peakRSS := resourceUsage()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	timing := StageTiming{
+		Stage:       stage,
+		WallSeconds: time.Since(start).Seconds(),
+		CPUSeconds:  (cpu - startCPU).Seconds(),
+		PeakRSSMB:   float64(peakRSS) / (1024.0 * 1024.0),
+		HeapMB:      float64(m.HeapInuse) / (1024.0 * 1024.0),
+	}
+	t.Stages = append(t.Stages, timing)
+	if t.Log {
+		log.Printf("timing: %s: wall: %.1fs cpu: %.1fs peak rss: %.0fMB heap: %.0fMB", timing.Stage, timing.WallSeconds, timing.CPUSeconds, timing.PeakRSSMB, timing.HeapMB)
+	}
+}
+
+func (t *Timings) end() {
+	if t.stage != "" {
+		t.record(t.stage, t.start, t.cpu)
+		t.stage = ""
+	}
+}
+
+// Done ends the current stage, and records the whole run as the stage
+// "total", returning every stage.
+func (t *Timings) Done() []StageTiming {
+	t.end()
+	t.record("total", t.runStart, t.runCPU)
+	return t.Stages
+}
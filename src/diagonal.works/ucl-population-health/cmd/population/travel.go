@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"diagonal.works/b6"
+	"gopkg.in/yaml.v3"
+)
+
+type TravelMode struct {
+	Name       string
+	KgCO2PerKm float64 `yaml:"kgco2perkm"`
+	// Average door to door speed, only needed for travel time estimates
+	SpeedKmh float64 `yaml:"speedkmh"`
+}
+
+type TravelBand struct {
+	MaxDistanceM float64 `yaml:"maxdistancem"` // 0 for no limit
+	Shares       map[string]float64
+}
+
+type TravelAssumptions struct {
+	Circuity float64
+	Modes    []TravelMode
+	Bands    []TravelBand
+}
+
+func (t *TravelAssumptions) Band(d float64) *TravelBand {
+	for i := range t.Bands {
+		if d < t.Bands[i].MaxDistanceM || t.Bands[i].MaxDistanceM == 0 {
+			return &t.Bands[i]
+		}
+	}
+	return &t.Bands[len(t.Bands)-1]
+}
+
+// CheckSpeeds returns an error if any mode is missing a speed
+func (t *TravelAssumptions) CheckSpeeds() error {
+	for _, m := range t.Modes {
+		if m.SpeedKmh <= 0.0 {
+			return fmt.Errorf("no speed for travel mode %q", m.Name)
+		}
+	}
+	return nil
+}
+
+func (t *TravelAssumptions) MaxSpeedKmh() float64 {
+	max := 0.0
+	for _, m := range t.Modes {
+		if m.SpeedKmh > max {
+			max = m.SpeedKmh
+		}
+	}
+	return max
+}
+
+// Minutes returns the expected travel time for a journey with the given
+// straight line distance, averaged over the mode shares for its band.
+func (t *TravelAssumptions) Minutes(d float64) float64 {
+	speeds := make(map[string]float64)
+	for _, m := range t.Modes {
+		speeds[m.Name] = m.SpeedKmh
+	}
+	km := d * t.Circuity / 1000.0
+	minutes := 0.0
+	for mode, share := range t.Band(d).Shares {
+		if speeds[mode] > 0.0 {
+			minutes += share * 60.0 * km / speeds[mode]
+		}
+	}
+	return minutes
+}
+
+func readTravelAssumptions(filename string) (*TravelAssumptions, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open travel assumptions: %s", err)
+	}
+	defer f.Close()
+	var t TravelAssumptions
+	if err := yaml.NewDecoder(f).Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to read travel assumptions: %s", err)
+	}
+	if len(t.Bands) == 0 {
+		return nil, fmt.Errorf("no travel bands in %s", filename)
+	}
+	modes := make(map[string]struct{})
+	for _, m := range t.Modes {
+		modes[m.Name] = struct{}{}
+	}
+	for _, b := range t.Bands {
+		total := 0.0
+		for mode, share := range b.Shares {
+			if _, ok := modes[mode]; !ok {
+				return nil, fmt.Errorf("unknown travel mode %q", mode)
+			}
+			total += share
+		}
+		if total < 0.99 || total > 1.01 {
+			return nil, fmt.Errorf("travel mode shares for band up to %.0fm sum to %f", b.MaxDistanceM, total)
+		}
+	}
+	if t.Circuity <= 0.0 {
+		t.Circuity = 1.0
+	}
+	return &t, nil
+}
+
+type TravelFootprint struct {
+	Patients     int
+	DistanceM    float64 // Total one way distance from patients' homes
+	AnnualVisits float64
+	AnnualKm     map[string]float64
+	AnnualKgCO2  float64
+}
+
+// estimateTravelFootprint estimates the distance travelled by patients to
+// visit the practice each year, and the resulting emissions. We assume each
+// patient makes the practice's average number of face-to-face appointments
+// per registered patient, as a return journey from the centre of their home
+// LSOA.
+func estimateTravelFootprint(gp *GPPractice, people []*Person, lsoas map[LSOACode]*LSOA, assumptions *TravelAssumptions) *TravelFootprint {
+	footprint := &TravelFootprint{Patients: len(people), AnnualKm: make(map[string]float64)}
+	if gp.ListSize == 0 {
+		return footprint
+	}
+	visits := float64(gp.AppointmentsFaceToFace*GPAppointmentsMonthsPerYear) / float64(gp.ListSize)
+	emissions := make(map[string]float64)
+	for _, m := range assumptions.Modes {
+		emissions[m.Name] = m.KgCO2PerKm
+	}
+	for _, p := range people {
+		d := b6.AngleToMeters(lsoas[p.Home].Center.Distance(gp.Location)) * assumptions.Circuity
+		footprint.DistanceM += d
+		footprint.AnnualVisits += visits
+		band := assumptions.Band(d)
+		km := 2.0 * visits * d / 1000.0
+		for mode, share := range band.Shares {
+			footprint.AnnualKm[mode] += km * share
+			footprint.AnnualKgCO2 += km * share * emissions[mode]
+		}
+	}
+	return footprint
+}
+
+func writeTravelFootprints(selected GPPracticeCodeSet, byPractice map[GPPracticeCode][]*Person, gps map[GPPracticeCode]*GPPractice, lsoas map[LSOACode]*LSOA, assumptions *TravelAssumptions, scenario string, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "travel.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"scenario", "code", "name", "patients", "mean_distance_km", "annual_visits", "annual_km"}
+	for _, m := range assumptions.Modes {
+		header = append(header, fmt.Sprintf("annual_km_%s", m.Name))
+	}
+	header = append(header, "annual_kg_co2")
+	w.Write(header)
+
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	totalKm := 0.0
+	totalKgCO2 := 0.0
+	for _, code := range codes {
+		gp := gps[code]
+		footprint := estimateTravelFootprint(gp, byPractice[code], lsoas, assumptions)
+		meanDistance := 0.0
+		if footprint.Patients > 0 {
+			meanDistance = footprint.DistanceM / float64(footprint.Patients) / 1000.0
+		}
+		km := 0.0
+		for _, m := range assumptions.Modes {
+			km += footprint.AnnualKm[m.Name]
+		}
+		row := []string{
+			scenario,
+			code.String(),
+			gp.Name,
+			strconv.Itoa(footprint.Patients),
+			fmt.Sprintf("%f", meanDistance),
+			fmt.Sprintf("%f", footprint.AnnualVisits),
+			fmt.Sprintf("%f", km),
+		}
+		for _, m := range assumptions.Modes {
+			row = append(row, fmt.Sprintf("%f", footprint.AnnualKm[m.Name]))
+		}
+		row = append(row, fmt.Sprintf("%f", footprint.AnnualKgCO2))
+		w.Write(row)
+		totalKm += km
+		totalKgCO2 += footprint.AnnualKgCO2
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	log.Printf("  annual patient travel: %.0fkm %.0fkg co2", totalKm, totalKgCO2)
+	return f.Close()
+}
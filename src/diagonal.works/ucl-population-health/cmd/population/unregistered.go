@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// UnregisteredCount counts the residents of an area, and those of them who
+// couldn't be assigned a GP practice.
+type UnregisteredCount struct {
+	Residents    int
+	Unregistered int
+}
+
+func (u *UnregisteredCount) Percentage() float64 {
+	if u.Residents == 0 {
+		return 0.0
+	}
+	return 100.0 * float64(u.Unregistered) / float64(u.Residents)
+}
+
+func (u *UnregisteredCount) ToRow() []string {
+	return []string{strconv.Itoa(u.Residents), strconv.Itoa(u.Unregistered), fmt.Sprintf("%f", u.Percentage())}
+}
+
+// Unregistered summarises the people living in homes who weren't assigned
+// a GP practice, usually since there were none with a list nearby. They're
+// absent from practice based outputs, like gps.csv and the registered
+// aggregates.
+type Unregistered struct {
+	Total  UnregisteredCount
+	ByLSOA map[LSOACode]*UnregisteredCount
+	Bands  *AgeBands
+	ByAge  []UnregisteredCount
+}
+
+func countUnregistered(people []Person, homes LSOASet, bands *AgeBands) *Unregistered {
+	u := &Unregistered{
+		ByLSOA: make(map[LSOACode]*UnregisteredCount),
+		Bands:  bands,
+		ByAge:  make([]UnregisteredCount, len(bands.Begins)),
+	}
+	for home := range homes {
+		u.ByLSOA[home] = &UnregisteredCount{}
+	}
+	for i := range people {
+		p := &people[i]
+		lsoa, ok := u.ByLSOA[p.Home]
+		if !ok {
+			continue
+		}
+		for _, c := range []*UnregisteredCount{&u.Total, lsoa, &u.ByAge[bands.Band(p.Age)]} {
+			c.Residents++
+			if p.GP == GPPracticeCodeInvalid {
+				c.Unregistered++
+			}
+		}
+	}
+	log.Printf("unregistered:")
+	log.Printf("  residents: %d unregistered: %d (%.02f%%)", u.Total.Residents, u.Total.Unregistered, u.Total.Percentage())
+	return u
+}
+
+// WriteLSOACSV writes unregistered-lsoa.csv, with a row for every LSOA in
+// the ICB.
+func (u *Unregistered) WriteLSOACSV(lsoas map[LSOACode]*LSOA, msoas map[MSOACode]*MSOA, outputDirectory string) error {
+	codes := make([]LSOACode, 0, len(u.ByLSOA))
+	for code := range u.ByLSOA {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	f, err := createOutput(filepath.Join(outputDirectory, "unregistered-lsoa.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"lsoa", "name", "msoa", "msoa_name", "residents", "unregistered", "unregistered_percentage"})
+	for _, code := range codes {
+		lsoa := lsoas[code]
+		msoaName := ""
+		if msoa, ok := msoas[lsoa.MSOACode]; ok {
+			msoaName = msoa.Name
+		}
+		row := []string{code.String(), lsoa.Name, lsoa.MSOACode.String(), msoaName}
+		w.Write(append(row, u.ByLSOA[code].ToRow()...))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteAgeCSV writes unregistered-age.csv, with a row for every age band.
+func (u *Unregistered) WriteAgeCSV(outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "unregistered-age.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"age", "residents", "unregistered", "unregistered_percentage"})
+	for i := range u.ByAge {
+		w.Write(append([]string{u.Bands.Label(i)}, u.ByAge[i].ToRow()...))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// The number of practices with the largest absolute error listed for each
+// condition in the validation report
+const ValidationWorstOffenders = 10
+
+// PracticeValidation compares the simulated register size for a condition
+// at a practice with that reported by QOF. The reported register is
+// estimated from the reported prevalence and list size.
+type PracticeValidation struct {
+	Code              GPPracticeCode
+	Name              string
+	ListSize          int
+	SimulatedListSize int
+	Reported          int
+	Simulated         int
+}
+
+func (p *PracticeValidation) Difference() int {
+	return p.Simulated - p.Reported
+}
+
+// PercentageError returns the error as a percentage of the reported
+// register, or NaN if nothing was reported.
+func (p *PracticeValidation) PercentageError() float64 {
+	if p.Reported == 0 {
+		return math.NaN()
+	}
+	return 100.0 * float64(p.Difference()) / float64(p.Reported)
+}
+
+type ConditionValidation struct {
+	Condition QOFCondition
+	Practices []*PracticeValidation
+	RMSE      float64
+	// Mean absolute percentage error, over practices with a non-zero
+	// reported register
+	MAPE float64
+}
+
+// Worst returns the practices with the largest absolute error
+func (c *ConditionValidation) Worst() []*PracticeValidation {
+	worst := make([]*PracticeValidation, len(c.Practices))
+	copy(worst, c.Practices)
+	sort.SliceStable(worst, func(i, j int) bool {
+		return math.Abs(float64(worst[i].Difference())) > math.Abs(float64(worst[j].Difference()))
+	})
+	if len(worst) > ValidationWorstOffenders {
+		worst = worst[0:ValidationWorstOffenders]
+	}
+	return worst
+}
+
+type Validation struct {
+	ListSizeRMSE float64
+	Conditions   []*ConditionValidation
+	// How the prevalence of each condition was obtained, for England and
+	// the scope
+	Coverage []*ConditionCoverage
+}
+
+// validatePrevalence compares simulated condition counts at the selected
+// practices with the registers reported by QOF. Practices without a
+// reported prevalence are skipped, since their prevalence was imputed.
+func validatePrevalence(selected GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition) *Validation {
+	codes := make([]GPPracticeCode, 0, len(selected))
+	for code := range selected {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	v := &Validation{ListSizeRMSE: estimateListSizeError(selected, gps)}
+	log.Printf("validation:")
+	for _, condition := range conditions {
+		c := &ConditionValidation{Condition: condition}
+		squared := 0.0
+		percentages := 0.0
+		n := 0
+		for _, code := range codes {
+			gp := gps[code]
+			reported, ok := gp.ReportedConditionPrevalence[condition]
+			if !ok {
+				continue
+			}
+			p := &PracticeValidation{
+				Code:              code,
+				Name:              gp.Name,
+				ListSize:          gp.ListSize,
+				SimulatedListSize: gp.SimulatedListSize,
+				Reported:          int(math.Round(reported * float64(gp.ListSize))),
+				Simulated:         gp.SimulatedConditionCounts[condition],
+			}
+			c.Practices = append(c.Practices, p)
+			squared += math.Pow(float64(p.Difference()), 2.0)
+			if p.Reported > 0 {
+				percentages += math.Abs(p.PercentageError())
+				n++
+			}
+		}
+		if len(c.Practices) > 0 {
+			c.RMSE = math.Sqrt(squared / float64(len(c.Practices)))
+		}
+		if n > 0 {
+			c.MAPE = percentages / float64(n)
+		}
+		log.Printf("  %s: practices: %d rmse: %f mape: %.02f%%", condition, len(c.Practices), c.RMSE, c.MAPE)
+		v.Conditions = append(v.Conditions, c)
+	}
+	return v
+}
+
+func formatPercentage(p float64) string {
+	if math.IsNaN(p) {
+		return ""
+	}
+	return fmt.Sprintf("%f", p)
+}
+
+func (v *Validation) WriteCSV(outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "validation.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"condition", "code", "name", "list_size", "simulated_list_size", "reported_register", "simulated_register", "error", "percentage_error"})
+	for _, c := range v.Conditions {
+		for _, p := range c.Practices {
+			w.Write([]string{
+				c.Condition.String(),
+				p.Code.String(),
+				p.Name,
+				strconv.Itoa(p.ListSize),
+				strconv.Itoa(p.SimulatedListSize),
+				strconv.Itoa(p.Reported),
+				strconv.Itoa(p.Simulated),
+				strconv.Itoa(p.Difference()),
+				formatPercentage(p.PercentageError()),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var validationTemplate = template.Must(template.New("validation").Funcs(template.FuncMap{
+	"percentage": func(p float64) string {
+		if math.IsNaN(p) {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", p)
+	},
+	"share": func(s float64) float64 {
+		return 100.0 * s
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Validation: simulated vs QOF registered prevalence</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: right; }
+th:first-child, td:first-child, td.name { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Simulated vs QOF registered prevalence</h1>
+<p>List size RMSE: {{printf "%.1f" .ListSizeRMSE}}</p>
+<table>
+<tr><th>Condition</th><th>Practices</th><th>RMSE</th><th>MAPE</th></tr>
+{{range .Conditions}}<tr><td>{{.Condition}}</td><td>{{len .Practices}}</td><td>{{printf "%.1f" .RMSE}}</td><td>{{percentage .MAPE}}</td></tr>
+{{end}}</table>
+{{if .Coverage}}<h2>Prevalence coverage</h2>
+<table>
+<tr><th>Area</th><th>Condition</th><th>Practices</th><th>Usable</th><th>Reported</th><th>Outliers</th><th>Imputed</th><th>Missing</th><th>Unparsed</th></tr>
+{{range .Coverage}}<tr><td>{{.Area}}</td><td class="name">{{.Condition}}</td><td>{{.Practices}}</td><td>{{percentage (share .UsableShare)}}</td><td>{{.Reported}}</td><td>{{.Outliers}}</td><td>{{.Imputed}}</td><td>{{.Missing}}</td><td>{{.Unparsed}}</td></tr>
+{{end}}</table>
+{{end}}{{range .Conditions}}<h2>{{.Condition}}: worst practices</h2>
+<table>
+<tr><th>Code</th><th>Name</th><th>List size</th><th>Simulated list size</th><th>Reported register</th><th>Simulated register</th><th>Error</th><th>Percentage error</th></tr>
+{{range .Worst}}<tr><td>{{.Code}}</td><td class="name">{{.Name}}</td><td>{{.ListSize}}</td><td>{{.SimulatedListSize}}</td><td>{{.Reported}}</td><td>{{.Simulated}}</td><td>{{.Difference}}</td><td>{{percentage .PercentageError}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+func (v *Validation) WriteHTML(outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "validation.html"))
+	if err != nil {
+		return err
+	}
+	if err := validationTemplate.Execute(f, v); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
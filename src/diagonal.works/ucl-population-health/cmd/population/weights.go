@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReweightMargin is a set of external totals to which the weights of
+// people are calibrated
+type ReweightMargin int
+
+const (
+	// The reported list size of each ICB practice
+	ReweightMarginPractices ReweightMargin = iota
+	// The mid-year estimate of the population of each borough whose
+	// LSOAs are all homes
+	ReweightMarginBoroughs
+	// The QOF register of each condition, across the ICB's practices
+	ReweightMarginConditions
+)
+
+func (r ReweightMargin) String() string {
+	switch r {
+	case ReweightMarginPractices:
+		return "practices"
+	case ReweightMarginBoroughs:
+		return "boroughs"
+	case ReweightMarginConditions:
+		return "conditions"
+	}
+	return "invalid"
+}
+
+// ReweightMarginsFromString returns the margins named in s, separated by
+// commas, or none if s is empty.
+func ReweightMarginsFromString(s string) ([]ReweightMargin, error) {
+	margins := make([]ReweightMargin, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for m := ReweightMarginPractices; m <= ReweightMarginConditions; m++ {
+			if m.String() == name {
+				margins = append(margins, m)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown reweighting margin %q, expected practices, boroughs or conditions", name)
+		}
+	}
+	return margins, nil
+}
+
+func hasReweightMargin(margins []ReweightMargin, margin ReweightMargin) bool {
+	for _, m := range margins {
+		if m == margin {
+			return true
+		}
+	}
+	return false
+}
+
+// The bounds on calibrating the weights of people: the maximum number of
+// passes over the controls, and the largest relative change to a weight in
+// a pass at which they're considered converged.
+const (
+	PersonReweightIterations = 200
+	PersonReweightTolerance  = 1e-6
+)
+
+// A ReweightControl is an external total to which the weights of the people
+// in a category are calibrated.
+type ReweightControl struct {
+	Margin   ReweightMargin
+	Category string
+	Target   float64
+	// Indices of the people in the category
+	People   []int
+	Weighted float64
+}
+
+// Reweighting is the result of calibrating the weights of people to
+// controls.
+type Reweighting struct {
+	Controls   []*ReweightControl
+	Iterations int
+	Converged  bool
+	MinWeight  float64
+	MaxWeight  float64
+}
+
+// MaxDifference returns the largest relative difference between the
+// weighted total of a control and its target.
+func (r *Reweighting) MaxDifference() float64 {
+	d := 0.0
+	for _, c := range r.Controls {
+		if c.Target > 0.0 {
+			d = math.Max(d, math.Abs(c.Weighted-c.Target)/c.Target)
+		}
+	}
+	return d
+}
+
+// reweightControls returns the controls of each of margins. The practice
+// and condition controls include everyone registered with an ICB
+// practice, wherever they live, and the borough controls everyone living
+// in boroughs whose LSOAs are all homes, since only their populations are
+// simulated in full.
+func reweightControls(margins []ReweightMargin, people []Person, homes LSOASet, practices GPPracticeCodeSet, gps map[GPPracticeCode]*GPPractice, conditions []QOFCondition, boroughs map[LSOACode]*LocalAuthority, targets *PopulationTargets) []*ReweightControl {
+	codes := make([]GPPracticeCode, 0, len(practices))
+	for code := range practices {
+		if gps[code].ListSize > 0 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	registered := make(map[GPPracticeCode][]int)
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			registered[people[i].GP] = append(registered[people[i].GP], i)
+		}
+	}
+
+	controls := make([]*ReweightControl, 0)
+	for _, margin := range margins {
+		switch margin {
+		case ReweightMarginPractices:
+			for _, code := range codes {
+				controls = append(controls, &ReweightControl{Margin: margin, Category: code.String(), Target: float64(gps[code].ListSize), People: registered[code]})
+			}
+		case ReweightMarginBoroughs:
+			// Keyed by the normalised code, as are the estimates, so that
+			// 2022 districts merged in 2023 are a single control, complete
+			// only if all of them are
+			complete := make(map[string]bool)
+			for lsoa, authority := range boroughs {
+				_, ok := homes[lsoa]
+				code := normaliseLADCode(authority.Code)
+				if c, seen := complete[code]; !seen || c {
+					complete[code] = ok
+				}
+			}
+			byBorough := make(map[string]*ReweightControl)
+			partial := 0
+			for code, c := range complete {
+				if !c {
+					partial++
+					continue
+				}
+				estimates, ok := targets.ByAuthority[code]
+				if !ok {
+					Warningf("  reweight: no estimates for %s in %d, so it isn't a control", code, targets.Year)
+					continue
+				}
+				total := 0.0
+				for _, byAge := range estimates {
+					for _, n := range byAge {
+						total += n
+					}
+				}
+				byBorough[code] = &ReweightControl{Margin: margin, Category: code, Target: total}
+			}
+			if len(byBorough) == 0 && len(complete) > partial {
+				Warningf("  reweight: none of the %d boroughs in the homes match the estimates for %d, so there are no borough controls", len(complete)-partial, targets.Year)
+			}
+			if partial > 0 {
+				Debugf("  reweight: %d boroughs partly outside the homes, so they aren't controls", partial)
+			}
+			for i := range people {
+				if authority, ok := boroughs[people[i].Home]; ok {
+					if c, ok := byBorough[normaliseLADCode(authority.Code)]; ok {
+						c.People = append(c.People, i)
+					}
+				}
+			}
+			ordered := make([]string, 0, len(byBorough))
+			for code := range byBorough {
+				ordered = append(ordered, code)
+			}
+			sort.Strings(ordered)
+			for _, code := range ordered {
+				controls = append(controls, byBorough[code])
+			}
+		case ReweightMarginConditions:
+			for _, condition := range conditions {
+				if !condition.HasRegister() {
+					continue
+				}
+				with := &ReweightControl{Margin: margin, Category: condition.String()}
+				without := &ReweightControl{Margin: margin, Category: "no_" + condition.String()}
+				for _, code := range codes {
+					gp := gps[code]
+					prevalence, ok := gp.ReportedConditionPrevalence[condition]
+					if !ok {
+						continue
+					}
+					with.Target += prevalence * float64(gp.ListSize)
+					without.Target += (1.0 - prevalence) * float64(gp.ListSize)
+					for _, i := range registered[code] {
+						if people[i].Conditions.Contains(condition) {
+							with.People = append(with.People, i)
+						} else {
+							without.People = append(without.People, i)
+						}
+					}
+				}
+				controls = append(controls, with, without)
+			}
+		}
+	}
+	return controls
+}
+
+// reweightPeople calibrates a weight for each person, by raking: the
+// weights of the people in each control are scaled in turn to match its
+// target, starting from 1, until the changes within a pass fall below
+// PersonReweightTolerance. Each person's Weight is set to the result, and
+// people in no control keep a weight of 1. Controls without people can't be
+// met, and are logged.
+func reweightPeople(people []Person, homes LSOASet, controls []*ReweightControl) *Reweighting {
+	r := &Reweighting{Controls: controls}
+	weights := make([]float64, len(people))
+	for i := range weights {
+		weights[i] = 1.0
+	}
+	for _, c := range controls {
+		if len(c.People) == 0 && c.Target > 0.0 {
+			Warningf("  reweight: %s %s: nobody in the control, so its target can't be met", c.Margin, c.Category)
+		}
+	}
+	for r.Iterations < PersonReweightIterations && !r.Converged {
+		r.Iterations++
+		change := 0.0
+		for _, c := range controls {
+			total := 0.0
+			for _, i := range c.People {
+				total += weights[i]
+			}
+			if total > 0.0 {
+				factor := c.Target / total
+				change = math.Max(change, math.Abs(factor-1.0))
+				for _, i := range c.People {
+					weights[i] *= factor
+				}
+			}
+		}
+		r.Converged = change < PersonReweightTolerance
+	}
+
+	r.MinWeight, r.MaxWeight = math.Inf(1), math.Inf(-1)
+	for i := range people {
+		if _, ok := homes[people[i].Home]; ok {
+			people[i].Weight = float32(weights[i])
+			r.MinWeight = math.Min(r.MinWeight, weights[i])
+			r.MaxWeight = math.Max(r.MaxWeight, weights[i])
+		}
+	}
+	for _, c := range controls {
+		c.Weighted = 0.0
+		for _, i := range c.People {
+			c.Weighted += weights[i]
+		}
+	}
+	log.Printf("  controls: %d", len(controls))
+	log.Printf("  iterations: %d", r.Iterations)
+	log.Printf("  weights: %f to %f", r.MinWeight, r.MaxWeight)
+	if !r.Converged {
+		Warningf("  reweight: didn't converge after %d iterations, with weighted totals up to %.4f%% from their targets, as the controls may conflict", r.Iterations, 100.0*r.MaxDifference())
+	}
+	return r
+}
+
+// writeReweightControls writes reweight-controls.csv, with the target,
+// unweighted and weighted totals of each control.
+func writeReweightControls(r *Reweighting, outputDirectory string) error {
+	f, err := createOutput(filepath.Join(outputDirectory, "reweight-controls.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"margin", "category", "target", "unweighted", "weighted"})
+	for _, c := range r.Controls {
+		w.Write([]string{c.Margin.String(), c.Category, fmt.Sprintf("%f", c.Target), strconv.Itoa(len(c.People)), fmt.Sprintf("%f", c.Weighted)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReweightMarginsFromString(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []ReweightMargin
+		valid    bool
+	}{
+		{"", []ReweightMargin{}, true},
+		{"practices, conditions", []ReweightMargin{ReweightMarginPractices, ReweightMarginConditions}, true},
+		{"boroughs", []ReweightMargin{ReweightMarginBoroughs}, true},
+		{"lsoas", nil, false},
+	}
+	for _, test := range tests {
+		margins, err := ReweightMarginsFromString(test.s)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%q: expected no error, found %s", test.s, err)
+			} else if !reflect.DeepEqual(margins, test.expected) {
+				t.Errorf("%q: expected %v, found %v", test.s, test.expected, margins)
+			}
+		} else if err == nil {
+			t.Errorf("%q: expected an error", test.s)
+		}
+	}
+}
+
+func TestReweightControlsBoroughsJoinMergedDistricts(t *testing.T) {
+	// Allerdale and Copeland were merged into Cumberland in 2023, so
+	// the estimates are for Cumberland, while the lookup gives the 2022
+	// districts
+	boroughs := map[LSOACode]*LocalAuthority{
+		"E01000001": {Code: "E07000026", Name: "Allerdale"},
+		"E01000002": {Code: "E07000029", Name: "Copeland"},
+		"E01000003": {Code: "E09000001", Name: "City of London"},
+	}
+	targets := &PopulationTargets{Year: 2023, ByAuthority: map[string]*[Female + 1][]float64{
+		"E06000063": {{10.0, 20.0}, {30.0, 40.0}},
+		"E09000001": {{1.0}, {2.0}},
+	}}
+	people := []Person{{Home: "E01000001"}, {Home: "E01000002"}, {Home: "E01000002"}, {Home: "E01000003"}}
+	tests := []struct {
+		name     string
+		homes    LSOASet
+		expected map[string][]int
+	}{
+		{
+			name:     "complete",
+			homes:    LSOASet{"E01000001": struct{}{}, "E01000002": struct{}{}, "E01000003": struct{}{}},
+			expected: map[string][]int{"E06000063": {0, 1, 2}, "E09000001": {3}},
+		},
+		{
+			// Cumberland isn't a control, since Copeland is outside the
+			// homes
+			name:     "partial",
+			homes:    LSOASet{"E01000001": struct{}{}, "E01000003": struct{}{}},
+			expected: map[string][]int{"E09000001": {3}},
+		},
+	}
+	for _, test := range tests {
+		controls := reweightControls([]ReweightMargin{ReweightMarginBoroughs}, people, test.homes, GPPracticeCodeSet{}, nil, nil, boroughs, targets)
+		found := make(map[string][]int)
+		for _, c := range controls {
+			found[c.Category] = c.People
+			if c.Category == "E06000063" && c.Target != 100.0 {
+				t.Errorf("%s: expected a target of 100 for Cumberland, found %f", test.name, c.Target)
+			}
+		}
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: expected %v, found %v", test.name, test.expected, found)
+		}
+	}
+}
+
+func TestReweightPeopleMatchesPracticesAndConditions(t *testing.T) {
+	var hypertensive QOFConditions
+	hypertensive.Add(QOFConditionHypertension)
+	homes := LSOASet{"E01000001": struct{}{}}
+	people := []Person{
+		{Home: "E01000001", GP: "G1", Conditions: hypertensive},
+		{Home: "E01000001", GP: "G1"},
+		{Home: "E01000001", GP: "G1"},
+		{Home: "E01000001", GP: "G2", Conditions: hypertensive},
+		{Home: "E01000001", GP: "G2"},
+		// Outside homes, so keeps its weight
+		{Home: "E01000002", GP: "G1", Weight: 1.0},
+	}
+	gps := map[GPPracticeCode]*GPPractice{
+		"G1": {Code: "G1", ListSize: 600, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionHypertension: 0.5}},
+		"G2": {Code: "G2", ListSize: 400, ReportedConditionPrevalence: map[QOFCondition]float64{QOFConditionHypertension: 0.25}},
+	}
+	practices := GPPracticeCodeSet{"G1": struct{}{}, "G2": struct{}{}}
+	margins := []ReweightMargin{ReweightMarginPractices, ReweightMarginConditions}
+	controls := reweightControls(margins, people, homes, practices, gps, []QOFCondition{QOFConditionHypertension}, nil, nil)
+	if len(controls) != 4 {
+		t.Fatalf("expected 4 controls, found %d", len(controls))
+	}
+	r := reweightPeople(people, homes, controls)
+	if !r.Converged {
+		t.Fatalf("expected reweighting to converge")
+	}
+	for _, c := range r.Controls {
+		if math.Abs(c.Weighted-c.Target) > 1e-3 {
+			t.Errorf("%s %s: expected a weighted total of %f, found %f", c.Margin, c.Category, c.Target, c.Weighted)
+		}
+	}
+	// 400 of the 1000 patients have hypertension
+	if c := r.Controls[2]; c.Category != "hyp" || c.Target != 400.0 {
+		t.Errorf("expected a target of 400 for hyp, found %s %f", c.Category, c.Target)
+	}
+	if people[5].Weight != 1.0 {
+		t.Errorf("expected the weight of people outside homes to be unchanged, found %f", people[5].Weight)
+	}
+}
@@ -2,11 +2,15 @@ module diagonal.works/ucl-population-health
 
 go 1.20
 
-require diagonal.works/b6 v0.0.4
+require (
+	diagonal.works/b6 v0.0.4
+	github.com/golang/geo v0.0.0-20190916061304-5b978397cfec
+	github.com/mattn/go-sqlite3 v1.14.17
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/apache/beam v2.32.0+incompatible // indirect
-	github.com/golang/geo v0.0.0-20190916061304-5b978397cfec // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/lukeroth/gdal v0.0.0-20220614134811-3c605a05e283 // indirect
@@ -19,7 +23,6 @@ require (
 	google.golang.org/genproto v0.0.0-20230403163135-c38d8f061ccd // indirect
 	google.golang.org/grpc v1.54.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 replace diagonal.works/b6 v0.0.4 => ../../../deps/diagonal-b6/src/diagonal.works/b6